@@ -0,0 +1,550 @@
+// Command ctl runs maintenance tasks directly against the database, for
+// incidents where the API is unhealthy and for tasks with no endpoint. It
+// reads the same environment as the server.
+//
+//	ctl <command> [args] [--yes]
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/backup"
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/handlers"
+	"github.com/freetorrent/freetorrent/internal/jobs"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/uploads"
+	"github.com/joho/godotenv"
+)
+
+// app is what commands run against
+type app struct {
+	cfg  *config.Config
+	db   *database.Database
+	auth *auth.AuthService
+}
+
+type command struct {
+	args        string // usage of the positional arguments
+	nargs       int
+	help        string
+	destructive bool // refused without --yes
+	run         func(ctx context.Context, a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"create-admin": {
+		args:  "<email>",
+		nargs: 1,
+		help:  "create an admin, or promote an existing user; the password is read from stdin or generated",
+		run:   createAdmin,
+	},
+	"reset-password": {
+		args:        "<email>",
+		nargs:       1,
+		help:        "set a user's password from stdin, or a generated one, and sign them out everywhere",
+		destructive: true,
+		run:         resetPassword,
+	},
+	"disable-2fa": {
+		args:        "<email>",
+		nargs:       1,
+		help:        "turn off a user's two-factor sign-in, for one who lost their authenticator",
+		destructive: true,
+		run:         disable2FA,
+	},
+	"list-users": {
+		help: "list users with their role and plan",
+		run:  listUsers,
+	},
+	"set-plan": {
+		args:        "<email> <plan>",
+		nargs:       2,
+		help:        "move a user to a plan, applying its limits and retention",
+		destructive: true,
+		run:         setPlan,
+	},
+	"purge-expired": {
+		help:        "delete expired torrents and their data, expired idempotency keys, stale churn counters and abandoned uploads",
+		destructive: true,
+		run:         purgeExpired,
+	},
+	"recalc-usage": {
+		args:  "<email>",
+		nargs: 1,
+		help:  "log pending upload usage and print a user's usage this period",
+		run:   recalcUsage,
+	},
+	"backup": {
+		args:  "<file>",
+		nargs: 1,
+		help:  "write users, plans, subscriptions and torrent records (not downloaded data) to a tar file",
+		run:   backupTo,
+	},
+	"restore": {
+		args:        "<file>",
+		nargs:       1,
+		help:        "import a backup into a fresh database; torrents whose data isn't on disk need redownloading",
+		destructive: true,
+		run:         restoreFrom,
+	},
+	"migrate": {
+		help: "run database migrations",
+		run: func(ctx context.Context, a *app, args []string) error {
+			if err := a.db.Migrate(ctx); err != nil {
+				return err
+			}
+			fmt.Println("Database migrations completed")
+			return nil
+		},
+	},
+}
+
+func main() {
+	// Load .env file if present
+	godotenv.Load()
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	args, yes := parseArgs(os.Args[2:])
+	if len(args) != cmd.nargs {
+		fmt.Fprintf(os.Stderr, "usage: ctl %s %s\n", name, cmd.args)
+		os.Exit(2)
+	}
+	if cmd.destructive && !yes {
+		fmt.Fprintf(os.Stderr, "%s changes data; re-run with --yes to confirm\n", name)
+		os.Exit(2)
+	}
+
+	cfg := config.Load()
+	db, err := database.New(cfg.DatabaseURL, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to database: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = cmd.run(ctx, &app{cfg: cfg, db: db, auth: auth.NewAuthService(cfg)}, args)
+	stop()
+	db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: ctl <command> [args] [--yes]")
+	fmt.Fprintln(os.Stderr)
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, cmd.args, cmd.help)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands that change data require --yes.")
+}
+
+// parseArgs splits --yes (or -y) out of args, wherever it appears
+func parseArgs(args []string) ([]string, bool) {
+	var rest []string
+	yes := false
+	for _, arg := range args {
+		switch arg {
+		case "--yes", "-yes", "-y":
+			yes = true
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest, yes
+}
+
+// userByEmail loads a user, failing if there is none
+func (a *app) userByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := a.db.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("no user with email %s", email)
+	}
+	return user, nil
+}
+
+// readPassword reads a password from the first line of stdin when it is
+// piped, else generates one and prints it
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no password on stdin")
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if err := auth.ValidatePassword(password); err != nil {
+			return "", err
+		}
+		return password, nil
+	}
+
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(bytes)
+	fmt.Printf("Generated password: %s\n", password)
+	return password, nil
+}
+
+func createAdmin(ctx context.Context, a *app, args []string) error {
+	email := strings.TrimSpace(args[0])
+	user, err := a.db.GetUserByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		hash, err := a.auth.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		if user, err = a.db.CreateUser(ctx, email, hash); err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+	} else if user.Role == "admin" {
+		fmt.Printf("%s is already an admin\n", email)
+		return nil
+	}
+
+	if err := a.db.UpdateUserRole(ctx, user.ID, "admin"); err != nil {
+		return fmt.Errorf("failed to set admin role: %w", err)
+	}
+	fmt.Printf("%s is now an admin\n", email)
+	return nil
+}
+
+func resetPassword(ctx context.Context, a *app, args []string) error {
+	user, err := a.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := a.auth.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	if err := a.db.UpdateUserPassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+	if err := a.db.DeleteUserRefreshTokens(ctx, user.ID); err != nil {
+		return fmt.Errorf("password reset, but failed to revoke sessions: %w", err)
+	}
+	fmt.Printf("Password reset for %s; existing sessions revoked\n", user.Email)
+	return nil
+}
+
+func disable2FA(ctx context.Context, a *app, args []string) error {
+	user, err := a.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !user.TwoFactorEnabled {
+		fmt.Printf("Two-factor sign-in is not enabled for %s\n", user.Email)
+		return nil
+	}
+	if err := a.db.DisableTOTP(ctx, user.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Two-factor sign-in disabled for %s\n", user.Email)
+	return nil
+}
+
+func listUsers(ctx context.Context, a *app, args []string) error {
+	const pageSize = 100
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tROLE\tPLAN\tCREATED\tID")
+	for offset := 0; ; offset += pageSize {
+		users, total, err := a.db.GetAllUsers(ctx, pageSize, offset)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			plan := "-"
+			if sub, err := a.db.GetSubscription(ctx, u.ID); err == nil && sub != nil {
+				plan = sub.Plan
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Email, u.Role, plan, u.CreatedAt.Format("2006-01-02"), u.ID)
+		}
+		if len(users) == 0 || offset+len(users) >= total {
+			break
+		}
+	}
+	return w.Flush()
+}
+
+func setPlan(ctx context.Context, a *app, args []string) error {
+	user, err := a.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	plan := args[1]
+	if _, ok := a.db.GetPlanLimits(ctx, plan); !ok {
+		return fmt.Errorf("unknown plan %q", plan)
+	}
+	actor := models.SubscriptionActor{Type: models.SubscriptionActorAdmin, Reason: "set with ctl"}
+	if err := handlers.ApplySubscription(ctx, a.db, user.ID, plan, "active", actor); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now on the %s plan\n", user.Email, plan)
+	return nil
+}
+
+// removeUnusedData removes a deleted torrent's data unless another user's
+// torrent shares it
+func removeUnusedData(ctx context.Context, a *app, t *models.Torrent) error {
+	if t.InfoHash == "" {
+		return nil
+	}
+	inUse, err := a.db.InfoHashInUse(ctx, t.InfoHash)
+	if err != nil {
+		return err
+	}
+	if !inUse {
+		if err := os.RemoveAll(torrent.DataDir(a.cfg.DownloadDir, t.InfoHash)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove data of %s: %v\n", t.ID, err)
+		}
+	}
+	return nil
+}
+
+// purgeExpired does the server's hourly cleanup. A running server keeps
+// seeding torrents it had loaded until it restarts, so prefer this when the
+// server is down.
+func purgeExpired(ctx context.Context, a *app, args []string) error {
+	expired, err := a.db.GetExpiredTorrents(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range expired {
+		if err := a.db.LogTorrentExpired(ctx, &t); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to log expiry of %s: %v\n", t.ID, err)
+		}
+		if err := a.db.ExpireDownloadTokens(ctx, t.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to expire download tokens of %s: %v\n", t.ID, err)
+		}
+		if err := a.db.DeleteTorrent(ctx, t.ID, models.ClosedExpired); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", t.ID, err)
+		}
+
+		if err := removeUnusedData(ctx, a, &t); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Purged %d expired torrents\n", len(expired))
+
+	days, _, err := jobs.FailedRetentionDays(ctx, a.db, a.cfg.FailedRetentionDays)
+	if err != nil {
+		return err
+	}
+	failed, err := a.db.GetFailedTorrentsBefore(ctx, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	for _, t := range failed {
+		if err := a.db.DeleteTorrent(ctx, t.ID, models.ClosedAutoDeleted); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", t.ID, err)
+		}
+		if err := removeUnusedData(ctx, a, &t); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Purged %d failed or cancelled torrents older than %d days\n", len(failed), days)
+
+	keys, err := a.db.DeleteExpiredIdempotencyKeys(ctx)
+	if err != nil {
+		return err
+	}
+	churn, err := a.db.DeleteStaleChurn(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d idempotency keys and %d churn counters\n", keys, churn)
+
+	uploadStore, err := uploads.NewStore(a.db, a.cfg.UploadDir)
+	if err != nil {
+		return err
+	}
+	n, err := uploadStore.SweepExpired(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d abandoned uploads\n", n)
+	return nil
+}
+
+// recalcUsage brings upload accounting up to date, then prints the usage
+// the API would report. The rest of usage is summed from usage logs on every
+// read, so there is nothing else to recalculate.
+func recalcUsage(ctx context.Context, a *app, args []string) error {
+	user, err := a.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := a.db.LogUploadUsage(ctx); err != nil {
+		return fmt.Errorf("failed to log upload usage: %w", err)
+	}
+
+	period, err := a.db.GetUsagePeriod(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	downloaded, err := a.db.GetMonthlyUsage(ctx, user.ID, period)
+	if err != nil {
+		return err
+	}
+	served, err := a.db.GetMonthlyServed(ctx, user.ID, period)
+	if err != nil {
+		return err
+	}
+	uploaded, err := a.db.GetMonthlyUpload(ctx, user.ID, period)
+	if err != nil {
+		return err
+	}
+	storage, err := a.db.GetStorageUsage(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	active, err := a.db.CountActiveTorrents(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	loc := models.UserLocation(user.Timezone)
+	fmt.Fprintf(w, "Usage period\t%s to %s\n", period.Start.In(loc).Format(time.RFC3339), period.End.In(loc).Format(time.RFC3339))
+	fmt.Fprintf(w, "Downloaded\t%s\n", models.HumanBytes(downloaded))
+	fmt.Fprintf(w, "Served\t%s\n", models.HumanBytes(served))
+	fmt.Fprintf(w, "Uploaded\t%s\n", models.HumanBytes(uploaded))
+	fmt.Fprintf(w, "Storage used\t%s\n", models.HumanBytes(storage.Used))
+	fmt.Fprintf(w, "Storage pending\t%s\n", models.HumanBytes(storage.Pending))
+	fmt.Fprintf(w, "Active torrents\t%d\n", active)
+	return w.Flush()
+}
+
+// backupTo writes a backup, as POST /admin/backup does, to a file
+func backupTo(ctx context.Context, a *app, args []string) error {
+	snap, err := backup.Export(ctx, a.db)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := snap.WriteTar(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	for _, t := range snap.Manifest.Tables {
+		fmt.Printf("%-14s %d rows\n", t.Name, t.Rows)
+	}
+	fmt.Printf("Backup written to %s\n", args[0])
+	return nil
+}
+
+// restoreFrom migrates the database, imports a backup into it, and marks
+// completed torrents whose files aren't under DOWNLOAD_DIR as needing a
+// redownload, which their owners start by retrying them. Torrents still
+// downloading resume when the server starts.
+func restoreFrom(ctx context.Context, a *app, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := a.db.Migrate(ctx); err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	manifest, err := backup.Restore(ctx, a.db, f)
+	if err != nil {
+		return err
+	}
+	for _, t := range manifest.Tables {
+		fmt.Printf("%-14s %d rows\n", t.Name, t.Rows)
+	}
+
+	torrents, err := a.db.GetTorrentsForReconciliation(ctx)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, t := range torrents {
+		if !t.Status.IsComplete() {
+			continue
+		}
+		onDisk := torrent.FilesOnDisk(a.cfg.DownloadDir, t.InfoHash, t.Files)
+		if len(t.Files) == 0 {
+			_, err := os.Stat(torrent.DataDir(a.cfg.DownloadDir, t.InfoHash))
+			onDisk = err == nil
+		}
+		if onDisk {
+			continue
+		}
+		if err := a.db.SetTorrentNeedsRedownload(ctx, t.ID,
+			"data was not restored with the backup; retry to download it again"); err != nil {
+			return fmt.Errorf("failed to mark %s: %w", t.ID, err)
+		}
+		missing++
+	}
+	fmt.Printf("Restored backup of %s; %d completed torrents need redownloading\n",
+		manifest.CreatedAt.Format(time.RFC3339), missing)
+	return nil
+}
@@ -0,0 +1,60 @@
+// Command engine runs the torrent engine on its own, serving it over gRPC
+// to API servers started with ENGINE_MODE=remote. It reads the same
+// environment as the server; DOWNLOAD_DIR must be shared with the API,
+// which serves files and zips from it.
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/torrent/remote"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	godotenv.Load()
+	cfg := config.Load()
+
+	if cfg.EngineToken == "" {
+		log.Fatal("ENGINE_TOKEN is required")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A client that fails to start is restarted by the API's watchdog, so
+	// the worker serves regardless
+	engine, err := torrent.NewEngine(ctx, cfg)
+	if err != nil {
+		log.Printf("Torrent engine unavailable, serving without it: %v", err)
+	}
+	defer engine.Close()
+
+	lis, err := net.Listen("tcp", cfg.EngineListen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.EngineListen, err)
+	}
+	srv := remote.NewServer(engine, cfg.EngineToken)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		log.Println("Shutting down engine...")
+		// Update subscriptions never end on their own, so streams are cut
+		// rather than drained
+		srv.Stop()
+	}()
+
+	log.Printf("Torrent engine serving on %s", cfg.EngineListen)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("Engine server error: %v", err)
+	}
+}
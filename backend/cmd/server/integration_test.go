@@ -0,0 +1,546 @@
+//go:build integration
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/jobs"
+	"github.com/freetorrent/freetorrent/internal/mail"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/notify"
+	"github.com/freetorrent/freetorrent/internal/reporting"
+	"github.com/freetorrent/freetorrent/internal/server"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/torrent/torrenttest"
+	"github.com/freetorrent/freetorrent/internal/uploads"
+	"github.com/google/uuid"
+)
+
+// lifecycleTimeout bounds each wait on the local swarm
+const lifecycleTimeout = time.Minute
+
+var fixtureSizes = map[string]int{
+	"a.bin":     300 << 10,
+	"dir/b.bin": 200 << 10,
+}
+
+// testServer is the API and update processor over one engine, as the
+// server runs them
+type testServer struct {
+	app       *server.App
+	db        *torrenttest.Database
+	engine    *torrenttest.Engine
+	hooks     *recordingHooks
+	uploads   *uploads.Store
+	completer *jobs.Completer
+	reporter  reporting.Reporter
+	stop      context.CancelFunc
+	userToken string
+}
+
+// startServer builds the API on engine and db and starts feeding the
+// engine's updates to the database
+func startServer(t *testing.T, db *torrenttest.Database, engine *torrenttest.Engine) *testServer {
+	t.Helper()
+	cfg := engine.Config
+	cfg.UploadDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	reporter := reporting.New("", "test")
+	broker := events.NewBroker()
+	notifier := notify.New(db.Database, broker, mail.New(mail.Config{}))
+	lifecycle := &recordingHooks{}
+	uploadStore, err := uploads.NewStore(db.Database, cfg.UploadDir)
+	if err != nil {
+		t.Fatalf("upload store: %v", err)
+	}
+	completer := jobs.NewCompleter(db.Database, engine, cfg, reporter, broker, notifier, lifecycle)
+	go processTorrentUpdates(ctx, db.Database, engine, completer, broker, reporter)
+
+	app := server.New(cfg, server.Services{
+		DB:        db.Database,
+		Engine:    engine,
+		Auth:      auth.NewAuthService(cfg),
+		Broker:    broker,
+		Notifier:  notifier,
+		Hooks:     lifecycle,
+		Uploads:   uploadStore,
+		Completer: completer,
+		Reporter:  reporter,
+	})
+	return &testServer{app: app, db: db, engine: engine, hooks: lifecycle, uploads: uploadStore, completer: completer, reporter: reporter, stop: cancel}
+}
+
+// recordingHooks records the lifecycle hooks called, as event names with
+// the torrent's ID or the deletion reason
+type recordingHooks struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (h *recordingHooks) record(call string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, call)
+}
+
+func (h *recordingHooks) OnTorrentAdded(t *models.Torrent) {
+	h.record("added " + t.ID.String())
+}
+
+func (h *recordingHooks) OnTorrentCompleted(t *models.Torrent, files []hooks.File) {
+	h.record(fmt.Sprintf("completed %s with %d files", t.ID, len(files)))
+}
+
+func (h *recordingHooks) OnTorrentDeleted(t *models.Torrent, reason string) {
+	h.record("deleted " + t.ID.String() + " " + reason)
+}
+
+func (h *recordingHooks) OnUserRegistered(u *models.User) {
+	h.record("registered")
+}
+
+func (h *recordingHooks) Calls() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+// do sends a request as the signed-in user, if any, and decodes a JSON
+// answer into out when it isn't nil
+func (s *testServer) do(t *testing.T, req *http.Request, wantStatus int, out any) []byte {
+	t.Helper()
+	if s.userToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.userToken)
+	}
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", req.Method, req.URL.Path, err)
+	}
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("%s %s: status %d, want %d: %s", req.Method, req.URL.Path, resp.StatusCode, wantStatus, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", req.Method, req.URL.Path, body, err)
+		}
+	}
+	return body
+}
+
+func (s *testServer) doJSON(t *testing.T, method, path string, in any, wantStatus int, out any) []byte {
+	t.Helper()
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, body)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return s.do(t, req, wantStatus, out)
+}
+
+// register signs up a fresh user and sends later requests as them
+func (s *testServer) register(t *testing.T) {
+	t.Helper()
+	var resp models.AuthResponse
+	s.doJSON(t, http.MethodPost, "/api/v1/auth/register", models.RegisterRequest{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "integration-Test-1",
+	}, http.StatusCreated, &resp)
+	s.userToken = resp.AccessToken
+}
+
+func (s *testServer) getTorrent(t *testing.T, id uuid.UUID) models.Torrent {
+	t.Helper()
+	var tr models.Torrent
+	s.doJSON(t, http.MethodGet, "/api/v1/torrents/"+id.String(), nil, http.StatusOK, &tr)
+	return tr
+}
+
+// waitForTorrent polls the torrent until cond holds of it
+func (s *testServer) waitForTorrent(t *testing.T, id uuid.UUID, cond func(models.Torrent) bool) models.Torrent {
+	t.Helper()
+	var tr models.Torrent
+	torrenttest.Eventually(t, lifecycleTimeout, func() bool {
+		tr = s.getTorrent(t, id)
+		return cond(tr)
+	})
+	return tr
+}
+
+// TestTorrentLifecycle adds a magnet and follows it through metadata,
+// download and completion to a zip served by download token, until it
+// expires
+func TestTorrentLifecycle(t *testing.T) {
+	tracker := torrenttest.NewTracker(t)
+	fixture := torrenttest.NewFixture(t, "lifecycle", fixtureSizes, tracker.URL)
+	torrenttest.NewSeeder(t, fixture)
+	db := torrenttest.NewDatabase(t)
+	engine := torrenttest.NewEngine(t, nil)
+	s := startServer(t, db, engine)
+	s.register(t)
+
+	var added models.Torrent
+	s.doJSON(t, http.MethodPost, "/api/v1/torrents", models.AddTorrentRequest{MagnetURI: fixture.Magnet()},
+		http.StatusCreated, &added)
+	if added.InfoHash != fixture.InfoHash() {
+		t.Fatalf("added info hash %s, want %s", added.InfoHash, fixture.InfoHash())
+	}
+
+	// Metadata, from the seeder
+	tr := s.waitForTorrent(t, added.ID, func(tr models.Torrent) bool {
+		return tr.Name == fixture.Name && tr.TotalSize > 0
+	})
+	if want := int64(300<<10 + 200<<10); tr.TotalSize != want {
+		t.Errorf("total size %d, want %d", tr.TotalSize, want)
+	}
+
+	// Download and completion, with a zip of the two files
+	tr = s.waitForTorrent(t, added.ID, func(tr models.Torrent) bool {
+		return tr.Status == models.TorrentStatusCompleted && tr.ZipPath != nil
+	})
+	if tr.Progress != 100 || tr.ExpiresAt == nil {
+		t.Errorf("completed torrent has progress %v and expiry %v", tr.Progress, tr.ExpiresAt)
+	}
+	fixture.Verify(t, torrent.DataDir(engine.Config.DownloadDir, fixture.InfoHash()))
+
+	// The zip, by download token
+	var token struct {
+		Token       string `json:"token"`
+		DownloadURL string `json:"download_url"`
+		IsZip       bool   `json:"is_zip"`
+	}
+	s.doJSON(t, http.MethodPost, "/api/v1/torrents/"+added.ID.String()+"/token",
+		map[string]any{"use_zip": true}, http.StatusOK, &token)
+	if !token.IsZip {
+		t.Fatalf("token is not for the zip")
+	}
+	archive := s.doJSON(t, http.MethodGet, token.DownloadURL, nil, http.StatusOK, nil)
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	got := map[string]int{}
+	for _, f := range zr.File {
+		got[strings.TrimPrefix(f.Name, fixture.Name+"/")] = int(f.UncompressedSize64)
+	}
+	for path, size := range fixtureSizes {
+		if got[path] != size {
+			t.Errorf("zip has %s at %d bytes, want %d", path, got[path], size)
+		}
+	}
+
+	// Expiry removes the torrent and its links
+	db.Exec(t, `UPDATE torrents SET expires_at = NOW() - INTERVAL '1 minute' WHERE id = $1`, added.ID)
+	cleanupExpired(context.Background(), db.Database, engine, s.completer, s.uploads, s.hooks, s.reporter)
+	s.doJSON(t, http.MethodGet, "/api/v1/torrents/"+added.ID.String(), nil, http.StatusNotFound, nil)
+	req := httptest.NewRequest(http.MethodGet, token.DownloadURL, nil)
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("download token still works after expiry")
+	}
+	if _, err := engine.GetTorrentStatus(fixture.InfoHash()); err == nil {
+		t.Errorf("engine still has the expired torrent")
+	}
+
+	// Each step told the hooks, once
+	want := []string{
+		"registered",
+		"added " + added.ID.String(),
+		fmt.Sprintf("completed %s with %d files", added.ID, len(fixtureSizes)),
+		"deleted " + added.ID.String() + " " + hooks.DeleteReasonExpired,
+	}
+	if got := s.hooks.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hook calls %q, want %q", got, want)
+	}
+}
+
+// TestPauseResumeReload pauses a torrent before it has a peer, restarts
+// the server, which reloads it paused, and resumes it to completion
+func TestPauseResumeReload(t *testing.T) {
+	tracker := torrenttest.NewTracker(t)
+	fixture := torrenttest.NewFixture(t, "paused", fixtureSizes, tracker.URL)
+	db := torrenttest.NewDatabase(t)
+	engine := torrenttest.NewEngine(t, nil)
+	s := startServer(t, db, engine)
+	s.register(t)
+
+	// The .torrent, so metadata needs no peer
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "paused.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(fixture.TorrentFile())
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/torrents/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	var added models.Torrent
+	s.do(t, req, http.StatusCreated, &added)
+	id := added.ID.String()
+
+	s.doJSON(t, http.MethodPost, "/api/v1/torrents/"+id+"/pause", nil, http.StatusOK, nil)
+	if tr := s.getTorrent(t, added.ID); tr.Status != models.TorrentStatusPaused {
+		t.Fatalf("status after pause %s, want paused", tr.Status)
+	}
+
+	// A server restart: a fresh engine on the same data, reloading what
+	// the database has
+	s.stop()
+	engine = engine.Reopen(t)
+	userToken := s.userToken
+	s = startServer(t, db, engine)
+	s.userToken = userToken
+	reloadActiveTorrents(context.Background(), db.Database, engine, false)
+	if _, err := engine.GetTorrentStatus(fixture.InfoHash()); err != nil {
+		t.Fatalf("torrent not reloaded: %v", err)
+	}
+	if tr := s.getTorrent(t, added.ID); tr.Status != models.TorrentStatusPaused {
+		t.Fatalf("status after reload %s, want paused", tr.Status)
+	}
+
+	// A peer turns up, and the resumed torrent completes
+	torrenttest.NewSeeder(t, fixture)
+	s.doJSON(t, http.MethodPost, "/api/v1/torrents/"+id+"/resume", nil, http.StatusOK, nil)
+	s.waitForTorrent(t, added.ID, func(tr models.Torrent) bool {
+		return tr.Status == models.TorrentStatusCompleted
+	})
+	fixture.Verify(t, torrent.DataDir(engine.Config.DownloadDir, fixture.InfoHash()))
+}
+
+// addResult is one add's answer
+type addResult struct {
+	status int
+	id     uuid.UUID
+}
+
+// addConcurrently sends adds of magnet at once, one as the user signed in
+// with each of tokens
+func (s *testServer) addConcurrently(t *testing.T, magnet string, tokens ...string) []addResult {
+	t.Helper()
+	body, err := json.Marshal(models.AddTorrentRequest{MagnetURI: magnet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]addResult, len(tokens))
+	errs := make([]error, len(tokens))
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/torrents", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tokens[i])
+			resp, err := s.app.Test(req, -1)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			var tr models.Torrent
+			json.NewDecoder(resp.Body).Decode(&tr)
+			results[i] = addResult{resp.StatusCode, tr.ID}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	return results
+}
+
+// TestConcurrentAddsOfOneMagnet adds the same magnet several times at once
+// as one user: one add creates the torrent and the rest get its row
+func TestConcurrentAddsOfOneMagnet(t *testing.T) {
+	tracker := torrenttest.NewTracker(t)
+	fixture := torrenttest.NewFixture(t, "racing", fixtureSizes, tracker.URL)
+	db := torrenttest.NewDatabase(t)
+	engine := torrenttest.NewEngine(t, nil)
+	s := startServer(t, db, engine)
+	s.register(t)
+
+	token := s.userToken
+	results := s.addConcurrently(t, fixture.Magnet(), token, token, token, token, token)
+	created := 0
+	for _, r := range results {
+		switch {
+		case r.status == http.StatusCreated:
+			created++
+		case r.status != http.StatusOK:
+			t.Errorf("add answered %d, want 201 or 200", r.status)
+		}
+		if r.id != results[0].id {
+			t.Errorf("adds answered torrents %s and %s", results[0].id, r.id)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d adds created the torrent, want 1", created)
+	}
+
+	rows, err := db.GetTorrentsByInfoHash(context.Background(), fixture.InfoHash())
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("rows for the info hash: %d, %v; want 1", len(rows), err)
+	}
+	status, err := engine.GetTorrentStatus(fixture.InfoHash())
+	if err != nil || status.ID != rows[0].ID {
+		t.Errorf("engine holds %v, %v; want the torrent %s", status, err, rows[0].ID)
+	}
+}
+
+// TestTwoUsersAddOneMagnet adds the same magnet as two users at once: each
+// gets a torrent of their own, over one engine torrent
+func TestTwoUsersAddOneMagnet(t *testing.T) {
+	tracker := torrenttest.NewTracker(t)
+	fixture := torrenttest.NewFixture(t, "shared", fixtureSizes, tracker.URL)
+	db := torrenttest.NewDatabase(t)
+	engine := torrenttest.NewEngine(t, nil)
+	s := startServer(t, db, engine)
+	s.register(t)
+	first := s.userToken
+	s.register(t)
+	second := s.userToken
+
+	results := s.addConcurrently(t, fixture.Magnet(), first, second, first, second)
+	firstResults := []addResult{results[0], results[2]}
+	secondResults := []addResult{results[1], results[3]}
+
+	ids := map[uuid.UUID]bool{}
+	for _, results := range [][]addResult{firstResults, secondResults} {
+		for _, r := range results {
+			if r.status != http.StatusCreated && r.status != http.StatusOK {
+				t.Errorf("add answered %d, want 201 or 200", r.status)
+			}
+			if r.id != results[0].id {
+				t.Errorf("one user's adds answered torrents %s and %s", results[0].id, r.id)
+			}
+		}
+		ids[results[0].id] = true
+	}
+	if len(ids) != 2 {
+		t.Fatalf("the users got torrents %v, want one each", ids)
+	}
+
+	rows, err := db.GetTorrentsByInfoHash(context.Background(), fixture.InfoHash())
+	if err != nil || len(rows) != 2 || rows[0].UserID == rows[1].UserID {
+		t.Fatalf("rows for the info hash: %+v, %v; want one per user", rows, err)
+	}
+	for _, row := range rows {
+		if !ids[row.ID] {
+			t.Errorf("row %s answered to neither user", row.ID)
+		}
+	}
+	if _, err := engine.GetTorrentStatus(fixture.InfoHash()); err != nil {
+		t.Errorf("engine doesn't hold the torrent: %v", err)
+	}
+
+	// Each downloads on their own once a peer turns up
+	torrenttest.NewSeeder(t, fixture)
+	s.userToken = first
+	s.waitForTorrent(t, firstResults[0].id, func(tr models.Torrent) bool {
+		return tr.Status == models.TorrentStatusCompleted
+	})
+	s.userToken = second
+	s.waitForTorrent(t, secondResults[0].id, func(tr models.Torrent) bool {
+		return tr.Status == models.TorrentStatusCompleted
+	})
+}
+
+// TestReloadCompleted restarts the server after a torrent completes: the
+// reloaded torrent shows as completed throughout, never back to fetching
+// metadata while the engine verifies its data
+func TestReloadCompleted(t *testing.T) {
+	tracker := torrenttest.NewTracker(t)
+	fixture := torrenttest.NewFixture(t, "reloaded", fixtureSizes, tracker.URL)
+	torrenttest.NewSeeder(t, fixture)
+	db := torrenttest.NewDatabase(t)
+	engine := torrenttest.NewEngine(t, nil)
+	s := startServer(t, db, engine)
+	s.register(t)
+
+	var added models.Torrent
+	s.doJSON(t, http.MethodPost, "/api/v1/torrents", models.AddTorrentRequest{MagnetURI: fixture.Magnet()},
+		http.StatusCreated, &added)
+	s.waitForTorrent(t, added.ID, func(tr models.Torrent) bool {
+		return tr.Status == models.TorrentStatusCompleted
+	})
+
+	s.stop()
+	engine = engine.Reopen(t)
+	userToken := s.userToken
+	s = startServer(t, db, engine)
+	s.userToken = userToken
+	reloadActiveTorrents(context.Background(), db.Database, engine, false)
+
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		if tr := s.getTorrent(t, added.ID); tr.Status != models.TorrentStatusCompleted || tr.Progress != 100 {
+			t.Fatalf("after reload: status %s at %v%%, want completed", tr.Status, tr.Progress)
+		}
+	}
+	fixture.Verify(t, torrent.DataDir(engine.Config.DownloadDir, fixture.InfoHash()))
+}
+
+// TestMetadataAfterResponse adds a magnet before any peer has it: the add
+// answers at once, and the metadata still arrives once a peer turns up,
+// long after the request's context is gone
+func TestMetadataAfterResponse(t *testing.T) {
+	tracker := torrenttest.NewTracker(t)
+	fixture := torrenttest.NewFixture(t, "late-metadata", fixtureSizes, tracker.URL)
+	db := torrenttest.NewDatabase(t)
+	engine := torrenttest.NewEngine(t, nil)
+	s := startServer(t, db, engine)
+	s.register(t)
+
+	var added models.Torrent
+	s.doJSON(t, http.MethodPost, "/api/v1/torrents", models.AddTorrentRequest{MagnetURI: fixture.Magnet()},
+		http.StatusCreated, &added)
+	if added.TotalSize != 0 {
+		t.Fatalf("metadata known with no peer: total size %d", added.TotalSize)
+	}
+
+	// Other requests come and go in the meantime
+	time.Sleep(time.Second)
+	s.getTorrent(t, added.ID)
+
+	torrenttest.NewSeeder(t, fixture)
+	s.waitForTorrent(t, added.ID, func(tr models.Torrent) bool {
+		return tr.Name == fixture.Name && tr.TotalSize > 0
+	})
+}
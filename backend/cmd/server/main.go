@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -13,16 +15,22 @@ import (
 	"github.com/freetorrent/freetorrent/internal/auth"
 	"github.com/freetorrent/freetorrent/internal/config"
 	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
 	"github.com/freetorrent/freetorrent/internal/handlers"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/jobs"
+	"github.com/freetorrent/freetorrent/internal/mail"
 	"github.com/freetorrent/freetorrent/internal/middleware"
 	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/notify"
+	"github.com/freetorrent/freetorrent/internal/reporting"
+	"github.com/freetorrent/freetorrent/internal/server"
 	"github.com/freetorrent/freetorrent/internal/torrent"
-	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/compress"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/freetorrent/freetorrent/internal/torrent/remote"
+	"github.com/freetorrent/freetorrent/internal/uploads"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -33,10 +41,13 @@ func main() {
 	cfg := config.Load()
 
 	log.Printf("Starting CT-SaaS server...")
-	log.Printf("Environment: %s", cfg.Environment)
+	log.Printf("Config: %s", cfg.Summary())
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
 	// Initialize database
-	db, err := database.New(cfg.DatabaseURL)
+	db, err := database.New(cfg.DatabaseURL, cfg.DBLogQueries)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -48,130 +59,141 @@ func main() {
 	}
 	log.Println("Database migrations completed")
 
-	// Initialize torrent engine
-	engine, err := torrent.NewEngine(cfg)
-	if err != nil {
-		log.Fatalf("Failed to initialize torrent engine: %v", err)
+	// Background work runs under ctx, which is cancelled on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Data from before torrents were stored by info hash is moved into
+	// place before the engine opens it. What fails to move is retried on
+	// the next start.
+	if err := jobs.RelocateDownloads(ctx, db, cfg.DownloadDir); err != nil {
+		log.Printf("Failed to relocate downloads: %v", err)
+	}
+
+	// Initialize torrent engine, in this process or on an engine worker.
+	// Without it the API still serves accounts, billing and stored
+	// torrents; the watchdog keeps trying to start it.
+	var engine torrent.Service
+	if cfg.EngineMode == config.EngineRemote {
+		client, err := remote.Dial(cfg)
+		if err != nil {
+			log.Fatalf("Failed to connect to torrent engine: %v", err)
+		}
+		// A restarted worker comes back empty
+		client.OnRestart(func() { reloadActiveTorrents(ctx, db, client, true) })
+		engine = client
+		log.Printf("Using torrent engine at %s", cfg.EngineAddr)
+	} else {
+		local, err := torrent.NewEngine(ctx, cfg)
+		engine = local
+		if err != nil {
+			log.Printf("Torrent engine unavailable, starting without it: %v", err)
+		} else {
+			log.Println("Torrent engine initialized")
+		}
 	}
 	defer engine.Close()
-	log.Println("Torrent engine initialized")
+
+	// Slow transfers are most often an unforwarded port; say so up front
+	go func() {
+		check := engine.CheckPortReachability(ctx)
+		if check.Status == torrent.PortClosed {
+			log.Printf("Warning: BitTorrent port %d is not reachable on %s (%s); check port forwarding", check.Port, check.ExternalIP, check.Error)
+		}
+	}()
+
+	// Errors and panics that would otherwise only reach the log
+	reporter := reporting.New(cfg.ErrorReportURL, cfg.Environment)
+
+	// User email, logged only when SMTP isn't configured
+	mailer := mail.New(mail.Config{
+		Host:     cfg.SMTPHost,
+		Port:     cfg.SMTPPort,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.MailFrom,
+	})
+	broker := events.NewBroker()
+	notifier := notify.New(db, broker, mailer)
+
+	// Deployment-specific commands run at points in torrents' and users' lives
+	lifecycle := hooks.New(hooks.Commands{
+		TorrentAdded:     cfg.HookTorrentAdded,
+		TorrentCompleted: cfg.HookTorrentCompleted,
+		TorrentDeleted:   cfg.HookTorrentDeleted,
+		UserRegistered:   cfg.HookUserRegistered,
+	}, time.Duration(cfg.HookTimeout)*time.Second)
 
 	// Start torrent update processor
-	go processTorrentUpdates(db, engine, cfg)
+	completer := jobs.NewCompleter(db, engine, cfg, reporter, broker, notifier, lifecycle)
+	go processTorrentUpdates(ctx, db, engine, completer, broker, reporter)
 
 	// Initialize auth service
 	authService := auth.NewAuthService(cfg)
 
-	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db, authService, cfg)
-	torrentHandler := handlers.NewTorrentHandler(db, engine)
-	adminHandler := handlers.NewAdminHandler(db, engine)
-	sseHandler := handlers.NewSSEHandler(engine, authService)
-	billingHandler := handlers.NewBillingHandler(db, cfg)
-
-	// Initialize rate limiter (100 requests per minute)
-	rateLimiter := middleware.NewRateLimiter(100, time.Minute)
-
-	// Create Fiber app
-	app := fiber.New(fiber.Config{
-		AppName:               "CT-SaaS",
-		ServerHeader:          "CT-SaaS",
-		DisableStartupMessage: cfg.Environment == "production",
-		ReadTimeout:           30 * time.Second,
-		WriteTimeout:          30 * time.Second,
-		IdleTimeout:           120 * time.Second,
-		BodyLimit:             50 * 1024 * 1024, // 50MB for torrent files
-	})
+	// Resumable uploads live outside the download directory
+	uploadStore, err := uploads.NewStore(db, cfg.UploadDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize upload store: %v", err)
+	}
 
-	// Global middleware
-	app.Use(recover.New())
-	app.Use(middleware.RequestIDMiddleware())
-	app.Use(middleware.CORSMiddleware())
-	
-	if cfg.Environment != "production" {
-		app.Use(logger.New(logger.Config{
-			Format: "${time} | ${status} | ${latency} | ${ip} | ${method} | ${path}\n",
-		}))
-	}
-
-	app.Use(compress.New(compress.Config{
-		Level: compress.LevelBestSpeed,
-	}))
-
-	// Health check
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status":  "healthy",
-			"service": "ct-saas",
-			"time":    time.Now().Format(time.RFC3339),
-		})
-	})
+	// Rate limits are shared with other servers through Redis when it's
+	// reachable, and counted by this server alone otherwise
+	var limits middleware.LimiterStore
+	if rdb := connectRedis(ctx, cfg.RedisURL); rdb != nil {
+		defer rdb.Close()
+		limits = middleware.NewRedisLimiterStore(rdb)
+		log.Println("Rate limits shared through Redis")
+	}
 
-	// API v1 routes
-	api := app.Group("/api/v1")
-
-	// Apply rate limiting to API routes
-	api.Use(middleware.RateLimitMiddleware(rateLimiter))
-
-	// Public auth routes
-	authRoutes := api.Group("/auth")
-	authRoutes.Post("/register", authHandler.Register)
-	authRoutes.Post("/login", authHandler.Login)
-	authRoutes.Post("/refresh", authHandler.Refresh)
-	authRoutes.Post("/logout", authHandler.Logout)
-
-	// Public download route (uses token-based auth, NOT JWT)
-	api.Get("/download/:token", torrentHandler.Download)
-
-	// Stripe webhook (no auth, uses signature verification)
-	api.Post("/webhooks/stripe", billingHandler.HandleWebhook)
-
-	// Protected routes (require authentication)
-	protected := api.Group("", middleware.AuthMiddleware(authService))
-
-	// User routes
-	protected.Get("/auth/me", authHandler.Me)
-
-	// Torrent routes
-	torrents := protected.Group("/torrents")
-	torrents.Post("", torrentHandler.AddTorrent)
-	torrents.Post("/upload", torrentHandler.UploadTorrent)
-	torrents.Get("", torrentHandler.ListTorrents)
-	torrents.Get("/:id", torrentHandler.GetTorrent)
-	torrents.Delete("/:id", torrentHandler.DeleteTorrent)
-	torrents.Post("/:id/pause", torrentHandler.PauseTorrent)
-	torrents.Post("/:id/resume", torrentHandler.ResumeTorrent)
-	torrents.Post("/:id/token", torrentHandler.CreateDownloadToken)
-
-	// SSE events
-	protected.Get("/events", sseHandler.Events)
-
-	// Billing routes
-	billing := protected.Group("/subscription")
-	billing.Get("", billingHandler.GetSubscription)
-	billing.Post("/checkout", billingHandler.CreateCheckoutSession)
-	billing.Post("/portal", billingHandler.CreatePortalSession)
-
-	// Admin routes
-	admin := protected.Group("/admin", middleware.AdminMiddleware())
-	admin.Get("/users", adminHandler.ListUsers)
-	admin.Get("/users/:id", adminHandler.GetUser)
-	admin.Patch("/users/:id", adminHandler.UpdateUser)
-	admin.Delete("/users/:id", adminHandler.DeleteUser)
-	admin.Get("/torrents", adminHandler.ListAllTorrents)
-	admin.Delete("/torrents/:id", adminHandler.DeleteTorrent)
-	admin.Get("/stats", adminHandler.GetStats)
-	admin.Post("/cleanup", adminHandler.CleanupExpired)
-	admin.Get("/events", sseHandler.EventsAll)
+	// The API
+	app := server.New(cfg, server.Services{
+		DB:        db,
+		Engine:    engine,
+		Auth:      authService,
+		Broker:    broker,
+		Notifier:  notifier,
+		Hooks:     lifecycle,
+		Uploads:   uploadStore,
+		Completer: completer,
+		Reporter:  reporter,
+		Limits:    limits,
+	})
 
 	// Create demo admin if doesn't exist
 	createDemoAdmin(db, authService)
 
 	// Reload active torrents from database
-	reloadActiveTorrents(db, engine)
+	if engine.Available() {
+		reloadActiveTorrents(ctx, db, engine, false)
+	}
+
+	// Restart the engine if it stalls, or start it if it failed to
+	go engineWatchdogJob(ctx, db, engine, time.Duration(cfg.EngineStallSeconds)*time.Second, reporter)
 
 	// Start cleanup job
-	go cleanupJob(db, engine)
+	go cleanupJob(ctx, db, engine, completer, uploadStore, lifecycle, reporter)
+
+	// Record upload usage every few minutes
+	go uploadUsageJob(ctx, db, reporter)
+
+	// Repair torrents whose completion was interrupted, now and hourly
+	go reconcileJob(ctx, completer, reporter)
+
+	// Report torrents whose sizes or progress don't add up, daily
+	go consistencyJob(ctx, db, reporter)
+
+	// Write API usage to usage logs hourly
+	go apiUsageJob(ctx, db, app.APIUsage, reporter)
+
+	// Load the download redirects, and follow changes made on other servers
+	go downloadRedirectsJob(ctx, db, app.Redirects, reporter)
+
+	// Work through bulk imports as plan limits allow
+	go importJob(ctx, app.Torrents, reporter)
+
+	// Warn users of torrents expiring within a day
+	go expiryWarningJob(ctx, jobs.NewExpiryWarner(db, broker, notifier), reporter)
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -180,6 +202,7 @@ func main() {
 	go func() {
 		<-quit
 		log.Println("Shutting down server...")
+		cancel()
 		app.Shutdown()
 	}()
 
@@ -191,80 +214,397 @@ func main() {
 	}
 }
 
-// processTorrentUpdates handles updates from the torrent engine
-func processTorrentUpdates(db *database.Database, engine *torrent.Engine, cfg *config.Config) {
-	for update := range engine.Updates() {
-		ctx := context.Background()
-		
-		// Update database
-		if update.Error != "" {
-			db.SetTorrentError(ctx, update.ID, update.Error)
-		} else if update.Progress >= 100 && update.Status == "completed" {
-			// Get user's retention days
-			t, err := db.GetTorrent(ctx, update.ID)
-			if err == nil && t != nil {
-				sub, _ := db.GetSubscription(ctx, t.UserID)
-				retentionDays := 1
-				if sub != nil {
-					retentionDays = sub.RetentionDays
-				}
-				db.SetTorrentCompleted(ctx, update.ID, retentionDays)
-				
-				// Update name and size on completion
-				if update.Name != "" && update.Name != "Fetching metadata..." {
-					db.UpdateTorrentName(ctx, update.ID, update.Name, update.TotalSize)
-				}
-				
-				// Save files to database
-				if len(update.Files) > 0 {
-					db.UpdateTorrentFiles(ctx, update.ID, update.Files)
-					
-					// Auto-zip if more than 1 file
-					if len(update.Files) > 1 {
-						go func(files []models.TorrentFile, name string, id uuid.UUID) {
-							var filePaths []string
-							for _, f := range files {
-								filePaths = append(filePaths, f.Path)
-							}
-							
-							zipPath, zipSize, err := torrent.CreateZipFromFiles(cfg.DownloadDir, name, filePaths)
-							if err != nil {
-								log.Printf("Failed to create zip for %s: %v", name, err)
-								return
-							}
-							
-							if err := db.UpdateTorrentZip(context.Background(), id, zipPath, zipSize); err != nil {
-								log.Printf("Failed to save zip path: %v", err)
-								return
-							}
-							
-							log.Printf("Created zip archive: %s (%.2f MB)", zipPath, float64(zipSize)/1024/1024)
-						}(update.Files, update.Name, update.ID)
-					}
-				}
-				
-				// Log usage
-				db.LogUsage(ctx, t.UserID, "download_completed", update.TotalSize, update.Name)
+// processTorrentUpdates handles updates from the torrent engine until ctx is cancelled
+func processTorrentUpdates(ctx context.Context, db *database.Database, engine torrent.Service, completer *jobs.Completer, broker *events.Broker, reporter reporting.Reporter) {
+	files := newFilesWrites()
+	marks := newProgressMarks()
+	drift := newStatusDrift()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-engine.Updates():
+			if !ok {
+				return
 			}
-		} else {
-			// Update status
-			db.UpdateTorrentStatus(ctx, update.ID, update.Status, update.Progress,
-				update.Downloaded, update.Uploaded, update.DownloadSpeed, update.UploadSpeed,
-				update.Peers, update.Seeds)
-			
-			// Update name and size if we got metadata
-			if update.Name != "" && update.Name != "Fetching metadata..." {
-				db.UpdateTorrentName(ctx, update.ID, update.Name, update.TotalSize)
+			applyTorrentUpdate(ctx, db, engine, completer, broker, reporter, files, marks, drift, update)
+		}
+	}
+}
+
+// applyTorrentUpdate writes one engine update to the database. Each call gets
+// its own deadline; a failure is logged and the pipeline moves on. A panic is
+// reported and confined to this update so status persistence keeps running.
+func applyTorrentUpdate(ctx context.Context, db *database.Database, engine torrent.Service, completer *jobs.Completer, broker *events.Broker, reporter reporting.Reporter, files *filesWrites, marks *progressMarks, drift *statusDrift, update torrent.TorrentUpdate) {
+	defer reporting.Recover(reporter, "torrent update processor", map[string]string{
+		"torrent_id": update.ID.String(),
+		"info_hash":  update.InfoHash,
+	})
+
+	update.Clamp()
+	marks.hold(&update)
+
+	if update.Error != "" {
+		if !update.ClosedReason.IsFailure() {
+			update.ClosedReason = models.ClosedFailedInternal
+		}
+		files.forget(update.ID)
+		marks.forget(update.ID)
+		completer.Forget(update.ID)
+		dbCall(ctx, "log failure", update.ID, func(ctx context.Context) error {
+			return db.LogTorrentFailed(ctx, update.ID, update.ClosedReason, update.Error)
+		})
+		dbCall(ctx, "set error", update.ID, func(ctx context.Context) error {
+			return db.SetTorrentError(ctx, update.ID, update.ClosedReason, update.Error)
+		})
+		if update.DiskError {
+			publishDiskError(ctx, db, broker, update)
+		}
+		return
+	}
+
+	// Uploads are accumulated in the database; the engine's counters reset
+	// with every restart
+	if update.UploadedDelta > 0 {
+		dbCall(ctx, "add upload", update.ID, func(ctx context.Context) error {
+			return db.AddTorrentUploaded(ctx, update.ID, update.UploadedDelta)
+		})
+	}
+
+	if update.Metadata != nil {
+		dbCall(ctx, "update metadata", update.ID, func(ctx context.Context) error {
+			return db.UpdateTorrentMetadata(ctx, update.ID, update.Metadata)
+		})
+	}
+
+	if update.HealthChanged {
+		applyHealthWarning(ctx, db, broker, update)
+	}
+
+	// A private torrent seeding to its ratio already has all its data
+	if update.Progress >= 100 && update.Status.IsComplete() {
+		files.forget(update.ID)
+		marks.forget(update.ID)
+		if err := completer.CompleteTorrent(ctx, update.ID); err != nil {
+			log.Printf("Failed to complete torrent %s: %v", update.ID, err)
+		}
+		return
+	}
+	// Not complete any more, as after a retry; completing it again runs
+	// every step
+	completer.Forget(update.ID)
+
+	// A row resumed on what was left of its owner's bandwidth stops once it
+	// has used it; the torrent keeps running for owners with budget left
+	if update.PauseAt > 0 && update.Downloaded >= update.PauseAt && update.Status != models.TorrentStatusPaused {
+		pauseOnBudget(ctx, db, engine, broker, &update)
+	}
+
+	// Update status. A status the torrent can't move to means the engine and
+	// database disagree, say a failed torrent still fetching metadata; the
+	// whole update is dropped.
+	rejected := false
+	dbCall(ctx, "update status", update.ID, func(ctx context.Context) error {
+		err := db.UpdateTorrentStatus(ctx, update.ID, update.Status, update.Progress,
+			update.Downloaded, update.DownloadSpeed, update.UploadSpeed,
+			update.Peers, update.Seeds, false)
+		if errors.Is(err, database.ErrIllegalTransition) || errors.Is(err, database.ErrInvalidStatus) {
+			rejected = true
+			drift.report(update.ID, err, time.Now())
+			return nil
+		}
+		return err
+	})
+	if rejected {
+		return
+	}
+
+	// Update name and size if we got metadata
+	if update.Name != "" && update.Name != "Fetching metadata..." {
+		dbCall(ctx, "update name", update.ID, func(ctx context.Context) error {
+			return db.UpdateTorrentName(ctx, update.ID, update.Name, update.TotalSize, update.IsPrivate)
+		})
+	}
+
+	// Save files if available and worth writing; see filesWrites
+	if len(update.Files) > 0 && files.due(update.ID, update.Files, time.Now()) {
+		dbCall(ctx, "update files", update.ID, func(ctx context.Context) error {
+			return db.UpdateTorrentFiles(ctx, update.ID, update.Files)
+		})
+	}
+}
+
+// applyHealthWarning records a torrent's changed health warning and tells its
+// owner, suggesting they check the source when the swarm looks dead
+func applyHealthWarning(ctx context.Context, db *database.Database, broker *events.Broker, update torrent.TorrentUpdate) {
+	var changed bool
+	dbCall(ctx, "set health warning", update.ID, func(ctx context.Context) error {
+		var err error
+		changed, err = db.SetTorrentHealthWarning(ctx, update.ID, update.HealthWarning)
+		return err
+	})
+	if !changed {
+		return
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	t, err := db.GetTorrent(dbCtx, update.ID)
+	cancel()
+	if err != nil || t == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"id":             t.ID,
+		"name":           t.Name,
+		"health_warning": update.HealthWarning,
+	}
+	switch update.HealthWarning {
+	case torrent.HealthNoSeeders:
+		data["message"] = "No seeders found for this torrent. Check the magnet link or source is still alive."
+	case torrent.HealthTrackersFailing:
+		data["message"] = "Every tracker of this torrent is failing. Check its tracker list for mistakes."
+	}
+	broker.Publish(events.Event{
+		UserID: t.UserID,
+		Type:   "torrent_health",
+		Data:   data,
+	})
+}
+
+// pauseOnBudget pauses the owner's row of a torrent that has downloaded the
+// bandwidth budget it was resumed on, turning update into a paused one, and
+// tells its owner. The engine stops the torrent only once every owner has
+// paused it.
+func pauseOnBudget(ctx context.Context, db *database.Database, engine torrent.Service, broker *events.Broker, update *torrent.TorrentUpdate) {
+	if err := engine.PauseTorrent(update.InfoHash, update.ID); err != nil {
+		log.Printf("Failed to pause torrent %s at its bandwidth budget: %v", update.ID, err)
+		return
+	}
+	engine.SetPauseAt(update.InfoHash, update.ID, 0)
+	update.Status = models.TorrentStatusPaused
+	update.DownloadSpeed, update.UploadSpeed, update.Peers, update.Seeds = 0, 0, 0, 0
+	dbCall(ctx, "clear pause budget", update.ID, func(ctx context.Context) error {
+		return db.SetTorrentPauseAt(ctx, update.ID, 0)
+	})
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	t, err := db.GetTorrent(dbCtx, update.ID)
+	cancel()
+	if err != nil || t == nil {
+		return
+	}
+	broker.Publish(events.Event{
+		UserID: t.UserID,
+		Type:   "torrent_paused",
+		Data: map[string]interface{}{
+			"id":         t.ID,
+			"name":       t.Name,
+			"reason":     "bandwidth_budget",
+			"downloaded": update.Downloaded,
+			"message":    "Paused after using the bandwidth left this period. Resume it once your usage resets or after upgrading.",
+		},
+	})
+}
+
+// publishDiskError tells a torrent's owner it failed because its data
+// couldn't be written; admins see the event on the all-events stream
+func publishDiskError(ctx context.Context, db *database.Database, broker *events.Broker, update torrent.TorrentUpdate) {
+	dbCtx, cancel := database.WithTimeout(ctx)
+	t, err := db.GetTorrent(dbCtx, update.ID)
+	cancel()
+	if err != nil || t == nil {
+		return
+	}
+	broker.Publish(events.Event{
+		UserID: t.UserID,
+		Type:   "disk_error",
+		Data: map[string]interface{}{
+			"id":      t.ID,
+			"name":    t.Name,
+			"error":   update.Error,
+			"message": "The server couldn't save this torrent's data. New torrents are paused until an administrator fixes the storage.",
+		},
+	})
+}
+
+// filesRefreshInterval is how often a torrent's files are written while only
+// their progress changes
+const filesRefreshInterval = 30 * time.Second
+
+// filesWrites decides when a torrent's files are written. The files JSONB
+// is rewritten whole, which for a torrent of thousands of files is most of
+// the update pipeline's writes, so it is only written when the number of
+// completed files changes or filesRefreshInterval has passed. Only the
+// update processor's goroutine uses it.
+type filesWrites struct {
+	last  map[uuid.UUID]filesWrite
+	swept time.Time
+}
+
+type filesWrite struct {
+	completed int
+	total     int
+	at        time.Time
+}
+
+func newFilesWrites() *filesWrites {
+	return &filesWrites{last: make(map[uuid.UUID]filesWrite)}
+}
+
+// due reports whether files should be written for torrent id now, and if
+// so records the write
+func (w *filesWrites) due(id uuid.UUID, files []models.TorrentFile, now time.Time) bool {
+	next := filesWrite{completed: models.CompletedFiles(files), total: len(files), at: now}
+	last, ok := w.last[id]
+	if ok && next.completed == last.completed && next.total == last.total &&
+		now.Sub(last.at) < filesRefreshInterval {
+		return false
+	}
+	w.last[id] = next
+
+	// Torrents that were deleted never say so here; drop what they left
+	if now.Sub(w.swept) > 10*filesRefreshInterval {
+		for id, write := range w.last {
+			if now.Sub(write.at) > 10*filesRefreshInterval {
+				delete(w.last, id)
 			}
-			
-			// Save files if available
-			if len(update.Files) > 0 {
-				db.UpdateTorrentFiles(ctx, update.ID, update.Files)
+		}
+		w.swept = now
+	}
+	return true
+}
+
+// forget drops a torrent that sends no more progress updates; the completer
+// writes its final files itself
+func (w *filesWrites) forget(id uuid.UUID) {
+	delete(w.last, id)
+}
+
+// progressMarks keeps the most each torrent has reported downloaded since
+// it was added to the engine, so a counter that dips (a stats glitch, a
+// recheck in progress) never moves a torrent backwards in the database.
+// Torrents start over when they are re-added: on a restart, when they go
+// back to fetching metadata after a retry, and after failing. Only the update
+// processor's goroutine uses it.
+type progressMarks struct {
+	downloaded map[uuid.UUID]progressMark
+	swept      time.Time
+}
+
+type progressMark struct {
+	bytes int64
+	at    time.Time
+}
+
+func newProgressMarks() *progressMarks {
+	return &progressMarks{downloaded: make(map[uuid.UUID]progressMark)}
+}
+
+// hold raises a clamped update's downloaded bytes, and its progress with
+// them, to the torrent's high-water mark, or records a new mark
+func (m *progressMarks) hold(update *torrent.TorrentUpdate) {
+	if update.Status == models.TorrentStatusPending || update.Status == models.TorrentStatusMetadataQueued ||
+		update.Status == models.TorrentStatusFetching {
+		delete(m.downloaded, update.ID)
+		return
+	}
+	if update.WantedSize <= 0 {
+		return
+	}
+	now := time.Now()
+	mark, ok := m.downloaded[update.ID]
+	if ok && update.Downloaded < mark.bytes {
+		update.Downloaded = mark.bytes
+		update.Progress = min(float64(mark.bytes)/float64(update.WantedSize)*100, 100)
+	}
+	m.downloaded[update.ID] = progressMark{bytes: update.Downloaded, at: now}
+
+	// As with filesWrites, deleted torrents just stop sending updates
+	if now.Sub(m.swept) > 10*filesRefreshInterval {
+		for id, mark := range m.downloaded {
+			if now.Sub(mark.at) > 10*filesRefreshInterval {
+				delete(m.downloaded, id)
 			}
 		}
+		m.swept = now
 	}
 }
 
+// forget drops a torrent that sends no more progress updates
+func (m *progressMarks) forget(id uuid.UUID) {
+	delete(m.downloaded, id)
+}
+
+// statusDriftInterval is how often a torrent whose engine status keeps
+// being rejected is logged again
+const statusDriftInterval = 10 * time.Minute
+
+// statusDrift logs status updates rejected by the database, once per
+// torrent every statusDriftInterval since the engine repeats them with
+// every update. Only the update processor's goroutine uses it.
+type statusDrift struct {
+	logged map[uuid.UUID]time.Time
+}
+
+func newStatusDrift() *statusDrift {
+	return &statusDrift{logged: make(map[uuid.UUID]time.Time)}
+}
+
+// report logs a rejected status update unless the torrent's was logged
+// recently
+func (d *statusDrift) report(id uuid.UUID, err error, now time.Time) {
+	if at, ok := d.logged[id]; ok && now.Sub(at) < statusDriftInterval {
+		return
+	}
+	log.Printf("Torrent %s: engine status rejected: %v", id, err)
+	d.logged[id] = now
+
+	for id, at := range d.logged {
+		if now.Sub(at) >= statusDriftInterval {
+			delete(d.logged, id)
+		}
+	}
+}
+
+// dbCall runs a single database operation for a background job under its own
+// timeout, logging the failure instead of returning it
+func dbCall(ctx context.Context, op string, id uuid.UUID, fn func(ctx context.Context) error) {
+	callCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+
+	if err := fn(callCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Torrent %s: %s timed out after %s", id, op, database.OperationTimeout)
+			return
+		}
+		if ctx.Err() == nil {
+			log.Printf("Torrent %s: %s failed: %v", id, op, err)
+		}
+	}
+}
+
+// connectRedis returns a client for the Redis at url, or nil when url is
+// empty or Redis can't be reached, which is logged
+func connectRedis(ctx context.Context, url string) *redis.Client {
+	if url == "" {
+		return nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		log.Printf("Invalid REDIS_URL, rate limits are per server: %v", err)
+		return nil
+	}
+	client := redis.NewClient(opts)
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		log.Printf("Redis unreachable, rate limits are per server: %v", err)
+		client.Close()
+		return nil
+	}
+	return client
+}
+
 // createDemoAccounts creates demo admin and demo user accounts if they don't exist
 // Credentials are read from environment variables for security
 func createDemoAdmin(db *database.Database, authService *auth.AuthService) {
@@ -359,12 +699,11 @@ func generateRandomPassword() string {
 	return hex.EncodeToString(bytes)
 }
 
-// reloadActiveTorrents loads active torrents from database into engine
-func reloadActiveTorrents(db *database.Database, engine *torrent.Engine) {
-	ctx := context.Background()
-	
+// reloadActiveTorrents loads active torrents from database into engine, at
+// startup or after the engine restarted
+func reloadActiveTorrents(ctx context.Context, db *database.Database, engine torrent.Service, restarted bool) {
 	// Get all non-expired, non-failed torrents
-	torrents, _, err := db.GetAllTorrents(ctx, 1000, 0)
+	torrents, _, err := db.GetAllTorrents(ctx, "", "", 1000, 0)
 	if err != nil {
 		log.Printf("Failed to load torrents from database: %v", err)
 		return
@@ -372,11 +711,24 @@ func reloadActiveTorrents(db *database.Database, engine *torrent.Engine) {
 	
 	reloaded := 0
 	for _, t := range torrents {
-		if t.Status == "failed" || t.Status == "cancelled" {
+		if t.Status == models.TorrentStatusFailed || t.Status == models.TorrentStatusCancelled ||
+			t.Status == models.TorrentStatusNeedsRedownload {
+			continue
+		}
+
+		// A URL fetch interrupted by the restart has nothing to reload. One
+		// still running when only the engine restarted adds its torrent itself.
+		if t.Status == models.TorrentStatusFetching {
+			if !restarted {
+				db.SetTorrentError(ctx, t.ID, models.ClosedFailedMetadata, "torrent fetch interrupted by server restart")
+			}
 			continue
 		}
 		
-		err := engine.ReloadTorrent(ctx, t.ID, t.UserID, t.MagnetURI, t.InfoHash, t.Status)
+		err := jobs.ReloadTorrent(ctx, db, engine, &t)
+		if errors.Is(err, torrent.ErrPrivateTorrentInUse) {
+			continue
+		}
 		if err != nil {
 			log.Printf("Failed to reload torrent %s: %v", t.InfoHash, err)
 			continue
@@ -389,29 +741,362 @@ func reloadActiveTorrents(db *database.Database, engine *torrent.Engine) {
 	}
 }
 
-// cleanupJob runs periodic cleanup tasks
-func cleanupJob(db *database.Database, engine *torrent.Engine) {
+// engineWatchdogInterval is how often the engine watchdog looks at the engine
+const engineWatchdogInterval = 10 * time.Second
+
+// engineWatchdogJob restarts the torrent engine when its update loop has
+// stalled for longer than stall, and retries an engine that isn't running
+// once every stall, reloading the torrents after each successful start
+func engineWatchdogJob(ctx context.Context, db *database.Database, engine torrent.Service, stall time.Duration, reporter reporting.Reporter) {
+	if stall <= 0 {
+		return
+	}
+	ticker := time.NewTicker(engineWatchdogInterval)
+	defer ticker.Stop()
+
+	check := func() {
+		defer reporting.Recover(reporter, "engine watchdog", nil)
+
+		var reason string
+		switch health := engine.Health(); {
+		case !health.Available:
+			if health.LastRestartAt != nil && time.Since(*health.LastRestartAt) < stall {
+				return
+			}
+			reason = "engine unavailable"
+			if health.Error != "" {
+				reason += ": " + health.Error
+			}
+		case engine.Stalled(stall):
+			reason = fmt.Sprintf("update loop stalled for over %s", stall)
+		default:
+			return
+		}
+
+		log.Printf("Restarting torrent engine: %s", reason)
+		if err := engine.Restart(reason); err != nil {
+			reporter.Report(reporting.Event{
+				Error: fmt.Sprintf("torrent engine restart failed: %v", err),
+				Tags:  map[string]string{"reason": reason},
+			})
+			return
+		}
+		reloadActiveTorrents(ctx, db, engine, true)
+		log.Println("Torrent engine restarted")
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		check()
+	}
+}
+
+// reconcileJob re-runs interrupted completions and flags missing data
+func reconcileJob(ctx context.Context, completer *jobs.Completer, reporter reporting.Reporter) {
 	ticker := time.NewTicker(time.Hour)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		ctx := context.Background()
-		
-		// Get expired torrents
-		expired, err := db.GetExpiredTorrents(ctx)
+	reconcile := func() {
+		defer reporting.Recover(reporter, "reconcile job", nil)
+		if err := completer.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Reconcile error: %v", err)
+		}
+	}
+
+	for {
+		reconcile()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// apiUsageJob writes users' API usage to usage logs hourly, and once more
+// on shutdown, as far as it gets before the process exits
+func apiUsageJob(ctx context.Context, db *database.Database, usage *middleware.APIUsage, reporter reporting.Reporter) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	flush := func() {
+		defer reporting.Recover(reporter, "API usage job", nil)
+		for userID, u := range usage.Flush() {
+			// Not ctx: the final flush runs after it is cancelled
+			logCtx, cancel := database.WithTimeout(context.Background())
+			err := db.LogAPIUsage(logCtx, userID, u)
+			cancel()
+			if err != nil {
+				log.Printf("API usage error: %v", err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// importJob adds the items of bulk imports. Queued items wait for a plan
+// limit, so they are retried every minute; a new import starts at once.
+func importJob(ctx context.Context, torrents *handlers.TorrentHandler, reporter reporting.Reporter) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	process := func() {
+		defer reporting.Recover(reporter, "import job", nil)
+		n, err := torrents.ProcessImports(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Import error: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Imported %d torrents", n)
+		}
+	}
+
+	for {
+		process()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-torrents.ImportWake():
+		}
+	}
+}
+
+// downloadRedirectsJob loads the download redirects from the settings now
+// and every minute, so a change saved through another server applies here
+func downloadRedirectsJob(ctx context.Context, db *database.Database, redirects *middleware.DownloadRedirects, reporter reporting.Reporter) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	load := func() {
+		defer reporting.Recover(reporter, "download redirects job", nil)
+		if err := handlers.LoadDownloadRedirects(ctx, db, redirects); err != nil && ctx.Err() == nil {
+			log.Printf("Download redirects error: %v", err)
+		}
+	}
+
+	for {
+		load()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expiryWarningJob warns users of torrents about to expire. It checks hourly
+// so a warning goes out close to a day ahead; each torrent is warned once.
+func expiryWarningJob(ctx context.Context, warner *jobs.ExpiryWarner, reporter reporting.Reporter) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	warn := func() {
+		defer reporting.Recover(reporter, "expiry warning job", nil)
+		n, err := warner.WarnExpiring(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Expiry warning error: %v", err)
+		} else if n > 0 {
+			log.Printf("Warned of %d expiring torrents", n)
+		}
+	}
+
+	for {
+		warn()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// uploadUsageJob periodically turns uploaded data into "upload" usage logs.
+// Unlogged uploads are kept in the database, so a shutdown loses nothing.
+func uploadUsageJob(ctx context.Context, db *database.Database, reporter reporting.Reporter) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	logUploads := func() {
+		defer reporting.Recover(reporter, "upload usage job", nil)
+		logCtx, cancel := database.WithTimeout(ctx)
+		defer cancel()
+		if _, err := db.LogUploadUsage(logCtx); err != nil && ctx.Err() == nil {
+			log.Printf("Upload usage error: %v", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logUploads()
+		}
+	}
+}
+
+// consistencyJob flags torrents with impossible sizes or progress into the
+// consistency report daily, for an admin to review and repair
+func consistencyJob(ctx context.Context, db *database.Database, reporter reporting.Reporter) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	check := func() {
+		defer reporting.Recover(reporter, "consistency job", nil)
+		checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		n, err := db.FlagInconsistentTorrents(checkCtx)
 		if err != nil {
-			log.Printf("Cleanup error: %v", err)
-			continue
+			if ctx.Err() == nil {
+				log.Printf("Consistency check error: %v", err)
+			}
+			return
 		}
+		if n > 0 {
+			log.Printf("Consistency check: %d torrents flagged, see /api/v1/admin/consistency", n)
+		}
+	}
 
-		for _, t := range expired {
-			log.Printf("Cleaning up expired torrent: %s", t.Name)
-			engine.RemoveTorrent(t.InfoHash, true)
-			db.DeleteTorrent(ctx, t.ID)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
 		}
+	}
+}
 
-		if len(expired) > 0 {
-			log.Printf("Cleaned up %d expired torrents", len(expired))
+// cleanupJob runs periodic cleanup tasks until ctx is cancelled
+func cleanupJob(ctx context.Context, db *database.Database, engine torrent.Service, completer *jobs.Completer, uploadStore *uploads.Store, lifecycle hooks.Hooks, reporter reporting.Reporter) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
+
+		cleanupExpired(ctx, db, engine, completer, uploadStore, lifecycle, reporter)
+	}
+}
+
+// cleanupExpired removes expired torrents, and failed ones past their
+// retention, from the engine, disk and database, along with expired
+// idempotency keys, stale churn counters, old import reports, abandoned
+// uploads, old notifications and bandwidth alerts
+func cleanupExpired(ctx context.Context, db *database.Database, engine torrent.Service, completer *jobs.Completer, uploadStore *uploads.Store, lifecycle hooks.Hooks, reporter reporting.Reporter) {
+	defer reporting.Recover(reporter, "cleanup job", nil)
+
+	// Get expired torrents
+	listCtx, cancel := database.WithTimeout(ctx)
+	expired, err := db.GetExpiredTorrents(listCtx)
+	cancel()
+	if err != nil {
+		log.Printf("Cleanup error: %v", err)
+		return
+	}
+
+	// Without the engine an expired torrent's files would be left behind
+	if !engine.Available() && len(expired) > 0 {
+		log.Printf("Torrent engine unavailable, leaving %d expired torrents for later", len(expired))
+		expired = nil
+	}
+
+	for _, t := range expired {
+		log.Printf("Cleaning up expired torrent: %s", t.Name)
+		engine.RemoveOwner(t.InfoHash, t.ID, true)
+		dbCall(ctx, "log expired", t.ID, func(ctx context.Context) error {
+			return db.LogTorrentExpired(ctx, &t)
+		})
+		dbCall(ctx, "expire download tokens", t.ID, func(ctx context.Context) error {
+			return db.ExpireDownloadTokens(ctx, t.ID)
+		})
+		dbCall(ctx, "delete expired", t.ID, func(ctx context.Context) error {
+			return db.DeleteTorrent(ctx, t.ID, models.ClosedExpired)
+		})
+		lifecycle.OnTorrentDeleted(&t, hooks.DeleteReasonExpired)
+	}
+
+	if len(expired) > 0 {
+		log.Printf("Cleaned up %d expired torrents", len(expired))
+	}
+
+	if n, err := completer.PurgeFailed(ctx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Purged %d failed or cancelled torrents past their retention", n)
+	}
+
+	keysCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := db.DeleteExpiredIdempotencyKeys(keysCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d expired idempotency keys", n)
+	}
+
+	tokensCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := db.DeleteStaleDownloadTokens(tokensCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d download tokens of expired torrents", n)
+	}
+
+	churnCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := db.DeleteStaleChurn(churnCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d stale churn counters", n)
+	}
+
+	importsCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := db.DeleteOldImportJobs(importsCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d old import reports", n)
+	}
+
+	uploadsCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := uploadStore.SweepExpired(uploadsCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d expired uploads", n)
+	}
+
+	notificationsCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := db.DeleteOldNotifications(notificationsCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d old notifications", n)
+	}
+
+	alertsCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	if n, err := db.DeleteOldBandwidthAlerts(alertsCtx); err != nil {
+		log.Printf("Cleanup error: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d old bandwidth alerts", n)
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/google/uuid"
+)
+
+// TestProgressMarksRestartSequence replays the updates a torrent sends
+// around a restart, the sequence that used to leave rows with more
+// downloaded than their size or going backwards
+func TestProgressMarksRestartSequence(t *testing.T) {
+	id := uuid.New()
+	marks := newProgressMarks()
+	apply := func(status models.TorrentStatus, progress float64, downloaded int64) torrent.TorrentUpdate {
+		update := torrent.TorrentUpdate{
+			ID:         id,
+			Status:     status,
+			Progress:   progress,
+			Downloaded: downloaded,
+			TotalSize:  1024,
+			WantedSize: 1024,
+		}
+		update.Clamp()
+		marks.hold(&update)
+		return update
+	}
+	check := func(step string, update torrent.TorrentUpdate, progress float64, downloaded int64) {
+		t.Helper()
+		if update.Progress != progress || update.Downloaded != downloaded {
+			t.Errorf("%s: progress %v, downloaded %d; want %v, %d", step, update.Progress, update.Downloaded, progress, downloaded)
+		}
+	}
+
+	check("downloading", apply(models.TorrentStatusDownloading, 50, 512), 50, 512)
+
+	// Before a restart the engine's counters glitch: a speed calculation
+	// overshooting the size, then a dip while it rechecks
+	check("overshoot", apply(models.TorrentStatusDownloading, 130, 1331), 100, 1024)
+	check("dip", apply(models.TorrentStatusDownloading, 25, 256), 100, 1024)
+
+	// The restart: the torrent is re-added and starts over from what is
+	// on disk, without the stats it had
+	check("re-added", apply(models.TorrentStatusMetadataQueued, 0, 0), 0, 0)
+	check("after restart", apply(models.TorrentStatusDownloading, 50, 512), 50, 512)
+	check("dip after restart", apply(models.TorrentStatusDownloading, 0, 0), 50, 512)
+	check("resumed", apply(models.TorrentStatusDownloading, 75, 768), 75, 768)
+
+	// A failure forgets the mark too, as a retry re-adds the torrent
+	marks.forget(id)
+	check("retried", apply(models.TorrentStatusDownloading, 25, 256), 25, 256)
+}
@@ -33,6 +33,8 @@ type Claims struct {
 	UserID string `json:"user_id"`
 	Email  string `json:"email"`
 	Role   string `json:"role"`
+	// TwoFactor is set when the session signed in with a two-factor code
+	TwoFactor bool `json:"2fa,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -130,12 +132,14 @@ func splitArgon2Hash(encoded string) []string {
 	return []string{salt, hash}
 }
 
-// GenerateAccessToken creates a new JWT access token
-func (a *AuthService) GenerateAccessToken(userID uuid.UUID, email, role string) (string, error) {
+// GenerateAccessToken creates a new JWT access token, for a session that
+// signed in with a two-factor code when twoFactor is set
+func (a *AuthService) GenerateAccessToken(userID uuid.UUID, email, role string, twoFactor bool) (string, error) {
 	claims := &Claims{
-		UserID: userID.String(),
-		Email:  email,
-		Role:   role,
+		UserID:    userID.String(),
+		Email:     email,
+		Role:      role,
+		TwoFactor: twoFactor,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(a.cfg.JWTAccessExpiry) * time.Minute)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -203,7 +203,7 @@ type HybridToken struct {
 
 // GenerateHybridTokens creates both classical and PQ tokens
 func (h *HybridAuthService) GenerateHybridTokens(userID uuid.UUID, email, role string) (*HybridToken, error) {
-	classical, err := h.classical.GenerateAccessToken(userID, email, role)
+	classical, err := h.classical.GenerateAccessToken(userID, email, role, false)
 	if err != nil {
 		return nil, err
 	}
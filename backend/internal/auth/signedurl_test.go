@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func signedDownload() SignedDownload {
+	return SignedDownload{
+		TorrentID: uuid.New(),
+		UserID:    uuid.New(),
+		InfoHash:  strings.Repeat("ab", 20),
+		FilePath:  "Season 1/episode.mkv",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		MaxBytes:  1 << 30,
+	}
+}
+
+func TestDownloadSignerVerify(t *testing.T) {
+	s := NewDownloadSigner("current-secret", "")
+	d := signedDownload()
+	token, err := s.Sign(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Verify(token)
+	if err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if *got != d {
+		t.Errorf("verified %+v, want %+v", *got, d)
+	}
+
+	// Another payload under the original signature
+	_, sig, _ := strings.Cut(token, ".")
+	tamper := func(change func(*SignedDownload)) string {
+		changed := d
+		change(&changed)
+		payload, err := json.Marshal(changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(payload) + "." + sig
+	}
+	other, err := NewDownloadSigner("other-secret", "").Sign(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"path", tamper(func(d *SignedDownload) { d.FilePath = "Season 1/other.mkv" })},
+		{"user", tamper(func(d *SignedDownload) { d.UserID = uuid.New() })},
+		{"expiry", tamper(func(d *SignedDownload) { d.ExpiresAt += 86400 })},
+		{"secret", other},
+	}
+	for _, tt := range tests {
+		if _, err := s.Verify(tt.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("tampered %s: err = %v, want ErrInvalidToken", tt.name, err)
+		}
+	}
+}
+
+func TestDownloadSignerExpired(t *testing.T) {
+	s := NewDownloadSigner("current-secret", "")
+	d := signedDownload()
+	d.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	token, err := s.Sign(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Verify(token); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expired token: err = %v, want ErrExpiredToken", err)
+	}
+	// Still decodes, to name the torrent behind the old link
+	if got, err := s.Decode(token); err != nil || got.TorrentID != d.TorrentID {
+		t.Errorf("decode expired token: %+v, %v", got, err)
+	}
+}
+
+func TestDownloadSignerRotation(t *testing.T) {
+	d := signedDownload()
+	old, err := NewDownloadSigner("old-secret", "").Sign(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := NewDownloadSigner("new-secret", "old-secret")
+	if got, err := rotated.Verify(old); err != nil || got.FilePath != d.FilePath {
+		t.Errorf("token signed with the previous secret: %+v, %v", got, err)
+	}
+	// New tokens are signed with the current secret
+	token, err := rotated.Sign(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDownloadSigner("new-secret", "").Verify(token); err != nil {
+		t.Errorf("token signed after rotating: %v", err)
+	}
+
+	// Once the previous secret is dropped its tokens stop working
+	if _, err := NewDownloadSigner("new-secret", "").Verify(old); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token signed with a dropped secret: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestDownloadSignerDisabled(t *testing.T) {
+	s := NewDownloadSigner("", "old-secret")
+	if s.Enabled() {
+		t.Error("signer without a current secret is enabled")
+	}
+	if _, err := s.Sign(signedDownload()); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("sign: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestDownloadSignerDecodeMalformed(t *testing.T) {
+	s := NewDownloadSigner("current-secret", "")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("not json"))
+	signedGarbage := encoded + "." + base64.RawURLEncoding.EncodeToString(mac([]byte("current-secret"), encoded))
+
+	for _, token := range []string{
+		"",
+		"no-separator",
+		".",
+		"payload.!!not-base64!!",
+		"!!not-base64!!." + base64.RawURLEncoding.EncodeToString(mac([]byte("current-secret"), "!!not-base64!!")),
+		signedGarbage,
+	} {
+		if d, err := s.Decode(token); !errors.Is(err, ErrInvalidToken) || d != nil {
+			t.Errorf("Decode(%q) = %+v, %v; want ErrInvalidToken", token, d, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// TicketTTL is how long an SSE ticket may be redeemed for
+const TicketTTL = 30 * time.Second
+
+// ticket is what a ticket stands in for
+type ticket struct {
+	claims    Claims
+	expiresAt time.Time
+}
+
+// TicketStore issues single-use opaque tickets that stand in for an access
+// token where no Authorization header can be sent, as with EventSource, so
+// the JWT itself never ends up in a URL. Tickets are kept in memory: they
+// only redeem on the instance that issued them, and a restart drops them.
+type TicketStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	tickets map[string]ticket
+}
+
+// NewTicketStore creates a store whose tickets expire after ttl
+func NewTicketStore(ttl time.Duration) *TicketStore {
+	return &TicketStore{
+		ttl:     ttl,
+		tickets: make(map[string]ticket),
+	}
+}
+
+// Issue returns a new ticket for the user the claims belong to
+func (s *TicketStore) Issue(claims Claims) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Sweep unredeemed tickets here rather than from a janitor goroutine;
+	// there are only ever a handful
+	for k, t := range s.tickets {
+		if now.After(t.expiresAt) {
+			delete(s.tickets, k)
+		}
+	}
+	s.tickets[id] = ticket{claims: claims, expiresAt: now.Add(s.ttl)}
+	return id, nil
+}
+
+// Redeem uses up a ticket, returning the claims it was issued for. It
+// returns false for unknown, expired or already redeemed tickets.
+func (s *TicketStore) Redeem(id string) (*Claims, bool) {
+	s.mu.Lock()
+	t, ok := s.tickets[id]
+	delete(s.tickets, id)
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(t.expiresAt) {
+		return nil, false
+	}
+	return &t.claims, true
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTicketStoreRedeem(t *testing.T) {
+	s := NewTicketStore(TicketTTL)
+	id, err := s.Issue(Claims{UserID: "u1", Role: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, ok := s.Redeem(id)
+	if !ok || claims.UserID != "u1" || claims.Role != "user" {
+		t.Fatalf("first redeem = %+v, %v", claims, ok)
+	}
+	// Single use
+	if _, ok := s.Redeem(id); ok {
+		t.Fatal("ticket redeemed twice")
+	}
+	if _, ok := s.Redeem("unknown"); ok {
+		t.Fatal("unknown ticket redeemed")
+	}
+	if _, ok := s.Redeem(""); ok {
+		t.Fatal("empty ticket redeemed")
+	}
+}
+
+func TestTicketStoreExpiry(t *testing.T) {
+	s := NewTicketStore(TicketTTL)
+	expired, _ := s.Issue(Claims{UserID: "u1"})
+	live, _ := s.Issue(Claims{UserID: "u2"})
+	s.mu.Lock()
+	s.tickets[expired] = ticket{claims: s.tickets[expired].claims, expiresAt: time.Now().Add(-time.Millisecond)}
+	s.mu.Unlock()
+
+	if _, ok := s.Redeem(expired); ok {
+		t.Error("expired ticket redeemed")
+	}
+	if claims, ok := s.Redeem(live); !ok || claims.UserID != "u2" {
+		t.Errorf("live ticket: %+v, %v", claims, ok)
+	}
+
+	// Issuing sweeps tickets that expired unredeemed
+	stale, _ := s.Issue(Claims{UserID: "u3"})
+	s.mu.Lock()
+	s.tickets[stale] = ticket{expiresAt: time.Now().Add(-time.Millisecond)}
+	s.mu.Unlock()
+	s.Issue(Claims{UserID: "u4"})
+	s.mu.Lock()
+	_, kept := s.tickets[stale]
+	s.mu.Unlock()
+	if kept {
+		t.Error("expired ticket not swept")
+	}
+}
+
+func TestTicketStoreConcurrentRedeem(t *testing.T) {
+	s := NewTicketStore(TicketTTL)
+	id, _ := s.Issue(Claims{UserID: "u1"})
+
+	var redeemed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := s.Redeem(id); ok {
+				redeemed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := redeemed.Load(); n != 1 {
+		t.Fatalf("ticket redeemed %d times, want 1", n)
+	}
+}
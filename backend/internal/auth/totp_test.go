@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		step, ok := ValidateTOTP(secret, v.code, time.Unix(v.unix, 0))
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("code %s at %d: step %d, %v", v.code, v.unix, step, ok)
+		}
+	}
+
+	at := time.Unix(1234567890, 0)
+	tests := []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{"a step late", at.Add(totpPeriod * time.Second), true},
+		{"a step early", at.Add(-totpPeriod * time.Second), true},
+		{"two steps late", at.Add(2 * totpPeriod * time.Second), false},
+	}
+	for _, tt := range tests {
+		if step, ok := ValidateTOTP(secret, "005924", tt.at); ok != tt.ok || ok && step != at.Unix()/totpPeriod {
+			t.Errorf("%s: step %d, %v", tt.name, step, ok)
+		}
+	}
+	for _, code := range []string{"", "5924", "0059240", "005925"} {
+		if _, ok := ValidateTOTP(secret, code, at); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := ValidateTOTP("", "005924", at); ok {
+		t.Error("empty secret accepted")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	key, _ := totpEncoding.DecodeString(secret)
+	if _, ok := ValidateTOTP(secret, totpCode(key, now.Unix()/totpPeriod), now); !ok {
+		t.Errorf("current code for %s refused", secret)
+	}
+
+	u, err := url.Parse(TOTPURI(secret, "a+b@example.com"))
+	if err != nil || u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/CT-SaaS:a+b@example.com" ||
+		u.Query().Get("secret") != secret || u.Query().Get("issuer") != "CT-SaaS" {
+		t.Errorf("uri %v: %v", u, err)
+	}
+}
@@ -0,0 +1,241 @@
+// Package backup exports application state to a tar file and restores it
+// into a fresh database. A backup holds users, subscriptions, plans,
+// collections, invites, torrents, usage logs, abuse reports and runtime
+// settings as JSON lines, one file per table, after a manifest. Downloaded data is not included.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+)
+
+// FormatVersion is the version of the backup layout
+const FormatVersion = 1
+
+// manifestName is the first entry of a backup
+const manifestName = "manifest.json"
+
+// Manifest describes a backup. Tables are in the order they restore in.
+type Manifest struct {
+	FormatVersion int         `json:"format_version"`
+	SchemaVersion int         `json:"schema_version"`
+	CreatedAt     time.Time   `json:"created_at"`
+	Tables        []TableInfo `json:"tables"`
+}
+
+// TableInfo is one table of a backup
+type TableInfo struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Rows int64  `json:"rows"`
+}
+
+// Snapshot is an export spooled to a temporary directory, so that database
+// errors surface before anything is written to the client and the tar
+// entries' sizes are known. Close removes it.
+type Snapshot struct {
+	dir      string
+	Manifest Manifest
+}
+
+// Export reads every backup table into a snapshot
+func Export(ctx context.Context, db *database.Database) (*Snapshot, error) {
+	dir, err := os.MkdirTemp("", "ct-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{dir: dir, Manifest: Manifest{
+		FormatVersion: FormatVersion,
+		SchemaVersion: database.SchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+	}}
+
+	for _, table := range database.BackupTables {
+		info, err := s.exportTable(ctx, db, table)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		s.Manifest.Tables = append(s.Manifest.Tables, info)
+	}
+	return s, nil
+}
+
+func (s *Snapshot) exportTable(ctx context.Context, db *database.Database, table string) (TableInfo, error) {
+	info := TableInfo{Name: table, File: table + ".jsonl"}
+	f, err := os.Create(filepath.Join(s.dir, info.File))
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	info.Rows, err = db.ExportTable(ctx, table, func(row []byte) error {
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	})
+	if err != nil {
+		return info, err
+	}
+	if err := w.Flush(); err != nil {
+		return info, err
+	}
+	return info, f.Close()
+}
+
+// WriteTar writes the snapshot as a tar: the manifest, then each table
+func (s *Snapshot) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	manifest, err := json.MarshalIndent(s.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0o600,
+		Size:    int64(len(manifest)),
+		ModTime: s.Manifest.CreatedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, table := range s.Manifest.Tables {
+		if err := s.writeTable(tw, table); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (s *Snapshot) writeTable(tw *tar.Writer, table TableInfo) error {
+	f, err := os.Open(filepath.Join(s.dir, table.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    table.File,
+		Mode:    0o600,
+		Size:    info.Size(),
+		ModTime: s.Manifest.CreatedAt,
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Close removes the snapshot's temporary files
+func (s *Snapshot) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// Restore imports a backup read from r into db, which must be migrated and
+// empty. The backup must come from this schema version, and every table
+// must hold the rows its manifest counts; otherwise nothing is imported.
+func Restore(ctx context.Context, db *database.Database, r io.Reader) (*Manifest, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if hdr.Name != manifestName {
+		return nil, errors.New("not a backup: manifest.json must come first")
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("backup format %d is not supported (want %d)", manifest.FormatVersion, FormatVersion)
+	}
+	if manifest.SchemaVersion != database.SchemaVersion {
+		return nil, fmt.Errorf("backup is of schema version %d, this build has %d; restore with the build that took it",
+			manifest.SchemaVersion, database.SchemaVersion)
+	}
+
+	tables := make(map[string]TableInfo)
+	for _, t := range manifest.Tables {
+		tables[t.File] = t
+	}
+
+	err = db.Restore(ctx, func(insert func(table string, row []byte) error) error {
+		restored := make(map[string]bool)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read backup: %w", err)
+			}
+			table, ok := tables[hdr.Name]
+			if !ok {
+				return fmt.Errorf("unexpected entry %s", hdr.Name)
+			}
+
+			n, err := restoreTable(tr, table.Name, insert)
+			if err != nil {
+				return fmt.Errorf("failed to restore %s: %w", table.Name, err)
+			}
+			if n != table.Rows {
+				return fmt.Errorf("%s has %d rows, the manifest says %d", table.Name, n, table.Rows)
+			}
+			restored[hdr.Name] = true
+		}
+		for _, t := range manifest.Tables {
+			if !restored[t.File] {
+				return fmt.Errorf("backup is truncated: %s is missing", t.File)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// restoreTable inserts each JSON line read from r, returning how many
+func restoreTable(r io.Reader, table string, insert func(table string, row []byte) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var n int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			if err := insert(table, line); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
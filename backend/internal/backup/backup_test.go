@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// tarOf builds a tar of the given entries, in order
+func tarOf(t *testing.T, entries ...[2]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0o600, Size: int64(len(e[1]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func manifestOf(t *testing.T, m Manifest) string {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestRestoreRejects covers backups refused before the database is touched
+func TestRestoreRejects(t *testing.T) {
+	current := Manifest{FormatVersion: FormatVersion, SchemaVersion: database.SchemaVersion}
+	tests := []struct {
+		name   string
+		backup *bytes.Buffer
+		want   string
+	}{
+		{"not a tar", bytes.NewBufferString("hello"), "failed to read backup"},
+		{"empty", tarOf(t), "failed to read backup"},
+		{"manifest not first", tarOf(t, [2]string{"users.jsonl", "{}\n"}, [2]string{manifestName, manifestOf(t, current)}), "manifest.json must come first"},
+		{"invalid manifest", tarOf(t, [2]string{manifestName, "{"}), "invalid manifest"},
+		{"other format", tarOf(t, [2]string{manifestName, manifestOf(t, Manifest{FormatVersion: FormatVersion + 1, SchemaVersion: database.SchemaVersion})}), "format"},
+		{"other schema", tarOf(t, [2]string{manifestName, manifestOf(t, Manifest{FormatVersion: FormatVersion, SchemaVersion: database.SchemaVersion - 1})}), "schema version"},
+	}
+	for _, tt := range tests {
+		_, err := Restore(context.Background(), nil, tt.backup)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRestoreTable(t *testing.T) {
+	var rows []string
+	insert := func(table string, row []byte) error {
+		rows = append(rows, table+" "+string(row))
+		return nil
+	}
+	n, err := restoreTable(strings.NewReader("{\"a\":1}\n\n{\"a\":2}"), "users", insert)
+	if err != nil || n != 2 || len(rows) != 2 || rows[1] != `users {"a":2}` {
+		t.Errorf("restoreTable = %d, %v; rows %q", n, err, rows)
+	}
+
+	failed := errors.New("insert failed")
+	n, err = restoreTable(strings.NewReader("{}\n{}\n"), "users", func(string, []byte) error { return failed })
+	if !errors.Is(err, failed) || n != 0 {
+		t.Errorf("failing insert: %d, %v", n, err)
+	}
+}
+
+// TestRoundTrip exports TEST_DATABASE_URL and restores it into
+// TEST_RESTORE_DATABASE_URL, whose backup tables it empties first
+func TestRoundTrip(t *testing.T) {
+	srcURL, dstURL := os.Getenv("TEST_DATABASE_URL"), os.Getenv("TEST_RESTORE_DATABASE_URL")
+	if srcURL == "" || dstURL == "" {
+		t.Skip("TEST_DATABASE_URL and TEST_RESTORE_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	connect := func(url string) *database.Database {
+		t.Helper()
+		db, err := database.New(url, false)
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		t.Cleanup(db.Close)
+		if err := db.Migrate(ctx); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+		return db
+	}
+	src, dst := connect(srcURL), connect(dstURL)
+
+	pool, err := pgxpool.New(ctx, dstURL)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	tables := make([]string, 0, len(database.BackupTables))
+	for _, table := range database.BackupTables {
+		if table != "plans" {
+			tables = append(tables, pgx.Identifier{table}.Sanitize())
+		}
+	}
+	if _, err := pool.Exec(ctx, `TRUNCATE `+strings.Join(tables, ", ")+` CASCADE`); err != nil {
+		t.Fatalf("empty the restore database: %v", err)
+	}
+
+	user, err := src.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	tr := &models.Torrent{UserID: user.ID, InfoHash: uuid.NewString(), Name: "backed up", Status: models.TorrentStatusCompleted}
+	if err := src.CreateTorrent(ctx, tr); err != nil {
+		t.Fatalf("create torrent: %v", err)
+	}
+
+	snapshot, err := Export(ctx, src)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	defer snapshot.Close()
+	var backup bytes.Buffer
+	if err := snapshot.WriteTar(&backup); err != nil {
+		t.Fatalf("write tar: %v", err)
+	}
+
+	// A truncated backup restores nothing
+	truncated := bytes.NewReader(backup.Bytes()[:backup.Len()/2])
+	if _, err := Restore(ctx, dst, truncated); err == nil {
+		t.Fatal("truncated backup restored")
+	}
+
+	manifest, err := Restore(ctx, dst, bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	for _, table := range manifest.Tables {
+		n, err := dst.ExportTable(ctx, table.Name, func([]byte) error { return nil })
+		if err != nil || n != table.Rows {
+			t.Errorf("%s: %d rows restored, %v; exported %d", table.Name, n, err, table.Rows)
+		}
+	}
+
+	got, err := dst.GetTorrent(ctx, tr.ID)
+	if err != nil || got == nil || got.UserID != user.ID || got.Name != tr.Name {
+		t.Fatalf("restored torrent: %+v, %v", got, err)
+	}
+	owner, err := dst.GetUserByID(ctx, got.UserID)
+	if err != nil || owner == nil || owner.Email != user.Email {
+		t.Errorf("restored torrent's owner: %+v, %v", owner, err)
+	}
+
+	if _, err := Restore(ctx, dst, bytes.NewReader(backup.Bytes())); !errors.Is(err, database.ErrNotEmpty) {
+		t.Errorf("restore into a restored database: err = %v, want ErrNotEmpty", err)
+	}
+}
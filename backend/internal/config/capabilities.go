@@ -0,0 +1,89 @@
+package config
+
+import "strings"
+
+// MaxRequestBody bounds request bodies, .torrent uploads included
+const MaxRequestBody = 50 * 1024 * 1024
+
+// Registration modes
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+// Address families the torrent client listens and reaches peers on
+const (
+	IPFamilyDual = "dual"
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+// Capabilities are the optional features this deployment supports. Handlers
+// gate on these rather than on the settings behind them, so what
+// GET /capabilities reports can't drift from what the API does.
+type Capabilities struct {
+	Billing          bool   `json:"billing_enabled"`
+	Email            bool   `json:"email_enabled"`
+	S3Storage        bool   `json:"s3_storage"`
+	Transcoding      bool   `json:"transcoding"`
+	Seeding          bool   `json:"seeding"`
+	RegistrationMode string `json:"registration_mode"` // open, invite or closed
+	SignedURLs       bool   `json:"signed_urls"`
+	MaxUploadSize    int64  `json:"max_upload_size"` // bytes per request
+
+	// Search is only present when providers are configured
+	Search          bool     `json:"search,omitempty"`
+	SearchProviders []string `json:"search_providers,omitempty"`
+
+	// CaptchaSiteKey is set when abuse reports need a CAPTCHA
+	CaptchaSiteKey string `json:"captcha_site_key,omitempty"`
+}
+
+// Capabilities derives the deployment's features from its configuration
+func (c *Config) Capabilities() Capabilities {
+	return Capabilities{
+		Billing: c.StripeSecretKey != "",
+		Email:   c.SMTPHost != "",
+		// STORAGE_TYPE=s3 isn't implemented yet; data is always stored locally
+		S3Storage:   false,
+		Transcoding: false,
+		// Private torrents seed to their plan's ratio once complete
+		Seeding:          true,
+		RegistrationMode: c.registrationMode(),
+		SignedURLs:       c.DownloadSigningSecret != "",
+		MaxUploadSize:    MaxRequestBody,
+		Search:           len(c.SearchProviders) > 0,
+		SearchProviders:  c.searchProviderNames(),
+		CaptchaSiteKey:   c.captchaSiteKey(),
+	}
+}
+
+// captchaSiteKey is the CAPTCHA site key, unless no secret is set to
+// check answers with
+func (c *Config) captchaSiteKey() string {
+	if c.CaptchaSecret == "" {
+		return ""
+	}
+	return c.CaptchaSiteKey
+}
+
+// searchProviderNames lists the configured search providers by name
+func (c *Config) searchProviderNames() []string {
+	var names []string
+	for _, p := range c.SearchProviders {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// registrationMode is the configured registration mode; anything unknown is
+// treated as closed
+func (c *Config) registrationMode() string {
+	switch mode := strings.ToLower(strings.TrimSpace(c.RegistrationMode)); mode {
+	case RegistrationOpen, RegistrationInvite:
+		return mode
+	default:
+		return RegistrationClosed
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package config
+
+// freeSpace can't be checked here; MIN_FREE_SPACE_GB is not enforced
+func freeSpace(dir string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
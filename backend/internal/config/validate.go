@@ -0,0 +1,225 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// requiredInProduction must be set explicitly in production; their
+// defaults only suit a development machine
+var requiredInProduction = []string{"DATABASE_URL", "JWT_SECRET", "DOWNLOAD_DIR"}
+
+// errFreeSpaceUnsupported is returned by freeSpace where it can't be read
+var errFreeSpaceUnsupported = errors.New("free space can't be checked on this platform")
+
+// Validate checks the configuration as a whole and returns every problem
+// found, one per line, or nil. The server refuses to start on any.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Environment == "production" {
+		for _, key := range requiredInProduction {
+			if os.Getenv(key) == "" {
+				problems = append(problems, key+" must be set in production")
+			}
+		}
+		if c.DBLogQueries {
+			problems = append(problems, "DB_LOG_QUERIES must not be set in production; query metrics are kept without it")
+		}
+	}
+
+	if err := checkWritableDir(c.DownloadDir); err != nil {
+		problems = append(problems, "DOWNLOAD_DIR: "+err.Error())
+	} else if c.MinFreeSpaceGB > 0 {
+		free, err := freeSpace(c.DownloadDir)
+		switch {
+		case errors.Is(err, errFreeSpaceUnsupported):
+		case err != nil:
+			problems = append(problems, "DOWNLOAD_DIR: failed to check free space: "+err.Error())
+		case free < int64(c.MinFreeSpaceGB)<<30:
+			problems = append(problems, fmt.Sprintf("DOWNLOAD_DIR has %.1f GB free, MIN_FREE_SPACE_GB requires %d",
+				float64(free)/(1<<30), c.MinFreeSpaceGB))
+		}
+	}
+	if err := checkWritableDir(c.UploadDir); err != nil {
+		problems = append(problems, "UPLOAD_DIR: "+err.Error())
+	}
+
+	if c.FrontendDir != "" {
+		if info, err := os.Stat(filepath.Join(c.FrontendDir, "index.html")); err != nil {
+			problems = append(problems, "FRONTEND_DIR: "+err.Error())
+		} else if !info.Mode().IsRegular() {
+			problems = append(problems, "FRONTEND_DIR: index.html is not a file")
+		}
+	}
+
+	if c.PublicBaseURL != "" {
+		if u, err := url.Parse(c.PublicBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.RawQuery != "" || u.Fragment != "" {
+			problems = append(problems, fmt.Sprintf("PUBLIC_BASE_URL %q is not an absolute http(s) URL", c.PublicBaseURL))
+		}
+	}
+
+	for _, entry := range c.AdminIPAllowlist {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			if _, err := netip.ParseAddr(entry); err != nil {
+				problems = append(problems, fmt.Sprintf("ADMIN_IP_ALLOWLIST entry %q is not an IP or CIDR", entry))
+			}
+		}
+	}
+
+	switch c.TorrentIPFamily {
+	case IPFamilyDual, IPFamilyIPv4, IPFamilyIPv6:
+		// A literal listen address must be of a family the client uses
+		if ip, err := netip.ParseAddr(c.TorrentListenAddr); err == nil &&
+			(c.TorrentIPFamily == IPFamilyIPv4 && ip.Unmap().Is6() || c.TorrentIPFamily == IPFamilyIPv6 && ip.Unmap().Is4()) {
+			problems = append(problems, fmt.Sprintf("TORRENT_LISTEN_ADDR %s is not an %s address", c.TorrentListenAddr, c.TorrentIPFamily))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("TORRENT_IP_FAMILY %q is not dual, ipv4 or ipv6", c.TorrentIPFamily))
+	}
+
+	if (c.StripeSecretKey == "") != (c.StripeWebhookKey == "") {
+		problems = append(problems, "STRIPE_SECRET_KEY and STRIPE_WEBHOOK_KEY must be set together")
+	}
+	if c.SMTPHost != "" && (c.SMTPUsername == "") != (c.SMTPPassword == "") {
+		problems = append(problems, "SMTP_USERNAME and SMTP_PASSWORD must be set together")
+	}
+	if (c.CaptchaSecret == "") != (c.CaptchaSiteKey == "") {
+		problems = append(problems, "CAPTCHA_SECRET and CAPTCHA_SITE_KEY must be set together")
+	}
+	if c.DownloadSigningSecretPrevious != "" && c.DownloadSigningSecret == "" {
+		problems = append(problems, "DOWNLOAD_SIGNING_SECRET_PREVIOUS is set without DOWNLOAD_SIGNING_SECRET")
+	}
+	switch c.EngineMode {
+	case EngineLocal:
+	case EngineRemote:
+		if c.EngineToken == "" {
+			problems = append(problems, "ENGINE_TOKEN is required with ENGINE_MODE=remote")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("ENGINE_MODE %q is not local or remote", c.EngineMode))
+	}
+	if c.FailedRetentionDays < MinFailedRetentionDays || c.FailedRetentionDays > MaxFailedRetentionDays {
+		problems = append(problems, fmt.Sprintf("FAILED_RETENTION_DAYS must be between %d and %d",
+			MinFailedRetentionDays, MaxFailedRetentionDays))
+	}
+	if c.SessionMaxAge < 0 {
+		problems = append(problems, "SESSION_MAX_AGE_DAYS must not be negative")
+	}
+	switch strings.ToLower(strings.TrimSpace(c.RegistrationMode)) {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	default:
+		problems = append(problems, fmt.Sprintf("REGISTRATION_MODE %q is not open, invite or closed", c.RegistrationMode))
+	}
+	hooks := [][2]string{
+		{"HOOK_TORRENT_ADDED", c.HookTorrentAdded},
+		{"HOOK_TORRENT_COMPLETED", c.HookTorrentCompleted},
+		{"HOOK_TORRENT_DELETED", c.HookTorrentDeleted},
+		{"HOOK_USER_REGISTERED", c.HookUserRegistered},
+	}
+	var anyHook bool
+	for _, hook := range hooks {
+		args := strings.Fields(hook[1])
+		if len(args) == 0 {
+			continue
+		}
+		anyHook = true
+		if _, err := exec.LookPath(args[0]); err != nil {
+			problems = append(problems, hook[0]+": "+err.Error())
+		}
+	}
+	if anyHook && c.HookTimeout <= 0 {
+		problems = append(problems, "HOOK_TIMEOUT_SECONDS must be positive when a hook is set")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("  - " + strings.Join(problems, "\n  - "))
+}
+
+// checkWritableDir creates dir if needed and checks a file can be written in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Summary describes the effective configuration for the startup log, with
+// secrets reduced to whether they are set
+func (c *Config) Summary() string {
+	lines := []string{
+		"environment=" + c.Environment,
+		"port=" + c.Port,
+		"frontend_url=" + c.FrontendURL,
+		"public_base_url=" + orNone(c.PublicBaseURL),
+		"registration=" + c.RegistrationMode,
+		"database=" + redactURL(c.DatabaseURL),
+		"redis=" + redactURL(c.RedisURL),
+		"jwt_secret=" + secretState("JWT_SECRET", c.JWTSecret),
+		"download_signing=" + secretState("DOWNLOAD_SIGNING_SECRET", c.DownloadSigningSecret),
+		"download_dir=" + c.DownloadDir,
+		"upload_dir=" + c.UploadDir,
+		"frontend_dir=" + orNone(c.FrontendDir),
+		fmt.Sprintf("torrent_port=%d", c.DefaultPort),
+		"engine=" + c.engineSummary(),
+		"storage=" + c.StorageType,
+		"stripe=" + secretState("STRIPE_SECRET_KEY", c.StripeSecretKey),
+		"smtp=" + orNone(c.SMTPHost),
+		fmt.Sprintf("search_providers=%d", len(c.SearchProviders)),
+		"trusted_proxies=" + orNone(strings.Join(c.TrustedProxies, ",")),
+		"admin_ip_allowlist=" + orNone(strings.Join(c.AdminIPAllowlist, ",")),
+		fmt.Sprintf("admin_require_2fa=%t", c.AdminRequire2FA),
+		fmt.Sprintf("failed_retention_days=%d", c.FailedRetentionDays),
+	}
+	return strings.Join(lines, " ")
+}
+
+func (c *Config) engineSummary() string {
+	if c.EngineMode == EngineRemote {
+		return "remote:" + c.EngineAddr + " token=" + secretState("ENGINE_TOKEN", c.EngineToken)
+	}
+	return c.EngineMode
+}
+
+// redactURL hides a URL's password, and the whole URL if it won't parse
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
+
+// secretState says whether a secret is set, and if it was generated rather
+// than read from key
+func secretState(key, value string) string {
+	switch {
+	case value == "":
+		return "unset"
+	case os.Getenv(key) == "":
+		return "generated"
+	default:
+		return "set"
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validConfig is a development configuration that passes Validate
+func validConfig(t *testing.T) *Config {
+	t.Helper()
+	return &Config{
+		Environment:         "development",
+		DownloadDir:         filepath.Join(t.TempDir(), "downloads"),
+		UploadDir:           filepath.Join(t.TempDir(), "uploads"),
+		TorrentIPFamily:     IPFamilyDual,
+		EngineMode:          EngineLocal,
+		RegistrationMode:    RegistrationOpen,
+		FailedRetentionDays: 30,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig(t).Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	frontend := t.TempDir()
+	if err := os.WriteFile(filepath.Join(frontend, "index.html"), []byte("<html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // a problem Validate must report, "" for none
+	}{
+		{"download dir is a file", func(c *Config) { c.DownloadDir = file }, "DOWNLOAD_DIR"},
+		{"upload dir is a file", func(c *Config) { c.UploadDir = file }, "UPLOAD_DIR"},
+
+		{"frontend with index.html", func(c *Config) { c.FrontendDir = frontend }, ""},
+		{"frontend without index.html", func(c *Config) { c.FrontendDir = t.TempDir() }, "FRONTEND_DIR"},
+
+		{"public base url", func(c *Config) { c.PublicBaseURL = "https://dl.example.com/ct" }, ""},
+		{"relative public base url", func(c *Config) { c.PublicBaseURL = "dl.example.com" }, "PUBLIC_BASE_URL"},
+		{"public base url with query", func(c *Config) { c.PublicBaseURL = "https://dl.example.com/?a=1" }, "PUBLIC_BASE_URL"},
+
+		{"ipv4 family", func(c *Config) { c.TorrentIPFamily = IPFamilyIPv4; c.TorrentListenAddr = "0.0.0.0" }, ""},
+		{"ipv6 family", func(c *Config) { c.TorrentIPFamily = IPFamilyIPv6; c.TorrentListenAddr = "::" }, ""},
+		{"unknown family", func(c *Config) { c.TorrentIPFamily = "ipx" }, "TORRENT_IP_FAMILY"},
+		{"ipv6 address for ipv4", func(c *Config) { c.TorrentIPFamily = IPFamilyIPv4; c.TorrentListenAddr = "::1" }, "TORRENT_LISTEN_ADDR"},
+		{"ipv4 address for ipv6", func(c *Config) { c.TorrentIPFamily = IPFamilyIPv6; c.TorrentListenAddr = "127.0.0.1" }, "TORRENT_LISTEN_ADDR"},
+
+		{"stripe pair", func(c *Config) { c.StripeSecretKey = "sk"; c.StripeWebhookKey = "whsec" }, ""},
+		{"stripe secret alone", func(c *Config) { c.StripeSecretKey = "sk" }, "STRIPE_SECRET_KEY and STRIPE_WEBHOOK_KEY"},
+		{"stripe webhook alone", func(c *Config) { c.StripeWebhookKey = "whsec" }, "STRIPE_SECRET_KEY and STRIPE_WEBHOOK_KEY"},
+		{"smtp without auth", func(c *Config) { c.SMTPHost = "mail" }, ""},
+		{"smtp user alone", func(c *Config) { c.SMTPHost = "mail"; c.SMTPUsername = "u" }, "SMTP_USERNAME and SMTP_PASSWORD"},
+		{"captcha secret alone", func(c *Config) { c.CaptchaSecret = "s" }, "CAPTCHA_SECRET and CAPTCHA_SITE_KEY"},
+		{"previous signing secret alone", func(c *Config) { c.DownloadSigningSecretPrevious = "old" }, "DOWNLOAD_SIGNING_SECRET_PREVIOUS"},
+
+		{"remote engine", func(c *Config) { c.EngineMode = EngineRemote; c.EngineToken = "t" }, ""},
+		{"remote engine without token", func(c *Config) { c.EngineMode = EngineRemote }, "ENGINE_TOKEN"},
+		{"unknown engine mode", func(c *Config) { c.EngineMode = "cluster" }, "ENGINE_MODE"},
+
+		{"admin allowlist", func(c *Config) { c.AdminIPAllowlist = []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"} }, ""},
+		{"invalid admin allowlist entry", func(c *Config) { c.AdminIPAllowlist = []string{"10.0.0.0/8", "office"} }, "ADMIN_IP_ALLOWLIST"},
+
+		{"negative session age", func(c *Config) { c.SessionMaxAge = -1 }, "SESSION_MAX_AGE_DAYS"},
+		{"no failed retention", func(c *Config) { c.FailedRetentionDays = 0 }, "FAILED_RETENTION_DAYS"},
+		{"failed retention too long", func(c *Config) { c.FailedRetentionDays = MaxFailedRetentionDays + 1 }, "FAILED_RETENTION_DAYS"},
+		{"registration mode any case", func(c *Config) { c.RegistrationMode = " Invite " }, ""},
+		{"unknown registration mode", func(c *Config) { c.RegistrationMode = "sometimes" }, "REGISTRATION_MODE"},
+
+		{"hook found", func(c *Config) { c.HookTorrentAdded = "sh -c true"; c.HookTimeout = 5 }, ""},
+		{"hook not found", func(c *Config) { c.HookTorrentAdded = "/nonexistent/hook arg"; c.HookTimeout = 5 }, "HOOK_TORRENT_ADDED"},
+		{"hook without timeout", func(c *Config) { c.HookTorrentDeleted = "sh"; c.HookTimeout = 0 }, "HOOK_TIMEOUT_SECONDS"},
+	}
+	for _, tt := range tests {
+		c := validConfig(t)
+		tt.change(c)
+		err := c.Validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: unexpected problems:\n%v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: got %v, want a problem about %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateFreeSpace(t *testing.T) {
+	if _, err := freeSpace(t.TempDir()); errors.Is(err, errFreeSpaceUnsupported) {
+		t.Skip(err)
+	}
+	c := validConfig(t)
+	c.MinFreeSpaceGB = 1 << 30
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "MIN_FREE_SPACE_GB") {
+		t.Errorf("got %v, want a problem about MIN_FREE_SPACE_GB", err)
+	}
+}
+
+func TestValidateProduction(t *testing.T) {
+	for _, key := range requiredInProduction {
+		t.Setenv(key, "")
+	}
+	c := validConfig(t)
+	c.Environment = "production"
+	c.DBLogQueries = true
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("production config without required settings passed")
+	}
+	// Every problem is reported, not just the first
+	for _, want := range append(requiredInProduction, "DB_LOG_QUERIES") {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("problems don't mention %s:\n%v", want, err)
+		}
+	}
+
+	for _, key := range requiredInProduction {
+		t.Setenv(key, "set")
+	}
+	c.DBLogQueries = false
+	if err := c.Validate(); err != nil {
+		t.Errorf("complete production config: %v", err)
+	}
+}
+
+func TestSummaryHidesSecrets(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	c := validConfig(t)
+	c.DatabaseURL = "postgres://app:hunter2@db/app"
+	c.JWTSecret = "generated-secret"
+	c.StripeSecretKey = "sk_live_secret"
+	t.Setenv("STRIPE_SECRET_KEY", c.StripeSecretKey)
+
+	summary := c.Summary()
+	for _, secret := range []string{"hunter2", "generated-secret", "sk_live_secret"} {
+		if strings.Contains(summary, secret) {
+			t.Errorf("summary shows %q: %s", secret, summary)
+		}
+	}
+	for _, want := range []string{"jwt_secret=generated", "stripe=set", "database=postgres://app:xxxxx@db/app"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary lacks %q: %s", want, summary)
+		}
+	}
+}
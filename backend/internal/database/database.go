@@ -3,20 +3,41 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/freetorrent/freetorrent/internal/models"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// OperationTimeout bounds a single database call made from a background job,
+// so one hung query can't stall the loop that issued it
+const OperationTimeout = 5 * time.Second
+
 type Database struct {
 	pool *pgxpool.Pool
+
+	// plans caches the plans table, see GetPlans
+	planMu       sync.RWMutex
+	plans        map[string]models.Plan
+	plansExpires time.Time
+
+	// tracer times every query, see QueryMetrics
+	tracer *queryTracer
 }
 
-func New(databaseURL string) (*Database, error) {
+// New connects to the database. With logQueries set every statement is
+// logged with its duration, rows and request ID; see queryTracer.
+func New(databaseURL string, logQueries bool) (*Database, error) {
 	config, err := pgxpool.ParseConfig(databaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse database URL: %w", err)
@@ -26,6 +47,18 @@ func New(databaseURL string) (*Database, error) {
 	config.MinConns = 5
 	config.MaxConnLifetime = time.Hour
 	config.MaxConnIdleTime = 30 * time.Minute
+	tracer := &queryTracer{logQueries: logQueries}
+	config.ConnConfig.Tracer = tracer
+	// Times come back in UTC rather than the host's zone, which is what the
+	// API serializes. Users' own zones only apply to messages.
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		conn.TypeMap().RegisterType(&pgtype.Type{
+			Name:  "timestamptz",
+			OID:   pgtype.TimestamptzOID,
+			Codec: &pgtype.TimestamptzCodec{ScanLocation: time.UTC},
+		})
+		return nil
+	}
 
 	pool, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
@@ -36,13 +69,28 @@ func New(databaseURL string) (*Database, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &Database{pool: pool}, nil
+	return &Database{pool: pool, tracer: tracer}, nil
 }
 
 func (db *Database) Close() {
 	db.pool.Close()
 }
 
+// Ping checks a connection to the database can be used
+func (db *Database) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
+}
+
+// WithTimeout derives a context for one database call from a job's parent context
+func WithTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, OperationTimeout)
+}
+
+// SchemaVersion identifies the schema Migrate produces. Bump it when a
+// migration changes a table in BackupTables, or a table joins them, so that
+// backups taken on another version aren't restored into it.
+const SchemaVersion = 12
+
 func (db *Database) Migrate(ctx context.Context) error {
 	schema := `
 	CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
@@ -124,19 +172,311 @@ func (db *Database) Migrate(ctx context.Context) error {
 		created_at TIMESTAMPTZ DEFAULT NOW()
 	);
 
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		key VARCHAR(255) NOT NULL,
+		request_hash VARCHAR(64) NOT NULL,
+		status_code INT NOT NULL DEFAULT 0,
+		content_type VARCHAR(255),
+		response_body BYTEA,
+		torrent_id UUID,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		PRIMARY KEY (user_id, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS uploads (
+		id UUID PRIMARY KEY,
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		filename VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		received BIGINT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS torrent_churn (
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		info_hash VARCHAR(40) NOT NULL,
+		deletes INT NOT NULL DEFAULT 0,
+		window_start TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		cooldown_until TIMESTAMPTZ,
+		PRIMARY KEY (user_id, info_hash)
+	);
+
+	CREATE TABLE IF NOT EXISTS collections (
+		id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		updated_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS invites (
+		id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		code VARCHAR(64) UNIQUE NOT NULL,
+		created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		max_uses INT NOT NULL DEFAULT 1,
+		uses INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS plans (
+		name VARCHAR(50) PRIMARY KEY,
+		limits JSONB NOT NULL,
+		stripe_price_id VARCHAR(255),
+		updated_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS import_jobs (
+		id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		status VARCHAR(20) NOT NULL DEFAULT 'running',
+		total INT NOT NULL,
+		added_ip VARCHAR(45),
+		added_user_agent TEXT,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		finished_at TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS import_items (
+		job_id UUID REFERENCES import_jobs(id) ON DELETE CASCADE,
+		position INT NOT NULL,
+		source TEXT NOT NULL,
+		label VARCHAR(255),
+		collection_id UUID REFERENCES collections(id) ON DELETE SET NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		torrent_id UUID,
+		error TEXT,
+		updated_at TIMESTAMPTZ DEFAULT NOW(),
+		PRIMARY KEY (job_id, position)
+	);
+
+	CREATE TABLE IF NOT EXISTS torrent_consistency (
+		torrent_id UUID PRIMARY KEY REFERENCES torrents(id) ON DELETE CASCADE,
+		problems TEXT[] NOT NULL,
+		found_at TIMESTAMPTZ DEFAULT NOW(),
+		checked_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS notifications (
+		id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(50) NOT NULL,
+		title VARCHAR(255) NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		metadata JSONB,
+		read_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS bandwidth_alerts (
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		period_start TIMESTAMPTZ NOT NULL,
+		threshold INT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		PRIMARY KEY (user_id, period_start, threshold)
+	);
+
+	CREATE TABLE IF NOT EXISTS subscription_events (
+		id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		actor_type VARCHAR(20) NOT NULL,
+		actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+		old_plan VARCHAR(50) NOT NULL,
+		new_plan VARCHAR(50) NOT NULL,
+		old_status VARCHAR(50) NOT NULL,
+		new_status VARCHAR(50) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS abuse_reports (
+		id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		info_hash VARCHAR(40),
+		download_url TEXT,
+		contact VARCHAR(255) NOT NULL,
+		reason TEXT NOT NULL,
+		reporter_ip VARCHAR(45),
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		resolution TEXT,
+		resolved_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		resolved_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS blocked_hashes (
+		info_hash VARCHAR(40) PRIMARY KEY,
+		reason TEXT NOT NULL,
+		report_id UUID REFERENCES abuse_reports(id) ON DELETE SET NULL,
+		blocked_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key VARCHAR(100) PRIMARY KEY,
+		value JSONB NOT NULL,
+		updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		updated_at TIMESTAMPTZ DEFAULT NOW()
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_torrents_user_status ON torrents(user_id, status);
 	CREATE INDEX IF NOT EXISTS idx_torrents_info_hash ON torrents(info_hash);
+	-- Covers the compact list view, see GetCompactTorrentsByUser
+	CREATE INDEX IF NOT EXISTS idx_torrents_user_created ON torrents(user_id, created_at DESC)
+		INCLUDE (id, name, status, progress, total_size, expires_at);
 	CREATE INDEX IF NOT EXISTS idx_download_tokens_token ON download_tokens(token);
+	CREATE INDEX IF NOT EXISTS idx_download_tokens_file ON download_tokens(torrent_id, file_path);
 	CREATE INDEX IF NOT EXISTS idx_usage_logs_user_date ON usage_logs(user_id, created_at);
 	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_hash ON refresh_tokens(token_hash);
+	CREATE INDEX IF NOT EXISTS idx_notifications_user_date ON notifications(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications(user_id) WHERE read_at IS NULL;
+	CREATE INDEX IF NOT EXISTS idx_subscription_events_user_date ON subscription_events(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);
+	CREATE INDEX IF NOT EXISTS idx_uploads_user ON uploads(user_id);
+	CREATE INDEX IF NOT EXISTS idx_collections_user ON collections(user_id);
+	CREATE INDEX IF NOT EXISTS idx_usage_logs_action_date ON usage_logs(action, created_at);
+	CREATE INDEX IF NOT EXISTS idx_usage_logs_created ON usage_logs(created_at);
+	CREATE INDEX IF NOT EXISTS idx_import_jobs_user ON import_jobs(user_id, status);
+	CREATE INDEX IF NOT EXISTS idx_import_items_open ON import_items(job_id, position) WHERE status IN ('pending', 'queued');
+	CREATE INDEX IF NOT EXISTS idx_abuse_reports_status_date ON abuse_reports(status, created_at);
+	CREATE INDEX IF NOT EXISTS idx_abuse_reports_info_hash ON abuse_reports(info_hash);
 
 	-- Migrations for existing databases
 	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS zip_path TEXT;
 	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS zip_size BIGINT DEFAULT 0;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS zip_sha256 VARCHAR(64);
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS zip_manifest JSONB;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ DEFAULT NOW();
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS status_history JSONB DEFAULT '[]';
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS data_missing BOOLEAN DEFAULT FALSE;
+
+	-- Rows completed before completion_logged existed already logged their usage
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS completion_logged BOOLEAN;
+	UPDATE torrents SET completion_logged = (completed_at IS NOT NULL) WHERE completion_logged IS NULL;
+	ALTER TABLE torrents ALTER COLUMN completion_logged SET DEFAULT FALSE;
+
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS metainfo BYTEA;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS retry_count INT DEFAULT 0;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS is_private BOOLEAN DEFAULT FALSE;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS metadata JSONB;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS source VARCHAR(20);
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS added_ip VARCHAR(45);
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS added_user_agent TEXT;
+	ALTER TABLE download_tokens ADD COLUMN IF NOT EXISTS is_directory BOOLEAN DEFAULT FALSE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS default_zip BOOLEAN DEFAULT TRUE;
+	ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS storage_limit_gb INT;
+	UPDATE subscriptions SET storage_limit_gb = CASE plan
+		WHEN 'starter' THEN 100 WHEN 'pro' THEN 1000 WHEN 'unlimited' THEN 4000 ELSE 5 END
+	 WHERE storage_limit_gb IS NULL;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_notifications BOOLEAN DEFAULT TRUE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS current_period_start TIMESTAMPTZ;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS extensions INT DEFAULT 0;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS expiry_warned_at TIMESTAMPTZ;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS auto_zip BOOLEAN;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS collection_id UUID REFERENCES collections(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS idx_torrents_collection ON torrents(collection_id);
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS zip_status VARCHAR(20);
+	UPDATE torrents SET zip_status = 'ready' WHERE zip_status IS NULL AND zip_path IS NOT NULL AND zip_path <> '';
+
+	-- Torrent names as search words, see torrentSearch
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS name_tsv TSVECTOR GENERATED ALWAYS AS
+		(to_tsvector('simple', regexp_replace(COALESCE(name, ''), '`+searchSeparators+`', ' ', 'g'))) STORED;
+	CREATE INDEX IF NOT EXISTS idx_torrents_name_tsv ON torrents USING GIN(name_tsv);
+
+	-- uploaded_size was a per-session counter before upload accounting;
+	-- nothing recorded until now is logged as upload usage
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS upload_logged BIGINT;
+	UPDATE torrents SET upload_logged = COALESCE(uploaded_size, 0) WHERE upload_logged IS NULL;
+	ALTER TABLE torrents ALTER COLUMN upload_logged SET DEFAULT 0;
+
+	-- File counts for list views, which don't read the files JSONB
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS files_completed INT NOT NULL DEFAULT 0;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS files_total INT NOT NULL DEFAULT 0;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS health_warning VARCHAR(30);
+	UPDATE torrents SET files_total = jsonb_array_length(files),
+		files_completed = (SELECT COUNT(*) FROM jsonb_array_elements(files) f WHERE (f->>'progress')::float >= 100)
+	 WHERE files_total = 0 AND jsonb_typeof(files) = 'array' AND jsonb_array_length(files) > 0;
+
+	-- Cross-seed deduplication: file SHA-256s by path, hashed when a
+	-- torrent is compared, and the torrent whose files this one's are hard
+	-- links to. Deleting that one makes this one the owner of the data.
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS file_hashes JSONB;
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS deduplicated_from UUID REFERENCES torrents(id) ON DELETE SET NULL;
+
+	-- The client (X-Client) and version each session signed in from
+	ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS client VARCHAR(32);
+	ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS client_version VARCHAR(32);
+
+	-- When a session signed in, carried across refresh token rotations so
+	-- sessions can be capped in age however often they refresh
+	ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_started_at TIMESTAMPTZ;
+	UPDATE refresh_tokens SET session_started_at = COALESCE(created_at, NOW()) WHERE session_started_at IS NULL;
+	ALTER TABLE refresh_tokens ALTER COLUMN session_started_at SET DEFAULT NOW();
+	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON refresh_tokens(user_id);
+	ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS two_factor BOOLEAN NOT NULL DEFAULT FALSE;
+
+	-- Downloaded bytes at which a torrent resumed on what was left of its
+	-- owner's bandwidth is paused again
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS pause_at_bytes BIGINT;
+
+	-- Why a torrent finished, see models.ClosedReason. Rows finished before
+	-- it was recorded get a best guess from their status and error.
+	ALTER TABLE torrents ADD COLUMN IF NOT EXISTS closed_reason VARCHAR(20);
+	UPDATE torrents SET closed_reason = CASE
+		WHEN status IN ('completed', 'seeding') THEN 'completed'
+		WHEN error_message ILIKE 'disk write error%' THEN 'failed_disk'
+		WHEN error_message ILIKE '%abuse report%' THEN 'dmca'
+		WHEN error_message = 'torrent already added' THEN 'failed_duplicate'
+		WHEN error_message IN ('failed to check torrent', 'failed to save torrent') THEN 'failed_internal'
+		WHEN total_size = 0 OR error_message ILIKE '%metadata%' OR error_message ILIKE '%torrent file%'
+			OR error_message ILIKE '%already active for another user%' THEN 'failed_metadata'
+		ELSE 'failed_stalled' END
+	 WHERE closed_reason IS NULL AND status IN ('completed', 'seeding', 'failed');
+
+	-- Failed and cancelled torrents past their retention, see GetFailedTorrentsBefore
+	CREATE INDEX IF NOT EXISTS idx_torrents_failed_updated ON torrents(updated_at)
+		WHERE status IN ('failed', 'cancelled');
 	`
 
-	_, err := db.pool.Exec(ctx, schema)
-	return err
+	if _, err := db.pool.Exec(ctx, schema); err != nil {
+		return err
+	}
+	return db.seedPlans(ctx)
+}
+
+// seedPlans adds the built-in plans missing from the plans table, so a new
+// deployment starts with them. Plans already there keep their limits, except
+// that limits added since they were saved take the built-in plan's value.
+func (db *Database) seedPlans(ctx context.Context) error {
+	for name, limits := range models.DefaultPlans {
+		data, err := json.Marshal(limits)
+		if err != nil {
+			return err
+		}
+		var priceID *string
+		if id, ok := models.DefaultStripePriceIDs[name]; ok {
+			priceID = &id
+		}
+		if _, err := db.pool.Exec(ctx,
+			`INSERT INTO plans (name, limits, stripe_price_id) VALUES ($1, $2, $3)
+			 ON CONFLICT (name) DO NOTHING`,
+			name, data, priceID); err != nil {
+			return fmt.Errorf("failed to seed plan %s: %w", name, err)
+		}
+		if _, err := db.pool.Exec(ctx,
+			`UPDATE plans SET limits = $2::jsonb || limits, updated_at = NOW()
+			 WHERE name = $1 AND $2::jsonb || limits <> limits`,
+			name, data); err != nil {
+			return fmt.Errorf("failed to update plan %s: %w", name, err)
+		}
+	}
+	db.invalidatePlans()
+	return nil
 }
 
 // User methods
@@ -146,6 +486,9 @@ func (db *Database) CreateUser(ctx context.Context, email, passwordHash string)
 		Email:     email,
 		PasswordHash: passwordHash,
 		Role:      "user",
+		DefaultZip: true,
+		EmailNotifications: true,
+		Timezone:  models.DefaultTimezone,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -159,10 +502,11 @@ func (db *Database) CreateUser(ctx context.Context, email, passwordHash string)
 	}
 
 	// Create default free subscription
+	free, _ := db.GetPlanLimits(ctx, "free")
 	_, err = db.pool.Exec(ctx,
-		`INSERT INTO subscriptions (user_id, plan, status, download_limit_gb, concurrent_limit, retention_days)
-		 VALUES ($1, 'free', 'active', 2, 1, 1)`,
-		user.ID)
+		`INSERT INTO subscriptions (user_id, plan, status, download_limit_gb, concurrent_limit, retention_days, storage_limit_gb)
+		 VALUES ($1, 'free', 'active', $2, $3, $4, $5)`,
+		user.ID, free.DownloadLimitGB, free.ConcurrentLimit, free.RetentionDays, free.StorageLimitGB)
 	if err != nil {
 		return nil, err
 	}
@@ -173,9 +517,9 @@ func (db *Database) CreateUser(ctx context.Context, email, passwordHash string)
 func (db *Database) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	user := &models.User{}
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, email, password_hash, role, stripe_customer_id, created_at, updated_at
+		`SELECT id, email, password_hash, role, stripe_customer_id, COALESCE(default_zip, TRUE), COALESCE(email_notifications, TRUE), timezone, totp_enabled, created_at, updated_at
 		 FROM users WHERE email = $1`,
-		email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.StripeCustomerID, &user.CreatedAt, &user.UpdatedAt)
+		email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.StripeCustomerID, &user.DefaultZip, &user.EmailNotifications, &user.Timezone, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -188,9 +532,9 @@ func (db *Database) GetUserByEmail(ctx context.Context, email string) (*models.U
 func (db *Database) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
 	user := &models.User{}
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, email, password_hash, role, stripe_customer_id, created_at, updated_at
+		`SELECT id, email, password_hash, role, stripe_customer_id, COALESCE(default_zip, TRUE), COALESCE(email_notifications, TRUE), timezone, totp_enabled, created_at, updated_at
 		 FROM users WHERE id = $1`,
-		id).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.StripeCustomerID, &user.CreatedAt, &user.UpdatedAt)
+		id).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.StripeCustomerID, &user.DefaultZip, &user.EmailNotifications, &user.Timezone, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -208,7 +552,7 @@ func (db *Database) GetAllUsers(ctx context.Context, limit, offset int) ([]model
 	}
 
 	rows, err := db.pool.Query(ctx,
-		`SELECT id, email, role, stripe_customer_id, created_at, updated_at
+		`SELECT id, email, role, stripe_customer_id, COALESCE(default_zip, TRUE), COALESCE(email_notifications, TRUE), timezone, totp_enabled, created_at, updated_at
 		 FROM users ORDER BY created_at DESC LIMIT $1 OFFSET $2`,
 		limit, offset)
 	if err != nil {
@@ -219,7 +563,7 @@ func (db *Database) GetAllUsers(ctx context.Context, limit, offset int) ([]model
 	var users []models.User
 	for rows.Next() {
 		var user models.User
-		if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.StripeCustomerID, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.StripeCustomerID, &user.DefaultZip, &user.EmailNotifications, &user.Timezone, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt); err != nil {
 			return nil, 0, err
 		}
 		users = append(users, user)
@@ -227,6 +571,28 @@ func (db *Database) GetAllUsers(ctx context.Context, limit, offset int) ([]model
 	return users, total, nil
 }
 
+func (db *Database) GetUserByStripeCustomerID(ctx context.Context, customerID string) (*models.User, error) {
+	user := &models.User{}
+	err := db.pool.QueryRow(ctx,
+		`SELECT id, email, password_hash, role, stripe_customer_id, COALESCE(default_zip, TRUE), COALESCE(email_notifications, TRUE), timezone, totp_enabled, created_at, updated_at
+		 FROM users WHERE stripe_customer_id = $1`,
+		customerID).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.StripeCustomerID, &user.DefaultZip, &user.EmailNotifications, &user.Timezone, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (db *Database) SetUserStripeCustomerID(ctx context.Context, userID uuid.UUID, customerID string) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE users SET stripe_customer_id = $1, updated_at = NOW() WHERE id = $2`,
+		customerID, userID)
+	return err
+}
+
 func (db *Database) UpdateUserRole(ctx context.Context, userID uuid.UUID, role string) error {
 	_, err := db.pool.Exec(ctx,
 		`UPDATE users SET role = $1, updated_at = NOW() WHERE id = $2`,
@@ -234,6 +600,94 @@ func (db *Database) UpdateUserRole(ctx context.Context, userID uuid.UUID, role s
 	return err
 }
 
+// UpdateUserSettings changes the settings that are set in s, leaving the
+// rest as they are
+func (db *Database) UpdateUserSettings(ctx context.Context, userID uuid.UUID, s models.UserSettings) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE users SET default_zip = COALESCE($1, default_zip),
+		 email_notifications = COALESCE($2, email_notifications),
+		 timezone = COALESCE($3, timezone), updated_at = NOW()
+		 WHERE id = $4`,
+		s.DefaultZip, s.EmailNotifications, s.Timezone, userID)
+	return err
+}
+
+// UpdateUserPassword replaces a user's password hash
+func (db *Database) UpdateUserPassword(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2`,
+		passwordHash, userID)
+	return err
+}
+
+// GetTOTP returns a user's TOTP secret, "" when none has been set up,
+// whether two-factor sign-in is enabled, and the last time step a code was
+// used for
+func (db *Database) GetTOTP(ctx context.Context, userID uuid.UUID) (string, bool, int64, error) {
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err := db.pool.QueryRow(ctx,
+		`SELECT COALESCE(totp_secret, ''), totp_enabled, totp_last_step FROM users WHERE id = $1`,
+		userID).Scan(&secret, &enabled, &lastStep)
+	if err == pgx.ErrNoRows {
+		return "", false, 0, nil
+	}
+	return secret, enabled, lastStep, err
+}
+
+// SetTOTPSecret stores a new TOTP secret for a user to enable, replacing one
+// set up before. Reports false when two-factor sign-in is already enabled.
+func (db *Database) SetTOTPSecret(ctx context.Context, userID uuid.UUID, secret string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE users SET totp_secret = $2, updated_at = NOW() WHERE id = $1 AND NOT totp_enabled`,
+		userID, secret)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// EnableTOTP turns on two-factor sign-in with the secret set up, using up
+// the time step of the code that confirmed it. Reports false when it was
+// already on.
+func (db *Database) EnableTOTP(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE users SET totp_enabled = TRUE, totp_last_step = $2, updated_at = NOW()
+		 WHERE id = $1 AND NOT totp_enabled AND totp_secret IS NOT NULL`,
+		userID, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// UseTOTPStep records that a code for step has been used, so it can't be
+// used again. Reports false when it, or a later one, already was.
+func (db *Database) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2`,
+		userID, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DisableTOTP turns off two-factor sign-in and forgets the secret. The
+// user's sessions no longer count as signed in with a code once they
+// refresh; access tokens already issued keep counting until they expire,
+// at most JWT_ACCESS_EXPIRY.
+func (db *Database) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`WITH off AS (
+			UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, updated_at = NOW() WHERE id = $1
+		)
+		UPDATE refresh_tokens SET two_factor = FALSE WHERE user_id = $1`,
+		userID)
+	return err
+}
+
 func (db *Database) DeleteUser(ctx context.Context, userID uuid.UUID) error {
 	_, err := db.pool.Exec(ctx, `DELETE FROM users WHERE id = $1`, userID)
 	return err
@@ -243,11 +697,12 @@ func (db *Database) DeleteUser(ctx context.Context, userID uuid.UUID) error {
 func (db *Database) GetSubscription(ctx context.Context, userID uuid.UUID) (*models.Subscription, error) {
 	sub := &models.Subscription{}
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, user_id, stripe_subscription_id, plan, status, current_period_end, 
-		 download_limit_gb, concurrent_limit, retention_days, created_at
+		`SELECT id, user_id, stripe_subscription_id, plan, status, current_period_start, current_period_end,
+		 download_limit_gb, concurrent_limit, retention_days, COALESCE(storage_limit_gb, 0), created_at
 		 FROM subscriptions WHERE user_id = $1`,
 		userID).Scan(&sub.ID, &sub.UserID, &sub.StripeSubscriptionID, &sub.Plan, &sub.Status,
-		&sub.CurrentPeriodEnd, &sub.DownloadLimitGB, &sub.ConcurrentLimit, &sub.RetentionDays, &sub.CreatedAt)
+		&sub.CurrentPeriodStart, &sub.CurrentPeriodEnd, &sub.DownloadLimitGB, &sub.ConcurrentLimit, &sub.RetentionDays,
+		&sub.StorageLimitGB, &sub.CreatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -257,79 +712,354 @@ func (db *Database) GetSubscription(ctx context.Context, userID uuid.UUID) (*mod
 	return sub, nil
 }
 
-func (db *Database) UpdateSubscription(ctx context.Context, userID uuid.UUID, plan, status string, limits models.PlanLimits) error {
-	_, err := db.pool.Exec(ctx,
+// UpdateSubscription moves a user's subscription to plan and status with
+// limits. A change of plan or status is recorded as a subscription event by
+// actor. A user without a subscription is left alone.
+func (db *Database) UpdateSubscription(ctx context.Context, userID uuid.UUID, plan, status string, limits models.PlanLimits, actor models.SubscriptionActor) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var oldPlan, oldStatus string
+	err = tx.QueryRow(ctx,
+		`SELECT plan, status FROM subscriptions WHERE user_id = $1 FOR UPDATE`,
+		userID).Scan(&oldPlan, &oldStatus)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx,
 		`UPDATE subscriptions SET plan = $1, status = $2, download_limit_gb = $3, 
-		 concurrent_limit = $4, retention_days = $5 WHERE user_id = $6`,
-		plan, status, limits.DownloadLimitGB, limits.ConcurrentLimit, limits.RetentionDays, userID)
+		 concurrent_limit = $4, retention_days = $5, storage_limit_gb = $6 WHERE user_id = $7`,
+		plan, status, limits.DownloadLimitGB, limits.ConcurrentLimit, limits.RetentionDays,
+		limits.StorageLimitGB, userID); err != nil {
+		return err
+	}
+	if oldPlan != plan || oldStatus != status {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO subscription_events (user_id, actor_type, actor_id, old_plan, new_plan, old_status, new_status, reason)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			userID, actor.Type, actor.ID, oldPlan, plan, oldStatus, status, actor.Reason); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// planCacheTTL is how long plans are cached. Changes made through this
+// instance apply at once; other instances see them within this long.
+const planCacheTTL = time.Minute
+
+// GetPlans returns every plan by name. The map is shared; don't modify it.
+func (db *Database) GetPlans(ctx context.Context) (map[string]models.Plan, error) {
+	db.planMu.RLock()
+	plans, expires := db.plans, db.plansExpires
+	db.planMu.RUnlock()
+	if plans != nil && time.Now().Before(expires) {
+		return plans, nil
+	}
+
+	rows, err := db.pool.Query(ctx, `SELECT name, limits, stripe_price_id, updated_at FROM plans`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans = make(map[string]models.Plan)
+	for rows.Next() {
+		var p models.Plan
+		var data []byte
+		if err := rows.Scan(&p.Name, &data, &p.StripePriceID, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &p.Limits); err != nil {
+			return nil, fmt.Errorf("plan %s: %w", p.Name, err)
+		}
+		plans[p.Name] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	db.planMu.Lock()
+	db.plans, db.plansExpires = plans, time.Now().Add(planCacheTTL)
+	db.planMu.Unlock()
+	return plans, nil
+}
+
+// GetPlanLimits returns the limits of the named plan, or false if there is
+// no such plan. If the plans can't be read the built-in ones stand in, so
+// limits are still enforced while the database is struggling.
+func (db *Database) GetPlanLimits(ctx context.Context, name string) (models.PlanLimits, bool) {
+	plans, err := db.GetPlans(ctx)
+	if err != nil {
+		log.Printf("Failed to load plans, using built-in limits: %v", err)
+		limits, ok := models.DefaultPlans[name]
+		return limits, ok
+	}
+	p, ok := plans[name]
+	return p.Limits, ok
+}
+
+// SavePlan creates or replaces a plan and applies its limits to the
+// subscriptions on it
+func (db *Database) SavePlan(ctx context.Context, p *models.Plan) error {
+	data, err := json.Marshal(p.Limits)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO plans (name, limits, stripe_price_id) VALUES ($1, $2, $3)
+		 ON CONFLICT (name) DO UPDATE SET limits = $2, stripe_price_id = $3, updated_at = NOW()
+		 RETURNING updated_at`,
+		p.Name, data, p.StripePriceID).Scan(&p.UpdatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE subscriptions SET download_limit_gb = $1, concurrent_limit = $2,
+		 retention_days = $3, storage_limit_gb = $4 WHERE plan = $5`,
+		p.Limits.DownloadLimitGB, p.Limits.ConcurrentLimit, p.Limits.RetentionDays,
+		p.Limits.StorageLimitGB, p.Name); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	db.invalidatePlans()
+	return nil
+}
+
+// DeletePlan deletes a plan nobody is subscribed to. It reports false when
+// there is no such plan or someone is still on it.
+func (db *Database) DeletePlan(ctx context.Context, name string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM plans WHERE name = $1
+		 AND NOT EXISTS (SELECT 1 FROM subscriptions WHERE plan = $1)`,
+		name)
+	if err != nil {
+		return false, err
+	}
+	db.invalidatePlans()
+	return tag.RowsAffected() == 1, nil
+}
+
+// CountPlanSubscribers returns how many users are on a plan
+func (db *Database) CountPlanSubscribers(ctx context.Context, name string) (int, error) {
+	var n int
+	err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM subscriptions WHERE plan = $1`, name).Scan(&n)
+	return n, err
+}
+
+// invalidatePlans makes the next GetPlans reload the table
+func (db *Database) invalidatePlans() {
+	db.planMu.Lock()
+	db.plans = nil
+	db.planMu.Unlock()
+}
+
+// SetSubscriptionPeriod records the user's Stripe subscription and its
+// current billing period; nil times clear the period, metering usage by
+// calendar month again
+func (db *Database) SetSubscriptionPeriod(ctx context.Context, userID uuid.UUID, stripeSubscriptionID string, start, end *time.Time) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE subscriptions SET stripe_subscription_id = NULLIF($1, ''),
+		 current_period_start = $2, current_period_end = $3 WHERE user_id = $4`,
+		stripeSubscriptionID, start, end, userID)
 	return err
 }
 
+// UpdateExpiriesForUser recomputes the expiry of the user's completed
+// torrents as completed_at plus retentionDays, wherever that is later than
+// the current expiry. Expiries are never shortened, so a downgrade keeps
+// what was already granted. It returns how many torrents were extended.
+func (db *Database) UpdateExpiriesForUser(ctx context.Context, userID uuid.UUID, retentionDays int) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET expires_at = completed_at + make_interval(days => $1),
+		 expiry_warned_at = NULL, updated_at = NOW()
+		 WHERE user_id = $2 AND completed_at IS NOT NULL AND expires_at IS NOT NULL
+		 AND completed_at + make_interval(days => $1) > expires_at`,
+		retentionDays, userID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 // Torrent methods
 func (db *Database) CreateTorrent(ctx context.Context, t *models.Torrent) error {
-	t.ID = uuid.New()
+	// Keep the ID the engine was given so its updates find this row
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
 	t.CreatedAt = time.Now()
 	
 	_, err := db.pool.Exec(ctx,
-		`INSERT INTO torrents (id, user_id, info_hash, name, magnet_uri, status, total_size, created_at)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
-		t.ID, t.UserID, t.InfoHash, t.Name, t.MagnetURI, t.Status, t.TotalSize, t.CreatedAt)
+		`INSERT INTO torrents (id, user_id, info_hash, name, magnet_uri, status, total_size, metainfo, is_private, metadata,
+		 source, added_ip, added_user_agent, auto_zip, collection_id, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, ''), NULLIF($13, ''), $14, $15, $16)`,
+		t.ID, t.UserID, t.InfoHash, t.Name, t.MagnetURI, t.Status, t.TotalSize, t.Metainfo, t.IsPrivate, t.Metadata,
+		t.Audit.Source, t.Audit.AddedIP, t.Audit.AddedUserAgent, t.AutoZip, t.CollectionID, t.CreatedAt)
 	return err
 }
 
-func (db *Database) GetTorrent(ctx context.Context, id uuid.UUID) (*models.Torrent, error) {
+// LogTorrentAdded writes a "torrent_added" usage log carrying the torrent's
+// audit fields, so usage can be correlated with where torrents came from
+func (db *Database) LogTorrentAdded(ctx context.Context, t *models.Torrent) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 VALUES ($1, 'torrent_added', 0, jsonb_build_object(
+			'torrent_id', $2::uuid, 'info_hash', $3::text, 'name', $4::text, 'source', $5::text,
+			'ip', NULLIF($6::text, ''), 'user_agent', NULLIF($7::text, '')))`,
+		t.UserID, t.ID, t.InfoHash, t.Name, t.Audit.Source, t.Audit.AddedIP, t.Audit.AddedUserAgent)
+	return err
+}
+
+// torrentColumns are the columns read by scanTorrent, in scan order
+const torrentColumns = `id, user_id, info_hash, name, magnet_uri, status, total_size, downloaded_size,
+	uploaded_size, download_speed, upload_speed, progress, peers, seeds, files,
+	zip_path, zip_size, error_message, started_at, completed_at, expires_at, created_at,
+	updated_at, status_history, data_missing, completion_logged, retry_count, is_private, metadata,
+	COALESCE(source, ''), COALESCE(added_ip, ''), COALESCE(added_user_agent, ''),
+	COALESCE(zip_status, ''), auto_zip, COALESCE(extensions, 0), collection_id,
+	files_completed, files_total, COALESCE(health_warning, ''), zip_sha256, deduplicated_from,
+	COALESCE(pause_at_bytes, 0), COALESCE(closed_reason, '')`
+
+// torrentListColumns omit the potentially large files and history JSONB
+// columns for list views; they are read by scanTorrentListRow
+const torrentListColumns = `id, user_id, info_hash, name, magnet_uri, status, total_size, downloaded_size,
+	uploaded_size, download_speed, upload_speed, progress, peers, seeds,
+	zip_path, zip_size, error_message, started_at, completed_at, expires_at, created_at,
+	updated_at, data_missing, retry_count, is_private,
+	COALESCE(source, ''), COALESCE(added_ip, ''), COALESCE(added_user_agent, ''),
+	COALESCE(zip_status, ''), auto_zip, COALESCE(extensions, 0), collection_id,
+	files_completed, files_total, COALESCE(health_warning, ''), deduplicated_from,
+	COALESCE(pause_at_bytes, 0), COALESCE(closed_reason, '')`
+
+// expiresIn returns the seconds left until expiresAt, never negative
+func expiresIn(expiresAt *time.Time) *int64 {
+	if expiresAt == nil {
+		return nil
+	}
+	secs := int64(time.Until(*expiresAt).Seconds())
+	if secs < 0 {
+		secs = 0
+	}
+	return &secs
+}
+
+func scanTorrent(row pgx.Row) (*models.Torrent, error) {
 	t := &models.Torrent{}
-	err := db.pool.QueryRow(ctx,
-		`SELECT id, user_id, info_hash, name, magnet_uri, status, total_size, downloaded_size,
-		 uploaded_size, download_speed, upload_speed, progress, peers, seeds, files, 
-		 zip_path, zip_size, error_message, started_at, completed_at, expires_at, created_at
-		 FROM torrents WHERE id = $1`,
-		id).Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status, &t.TotalSize,
+	err := row.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status, &t.TotalSize,
 		&t.DownloadedSize, &t.UploadedSize, &t.DownloadSpeed, &t.UploadSpeed, &t.Progress,
-		&t.Peers, &t.Seeds, &t.Files, &t.ZipPath, &t.ZipSize, &t.ErrorMessage, 
-		&t.StartedAt, &t.CompletedAt, &t.ExpiresAt, &t.CreatedAt)
+		&t.Peers, &t.Seeds, &t.Files, &t.ZipPath, &t.ZipSize, &t.ErrorMessage,
+		&t.StartedAt, &t.CompletedAt, &t.ExpiresAt, &t.CreatedAt,
+		&t.UpdatedAt, &t.StatusHistory, &t.DataMissing, &t.CompletionLogged, &t.RetryCount,
+		&t.IsPrivate, &t.Metadata, &t.Audit.Source, &t.Audit.AddedIP, &t.Audit.AddedUserAgent,
+		&t.ZipStatus, &t.AutoZip, &t.Extensions, &t.CollectionID, &t.FilesCompleted, &t.FilesTotal,
+		&t.HealthWarning, &t.ZipSHA256, &t.DeduplicatedFrom, &t.PauseAtBytes, &t.ClosedReason)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
+	t.ExpiresIn = expiresIn(t.ExpiresAt)
 	return t, nil
 }
 
+func scanTorrentListRow(rows pgx.Rows) (models.Torrent, error) {
+	var t models.Torrent
+	err := rows.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status,
+		&t.TotalSize, &t.DownloadedSize, &t.UploadedSize, &t.DownloadSpeed, &t.UploadSpeed,
+		&t.Progress, &t.Peers, &t.Seeds, &t.ZipPath, &t.ZipSize, &t.ErrorMessage,
+		&t.StartedAt, &t.CompletedAt, &t.ExpiresAt, &t.CreatedAt, &t.UpdatedAt, &t.DataMissing,
+		&t.RetryCount, &t.IsPrivate, &t.Audit.Source, &t.Audit.AddedIP, &t.Audit.AddedUserAgent,
+		&t.ZipStatus, &t.AutoZip, &t.Extensions, &t.CollectionID, &t.FilesCompleted, &t.FilesTotal,
+		&t.HealthWarning, &t.DeduplicatedFrom, &t.PauseAtBytes, &t.ClosedReason)
+	t.ExpiresIn = expiresIn(t.ExpiresAt)
+	return t, err
+}
+
+func (db *Database) GetTorrent(ctx context.Context, id uuid.UUID) (*models.Torrent, error) {
+	return scanTorrent(db.pool.QueryRow(ctx,
+		`SELECT `+torrentColumns+` FROM torrents WHERE id = $1`,
+		id))
+}
+
 func (db *Database) GetTorrentByInfoHash(ctx context.Context, userID uuid.UUID, infoHash string) (*models.Torrent, error) {
-	t := &models.Torrent{}
-	err := db.pool.QueryRow(ctx,
-		`SELECT id, user_id, info_hash, name, magnet_uri, status, total_size, downloaded_size,
-		 uploaded_size, download_speed, upload_speed, progress, peers, seeds, files, 
-		 zip_path, zip_size, error_message, started_at, completed_at, expires_at, created_at
-		 FROM torrents WHERE user_id = $1 AND info_hash = $2 ORDER BY created_at DESC LIMIT 1`,
-		userID, infoHash).Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status, &t.TotalSize,
-		&t.DownloadedSize, &t.UploadedSize, &t.DownloadSpeed, &t.UploadSpeed, &t.Progress,
-		&t.Peers, &t.Seeds, &t.Files, &t.ZipPath, &t.ZipSize, &t.ErrorMessage, 
-		&t.StartedAt, &t.CompletedAt, &t.ExpiresAt, &t.CreatedAt)
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+	return scanTorrent(db.pool.QueryRow(ctx,
+		`SELECT `+torrentColumns+` FROM torrents
+		 WHERE user_id = $1 AND info_hash = $2 ORDER BY created_at DESC LIMIT 1`,
+		userID, infoHash))
+}
+
+// searchSeparators is the pattern of name punctuation searched as spaces, so
+// "ubuntu-22.04.iso" is found by "ubuntu 22 iso"
+const searchSeparators = `[._+()\[\]{}]+`
+
+// minFullTextQuery is the shortest query searched as words; shorter ones
+// match anywhere in the name
+const minFullTextQuery = 3
+
+// torrentSearch returns the condition matching torrent names against query,
+// given as parameter $param, the rank to order matches by, and the argument
+// to pass for it. Queries are searched as words in any order, with
+// websearch syntax ("quoted phrases", -excluded); very short ones use ILIKE.
+// An empty query matches everything.
+func torrentSearch(query string, param int) (cond, rank string, arg string) {
+	query = strings.TrimSpace(query)
+	p := fmt.Sprintf("$%d::text", param)
+	switch {
+	case query == "":
+		return p + " = ''", "0", ""
+	case utf8.RuneCountInString(query) < minFullTextQuery:
+		return "name ILIKE '%' || " + p + " || '%'", "0", escapeLike(query)
+	default:
+		tsquery := "websearch_to_tsquery('simple', regexp_replace(" + p + ", '" + searchSeparators + "', ' ', 'g'))"
+		return "name_tsv @@ " + tsquery, "ts_rank(name_tsv, " + tsquery + ")", query
 	}
-	return t, nil
 }
 
-func (db *Database) GetTorrentsByUser(ctx context.Context, userID uuid.UUID, limit, offset int) ([]models.Torrent, int, error) {
+// escapeLike escapes LIKE wildcards so s matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// GetTorrentsByUser lists the user's torrents, newest first, or best match
+// first when searching with query. A non-nil collectionID restricts the list
+// to that collection's members, and a non-empty status to torrents in it.
+func (db *Database) GetTorrentsByUser(ctx context.Context, userID uuid.UUID, collectionID *uuid.UUID, status models.TorrentStatus, query string, limit, offset int) ([]models.Torrent, int, error) {
+	search, rank, arg := torrentSearch(query, 3)
+
 	var total int
-	err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM torrents WHERE user_id = $1`, userID).Scan(&total)
+	err := db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM torrents
+		 WHERE user_id = $1 AND ($2::uuid IS NULL OR collection_id = $2)
+		   AND ($4::text = '' OR status = $4) AND `+search,
+		userID, collectionID, arg, string(status)).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	rows, err := db.pool.Query(ctx,
-		`SELECT id, user_id, info_hash, name, magnet_uri, status, total_size, downloaded_size,
-		 uploaded_size, download_speed, upload_speed, progress, peers, seeds, 
-		 zip_path, zip_size, error_message, started_at, completed_at, expires_at, created_at
-		 FROM torrents WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`,
-		userID, limit, offset)
+		`SELECT `+torrentListColumns+`
+		 FROM torrents WHERE user_id = $1 AND ($2::uuid IS NULL OR collection_id = $2)
+		   AND ($6::text = '' OR status = $6) AND `+search+`
+		 ORDER BY `+rank+` DESC, created_at DESC LIMIT $4 OFFSET $5`,
+		userID, collectionID, arg, limit, offset, string(status))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -337,11 +1067,8 @@ func (db *Database) GetTorrentsByUser(ctx context.Context, userID uuid.UUID, lim
 
 	var torrents []models.Torrent
 	for rows.Next() {
-		var t models.Torrent
-		if err := rows.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status,
-			&t.TotalSize, &t.DownloadedSize, &t.UploadedSize, &t.DownloadSpeed, &t.UploadSpeed,
-			&t.Progress, &t.Peers, &t.Seeds, &t.ZipPath, &t.ZipSize, &t.ErrorMessage, 
-			&t.StartedAt, &t.CompletedAt, &t.ExpiresAt, &t.CreatedAt); err != nil {
+		t, err := scanTorrentListRow(rows)
+		if err != nil {
 			return nil, 0, err
 		}
 		torrents = append(torrents, t)
@@ -349,99 +1076,434 @@ func (db *Database) GetTorrentsByUser(ctx context.Context, userID uuid.UUID, lim
 	return torrents, total, nil
 }
 
-func (db *Database) GetAllTorrents(ctx context.Context, limit, offset int) ([]models.Torrent, int, error) {
+// GetAllTorrents lists every user's torrents, newest first. A non-empty
+// source restricts the list to torrents added that way; a query searches
+// names as GetTorrentsByUser does, and owners' emails.
+func (db *Database) GetAllTorrents(ctx context.Context, source, query string, limit, offset int) ([]models.Torrent, int, error) {
+	cond, _, args := allTorrentsFilter(source, query)
 	var total int
-	err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM torrents`).Scan(&total)
+	if err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM torrents WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	var torrents []models.Torrent
+	err := db.eachOfAllTorrents(ctx, source, query, limit, offset, func(t *models.Torrent) error {
+		torrents = append(torrents, *t)
+		return nil
+	})
 	if err != nil {
 		return nil, 0, err
 	}
+	return torrents, total, nil
+}
+
+// EachTorrent calls fn with every torrent GetAllTorrents would list, in
+// the same order, one row at a time rather than gathering them. An error
+// from fn stops the iteration and is returned.
+func (db *Database) EachTorrent(ctx context.Context, source, query string, fn func(t *models.Torrent) error) error {
+	return db.eachOfAllTorrents(ctx, source, query, 0, 0, fn)
+}
 
+// eachOfAllTorrents iterates a page of GetAllTorrents; limit 0 for all
+func (db *Database) eachOfAllTorrents(ctx context.Context, source, query string, limit, offset int, fn func(t *models.Torrent) error) error {
+	cond, rank, args := allTorrentsFilter(source, query)
 	rows, err := db.pool.Query(ctx,
-		`SELECT id, user_id, info_hash, name, magnet_uri, status, total_size, downloaded_size,
-		 uploaded_size, download_speed, upload_speed, progress, peers, seeds, 
-		 zip_path, zip_size, error_message, started_at, completed_at, expires_at, created_at
-		 FROM torrents ORDER BY created_at DESC LIMIT $1 OFFSET $2`,
-		limit, offset)
+		`SELECT `+torrentListColumns+`
+		 FROM torrents WHERE `+cond+`
+		 ORDER BY `+rank+` DESC, created_at DESC LIMIT NULLIF($4, 0) OFFSET $5`,
+		append(args, limit, offset)...)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 	defer rows.Close()
 
-	var torrents []models.Torrent
 	for rows.Next() {
-		var t models.Torrent
-		if err := rows.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status,
-			&t.TotalSize, &t.DownloadedSize, &t.UploadedSize, &t.DownloadSpeed, &t.UploadSpeed,
-			&t.Progress, &t.Peers, &t.Seeds, &t.ZipPath, &t.ZipSize, &t.ErrorMessage,
-			&t.StartedAt, &t.CompletedAt, &t.ExpiresAt, &t.CreatedAt); err != nil {
-			return nil, 0, err
+		t, err := scanTorrentListRow(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(&t); err != nil {
+			return err
 		}
-		torrents = append(torrents, t)
 	}
-	return torrents, total, nil
+	return rows.Err()
+}
+
+// allTorrentsFilter returns the condition of GetAllTorrents, its ranking
+// and the arguments they take, $1 to $3
+func allTorrentsFilter(source, query string) (string, string, []any) {
+	search, rank, arg := torrentSearch(query, 2)
+	// Admins also find torrents by their owner's email
+	cond := `($1 = '' OR source = $1) AND (` + search + ` OR ($3::text <> ''
+		AND user_id IN (SELECT id FROM users WHERE email ILIKE '%' || $3 || '%')))`
+	email := escapeLike(strings.TrimSpace(query))
+	return cond, rank, []any{source, arg, email}
+}
+
+// maxStatusHistory caps the number of transitions kept in status_history
+const maxStatusHistory = 20
+
+// statusHistoryUpdate returns a SET expression that appends a transition to
+// status_history when the status changes, keeping only the most recent
+// maxStatusHistory entries. newStatus is a SQL expression (placeholder or literal).
+func statusHistoryUpdate(newStatus string) string {
+	return fmt.Sprintf(`status_history = CASE WHEN status IS DISTINCT FROM %[1]s THEN (
+		SELECT COALESCE(jsonb_agg(entry ORDER BY ord), '[]'::jsonb) FROM (
+			SELECT entry, ord FROM jsonb_array_elements(
+				COALESCE(status_history, '[]'::jsonb) || jsonb_build_array(jsonb_build_object('status', %[1]s, 'at', NOW()))
+			) WITH ORDINALITY AS h(entry, ord)
+			ORDER BY ord DESC LIMIT %[2]d
+		) recent
+	) ELSE status_history END`, newStatus, maxStatusHistory)
+}
+
+// ErrInvalidStatus is returned when writing a status models doesn't know
+var ErrInvalidStatus = errors.New("invalid torrent status")
+
+// ErrIllegalTransition is returned when a torrent can't move from its
+// current status to the one being written, see models.TorrentStatus.CanTransitionTo
+var ErrIllegalTransition = errors.New("illegal torrent status transition")
+
+// UpdateTorrentStatus records a torrent's status and progress. The status
+// must be valid and, unless force is set, reachable from the current one;
+// otherwise nothing is written and ErrInvalidStatus or ErrIllegalTransition
+// is returned. The guard is what keeps a late engine update from moving a
+// completed, failed or cancelled torrent back to downloading, so only
+// explicit user actions such as resume should force. Taken-down torrents
+// are deleted rather than given a status, so there is none to protect.
+// Failing a torrent records why, so it goes through SetTorrentError.
+func (db *Database) UpdateTorrentStatus(ctx context.Context, id uuid.UUID, status models.TorrentStatus, progress float64, downloaded int64, dlSpeed, ulSpeed float64, peers, seeds int, force bool) error {
+	if !status.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
+	if status == models.TorrentStatusFailed || status == models.TorrentStatusCancelled {
+		return fmt.Errorf("%w: %s needs a closed reason, see SetTorrentError", ErrInvalidStatus, status)
+	}
+	var from []string
+	for _, s := range models.TransitionsTo(status) {
+		from = append(from, string(s))
+	}
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET status = $1, progress = $2, downloaded_size = $3,
+		 download_speed = $4, upload_speed = $5, peers = $6, seeds = $7,
+		 started_at = CASE WHEN $1 = 'downloading' THEN COALESCE(started_at, NOW()) ELSE started_at END,
+		 closed_reason = CASE WHEN $1 IN ('completed', 'seeding') THEN 'completed' END,
+		 `+statusHistoryUpdate("$1::text")+`, updated_at = NOW()
+		 WHERE id = $8 AND ($10 OR status = ANY($9))`,
+		string(status), progress, downloaded, dlSpeed, ulSpeed, peers, seeds, id, from, force)
+	if err != nil || tag.RowsAffected() > 0 {
+		return err
+	}
+
+	// Nothing written: the torrent is gone or in a status that can't move
+	var current models.TorrentStatus
+	err = db.pool.QueryRow(ctx, `SELECT status FROM torrents WHERE id = $1`, id).Scan(&current)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("%w: %s to %s", ErrIllegalTransition, current, status)
+}
+
+// SetTorrentHealthWarning sets or, with "", clears a torrent's health
+// warning and reports whether it changed
+func (db *Database) SetTorrentHealthWarning(ctx context.Context, id uuid.UUID, warning string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET health_warning = NULLIF($1, '')
+		 WHERE id = $2 AND COALESCE(health_warning, '') <> $1`,
+		warning, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// SetTorrentPauseAt records the downloaded bytes at which a resumed torrent
+// is paused again; zero clears it
+func (db *Database) SetTorrentPauseAt(ctx context.Context, id uuid.UUID, pauseAt int64) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET pause_at_bytes = NULLIF($1, 0), updated_at = NOW() WHERE id = $2`,
+		pauseAt, id)
+	return err
 }
 
-func (db *Database) UpdateTorrentStatus(ctx context.Context, id uuid.UUID, status string, progress float64, downloaded, uploaded int64, dlSpeed, ulSpeed float64, peers, seeds int) error {
+// AddTorrentUploaded adds data uploaded since the last update to the
+// torrent's total, which survives restarts unlike the engine's counters
+func (db *Database) AddTorrentUploaded(ctx context.Context, id uuid.UUID, bytes int64) error {
 	_, err := db.pool.Exec(ctx,
-		`UPDATE torrents SET status = $1, progress = $2, downloaded_size = $3, uploaded_size = $4,
-		 download_speed = $5, upload_speed = $6, peers = $7, seeds = $8 WHERE id = $9`,
-		status, progress, downloaded, uploaded, dlSpeed, ulSpeed, peers, seeds, id)
+		`UPDATE torrents SET uploaded_size = uploaded_size + $1, updated_at = NOW() WHERE id = $2`,
+		bytes, id)
 	return err
 }
 
 func (db *Database) SetTorrentCompleted(ctx context.Context, id uuid.UUID, retentionDays int) error {
 	expiresAt := time.Now().AddDate(0, 0, retentionDays)
 	_, err := db.pool.Exec(ctx,
-		`UPDATE torrents SET status = 'completed', progress = 100, completed_at = NOW(), expires_at = $1 WHERE id = $2`,
+		`UPDATE torrents SET status = 'completed', progress = 100, completed_at = NOW(), expires_at = $1,
+		 expiry_warned_at = NULL, closed_reason = 'completed', `+statusHistoryUpdate("'completed'")+`, updated_at = NOW()
+		 WHERE id = $2`,
 		expiresAt, id)
 	return err
 }
 
+// UpdateTorrentFiles stores a torrent's files and their completed count
 func (db *Database) UpdateTorrentFiles(ctx context.Context, id uuid.UUID, files []models.TorrentFile) error {
 	filesJSON, err := json.Marshal(files)
 	if err != nil {
 		return err
 	}
 	_, err = db.pool.Exec(ctx,
-		`UPDATE torrents SET files = $1 WHERE id = $2`,
-		filesJSON, id)
+		`UPDATE torrents SET files = $1, files_completed = $2, files_total = $3, updated_at = NOW() WHERE id = $4`,
+		filesJSON, models.CompletedFiles(files), len(files), id)
+	return err
+}
+
+// UpdateTorrentName records what the torrent's metadata says about it
+func (db *Database) UpdateTorrentName(ctx context.Context, id uuid.UUID, name string, totalSize int64, isPrivate bool) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET name = $1, total_size = $2, is_private = $3, updated_at = NOW() WHERE id = $4`,
+		name, totalSize, isPrivate, id)
+	return err
+}
+
+// UpdateTorrentMetadata stores what the torrent's metainfo says about it
+func (db *Database) UpdateTorrentMetadata(ctx context.Context, id uuid.UUID, metadata *models.TorrentMetadata) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET metadata = $1, updated_at = NOW() WHERE id = $2`,
+		metadata, id)
+	return err
+}
+
+// UpdateTorrentZip records a torrent's finished zip archive, with its
+// checksum and manifest
+func (db *Database) UpdateTorrentZip(ctx context.Context, id uuid.UUID, zipPath string, zipSize int64, sha256 string, manifest []models.ZipManifestEntry) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET zip_path = $1, zip_size = $2, zip_sha256 = $3, zip_manifest = $4,
+		 zip_status = 'ready', updated_at = NOW() WHERE id = $5`,
+		zipPath, zipSize, sha256, manifest, id)
+	return err
+}
+
+// GetTorrentZipManifest returns the entries of a torrent's zip archive, nil
+// when it has no zip or the zip was made before manifests were recorded
+func (db *Database) GetTorrentZipManifest(ctx context.Context, id uuid.UUID) ([]models.ZipManifestEntry, error) {
+	var manifest []models.ZipManifestEntry
+	err := db.pool.QueryRow(ctx, `SELECT zip_manifest FROM torrents WHERE id = $1`, id).Scan(&manifest)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// SetTorrentZipStatus records why a completed torrent has no zip
+func (db *Database) SetTorrentZipStatus(ctx context.Context, id uuid.UUID, status string) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET zip_status = $1, updated_at = NOW() WHERE id = $2`,
+		status, id)
 	return err
 }
 
-func (db *Database) UpdateTorrentName(ctx context.Context, id uuid.UUID, name string, totalSize int64) error {
+// ErrInvalidClosedReason is returned when writing a closed reason models
+// doesn't know
+var ErrInvalidClosedReason = errors.New("invalid closed reason")
+
+// SetTorrentError fails a torrent with errMsg, closing it for reason, which
+// must be a failure
+func (db *Database) SetTorrentError(ctx context.Context, id uuid.UUID, reason models.ClosedReason, errMsg string) error {
+	if !reason.IsFailure() {
+		return fmt.Errorf("%w: %q", ErrInvalidClosedReason, reason)
+	}
 	_, err := db.pool.Exec(ctx,
-		`UPDATE torrents SET name = $1, total_size = $2 WHERE id = $3`,
-		name, totalSize, id)
+		`UPDATE torrents SET status = 'failed', error_message = $1, closed_reason = $3,
+		 `+statusHistoryUpdate("'failed'")+`, updated_at = NOW()
+		 WHERE id = $2`,
+		errMsg, id, string(reason))
 	return err
 }
 
-func (db *Database) UpdateTorrentZip(ctx context.Context, id uuid.UUID, zipPath string, zipSize int64) error {
+// UpdateTorrentFetched fills in a torrent created from a URL once its .torrent
+// file has been downloaded and added to the engine
+func (db *Database) UpdateTorrentFetched(ctx context.Context, id uuid.UUID, infoHash, name string, totalSize int64, isPrivate bool, status models.TorrentStatus, metainfo []byte) error {
+	if !status.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
 	_, err := db.pool.Exec(ctx,
-		`UPDATE torrents SET zip_path = $1, zip_size = $2 WHERE id = $3`,
-		zipPath, zipSize, id)
+		`UPDATE torrents SET info_hash = $1, name = $2, total_size = $3, status = $4, metainfo = $5, is_private = $6,
+		 `+statusHistoryUpdate("$4::text")+`, updated_at = NOW()
+		 WHERE id = $7`,
+		infoHash, name, totalSize, string(status), metainfo, isPrivate, id)
 	return err
 }
 
-func (db *Database) SetTorrentError(ctx context.Context, id uuid.UUID, errMsg string) error {
+// GetTorrentMetainfo returns the .torrent file a torrent was added from, if any
+func (db *Database) GetTorrentMetainfo(ctx context.Context, id uuid.UUID) ([]byte, error) {
+	var data []byte
+	err := db.pool.QueryRow(ctx, `SELECT metainfo FROM torrents WHERE id = $1`, id).Scan(&data)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// ResetTorrentForRetry returns a torrent to pending and counts the attempt.
+// Like a forced UpdateTorrentStatus it moves a torrent out of any status,
+// including failed and completed. It reports false when the torrent has
+// already used maxRetries attempts.
+func (db *Database) ResetTorrentForRetry(ctx context.Context, id uuid.UUID, maxRetries int) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET status = 'pending', error_message = NULL, closed_reason = NULL, progress = 0,
+		 download_speed = 0, upload_speed = 0, peers = 0, seeds = 0,
+		 retry_count = retry_count + 1,
+		 `+statusHistoryUpdate("'pending'")+`, updated_at = NOW()
+		 WHERE id = $1 AND retry_count < $2`,
+		id, maxRetries)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// SetTorrentDataMissing flags a completed torrent whose files are no longer on disk
+func (db *Database) SetTorrentDataMissing(ctx context.Context, id uuid.UUID, missing bool) error {
 	_, err := db.pool.Exec(ctx,
-		`UPDATE torrents SET status = 'failed', error_message = $1 WHERE id = $2`,
-		errMsg, id)
+		`UPDATE torrents SET data_missing = $1, updated_at = NOW() WHERE id = $2`,
+		missing, id)
 	return err
 }
 
-func (db *Database) DeleteTorrent(ctx context.Context, id uuid.UUID) error {
-	_, err := db.pool.Exec(ctx, `DELETE FROM torrents WHERE id = $1`, id)
+// LogCompletionUsage records the download_completed usage entry for a torrent
+// exactly once, no matter how often completion is re-run
+func (db *Database) LogCompletionUsage(ctx context.Context, id, userID uuid.UUID, bytes int64, name string) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE torrents SET completion_logged = TRUE WHERE id = $1 AND NOT completion_logged`,
+		id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 VALUES ($1, 'download_completed', $2, jsonb_build_object('torrent_id', $3::uuid, 'name', $4::text))`,
+		userID, bytes, id, name); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetTorrentsForRelocation returns every torrent with an info hash, with the
+// file list and zip that locate its data on disk
+func (db *Database) GetTorrentsForRelocation(ctx context.Context) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, info_hash, files, zip_path FROM torrents WHERE info_hash <> '' ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		var t models.Torrent
+		if err := rows.Scan(&t.ID, &t.InfoHash, &t.Files, &t.ZipPath); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, rows.Err()
+}
+
+// GetTorrentsForReconciliation returns every torrent that has not failed or
+// been cancelled, including its recorded file list
+func (db *Database) GetTorrentsForReconciliation(ctx context.Context) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, user_id, info_hash, name, status, files, completed_at, data_missing
+		 FROM torrents WHERE status NOT IN ('failed', 'cancelled')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		var t models.Torrent
+		if err := rows.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.Status, &t.Files,
+			&t.CompletedAt, &t.DataMissing); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, nil
+}
+
+// DeleteTorrent deletes a torrent for reason, writing a "torrent_deleted"
+// usage log so the owner's activity still says why it went. Expired and
+// taken-down torrents are logged by LogTorrentExpired and
+// LogTorrentTakenDown instead.
+func (db *Database) DeleteTorrent(ctx context.Context, id uuid.UUID, reason models.ClosedReason) error {
+	if !reason.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidClosedReason, reason)
+	}
+	_, err := db.pool.Exec(ctx,
+		`WITH deleted AS (DELETE FROM torrents WHERE id = $1 RETURNING id, user_id, info_hash, name)
+		 INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 SELECT user_id, 'torrent_deleted', 0, jsonb_build_object(
+			'torrent_id', id, 'info_hash', info_hash, 'name', name, 'closed_reason', $2::text)
+		 FROM deleted WHERE $2::text NOT IN ('expired', 'dmca')`,
+		id, string(reason))
 	return err
 }
 
 func (db *Database) CountActiveTorrents(ctx context.Context, userID uuid.UUID) (int, error) {
 	var count int
 	err := db.pool.QueryRow(ctx,
-		`SELECT COUNT(*) FROM torrents WHERE user_id = $1 AND status IN ('pending', 'downloading')`,
+		`SELECT COUNT(*) FROM torrents WHERE user_id = $1 AND status IN ('fetching', 'metadata_queued', 'pending', 'downloading')`,
+		userID).Scan(&count)
+	return count, err
+}
+
+// CountCreatedTorrents counts the torrents the user created from their own
+// files that are still kept, and so seeding
+func (db *Database) CountCreatedTorrents(ctx context.Context, userID uuid.UUID) (int, error) {
+	var count int
+	err := db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM torrents WHERE user_id = $1 AND source = 'created' AND status NOT IN ('failed', 'cancelled')`,
 		userID).Scan(&count)
 	return count, err
 }
 
+// GetStorageUsage returns the user's footprint on disk. It is computed from
+// the torrents table, so torrents the cleanup job purges stop counting as
+// soon as their rows are gone.
+func (db *Database) GetStorageUsage(ctx context.Context, userID uuid.UUID) (models.StorageUsage, error) {
+	var usage models.StorageUsage
+	err := db.pool.QueryRow(ctx,
+		`SELECT
+			COALESCE(SUM(CASE WHEN deduplicated_from IS NULL THEN total_size ELSE 0 END + COALESCE(zip_size, 0)) FILTER (
+				WHERE status IN ('completed', 'seeding', 'checking') AND (expires_at IS NULL OR expires_at > NOW())), 0),
+			COALESCE(SUM(total_size) FILTER (
+				WHERE status IN ('fetching', 'metadata_queued', 'pending', 'downloading', 'paused', 'stalled')), 0)
+		 FROM torrents WHERE user_id = $1`,
+		userID).Scan(&usage.Used, &usage.Pending)
+	return usage, err
+}
+
 func (db *Database) GetExpiredTorrents(ctx context.Context) ([]models.Torrent, error) {
 	rows, err := db.pool.Query(ctx,
 		`SELECT id, user_id, info_hash, name FROM torrents WHERE expires_at < NOW()`)
@@ -461,31 +1523,178 @@ func (db *Database) GetExpiredTorrents(ctx context.Context) ([]models.Torrent, e
 	return torrents, nil
 }
 
+// GetFailedTorrentsBefore returns the failed and cancelled torrents that
+// last changed before cutoff, oldest first
+func (db *Database) GetFailedTorrentsBefore(ctx context.Context, cutoff time.Time) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, user_id, COALESCE(info_hash, ''), name, status FROM torrents
+		 WHERE status IN ('failed', 'cancelled') AND updated_at < $1
+		 ORDER BY updated_at`,
+		cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		var t models.Torrent
+		if err := rows.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.Status); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, rows.Err()
+}
+
+// InfoHashInUse reports whether any torrent still references infoHash, so
+// its data on disk must be kept
+func (db *Database) InfoHashInUse(ctx context.Context, infoHash string) (bool, error) {
+	var inUse bool
+	err := db.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM torrents WHERE info_hash = $1)`,
+		infoHash).Scan(&inUse)
+	return inUse, err
+}
+
+// LogTorrentExpired writes an "expired" usage log, so the user's history
+// shows why the torrent disappeared
+func (db *Database) LogTorrentExpired(ctx context.Context, t *models.Torrent) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 VALUES ($1, 'expired', 0, jsonb_build_object(
+			'torrent_id', $2::uuid, 'info_hash', $3::text, 'name', $4::text))`,
+		t.UserID, t.ID, t.InfoHash, t.Name)
+	return err
+}
+
+// GetTorrentsExpiringWithin returns torrents expiring in the next window
+// whose owners haven't been warned yet
+func (db *Database) GetTorrentsExpiringWithin(ctx context.Context, window time.Duration) ([]models.ExpiringTorrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT t.id, t.user_id, t.name, t.expires_at, u.email, COALESCE(u.email_notifications, TRUE), u.timezone
+		 FROM torrents t JOIN users u ON u.id = t.user_id
+		 WHERE t.expires_at > NOW() AND t.expires_at <= $1 AND t.expiry_warned_at IS NULL`,
+		time.Now().Add(window))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.ExpiringTorrent
+	for rows.Next() {
+		var t models.ExpiringTorrent
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.ExpiresAt, &t.Email, &t.EmailNotifications, &t.Timezone); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, rows.Err()
+}
+
+// MarkExpiryWarned records that the torrent's owner was warned of its expiry
+func (db *Database) MarkExpiryWarned(ctx context.Context, id uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET expiry_warned_at = NOW() WHERE id = $1`,
+		id)
+	return err
+}
+
+// ExtendTorrentExpiry re-applies retentionDays from now to a completed
+// torrent, never shortening it, and counts the extension. It returns false
+// if the torrent has no expiry or has already been extended maxExtensions
+// times.
+func (db *Database) ExtendTorrentExpiry(ctx context.Context, id uuid.UUID, retentionDays, maxExtensions int) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET expires_at = GREATEST(expires_at, $1), extensions = COALESCE(extensions, 0) + 1,
+		 expiry_warned_at = NULL, updated_at = NOW()
+		 WHERE id = $2 AND expires_at IS NOT NULL AND COALESCE(extensions, 0) < $3`,
+		time.Now().AddDate(0, 0, retentionDays), id, maxExtensions)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
 // Download token methods
-func (db *Database) CreateDownloadToken(ctx context.Context, torrentID uuid.UUID, filePath, token string, maxDownloads int, expiresIn time.Duration) error {
-	expiresAt := time.Now().Add(expiresIn)
+func (db *Database) CreateDownloadToken(ctx context.Context, torrentID uuid.UUID, filePath string, isDirectory bool, token string, maxDownloads int, expiresAt time.Time) error {
 	_, err := db.pool.Exec(ctx,
-		`INSERT INTO download_tokens (torrent_id, file_path, token, expires_at, max_downloads)
-		 VALUES ($1, $2, $3, $4, $5)`,
-		torrentID, filePath, token, expiresAt, maxDownloads)
+		`INSERT INTO download_tokens (torrent_id, file_path, is_directory, token, expires_at, max_downloads)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		torrentID, filePath, isDirectory, token, expiresAt, maxDownloads)
 	return err
 }
 
+// GetActiveTokenForFile returns a download token for the torrent's file,
+// or directory, issued for maxDownloads that has downloads left and is
+// valid for at least minValidity more, the latest expiring if there are
+// several; nil if none is
+func (db *Database) GetActiveTokenForFile(ctx context.Context, torrentID uuid.UUID, filePath string, isDirectory bool, maxDownloads int, minValidity time.Duration) (*models.DownloadToken, error) {
+	dt := &models.DownloadToken{}
+	err := db.pool.QueryRow(ctx,
+		`SELECT id, torrent_id, file_path, COALESCE(is_directory, FALSE), token, expires_at, download_count, max_downloads, created_at
+		 FROM download_tokens
+		 WHERE torrent_id = $1 AND file_path = $2 AND COALESCE(is_directory, FALSE) = $3
+		 AND max_downloads = $4 AND download_count < max_downloads AND expires_at > $5
+		 ORDER BY expires_at DESC LIMIT 1`,
+		torrentID, filePath, isDirectory, maxDownloads, time.Now().Add(minValidity)).Scan(&dt.ID, &dt.TorrentID,
+		&dt.FilePath, &dt.IsDirectory, &dt.Token, &dt.ExpiresAt, &dt.DownloadCount, &dt.MaxDownloads, &dt.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return dt, nil
+}
+
 func (db *Database) GetDownloadToken(ctx context.Context, token string) (*models.DownloadToken, error) {
 	dt := &models.DownloadToken{}
+	var torrentID *uuid.UUID
 	err := db.pool.QueryRow(ctx,
-		`SELECT id, torrent_id, file_path, token, expires_at, download_count, max_downloads, created_at
+		`SELECT id, torrent_id, file_path, COALESCE(is_directory, FALSE), token, expires_at, download_count, max_downloads, created_at
 		 FROM download_tokens WHERE token = $1`,
-		token).Scan(&dt.ID, &dt.TorrentID, &dt.FilePath, &dt.Token, &dt.ExpiresAt, &dt.DownloadCount, &dt.MaxDownloads, &dt.CreatedAt)
+		token).Scan(&dt.ID, &torrentID, &dt.FilePath, &dt.IsDirectory, &dt.Token, &dt.ExpiresAt, &dt.DownloadCount, &dt.MaxDownloads, &dt.CreatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if torrentID != nil {
+		dt.TorrentID = *torrentID
+	} else {
+		dt.TorrentExpired = true
+	}
 	return dt, nil
 }
 
+// ExpireDownloadTokens detaches an expired torrent's download tokens before
+// it is deleted, which would otherwise take them with it, so their links
+// keep answering that the torrent expired rather than that they never
+// existed
+func (db *Database) ExpireDownloadTokens(ctx context.Context, torrentID uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE download_tokens SET torrent_id = NULL WHERE torrent_id = $1`, torrentID)
+	return err
+}
+
+// ExpiredTokenRetention is how long after they run out the tokens of
+// expired torrents are kept to answer for them
+const ExpiredTokenRetention = 7 * 24 * time.Hour
+
+// DeleteStaleDownloadTokens removes the tokens of expired torrents
+// ExpiredTokenRetention after they ran out
+func (db *Database) DeleteStaleDownloadTokens(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM download_tokens WHERE torrent_id IS NULL AND expires_at < $1`,
+		time.Now().Add(-ExpiredTokenRetention))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 func (db *Database) IncrementDownloadCount(ctx context.Context, token string) error {
 	_, err := db.pool.Exec(ctx,
 		`UPDATE download_tokens SET download_count = download_count + 1 WHERE token = $1`,
@@ -493,44 +1702,240 @@ func (db *Database) IncrementDownloadCount(ctx context.Context, token string) er
 	return err
 }
 
-// Usage logging
-func (db *Database) LogUsage(ctx context.Context, userID uuid.UUID, action string, bytes int64, metadata string) error {
-	_, err := db.pool.Exec(ctx,
+// LogUsage writes a usage log. metadata is stored as a JSON object, e.g. a
+// map with the torrent_id and name the activity feed reads back.
+func (db *Database) LogUsage(ctx context.Context, userID uuid.UUID, action string, bytes int64, metadata map[string]interface{}) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = db.pool.Exec(ctx,
 		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata) VALUES ($1, $2, $3, $4)`,
-		userID, action, bytes, metadata)
+		userID, action, bytes, data)
+	return err
+}
+
+// LogAdminDenied writes an "admin_denied" usage log, the audit record of a
+// refused admin request
+func (db *Database) LogAdminDenied(ctx context.Context, d models.AdminDenial) error {
+	return db.LogUsage(ctx, d.UserID, "admin_denied", 0, map[string]interface{}{
+		"reason": d.Reason,
+		"ip":     d.IP,
+		"method": d.Method,
+		"path":   d.Path,
+	})
+}
+
+// LogTorrentFailed writes a "torrent_failed" usage log, unless the torrent
+// has already failed. Call it before SetTorrentError.
+func (db *Database) LogTorrentFailed(ctx context.Context, id uuid.UUID, reason models.ClosedReason, errMsg string) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 SELECT user_id, 'torrent_failed', 0, jsonb_build_object(
+			'torrent_id', id, 'name', name, 'error', $2::text, 'closed_reason', $3::text)
+		 FROM torrents WHERE id = $1 AND status <> 'failed'`,
+		id, errMsg, string(reason))
 	return err
 }
 
-func (db *Database) GetMonthlyUsage(ctx context.Context, userID uuid.UUID) (int64, error) {
+// LogPlanChanged writes a "plan_changed" usage log
+func (db *Database) LogPlanChanged(ctx context.Context, userID uuid.UUID, plan, previousPlan string) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 VALUES ($1, 'plan_changed', 0, jsonb_build_object('plan', $2::text, 'previous_plan', $3::text))`,
+		userID, plan, previousPlan)
+	return err
+}
+
+// GetActivity returns activity feed entries older than before (all when nil),
+// newest first, for one user or, when userID is nil, everyone with their
+// email. Names come
+// from the log's metadata, falling back to the torrent while it exists and
+// to the bare string metadata of entries written before it was structured.
+func (db *Database) GetActivity(ctx context.Context, userID *uuid.UUID, before *time.Time, limit int) ([]models.Activity, error) {
+	var activities []models.Activity
+	err := db.eachActivity(ctx, userID, before, limit, func(a *models.Activity) error {
+		activities = append(activities, *a)
+		return nil
+	})
+	return activities, err
+}
+
+// EachActivity calls fn with every activity feed entry GetActivity would
+// return with no limit, in the same order, one row at a time. An error from
+// fn stops the iteration and is returned.
+func (db *Database) EachActivity(ctx context.Context, userID *uuid.UUID, before *time.Time, fn func(a *models.Activity) error) error {
+	return db.eachActivity(ctx, userID, before, 0, fn)
+}
+
+// eachActivity iterates GetActivity's entries; limit 0 for all
+func (db *Database) eachActivity(ctx context.Context, userID *uuid.UUID, before *time.Time, limit int, fn func(a *models.Activity) error) error {
+	actions := make([]string, 0, len(models.ActivityActions))
+	for action := range models.ActivityActions {
+		if userID == nil || !models.AdminOnlyActions[action] {
+			actions = append(actions, action)
+		}
+	}
+
+	rows, err := db.pool.Query(ctx,
+		`SELECT l.id, l.user_id, CASE WHEN $2::uuid IS NULL THEN COALESCE(u.email, '') ELSE '' END, l.action, COALESCE(l.bytes_transferred, 0),
+			t.id, COALESCE(l.metadata->>'name', t.name,
+				CASE WHEN jsonb_typeof(l.metadata) = 'string' THEN l.metadata #>> '{}' END, ''),
+			COALESCE(l.metadata->>'plan', ''), COALESCE(l.metadata->>'invite_code', ''),
+			COALESCE(l.metadata->>'reason', ''), COALESCE(l.metadata->>'ip', ''),
+			COALESCE((l.metadata->>'method') || ' ' || (l.metadata->>'path'), ''),
+			COALESCE(l.metadata->>'closed_reason', CASE l.action WHEN 'download_completed' THEN 'completed'
+				WHEN 'expired' THEN 'expired' WHEN 'taken_down' THEN 'dmca' END, ''), l.created_at
+		 FROM usage_logs l
+		 LEFT JOIN users u ON u.id = l.user_id
+		 LEFT JOIN torrents t ON t.id = CASE WHEN l.metadata->>'torrent_id' ~ '^[0-9a-f-]{36}$'
+			THEN (l.metadata->>'torrent_id')::uuid END
+		 WHERE l.action = ANY($1)
+		 AND ($2::uuid IS NULL OR l.user_id = $2)
+		 AND ($3::timestamptz IS NULL OR l.created_at < $3)
+		 ORDER BY l.created_at DESC LIMIT NULLIF($4, 0)`,
+		actions, userID, before, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Activity
+		var action string
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Email, &action, &a.Bytes,
+			&a.TorrentID, &a.TorrentName, &a.Plan, &a.InviteCode, &a.Reason, &a.IP, &a.Request, &a.ClosedReason, &a.CreatedAt); err != nil {
+			return err
+		}
+		a.Type = models.ActivityActions[action]
+		if err := fn(&a); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LogUploadUsage writes an "upload" usage log for every torrent that has
+// uploaded data since it was last logged, tagged with the owner's current
+// plan, and returns how many torrents were logged
+func (db *Database) LogUploadUsage(ctx context.Context) (int, error) {
+	tag, err := db.pool.Exec(ctx,
+		`WITH pending AS (
+			SELECT id, user_id, uploaded_size, uploaded_size - upload_logged AS delta
+			FROM torrents
+			WHERE uploaded_size > upload_logged
+			FOR UPDATE
+		), marked AS (
+			UPDATE torrents t SET upload_logged = p.uploaded_size
+			FROM pending p WHERE t.id = p.id
+		)
+		INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		SELECT p.user_id, 'upload', p.delta,
+			jsonb_build_object('torrent_id', p.id, 'plan', COALESCE(
+				(SELECT plan FROM subscriptions s WHERE s.user_id = p.user_id ORDER BY created_at DESC LIMIT 1),
+				'free'))
+		FROM pending p`)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// GetUsagePeriod returns the user's current usage period, see
+// models.CurrentUsagePeriod
+func (db *Database) GetUsagePeriod(ctx context.Context, userID uuid.UUID) (models.UsagePeriod, error) {
+	sub, err := db.GetSubscription(ctx, userID)
+	if err != nil {
+		return models.UsagePeriod{}, err
+	}
+	return models.CurrentUsagePeriod(sub, time.Now()), nil
+}
+
+// sumUsage totals the bytes of the user's usage logs of action within period
+func (db *Database) sumUsage(ctx context.Context, userID uuid.UUID, action string, period models.UsagePeriod) (int64, error) {
 	var total int64
 	err := db.pool.QueryRow(ctx,
-		`SELECT COALESCE(SUM(bytes_transferred), 0) FROM usage_logs 
-		 WHERE user_id = $1 AND action = 'download_completed'
-		 AND created_at >= date_trunc('month', CURRENT_DATE)`,
-		userID).Scan(&total)
+		`SELECT COALESCE(SUM(bytes_transferred), 0) FROM usage_logs
+		 WHERE user_id = $1 AND action = $2
+		 AND created_at >= $3 AND created_at < $4`,
+		userID, action, period.Start, period.End).Scan(&total)
 	return total, err
 }
 
+// GetMonthlyUpload returns the data the user's torrents uploaded in period
+func (db *Database) GetMonthlyUpload(ctx context.Context, userID uuid.UUID, period models.UsagePeriod) (int64, error) {
+	return db.sumUsage(ctx, userID, "upload", period)
+}
+
+// GetMonthlyUsage returns the bytes of torrents the user downloaded in
+// period, which is what plans meter
+func (db *Database) GetMonthlyUsage(ctx context.Context, userID uuid.UUID, period models.UsagePeriod) (int64, error) {
+	return db.sumUsage(ctx, userID, "download_completed", period)
+}
+
+// GetMonthlyServed returns the bytes actually sent to the user over HTTP in
+// period, re-downloads included and aborted downloads counted only as far
+// as they got
+func (db *Database) GetMonthlyServed(ctx context.Context, userID uuid.UUID, period models.UsagePeriod) (int64, error) {
+	return db.sumUsage(ctx, userID, "download_served", period)
+}
+
 // Refresh token methods
-func (db *Database) SaveRefreshToken(ctx context.Context, userID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+
+// SaveRefreshToken records a session's refresh token, with when the session
+// signed in, whether it did with a two-factor code, and the client and
+// version it was signed in from, "" when unknown
+func (db *Database) SaveRefreshToken(ctx context.Context, userID uuid.UUID, tokenHash string, expiresAt, sessionStartedAt time.Time, twoFactor bool, client, clientVersion string) error {
 	_, err := db.pool.Exec(ctx,
-		`INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
-		userID, tokenHash, expiresAt)
+		`INSERT INTO refresh_tokens (user_id, token_hash, expires_at, session_started_at, two_factor, client, client_version)
+		 VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))`,
+		userID, tokenHash, expiresAt, sessionStartedAt, twoFactor, client, clientVersion)
 	return err
 }
 
-func (db *Database) GetRefreshToken(ctx context.Context, tokenHash string) (uuid.UUID, error) {
+// GetRefreshToken returns the user an unexpired refresh token belongs to,
+// when its session signed in and whether it did with a two-factor code, or
+// uuid.Nil when there is no such token
+func (db *Database) GetRefreshToken(ctx context.Context, tokenHash string) (uuid.UUID, time.Time, bool, error) {
 	var userID uuid.UUID
+	var startedAt time.Time
+	var twoFactor bool
 	err := db.pool.QueryRow(ctx,
-		`SELECT user_id FROM refresh_tokens WHERE token_hash = $1 AND expires_at > NOW()`,
-		tokenHash).Scan(&userID)
+		`SELECT user_id, COALESCE(session_started_at, created_at), two_factor FROM refresh_tokens
+		 WHERE token_hash = $1 AND expires_at > NOW()`,
+		tokenHash).Scan(&userID, &startedAt, &twoFactor)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			return uuid.Nil, nil
+			return uuid.Nil, time.Time{}, false, nil
+		}
+		return uuid.Nil, time.Time{}, false, err
+	}
+	return userID, startedAt, twoFactor, nil
+}
+
+// GetUserSessions returns the user's unexpired sessions, most recently
+// refreshed first
+func (db *Database) GetUserSessions(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, COALESCE(client, ''), COALESCE(client_version, ''),
+			COALESCE(session_started_at, created_at), created_at, expires_at, two_factor
+		 FROM refresh_tokens WHERE user_id = $1 AND expires_at > NOW()
+		 ORDER BY created_at DESC`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.Client, &s.ClientVersion, &s.StartedAt, &s.RefreshedAt, &s.ExpiresAt, &s.TwoFactor); err != nil {
+			return nil, err
 		}
-		return uuid.Nil, err
+		sessions = append(sessions, s)
 	}
-	return userID, nil
+	return sessions, rows.Err()
 }
 
 func (db *Database) DeleteRefreshToken(ctx context.Context, tokenHash string) error {
@@ -542,3 +1947,1534 @@ func (db *Database) DeleteUserRefreshTokens(ctx context.Context, userID uuid.UUI
 	_, err := db.pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1`, userID)
 	return err
 }
+
+// IdempotencyKeyTTL is how long a stored idempotent response is replayed
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyClaimLease is how long a claimed key may stay in progress. It
+// is well past any request deadline, so a claim older than this was left by
+// a server that died before completing or releasing it.
+const IdempotencyClaimLease = 10 * time.Minute
+
+// ClaimIdempotencyKey reserves key for the user's request. It returns nil
+// when the key is new (or its previous use has expired, or its claim has
+// outlived IdempotencyClaimLease) and the caller should run the request, or
+// the record left by an earlier request with the key.
+func (db *Database) ClaimIdempotencyKey(ctx context.Context, userID uuid.UUID, key, requestHash string) (*models.IdempotencyRecord, error) {
+	now := time.Now()
+	if _, err := db.pool.Exec(ctx,
+		`DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2
+		 AND (created_at < $3 OR (status_code = 0 AND created_at < $4))`,
+		userID, key, now.Add(-IdempotencyKeyTTL), now.Add(-IdempotencyClaimLease)); err != nil {
+		return nil, err
+	}
+
+	tag, err := db.pool.Exec(ctx,
+		`INSERT INTO idempotency_keys (user_id, key, request_hash) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id, key) DO NOTHING`,
+		userID, key, requestHash)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, nil
+	}
+
+	rec := &models.IdempotencyRecord{Key: key}
+	var contentType *string
+	err = db.pool.QueryRow(ctx,
+		`SELECT request_hash, status_code, content_type, response_body, torrent_id, created_at
+		 FROM idempotency_keys WHERE user_id = $1 AND key = $2`,
+		userID, key).Scan(&rec.RequestHash, &rec.StatusCode, &contentType, &rec.ResponseBody,
+		&rec.TorrentID, &rec.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// Released between our insert and read; let the caller retry
+			return nil, fmt.Errorf("idempotency key %q was released concurrently", key)
+		}
+		return nil, err
+	}
+	if contentType != nil {
+		rec.ContentType = *contentType
+	}
+	return rec, nil
+}
+
+// CompleteIdempotencyKey stores the response to replay for a claimed key.
+// A response is never overwritten: when a request outlives its lease and a
+// retry took the key over and completed first, the retry's response stays.
+func (db *Database) CompleteIdempotencyKey(ctx context.Context, userID uuid.UUID, rec *models.IdempotencyRecord) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE idempotency_keys SET status_code = $1, content_type = $2, response_body = $3, torrent_id = $4
+		 WHERE user_id = $5 AND key = $6 AND status_code = 0`,
+		rec.StatusCode, rec.ContentType, rec.ResponseBody, rec.TorrentID, userID, rec.Key)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claimed key so the request can be retried.
+// A stored response is kept.
+func (db *Database) ReleaseIdempotencyKey(ctx context.Context, userID uuid.UUID, key string) error {
+	_, err := db.pool.Exec(ctx,
+		`DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status_code = 0`,
+		userID, key)
+	return err
+}
+
+// ConfirmTokenTTL is how long a destructive action may be confirmed for
+const ConfirmTokenTTL = 2 * time.Minute
+
+// confirmKeyPrefix sets confirmation tokens apart from Idempotency-Keys,
+// which share their table; the action confirmed is kept as the request hash
+const confirmKeyPrefix = "confirm:"
+
+// CreateConfirmToken stores a token with which the user may confirm action
+func (db *Database) CreateConfirmToken(ctx context.Context, userID uuid.UUID, token, action string) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO idempotency_keys (user_id, key, request_hash) VALUES ($1, $2, $3)`,
+		userID, confirmKeyPrefix+token, action)
+	return err
+}
+
+// ConsumeConfirmToken uses up the user's token for action, reporting whether
+// it existed and had not expired
+func (db *Database) ConsumeConfirmToken(ctx context.Context, userID uuid.UUID, token, action string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM idempotency_keys
+		 WHERE user_id = $1 AND key = $2 AND request_hash = $3 AND created_at >= $4`,
+		userID, confirmKeyPrefix+token, action, time.Now().Add(-ConfirmTokenTTL))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteExpiredIdempotencyKeys removes keys older than IdempotencyKeyTTL and
+// confirmation tokens older than ConfirmTokenTTL
+func (db *Database) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM idempotency_keys WHERE created_at < $1
+		 OR (key LIKE $2 AND created_at < $3)`,
+		time.Now().Add(-IdempotencyKeyTTL), confirmKeyPrefix+"%", time.Now().Add(-ConfirmTokenTTL))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Upload methods
+func (db *Database) CreateUpload(ctx context.Context, u *models.Upload) error {
+	u.CreatedAt = time.Now()
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO uploads (id, user_id, filename, size, received, expires_at, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		u.ID, u.UserID, u.Filename, u.Size, u.Received, u.ExpiresAt, u.CreatedAt)
+	return err
+}
+
+func (db *Database) GetUpload(ctx context.Context, id uuid.UUID) (*models.Upload, error) {
+	u := &models.Upload{}
+	err := db.pool.QueryRow(ctx,
+		`SELECT id, user_id, filename, size, received, expires_at, created_at
+		 FROM uploads WHERE id = $1 AND expires_at > NOW()`,
+		id).Scan(&u.ID, &u.UserID, &u.Filename, &u.Size, &u.Received, &u.ExpiresAt, &u.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// AdvanceUpload moves an upload's received count from one offset to another
+// and pushes back its expiry. It reports false if the upload was no longer at
+// from, meaning another chunk got there first.
+func (db *Database) AdvanceUpload(ctx context.Context, id uuid.UUID, from, to int64, expiresAt time.Time) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE uploads SET received = $1, expires_at = $2 WHERE id = $3 AND received = $4`,
+		to, expiresAt, id, from)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// CountActiveUploads counts the user's unexpired, incomplete uploads
+func (db *Database) CountActiveUploads(ctx context.Context, userID uuid.UUID) (int, error) {
+	var count int
+	err := db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM uploads WHERE user_id = $1 AND received < size AND expires_at > NOW()`,
+		userID).Scan(&count)
+	return count, err
+}
+
+func (db *Database) DeleteUpload(ctx context.Context, id uuid.UUID) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM uploads WHERE id = $1`, id)
+	return err
+}
+
+// DeleteExpiredUploads removes expired uploads and returns them so their
+// stored data can be removed too
+func (db *Database) DeleteExpiredUploads(ctx context.Context) ([]models.Upload, error) {
+	rows, err := db.pool.Query(ctx,
+		`DELETE FROM uploads WHERE expires_at <= NOW() RETURNING id, user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []models.Upload
+	for rows.Next() {
+		var u models.Upload
+		if err := rows.Scan(&u.ID, &u.UserID); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+// Add velocity and churn: the same info hash deleted ChurnThreshold times
+// within ChurnWindow can't be added again by that user for ChurnCooldown
+const (
+	ChurnThreshold = 3
+	ChurnWindow    = 24 * time.Hour
+	ChurnCooldown  = 6 * time.Hour
+)
+
+// CountTorrentAdds returns how many torrents the user added in the last hour
+// and the last day, deleted ones included
+func (db *Database) CountTorrentAdds(ctx context.Context, userID uuid.UUID) (hour, day int, err error) {
+	now := time.Now()
+	err = db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE created_at > $2), COUNT(*)
+		 FROM usage_logs WHERE user_id = $1 AND action = 'torrent_added' AND created_at > $3`,
+		userID, now.Add(-time.Hour), now.Add(-24*time.Hour)).Scan(&hour, &day)
+	return hour, day, err
+}
+
+// RecordTorrentChurn counts a user deleting a torrent, starting a cool-down
+// for its info hash once it has been deleted ChurnThreshold times in the window
+func (db *Database) RecordTorrentChurn(ctx context.Context, userID uuid.UUID, infoHash string) error {
+	now := time.Now()
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO torrent_churn (user_id, info_hash, deletes, window_start)
+		 VALUES ($1, $2, 1, $3)
+		 ON CONFLICT (user_id, info_hash) DO UPDATE SET
+			deletes = CASE WHEN torrent_churn.window_start < $4 THEN 1 ELSE torrent_churn.deletes + 1 END,
+			window_start = CASE WHEN torrent_churn.window_start < $4 THEN $3 ELSE torrent_churn.window_start END,
+			cooldown_until = CASE
+				WHEN torrent_churn.window_start >= $4 AND torrent_churn.deletes + 1 >= $5 THEN $6
+				ELSE torrent_churn.cooldown_until END`,
+		userID, infoHash, now, now.Add(-ChurnWindow), ChurnThreshold, now.Add(ChurnCooldown))
+	return err
+}
+
+// GetChurnCooldown returns when the user may add the info hash again, or nil
+// if it isn't cooling down
+func (db *Database) GetChurnCooldown(ctx context.Context, userID uuid.UUID, infoHash string) (*time.Time, error) {
+	var until time.Time
+	err := db.pool.QueryRow(ctx,
+		`SELECT cooldown_until FROM torrent_churn
+		 WHERE user_id = $1 AND info_hash = $2 AND cooldown_until > NOW()`,
+		userID, infoHash).Scan(&until)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &until, nil
+}
+
+// DeleteStaleChurn removes churn counters whose window and cool-down are over
+func (db *Database) DeleteStaleChurn(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM torrent_churn
+		 WHERE window_start < $1 AND (cooldown_until IS NULL OR cooldown_until < NOW())`,
+		time.Now().Add(-ChurnWindow))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetAddOffenders returns the users adding or churning the most torrents over
+// the last day, heaviest first
+func (db *Database) GetAddOffenders(ctx context.Context, limit int) ([]models.AddOffender, error) {
+	since := time.Now().Add(-24 * time.Hour)
+	rows, err := db.pool.Query(ctx,
+		`WITH adds AS (
+			SELECT user_id, COUNT(*) AS n FROM usage_logs
+			WHERE action = 'torrent_added' AND created_at > $1
+			GROUP BY user_id
+		), churn AS (
+			SELECT user_id, SUM(deletes) AS n, COUNT(*) FILTER (WHERE cooldown_until > NOW()) AS cooling
+			FROM torrent_churn WHERE window_start > $2 OR cooldown_until > NOW()
+			GROUP BY user_id
+		)
+		SELECT u.id, u.email, COALESCE(a.n, 0), COALESCE(c.n, 0), COALESCE(c.cooling, 0)
+		FROM users u
+		LEFT JOIN adds a ON a.user_id = u.id
+		LEFT JOIN churn c ON c.user_id = u.id
+		WHERE a.n IS NOT NULL OR c.n IS NOT NULL
+		ORDER BY COALESCE(a.n, 0) + COALESCE(c.n, 0) DESC
+		LIMIT $3`,
+		since, time.Now().Add(-ChurnWindow), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offenders []models.AddOffender
+	for rows.Next() {
+		var o models.AddOffender
+		if err := rows.Scan(&o.UserID, &o.Email, &o.Adds, &o.Deletes, &o.Cooldowns); err != nil {
+			return nil, err
+		}
+		offenders = append(offenders, o)
+	}
+	return offenders, rows.Err()
+}
+
+// Collection methods
+func (db *Database) CreateCollection(ctx context.Context, userID uuid.UUID, name string) (*models.Collection, error) {
+	c := &models.Collection{ID: uuid.New(), UserID: userID, Name: name}
+	err := db.pool.QueryRow(ctx,
+		`INSERT INTO collections (id, user_id, name) VALUES ($1, $2, $3) RETURNING created_at, updated_at`,
+		c.ID, userID, name).Scan(&c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// collectionColumns are the columns read by scanCollection, member count included
+const collectionColumns = `c.id, c.user_id, c.name, c.created_at, c.updated_at,
+	(SELECT COUNT(*) FROM torrents t WHERE t.collection_id = c.id)`
+
+func scanCollection(row pgx.Row) (*models.Collection, error) {
+	c := &models.Collection{}
+	err := row.Scan(&c.ID, &c.UserID, &c.Name, &c.CreatedAt, &c.UpdatedAt, &c.TorrentCount)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (db *Database) GetCollection(ctx context.Context, id uuid.UUID) (*models.Collection, error) {
+	return scanCollection(db.pool.QueryRow(ctx,
+		`SELECT `+collectionColumns+` FROM collections c WHERE c.id = $1`,
+		id))
+}
+
+func (db *Database) GetCollectionsByUser(ctx context.Context, userID uuid.UUID) ([]models.Collection, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+collectionColumns+` FROM collections c WHERE c.user_id = $1 ORDER BY c.name`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []models.Collection
+	for rows.Next() {
+		c, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, *c)
+	}
+	return collections, rows.Err()
+}
+
+func (db *Database) RenameCollection(ctx context.Context, id uuid.UUID, name string) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE collections SET name = $1, updated_at = NOW() WHERE id = $2`,
+		name, id)
+	return err
+}
+
+// DeleteCollection removes a collection; its torrents stay, ungrouped
+func (db *Database) DeleteCollection(ctx context.Context, id uuid.UUID) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM collections WHERE id = $1`, id)
+	return err
+}
+
+// GetCollectionTorrents returns a collection's member torrents with their files
+func (db *Database) GetCollectionTorrents(ctx context.Context, id uuid.UUID) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+torrentColumns+` FROM torrents WHERE collection_id = $1 ORDER BY created_at`,
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		t, err := scanTorrent(rows)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, *t)
+	}
+	return torrents, rows.Err()
+}
+
+// SetTorrentCollection moves a torrent into a collection, or out of any
+// when collectionID is nil
+func (db *Database) SetTorrentCollection(ctx context.Context, id uuid.UUID, collectionID *uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET collection_id = $1, updated_at = NOW() WHERE id = $2`,
+		collectionID, id)
+	return err
+}
+
+// Invite methods
+
+// inviteColumns are the columns read by scanInvite
+const inviteColumns = `id, code, created_by, max_uses, uses, expires_at, created_at`
+
+func scanInvite(row pgx.Row) (*models.Invite, error) {
+	inv := &models.Invite{}
+	err := row.Scan(&inv.ID, &inv.Code, &inv.CreatedBy, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return inv, nil
+}
+
+// CreateInvite stores a new invite and reports false if its code is taken
+func (db *Database) CreateInvite(ctx context.Context, inv *models.Invite) (bool, error) {
+	inv.ID = uuid.New()
+	err := db.pool.QueryRow(ctx,
+		`INSERT INTO invites (id, code, created_by, max_uses, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (code) DO NOTHING RETURNING created_at`,
+		inv.ID, inv.Code, inv.CreatedBy, inv.MaxUses, inv.ExpiresAt).Scan(&inv.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *Database) GetInvite(ctx context.Context, id uuid.UUID) (*models.Invite, error) {
+	return scanInvite(db.pool.QueryRow(ctx,
+		`SELECT `+inviteColumns+` FROM invites WHERE id = $1`, id))
+}
+
+func (db *Database) GetInvites(ctx context.Context) ([]models.Invite, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+inviteColumns+` FROM invites ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []models.Invite
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, *inv)
+	}
+	return invites, rows.Err()
+}
+
+// UpdateInvite changes an invite's use limit and expiry
+func (db *Database) UpdateInvite(ctx context.Context, id uuid.UUID, maxUses int, expiresAt *time.Time) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE invites SET max_uses = $1, expires_at = $2 WHERE id = $3`,
+		maxUses, expiresAt, id)
+	return err
+}
+
+func (db *Database) DeleteInvite(ctx context.Context, id uuid.UUID) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM invites WHERE id = $1`, id)
+	return err
+}
+
+// ConsumeInvite takes one use of the invite with code, atomically, and
+// returns it; nil if there is no such invite or it is used up or expired
+func (db *Database) ConsumeInvite(ctx context.Context, code string) (*models.Invite, error) {
+	return scanInvite(db.pool.QueryRow(ctx,
+		`UPDATE invites SET uses = uses + 1
+		 WHERE code = $1 AND uses < max_uses AND (expires_at IS NULL OR expires_at > NOW())
+		 RETURNING `+inviteColumns,
+		code))
+}
+
+// ReleaseInvite gives back a use taken by a registration that then failed
+func (db *Database) ReleaseInvite(ctx context.Context, id uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE invites SET uses = GREATEST(uses - 1, 0) WHERE id = $1`, id)
+	return err
+}
+
+// LogInviteUsed writes an "invite_used" usage log for the user who
+// registered with inv, shown in the admin activity feed
+func (db *Database) LogInviteUsed(ctx context.Context, userID uuid.UUID, inv *models.Invite) error {
+	return db.LogUsage(ctx, userID, "invite_used", 0, map[string]interface{}{
+		"invite_id":   inv.ID,
+		"invite_code": inv.Code,
+		"created_by":  inv.CreatedBy,
+	})
+}
+
+// BackupTables are the tables a backup holds, in an order that satisfies
+// their foreign keys: users and their plans, subscriptions and subscription
+// events, collections, invites, torrents, usage logs, notifications, abuse
+// reports, blocked hashes and settings. Sessions, download tokens,
+// idempotency keys, uploads, churn counters and import jobs are left out;
+// they mean nothing on another instance.
+var BackupTables = []string{"users", "plans", "subscriptions", "subscription_events", "collections", "invites", "torrents", "usage_logs",
+	"notifications", "abuse_reports", "blocked_hashes", "settings"}
+
+// ErrNotEmpty is returned when restoring into a database that has data
+var ErrNotEmpty = errors.New("database is not empty")
+
+// isBackupTable reports whether table is one of BackupTables
+func isBackupTable(table string) bool {
+	for _, t := range BackupTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// backupReset are columns a backup doesn't keep, as JSON of the values its
+// rows hold instead, by table. TOTP secrets would be working second factors
+// for every user in anyone's hands who has the backup, so two-factor sign-in
+// is off after a restore and users enroll again.
+var backupReset = map[string]string{
+	"users": `{"totp_secret": null, "totp_enabled": false, "totp_last_step": 0}`,
+}
+
+// ExportTable calls fn with each row of a backup table as a JSON object,
+// and returns how many rows there were
+func (db *Database) ExportTable(ctx context.Context, table string, fn func(row []byte) error) (int64, error) {
+	if !isBackupTable(table) {
+		return 0, fmt.Errorf("%s is not a backup table", table)
+	}
+	reset, ok := backupReset[table]
+	if !ok {
+		reset = "{}"
+	}
+	rows, err := db.pool.Query(ctx,
+		`SELECT (to_jsonb(t) || $1::jsonb)::text FROM `+pgx.Identifier{table}.Sanitize()+` t`, reset)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return n, err
+		}
+		if err := fn([]byte(row)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// Restore imports a backup in one transaction. fn is given an insert
+// function taking a backup table and a row as exported by ExportTable;
+// generated columns are recomputed. Every backup table but plans, which Migrate seeds and the
+// backup replaces, must be empty. Nothing is kept if fn or any insert fails.
+func (db *Database) Restore(ctx context.Context, fn func(insert func(table string, row []byte) error) error) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range BackupTables {
+		if table == "plans" {
+			continue
+		}
+		var exists bool
+		if err := tx.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM `+pgx.Identifier{table}.Sanitize()+`)`).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: %s has rows", ErrNotEmpty, table)
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM plans`); err != nil {
+		return err
+	}
+
+	inserts := make(map[string]string)
+	insert := func(table string, row []byte) error {
+		if !isBackupTable(table) {
+			return fmt.Errorf("%s is not a backup table", table)
+		}
+		query, ok := inserts[table]
+		if !ok {
+			var err error
+			if query, err = restoreInsert(ctx, tx, table); err != nil {
+				return err
+			}
+			inserts[table] = query
+		}
+		_, err := tx.Exec(ctx, query, string(row))
+		return err
+	}
+	if err := fn(insert); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	db.invalidatePlans()
+	return nil
+}
+
+// restoreInsert builds the statement inserting one JSON row into table,
+// naming every column but generated ones
+func restoreInsert(ctx context.Context, tx pgx.Tx, table string) (string, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT column_name FROM information_schema.columns
+		 WHERE table_schema = current_schema() AND table_name = $1 AND is_generated = 'NEVER'
+		 ORDER BY ordinal_position`,
+		table)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		columns = append(columns, pgx.Identifier{name}.Sanitize())
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("table %s not found", table)
+	}
+
+	// Backups only restore into the schema version they came from, so rows
+	// have every column; a missing key would be inserted as NULL
+	list := strings.Join(columns, ", ")
+	ident := pgx.Identifier{table}.Sanitize()
+	return `INSERT INTO ` + ident + ` (` + list + `)
+		SELECT ` + list + ` FROM json_populate_record(NULL::` + ident + `, $1::json)`, nil
+}
+
+// SetTorrentNeedsRedownload marks a torrent whose data isn't on disk, with
+// reason as its error. It can be retried from its magnet or torrent file like
+// a failed one.
+func (db *Database) SetTorrentNeedsRedownload(ctx context.Context, id uuid.UUID, reason string) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET status = 'needs_redownload', progress = 0, downloaded_size = 0,
+		 download_speed = 0, upload_speed = 0, peers = 0, seeds = 0, retry_count = 0,
+		 data_missing = TRUE, zip_path = NULL, zip_size = 0, zip_sha256 = NULL, zip_manifest = NULL, zip_status = NULL,
+		 error_message = $2, `+statusHistoryUpdate("'needs_redownload'")+`, updated_at = NOW()
+		 WHERE id = $1`,
+		id, reason)
+	return err
+}
+
+// ImportJobTTL is how long finished import reports are kept
+const ImportJobTTL = 30 * 24 * time.Hour
+
+// CreateImportJob records an import job and its items, pending unless
+// already failed. It reports false, creating nothing, when the user already
+// has one running.
+func (db *Database) CreateImportJob(ctx context.Context, job *models.ImportJob) (bool, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize the user's imports so two can't start at once
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, job.UserID); err != nil {
+		return false, err
+	}
+	var running bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM import_jobs WHERE user_id = $1 AND status = 'running')`,
+		job.UserID).Scan(&running); err != nil {
+		return false, err
+	}
+	if running {
+		return false, nil
+	}
+
+	job.ID = uuid.New()
+	job.Status = models.ImportRunning
+	job.Total = len(job.Items)
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO import_jobs (id, user_id, total, added_ip, added_user_agent)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, '')) RETURNING created_at`,
+		job.ID, job.UserID, job.Total, job.Audit.AddedIP, job.Audit.AddedUserAgent).Scan(&job.CreatedAt); err != nil {
+		return false, err
+	}
+
+	job.Counts = make(map[string]int)
+	for i := range job.Items {
+		item := &job.Items[i]
+		if item.Status == "" {
+			item.Status = models.ImportItemPending
+		}
+		item.UpdatedAt = job.CreatedAt
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO import_items (job_id, position, source, label, collection_id, status, error, updated_at)
+			 VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, NULLIF($7, ''), $8)`,
+			job.ID, item.Position, item.Source, item.Label, item.CollectionID,
+			item.Status, item.Error, job.CreatedAt); err != nil {
+			return false, err
+		}
+		job.Counts[item.Status]++
+	}
+	return true, tx.Commit(ctx)
+}
+
+// GetImportJob returns an import job with its items in order, or nil
+func (db *Database) GetImportJob(ctx context.Context, id uuid.UUID) (*models.ImportJob, error) {
+	job := &models.ImportJob{}
+	err := db.pool.QueryRow(ctx,
+		`SELECT id, user_id, status, total, created_at, finished_at FROM import_jobs WHERE id = $1`,
+		id).Scan(&job.ID, &job.UserID, &job.Status, &job.Total, &job.CreatedAt, &job.FinishedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rows, err := db.pool.Query(ctx,
+		`SELECT position, source, COALESCE(label, ''), collection_id, status, torrent_id,
+		 COALESCE(error, ''), updated_at
+		 FROM import_items WHERE job_id = $1 ORDER BY position`,
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	job.Counts = make(map[string]int)
+	for rows.Next() {
+		var item models.ImportItem
+		if err := rows.Scan(&item.Position, &item.Source, &item.Label, &item.CollectionID,
+			&item.Status, &item.TorrentID, &item.Error, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		job.Counts[item.Status]++
+		job.Items = append(job.Items, item)
+	}
+	return job, rows.Err()
+}
+
+// GetOpenImportItems returns the first perJob pending or queued items of
+// each running import job, oldest job first and in order within a job, with
+// the owner and audit of their job
+func (db *Database) GetOpenImportItems(ctx context.Context, perJob int) ([]models.ImportItem, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT job_id, user_id, added_ip, added_user_agent, position, source, label,
+		 collection_id, status, error
+		 FROM (
+			SELECT i.job_id, j.user_id, COALESCE(j.added_ip, '') AS added_ip,
+			 COALESCE(j.added_user_agent, '') AS added_user_agent, i.position, i.source,
+			 COALESCE(i.label, '') AS label, i.collection_id, i.status, COALESCE(i.error, '') AS error,
+			 j.created_at, ROW_NUMBER() OVER (PARTITION BY i.job_id ORDER BY i.position) AS n
+			FROM import_items i JOIN import_jobs j ON j.id = i.job_id
+			WHERE j.status = 'running' AND i.status IN ('pending', 'queued')
+		 ) open
+		 WHERE n <= $1
+		 ORDER BY created_at, job_id, position`,
+		perJob)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.ImportItem
+	for rows.Next() {
+		var item models.ImportItem
+		if err := rows.Scan(&item.JobID, &item.UserID, &item.Audit.AddedIP, &item.Audit.AddedUserAgent,
+			&item.Position, &item.Source, &item.Label, &item.CollectionID, &item.Status, &item.Error); err != nil {
+			return nil, err
+		}
+		item.Audit.Source = models.SourceImport
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// UpdateImportItem records what became of an import item
+func (db *Database) UpdateImportItem(ctx context.Context, item *models.ImportItem) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE import_items SET status = $1, torrent_id = $2, error = NULLIF($3, ''), updated_at = NOW()
+		 WHERE job_id = $4 AND position = $5`,
+		item.Status, item.TorrentID, item.Error, item.JobID, item.Position)
+	return err
+}
+
+// FinishImportJobs marks running import jobs with no pending or queued
+// items done, returning them
+func (db *Database) FinishImportJobs(ctx context.Context) ([]models.ImportJob, error) {
+	rows, err := db.pool.Query(ctx,
+		`UPDATE import_jobs j SET status = 'done', finished_at = NOW()
+		 WHERE status = 'running' AND NOT EXISTS (
+			SELECT 1 FROM import_items i WHERE i.job_id = j.id AND i.status IN ('pending', 'queued'))
+		 RETURNING id, user_id, total, created_at, finished_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []models.ImportJob
+	for rows.Next() {
+		job := models.ImportJob{Status: models.ImportDone}
+		if err := rows.Scan(&job.ID, &job.UserID, &job.Total, &job.CreatedAt, &job.FinishedAt); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// DeleteOldImportJobs removes import jobs finished more than ImportJobTTL ago
+func (db *Database) DeleteOldImportJobs(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM import_jobs WHERE status = 'done' AND finished_at < $1`,
+		time.Now().Add(-ImportJobTTL))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// LogAPIUsage writes an "api_usage" usage log of the user's API requests
+// since the last one, bytes out as its bytes and requests by client in
+// its metadata
+func (db *Database) LogAPIUsage(ctx context.Context, userID uuid.UUID, usage models.APIUsage) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 VALUES ($1, 'api_usage', $2, jsonb_build_object(
+			'requests', $3::bigint, 'bytes_in', $4::bigint, 'time_ms', $5::bigint, 'clients', $6::jsonb))`,
+		userID, usage.BytesOut, usage.Requests, usage.BytesIn, usage.TimeMs, usage.Clients)
+	return err
+}
+
+// GetAPIUsage totals the user's logged API usage since since
+func (db *Database) GetAPIUsage(ctx context.Context, userID uuid.UUID, since time.Time) (models.APIUsage, error) {
+	var usage models.APIUsage
+	err := db.pool.QueryRow(ctx,
+		`SELECT COALESCE(SUM((metadata->>'requests')::bigint), 0), COALESCE(SUM((metadata->>'bytes_in')::bigint), 0),
+		 COALESCE(SUM(bytes_transferred), 0), COALESCE(SUM((metadata->>'time_ms')::bigint), 0)
+		 FROM usage_logs WHERE user_id = $1 AND action = 'api_usage' AND created_at >= $2`,
+		userID, since).Scan(&usage.Requests, &usage.BytesIn, &usage.BytesOut, &usage.TimeMs)
+	return usage, err
+}
+
+// MaxPlausibleUploadRatio is the most a torrent is expected to have uploaded,
+// as a multiple of its size, before the consistency check reports it
+const MaxPlausibleUploadRatio = 10
+
+// consistencyProblems lists, as a SQL array, the consistency problems of
+// the torrents row it is evaluated against
+var consistencyProblems = fmt.Sprintf(`ARRAY_REMOVE(ARRAY[
+	CASE WHEN progress < 0 OR progress > 100 THEN '%s' END,
+	CASE WHEN downloaded_size < 0 OR (total_size > 0 AND downloaded_size > total_size) THEN '%s' END,
+	CASE WHEN total_size > 0 AND uploaded_size > total_size * %d THEN '%s' END,
+	CASE WHEN progress >= 100 AND data_missing AND status <> 'needs_redownload' THEN '%s' END,
+	CASE WHEN status = 'completed' AND progress < 100 THEN '%s' END
+]::text[], NULL)`,
+	models.ProblemProgressOutOfRange, models.ProblemDownloadedExceeds,
+	MaxPlausibleUploadRatio, models.ProblemUploadedImplausible,
+	models.ProblemCompleteWithoutData, models.ProblemCompletedBelow100)
+
+// FlagInconsistentTorrents records every torrent with consistency problems
+// in the report, keeping when each was first found, and drops those that no
+// longer have any. It returns how many are flagged.
+func (db *Database) FlagInconsistentTorrents(ctx context.Context) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// NOW() is the transaction's start, so rows not upserted here are older
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO torrent_consistency (torrent_id, problems)
+		 SELECT id, problems FROM (SELECT id, `+consistencyProblems+` AS problems FROM torrents) t
+		 WHERE cardinality(problems) > 0
+		 ON CONFLICT (torrent_id) DO UPDATE SET problems = EXCLUDED.problems, checked_at = NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM torrent_consistency WHERE checked_at < NOW()`); err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), tx.Commit(ctx)
+}
+
+// GetInconsistentTorrents returns the torrents flagged by the last
+// consistency check, longest flagged first
+func (db *Database) GetInconsistentTorrents(ctx context.Context) ([]models.TorrentInconsistency, error) {
+	var list []models.TorrentInconsistency
+	err := db.EachInconsistentTorrent(ctx, func(t *models.TorrentInconsistency) error {
+		list = append(list, *t)
+		return nil
+	})
+	return list, err
+}
+
+// EachInconsistentTorrent calls fn with each torrent GetInconsistentTorrents
+// would return, in the same order, one row at a time. An error from fn
+// stops the iteration and is returned.
+func (db *Database) EachInconsistentTorrent(ctx context.Context, fn func(t *models.TorrentInconsistency) error) error {
+	rows, err := db.pool.Query(ctx,
+		`SELECT t.id, t.user_id, t.info_hash, t.name, t.status, t.total_size, t.downloaded_size,
+		 t.uploaded_size, t.progress, t.data_missing, t.files, c.problems, c.found_at, c.checked_at
+		 FROM torrent_consistency c JOIN torrents t ON t.id = c.torrent_id
+		 ORDER BY c.found_at, t.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t models.TorrentInconsistency
+		if err := rows.Scan(&t.TorrentID, &t.UserID, &t.InfoHash, &t.Name, &t.Status, &t.TotalSize,
+			&t.DownloadedSize, &t.UploadedSize, &t.Progress, &t.DataMissing, &t.Files,
+			&t.Problems, &t.FoundAt, &t.CheckedAt); err != nil {
+			return err
+		}
+		if err := fn(&t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// RepairTorrentSizes sets a torrent's downloaded bytes and progress to
+// recomputed values and re-checks it, keeping it in the report only if it
+// still has problems
+func (db *Database) RepairTorrentSizes(ctx context.Context, id uuid.UUID, downloaded int64, progress float64) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE torrents SET downloaded_size = $1, progress = $2, updated_at = NOW() WHERE id = $3`,
+		downloaded, progress, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`WITH t AS (SELECT `+consistencyProblems+` AS problems FROM torrents WHERE id = $1)
+		 UPDATE torrent_consistency c SET problems = t.problems, checked_at = NOW()
+		 FROM t WHERE c.torrent_id = $1`,
+		id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM torrent_consistency WHERE torrent_id = $1 AND cardinality(problems) = 0`,
+		id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// NotificationTTL is how long notifications are kept, read or not
+const NotificationTTL = 90 * 24 * time.Hour
+
+// CreateNotification adds a notification to the user's inbox
+func (db *Database) CreateNotification(ctx context.Context, n *models.Notification) error {
+	n.ID = uuid.New()
+	return db.pool.QueryRow(ctx,
+		`INSERT INTO notifications (id, user_id, type, title, body, metadata)
+		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at`,
+		n.ID, n.UserID, n.Type, n.Title, n.Body, n.Metadata).Scan(&n.CreatedAt)
+}
+
+// GetNotifications returns a page of the user's notifications, newest
+// first, optionally only unread ones and only those created before before
+func (db *Database) GetNotifications(ctx context.Context, userID uuid.UUID, unread bool, before *time.Time, limit int) ([]models.Notification, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, user_id, type, title, body, metadata, read_at, created_at
+		 FROM notifications
+		 WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		 AND ($3::timestamptz IS NULL OR created_at < $3)
+		 ORDER BY created_at DESC LIMIT $4`,
+		userID, unread, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.Notification
+	for rows.Next() {
+		var n models.Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Type, &n.Title, &n.Body, &n.Metadata, &n.ReadAt, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// CountUnreadNotifications counts the user's unread notifications
+func (db *Database) CountUnreadNotifications(ctx context.Context, userID uuid.UUID) (int, error) {
+	var count int
+	err := db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL`,
+		userID).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationRead marks one of the user's notifications read, keeping
+// the time it was first read. Reports false if the user has no such
+// notification.
+func (db *Database) MarkNotificationRead(ctx context.Context, userID, id uuid.UUID) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE notifications SET read_at = COALESCE(read_at, NOW()) WHERE id = $1 AND user_id = $2`,
+		id, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user read
+// and returns how many there were
+func (db *Database) MarkAllNotificationsRead(ctx context.Context, userID uuid.UUID) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE notifications SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL`,
+		userID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteOldNotifications removes notifications older than NotificationTTL
+func (db *Database) DeleteOldNotifications(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM notifications WHERE created_at < $1`,
+		time.Now().Add(-NotificationTTL))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// BandwidthAlertThresholds are the shares of their plan's bandwidth, in
+// percent, users are warned on reaching
+var BandwidthAlertThresholds = []int{80, 100}
+
+// ClaimBandwidthAlert compares the user's downloads this usage period with
+// their plan's bandwidth and records every threshold of
+// BandwidthAlertThresholds reached that hasn't fired yet this period. It
+// returns the alert for the highest of them, so a jump straight past 100%
+// warns once, or nil when none is due. Unlimited plans never alert.
+func (db *Database) ClaimBandwidthAlert(ctx context.Context, userID uuid.UUID) (*models.BandwidthAlert, error) {
+	sub, err := db.GetSubscription(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	limits, _ := db.GetPlanLimits(ctx, "free")
+	if sub != nil {
+		if planLimits, ok := db.GetPlanLimits(ctx, sub.Plan); ok {
+			limits = planLimits
+		}
+	}
+	if limits.DownloadLimitGB <= 0 {
+		return nil, nil
+	}
+
+	period := models.CurrentUsagePeriod(sub, time.Now())
+	used, err := db.GetMonthlyUsage(ctx, userID, period)
+	if err != nil {
+		return nil, err
+	}
+	limitBytes := models.GBytes(limits.DownloadLimitGB)
+
+	var reached []int
+	for _, threshold := range BandwidthAlertThresholds {
+		if used*100 >= limitBytes*int64(threshold) {
+			reached = append(reached, threshold)
+		}
+	}
+	if len(reached) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.pool.Query(ctx,
+		`INSERT INTO bandwidth_alerts (user_id, period_start, threshold)
+		 SELECT $1, $2, unnest($3::int[])
+		 ON CONFLICT DO NOTHING RETURNING threshold`,
+		userID, period.Start, reached)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alert *models.BandwidthAlert
+	for rows.Next() {
+		var threshold int
+		if err := rows.Scan(&threshold); err != nil {
+			return nil, err
+		}
+		if alert == nil || threshold > alert.Threshold {
+			alert = &models.BandwidthAlert{
+				Threshold:  threshold,
+				UsedBytes:  used,
+				LimitBytes: limitBytes,
+				Period:     period,
+			}
+		}
+	}
+	return alert, rows.Err()
+}
+
+// DeleteOldBandwidthAlerts removes the fired thresholds of usage periods that
+// started more than a year ago, long past mattering
+func (db *Database) DeleteOldBandwidthAlerts(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`DELETE FROM bandwidth_alerts WHERE period_start < $1`,
+		time.Now().AddDate(-1, 0, 0))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetSubscriptionEvents returns the user's subscription changes older than
+// before (all when nil), newest first, with the email of the admin or user
+// who made each while their account exists
+func (db *Database) GetSubscriptionEvents(ctx context.Context, userID uuid.UUID, before *time.Time, limit int) ([]models.SubscriptionEvent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT e.id, e.user_id, e.actor_type, e.actor_id, COALESCE(a.email, ''), e.old_plan, e.new_plan,
+		 e.old_status, e.new_status, e.reason, e.created_at
+		 FROM subscription_events e LEFT JOIN users a ON a.id = e.actor_id
+		 WHERE e.user_id = $1 AND ($2::timestamptz IS NULL OR e.created_at < $2)
+		 ORDER BY e.created_at DESC LIMIT $3`,
+		userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.SubscriptionEvent
+	for rows.Next() {
+		var e models.SubscriptionEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.ActorType, &e.ActorID, &e.ActorEmail, &e.OldPlan, &e.NewPlan,
+			&e.OldStatus, &e.NewStatus, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// abuseReportColumns are the columns read by scanAbuseReport, in scan order,
+// with the count of reports naming the same info hash
+const abuseReportColumns = `r.id, COALESCE(r.info_hash, ''), COALESCE(r.download_url, ''), r.contact, r.reason,
+	COALESCE(r.reporter_ip, ''), r.status, COALESCE(r.resolution, ''), r.resolved_by, r.resolved_at, r.created_at,
+	CASE WHEN r.info_hash IS NULL THEN 1
+		ELSE (SELECT COUNT(*) FROM abuse_reports o WHERE o.info_hash = r.info_hash) END`
+
+func scanAbuseReport(row pgx.Row) (*models.AbuseReport, error) {
+	r := &models.AbuseReport{}
+	err := row.Scan(&r.ID, &r.InfoHash, &r.DownloadURL, &r.Contact, &r.Reason,
+		&r.ReporterIP, &r.Status, &r.Resolution, &r.ResolvedBy, &r.ResolvedAt, &r.CreatedAt,
+		&r.HashReports)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// CreateAbuseReport stores a new open report
+func (db *Database) CreateAbuseReport(ctx context.Context, r *models.AbuseReport) error {
+	r.ID = uuid.New()
+	r.Status = models.ReportOpen
+	return db.pool.QueryRow(ctx,
+		`INSERT INTO abuse_reports (id, info_hash, download_url, contact, reason, reporter_ip, status)
+		 VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7)
+		 RETURNING created_at`,
+		r.ID, r.InfoHash, r.DownloadURL, r.Contact, r.Reason, r.ReporterIP, r.Status).Scan(&r.CreatedAt)
+}
+
+// GetAbuseReport returns a report, or nil if there is none
+func (db *Database) GetAbuseReport(ctx context.Context, id uuid.UUID) (*models.AbuseReport, error) {
+	return scanAbuseReport(db.pool.QueryRow(ctx,
+		`SELECT `+abuseReportColumns+` FROM abuse_reports r WHERE r.id = $1`, id))
+}
+
+// GetAbuseReports returns reports with the given status (all when empty)
+// older than before (all when nil), newest first
+func (db *Database) GetAbuseReports(ctx context.Context, status string, before *time.Time, limit int) ([]models.AbuseReport, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+abuseReportColumns+` FROM abuse_reports r
+		 WHERE ($1 = '' OR r.status = $1) AND ($2::timestamptz IS NULL OR r.created_at < $2)
+		 ORDER BY r.created_at DESC LIMIT $3`,
+		status, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []models.AbuseReport
+	for rows.Next() {
+		r, err := scanAbuseReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *r)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveAbuseReports closes an open report with status and the admin's
+// note, along with every other open report of infoHash unless it is empty.
+// It returns how many reports were closed.
+func (db *Database) ResolveAbuseReports(ctx context.Context, id uuid.UUID, infoHash, status, resolution string, adminID uuid.UUID) (int64, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE abuse_reports SET status = $3, resolution = NULLIF($4, ''), resolved_by = $5, resolved_at = NOW()
+		 WHERE status = 'open' AND (id = $1 OR ($2 <> '' AND info_hash = $2))`,
+		id, infoHash, status, resolution, adminID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetTorrentsByInfoHash returns every user's torrents of infoHash
+func (db *Database) GetTorrentsByInfoHash(ctx context.Context, infoHash string) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT `+torrentColumns+` FROM torrents WHERE info_hash = $1 ORDER BY created_at`,
+		infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		t, err := scanTorrent(rows)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, *t)
+	}
+	return torrents, rows.Err()
+}
+
+// BlockInfoHash stops anyone adding an info hash. Blocking one already
+// blocked keeps the original entry.
+func (db *Database) BlockInfoHash(ctx context.Context, b *models.BlockedHash) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO blocked_hashes (info_hash, reason, report_id, blocked_by)
+		 VALUES ($1, $2, $3, $4) ON CONFLICT (info_hash) DO NOTHING`,
+		b.InfoHash, b.Reason, b.ReportID, b.BlockedBy)
+	return err
+}
+
+// IsInfoHashBlocked reports whether an info hash may not be added
+func (db *Database) IsInfoHashBlocked(ctx context.Context, infoHash string) (bool, error) {
+	var blocked bool
+	err := db.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM blocked_hashes WHERE info_hash = $1)`,
+		strings.ToLower(infoHash)).Scan(&blocked)
+	return blocked, err
+}
+
+// GetBlockedHashes returns every blocked info hash, newest first
+func (db *Database) GetBlockedHashes(ctx context.Context) ([]models.BlockedHash, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT info_hash, reason, report_id, blocked_by, created_at FROM blocked_hashes ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.BlockedHash
+	for rows.Next() {
+		var b models.BlockedHash
+		if err := rows.Scan(&b.InfoHash, &b.Reason, &b.ReportID, &b.BlockedBy, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+// UnblockInfoHash lets an info hash be added again and reports whether it
+// was blocked
+func (db *Database) UnblockInfoHash(ctx context.Context, infoHash string) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM blocked_hashes WHERE info_hash = $1`, strings.ToLower(infoHash))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// LogTorrentTakenDown records in the owner's activity that a torrent was
+// removed after an abuse report
+func (db *Database) LogTorrentTakenDown(ctx context.Context, t *models.Torrent, reportID uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO usage_logs (user_id, action, bytes_transferred, metadata)
+		 VALUES ($1, 'taken_down', 0, jsonb_build_object(
+			'torrent_id', $2::uuid, 'info_hash', $3::text, 'name', $4::text, 'report_id', $5::uuid))`,
+		t.UserID, t.ID, t.InfoHash, t.Name, reportID)
+	return err
+}
+
+// GetActiveInfoHashes returns every torrent the engine should be running:
+// all but failed, cancelled and needs_redownload ones. Rows still fetching
+// their .torrent file have no info hash yet. Only the columns needed to
+// reload them are read.
+func (db *Database) GetActiveInfoHashes(ctx context.Context) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, user_id, COALESCE(info_hash, ''), name, COALESCE(magnet_uri, ''), status,
+		        COALESCE(source, ''), updated_at
+		 FROM torrents WHERE status NOT IN ('failed', 'cancelled', 'needs_redownload')
+		 ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		var t models.Torrent
+		if err := rows.Scan(&t.ID, &t.UserID, &t.InfoHash, &t.Name, &t.MagnetURI, &t.Status,
+			&t.Audit.Source, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, rows.Err()
+}
+
+// GetDedupCandidates returns the user's completed torrents of the given
+// total size, other than excludeID, that could hold the same content: not
+// missing data and not deduplicated themselves, so links always point at
+// an original. Only what comparing them needs is read.
+func (db *Database) GetDedupCandidates(ctx context.Context, userID, excludeID uuid.UUID, totalSize int64) ([]models.Torrent, error) {
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, info_hash, files, file_hashes FROM torrents
+		 WHERE user_id = $1 AND id <> $2 AND total_size = $3
+		 AND status IN ('completed', 'seeding') AND NOT COALESCE(data_missing, FALSE)
+		 AND deduplicated_from IS NULL
+		 ORDER BY created_at`,
+		userID, excludeID, totalSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var torrents []models.Torrent
+	for rows.Next() {
+		var t models.Torrent
+		if err := rows.Scan(&t.ID, &t.InfoHash, &t.Files, &t.FileHashes); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, rows.Err()
+}
+
+// GetTorrentFileHashes returns the file SHA-256s recorded for a torrent,
+// nil if it was never hashed
+func (db *Database) GetTorrentFileHashes(ctx context.Context, id uuid.UUID) (map[string]string, error) {
+	var hashes map[string]string
+	err := db.pool.QueryRow(ctx, `SELECT file_hashes FROM torrents WHERE id = $1`, id).Scan(&hashes)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return hashes, err
+}
+
+// SetTorrentFileHashes records a torrent's file SHA-256s by path
+func (db *Database) SetTorrentFileHashes(ctx context.Context, id uuid.UUID, hashes map[string]string) error {
+	_, err := db.pool.Exec(ctx, `UPDATE torrents SET file_hashes = $1 WHERE id = $2`, hashes, id)
+	return err
+}
+
+// SetTorrentDeduplicated records that a torrent's files are hard links to
+// those of the torrent from
+func (db *Database) SetTorrentDeduplicated(ctx context.Context, id, from uuid.UUID) error {
+	_, err := db.pool.Exec(ctx,
+		`UPDATE torrents SET deduplicated_from = $1, updated_at = NOW() WHERE id = $2`, from, id)
+	return err
+}
+
+// GetCompactTorrentsByUser lists the user's torrents as GetTorrentsByUser
+// does, filtered and ordered the same way, with only the compact view's
+// columns. Unfiltered, the newest-first page is read from
+// idx_torrents_user_created alone, for accounts with thousands of torrents.
+func (db *Database) GetCompactTorrentsByUser(ctx context.Context, userID uuid.UUID, collectionID *uuid.UUID, status models.TorrentStatus, query string, limit, offset int) ([]models.CompactTorrent, int, error) {
+	search, rank, arg := torrentSearch(query, 3)
+
+	var total int
+	err := db.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM torrents
+		 WHERE user_id = $1 AND ($2::uuid IS NULL OR collection_id = $2)
+		   AND ($4::text = '' OR status = $4) AND `+search,
+		userID, collectionID, arg, string(status)).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.pool.Query(ctx,
+		`SELECT id, name, status, progress, total_size, expires_at
+		 FROM torrents WHERE user_id = $1 AND ($2::uuid IS NULL OR collection_id = $2)
+		   AND ($6::text = '' OR status = $6) AND `+search+`
+		 ORDER BY `+rank+` DESC, created_at DESC LIMIT $4 OFFSET $5`,
+		userID, collectionID, arg, limit, offset, string(status))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var torrents []models.CompactTorrent
+	for rows.Next() {
+		var t models.CompactTorrent
+		if err := rows.Scan(&t.ID, &t.Name, &t.Status, &t.Progress, &t.TotalSize, &t.ExpiresAt); err != nil {
+			return nil, 0, err
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, total, rows.Err()
+}
+
+// GetClientUsage breaks API use down by client version: requests and
+// distinct users in api_usage logs since since, and unexpired sessions
+// signed in from each, most requests first
+func (db *Database) GetClientUsage(ctx context.Context, since time.Time) ([]models.ClientUsage, error) {
+	byClient := make(map[string]*models.ClientUsage)
+	entry := func(client string) *models.ClientUsage {
+		u, ok := byClient[client]
+		if !ok {
+			u = &models.ClientUsage{Client: client}
+			byClient[client] = u
+		}
+		return u
+	}
+
+	rows, err := db.pool.Query(ctx,
+		`SELECT c.key, SUM(c.value::bigint), COUNT(DISTINCT l.user_id)
+		 FROM usage_logs l, jsonb_each_text(l.metadata->'clients') c
+		 WHERE l.action = 'api_usage' AND l.created_at >= $1
+		 GROUP BY c.key`,
+		since)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var client string
+		var requests, users int64
+		if err := rows.Scan(&client, &requests, &users); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		u := entry(client)
+		u.Requests, u.Users = requests, users
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keyed as middleware.ClientKey keys requests
+	rows, err = db.pool.Query(ctx,
+		`SELECT CASE WHEN client IS NULL THEN 'unknown'
+		 WHEN client_version IS NULL THEN client
+		 ELSE client || '/' || client_version END, COUNT(*)
+		 FROM refresh_tokens WHERE expires_at > NOW()
+		 GROUP BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client string
+		var sessions int64
+		if err := rows.Scan(&client, &sessions); err != nil {
+			return nil, err
+		}
+		entry(client).Sessions = sessions
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	usage := make([]models.ClientUsage, 0, len(byClient))
+	for _, u := range byClient {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Requests != usage[j].Requests {
+			return usage[i].Requests > usage[j].Requests
+		}
+		return usage[i].Client < usage[j].Client
+	})
+	return usage, nil
+}
+
+// GetSetting decodes the runtime setting key into v and reports whether it
+// is set
+func (db *Database) GetSetting(ctx context.Context, key string, v any) (bool, error) {
+	var value []byte
+	err := db.pool.QueryRow(ctx, `SELECT value FROM settings WHERE key = $1`, key).Scan(&value)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(value, v)
+}
+
+// SetSetting stores v as the runtime setting key, replacing its value
+func (db *Database) SetSetting(ctx context.Context, key string, v any, updatedBy uuid.UUID) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = db.pool.Exec(ctx,
+		`INSERT INTO settings (key, value, updated_by) VALUES ($1, $2, $3)
+		 ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_by = EXCLUDED.updated_by, updated_at = NOW()`,
+		key, value, updatedBy)
+	return err
+}
+
+// DeleteSetting unsets a runtime setting and reports whether it was set
+func (db *Database) DeleteSetting(ctx context.Context, key string) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM settings WHERE key = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,621 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// testDB connects to TEST_DATABASE_URL and migrates it, skipping the test
+// when it isn't set
+func testDB(t *testing.T) *Database {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := New(url, false)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func TestTimesScanInUTC(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	got, err := db.GetUserByID(ctx, user.ID)
+	if err != nil || got == nil {
+		t.Fatalf("get user: %v", err)
+	}
+	if loc := got.CreatedAt.Location(); loc != time.UTC {
+		t.Errorf("created_at in %v, want UTC", loc)
+	}
+}
+
+func TestUpdateTorrentStatusOutOfOrder(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	tr := &models.Torrent{
+		UserID:   user.ID,
+		InfoHash: uuid.NewString(),
+		Name:     "out-of-order",
+		Status:   models.TorrentStatusPending,
+	}
+	if err := db.CreateTorrent(ctx, tr); err != nil {
+		t.Fatalf("create torrent: %v", err)
+	}
+	status := func() models.TorrentStatus {
+		t.Helper()
+		got, err := db.GetTorrent(ctx, tr.ID)
+		if err != nil || got == nil {
+			t.Fatalf("get torrent: %v", err)
+		}
+		return got.Status
+	}
+
+	if err := db.UpdateTorrentStatus(ctx, tr.ID, models.TorrentStatusDownloading, 50, 50, 1, 0, 1, 1, false); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	if _, err := db.pool.Exec(ctx, `UPDATE torrents SET status = 'completed', progress = 100 WHERE id = $1`, tr.ID); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	// A tick the engine sent before completing, applied after it
+	err = db.UpdateTorrentStatus(ctx, tr.ID, models.TorrentStatusDownloading, 99, 99, 1, 0, 1, 1, false)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Fatalf("late downloading update: err = %v, want ErrIllegalTransition", err)
+	}
+	if got := status(); got != models.TorrentStatusCompleted {
+		t.Fatalf("status after late update = %s, want completed", got)
+	}
+
+	if err := db.UpdateTorrentStatus(ctx, tr.ID, models.TorrentStatusDownloading, 0, 0, 0, 0, 0, 0, true); err != nil {
+		t.Fatalf("forced update: %v", err)
+	}
+	if got := status(); got != models.TorrentStatusDownloading {
+		t.Fatalf("status after forced update = %s, want downloading", got)
+	}
+}
+
+func TestGetActiveTokenForFile(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	tr := &models.Torrent{UserID: user.ID, InfoHash: uuid.NewString(), Name: "tokens", Status: models.TorrentStatusCompleted}
+	if err := db.CreateTorrent(ctx, tr); err != nil {
+		t.Fatalf("create torrent: %v", err)
+	}
+	create := func(filePath string, isDirectory bool, maxDownloads int, validFor time.Duration) string {
+		t.Helper()
+		token := uuid.NewString()
+		if err := db.CreateDownloadToken(ctx, tr.ID, filePath, isDirectory, token, maxDownloads, time.Now().Add(validFor)); err != nil {
+			t.Fatalf("create token: %v", err)
+		}
+		return token
+	}
+	active := func(filePath string, isDirectory bool, maxDownloads int, minValidity time.Duration) string {
+		t.Helper()
+		dt, err := db.GetActiveTokenForFile(ctx, tr.ID, filePath, isDirectory, maxDownloads, minValidity)
+		if err != nil {
+			t.Fatalf("get active token: %v", err)
+		}
+		if dt == nil {
+			return ""
+		}
+		return dt.Token
+	}
+
+	if got := active("a.mkv", false, 10, time.Hour); got != "" {
+		t.Fatalf("no tokens: got %q", got)
+	}
+
+	first := create("a.mkv", false, 10, 2*time.Hour)
+	if got := active("a.mkv", false, 10, time.Hour); got != first {
+		t.Errorf("valid for 2h, wanting 1h: got %q, want %q", got, first)
+	}
+	if got := active("a.mkv", false, 10, 3*time.Hour); got != "" {
+		t.Errorf("valid for 2h, wanting 3h: got %q", got)
+	}
+	if got := active("a.mkv", false, 5, time.Hour); got != "" {
+		t.Errorf("other max_downloads: got %q", got)
+	}
+	if got := active("b.mkv", false, 10, time.Hour); got != "" {
+		t.Errorf("other file: got %q", got)
+	}
+	if got := active("a.mkv", true, 10, time.Hour); got != "" {
+		t.Errorf("directory of the same path: got %q", got)
+	}
+
+	// Of several, the latest expiring with downloads left
+	used := create("a.mkv", false, 10, 30*time.Hour)
+	if _, err := db.pool.Exec(ctx, `UPDATE download_tokens SET download_count = max_downloads WHERE token = $1`, used); err != nil {
+		t.Fatal(err)
+	}
+	later := create("a.mkv", false, 10, 20*time.Hour)
+	if got := active("a.mkv", false, 10, time.Hour); got != later {
+		t.Errorf("several tokens: got %q, want %q", got, later)
+	}
+
+	expired := create("c.mkv", false, 10, -time.Minute)
+	if got := active("c.mkv", false, 10, 0); got != "" {
+		t.Errorf("expired token %q: got %q", expired, got)
+	}
+}
+
+func TestUpdateExpiriesForUser(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	newUser := func() uuid.UUID {
+		t.Helper()
+		user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+		if err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		return user.ID
+	}
+	newTorrent := func(userID uuid.UUID) uuid.UUID {
+		t.Helper()
+		tr := &models.Torrent{UserID: userID, InfoHash: uuid.NewString(), Name: "expiry", Status: models.TorrentStatusDownloading}
+		if err := db.CreateTorrent(ctx, tr); err != nil {
+			t.Fatalf("create torrent: %v", err)
+		}
+		return tr.ID
+	}
+	complete := func(id uuid.UUID, retentionDays int) {
+		t.Helper()
+		if err := db.SetTorrentCompleted(ctx, id, retentionDays); err != nil {
+			t.Fatalf("complete: %v", err)
+		}
+	}
+	// retention is how long after completing a torrent expires, or 0 for
+	// no expiry
+	retention := func(id uuid.UUID) time.Duration {
+		t.Helper()
+		var completedAt, expiresAt *time.Time
+		if err := db.pool.QueryRow(ctx, `SELECT completed_at, expires_at FROM torrents WHERE id = $1`, id).
+			Scan(&completedAt, &expiresAt); err != nil {
+			t.Fatal(err)
+		}
+		if completedAt == nil || expiresAt == nil {
+			return 0
+		}
+		return expiresAt.Sub(*completedAt).Round(time.Hour)
+	}
+	update := func(userID uuid.UUID, retentionDays int, want int64) {
+		t.Helper()
+		n, err := db.UpdateExpiriesForUser(ctx, userID, retentionDays)
+		if err != nil || n != want {
+			t.Fatalf("UpdateExpiriesForUser(%d days) = %d, %v; want %d", retentionDays, n, err, want)
+		}
+	}
+	const day = 24 * time.Hour
+
+	user, other := newUser(), newUser()
+	freeTorrent := newTorrent(user)
+	complete(freeTorrent, 1)
+	extended := newTorrent(user)
+	complete(extended, 1)
+	if _, err := db.pool.Exec(ctx, `UPDATE torrents SET expires_at = completed_at + INTERVAL '30 days' WHERE id = $1`, extended); err != nil {
+		t.Fatal(err)
+	}
+	downloading := newTorrent(user)
+	othersTorrent := newTorrent(other)
+	complete(othersTorrent, 1)
+
+	// Upgrade: only the torrent whose expiry the new retention lengthens
+	update(user, 7, 1)
+	if got := retention(freeTorrent); got != 7*day {
+		t.Errorf("after upgrade: retention %v, want 7 days", got)
+	}
+	if got := retention(extended); got != 30*day {
+		t.Errorf("extended past the new retention: %v, want 30 days", got)
+	}
+	if got := retention(downloading); got != 0 {
+		t.Errorf("still downloading: retention %v, want none", got)
+	}
+	if got := retention(othersTorrent); got != day {
+		t.Errorf("another user's torrent: retention %v, want 1 day", got)
+	}
+
+	// Downgrade keeps what was granted
+	update(user, 1, 0)
+	if got := retention(freeTorrent); got != 7*day {
+		t.Errorf("after downgrade: retention %v, want 7 days", got)
+	}
+
+	// Mixed: one extended, one already past it
+	update(user, 14, 1)
+	if got, got2 := retention(freeTorrent), retention(extended); got != 14*day || got2 != 30*day {
+		t.Errorf("after upgrade to 14 days: retentions %v and %v, want 14 and 30 days", got, got2)
+	}
+}
+
+func TestClaimBandwidthAlert(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	limits, ok := db.GetPlanLimits(ctx, "free")
+	if !ok || limits.DownloadLimitGB <= 0 {
+		t.Skip("free plan has no bandwidth limit")
+	}
+	limit := models.GBytes(limits.DownloadLimitGB)
+
+	newUser := func() uuid.UUID {
+		t.Helper()
+		user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+		if err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		return user.ID
+	}
+	// download brings the user's usage this period up to percent of limit
+	used := map[uuid.UUID]int64{}
+	download := func(userID uuid.UUID, percent int64) {
+		t.Helper()
+		bytes := limit*percent/100 - used[userID]
+		if err := db.LogUsage(ctx, userID, "download_completed", bytes, nil); err != nil {
+			t.Fatalf("log usage: %v", err)
+		}
+		used[userID] += bytes
+	}
+	claim := func(userID uuid.UUID) int {
+		t.Helper()
+		alert, err := db.ClaimBandwidthAlert(ctx, userID)
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		if alert == nil {
+			return 0
+		}
+		if alert.UsedBytes != used[userID] || alert.LimitBytes != limit {
+			t.Errorf("alert at %d%%: used %d of %d, want %d of %d", alert.Threshold, alert.UsedBytes, alert.LimitBytes, used[userID], limit)
+		}
+		return alert.Threshold
+	}
+
+	user := newUser()
+	steps := []struct {
+		percent int64
+		want    int
+	}{
+		{0, 0},
+		{79, 0},
+		{80, 80},
+		{90, 0},
+		{150, 100},
+		{200, 0},
+	}
+	for _, s := range steps {
+		download(user, s.percent)
+		if got := claim(user); got != s.want {
+			t.Errorf("at %d%%: alert %d, want %d", s.percent, got, s.want)
+		}
+	}
+
+	// Straight past 100% warns once, and the 80% threshold is spent too
+	jumper := newUser()
+	download(jumper, 100)
+	if got := claim(jumper); got != 100 {
+		t.Errorf("jump to 100%%: alert %d, want 100", got)
+	}
+	if got := claim(jumper); got != 0 {
+		t.Errorf("after jumping: alert %d, want none", got)
+	}
+	var fired int
+	if err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM bandwidth_alerts WHERE user_id = $1`, jumper).Scan(&fired); err != nil {
+		t.Fatal(err)
+	}
+	if fired != len(BandwidthAlertThresholds) {
+		t.Errorf("thresholds recorded after jumping: %d, want %d", fired, len(BandwidthAlertThresholds))
+	}
+
+	// A new period starts over
+	if _, err := db.pool.Exec(ctx,
+		`UPDATE bandwidth_alerts SET period_start = period_start - INTERVAL '1 month' WHERE user_id = $1`, jumper); err != nil {
+		t.Fatal(err)
+	}
+	if got := claim(jumper); got != 100 {
+		t.Errorf("next period: alert %d, want 100", got)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	key := "test_" + uuid.NewString()
+	t.Cleanup(func() { db.DeleteSetting(ctx, key) })
+
+	var got []models.DownloadRedirect
+	if ok, err := db.GetSetting(ctx, key, &got); ok || err != nil {
+		t.Fatalf("unset setting: %v, %v", ok, err)
+	}
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	for _, want := range []string{"https://one.example.com", "https://two.example.com"} {
+		if err := db.SetSetting(ctx, key, []models.DownloadRedirect{{Host: "old.example.com", BaseURL: want}}, user.ID); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if ok, err := db.GetSetting(ctx, key, &got); !ok || err != nil || len(got) != 1 || got[0].BaseURL != want {
+			t.Errorf("after setting %s: %+v, %v, %v", want, got, ok, err)
+		}
+	}
+
+	if deleted, err := db.DeleteSetting(ctx, key); !deleted || err != nil {
+		t.Errorf("delete: %v, %v", deleted, err)
+	}
+	if deleted, err := db.DeleteSetting(ctx, key); deleted || err != nil {
+		t.Errorf("delete again: %v, %v", deleted, err)
+	}
+}
+
+func TestEachTorrent(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	email := uuid.NewString() + "@example.com"
+	user, err := db.CreateUser(ctx, email, "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		tr := &models.Torrent{UserID: user.ID, InfoHash: uuid.NewString(), Name: "each", Status: models.TorrentStatusPending}
+		if err := db.CreateTorrent(ctx, tr); err != nil {
+			t.Fatalf("create torrent: %v", err)
+		}
+	}
+
+	page, total, err := db.GetAllTorrents(ctx, "", email, 10, 0)
+	if err != nil || total != 3 || len(page) != 3 {
+		t.Fatalf("GetAllTorrents: %d of %d, %v", len(page), total, err)
+	}
+	var ids []uuid.UUID
+	err = db.EachTorrent(ctx, "", email, func(tr *models.Torrent) error {
+		ids = append(ids, tr.ID)
+		return nil
+	})
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("EachTorrent: %v, %v", ids, err)
+	}
+	for i := range page {
+		if ids[i] != page[i].ID {
+			t.Errorf("row %d: %s, want %s as listed", i, ids[i], page[i].ID)
+		}
+	}
+
+	stop := errors.New("stop")
+	rows := 0
+	err = db.EachTorrent(ctx, "", email, func(*models.Torrent) error {
+		rows++
+		return stop
+	})
+	if !errors.Is(err, stop) || rows != 1 {
+		t.Errorf("stopping: %d rows, %v", rows, err)
+	}
+}
+
+func TestClosedReason(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	create := func() *models.Torrent {
+		t.Helper()
+		tr := &models.Torrent{UserID: user.ID, InfoHash: uuid.NewString(), Name: "closed", Status: models.TorrentStatusDownloading}
+		if err := db.CreateTorrent(ctx, tr); err != nil {
+			t.Fatalf("create torrent: %v", err)
+		}
+		return tr
+	}
+	reason := func(id uuid.UUID) models.ClosedReason {
+		t.Helper()
+		got, err := db.GetTorrent(ctx, id)
+		if err != nil || got == nil {
+			t.Fatalf("get torrent: %v", err)
+		}
+		return got.ClosedReason
+	}
+
+	tr := create()
+	if err := db.SetTorrentError(ctx, tr.ID, models.ClosedFailedDisk, "disk write error: no space"); err != nil {
+		t.Fatalf("set error: %v", err)
+	}
+	if got := reason(tr.ID); got != models.ClosedFailedDisk {
+		t.Errorf("after SetTorrentError: %q, want %q", got, models.ClosedFailedDisk)
+	}
+	if err := db.SetTorrentError(ctx, tr.ID, "failed", "x"); !errors.Is(err, ErrInvalidClosedReason) {
+		t.Errorf("unknown reason: err = %v, want ErrInvalidClosedReason", err)
+	}
+	if ok, err := db.ResetTorrentForRetry(ctx, tr.ID, 5); !ok || err != nil {
+		t.Fatalf("retry: %v, %v", ok, err)
+	}
+	if got := reason(tr.ID); got != "" {
+		t.Errorf("after retry: %q, want none", got)
+	}
+	if err := db.SetTorrentError(ctx, tr.ID, "", "torrent already added"); !errors.Is(err, ErrInvalidClosedReason) {
+		t.Errorf("no reason: err = %v, want ErrInvalidClosedReason", err)
+	}
+	if err := db.SetTorrentError(ctx, tr.ID, models.ClosedCompleted, "x"); !errors.Is(err, ErrInvalidClosedReason) {
+		t.Errorf("non-failure reason: err = %v, want ErrInvalidClosedReason", err)
+	}
+	err = db.UpdateTorrentStatus(ctx, tr.ID, models.TorrentStatusFailed, 0, 0, 0, 0, 0, 0, true)
+	if !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("failing through UpdateTorrentStatus: err = %v, want ErrInvalidStatus", err)
+	}
+
+	deletedLogs := func(id uuid.UUID) []string {
+		t.Helper()
+		rows, err := db.pool.Query(ctx,
+			`SELECT metadata->>'closed_reason' FROM usage_logs
+			 WHERE action = 'torrent_deleted' AND metadata->>'torrent_id' = $1`, id.String())
+		if err != nil {
+			t.Fatalf("query logs: %v", err)
+		}
+		defer rows.Close()
+		var reasons []string
+		for rows.Next() {
+			var r string
+			if err := rows.Scan(&r); err != nil {
+				t.Fatalf("scan log: %v", err)
+			}
+			reasons = append(reasons, r)
+		}
+		return reasons
+	}
+	tests := []struct {
+		reason models.ClosedReason
+		logged bool
+	}{
+		{models.ClosedUserDeleted, true},
+		{models.ClosedAdminDeleted, true},
+		// Logged by LogTorrentExpired and LogTorrentTakenDown instead
+		{models.ClosedExpired, false},
+		{models.ClosedDMCA, false},
+	}
+	for _, tt := range tests {
+		tr := create()
+		if err := db.DeleteTorrent(ctx, tr.ID, tt.reason); err != nil {
+			t.Fatalf("delete %s: %v", tt.reason, err)
+		}
+		if got, _ := db.GetTorrent(ctx, tr.ID); got != nil {
+			t.Errorf("%s: torrent still there", tt.reason)
+		}
+		logs := deletedLogs(tr.ID)
+		switch {
+		case tt.logged && (len(logs) != 1 || logs[0] != string(tt.reason)):
+			t.Errorf("%s: logged %v, want one torrent_deleted log with its reason", tt.reason, logs)
+		case !tt.logged && len(logs) != 0:
+			t.Errorf("%s: logged %v, want none", tt.reason, logs)
+		}
+	}
+	if err := db.DeleteTorrent(ctx, create().ID, ""); !errors.Is(err, ErrInvalidClosedReason) {
+		t.Errorf("delete without reason: err = %v, want ErrInvalidClosedReason", err)
+	}
+}
+
+func TestFailedTorrentsBefore(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	create := func(status models.TorrentStatus, age time.Duration) uuid.UUID {
+		t.Helper()
+		tr := &models.Torrent{UserID: user.ID, InfoHash: uuid.NewString(), Name: "purge", Status: status}
+		if err := db.CreateTorrent(ctx, tr); err != nil {
+			t.Fatalf("create torrent: %v", err)
+		}
+		if _, err := db.pool.Exec(ctx,
+			`UPDATE torrents SET status = $2, updated_at = NOW() - make_interval(secs => $3) WHERE id = $1`,
+			tr.ID, string(status), age.Seconds()); err != nil {
+			t.Fatalf("age torrent: %v", err)
+		}
+		return tr.ID
+	}
+	oldFailed := create(models.TorrentStatusFailed, 40*24*time.Hour)
+	oldCancelled := create(models.TorrentStatusCancelled, 31*24*time.Hour)
+	create(models.TorrentStatusFailed, time.Hour)
+	create(models.TorrentStatusCompleted, 40*24*time.Hour)
+
+	got, err := db.GetFailedTorrentsBefore(ctx, time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatalf("GetFailedTorrentsBefore: %v", err)
+	}
+	var ids []uuid.UUID
+	for _, tr := range got {
+		if tr.UserID == user.ID {
+			ids = append(ids, tr.ID)
+		}
+	}
+	if len(ids) != 2 || ids[0] != oldFailed || ids[1] != oldCancelled {
+		t.Errorf("got %v, want the old failed then the old cancelled torrent", ids)
+	}
+
+	failed, total, err := db.GetTorrentsByUser(ctx, user.ID, nil, models.TorrentStatusFailed, "", 10, 0)
+	if err != nil {
+		t.Fatalf("GetTorrentsByUser: %v", err)
+	}
+	if total != 2 || len(failed) != 2 {
+		t.Errorf("status=failed: %d of %d, want 2 of 2", len(failed), total)
+	}
+}
+
+func TestExportLeavesOutTOTP(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if ok, err := db.SetTOTPSecret(ctx, user.ID, "JBSWY3DPEHPK3PXP"); !ok || err != nil {
+		t.Fatalf("set secret: %v, %v", ok, err)
+	}
+	if ok, err := db.EnableTOTP(ctx, user.ID, 1); !ok || err != nil {
+		t.Fatalf("enable: %v, %v", ok, err)
+	}
+
+	found := false
+	_, err = db.ExportTable(ctx, "users", func(row []byte) error {
+		var u struct {
+			ID           uuid.UUID `json:"id"`
+			Email        string    `json:"email"`
+			TOTPSecret   *string   `json:"totp_secret"`
+			TOTPEnabled  bool      `json:"totp_enabled"`
+			TOTPLastStep int64     `json:"totp_last_step"`
+		}
+		if err := json.Unmarshal(row, &u); err != nil {
+			return err
+		}
+		if u.ID != user.ID {
+			return nil
+		}
+		found = true
+		if u.Email != user.Email {
+			t.Errorf("email = %q, want %q", u.Email, user.Email)
+		}
+		if u.TOTPSecret != nil || u.TOTPEnabled || u.TOTPLastStep != 0 {
+			t.Errorf("exported two-factor state: %v, %v, %d", u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !found {
+		t.Error("user not exported")
+	}
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type traceKey int
+
+const (
+	requestIDKey traceKey = iota
+	queryStatsKey
+	queryStartKey
+)
+
+// WithRequestID attaches the ID of the request a context serves, so its
+// queries can be logged against it
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// QueryStats totals the queries run under one context, see WithQueryStats
+type QueryStats struct {
+	count atomic.Int64
+	nanos atomic.Int64
+}
+
+// Count is the number of queries run so far
+func (s *QueryStats) Count() int64 {
+	return s.count.Load()
+}
+
+// Duration is the time spent in those queries
+func (s *QueryStats) Duration() time.Duration {
+	return time.Duration(s.nanos.Load())
+}
+
+func (s *QueryStats) add(d time.Duration) {
+	s.count.Add(1)
+	s.nanos.Add(int64(d))
+}
+
+// WithQueryStats returns a context whose queries are totalled in the
+// returned stats, for reporting a request's database time
+func WithQueryStats(ctx context.Context) (context.Context, *QueryStats) {
+	stats := &QueryStats{}
+	return context.WithValue(ctx, queryStatsKey, stats), stats
+}
+
+// QueryMetrics are the totals of every query the pool has run
+type QueryMetrics struct {
+	Queries     int64   `json:"queries"`
+	Errors      int64   `json:"errors"`
+	QueryTimeMs float64 `json:"query_time_ms"`
+}
+
+// queryTracer times every query. It totals them for QueryMetrics and for
+// the QueryStats of the query's context, and with logQueries set logs each
+// statement with its request. Arguments are never logged.
+type queryTracer struct {
+	logQueries bool
+	totals     QueryStats
+	errors     atomic.Int64
+}
+
+type queryStart struct {
+	at  time.Time
+	sql string
+}
+
+func (t *queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	start := queryStart{at: time.Now()}
+	if t.logQueries {
+		start.sql = data.SQL
+	}
+	return context.WithValue(ctx, queryStartKey, start)
+}
+
+func (t *queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey).(queryStart)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(start.at)
+	t.totals.add(elapsed)
+	if data.Err != nil {
+		t.errors.Add(1)
+	}
+	if stats, ok := ctx.Value(queryStatsKey).(*QueryStats); ok {
+		stats.add(elapsed)
+	}
+
+	if !t.logQueries {
+		return
+	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	if requestID == "" {
+		requestID = "none"
+	}
+	outcome := data.CommandTag.String()
+	if data.Err != nil {
+		outcome = "error: " + data.Err.Error()
+	}
+	log.Printf("Query (request %s) took %s, %s: %s",
+		requestID, elapsed.Round(time.Microsecond), outcome, strings.Join(strings.Fields(start.sql), " "))
+}
+
+// QueryMetrics returns the totals of every query run since startup
+func (db *Database) QueryMetrics() QueryMetrics {
+	return QueryMetrics{
+		Queries:     db.tracer.totals.Count(),
+		Errors:      db.tracer.errors.Load(),
+		QueryTimeMs: float64(db.tracer.totals.Duration()) / float64(time.Millisecond),
+	}
+}
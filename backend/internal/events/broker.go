@@ -0,0 +1,74 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Event is a named server-sent event addressed to one user
+type Event struct {
+	UserID uuid.UUID
+	Type   string
+	Data   interface{}
+}
+
+// Broker fans out events to SSE subscribers. Publishing never blocks: a
+// subscriber that falls behind simply misses events, as with torrent updates.
+type Broker struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	userID uuid.UUID
+	all    bool
+	ch     chan Event
+}
+
+// NewBroker creates a new event broker
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[*subscription]struct{}),
+	}
+}
+
+// Publish delivers an event to the user's subscribers and to admin subscribers
+func (b *Broker) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		if !sub.all && sub.userID != e.UserID {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			// Subscriber not keeping up, drop event
+		}
+	}
+}
+
+// Subscribe returns a channel of events for one user and a function that
+// must be called to unsubscribe
+func (b *Broker) Subscribe(userID uuid.UUID) (<-chan Event, func()) {
+	return b.subscribe(&subscription{userID: userID, ch: make(chan Event, 16)})
+}
+
+// SubscribeAll returns a channel of events for every user (admin streams)
+func (b *Broker) SubscribeAll() (<-chan Event, func()) {
+	return b.subscribe(&subscription{all: true, ch: make(chan Event, 64)})
+}
+
+func (b *Broker) subscribe(sub *subscription) (<-chan Event, func()) {
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub.ch, func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}
+}
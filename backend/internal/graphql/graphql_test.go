@@ -0,0 +1,211 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+type fakeStore struct {
+	user     *models.User
+	sub      *models.Subscription
+	torrents []models.Torrent
+
+	subCalls      int
+	limit, offset int
+	query         string
+	collectionID  *uuid.UUID
+}
+
+func (s *fakeStore) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if s.user == nil || s.user.ID != id {
+		return nil, nil
+	}
+	return s.user, nil
+}
+
+func (s *fakeStore) GetSubscription(ctx context.Context, userID uuid.UUID) (*models.Subscription, error) {
+	s.subCalls++
+	return s.sub, nil
+}
+
+func (s *fakeStore) GetTorrentsByUser(ctx context.Context, userID uuid.UUID, collectionID *uuid.UUID, status models.TorrentStatus, query string, limit, offset int) ([]models.Torrent, int, error) {
+	s.limit, s.offset, s.query, s.collectionID = limit, offset, query, collectionID
+	end := offset + limit
+	if end > len(s.torrents) {
+		end = len(s.torrents)
+	}
+	if offset >= end {
+		return nil, len(s.torrents), nil
+	}
+	return append([]models.Torrent(nil), s.torrents[offset:end]...), len(s.torrents), nil
+}
+
+func newTestSchema(t *testing.T, n int) (*fakeStore, *int, func(query string, vars map[string]interface{}) map[string]interface{}) {
+	t.Helper()
+	userID := uuid.New()
+	store := &fakeStore{
+		user: &models.User{ID: userID, Email: "a@example.com", Role: "user", CreatedAt: time.Unix(0, 0).UTC()},
+		sub:  &models.Subscription{Plan: "pro", Status: "active", DownloadLimitGB: 500},
+	}
+	for i := 0; i < n; i++ {
+		store.torrents = append(store.torrents, models.Torrent{
+			ID:        uuid.New(),
+			UserID:    userID,
+			InfoHash:  fmt.Sprintf("%040d", i),
+			Name:      fmt.Sprintf("torrent %d", i),
+			MagnetURI: "magnet:?xt=urn:btih:secret",
+			Status:    "downloading",
+			TotalSize: 10 << 30,
+		})
+	}
+
+	liveCalls := 0
+	live := func(id uuid.UUID, torrents []models.Torrent) {
+		liveCalls++
+		for i := range torrents {
+			torrents[i].DownloadSpeed = 1024
+		}
+	}
+	usage := func(ctx context.Context, id uuid.UUID, sub *models.Subscription) models.UsageStats {
+		return models.UsageStats{Plan: sub.Plan, LimitGB: sub.DownloadLimitGB}
+	}
+	schema := NewSchema(store, usage, live)
+
+	exec := func(query string, vars map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		resp := schema.Exec(WithViewer(context.Background(), userID), query, "", vars)
+		if len(resp.Errors) > 0 {
+			t.Fatalf("query errors: %v", resp.Errors)
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(resp.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		return data["viewer"].(map[string]interface{})
+	}
+	return store, &liveCalls, exec
+}
+
+func TestFieldSelection(t *testing.T) {
+	store, liveCalls, exec := newTestSchema(t, 3)
+
+	viewer := exec(`{ viewer { user { email } torrents { nodes { id name } } } }`, nil)
+	if len(viewer) != 2 {
+		t.Errorf("viewer has %d fields, want only user and torrents", len(viewer))
+	}
+	node := viewer["torrents"].(map[string]interface{})["nodes"].([]interface{})[0].(map[string]interface{})
+	if len(node) != 2 || node["id"] == nil || node["name"] == nil {
+		t.Errorf("node = %v, want only id and name", node)
+	}
+	if store.subCalls != 0 {
+		t.Errorf("subscription loaded %d times without being selected", store.subCalls)
+	}
+
+	exec(`{ viewer { subscription { plan } usage { plan limitGb } } }`, nil)
+	if store.subCalls != 1 {
+		t.Errorf("subscription loaded %d times for subscription and usage, want 1", store.subCalls)
+	}
+	if *liveCalls != 1 {
+		t.Errorf("engine looked up %d times, want 1 for the name field", *liveCalls)
+	}
+
+	*liveCalls = 0
+	exec(`{ viewer { torrents { nodes { id infoHash totalSize } } } }`, nil)
+	if *liveCalls != 0 {
+		t.Errorf("engine looked up %d times for stored fields only", *liveCalls)
+	}
+
+	viewer = exec(`{ viewer { torrents { nodes { downloadSpeed peers } } } }`, nil)
+	if *liveCalls != 1 {
+		t.Errorf("engine looked up %d times for a page of 3, want 1", *liveCalls)
+	}
+	for _, n := range viewer["torrents"].(map[string]interface{})["nodes"].([]interface{}) {
+		if speed := n.(map[string]interface{})["downloadSpeed"]; speed != float64(1024) {
+			t.Errorf("downloadSpeed = %v, want the engine's 1024", speed)
+		}
+	}
+}
+
+func TestNoMagnetField(t *testing.T) {
+	schema := NewSchema(&fakeStore{}, nil, nil)
+	resp := schema.Exec(WithViewer(context.Background(), uuid.New()),
+		`{ viewer { torrents { nodes { magnetUri } } } }`, "", nil)
+	if len(resp.Errors) == 0 {
+		t.Error("magnetUri is queryable")
+	}
+}
+
+func TestPagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       interface{}
+		wantLimit  int
+		wantOffset int
+		wantNodes  int
+		wantNext   bool
+	}{
+		{"default", nil, 20, 0, 20, true},
+		{"second page", map[string]interface{}{"page": 2, "pageSize": 20}, 20, 20, 5, false},
+		{"small pages", map[string]interface{}{"page": 3, "pageSize": 10}, 10, 20, 5, false},
+		{"exact end", map[string]interface{}{"page": 5, "pageSize": 5}, 5, 20, 5, false},
+		{"past the end", map[string]interface{}{"page": 9, "pageSize": 10}, 10, 80, 0, false},
+		{"page below 1", map[string]interface{}{"page": 0, "pageSize": 10}, 10, 0, 10, true},
+		{"oversized page", map[string]interface{}{"page": 1, "pageSize": 1000}, 20, 0, 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _, exec := newTestSchema(t, 25)
+			viewer := exec(`query($page: PageInput) {
+				viewer { torrents(page: $page) { nodes { id } totalCount page pageSize hasNextPage } }
+			}`, map[string]interface{}{"page": tt.page})
+
+			if store.limit != tt.wantLimit || store.offset != tt.wantOffset {
+				t.Errorf("limit, offset = %d, %d, want %d, %d", store.limit, store.offset, tt.wantLimit, tt.wantOffset)
+			}
+			page := viewer["torrents"].(map[string]interface{})
+			if n := len(page["nodes"].([]interface{})); n != tt.wantNodes {
+				t.Errorf("%d nodes, want %d", n, tt.wantNodes)
+			}
+			if page["totalCount"] != float64(25) {
+				t.Errorf("totalCount = %v, want 25", page["totalCount"])
+			}
+			if page["hasNextPage"] != tt.wantNext {
+				t.Errorf("hasNextPage = %v, want %v", page["hasNextPage"], tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	store, _, exec := newTestSchema(t, 1)
+	collectionID := uuid.New()
+	exec(`query($f: TorrentFilter) { viewer { torrents(filter: $f) { totalCount } } }`,
+		map[string]interface{}{"f": map[string]interface{}{"query": "linux", "collectionId": collectionID.String()}})
+	if store.query != "linux" {
+		t.Errorf("query = %q, want linux", store.query)
+	}
+	if store.collectionID == nil || *store.collectionID != collectionID {
+		t.Errorf("collectionID = %v, want %s", store.collectionID, collectionID)
+	}
+
+	schema := NewSchema(store, nil, nil)
+	resp := schema.Exec(WithViewer(context.Background(), store.user.ID),
+		`{ viewer { torrents(filter: {collectionId: "nope"}) { totalCount } } }`, "", nil)
+	if len(resp.Errors) == 0 {
+		t.Error("invalid collection ID accepted")
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	schema := NewSchema(&fakeStore{}, nil, nil)
+	resp := schema.Exec(context.Background(), `{ viewer { user { id } } }`, "", nil)
+	if len(resp.Errors) == 0 {
+		t.Error("query without a viewer succeeded")
+	}
+}
@@ -0,0 +1,313 @@
+package graphql
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+	graphqlgo "github.com/graph-gophers/graphql-go"
+)
+
+// Page size bounds, as for GET /torrents
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// maxDepth bounds query nesting; the schema itself is only four levels deep
+const maxDepth = 8
+
+// Store is the part of the database the schema reads
+type Store interface {
+	GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error)
+	GetSubscription(ctx context.Context, userID uuid.UUID) (*models.Subscription, error)
+	GetTorrentsByUser(ctx context.Context, userID uuid.UUID, collectionID *uuid.UUID, status models.TorrentStatus, query string, limit, offset int) ([]models.Torrent, int, error)
+}
+
+// UsageFunc computes a user's usage the way GET /auth/me does
+type UsageFunc func(ctx context.Context, userID uuid.UUID, subscription *models.Subscription) models.UsageStats
+
+// LiveStatusFunc merges the engine's live state into torrents, all owned by
+// userID, with one engine lookup for the lot
+type LiveStatusFunc func(userID uuid.UUID, torrents []models.Torrent)
+
+// ErrUnauthenticated is returned when a query runs without a viewer
+var ErrUnauthenticated = errors.New("not authenticated")
+
+type viewerKey struct{}
+
+// WithViewer returns a context that queries run in as userID
+func WithViewer(ctx context.Context, userID uuid.UUID) context.Context {
+	return context.WithValue(ctx, viewerKey{}, userID)
+}
+
+// NewSchema binds the dashboard schema to store
+func NewSchema(store Store, usage UsageFunc, live LiveStatusFunc) *graphqlgo.Schema {
+	return graphqlgo.MustParseSchema(schema, &rootResolver{store: store, usage: usage, live: live},
+		graphqlgo.MaxDepth(maxDepth))
+}
+
+type rootResolver struct {
+	store Store
+	usage UsageFunc
+	live  LiveStatusFunc
+}
+
+// Viewer resolves the signed-in user. Everything under it is loaded lazily,
+// only when selected, and at most once per query.
+func (r *rootResolver) Viewer(ctx context.Context) (*viewerResolver, error) {
+	userID, ok := ctx.Value(viewerKey{}).(uuid.UUID)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return &viewerResolver{root: r, userID: userID}, nil
+}
+
+type viewerResolver struct {
+	root   *rootResolver
+	userID uuid.UUID
+
+	subOnce sync.Once
+	sub     *models.Subscription
+	subErr  error
+}
+
+// subscription is shared by the subscription and usage fields, which
+// resolve concurrently
+func (v *viewerResolver) subscription(ctx context.Context) (*models.Subscription, error) {
+	v.subOnce.Do(func() {
+		v.sub, v.subErr = v.root.store.GetSubscription(ctx, v.userID)
+	})
+	return v.sub, v.subErr
+}
+
+func (v *viewerResolver) User(ctx context.Context) (*userResolver, error) {
+	user, err := v.root.store.GetUserByID(ctx, v.userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	return &userResolver{user}, nil
+}
+
+func (v *viewerResolver) Subscription(ctx context.Context) (*subscriptionResolver, error) {
+	sub, err := v.subscription(ctx)
+	if err != nil || sub == nil {
+		return nil, err
+	}
+	return &subscriptionResolver{sub}, nil
+}
+
+func (v *viewerResolver) Usage(ctx context.Context) (*usageResolver, error) {
+	sub, err := v.subscription(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &usageResolver{v.root.usage(ctx, v.userID, sub)}, nil
+}
+
+type torrentFilter struct {
+	Query        *string
+	CollectionID *graphqlgo.ID
+}
+
+type pageInput struct {
+	Page     int32
+	PageSize int32
+}
+
+type torrentsArgs struct {
+	Filter *torrentFilter
+	Page   *pageInput
+}
+
+func (v *viewerResolver) Torrents(ctx context.Context, args torrentsArgs) (*torrentPageResolver, error) {
+	page, pageSize := 1, defaultPageSize
+	if args.Page != nil {
+		if args.Page.Page > 1 {
+			page = int(args.Page.Page)
+		}
+		if args.Page.PageSize >= 1 && args.Page.PageSize <= maxPageSize {
+			pageSize = int(args.Page.PageSize)
+		}
+	}
+
+	var query string
+	var collectionID *uuid.UUID
+	if f := args.Filter; f != nil {
+		if f.Query != nil {
+			query = *f.Query
+		}
+		if f.CollectionID != nil {
+			id, err := uuid.Parse(string(*f.CollectionID))
+			if err != nil {
+				return nil, errors.New("invalid collection ID")
+			}
+			collectionID = &id
+		}
+	}
+
+	torrents, total, err := v.root.store.GetTorrentsByUser(ctx, v.userID, collectionID, "", query, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &torrentPageResolver{
+		loader:   &liveLoader{live: v.root.live, userID: v.userID, torrents: torrents},
+		total:    total,
+		page:     page,
+		pageSize: pageSize,
+	}, nil
+}
+
+// liveLoader merges the engine's state into a copy of a page of torrents
+// the first time a node's live field is resolved, so a page costs one
+// engine lookup however many nodes it has, and none when only stored fields
+// are selected. Stored fields keep reading the untouched page while the
+// merge runs.
+type liveLoader struct {
+	live     LiveStatusFunc
+	userID   uuid.UUID
+	torrents []models.Torrent
+
+	once   sync.Once
+	merged []models.Torrent
+}
+
+func (l *liveLoader) load(i int) *models.Torrent {
+	l.once.Do(func() {
+		l.merged = slices.Clone(l.torrents)
+		if l.live != nil {
+			l.live(l.userID, l.merged)
+		}
+	})
+	return &l.merged[i]
+}
+
+type torrentPageResolver struct {
+	loader   *liveLoader
+	total    int
+	page     int
+	pageSize int
+}
+
+func (p *torrentPageResolver) Nodes() []*torrentResolver {
+	nodes := make([]*torrentResolver, len(p.loader.torrents))
+	for i := range p.loader.torrents {
+		nodes[i] = &torrentResolver{loader: p.loader, i: i}
+	}
+	return nodes
+}
+
+func (p *torrentPageResolver) TotalCount() int32 { return int32(p.total) }
+func (p *torrentPageResolver) Page() int32       { return int32(p.page) }
+func (p *torrentPageResolver) PageSize() int32   { return int32(p.pageSize) }
+
+func (p *torrentPageResolver) HasNextPage() bool {
+	return p.page*p.pageSize < p.total
+}
+
+type userResolver struct {
+	u *models.User
+}
+
+func (r *userResolver) ID() graphqlgo.ID          { return graphqlgo.ID(r.u.ID.String()) }
+func (r *userResolver) Email() string             { return r.u.Email }
+func (r *userResolver) Role() string              { return r.u.Role }
+func (r *userResolver) DefaultZip() bool          { return r.u.DefaultZip }
+func (r *userResolver) EmailNotifications() bool  { return r.u.EmailNotifications }
+func (r *userResolver) CreatedAt() graphqlgo.Time { return graphqlgo.Time{Time: r.u.CreatedAt} }
+
+type subscriptionResolver struct {
+	s *models.Subscription
+}
+
+func (r *subscriptionResolver) Plan() string   { return r.s.Plan }
+func (r *subscriptionResolver) Status() string { return r.s.Status }
+func (r *subscriptionResolver) CurrentPeriodStart() *graphqlgo.Time {
+	return optionalTime(r.s.CurrentPeriodStart)
+}
+func (r *subscriptionResolver) CurrentPeriodEnd() *graphqlgo.Time {
+	return optionalTime(r.s.CurrentPeriodEnd)
+}
+func (r *subscriptionResolver) DownloadLimitGb() int32 { return int32(r.s.DownloadLimitGB) }
+func (r *subscriptionResolver) ConcurrentLimit() int32 { return int32(r.s.ConcurrentLimit) }
+func (r *subscriptionResolver) RetentionDays() int32   { return int32(r.s.RetentionDays) }
+func (r *subscriptionResolver) StorageLimitGb() int32  { return int32(r.s.StorageLimitGB) }
+
+type usageResolver struct {
+	u models.UsageStats
+}
+
+func (r *usageResolver) UsedGb() float64             { return r.u.UsedGB }
+func (r *usageResolver) UploadedGb() float64         { return r.u.UploadedGB }
+func (r *usageResolver) ServedGb() float64           { return r.u.ServedGB }
+func (r *usageResolver) LimitGb() int32              { return int32(r.u.LimitGB) }
+func (r *usageResolver) ActiveTorrents() int32       { return int32(r.u.ActiveTorrents) }
+func (r *usageResolver) ConcurrentLimit() int32      { return int32(r.u.ConcurrentLimit) }
+func (r *usageResolver) Plan() string                { return r.u.Plan }
+func (r *usageResolver) StorageUsedGb() float64      { return r.u.StorageUsedGB }
+func (r *usageResolver) StorageLimitGb() int32       { return int32(r.u.StorageLimitGB) }
+func (r *usageResolver) PeriodStart() graphqlgo.Time { return graphqlgo.Time{Time: r.u.Start} }
+func (r *usageResolver) PeriodEnd() graphqlgo.Time   { return graphqlgo.Time{Time: r.u.End} }
+
+// torrentResolver reads stored fields straight from the page and live ones
+// through the page's loader
+type torrentResolver struct {
+	loader *liveLoader
+	i      int
+}
+
+func (r *torrentResolver) stored() *models.Torrent { return &r.loader.torrents[r.i] }
+func (r *torrentResolver) live() *models.Torrent   { return r.loader.load(r.i) }
+
+func (r *torrentResolver) ID() graphqlgo.ID   { return graphqlgo.ID(r.stored().ID.String()) }
+func (r *torrentResolver) InfoHash() string   { return r.stored().InfoHash }
+func (r *torrentResolver) Name() string       { return r.live().Name }
+func (r *torrentResolver) Status() string     { return string(r.live().Status) }
+func (r *torrentResolver) Progress() float64  { return r.live().Progress }
+func (r *torrentResolver) TotalSize() float64 { return float64(r.stored().TotalSize) }
+func (r *torrentResolver) DownloadedSize() float64 {
+	return float64(r.live().DownloadedSize)
+}
+func (r *torrentResolver) DownloadSpeed() float64 { return r.live().DownloadSpeed }
+func (r *torrentResolver) UploadSpeed() float64   { return r.live().UploadSpeed }
+func (r *torrentResolver) Peers() int32           { return int32(r.live().Peers) }
+func (r *torrentResolver) Seeds() int32           { return int32(r.live().Seeds) }
+func (r *torrentResolver) IsPrivate() bool        { return r.stored().IsPrivate }
+func (r *torrentResolver) FileCount() int32       { return int32(len(r.live().Files)) }
+
+func (r *torrentResolver) ZipStatus() *string {
+	if s := r.stored().ZipStatus; s != "" {
+		return &s
+	}
+	return nil
+}
+
+func (r *torrentResolver) ErrorMessage() *string { return r.stored().ErrorMessage }
+
+func (r *torrentResolver) CollectionID() *graphqlgo.ID {
+	if id := r.stored().CollectionID; id != nil {
+		gid := graphqlgo.ID(id.String())
+		return &gid
+	}
+	return nil
+}
+
+func (r *torrentResolver) CreatedAt() graphqlgo.Time {
+	return graphqlgo.Time{Time: r.stored().CreatedAt}
+}
+func (r *torrentResolver) CompletedAt() *graphqlgo.Time { return optionalTime(r.stored().CompletedAt) }
+func (r *torrentResolver) ExpiresAt() *graphqlgo.Time   { return optionalTime(r.stored().ExpiresAt) }
+
+func optionalTime(t *time.Time) *graphqlgo.Time {
+	if t == nil {
+		return nil
+	}
+	return &graphqlgo.Time{Time: *t}
+}
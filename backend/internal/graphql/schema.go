@@ -0,0 +1,96 @@
+package graphql
+
+// schema is the dashboard's read-only view of the signed-in user. Sizes are
+// Floats: GraphQL's Int is 32-bit and torrents aren't.
+const schema = `
+schema {
+	query: Query
+}
+
+scalar Time
+
+type Query {
+	viewer: Viewer!
+}
+
+type Viewer {
+	user: User!
+	subscription: Subscription
+	usage: Usage!
+	torrents(filter: TorrentFilter, page: PageInput): TorrentPage!
+}
+
+type User {
+	id: ID!
+	email: String!
+	role: String!
+	defaultZip: Boolean!
+	emailNotifications: Boolean!
+	createdAt: Time!
+}
+
+type Subscription {
+	plan: String!
+	status: String!
+	currentPeriodStart: Time
+	currentPeriodEnd: Time
+	downloadLimitGb: Int!
+	concurrentLimit: Int!
+	retentionDays: Int!
+	storageLimitGb: Int!
+}
+
+type Usage {
+	usedGb: Float!
+	uploadedGb: Float!
+	servedGb: Float!
+	limitGb: Int!
+	activeTorrents: Int!
+	concurrentLimit: Int!
+	plan: String!
+	storageUsedGb: Float!
+	storageLimitGb: Int!
+	periodStart: Time!
+	periodEnd: Time!
+}
+
+input TorrentFilter {
+	query: String
+	collectionId: ID
+}
+
+input PageInput {
+	page: Int = 1
+	pageSize: Int = 20
+}
+
+type TorrentPage {
+	nodes: [Torrent!]!
+	totalCount: Int!
+	page: Int!
+	pageSize: Int!
+	hasNextPage: Boolean!
+}
+
+type Torrent {
+	id: ID!
+	infoHash: String!
+	name: String!
+	status: String!
+	progress: Float!
+	totalSize: Float!
+	downloadedSize: Float!
+	downloadSpeed: Float!
+	uploadSpeed: Float!
+	peers: Int!
+	seeds: Int!
+	isPrivate: Boolean!
+	fileCount: Int!
+	zipStatus: String
+	errorMessage: String
+	collectionId: ID
+	createdAt: Time!
+	completedAt: Time
+	expiresAt: Time
+}
+`
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ActivityHandler serves the user's activity feed
+type ActivityHandler struct {
+	db *database.Database
+}
+
+func NewActivityHandler(db *database.Database) *ActivityHandler {
+	return &ActivityHandler{db: db}
+}
+
+// ListActivity returns a page of the user's activity, newest first
+func (h *ActivityHandler) ListActivity(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	return activityPage(c, h.db, &userID, false)
+}
+
+// activityPage responds with one page of activity for userID, or for every
+// user when nil. Pages are keyed by created_at: before= takes the previous
+// page's next_before. When stream is set, a request for a stream (see
+// wantsStream) gets every entry older than before, unpaged.
+func activityPage(c *fiber.Ctx, db *database.Database, userID *uuid.UUID, stream bool) error {
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var before *time.Time
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid before",
+				Details: "expected an RFC 3339 timestamp",
+			})
+		}
+		before = &t
+	}
+
+	if stream && wantsStream(c) {
+		return streamNDJSON(c, "Activity", func(ctx context.Context, emit func(v any) error) error {
+			return db.EachActivity(ctx, userID, before, func(a *models.Activity) error {
+				return emit(a)
+			})
+		})
+	}
+
+	activities, err := db.GetActivity(c.UserContext(), userID, before, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch activity",
+		})
+	}
+
+	resp := models.ActivityListResponse{Activities: activities}
+	if resp.Activities == nil {
+		resp.Activities = []models.Activity{}
+	}
+	if len(activities) == limit {
+		resp.NextBefore = &activities[len(activities)-1].CreatedAt
+	}
+	return c.JSON(resp)
+}
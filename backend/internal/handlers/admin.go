@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/jobs"
+	"github.com/freetorrent/freetorrent/internal/middleware"
 	"github.com/freetorrent/freetorrent/internal/models"
 	"github.com/freetorrent/freetorrent/internal/torrent"
 	"github.com/gofiber/fiber/v2"
@@ -12,14 +18,25 @@ import (
 )
 
 type AdminHandler struct {
-	db     *database.Database
-	engine *torrent.Engine
+	db          *database.Database
+	engine      torrent.Service
+	apiUsage    *middleware.APIUsage
+	compression *middleware.Compression
+	redirects   *middleware.DownloadRedirects
+	hooks       hooks.Hooks
+	completer   *jobs.Completer
 }
 
-func NewAdminHandler(db *database.Database, engine *torrent.Engine) *AdminHandler {
+func NewAdminHandler(db *database.Database, engine torrent.Service, apiUsage *middleware.APIUsage, compression *middleware.Compression,
+	redirects *middleware.DownloadRedirects, h hooks.Hooks, completer *jobs.Completer) *AdminHandler {
 	return &AdminHandler{
-		db:     db,
-		engine: engine,
+		db:          db,
+		engine:      engine,
+		apiUsage:    apiUsage,
+		compression: compression,
+		redirects:   redirects,
+		hooks:       h,
+		completer:   completer,
 	}
 }
 
@@ -35,7 +52,7 @@ func (h *AdminHandler) ListUsers(c *fiber.Ctx) error {
 	}
 	offset := (page - 1) * pageSize
 
-	users, total, err := h.db.GetAllUsers(c.Context(), pageSize, offset)
+	users, total, err := h.db.GetAllUsers(c.UserContext(), pageSize, offset)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to fetch users",
@@ -51,7 +68,7 @@ func (h *AdminHandler) ListUsers(c *fiber.Ctx) error {
 	enrichedUsers := make([]UserWithSub, len(users))
 	for i, user := range users {
 		enrichedUsers[i].User = user
-		sub, _ := h.db.GetSubscription(c.Context(), user.ID)
+		sub, _ := h.db.GetSubscription(c.UserContext(), user.ID)
 		enrichedUsers[i].Subscription = sub
 	}
 
@@ -72,7 +89,7 @@ func (h *AdminHandler) GetUser(c *fiber.Ctx) error {
 		})
 	}
 
-	user, err := h.db.GetUserByID(c.Context(), userID)
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "database error",
@@ -85,25 +102,51 @@ func (h *AdminHandler) GetUser(c *fiber.Ctx) error {
 	}
 
 	// Get subscription
-	subscription, _ := h.db.GetSubscription(c.Context(), userID)
+	subscription, _ := h.db.GetSubscription(c.UserContext(), userID)
 
 	// Get usage stats
-	monthlyUsage, _ := h.db.GetMonthlyUsage(c.Context(), userID)
-	activeTorrents, _ := h.db.CountActiveTorrents(c.Context(), userID)
+	period := models.CurrentUsagePeriod(subscription, time.Now())
+	monthlyUsage, _ := h.db.GetMonthlyUsage(c.UserContext(), userID, period)
+	monthlyUpload, _ := h.db.GetMonthlyUpload(c.UserContext(), userID, period)
+	monthlyServed, _ := h.db.GetMonthlyServed(c.UserContext(), userID, period)
+	activeTorrents, _ := h.db.CountActiveTorrents(c.UserContext(), userID)
+	storage, _ := h.db.GetStorageUsage(c.UserContext(), userID)
+
+	// API usage logged over the last day, plus what is still in memory
+	apiUsage, _ := h.db.GetAPIUsage(c.UserContext(), userID, time.Now().Add(-24*time.Hour))
+	unflushed, recentBytes, throttled := h.apiUsage.Recent(userID)
+	apiUsage.Requests += unflushed.Requests
+	apiUsage.BytesIn += unflushed.BytesIn
+	apiUsage.BytesOut += unflushed.BytesOut
+	apiUsage.TimeMs += unflushed.TimeMs
 
 	// Get torrents
-	torrents, totalTorrents, _ := h.db.GetTorrentsByUser(c.Context(), userID, 10, 0)
+	torrents, totalTorrents, _ := h.db.GetTorrentsByUser(c.UserContext(), userID, nil, "", "", 10, 0)
 
 	return c.JSON(fiber.Map{
 		"user":         user,
 		"subscription": subscription,
 		"usage": fiber.Map{
 			"monthly_bytes":   monthlyUsage,
-			"monthly_gb":      float64(monthlyUsage) / (1024 * 1024 * 1024),
+			"monthly_gb":      float64(monthlyUsage) / float64(models.GB),
+			"upload_bytes":    monthlyUpload,
+			"upload_gb":       float64(monthlyUpload) / float64(models.GB),
+			"served_bytes":    monthlyServed,
+			"served_gb":       float64(monthlyServed) / float64(models.GB),
+			"period_start":    period.Start,
+			"period_end":      period.End,
 			"active_torrents": activeTorrents,
+			"storage_bytes":   storage.Used,
+			"storage_gb":      float64(storage.Used) / float64(models.GB),
+			"pending_bytes":   storage.Pending,
+		},
+		"api_usage": fiber.Map{
+			"last_day":     apiUsage,
+			"recent_bytes": recentBytes,
+			"throttled":    throttled,
 		},
 		"torrents": fiber.Map{
-			"items": torrents,
+			"items": models.NewAdminTorrents(torrents),
 			"total": totalTorrents,
 		},
 	})
@@ -119,8 +162,9 @@ func (h *AdminHandler) UpdateUser(c *fiber.Ctx) error {
 	}
 
 	type UpdateRequest struct {
-		Role string `json:"role,omitempty"`
-		Plan string `json:"plan,omitempty"`
+		Role   string `json:"role,omitempty"`
+		Plan   string `json:"plan,omitempty"`
+		Reason string `json:"reason,omitempty"` // kept in the subscription history
 	}
 
 	var req UpdateRequest
@@ -138,7 +182,7 @@ func (h *AdminHandler) UpdateUser(c *fiber.Ctx) error {
 				Error: "invalid role",
 			})
 		}
-		if err := h.db.UpdateUserRole(c.Context(), userID, req.Role); err != nil {
+		if err := h.db.UpdateUserRole(c.UserContext(), userID, req.Role); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 				Error: "failed to update role",
 			})
@@ -147,13 +191,19 @@ func (h *AdminHandler) UpdateUser(c *fiber.Ctx) error {
 
 	// Update plan if provided
 	if req.Plan != "" {
-		limits, ok := models.Plans[req.Plan]
-		if !ok {
+		if _, ok := h.db.GetPlanLimits(c.UserContext(), req.Plan); !ok {
 			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
 				Error: "invalid plan",
 			})
 		}
-		if err := h.db.UpdateSubscription(c.Context(), userID, req.Plan, "active", limits); err != nil {
+		adminID, err := middleware.GetUserID(c)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+				Error: "invalid user",
+			})
+		}
+		actor := models.SubscriptionActor{Type: models.SubscriptionActorAdmin, ID: &adminID, Reason: req.Reason}
+		if err := ApplySubscription(c.UserContext(), h.db, userID, req.Plan, "active", actor); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 				Error: "failed to update subscription",
 			})
@@ -165,6 +215,31 @@ func (h *AdminHandler) UpdateUser(c *fiber.Ctx) error {
 	})
 }
 
+// GetSubscriptionHistory returns a page of a user's plan and status changes,
+// with who made each and why
+func (h *AdminHandler) GetSubscriptionHistory(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid user ID",
+		})
+	}
+
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "database error",
+		})
+	}
+	if user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "user not found",
+		})
+	}
+
+	return subscriptionHistoryPage(c, h.db, userID, true)
+}
+
 // DeleteUser removes a user and all their data
 func (h *AdminHandler) DeleteUser(c *fiber.Ctx) error {
 	userID, err := uuid.Parse(c.Params("id"))
@@ -174,14 +249,25 @@ func (h *AdminHandler) DeleteUser(c *fiber.Ctx) error {
 		})
 	}
 
+	adminID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	if ok, err := confirmDestructive(c, h.db, adminID, "delete_user:"+userID.String(),
+		"deleting a user removes their account and all their torrents"); !ok {
+		return err
+	}
+
 	// Get user's torrents and remove them from engine
-	torrents, _, _ := h.db.GetTorrentsByUser(c.Context(), userID, 1000, 0)
+	torrents, _, _ := h.db.GetTorrentsByUser(c.UserContext(), userID, nil, "", "", 1000, 0)
 	for _, t := range torrents {
-		h.engine.RemoveTorrent(t.InfoHash, true)
+		h.engine.RemoveOwner(t.InfoHash, t.ID, true)
 	}
 
 	// Delete user (cascades to torrents, subscriptions, etc.)
-	if err := h.db.DeleteUser(c.Context(), userID); err != nil {
+	if err := h.db.DeleteUser(c.UserContext(), userID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to delete user",
 		})
@@ -192,8 +278,13 @@ func (h *AdminHandler) DeleteUser(c *fiber.Ctx) error {
 	})
 }
 
-// ListAllTorrents returns all torrents across all users
+// ListAllTorrents returns all torrents across all users. Streamed (see
+// wantsStream), it sends every torrent matching the filters, unpaged.
 func (h *AdminHandler) ListAllTorrents(c *fiber.Ctx) error {
+	if wantsStream(c) {
+		return h.streamAllTorrents(c)
+	}
+
 	page, _ := strconv.Atoi(c.Query("page", "1"))
 	pageSize, _ := strconv.Atoi(c.Query("page_size", "20"))
 	if page < 1 {
@@ -204,7 +295,7 @@ func (h *AdminHandler) ListAllTorrents(c *fiber.Ctx) error {
 	}
 	offset := (page - 1) * pageSize
 
-	torrents, total, err := h.db.GetAllTorrents(c.Context(), pageSize, offset)
+	torrents, total, err := h.db.GetAllTorrents(c.UserContext(), c.Query("source"), c.Query("q"), pageSize, offset)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to fetch torrents",
@@ -214,22 +305,57 @@ func (h *AdminHandler) ListAllTorrents(c *fiber.Ctx) error {
 	// Enrich with live stats
 	for i := range torrents {
 		if status, err := h.engine.GetTorrentStatus(torrents[i].InfoHash); err == nil {
-			torrents[i].DownloadSpeed = status.DownloadSpeed
-			torrents[i].Progress = status.Progress
-			if status.Status != "" {
-				torrents[i].Status = status.Status
-			}
+			applyLiveStatus(&torrents[i], status)
 		}
 	}
 
 	return c.JSON(fiber.Map{
-		"torrents":    torrents,
+		"torrents":    models.NewAdminTorrents(torrents),
 		"total_count": total,
 		"page":        page,
 		"page_size":   pageSize,
 	})
 }
 
+// streamAllTorrents streams every torrent ListAllTorrents would page
+// through. Live stats come from one snapshot of the engine rather than a
+// lookup per row.
+func (h *AdminHandler) streamAllTorrents(c *fiber.Ctx) error {
+	source, query := strings.Clone(c.Query("source")), strings.Clone(c.Query("q"))
+
+	live := make(map[string]*torrent.TorrentUpdate)
+	running := h.engine.GetActiveTorrents()
+	for i := range running {
+		live[running[i].InfoHash] = &running[i]
+	}
+
+	return streamNDJSON(c, "Admin torrent list", func(ctx context.Context, emit func(v any) error) error {
+		return h.db.EachTorrent(ctx, source, query, func(t *models.Torrent) error {
+			if status, ok := live[t.InfoHash]; ok {
+				applyLiveStatus(t, status)
+			}
+			return emit(models.AdminTorrent{Torrent: *t, TorrentAudit: t.Audit})
+		})
+	})
+}
+
+// ListActivity returns a page of activity across all users, or one user's
+// with user_id=
+func (h *AdminHandler) ListActivity(c *fiber.Ctx) error {
+	var userID *uuid.UUID
+	if v := c.Query("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid user ID",
+			})
+		}
+		userID = &id
+	}
+
+	return activityPage(c, h.db, userID, true)
+}
+
 // DeleteTorrent removes any torrent (admin override)
 func (h *AdminHandler) DeleteTorrent(c *fiber.Ctx) error {
 	torrentID, err := uuid.Parse(c.Params("id"))
@@ -239,53 +365,64 @@ func (h *AdminHandler) DeleteTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	t, err := h.db.GetTorrent(c.Context(), torrentID)
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
 	if err != nil || t == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
 	deleteFiles := c.Query("delete_files", "true") == "true"
 
 	// Remove from engine
-	h.engine.RemoveTorrent(t.InfoHash, deleteFiles)
+	h.engine.RemoveOwner(t.InfoHash, t.ID, deleteFiles)
 
 	// Remove from database
-	if err := h.db.DeleteTorrent(c.Context(), torrentID); err != nil {
+	if err := h.db.DeleteTorrent(c.UserContext(), torrentID, models.ClosedAdminDeleted); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to delete torrent",
 		})
 	}
+	h.hooks.OnTorrentDeleted(t, hooks.DeleteReasonAdmin)
 
 	return c.JSON(models.SuccessResponse{
 		Message: "torrent deleted",
 	})
 }
 
-// GetStats returns platform-wide statistics
+// engineStatsStall is how long the engine's update loop may have been quiet
+// before admin stats stop asking it about torrents, which would hang on a
+// stuck client
+const engineStatsStall = 10 * time.Second
+
+// GetStats returns platform-wide statistics, with the engine's health
 func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 	// User counts
-	users, totalUsers, _ := h.db.GetAllUsers(c.Context(), 1, 0)
+	users, totalUsers, _ := h.db.GetAllUsers(c.UserContext(), 1, 0)
 	_ = users // unused, we just need total
 
 	// Torrent counts
-	torrents, totalTorrents, _ := h.db.GetAllTorrents(c.Context(), 1, 0)
+	torrents, totalTorrents, _ := h.db.GetAllTorrents(c.UserContext(), "", "", 1, 0)
 	_ = torrents // unused
 
-	// Active torrents from engine
-	activeTorrents := h.engine.GetActiveTorrents()
+	// Active torrents from engine, unless it is stuck and would hang this
+	engine := h.engine.Health()
+	var activeTorrents []torrent.TorrentUpdate
+	if engine.Available && !h.engine.Stalled(engineStatsStall) {
+		activeTorrents = h.engine.GetActiveTorrents()
+	}
 	
 	var totalDownloading, totalSeeding, totalCompleted int
 	var totalDownloadSpeed, totalUploadSpeed float64
 	
 	for _, t := range activeTorrents {
 		switch t.Status {
-		case "downloading":
+		case models.TorrentStatusDownloading:
 			totalDownloading++
-		case "seeding":
+		case models.TorrentStatusSeeding:
 			totalSeeding++
-		case "completed":
+		case models.TorrentStatusCompleted:
 			totalCompleted++
 		}
 		totalDownloadSpeed += t.DownloadSpeed
@@ -298,6 +435,24 @@ func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 		Count int    `json:"count"`
 	}
 
+	// Heaviest adders and churners, for abuse review
+	offenders, err := h.db.GetAddOffenders(c.UserContext(), 10)
+	if err != nil {
+		log.Printf("Failed to get add offenders: %v", err)
+	}
+	if offenders == nil {
+		offenders = []models.AddOffender{}
+	}
+
+	// Who is on which client version, to know who a breaking change hits
+	clients, err := h.db.GetClientUsage(c.UserContext(), time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		log.Printf("Failed to get client usage: %v", err)
+	}
+	if clients == nil {
+		clients = []models.ClientUsage{}
+	}
+
 	return c.JSON(fiber.Map{
 		"users": fiber.Map{
 			"total": totalUsers,
@@ -313,13 +468,73 @@ func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 			"download_speed_bps": totalDownloadSpeed,
 			"upload_speed_bps":   totalUploadSpeed,
 		},
-		"timestamp": time.Now(),
+		"top_offenders": offenders,
+		"clients":       clients,
+		"port_check":    h.engine.LastPortCheck(),
+		"engine":        engine,
+		"database":      h.db.QueryMetrics(),
+		"compression":   h.compression.Metrics(),
+		"timestamp":     time.Now(),
+	})
+}
+
+// GetEngineStatus returns the torrent client's health, effective network
+// settings, the depth of the metadata fetch queue and the last port check
+func (h *AdminHandler) GetEngineStatus(c *fiber.Ctx) error {
+	health := h.engine.Health()
+	if !health.Available || h.engine.Stalled(engineStatsStall) {
+		return c.JSON(fiber.Map{
+			"health":     health,
+			"port_check": h.engine.LastPortCheck(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"health":          health,
+		"settings":        h.engine.Settings(),
+		"active_torrents": len(h.engine.GetActiveTorrents()),
+		"metadata_queue":  h.engine.MetadataQueue(),
+		"port_check":      h.engine.LastPortCheck(),
+	})
+}
+
+// CheckPort checks now whether the BitTorrent port is reachable from the
+// internet
+func (h *AdminHandler) CheckPort(c *fiber.Ctx) error {
+	return c.JSON(h.engine.CheckPortReachability(c.UserContext()))
+}
+
+// ClearDiskError lets the engine take new torrents again after a disk write
+// error, once the download directory takes writes. Torrents that failed
+// stay failed until retried.
+func (h *AdminHandler) ClearDiskError(c *fiber.Ctx) error {
+	if h.engine.DiskError() == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "no disk error to clear",
+			Code:  "NO_DISK_ERROR",
+		})
+	}
+	if err := h.engine.ProbeDownloadDir(); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error:   "download directory still can't be written",
+			Code:    "DISK_NOT_WRITABLE",
+			Details: err.Error(),
+		})
+	}
+
+	cleared := h.engine.ClearDiskError()
+	if cleared != nil {
+		log.Printf("Admin cleared the disk error of torrent %s: %s", cleared.InfoHash, cleared.Error)
+	}
+	return c.JSON(fiber.Map{
+		"message": "disk error cleared; new torrents are accepted again",
+		"cleared": cleared,
 	})
 }
 
-// CleanupExpired removes expired torrents
+// CleanupExpired removes expired torrents, and failed and cancelled ones
+// past their retention
 func (h *AdminHandler) CleanupExpired(c *fiber.Ctx) error {
-	expired, err := h.db.GetExpiredTorrents(c.Context())
+	expired, err := h.db.GetExpiredTorrents(c.UserContext())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to fetch expired torrents",
@@ -328,13 +543,25 @@ func (h *AdminHandler) CleanupExpired(c *fiber.Ctx) error {
 
 	var cleaned int
 	for _, t := range expired {
-		h.engine.RemoveTorrent(t.InfoHash, true)
-		h.db.DeleteTorrent(c.Context(), t.ID)
+		h.engine.RemoveOwner(t.InfoHash, t.ID, true)
+		h.db.LogTorrentExpired(c.UserContext(), &t)
+		h.db.ExpireDownloadTokens(c.UserContext(), t.ID)
+		h.db.DeleteTorrent(c.UserContext(), t.ID, models.ClosedExpired)
+		h.hooks.OnTorrentDeleted(&t, hooks.DeleteReasonExpired)
 		cleaned++
 	}
 
+	purged, err := h.completer.PurgeFailed(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error:   "failed to purge failed torrents",
+			Details: err.Error(),
+		})
+	}
+
 	return c.JSON(fiber.Map{
-		"message": "cleanup complete",
-		"removed": cleaned,
+		"message":       "cleanup complete",
+		"removed":       cleaned,
+		"failed_purged": purged,
 	})
 }
@@ -1,29 +1,42 @@
 package handlers
 
 import (
+	"context"
+	"log"
 	"regexp"
 	"time"
 
 	"github.com/freetorrent/freetorrent/internal/auth"
 	"github.com/freetorrent/freetorrent/internal/config"
 	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/hooks"
 	"github.com/freetorrent/freetorrent/internal/middleware"
 	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type AuthHandler struct {
-	db   *database.Database
-	auth *auth.AuthService
-	cfg  *config.Config
+	db     *database.Database
+	auth   *auth.AuthService
+	cfg    *config.Config
+	engine torrent.Service
+	hooks  hooks.Hooks
+
+	// codeAttempts limits two-factor code checks per user, whichever
+	// addresses they come from
+	codeAttempts *middleware.RateLimiter
 }
 
-func NewAuthHandler(db *database.Database, authService *auth.AuthService, cfg *config.Config) *AuthHandler {
+func NewAuthHandler(db *database.Database, authService *auth.AuthService, cfg *config.Config, engine torrent.Service, h hooks.Hooks) *AuthHandler {
 	return &AuthHandler{
-		db:   db,
-		auth: authService,
-		cfg:  cfg,
+		db:           db,
+		auth:         authService,
+		cfg:          cfg,
+		engine:       engine,
+		hooks:        h,
+		codeAttempts: middleware.NewRateLimiter(twoFactorAttempts, time.Minute),
 	}
 }
 
@@ -31,6 +44,14 @@ var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]
 
 // Register creates a new user account
 func (h *AuthHandler) Register(c *fiber.Ctx) error {
+	mode := h.cfg.Capabilities().RegistrationMode
+	if mode == config.RegistrationClosed {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "registration is closed",
+			Code:  "REGISTRATION_CLOSED",
+		})
+	}
+
 	var req models.RegisterRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
@@ -54,7 +75,7 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 	}
 
 	// Check if user exists
-	existing, err := h.db.GetUserByEmail(c.Context(), req.Email)
+	existing, err := h.db.GetUserByEmail(c.UserContext(), req.Email)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "database error",
@@ -75,43 +96,54 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		})
 	}
 
+	// In invite mode a use is taken last, once nothing else can refuse
+	var invite *models.Invite
+	if mode == config.RegistrationInvite {
+		if req.InviteCode == "" {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Error: "an invite code is required",
+				Code:  "INVITE_REQUIRED",
+			})
+		}
+		invite, err = h.db.ConsumeInvite(c.UserContext(), normalizeInviteCode(req.InviteCode))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "database error",
+			})
+		}
+		if invite == nil {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Error: "invite code is invalid, used up or expired",
+				Code:  "INVITE_INVALID",
+			})
+		}
+	}
+
 	// Create user
-	user, err := h.db.CreateUser(c.Context(), req.Email, passwordHash)
+	user, err := h.db.CreateUser(c.UserContext(), req.Email, passwordHash)
 	if err != nil {
+		if invite != nil {
+			if err := h.db.ReleaseInvite(c.UserContext(), invite.ID); err != nil {
+				log.Printf("Failed to release invite %s: %v", invite.ID, err)
+			}
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to create user",
 		})
 	}
-
-	// Generate tokens
-	accessToken, err := h.auth.GenerateAccessToken(user.ID, user.Email, user.Role)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to generate access token",
-		})
+	if invite != nil {
+		if err := h.db.LogInviteUsed(c.UserContext(), user.ID, invite); err != nil {
+			log.Printf("Failed to log invite use for %s: %v", user.ID, err)
+		}
 	}
+	h.hooks.OnUserRegistered(user)
 
-	refreshToken, tokenHash, err := h.auth.GenerateRefreshToken()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to generate refresh token",
-		})
-	}
-
-	// Save refresh token
-	expiresAt := time.Now().AddDate(0, 0, h.cfg.JWTRefreshExpiry)
-	if err := h.db.SaveRefreshToken(c.Context(), user.ID, tokenHash, expiresAt); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to save refresh token",
-		})
+	// Generate tokens for a new session
+	resp, ok, err := h.issueTokens(c, user, time.Now(), false)
+	if !ok {
+		return err
 	}
-
-	return c.Status(fiber.StatusCreated).JSON(models.AuthResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    h.cfg.JWTAccessExpiry * 60,
-		User:         user,
-	})
+	return c.Status(fiber.StatusCreated).JSON(resp)
 }
 
 // Login authenticates a user
@@ -124,7 +156,7 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 	}
 
 	// Get user
-	user, err := h.db.GetUserByEmail(c.Context(), req.Email)
+	user, err := h.db.GetUserByEmail(c.UserContext(), req.Email)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "database error",
@@ -143,35 +175,34 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate tokens
-	accessToken, err := h.auth.GenerateAccessToken(user.ID, user.Email, user.Role)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to generate access token",
-		})
-	}
-
-	refreshToken, tokenHash, err := h.auth.GenerateRefreshToken()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to generate refresh token",
-		})
-	}
-
-	// Save refresh token
-	expiresAt := time.Now().AddDate(0, 0, h.cfg.JWTRefreshExpiry)
-	if err := h.db.SaveRefreshToken(c.Context(), user.ID, tokenHash, expiresAt); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to save refresh token",
-		})
-	}
-
-	return c.JSON(models.AuthResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    h.cfg.JWTAccessExpiry * 60,
-		User:         user,
-	})
+	// Then the two-factor code, once it is enabled
+	if user.TwoFactorEnabled {
+		if req.TOTPCode == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+				Error: "two-factor code required",
+				Code:  "TWO_FACTOR_CODE_REQUIRED",
+			})
+		}
+		valid, err := h.checkTwoFactorCode(c.UserContext(), user.ID, req.TOTPCode)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "database error",
+			})
+		}
+		if !valid {
+			return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+				Error: "invalid two-factor code",
+				Code:  "TWO_FACTOR_CODE_INVALID",
+			})
+		}
+	}
+
+	// Generate tokens for a new session
+	resp, ok, err := h.issueTokens(c, user, time.Now(), user.TwoFactorEnabled)
+	if !ok {
+		return err
+	}
+	return c.JSON(resp)
 }
 
 // Refresh generates a new access token using a refresh token
@@ -189,7 +220,7 @@ func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
 
 	// Hash the refresh token and look it up
 	tokenHash := h.auth.HashRefreshToken(req.RefreshToken)
-	userID, err := h.db.GetRefreshToken(c.Context(), tokenHash)
+	userID, started, twoFactor, err := h.db.GetRefreshToken(c.UserContext(), tokenHash)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "database error",
@@ -201,8 +232,18 @@ func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
 		})
 	}
 
+	// Tokens are capped at the session's end when issued, but the cap may
+	// have been lowered since
+	if end := h.sessionEnd(started); end != nil && !time.Now().Before(*end) {
+		h.db.DeleteRefreshToken(c.UserContext(), tokenHash)
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "session has reached its maximum age; sign in again",
+			Code:  "SESSION_EXPIRED",
+		})
+	}
+
 	// Get user
-	user, err := h.db.GetUserByID(c.Context(), userID)
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
 	if err != nil || user == nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
 			Error: "user not found",
@@ -210,37 +251,67 @@ func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
 	}
 
 	// Delete old refresh token (rotation)
-	h.db.DeleteRefreshToken(c.Context(), tokenHash)
+	h.db.DeleteRefreshToken(c.UserContext(), tokenHash)
 
-	// Generate new tokens
-	accessToken, err := h.auth.GenerateAccessToken(user.ID, user.Email, user.Role)
+	// Generate new tokens, sliding the refresh token's expiry within the
+	// same session
+	resp, ok, err := h.issueTokens(c, user, started, twoFactor)
+	if !ok {
+		return err
+	}
+	return c.JSON(resp)
+}
+
+// issueTokens signs user in to a session that started at started, with a
+// two-factor code when twoFactor is set: a new access token, and a new
+// refresh token saved for the session. The refresh token lasts
+// JWTRefreshExpiry days from now but never past the session's end. Reports
+// false once it has responded.
+func (h *AuthHandler) issueTokens(c *fiber.Ctx, user *models.User, started time.Time, twoFactor bool) (models.AuthResponse, bool, error) {
+	accessToken, err := h.auth.GenerateAccessToken(user.ID, user.Email, user.Role, twoFactor)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		return models.AuthResponse{}, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to generate access token",
 		})
 	}
 
-	newRefreshToken, newTokenHash, err := h.auth.GenerateRefreshToken()
+	refreshToken, tokenHash, err := h.auth.GenerateRefreshToken()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		return models.AuthResponse{}, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to generate refresh token",
 		})
 	}
 
-	// Save new refresh token
 	expiresAt := time.Now().AddDate(0, 0, h.cfg.JWTRefreshExpiry)
-	if err := h.db.SaveRefreshToken(c.Context(), user.ID, newTokenHash, expiresAt); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+	end := h.sessionEnd(started)
+	if end != nil && end.Before(expiresAt) {
+		expiresAt = *end
+	}
+	client, clientVersion := middleware.Client(c)
+	if err := h.db.SaveRefreshToken(c.UserContext(), user.ID, tokenHash, expiresAt, started, twoFactor, client, clientVersion); err != nil {
+		return models.AuthResponse{}, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to save refresh token",
 		})
 	}
 
-	return c.JSON(models.AuthResponse{
-		AccessToken:  accessToken,
-		RefreshToken: newRefreshToken,
-		ExpiresIn:    h.cfg.JWTAccessExpiry * 60,
-		User:         user,
-	})
+	return models.AuthResponse{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		ExpiresIn:        h.cfg.JWTAccessExpiry * 60,
+		User:             user,
+		RefreshExpiresAt: expiresAt,
+		SessionExpiresAt: end,
+	}, true, nil
+}
+
+// sessionEnd returns when a session that signed in at started ends however
+// often it is refreshed, or nil when sessions aren't capped
+func (h *AuthHandler) sessionEnd(started time.Time) *time.Time {
+	if h.cfg.SessionMaxAge <= 0 {
+		return nil
+	}
+	end := started.AddDate(0, 0, h.cfg.SessionMaxAge)
+	return &end
 }
 
 // Logout invalidates the refresh token
@@ -258,13 +329,38 @@ func (h *AuthHandler) Logout(c *fiber.Ctx) error {
 
 	// Delete refresh token
 	tokenHash := h.auth.HashRefreshToken(req.RefreshToken)
-	h.db.DeleteRefreshToken(c.Context(), tokenHash)
+	h.db.DeleteRefreshToken(c.UserContext(), tokenHash)
 
 	return c.JSON(models.SuccessResponse{
 		Message: "logged out successfully",
 	})
 }
 
+// ListSessions lists the current user's signed-in sessions, with when each
+// one's refresh token and the session itself expire
+func (h *AuthHandler) ListSessions(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	sessions, err := h.db.GetUserSessions(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch sessions",
+		})
+	}
+	for i := range sessions {
+		sessions[i].SessionExpiresAt = h.sessionEnd(sessions[i].StartedAt)
+	}
+
+	return c.JSON(fiber.Map{
+		"sessions": sessions,
+	})
+}
+
 // Me returns the current user's information
 func (h *AuthHandler) Me(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
@@ -274,7 +370,7 @@ func (h *AuthHandler) Me(c *fiber.Ctx) error {
 		})
 	}
 
-	user, err := h.db.GetUserByID(c.Context(), userID)
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
 	if err != nil || user == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "user not found",
@@ -282,38 +378,84 @@ func (h *AuthHandler) Me(c *fiber.Ctx) error {
 	}
 
 	// Get subscription
-	subscription, _ := h.db.GetSubscription(c.Context(), userID)
+	subscription, _ := h.db.GetSubscription(c.UserContext(), userID)
 
-	// Get usage stats
-	monthlyUsage, _ := h.db.GetMonthlyUsage(c.Context(), userID)
-	activeTorrents, _ := h.db.CountActiveTorrents(c.Context(), userID)
+	unread, _ := h.db.CountUnreadNotifications(c.UserContext(), userID)
 
 	type MeResponse struct {
-		User         *models.User         `json:"user"`
-		Subscription *models.Subscription `json:"subscription"`
-		Usage        models.UsageStats    `json:"usage"`
+		User                *models.User          `json:"user"`
+		Subscription        *models.Subscription  `json:"subscription"`
+		Usage               models.UsageStats     `json:"usage"`
+		UnreadNotifications int                   `json:"unread_notifications"`
+		Transfers           torrent.UserAggregate `json:"transfers"`
 	}
 
-	usedGB := float64(monthlyUsage) / (1024 * 1024 * 1024)
-	limitGB := 2
-	concurrentLimit := 1
-	plan := "free"
-	
+	return c.JSON(MeResponse{
+		User:                user,
+		Subscription:        subscription,
+		Usage:               userUsage(c.UserContext(), h.db, userID, subscription),
+		UnreadNotifications: unread,
+		Transfers:           h.engine.GetUserAggregate(userID),
+	})
+}
+
+// userUsage returns the user's usage over the current period, against the
+// limits adding a torrent is checked against, so the dashboard agrees with
+// the quota checks
+func userUsage(ctx context.Context, db *database.Database, userID uuid.UUID, subscription *models.Subscription) models.UsageStats {
+	period := models.CurrentUsagePeriod(subscription, time.Now())
+	monthlyUsage, _ := db.GetMonthlyUsage(ctx, userID, period)
+	monthlyUpload, _ := db.GetMonthlyUpload(ctx, userID, period)
+	monthlyServed, _ := db.GetMonthlyServed(ctx, userID, period)
+	activeTorrents, _ := db.CountActiveTorrents(ctx, userID)
+	storage, _ := db.GetStorageUsage(ctx, userID)
+
+	limits := UserPlanLimits(ctx, db, userID)
+	usage := models.NewUsageStats(monthlyUsage, monthlyUpload, monthlyServed, limits.DownloadLimitGB, storage, limits.StorageLimitGB)
+	usage.ActiveTorrents = activeTorrents
+	usage.ConcurrentLimit = limits.ConcurrentLimit
+	usage.Plan = "free"
 	if subscription != nil {
-		limitGB = subscription.DownloadLimitGB
-		concurrentLimit = subscription.ConcurrentLimit
-		plan = subscription.Plan
+		usage.Plan = subscription.Plan
 	}
+	usage.UsagePeriod = period
 
-	return c.JSON(MeResponse{
-		User:         user,
-		Subscription: subscription,
-		Usage: models.UsageStats{
-			UsedGB:          usedGB,
-			LimitGB:         limitGB,
-			ActiveTorrents:  activeTorrents,
-			ConcurrentLimit: concurrentLimit,
-			Plan:            plan,
-		},
-	})
+	return usage
+}
+
+// UpdateMe changes the current user's settings
+func (h *AuthHandler) UpdateMe(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var req models.UserSettings
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if req.Timezone != nil && !validTimezone(*req.Timezone) {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "unknown timezone",
+			Code:  "INVALID_TIMEZONE",
+		})
+	}
+
+	if err := h.db.UpdateUserSettings(c.UserContext(), userID, req); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to update settings",
+		})
+	}
+
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "user not found",
+		})
+	}
+	return c.JSON(user)
 }
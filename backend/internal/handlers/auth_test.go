@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestSessionEnd(t *testing.T) {
+	started := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		maxAge int
+		want   *time.Time
+	}{
+		{0, nil},
+		{-1, nil},
+		{1, ptr(time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC))},
+		{90, ptr(time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))},
+	}
+	for _, tt := range tests {
+		h := &AuthHandler{cfg: &config.Config{SessionMaxAge: tt.maxAge}}
+		got := h.sessionEnd(started)
+		if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(*tt.want)) {
+			t.Errorf("SessionMaxAge %d: sessionEnd = %v, want %v", tt.maxAge, got, tt.want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// TestRefreshRotationChain follows one session through several refreshes
+// against TEST_DATABASE_URL: the session's start and end carry over, each
+// refresh token is single use and capped at the session's end, and a
+// session past its end can't refresh
+func TestRefreshRotationChain(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := database.New(url, false)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	cfg := &config.Config{
+		JWTSecret:        "test-secret",
+		JWTAccessExpiry:  15,
+		JWTRefreshExpiry: 7,
+		SessionMaxAge:    3,
+		RegistrationMode: config.RegistrationOpen,
+	}
+	h := NewAuthHandler(db, auth.NewAuthService(cfg), cfg, nil, hooks.New(hooks.Commands{}, time.Second))
+	app := fiber.New()
+	app.Post("/register", h.Register)
+	app.Post("/refresh", h.Refresh)
+
+	post := func(path string, body any, wantStatus int) models.AuthResponse {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("POST %s: status %d, want %d", path, resp.StatusCode, wantStatus)
+		}
+		var out models.AuthResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+	refresh := func(token string, wantStatus int) models.AuthResponse {
+		t.Helper()
+		return post("/refresh", map[string]string{"refresh_token": token}, wantStatus)
+	}
+
+	first := post("/register", models.RegisterRequest{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "rotation-Test-1",
+	}, http.StatusCreated)
+	if first.SessionExpiresAt == nil {
+		t.Fatal("registration has no session expiry")
+	}
+	sessionEnd := *first.SessionExpiresAt
+
+	token := first.RefreshToken
+	for i := 0; i < 3; i++ {
+		next := refresh(token, http.StatusOK)
+		if next.SessionExpiresAt == nil || !next.SessionExpiresAt.Equal(sessionEnd) {
+			t.Fatalf("refresh %d: session expiry %v, want %v", i, next.SessionExpiresAt, sessionEnd)
+		}
+		if next.RefreshExpiresAt.After(sessionEnd) {
+			t.Fatalf("refresh %d: refresh token expires %v, after the session's end %v", i, next.RefreshExpiresAt, sessionEnd)
+		}
+		// Rotated: the old token is gone
+		refresh(token, http.StatusUnauthorized)
+		token = next.RefreshToken
+	}
+
+	// The session signed in longer ago than its cap
+	_, err = pool.Exec(context.Background(),
+		`UPDATE refresh_tokens SET session_started_at = NOW() - INTERVAL '4 days' WHERE user_id = $1`,
+		first.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh(token, http.StatusUnauthorized)
+	// and its token was dropped
+	refresh(token, http.StatusUnauthorized)
+}
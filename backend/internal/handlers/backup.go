@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"bufio"
+	"log"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/backup"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Backup streams a backup of the application state as a tar. It holds
+// password hashes and Stripe customer IDs, so store it like a database
+// dump. Restore it with `ctl restore`.
+func (h *AdminHandler) Backup(c *fiber.Ctx) error {
+	snap, err := backup.Export(c.UserContext(), h.db)
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to export data",
+		})
+	}
+
+	name := "ct-saas-backup-" + snap.Manifest.CreatedAt.Format("20060102-150405") + ".tar"
+	c.Set("Content-Disposition", attachmentDisposition(name))
+	c.Set("Content-Type", "application/x-tar")
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer snap.Close()
+		start := time.Now()
+		err := snap.WriteTar(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("Backup download stopped: %v", err)
+			return
+		}
+		log.Printf("Backup %s sent in %s", name, time.Since(start).Round(time.Millisecond))
+	}))
+	return nil
+}
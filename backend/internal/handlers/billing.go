@@ -1,14 +1,23 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/freetorrent/freetorrent/internal/config"
 	"github.com/freetorrent/freetorrent/internal/database"
 	"github.com/freetorrent/freetorrent/internal/middleware"
 	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/notify"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v76"
 	portalsession "github.com/stripe/stripe-go/v76/billingportal/session"
 	checkoutsession "github.com/stripe/stripe-go/v76/checkout/session"
@@ -16,28 +25,94 @@ import (
 	"github.com/stripe/stripe-go/v76/webhook"
 )
 
-// Stripe Price IDs (set these in production via environment variables)
-var stripePriceIDs = map[string]string{
-	"starter":   "price_starter_monthly",   // Replace with actual Stripe price ID
-	"pro":       "price_pro_monthly",       // Replace with actual Stripe price ID
-	"unlimited": "price_unlimited_monthly", // Replace with actual Stripe price ID
+// maxRedirectURLLength caps the URLs Stripe sends users back to
+const maxRedirectURLLength = 2048
+
+const (
+	// WebhookMaxBody bounds Stripe webhook payloads, which are a few KB
+	WebhookMaxBody = 64 * 1024
+
+	// webhookTolerance is how long after Stripe signs a webhook we accept
+	// it; older deliveries are treated as replays
+	webhookTolerance = 5 * time.Minute
+)
+
+// errInvalidEventData is returned for events whose data doesn't decode
+var errInvalidEventData = errors.New("invalid event data")
+
+// webhookProcessor applies verified Stripe events. BillingHandler is the
+// real one; dispatchWebhookEvent only needs this, so event handling can be
+// exercised without signed payloads.
+type webhookProcessor interface {
+	handleCheckoutCompleted(sess *stripe.CheckoutSession)
+	handleSubscriptionUpdated(ctx context.Context, eventID string, sub *stripe.Subscription)
+	handleSubscriptionCanceled(ctx context.Context, eventID string, sub *stripe.Subscription)
+	handlePaymentFailed(ctx context.Context, inv *stripe.Invoice)
 }
 
 type BillingHandler struct {
-	db  *database.Database
-	cfg *config.Config
+	db       *database.Database
+	cfg      *config.Config
+	notifier *notify.Notifier
+
+	redirectOrigins []string // where checkout and the portal may return to
 }
 
-func NewBillingHandler(db *database.Database, cfg *config.Config) *BillingHandler {
-	if cfg.StripeSecretKey != "" {
+func NewBillingHandler(db *database.Database, cfg *config.Config, notifier *notify.Notifier) *BillingHandler {
+	if cfg.Capabilities().Billing {
 		stripe.Key = cfg.StripeSecretKey
 	}
 	return &BillingHandler{
-		db:  db,
-		cfg: cfg,
+		db:       db,
+		cfg:      cfg,
+		notifier: notifier,
+
+		redirectOrigins: cfg.RedirectOrigins(),
 	}
 }
 
+// validRedirectURL reports whether raw is an absolute http(s) URL on one of
+// origins, https only when requireHTTPS is set. Relative and
+// protocol-relative URLs, other schemes and URLs with userinfo are rejected
+// so checkout can't be used as an open redirect.
+func validRedirectURL(raw string, origins []string, requireHTTPS bool) bool {
+	if raw == "" || len(raw) > maxRedirectURLLength {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Opaque != "" || u.User != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "https" && (scheme != "http" || requireHTTPS) {
+		return false
+	}
+
+	origin := scheme + "://" + strings.ToLower(u.Host)
+	for _, allowed := range origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirectURLs responds with 400 INVALID_REDIRECT and returns false
+// unless every URL is one billing may redirect to
+func (h *BillingHandler) checkRedirectURLs(c *fiber.Ctx, urls ...string) (bool, error) {
+	requireHTTPS := h.cfg.Environment == "production"
+	for _, raw := range urls {
+		if !validRedirectURL(raw, h.redirectOrigins, requireHTTPS) {
+			return false, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "redirect URL is not allowed",
+				Code:    "INVALID_REDIRECT",
+				Details: fmt.Sprintf("must be an absolute URL on %s", strings.Join(h.redirectOrigins, ", ")),
+			})
+		}
+	}
+	return true, nil
+}
+
 // GetSubscription returns the current user's subscription
 func (h *BillingHandler) GetSubscription(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
@@ -47,48 +122,100 @@ func (h *BillingHandler) GetSubscription(c *fiber.Ctx) error {
 		})
 	}
 
-	sub, err := h.db.GetSubscription(c.Context(), userID)
+	sub, err := h.db.GetSubscription(c.UserContext(), userID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to get subscription",
 		})
 	}
 
-	// Handle nil subscription
-	if sub == nil {
-		return c.JSON(fiber.Map{
-			"subscription": nil,
-			"usage": models.UsageStats{
-				UsedGB:          0,
-				LimitGB:         2,
-				ActiveTorrents:  0,
-				ConcurrentLimit: 1,
-				Plan:            "free",
-			},
-			"plans": models.Plans,
-		})
+	// Get usage stats, against the limits adding a torrent is checked
+	// against
+	period := models.CurrentUsagePeriod(sub, time.Now())
+	monthlyUsage, _ := h.db.GetMonthlyUsage(c.UserContext(), userID, period)
+	monthlyUpload, _ := h.db.GetMonthlyUpload(c.UserContext(), userID, period)
+	monthlyServed, _ := h.db.GetMonthlyServed(c.UserContext(), userID, period)
+	activeTorrents, _ := h.db.CountActiveTorrents(c.UserContext(), userID)
+	storage, _ := h.db.GetStorageUsage(c.UserContext(), userID)
+	limits := UserPlanLimits(c.UserContext(), h.db, userID)
+
+	usage := models.NewUsageStats(monthlyUsage, monthlyUpload, monthlyServed, limits.DownloadLimitGB, storage, limits.StorageLimitGB)
+	usage.ActiveTorrents = activeTorrents
+	usage.ConcurrentLimit = limits.ConcurrentLimit
+	usage.Plan = "free"
+	if sub != nil {
+		usage.Plan = sub.Plan
 	}
-
-	// Get usage stats
-	monthlyUsage, _ := h.db.GetMonthlyUsage(c.Context(), userID)
-	activeTorrents, _ := h.db.CountActiveTorrents(c.Context(), userID)
+	usage.UsagePeriod = period
 
 	return c.JSON(fiber.Map{
 		"subscription": sub,
-		"usage": models.UsageStats{
-			UsedGB:          float64(monthlyUsage) / (1024 * 1024 * 1024),
-			LimitGB:         sub.DownloadLimitGB,
-			ActiveTorrents:  activeTorrents,
-			ConcurrentLimit: sub.ConcurrentLimit,
-			Plan:            sub.Plan,
-		},
-		"plans": models.Plans,
+		"usage":        usage,
+		"plans":        planLimitsByName(c.UserContext(), h.db),
 	})
 }
 
+// GetSubscriptionHistory returns a page of the current user's plan and
+// status changes, without who made them or why
+func (h *BillingHandler) GetSubscriptionHistory(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	return subscriptionHistoryPage(c, h.db, userID, false)
+}
+
+// subscriptionHistoryPage responds with one page of userID's subscription
+// changes, with the actor's ID and email and the reason only when full.
+// Pages are keyed by created_at: before= takes the previous page's
+// next_before.
+func subscriptionHistoryPage(c *fiber.Ctx, db *database.Database, userID uuid.UUID, full bool) error {
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var before *time.Time
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid before",
+				Details: "expected an RFC 3339 timestamp",
+			})
+		}
+		before = &t
+	}
+
+	events, err := db.GetSubscriptionEvents(c.UserContext(), userID, before, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch subscription history",
+		})
+	}
+
+	resp := models.SubscriptionHistoryResponse{Events: events}
+	if resp.Events == nil {
+		resp.Events = []models.SubscriptionEvent{}
+	}
+	if len(events) == limit {
+		resp.NextBefore = &events[len(events)-1].CreatedAt
+	}
+	if !full {
+		for i := range resp.Events {
+			e := &resp.Events[i]
+			e.ActorID, e.ActorEmail, e.Reason = nil, "", ""
+		}
+	}
+	return c.JSON(resp)
+}
+
 // CreateCheckoutSession creates a Stripe checkout session for subscription
 func (h *BillingHandler) CreateCheckoutSession(c *fiber.Ctx) error {
-	if h.cfg.StripeSecretKey == "" {
+	if !h.cfg.Capabilities().Billing {
 		return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
 			Error: "billing not configured",
 		})
@@ -115,15 +242,25 @@ func (h *BillingHandler) CreateCheckoutSession(c *fiber.Ctx) error {
 	}
 
 	// Validate plan
-	priceID, ok := stripePriceIDs[req.Plan]
-	if !ok || req.Plan == "free" {
+	plans, err := h.db.GetPlans(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch plans",
+		})
+	}
+	plan, ok := plans[req.Plan]
+	if !ok || req.Plan == "free" || plan.StripePriceID == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
 			Error: "invalid plan",
 		})
 	}
 
+	if ok, err := h.checkRedirectURLs(c, req.SuccessURL, req.CancelURL); !ok {
+		return err
+	}
+
 	// Get user
-	user, err := h.db.GetUserByID(c.Context(), userID)
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
 	if err != nil || user == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "user not found",
@@ -150,7 +287,10 @@ func (h *BillingHandler) CreateCheckoutSession(c *fiber.Ctx) error {
 			})
 		}
 		customerID = cust.ID
-		// TODO: Save customer ID to database
+		// Subscription webhooks find the user by this ID
+		if err := h.db.SetUserStripeCustomerID(c.UserContext(), userID, customerID); err != nil {
+			log.Printf("Failed to save Stripe customer ID: %v", err)
+		}
 	}
 
 	// Create checkout session
@@ -159,7 +299,7 @@ func (h *BillingHandler) CreateCheckoutSession(c *fiber.Ctx) error {
 		Mode:     stripe.String(string(stripe.CheckoutSessionModeSubscription)),
 		LineItems: []*stripe.CheckoutSessionLineItemParams{
 			{
-				Price:    stripe.String(priceID),
+				Price:    plan.StripePriceID,
 				Quantity: stripe.Int64(1),
 			},
 		},
@@ -187,7 +327,7 @@ func (h *BillingHandler) CreateCheckoutSession(c *fiber.Ctx) error {
 
 // CreatePortalSession creates a Stripe billing portal session
 func (h *BillingHandler) CreatePortalSession(c *fiber.Ctx) error {
-	if h.cfg.StripeSecretKey == "" {
+	if !h.cfg.Capabilities().Billing {
 		return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
 			Error: "billing not configured",
 		})
@@ -200,7 +340,7 @@ func (h *BillingHandler) CreatePortalSession(c *fiber.Ctx) error {
 		})
 	}
 
-	user, err := h.db.GetUserByID(c.Context(), userID)
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
 	if err != nil || user == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "user not found",
@@ -218,8 +358,18 @@ func (h *BillingHandler) CreatePortalSession(c *fiber.Ctx) error {
 	}
 
 	var req PortalRequest
-	if err := c.BodyParser(&req); err != nil {
-		req.ReturnURL = "/"
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid request",
+			})
+		}
+	}
+	if req.ReturnURL == "" {
+		req.ReturnURL = h.cfg.FrontendURL + "/dashboard/settings"
+	}
+	if ok, err := h.checkRedirectURLs(c, req.ReturnURL); !ok {
+		return err
 	}
 
 	params := &stripe.BillingPortalSessionParams{
@@ -251,53 +401,68 @@ func (h *BillingHandler) HandleWebhook(c *fiber.Ctx) error {
 	payload := c.Body()
 	sigHeader := c.Get("Stripe-Signature")
 
-	event, err := webhook.ConstructEvent(payload, sigHeader, h.cfg.StripeWebhookKey)
+	event, err := constructWebhookEvent(payload, sigHeader, h.cfg.StripeWebhookKey)
 	if err != nil {
-		log.Printf("Webhook signature verification failed: %v", err)
+		if errors.Is(err, webhook.ErrTooOld) {
+			log.Printf("Webhook rejected as a possible replay: signed more than %s ago", webhookTolerance)
+		} else {
+			log.Printf("Webhook signature verification failed: %v", err)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
 			Error: "invalid signature",
 		})
 	}
 
+	if err := dispatchWebhookEvent(c.UserContext(), h, event); err != nil {
+		log.Printf("Webhook %s (%s) not handled: %v", event.ID, event.Type, err)
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid event data",
+		})
+	}
+
+	return c.JSON(fiber.Map{"received": true})
+}
+
+// constructWebhookEvent verifies a webhook's signature and decodes it,
+// refusing with webhook.ErrTooOld deliveries signed over webhookTolerance ago
+func constructWebhookEvent(payload []byte, sigHeader, secret string) (stripe.Event, error) {
+	return webhook.ConstructEventWithOptions(payload, sigHeader, secret,
+		webhook.ConstructEventOptions{Tolerance: webhookTolerance})
+}
+
+// dispatchWebhookEvent decodes a verified event and passes it to p. Event
+// types we don't handle are ignored.
+func dispatchWebhookEvent(ctx context.Context, p webhookProcessor, event stripe.Event) error {
 	switch event.Type {
 	case "checkout.session.completed":
 		var sess stripe.CheckoutSession
 		if err := json.Unmarshal(event.Data.Raw, &sess); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error: "invalid event data",
-			})
+			return errInvalidEventData
 		}
-		h.handleCheckoutCompleted(&sess)
+		p.handleCheckoutCompleted(&sess)
 
 	case "customer.subscription.created", "customer.subscription.updated":
 		var sub stripe.Subscription
 		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error: "invalid event data",
-			})
+			return errInvalidEventData
 		}
-		h.handleSubscriptionUpdated(&sub)
+		p.handleSubscriptionUpdated(ctx, event.ID, &sub)
 
 	case "customer.subscription.deleted":
 		var sub stripe.Subscription
 		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error: "invalid event data",
-			})
+			return errInvalidEventData
 		}
-		h.handleSubscriptionCanceled(&sub)
+		p.handleSubscriptionCanceled(ctx, event.ID, &sub)
 
 	case "invoice.payment_failed":
 		var inv stripe.Invoice
 		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error: "invalid event data",
-			})
+			return errInvalidEventData
 		}
-		h.handlePaymentFailed(&inv)
+		p.handlePaymentFailed(ctx, &inv)
 	}
-
-	return c.JSON(fiber.Map{"received": true})
+	return nil
 }
 
 func (h *BillingHandler) handleCheckoutCompleted(sess *stripe.CheckoutSession) {
@@ -305,16 +470,21 @@ func (h *BillingHandler) handleCheckoutCompleted(sess *stripe.CheckoutSession) {
 	// The subscription webhook will handle the actual update
 }
 
-func (h *BillingHandler) handleSubscriptionUpdated(sub *stripe.Subscription) {
+func (h *BillingHandler) handleSubscriptionUpdated(ctx context.Context, eventID string, sub *stripe.Subscription) {
 	log.Printf("Subscription updated: %s, status: %s", sub.ID, sub.Status)
 
 	// Determine plan from price ID
 	plan := "free"
 	if len(sub.Items.Data) > 0 {
 		priceID := sub.Items.Data[0].Price.ID
-		for p, id := range stripePriceIDs {
-			if id == priceID {
-				plan = p
+		plans, err := h.db.GetPlans(ctx)
+		if err != nil {
+			log.Printf("Failed to load plans for subscription %s: %v", sub.ID, err)
+			return
+		}
+		for name, p := range plans {
+			if p.StripePriceID != nil && *p.StripePriceID == priceID {
+				plan = name
 				break
 			}
 		}
@@ -334,18 +504,111 @@ func (h *BillingHandler) handleSubscriptionUpdated(sub *stripe.Subscription) {
 	}
 
 	log.Printf("Plan: %s, Status: %s", plan, status)
-	
-	// TODO: Find user by Stripe customer ID and update subscription
-	// This requires adding h.db.GetUserByStripeCustomerID() method
-	// Then call h.db.UpdateSubscription(ctx, userID, plan, status, models.Plans[plan])
+
+	h.applyWebhookPlan(ctx, eventID, sub, plan, status)
 }
 
-func (h *BillingHandler) handleSubscriptionCanceled(sub *stripe.Subscription) {
+func (h *BillingHandler) handleSubscriptionCanceled(ctx context.Context, eventID string, sub *stripe.Subscription) {
 	log.Printf("Subscription canceled: %s", sub.ID)
-	// TODO: Downgrade user to free plan
+	h.applyWebhookPlan(ctx, eventID, sub, "free", "canceled")
 }
 
-func (h *BillingHandler) handlePaymentFailed(inv *stripe.Invoice) {
+// applyWebhookPlan applies a plan change to the user owning the subscription's
+// Stripe customer, giving the event as the reason for it
+func (h *BillingHandler) applyWebhookPlan(ctx context.Context, eventID string, sub *stripe.Subscription, plan, status string) {
+	if sub.Customer == nil {
+		log.Printf("Subscription %s has no customer", sub.ID)
+		return
+	}
+	user, err := h.db.GetUserByStripeCustomerID(ctx, sub.Customer.ID)
+	if err != nil || user == nil {
+		log.Printf("No user for Stripe customer %s: %v", sub.Customer.ID, err)
+		return
+	}
+	actor := models.SubscriptionActor{Type: models.SubscriptionActorStripe, Reason: eventID}
+	if err := ApplySubscription(ctx, h.db, user.ID, plan, status, actor); err != nil {
+		log.Printf("Failed to update subscription for %s: %v", user.ID, err)
+		return
+	}
+
+	// Usage is metered over the billing period while the user pays
+	subID := ""
+	var start, end *time.Time
+	if plan != "free" && sub.CurrentPeriodStart > 0 && sub.CurrentPeriodEnd > 0 {
+		subID = sub.ID
+		s, e := time.Unix(sub.CurrentPeriodStart, 0), time.Unix(sub.CurrentPeriodEnd, 0)
+		start, end = &s, &e
+	}
+	if err := h.db.SetSubscriptionPeriod(ctx, user.ID, subID, start, end); err != nil {
+		log.Printf("Failed to update billing period for %s: %v", user.ID, err)
+	}
+}
+
+// ApplySubscription moves a user to a plan, records the change in their
+// subscription history as made by actor and a plan change in their
+// activity, and extends the expiry of their completed torrents if the plan
+// retains data longer. Every path that changes a subscription goes through
+// here.
+func ApplySubscription(ctx context.Context, db *database.Database, userID uuid.UUID, plan, status string, actor models.SubscriptionActor) error {
+	limits, ok := db.GetPlanLimits(ctx, plan)
+	if !ok {
+		return fmt.Errorf("unknown plan %q", plan)
+	}
+	previous, err := db.GetSubscription(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := db.UpdateSubscription(ctx, userID, plan, status, limits, actor); err != nil {
+		return err
+	}
+	if previous == nil || previous.Plan != plan {
+		previousPlan := ""
+		if previous != nil {
+			previousPlan = previous.Plan
+		}
+		if err := db.LogPlanChanged(ctx, userID, plan, previousPlan); err != nil {
+			log.Printf("Failed to log plan change for %s: %v", userID, err)
+		}
+	}
+
+	n, err := db.UpdateExpiriesForUser(ctx, userID, limits.RetentionDays)
+	if err != nil {
+		return fmt.Errorf("failed to update expiries: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Extended expiry of %d torrents for %s after moving to %s", n, userID, plan)
+	}
+	return nil
+}
+
+// handlePaymentFailed tells the customer's user their payment failed, by
+// email too unless they opted out. Stripe retries the payment and moves the
+// subscription to past_due on its own.
+func (h *BillingHandler) handlePaymentFailed(ctx context.Context, inv *stripe.Invoice) {
+	if inv.Customer == nil {
+		log.Printf("Failed invoice %s has no customer", inv.ID)
+		return
+	}
 	log.Printf("Payment failed for customer %s", inv.Customer.ID)
-	// TODO: Send notification to user, maybe restrict access
+
+	user, err := h.db.GetUserByStripeCustomerID(ctx, inv.Customer.ID)
+	if err != nil || user == nil {
+		log.Printf("No user for Stripe customer %s: %v", inv.Customer.ID, err)
+		return
+	}
+	email := ""
+	if user.EmailNotifications {
+		email = user.Email
+	}
+	err = h.notifier.Notify(ctx, &models.Notification{
+		UserID: user.ID,
+		Type:   models.NotificationPaymentFailed,
+		Title:  "Your plan payment failed",
+		Body: "We couldn't charge your payment method for your subscription. " +
+			"Update it from the billing portal to keep your plan; we'll retry the payment in the meantime.\n",
+		Metadata: map[string]interface{}{"invoice_id": inv.ID},
+	}, email)
+	if err != nil {
+		log.Printf("Failed to record payment failure for user %s: %v", user.ID, err)
+	}
 }
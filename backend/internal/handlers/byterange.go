@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxByteRanges caps how many ranges one request may ask for, so a client
+// can't make us re-read a file many times over in a single response
+const maxByteRanges = 16
+
+var (
+	// errMalformedRange is returned for a Range header that doesn't parse
+	errMalformedRange = errors.New("malformed range")
+	// errUnsatisfiableRange is returned when no requested range overlaps the file
+	errUnsatisfiableRange = errors.New("range not satisfiable")
+)
+
+// byteRange is an inclusive span of a file, as in a Content-Range header
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseByteRanges parses a Range header (RFC 7233) against a file of the
+// given size. Ranges past the end of the file are dropped and ends beyond it
+// are clamped; if nothing is left, errUnsatisfiableRange is returned. Any
+// syntax error, including numbers too large for int64, is errMalformedRange.
+func parseByteRanges(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, errMalformedRange
+	}
+
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxByteRanges {
+		return nil, errMalformedRange
+	}
+
+	var ranges []byteRange
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		first, last, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, errMalformedRange
+		}
+
+		// Suffix range: the last n bytes
+		if first == "" {
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ranges = append(ranges, byteRange{start: size - n, end: size - 1})
+			continue
+		}
+
+		start, err := parseRangeInt(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = parseRangeInt(last); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, errMalformedRange
+			}
+		}
+
+		if start >= size {
+			continue
+		}
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, byteRange{start: start, end: end})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// rangesLength is how many bytes of a file of the given size ranges cover,
+// the whole file when there are none. Overlapping ranges count twice, as
+// they are sent twice.
+func rangesLength(ranges []byteRange, size int64) int64 {
+	if len(ranges) == 0 {
+		return size
+	}
+	var n int64
+	for _, r := range ranges {
+		n += r.length()
+	}
+	return n
+}
+
+// parseRangeInt parses one position of a range spec: plain decimal digits
+// only, so signs, spaces and overflowing values are all malformed
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, errMalformedRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errMalformedRange
+	}
+	return n, nil
+}
+
+// rangeNotSatisfiable answers a Range header parseByteRanges refused with
+// 416, giving the file's size in Content-Range as RFC 7233 asks
+func rangeNotSatisfiable(c *fiber.Ctx, size int64, err error) error {
+	c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+	return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(models.ErrorResponse{
+		Error:   err.Error(),
+		Code:    "RANGE_NOT_SATISFIABLE",
+		Details: fmt.Sprintf("the file is %d bytes", size),
+	})
+}
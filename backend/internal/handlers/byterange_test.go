@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParseByteRanges(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-499", []byteRange{{0, 499}}, nil},
+		{"bytes=500-", []byteRange{{500, 999}}, nil},
+		{"bytes=900-5000", []byteRange{{900, 999}}, nil},
+		{"bytes=0-0, 10-19", []byteRange{{0, 0}, {10, 19}}, nil},
+
+		// Suffix ranges
+		{"bytes=-100", []byteRange{{900, 999}}, nil},
+		{"bytes=-5000", []byteRange{{0, 999}}, nil},
+		{"bytes=-0", nil, errUnsatisfiableRange},
+
+		// Unsatisfiable: nothing overlaps the file
+		{"bytes=1000-", nil, errUnsatisfiableRange},
+		{"bytes=1000-2000, 5000-", nil, errUnsatisfiableRange},
+		{"bytes=1000-2000, 0-9", []byteRange{{0, 9}}, nil},
+
+		// Malformed
+		{"", nil, errMalformedRange},
+		{"items=0-9", nil, errMalformedRange},
+		{"bytes=", nil, errMalformedRange},
+		{"bytes=5", nil, errMalformedRange},
+		{"bytes=9-5", nil, errMalformedRange},
+		{"bytes=-", nil, errMalformedRange},
+		{"bytes=+1-5", nil, errMalformedRange},
+		{"bytes=1- 5", nil, errMalformedRange},
+		{"bytes=0x10-20", nil, errMalformedRange},
+
+		// Overflowing int64
+		{"bytes=0-9223372036854775808", nil, errMalformedRange},
+		{"bytes=9223372036854775808-", nil, errMalformedRange},
+		{"bytes=-99999999999999999999", nil, errMalformedRange},
+		{"bytes=0-9223372036854775807", []byteRange{{0, 999}}, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseByteRanges(tt.header, size)
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseByteRanges(%q) = %v, %v; want %v, %v", tt.header, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseByteRangesLimit(t *testing.T) {
+	specs := make([]string, maxByteRanges+1)
+	for i := range specs {
+		specs[i] = strconv.Itoa(i) + "-" + strconv.Itoa(i)
+	}
+
+	ranges, err := parseByteRanges("bytes="+strings.Join(specs[:maxByteRanges], ","), 1000)
+	if err != nil || len(ranges) != maxByteRanges {
+		t.Errorf("%d ranges: got %d, %v", maxByteRanges, len(ranges), err)
+	}
+	if _, err := parseByteRanges("bytes="+strings.Join(specs, ","), 1000); !errors.Is(err, errMalformedRange) {
+		t.Errorf("%d ranges: err = %v, want errMalformedRange", len(specs), err)
+	}
+}
+
+func TestParseByteRangesEmptyFile(t *testing.T) {
+	for _, header := range []string{"bytes=0-", "bytes=-10"} {
+		if _, err := parseByteRanges(header, 0); !errors.Is(err, errUnsatisfiableRange) {
+			t.Errorf("parseByteRanges(%q) on an empty file: err = %v, want errUnsatisfiableRange", header, err)
+		}
+	}
+}
+
+func TestRangesLength(t *testing.T) {
+	if n := rangesLength(nil, 1000); n != 1000 {
+		t.Errorf("no ranges: %d, want the whole file", n)
+	}
+	if n := rangesLength([]byteRange{{0, 9}, {5, 14}}, 1000); n != 20 {
+		t.Errorf("overlapping ranges: %d, want 20", n)
+	}
+}
+
+// TestRangeNotSatisfiable answers a range past the end of a file with the
+// standard JSON error and the file's size in Content-Range
+func TestRangeNotSatisfiable(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		_, err := parseByteRanges(c.Get(fiber.HeaderRange), 1000)
+		return rangeNotSatisfiable(c, 1000, err)
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=5000-")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != fiber.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("status = %d, want 416", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes */1000" {
+		t.Errorf("Content-Range = %q, want bytes */1000", got)
+	}
+	var body models.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("body isn't an error response: %v", err)
+	}
+	if body.Code != "RANGE_NOT_SATISFIABLE" || body.Error != errUnsatisfiableRange.Error() {
+		t.Errorf("body = %+v", body)
+	}
+}
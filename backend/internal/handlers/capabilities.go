@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/gofiber/fiber/v2"
+)
+
+// capabilitiesMaxAge is how long clients and proxies may cache capabilities;
+// features only change on restart, and plans rarely
+const capabilitiesMaxAge = "public, max-age=300"
+
+// CapabilitiesHandler tells clients what this deployment supports, so they
+// needn't probe endpoints for 503s
+type CapabilitiesHandler struct {
+	caps   config.Capabilities
+	db     *database.Database
+	engine torrent.Service
+}
+
+func NewCapabilitiesHandler(cfg *config.Config, db *database.Database, engine torrent.Service) *CapabilitiesHandler {
+	return &CapabilitiesHandler{
+		caps:   cfg.Capabilities(),
+		db:     db,
+		engine: engine,
+	}
+}
+
+// GetCapabilities returns the enabled features and the plans table.
+// port_unreachable is set when the last port check found the BitTorrent
+// port closed, so the UI can warn self-hosters to forward it, and
+// torrents_disabled while the torrent engine is down or refusing torrents
+// after a disk write error, which isn't cached.
+func (h *CapabilitiesHandler) GetCapabilities(c *fiber.Ctx) error {
+	disabled := !h.engine.Available() || h.engine.DiskError() != nil
+	if disabled {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+	} else {
+		c.Set(fiber.HeaderCacheControl, capabilitiesMaxAge)
+	}
+	check := h.engine.LastPortCheck()
+	return c.JSON(struct {
+		config.Capabilities
+		PortUnreachable  bool                         `json:"port_unreachable,omitempty"`
+		TorrentsDisabled bool                         `json:"torrents_disabled,omitempty"`
+		Plans            map[string]models.PlanLimits `json:"plans"`
+	}{h.caps, check != nil && check.Status == torrent.PortClosed, disabled, planLimitsByName(c.UserContext(), h.db)})
+}
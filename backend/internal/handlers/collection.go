@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+// CollectionHandler manages collections, named groups of a user's torrents
+type CollectionHandler struct {
+	db     *database.Database
+	engine torrent.Service
+	hooks  hooks.Hooks
+}
+
+func NewCollectionHandler(db *database.Database, engine torrent.Service, h hooks.Hooks) *CollectionHandler {
+	return &CollectionHandler{
+		db:     db,
+		engine: engine,
+		hooks:  h,
+	}
+}
+
+type collectionRequest struct {
+	Name string `json:"name"`
+}
+
+// ListCollections returns the user's collections
+func (h *CollectionHandler) ListCollections(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	collections, err := h.db.GetCollectionsByUser(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch collections",
+		})
+	}
+	if collections == nil {
+		collections = []models.Collection{}
+	}
+
+	return c.JSON(fiber.Map{
+		"collections": collections,
+	})
+}
+
+// CreateCollection creates an empty collection
+func (h *CollectionHandler) CreateCollection(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	name, ok, err := parseCollectionName(c)
+	if !ok {
+		return err
+	}
+
+	collection, err := h.db.CreateCollection(c.UserContext(), userID, name)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create collection",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(collection)
+}
+
+// GetCollection returns a collection with its member torrents
+func (h *CollectionHandler) GetCollection(c *fiber.Ctx) error {
+	collection, err := h.ownedCollection(c)
+	if collection == nil {
+		return err
+	}
+
+	torrents, err := h.db.GetCollectionTorrents(c.UserContext(), collection.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrents",
+		})
+	}
+	for i := range torrents {
+		if status, err := h.engine.GetTorrentStatus(torrents[i].InfoHash); err == nil {
+			applyLiveStatus(&torrents[i], status)
+		}
+	}
+	if torrents == nil {
+		torrents = []models.Torrent{}
+	}
+
+	return c.JSON(fiber.Map{
+		"collection": collection,
+		"torrents":   torrents,
+	})
+}
+
+// UpdateCollection renames a collection
+func (h *CollectionHandler) UpdateCollection(c *fiber.Ctx) error {
+	collection, err := h.ownedCollection(c)
+	if collection == nil {
+		return err
+	}
+
+	name, ok, err := parseCollectionName(c)
+	if !ok {
+		return err
+	}
+
+	if err := h.db.RenameCollection(c.UserContext(), collection.ID, name); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to update collection",
+		})
+	}
+	collection.Name = name
+
+	return c.JSON(collection)
+}
+
+// DeleteCollection deletes a collection. Its torrents are kept and ungrouped
+// unless cascade=true, which deletes them (and their files) as well.
+func (h *CollectionHandler) DeleteCollection(c *fiber.Ctx) error {
+	collection, err := h.ownedCollection(c)
+	if collection == nil {
+		return err
+	}
+
+	if c.Query("cascade") == "true" {
+		torrents, err := h.db.GetCollectionTorrents(c.UserContext(), collection.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to fetch torrents",
+			})
+		}
+		for _, t := range torrents {
+			h.engine.RemoveOwner(t.InfoHash, t.ID, true)
+			if err := h.db.DeleteTorrent(c.UserContext(), t.ID, models.ClosedUserDeleted); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+					Error: "failed to delete torrent",
+				})
+			}
+			h.hooks.OnTorrentDeleted(&t, hooks.DeleteReasonUser)
+			if t.InfoHash != "" {
+				if err := h.db.RecordTorrentChurn(c.UserContext(), collection.UserID, t.InfoHash); err != nil {
+					log.Printf("Failed to record churn for %s: %v", t.InfoHash, err)
+				}
+			}
+		}
+	}
+
+	if err := h.db.DeleteCollection(c.UserContext(), collection.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to delete collection",
+		})
+	}
+
+	return c.JSON(models.SuccessResponse{
+		Message: "collection deleted",
+	})
+}
+
+// DownloadCollection streams the completed files of every torrent in the
+// collection as one zip built on the fly. Each torrent's files keep their
+// own paths; torrents whose paths would collide are put under their info
+// hash. Usage is logged with the bytes actually sent once the stream ends.
+func (h *CollectionHandler) DownloadCollection(c *fiber.Ctx) error {
+	collection, err := h.ownedCollection(c)
+	if collection == nil {
+		return err
+	}
+
+	torrents, err := h.db.GetCollectionTorrents(c.UserContext(), collection.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrents",
+		})
+	}
+
+	var entries []torrent.ZipEntry
+	seen := make(map[string]bool)
+	for i := range torrents {
+		t := &torrents[i]
+		if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil {
+			applyLiveStatus(t, status)
+		}
+
+		files := completedFiles(t.Files)
+		prefix := ""
+		for _, f := range files {
+			if seen[f.Path] {
+				prefix = t.InfoHash + "/"
+				break
+			}
+		}
+		for _, f := range files {
+			seen[prefix+f.Path] = true
+			entries = append(entries, torrent.ZipEntry{
+				Path: path.Join(t.InfoHash, f.Path),
+				Name: prefix + f.Path,
+			})
+		}
+	}
+	if len(entries) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "no completed files in collection",
+		})
+	}
+
+	c.Set("Content-Disposition", attachmentDisposition(collection.Name+".zip"))
+	c.Set("Content-Type", "application/zip")
+
+	downloadDir := h.engine.GetDownloadDir()
+	userID := collection.UserID
+	metadata := fiber.Map{"collection_id": collection.ID, "name": collection.Name}
+
+	release := middleware.HoldConcurrencySlot(c)
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer release()
+		written, err := torrent.WriteZip(h.engine.Context(), w, downloadDir, entries)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("Collection download of %s stopped after %d bytes: %v", collection.ID, written, err)
+		}
+
+		ctx, cancel := database.WithTimeout(context.Background())
+		defer cancel()
+		h.db.LogUsage(ctx, userID, "download_started", written, metadata)
+		if written > 0 {
+			h.db.LogUsage(ctx, userID, "download_served", written, metadata)
+		}
+	}))
+	return nil
+}
+
+// ownedCollection loads the :id collection and checks the user owns it.
+// On failure it returns nil and the result of responding.
+func (h *CollectionHandler) ownedCollection(c *fiber.Ctx) (*models.Collection, error) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	collectionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid collection ID",
+		})
+	}
+
+	collection, err := h.db.GetCollection(c.UserContext(), collectionID)
+	if err != nil {
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch collection",
+		})
+	}
+	if collection == nil || collection.UserID != userID {
+		return nil, c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "collection not found",
+		})
+	}
+	return collection, nil
+}
+
+// parseCollectionName reads and validates the name in a collection request.
+// Reports false once it has responded.
+func parseCollectionName(c *fiber.Ctx) (string, bool, error) {
+	var req collectionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return "", false, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 255 {
+		return "", false, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "name must be 1 to 255 characters",
+		})
+	}
+	return name, true, nil
+}
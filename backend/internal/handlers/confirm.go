@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// confirmDestructive gates a destructive action on the caller confirming it.
+// action names what is being destroyed, e.g. "delete_torrent:<id>", and reason
+// why it needs confirming; an empty reason means it doesn't. It returns true
+// when the request may go ahead: nothing to confirm, ?force=true, or a valid
+// X-Confirm-Token for action. Otherwise it has responded: 202 with a fresh
+// token to repeat the request with, or 409 for an unknown or expired token.
+func confirmDestructive(c *fiber.Ctx, db *database.Database, userID uuid.UUID, action, reason string) (bool, error) {
+	if reason == "" || c.Query("force") == "true" {
+		return true, nil
+	}
+
+	if token := c.Get("X-Confirm-Token"); token != "" {
+		ok, err := db.ConsumeConfirmToken(c.UserContext(), userID, token, action)
+		if err != nil {
+			log.Printf("Failed to check confirmation token: %v", err)
+			return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to check confirmation",
+			})
+		}
+		if !ok {
+			return false, c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Error: "confirmation token is invalid or expired; repeat the request without it",
+				Code:  "CONFIRM_TOKEN_INVALID",
+			})
+		}
+		return true, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create confirmation",
+		})
+	}
+	token := hex.EncodeToString(b)
+	if err := db.CreateConfirmToken(c.UserContext(), userID, token, action); err != nil {
+		log.Printf("Failed to store confirmation token: %v", err)
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create confirmation",
+		})
+	}
+
+	return false, c.Status(fiber.StatusAccepted).JSON(models.ConfirmationResponse{
+		Message:      "repeat the request with the X-Confirm-Token header to confirm",
+		Code:         "CONFIRMATION_REQUIRED",
+		Reason:       reason,
+		ConfirmToken: token,
+		ExpiresAt:    time.Now().Add(database.ConfirmTokenTTL),
+	})
+}
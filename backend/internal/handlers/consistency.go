@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ListInconsistencies returns the torrents the last consistency check
+// flagged, with their problems, or streams them (see wantsStream)
+func (h *AdminHandler) ListInconsistencies(c *fiber.Ctx) error {
+	if wantsStream(c) {
+		return streamNDJSON(c, "Consistency report", func(ctx context.Context, emit func(v any) error) error {
+			return h.db.EachInconsistentTorrent(ctx, func(t *models.TorrentInconsistency) error {
+				return emit(t)
+			})
+		})
+	}
+
+	list, err := h.db.GetInconsistentTorrents(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch consistency report",
+		})
+	}
+	if list == nil {
+		list = []models.TorrentInconsistency{}
+	}
+
+	return c.JSON(fiber.Map{
+		"torrents": list,
+	})
+}
+
+// RepairInconsistencies recomputes the downloaded bytes and progress of
+// flagged torrents, all of them or those in torrent_ids, from the engine or
+// the files on disk. A completed torrent found short of data needs
+// redownloading. Uploaded bytes can't be recomputed, so a torrent flagged
+// only for them is skipped and stays in the report.
+func (h *AdminHandler) RepairInconsistencies(c *fiber.Ctx) error {
+	var req struct {
+		TorrentIDs []uuid.UUID `json:"torrent_ids"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid request body",
+			})
+		}
+	}
+
+	ctx := c.UserContext()
+	list, err := h.db.GetInconsistentTorrents(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch consistency report",
+		})
+	}
+
+	repaired := []fiber.Map{}
+	skipped := []fiber.Map{}
+	for _, t := range list {
+		if len(req.TorrentIDs) > 0 && !slices.Contains(req.TorrentIDs, t.TorrentID) {
+			continue
+		}
+		if len(t.Problems) == 1 && t.Problems[0] == models.ProblemUploadedImplausible {
+			skipped = append(skipped, fiber.Map{"torrent_id": t.TorrentID, "reason": "uploaded bytes can't be recomputed"})
+			continue
+		}
+
+		downloaded, source := h.engine.MeasureDownloaded(t.InfoHash, t.Files)
+		if source == "disk" && len(t.Files) == 0 {
+			skipped = append(skipped, fiber.Map{"torrent_id": t.TorrentID, "reason": "no file list to measure on disk"})
+			continue
+		}
+		// Skipped files don't count towards progress
+		wanted := models.WantedSize(t.Files, t.TotalSize)
+		downloaded = max(0, min(downloaded, wanted))
+		var progress float64
+		if wanted > 0 {
+			progress = float64(downloaded) / float64(wanted) * 100
+		}
+
+		status := t.Status
+		if t.Status == models.TorrentStatusCompleted && downloaded < wanted {
+			if err := h.db.SetTorrentNeedsRedownload(ctx, t.TorrentID,
+				"data went missing from disk; retry to download it again"); err != nil {
+				log.Printf("Failed to mark torrent %s for redownload: %v", t.TorrentID, err)
+				skipped = append(skipped, fiber.Map{"torrent_id": t.TorrentID, "reason": "failed to save"})
+				continue
+			}
+			status = models.TorrentStatusNeedsRedownload
+			downloaded, progress = 0, 0
+		}
+		if err := h.db.RepairTorrentSizes(ctx, t.TorrentID, downloaded, progress); err != nil {
+			log.Printf("Failed to repair torrent %s: %v", t.TorrentID, err)
+			skipped = append(skipped, fiber.Map{"torrent_id": t.TorrentID, "reason": "failed to save"})
+			continue
+		}
+
+		repaired = append(repaired, fiber.Map{
+			"torrent_id":      t.TorrentID,
+			"source":          source,
+			"status":          status,
+			"downloaded_size": downloaded,
+			"progress":        progress,
+			"was": fiber.Map{
+				"downloaded_size": t.DownloadedSize,
+				"progress":        t.Progress,
+			},
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"repaired": repaired,
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/uploads"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	maxCreateUploads  = 1000
+	maxCreateTrackers = 20
+	maxCreateComment  = 1024
+)
+
+// createName checks the name of a created torrent, which becomes a file or
+// directory name on disk
+func createName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name is required")
+	case len(name) > 255:
+		return errors.New("name is too long")
+	case strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0):
+		return errors.New("name must not contain path separators")
+	case strings.HasPrefix(name, "."):
+		return errors.New("name must not start with a dot")
+	}
+	return nil
+}
+
+// createTracker checks an announce URL given for a created torrent
+func createTracker(tracker string) error {
+	u, err := url.Parse(tracker)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid tracker URL %q", tracker)
+	}
+	switch u.Scheme {
+	case "http", "https", "udp":
+		return nil
+	}
+	return fmt.Errorf("tracker %q must be http, https or udp", tracker)
+}
+
+// CreateTorrent makes a torrent from the user's completed uploads and seeds
+// it. One upload becomes a single-file torrent named after it, unless a name
+// is given; several become a directory of that name. Seeding your own files
+// is a plan feature, limited to ConcurrentSeeds torrents at a time. The
+// uploads are consumed.
+func (h *TorrentHandler) CreateTorrent(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	if ok, err := h.checkDiskError(c); !ok {
+		return err
+	}
+
+	var req models.CreateTorrentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if len(req.UploadIDs) == 0 || len(req.UploadIDs) > maxCreateUploads {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: fmt.Sprintf("between 1 and %d upload IDs are required", maxCreateUploads),
+		})
+	}
+	seen := make(map[uuid.UUID]bool, len(req.UploadIDs))
+	for _, id := range req.UploadIDs {
+		if seen[id] {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "duplicate upload ID",
+			})
+		}
+		seen[id] = true
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name != "" || len(req.UploadIDs) > 1 {
+		if err := createName(req.Name); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: err.Error(),
+			})
+		}
+	}
+	if p := req.PieceSize; p != 0 && (p < torrent.MinPieceLength || p > torrent.MaxPieceLength || p&(p-1) != 0) {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: fmt.Sprintf("piece_size must be a power of two from %d to %d bytes", torrent.MinPieceLength, torrent.MaxPieceLength),
+		})
+	}
+	if len(req.Trackers) > maxCreateTrackers {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: fmt.Sprintf("at most %d trackers are allowed", maxCreateTrackers),
+		})
+	}
+	for _, tracker := range req.Trackers {
+		if err := createTracker(tracker); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: err.Error(),
+			})
+		}
+	}
+	if len(req.Comment) > maxCreateComment {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "comment is too long",
+		})
+	}
+
+	ctx := c.UserContext()
+	limits, err := h.planLimits(ctx, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check subscription",
+		})
+	}
+	if limits.ConcurrentSeeds <= 0 {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "seeding your own files is not included in your plan",
+			Code:  "PLAN_REQUIRED",
+		})
+	}
+	seeding, err := h.db.CountCreatedTorrents(ctx, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check seed limit",
+		})
+	}
+	if seeding >= limits.ConcurrentSeeds {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error:   "seed limit reached",
+			Code:    "SEED_LIMIT",
+			Details: fmt.Sprintf("your plan seeds %d created torrents at a time; delete one to create another", limits.ConcurrentSeeds),
+		})
+	}
+	if ok, err := h.checkCollection(c, userID, req.CollectionID); !ok {
+		return err
+	}
+
+	files := make([]*models.Upload, 0, len(req.UploadIDs))
+	filenames := make(map[string]bool, len(req.UploadIDs))
+	var total int64
+	for _, id := range req.UploadIDs {
+		upload, err := h.uploads.Get(ctx, userID, id)
+		if err != nil {
+			return uploadError(c, err)
+		}
+		if !upload.Complete() {
+			return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Error:   "upload is not complete",
+				Code:    "UPLOAD_INCOMPLETE",
+				Details: upload.ID.String(),
+			})
+		}
+		filename := torrent.SanitizeFileName(upload.Filename)
+		if filenames[filename] {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "two uploads have the same filename",
+				Details: filename,
+			})
+		}
+		filenames[filename] = true
+		files = append(files, upload)
+		total += upload.Size
+	}
+	if req.Name == "" {
+		req.Name = torrent.SanitizeFileName(files[0].Filename)
+	}
+
+	if ok, err := h.checkStorage(c, userID, total); !ok {
+		return err
+	}
+	if ok, err := h.checkAddVelocity(c, userID); !ok {
+		return err
+	}
+
+	// Lay the files out as the torrent has them next to the download
+	// directory, so moving them into place is a rename
+	torrentID := uuid.New()
+	staging := filepath.Join(h.engine.GetDownloadDir(), ".create-"+torrentID.String())
+	defer os.RemoveAll(staging)
+	root := filepath.Join(staging, req.Name)
+	dir := staging
+	if len(files) > 1 {
+		dir = root
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Failed to stage created torrent %s: %v", torrentID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to prepare files",
+		})
+	}
+	for _, upload := range files {
+		dest := root
+		if len(files) > 1 {
+			dest = filepath.Join(root, torrent.SanitizeFileName(upload.Filename))
+		}
+		if err := h.uploads.LinkTo(upload, dest); err != nil {
+			if errors.Is(err, uploads.ErrIncomplete) {
+				return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+					Error: "upload is not complete",
+					Code:  "UPLOAD_INCOMPLETE",
+				})
+			}
+			log.Printf("Failed to stage upload %s: %v", upload.ID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to prepare files",
+			})
+		}
+	}
+
+	created, err := h.engine.CreateTorrent(torrentID, userID, root, torrent.CreateOptions{
+		PieceLength: req.PieceSize,
+		Trackers:    req.Trackers,
+		Comment:     req.Comment,
+	})
+	if errors.Is(err, torrent.ErrContentActive) {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "a torrent of these files is already active",
+			Code:  "TORRENT_EXISTS",
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to create torrent %s: %v", torrentID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create torrent",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), created.InfoHash)
+
+	t := &models.Torrent{
+		ID:           torrentID,
+		UserID:       userID,
+		InfoHash:     created.InfoHash,
+		Name:         created.Name,
+		MagnetURI:    created.Magnet,
+		Metadata:     created.Metadata,
+		Status:       models.TorrentStatusChecking,
+		TotalSize:    created.TotalSize,
+		Metainfo:     created.Metainfo,
+		Audit:        addAudit(c, models.SourceCreated),
+		CollectionID: req.CollectionID,
+	}
+	if err := h.db.CreateTorrent(ctx, t); err != nil {
+		h.engine.RemoveOwner(created.InfoHash, torrentID, true)
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save torrent",
+		})
+	}
+	h.db.LogTorrentAdded(ctx, t)
+	h.hooks.OnTorrentAdded(t)
+	c.Locals(string(middleware.TorrentIDKey), t.ID)
+
+	for _, upload := range files {
+		if err := h.uploads.Remove(ctx, upload); err != nil {
+			log.Printf("Failed to remove consumed upload %s: %v", upload.ID, err)
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(t)
+}
+
+// GetTorrentFile returns the .torrent file of a torrent, as it was uploaded
+// or created, or rebuilt from the engine's metadata for a magnet
+func (h *TorrentHandler) GetTorrentFile(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent",
+		})
+	}
+	if t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	role := middleware.GetUserRole(c)
+	if t.UserID != userID && role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+
+	data, err := h.db.GetTorrentMetainfo(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent file",
+		})
+	}
+	if len(data) == 0 {
+		var ok bool
+		if data, ok = h.engine.MetainfoFile(t.InfoHash); !ok {
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Error: "torrent metadata is not available yet",
+			})
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "application/x-bittorrent")
+	c.Set(fiber.HeaderContentDisposition, attachmentDisposition(t.Name+".torrent"))
+	return c.Send(data)
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/freetorrent/freetorrent/internal/jobs"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DiagnosticsHandler serves admin checks of the engine against the database
+type DiagnosticsHandler struct {
+	completer *jobs.Completer
+}
+
+func NewDiagnosticsHandler(completer *jobs.Completer) *DiagnosticsHandler {
+	return &DiagnosticsHandler{completer: completer}
+}
+
+// GetDivergence reports torrents the database expects to run that the
+// engine doesn't have, engine torrents no active row has, and engine
+// torrents held under an ID that isn't one of their rows
+func (h *DiagnosticsHandler) GetDivergence(c *fiber.Ctx) error {
+	d, err := h.completer.Divergence(c.UserContext())
+	if err != nil {
+		return divergenceFailed(c, err)
+	}
+	return c.JSON(d)
+}
+
+// RepairDivergence reloads torrents missing from the engine, attaches rows
+// to mismatched engine torrents and drops orphans
+func (h *DiagnosticsHandler) RepairDivergence(c *fiber.Ctx) error {
+	repair, err := h.completer.RepairDivergence(c.UserContext())
+	if err != nil {
+		return divergenceFailed(c, err)
+	}
+	log.Printf("Divergence repair: %d reloaded, %d reattached, %d orphans dropped, %d errors",
+		repair.Reloaded, repair.Reattached, repair.OrphansDropped, len(repair.Errors))
+	return c.JSON(repair)
+}
+
+func divergenceFailed(c *fiber.Ctx, err error) error {
+	if errors.Is(err, torrent.ErrEngineUnavailable) {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+			Error: "torrent engine unavailable",
+			Code:  "ENGINE_UNAVAILABLE",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+		Error: "failed to compare engine and database",
+	})
+}
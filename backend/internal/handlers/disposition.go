@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/torrent"
+)
+
+// attachmentDisposition returns a Content-Disposition header saving the
+// response as name, sanitized with torrent.SanitizeFileName. Non-ASCII names
+// go in filename* (RFC 6266); filename carries an ASCII fallback for clients
+// that don't read it.
+func attachmentDisposition(name string) string {
+	return disposition("attachment", name)
+}
+
+// inlineDisposition is attachmentDisposition for a response to be shown in
+// the browser, named name should it be saved
+func inlineDisposition(name string) string {
+	return disposition("inline", name)
+}
+
+func disposition(kind, name string) string {
+	name = torrent.SanitizeFileName(name)
+
+	var fallback, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x80 {
+			fallback.WriteRune(r)
+		} else if !strings.HasSuffix(fallback.String(), "_") {
+			fallback.WriteByte('_')
+		}
+	}
+	for i := 0; i < len(name); i++ {
+		if b := name[i]; isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	if fallback.String() == name {
+		return fmt.Sprintf(`%s; filename="%s"`, kind, name)
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, kind, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unescaped in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
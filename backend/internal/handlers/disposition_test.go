@@ -0,0 +1,25 @@
+package handlers
+
+import "testing"
+
+func TestAttachmentDisposition(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"movie.mkv", `attachment; filename="movie.mkv"`},
+		{"a/b.mkv", `attachment; filename="a_b.mkv"`},
+		{`say "hi".txt`, `attachment; filename="say _hi_.txt"`},
+		{"电影.mkv", `attachment; filename="_.mkv"; filename*=UTF-8''%E7%94%B5%E5%BD%B1.mkv`},
+		{"🎬 film.mkv", `attachment; filename="_ film.mkv"; filename*=UTF-8''%F0%9F%8E%AC%20film.mkv`},
+		{"evil‮gpj.exe", `attachment; filename="evil_gpj.exe"`},
+		{"", `attachment; filename="download"`},
+	}
+	for _, tt := range tests {
+		if got := attachmentDisposition(tt.name); got != tt.want {
+			t.Errorf("attachmentDisposition(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if got, want := inlineDisposition("notes.txt"), `inline; filename="notes.txt"`; got != want {
+		t.Errorf("inlineDisposition = %s, want %s", got, want)
+	}
+}
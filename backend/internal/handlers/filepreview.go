@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxPreviewSize is the largest file previewed whole; a text file of
+	// any size can still be previewed by its first lines
+	maxPreviewSize = 20 << 20
+	// maxPreviewLines bounds ?lines=, and maxPreviewLineBytes what is read
+	// for them, so a file without line breaks isn't read through
+	maxPreviewLines     = 1000
+	maxPreviewLineBytes = 1 << 20
+	// sniffLen is how much of a file http.DetectContentType looks at
+	sniffLen = 512
+	// previewCSP keeps a previewed file from running anything should it be
+	// opened directly rather than shown by the app
+	previewCSP = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+)
+
+// errPreviewPath is a file path that leads out of its torrent's directory
+var errPreviewPath = errors.New("invalid file path")
+
+// PreviewFile sends one of a torrent's files inline for viewing in the app,
+// without minting a download token: text, images and PDFs up to
+// maxPreviewSize, with range support, and anything else 415. The type is
+// sniffed from the file's start, not taken from its name, and text is
+// always sent as text/plain, so HTML shows as source rather than running.
+// ?lines=N sends only a text file's first N lines, of any size file,
+// reading no further than them; X-Preview-Truncated says whether the file
+// goes on. Previews count towards the owner's bandwidth like downloads,
+// but not as downloads in their activity.
+func (h *TorrentHandler) PreviewFile(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	lines := 0
+	if s := c.Query("lines"); s != "" {
+		if lines, err = strconv.Atoi(s); err != nil || lines < 1 || lines > maxPreviewLines {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid lines",
+				Details: fmt.Sprintf("between 1 and %d", maxPreviewLines),
+			})
+		}
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent",
+		})
+	}
+	if t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	if t.UserID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+
+	relPath := c.Query("path")
+	file := recordedFile(t, relPath)
+	if file == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "file not found",
+		})
+	}
+
+	// Previews read a little and seek, like a player
+	reader, size, err := h.engine.GetFileReader(t.InfoHash, relPath, h.engine.StreamReaderOptions())
+	if err != nil {
+		if file.Progress < 100 {
+			return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Error:   "file has not finished downloading",
+				Code:    "FILE_INCOMPLETE",
+				Details: fmt.Sprintf("%.1f%% downloaded", file.Progress),
+			})
+		}
+		reader, size, err = openOnDisk(h.engine.TorrentDir(t.InfoHash), relPath)
+		switch {
+		case errors.Is(err, errPreviewPath):
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Error: "invalid file path",
+			})
+		case errors.Is(err, os.ErrNotExist):
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Error: "file not found on disk",
+			})
+		case err != nil:
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to open file",
+			})
+		}
+	}
+
+	if lines == 0 && size > maxPreviewSize {
+		reader.Close()
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(models.ErrorResponse{
+			Error:   "file is too large to preview",
+			Code:    "PREVIEW_TOO_LARGE",
+			Details: fmt.Sprintf("at most %s; text files can be previewed by their first lines", models.HumanBytes(maxPreviewSize)),
+		})
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		reader.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to read file",
+		})
+	}
+	contentType, ok := previewType(head[:n], relPath)
+	if !ok {
+		reader.Close()
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(models.ErrorResponse{
+			Error:   "files of this type can't be previewed",
+			Code:    "PREVIEW_UNSUPPORTED",
+			Details: contentType,
+		})
+	}
+	if lines > 0 && !strings.HasPrefix(contentType, "text/") {
+		reader.Close()
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "lines only applies to text files",
+		})
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		reader.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to read file",
+		})
+	}
+
+	metadata := fiber.Map{"torrent_id": t.ID, "name": t.Name, "file": relPath, "preview": true}
+	filename := relPath
+	if idx := strings.LastIndex(filename, "/"); idx >= 0 {
+		filename = filename[idx+1:]
+	}
+
+	if lines > 0 {
+		defer reader.Close()
+		text, truncated, err := headLines(reader, lines)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to read file",
+			})
+		}
+		h.logDownload(userID, "download_served", int64(len(text)), metadata)
+		setPreviewHeaders(c, contentType, filename)
+		c.Set("X-Preview-Truncated", strconv.FormatBool(truncated))
+		return c.Send(text)
+	}
+
+	// The stream closes the reader once the response ends, and every early
+	// return below closes it
+	body := &servedReader{Reader: reader, closer: reader, done: func(n int64) {
+		h.logDownload(userID, "download_served", n, metadata)
+	}}
+
+	etag := contentETag(t.InfoHash, relPath, size)
+	rangeHeader := c.Get(fiber.HeaderRange)
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+	var ranges []byteRange
+	if rangeHeader != "" {
+		if ranges, err = parseByteRanges(rangeHeader, size); err != nil {
+			body.Close()
+			return rangeNotSatisfiable(c, size, err)
+		}
+	}
+
+	setPreviewHeaders(c, contentType, filename)
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderETag, etag)
+	if len(ranges) > 0 {
+		return h.serveRanges(c, reader, body, size, ranges)
+	}
+	c.Status(fiber.StatusOK)
+	c.Context().SetBodyStream(body, int(size))
+	return nil
+}
+
+// setPreviewHeaders marks a preview as one to show rather than save, and
+// one never to run, whatever it turns out to hold
+func setPreviewHeaders(c *fiber.Ctx, contentType, filename string) {
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, inlineDisposition(filename))
+	c.Set(fiber.HeaderContentSecurityPolicy, previewCSP)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+}
+
+// openOnDisk opens one of a torrent's files from its directory, for when
+// the engine doesn't have the torrent
+func openOnDisk(torrentDir, relPath string) (io.ReadSeekCloser, int64, error) {
+	filePath := filepath.Join(torrentDir, relPath)
+	if !withinDir(torrentDir, filePath) {
+		return nil, 0, errPreviewPath
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, 0, os.ErrNotExist
+	}
+	return f, info.Size(), nil
+}
+
+// previewType returns the content type a file is previewed as, sniffed
+// from head, its first bytes, and whether it may be previewed at all
+func previewType(head []byte, relPath string) (string, bool) {
+	contentType := http.DetectContentType(head)
+	mediaType, params, _ := strings.Cut(contentType, ";")
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		// SVG sniffs as XML or plain text
+		if strings.EqualFold(path.Ext(relPath), ".svg") {
+			return "image/svg+xml", true
+		}
+		if params == "" {
+			params = " charset=utf-8"
+		}
+		return "text/plain;" + params, true
+	case strings.HasPrefix(mediaType, "image/"), mediaType == "application/pdf":
+		return mediaType, true
+	}
+	return mediaType, false
+}
+
+// headLines reads r's first n lines, no more than maxPreviewLineBytes of
+// them, and reports whether r goes on past what was read
+func headLines(r io.Reader, n int) ([]byte, bool, error) {
+	limited := &io.LimitedReader{R: r, N: maxPreviewLineBytes}
+	br := bufio.NewReader(limited)
+	var out bytes.Buffer
+	for i := 0; i < n; i++ {
+		line, err := br.ReadBytes('\n')
+		out.Write(line)
+		if err == io.EOF {
+			// Out of bytes to read rather than out of file
+			return out.Bytes(), limited.N == 0, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if _, err := br.Peek(1); err == nil {
+		return out.Bytes(), true, nil
+	}
+	return out.Bytes(), limited.N == 0, nil
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Vite puts hashed build output under /assets/; a changed file gets a
+	// new name, so these never need revalidating
+	immutableMaxAge = "public, max-age=31536000, immutable"
+	// index.html and unhashed files such as the favicon are revalidated
+	// on every load, so a deploy shows up at once
+	revalidateMaxAge = "no-cache"
+)
+
+// precompressed are the encodings a built file may have a compressed copy
+// for beside it, file.js.br or file.js.gz, in order of preference
+var precompressed = []struct {
+	encoding, suffix string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// FrontendHandler serves the built SPA from a directory, answering any
+// other page path with index.html so the client side router can take
+// deep links
+type FrontendHandler struct {
+	dir string
+}
+
+func NewFrontendHandler(dir string) *FrontendHandler {
+	return &FrontendHandler{dir: dir}
+}
+
+// Serve is mounted after every route. It passes on anything the SPA
+// mustn't answer, so /api and /health keep their JSON 404s, and misses on
+// paths with an extension 404 too rather than get the page as a script
+// or stylesheet.
+func (h *FrontendHandler) Serve(c *fiber.Ctx) error {
+	if (c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) || serverPath(c.Path()) {
+		return c.Next()
+	}
+	name, err := url.PathUnescape(c.Path())
+	if err != nil {
+		return c.Next()
+	}
+	name = path.Clean("/" + name)
+
+	if name != "/" && !hiddenPath(name) {
+		if ok, err := h.sendFile(c, name); ok || err != nil {
+			return err
+		}
+		if path.Ext(name) != "" {
+			return c.Next()
+		}
+	}
+	if ok, err := h.sendFile(c, "/index.html"); ok || err != nil {
+		return err
+	}
+	return c.Next()
+}
+
+// sendFile sends the file at name under the directory, a precompressed
+// copy of it when the client takes one, and reports whether there was one
+func (h *FrontendHandler) sendFile(c *fiber.Ctx, name string) (bool, error) {
+	file := filepath.Join(h.dir, filepath.FromSlash(name))
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	encoding := ""
+	if c.Get(fiber.HeaderAcceptEncoding) != "" {
+		for _, p := range precompressed {
+			if c.AcceptsEncodings(p.encoding) != p.encoding {
+				continue
+			}
+			if pi, err := os.Stat(file + p.suffix); err == nil && pi.Mode().IsRegular() {
+				file, info, encoding = file+p.suffix, pi, p.encoding
+				break
+			}
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return false, nil
+	}
+
+	if strings.HasPrefix(name, "/assets/") {
+		c.Set(fiber.HeaderCacheControl, immutableMaxAge)
+	} else {
+		c.Set(fiber.HeaderCacheControl, revalidateMaxAge)
+	}
+	c.Type(path.Ext(name))
+	c.Vary(fiber.HeaderAcceptEncoding)
+	if encoding != "" {
+		// The compress middleware leaves encoded bodies alone
+		c.Set(fiber.HeaderContentEncoding, encoding)
+	}
+	modified := info.ModTime().UTC().Truncate(time.Second)
+	c.Set(fiber.HeaderLastModified, modified.Format(http.TimeFormat))
+	// Fiber's Fresh takes any If-Modified-Since alone as fresh
+	if since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince)); err == nil && !modified.After(since) {
+		f.Close()
+		c.Status(fiber.StatusNotModified)
+		return true, nil
+	}
+	return true, c.SendStream(f, int(info.Size()))
+}
+
+// serverPath reports whether a path belongs to the API server, never to
+// the SPA
+func serverPath(p string) bool {
+	for _, prefix := range []string{"/api", "/health"} {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenPath reports whether any segment of a path is a dotfile, which is
+// never served
+func hiddenPath(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
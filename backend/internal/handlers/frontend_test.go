@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestFrontendRouting(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":            "index",
+		"favicon.ico":           "icon",
+		"assets/app-1a2b.js":    "app",
+		"assets/app-1a2b.js.br": "app br",
+		".env":                  "secret",
+	} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/api/v1/torrents", func(c *fiber.Ctx) error { return c.SendString("api") })
+	app.Get("/health", func(c *fiber.Ctx) error { return c.SendString("ok") })
+	app.Use(NewFrontendHandler(dir).Serve)
+
+	tests := []struct {
+		method, path, acceptEncoding string
+		status                       int
+		body, cacheControl           string
+	}{
+		// Routes still answer, and the SPA never takes over their prefixes
+		{"GET", "/api/v1/torrents", "", 200, "api", ""},
+		{"GET", "/health", "", 200, "ok", ""},
+		{"GET", "/api/v1/nope", "", 404, "Cannot GET /api/v1/nope", ""},
+		{"GET", "/api", "", 404, "Cannot GET /api", ""},
+		{"GET", "/health/deep", "", 404, "Cannot GET /health/deep", ""},
+		{"POST", "/torrents", "", 404, "Cannot POST /torrents", ""},
+
+		// Deep links get the page
+		{"GET", "/", "", 200, "index", revalidateMaxAge},
+		{"GET", "/torrents/123", "", 200, "index", revalidateMaxAge},
+		{"GET", "/apiary", "", 200, "index", revalidateMaxAge},
+		{"HEAD", "/settings", "", 200, "", revalidateMaxAge},
+
+		{"GET", "/favicon.ico", "", 200, "icon", revalidateMaxAge},
+		{"GET", "/assets/app-1a2b.js", "", 200, "app", immutableMaxAge},
+		{"GET", "/assets/app-1a2b.js", "gzip, br", 200, "app br", immutableMaxAge},
+		{"GET", "/assets/missing.js", "", 404, "Cannot GET /assets/missing.js", ""},
+		// Dotfiles are never served; the path is a page like any other
+		{"GET", "/.env", "", 200, "index", revalidateMaxAge},
+		{"GET", "/../index.html", "", 200, "index", revalidateMaxAge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set(fiber.HeaderAcceptEncoding, tt.acceptEncoding)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || string(body) != tt.body || resp.Header.Get(fiber.HeaderCacheControl) != tt.cacheControl {
+			t.Errorf("%s %s: %d %q, Cache-Control %q; want %d %q, %q", tt.method, tt.path,
+				resp.StatusCode, body, resp.Header.Get(fiber.HeaderCacheControl), tt.status, tt.body, tt.cacheControl)
+		}
+	}
+
+	// Revalidation of the page
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(fiber.HeaderIfModifiedSince, resp.Header.Get(fiber.HeaderLastModified))
+	if resp, err = app.Test(req, -1); err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: %v, %v; want 304", resp.StatusCode, err)
+	}
+}
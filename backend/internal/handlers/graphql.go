@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/graphql"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	graphqlgo "github.com/graph-gophers/graphql-go"
+)
+
+// GraphQLHandler serves the dashboard's read-only GraphQL API, which loads
+// the user, subscription, usage and a page of torrents in one request
+type GraphQLHandler struct {
+	schema *graphqlgo.Schema
+}
+
+func NewGraphQLHandler(db *database.Database, engine torrent.Service) *GraphQLHandler {
+	usage := func(ctx context.Context, userID uuid.UUID, subscription *models.Subscription) models.UsageStats {
+		return userUsage(ctx, db, userID, subscription)
+	}
+	live := func(userID uuid.UUID, torrents []models.Torrent) {
+		updates := engine.GetUserTorrents(userID)
+		byID := make(map[uuid.UUID]*torrent.TorrentUpdate, len(updates))
+		for i := range updates {
+			byID[updates[i].ID] = &updates[i]
+		}
+		for i := range torrents {
+			if status, ok := byID[torrents[i].ID]; ok {
+				applyLiveStatus(&torrents[i], status)
+			}
+		}
+	}
+	return &GraphQLHandler{
+		schema: graphql.NewSchema(db, usage, live),
+	}
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Query runs a query given as a JSON body, or as query, operationName and
+// variables parameters on GET. Query errors are reported in the response's
+// errors, with 200 as GraphQL clients expect.
+func (h *GraphQLHandler) Query(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var req graphqlRequest
+	if c.Method() == fiber.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if v := c.Query("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+					Error: "invalid variables",
+				})
+			}
+		}
+	} else if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if req.Query == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "query is required",
+		})
+	}
+
+	ctx := graphql.WithViewer(c.UserContext(), userID)
+	return c.JSON(h.schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
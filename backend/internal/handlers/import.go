@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/redact"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	maxImportItems  = 1000
+	maxImportSource = 8192 // magnets with long tracker lists included
+	maxImportLabel  = 255
+
+	// importBatch is how many open items of each job one pass of
+	// ProcessImports reads, so one large import can't starve the others
+	importBatch = 50
+)
+
+// infoHashPattern matches a bare v1 info hash, hex or base32
+var infoHashPattern = regexp.MustCompile(`^(?i:[0-9a-f]{40}|[a-z2-7]{32})$`)
+
+// importMagnet turns an import entry, a magnet URI or a bare info hash, into
+// a magnet URI and the info hash it adds
+func importMagnet(source string) (magnet, infoHash string, err error) {
+	magnet = source
+	if infoHashPattern.MatchString(source) {
+		magnet = "magnet:?xt=urn:btih:" + source
+	}
+	if !strings.HasPrefix(magnet, "magnet:") {
+		return "", "", errors.New("not a magnet URI or info hash")
+	}
+	infoHash, err = torrent.MagnetInfoHash(magnet)
+	if err != nil {
+		return "", "", err
+	}
+	return magnet, infoHash, nil
+}
+
+// ImportTorrents starts a background import of magnets and info hashes,
+// given as a JSON array of {magnet, label} or as a CSV "file" upload with
+// the magnet or info hash in the first column and an optional label in the
+// second. A label puts the torrent in the user's collection of that name,
+// if there is one. Malformed entries are reported failed in the job rather
+// than refusing the import; a user runs one import at a time.
+func (h *TorrentHandler) ImportTorrents(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var entries []models.ImportRequestItem
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "no file uploaded",
+			})
+		}
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to open file",
+			})
+		}
+		defer f.Close()
+
+		entries, err = readImportCSV(f)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid CSV",
+				Details: err.Error(),
+			})
+		}
+	} else if err := c.BodyParser(&entries); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	if len(entries) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "nothing to import",
+		})
+	}
+	if len(entries) > maxImportItems {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Error:   "too many torrents",
+			Details: fmt.Sprintf("an import can hold up to %d torrents", maxImportItems),
+		})
+	}
+
+	collections, err := h.db.GetCollectionsByUser(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch collections",
+		})
+	}
+	byName := make(map[string]uuid.UUID, len(collections))
+	for _, col := range collections {
+		byName[strings.ToLower(col.Name)] = col.ID
+	}
+
+	job := &models.ImportJob{
+		UserID: userID,
+		Audit:  addAudit(c, models.SourceImport),
+		Items:  make([]models.ImportItem, len(entries)),
+	}
+	for i, entry := range entries {
+		item := &job.Items[i]
+		item.Position = i + 1
+		item.Source = strings.TrimSpace(entry.Magnet)
+		item.Label = strings.TrimSpace(entry.Label)
+
+		switch {
+		case len(item.Source) > maxImportSource:
+			item.Source = item.Source[:maxImportSource]
+			item.Status, item.Error = models.ImportItemFailed, "magnet URI is too long"
+		case utf8.RuneCountInString(item.Label) > maxImportLabel:
+			item.Label = ""
+			item.Status, item.Error = models.ImportItemFailed, "label is longer than 255 characters"
+		default:
+			if _, _, err := importMagnet(item.Source); err != nil {
+				item.Status, item.Error = models.ImportItemFailed, redact.Error(err)
+			}
+		}
+		if id, ok := byName[strings.ToLower(item.Label)]; ok && item.Label != "" {
+			item.CollectionID = &id
+		}
+	}
+
+	created, err := h.db.CreateImportJob(c.UserContext(), job)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save import",
+		})
+	}
+	if !created {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "an import is already running",
+			Code:  "IMPORT_RUNNING",
+		})
+	}
+
+	select {
+	case h.importWake <- struct{}{}:
+	default:
+	}
+
+	// The items are in the report at GET /torrents/import/:jobID
+	job.Items = nil
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// readImportCSV reads magnet or info hash, label rows. A first row that
+// isn't a magnet or info hash is taken as a header; blank rows are skipped.
+func readImportCSV(r io.Reader) ([]models.ImportRequestItem, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var entries []models.ImportRequestItem
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := models.ImportRequestItem{Magnet: strings.TrimSpace(record[0])}
+		if len(record) > 1 {
+			entry.Label = record[1]
+		}
+		if entry.Magnet == "" && entry.Label == "" {
+			continue
+		}
+		if first {
+			if _, _, err := importMagnet(entry.Magnet); err != nil {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+		if len(entries) > maxImportItems {
+			return entries, nil
+		}
+	}
+}
+
+// GetImportJob reports an import job and the outcome of each item
+func (h *TorrentHandler) GetImportJob(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	jobID, err := uuid.Parse(c.Params("jobID"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid job ID",
+		})
+	}
+
+	job, err := h.db.GetImportJob(c.UserContext(), jobID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch import",
+		})
+	}
+	if job == nil || job.UserID != userID {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "import not found",
+		})
+	}
+
+	return c.JSON(job)
+}
+
+// ImportWake is signalled when an import is created, so the import job can
+// start on it without waiting for its next pass
+func (h *TorrentHandler) ImportWake() <-chan struct{} {
+	return h.importWake
+}
+
+// ProcessImports tries open import items in order and returns how many
+// torrents it added. An item a plan limit holds up is queued, and so are
+// that user's later items, until a later pass finds the limit allows it;
+// the user's hourly and daily add limits pace imports the same way.
+// Finished jobs are marked done and their users told over SSE.
+func (h *TorrentHandler) ProcessImports(ctx context.Context) (int, error) {
+	// Items wait while the engine is down or stopped by a disk write error
+	// rather than failing
+	if !h.engine.Available() || h.engine.DiskError() != nil {
+		return 0, nil
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	items, err := h.db.GetOpenImportItems(dbCtx, importBatch)
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list import items: %w", err)
+	}
+
+	added := 0
+	held := make(map[uuid.UUID]string) // users held up this pass, and why
+	for i := range items {
+		if err := ctx.Err(); err != nil {
+			return added, err
+		}
+		item := &items[i]
+		was := *item
+
+		if reason, ok := held[item.UserID]; ok {
+			item.Status, item.Error = models.ImportItemQueued, reason
+		} else {
+			dbCtx, cancel := database.WithTimeout(ctx)
+			err := h.importItem(dbCtx, item)
+			cancel()
+			if err != nil {
+				return added, fmt.Errorf("import %s item %d: %w", item.JobID, item.Position, err)
+			}
+			switch item.Status {
+			case models.ImportItemQueued:
+				held[item.UserID] = item.Error
+			case models.ImportItemAdded:
+				added++
+			}
+		}
+
+		if item.Status == was.Status && item.Error == was.Error {
+			continue
+		}
+		dbCtx, cancel := database.WithTimeout(ctx)
+		err := h.db.UpdateImportItem(dbCtx, item)
+		cancel()
+		if err != nil {
+			return added, fmt.Errorf("failed to update import item: %w", err)
+		}
+	}
+
+	dbCtx, cancel = database.WithTimeout(ctx)
+	finished, err := h.db.FinishImportJobs(dbCtx)
+	cancel()
+	if err != nil {
+		return added, fmt.Errorf("failed to finish imports: %w", err)
+	}
+	for _, job := range finished {
+		h.events.Publish(events.Event{
+			UserID: job.UserID,
+			Type:   "import_finished",
+			Data:   job,
+		})
+	}
+	return added, nil
+}
+
+// importItem adds one import item the way AddTorrent adds a magnet, setting
+// its outcome. Plan limits queue it rather than fail it, except a churn
+// cooldown, which can outlast the import. It returns an error, leaving the
+// item as it was, only when the attempt should simply be repeated.
+func (h *TorrentHandler) importItem(ctx context.Context, item *models.ImportItem) error {
+	magnet, infoHash, err := importMagnet(item.Source)
+	if err != nil {
+		item.Status, item.Error = models.ImportItemFailed, redact.Error(err)
+		return nil
+	}
+
+	existing, err := h.db.GetTorrentByInfoHash(ctx, item.UserID, infoHash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		item.Status, item.TorrentID, item.Error = models.ImportItemExists, &existing.ID, ""
+		return nil
+	}
+
+	reasons, err := h.limitReasons(ctx, item.UserID, infoHash, 0)
+	if err != nil {
+		return err
+	}
+	for _, reason := range reasons {
+		switch reason {
+		case "ADD_COOLDOWN":
+			item.Status, item.Error = models.ImportItemFailed, "torrent was added and deleted too many times"
+			return nil
+		case "TORRENT_BLOCKED":
+			item.Status, item.Error = models.ImportItemFailed, "torrent has been removed following an abuse report"
+			return nil
+		}
+	}
+	if len(reasons) > 0 {
+		item.Status, item.Error = models.ImportItemQueued, strings.Join(reasons, ", ")
+		return nil
+	}
+
+	torrentID := uuid.New()
+	update, err := h.engine.AddMagnet(h.engine.Context(), torrentID, item.UserID, magnet)
+	if err != nil {
+		item.Status, item.Error = models.ImportItemFailed, redact.Error(err)
+		return nil
+	}
+	if update.Status == torrent.StatusExists {
+		if existing, err := h.db.GetTorrent(ctx, update.ID); err == nil && existing != nil && existing.UserID == item.UserID {
+			item.Status, item.TorrentID, item.Error = models.ImportItemExists, &existing.ID, ""
+		} else {
+			item.Status, item.Error = models.ImportItemFailed, "torrent already exists"
+		}
+		return nil
+	}
+
+	t := &models.Torrent{
+		ID:           torrentID,
+		UserID:       item.UserID,
+		InfoHash:     update.InfoHash,
+		Name:         update.Name,
+		MagnetURI:    magnet,
+		IsPrivate:    update.IsPrivate,
+		Audit:        item.Audit,
+		CollectionID: item.CollectionID,
+		Metadata:     update.Metadata,
+		Status:       update.Status,
+		TotalSize:    update.TotalSize,
+	}
+	if err := h.db.CreateTorrent(ctx, t); err != nil {
+		h.engine.RemoveOwner(update.InfoHash, torrentID, false)
+		item.Status, item.Error = models.ImportItemFailed, "failed to save torrent"
+		return nil
+	}
+	h.db.LogTorrentAdded(ctx, t)
+	h.hooks.OnTorrentAdded(t)
+	h.engine.SetSeedRatio(update.InfoHash, h.seedRatio(ctx, item.UserID))
+
+	h.events.Publish(events.Event{
+		UserID: item.UserID,
+		Type:   "torrent_added",
+		Data:   t,
+	})
+	item.Status, item.TorrentID, item.Error = models.ImportItemAdded, &t.ID, ""
+	return nil
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxInviteUses bounds how many registrations one invite may allow
+const maxInviteUses = 10000
+
+// inviteCodeRegex is what invite codes chosen by admins may look like
+var inviteCodeRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{4,64}$`)
+
+// normalizeInviteCode makes codes case-insensitive
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// generateInviteCode returns a random 16-character code
+func generateInviteCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// ListInvites returns every invite, newest first
+func (h *AdminHandler) ListInvites(c *fiber.Ctx) error {
+	invites, err := h.db.GetInvites(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch invites",
+		})
+	}
+	if invites == nil {
+		invites = []models.Invite{}
+	}
+
+	return c.JSON(fiber.Map{
+		"invites": invites,
+	})
+}
+
+// CreateInvite creates an invite, with a generated code unless one is given.
+// It allows one registration unless max_uses says otherwise.
+func (h *AdminHandler) CreateInvite(c *fiber.Ctx) error {
+	adminID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var req models.InviteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	inv := &models.Invite{CreatedBy: &adminID, MaxUses: 1, ExpiresAt: req.ExpiresAt}
+	if req.MaxUses != nil {
+		inv.MaxUses = *req.MaxUses
+	}
+	if ok, err := validateInvite(c, inv); !ok {
+		return err
+	}
+
+	if req.Code != "" {
+		if !inviteCodeRegex.MatchString(req.Code) {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "code must be 4 to 64 letters, digits, dashes or underscores",
+			})
+		}
+		inv.Code = normalizeInviteCode(req.Code)
+	} else if inv.Code, err = generateInviteCode(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to generate code",
+		})
+	}
+
+	created, err := h.db.CreateInvite(c.UserContext(), inv)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create invite",
+		})
+	}
+	if !created {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "invite code already exists",
+			Code:  "INVITE_EXISTS",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(inv)
+}
+
+// UpdateInvite changes an invite's use limit or expiry
+func (h *AdminHandler) UpdateInvite(c *fiber.Ctx) error {
+	inv, err := h.invite(c)
+	if inv == nil {
+		return err
+	}
+
+	var req models.InviteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if req.MaxUses != nil {
+		inv.MaxUses = *req.MaxUses
+	}
+	if req.ExpiresAt != nil {
+		inv.ExpiresAt = req.ExpiresAt
+	}
+	if ok, err := validateInvite(c, inv); !ok {
+		return err
+	}
+
+	if err := h.db.UpdateInvite(c.UserContext(), inv.ID, inv.MaxUses, inv.ExpiresAt); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to update invite",
+		})
+	}
+
+	return c.JSON(inv)
+}
+
+// DeleteInvite revokes an invite. Accounts created with it are kept.
+func (h *AdminHandler) DeleteInvite(c *fiber.Ctx) error {
+	inv, err := h.invite(c)
+	if inv == nil {
+		return err
+	}
+
+	if err := h.db.DeleteInvite(c.UserContext(), inv.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to delete invite",
+		})
+	}
+
+	return c.JSON(models.SuccessResponse{
+		Message: "invite deleted",
+	})
+}
+
+// invite loads the :id invite. On failure it returns nil and the result of
+// responding.
+func (h *AdminHandler) invite(c *fiber.Ctx) (*models.Invite, error) {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid invite ID",
+		})
+	}
+
+	inv, err := h.db.GetInvite(c.UserContext(), id)
+	if err != nil {
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch invite",
+		})
+	}
+	if inv == nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "invite not found",
+		})
+	}
+	return inv, nil
+}
+
+// validateInvite checks an invite's use limit and expiry. Reports false
+// once it has responded.
+func validateInvite(c *fiber.Ctx, inv *models.Invite) (bool, error) {
+	if inv.MaxUses < 1 || inv.MaxUses > maxInviteUses {
+		return false, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "max_uses must be 1 to 10000",
+		})
+	}
+	if inv.ExpiresAt != nil && inv.ExpiresAt.Before(time.Now()) {
+		return false, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "expires_at must be in the future",
+		})
+	}
+	return true, nil
+}
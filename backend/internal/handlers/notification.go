@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// NotificationHandler serves the user's in-app notifications
+type NotificationHandler struct {
+	db *database.Database
+}
+
+func NewNotificationHandler(db *database.Database) *NotificationHandler {
+	return &NotificationHandler{db: db}
+}
+
+// ListNotifications returns a page of the user's notifications, newest
+// first, only unread ones with unread=true, and their unread count. Pages are
+// keyed by created_at: before= takes the previous page's next_before.
+func (h *NotificationHandler) ListNotifications(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var unread bool
+	if v := c.Query("unread"); v != "" {
+		unread, err = strconv.ParseBool(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "unread must be true or false",
+			})
+		}
+	}
+
+	var before *time.Time
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid before",
+				Details: "expected an RFC 3339 timestamp",
+			})
+		}
+		before = &t
+	}
+
+	list, err := h.db.GetNotifications(c.UserContext(), userID, unread, before, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch notifications",
+		})
+	}
+	count, err := h.db.CountUnreadNotifications(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch notifications",
+		})
+	}
+
+	resp := models.NotificationListResponse{Notifications: list, Unread: count}
+	if resp.Notifications == nil {
+		resp.Notifications = []models.Notification{}
+	}
+	if len(list) == limit {
+		resp.NextBefore = &list[len(list)-1].CreatedAt
+	}
+	return c.JSON(resp)
+}
+
+// MarkRead marks one of the user's notifications read and returns how many
+// are left unread
+func (h *NotificationHandler) MarkRead(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid notification ID",
+		})
+	}
+
+	found, err := h.db.MarkNotificationRead(c.UserContext(), userID, id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to update notification",
+		})
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "notification not found",
+		})
+	}
+
+	count, err := h.db.CountUnreadNotifications(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch notifications",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"unread": count,
+	})
+}
+
+// MarkAllRead marks all of the user's notifications read and returns how
+// many it marked
+func (h *NotificationHandler) MarkAllRead(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	n, err := h.db.MarkAllNotificationsRead(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to update notifications",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"marked": n,
+		"unread": 0,
+	})
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// planNameRegex is what plan names may look like
+var planNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,50}$`)
+
+// planLimitsByName returns every plan's limits, as the plans tables of the
+// capabilities and subscription responses show them. The built-in plans
+// stand in when the plans can't be read.
+func planLimitsByName(ctx context.Context, db *database.Database) map[string]models.PlanLimits {
+	plans, err := db.GetPlans(ctx)
+	if err != nil {
+		log.Printf("Failed to load plans: %v", err)
+		return models.DefaultPlans
+	}
+	limits := make(map[string]models.PlanLimits, len(plans))
+	for name, p := range plans {
+		limits[name] = p.Limits
+	}
+	return limits
+}
+
+// validatePlanLimits checks that no limit is negative. DownloadLimitGB may be
+// -1, for unlimited.
+func validatePlanLimits(l models.PlanLimits) error {
+	if l.DownloadLimitGB < -1 {
+		return fmt.Errorf("DownloadLimitGB must be -1 (unlimited) or more")
+	}
+	for name, v := range map[string]int{
+		"ConcurrentLimit": l.ConcurrentLimit, "RetentionDays": l.RetentionDays,
+		"PriceMonthly": l.PriceMonthly, "PriceAnnual": l.PriceAnnual, "MaxUploadMB": l.MaxUploadMB,
+		"ConcurrentUploads": l.ConcurrentUploads, "AddsPerHour": l.AddsPerHour,
+		"AddsPerDay": l.AddsPerDay, "StorageLimitGB": l.StorageLimitGB,
+		"ConcurrentZips": l.ConcurrentZips, "ConcurrentPreviews": l.ConcurrentPreviews,
+		"ConcurrentSeeds": l.ConcurrentSeeds,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if l.PrivateSeedRatio < 0 {
+		return fmt.Errorf("PrivateSeedRatio must not be negative")
+	}
+	return nil
+}
+
+// ListPlans returns every plan, by name
+func (h *AdminHandler) ListPlans(c *fiber.Ctx) error {
+	plans, err := h.db.GetPlans(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch plans",
+		})
+	}
+
+	list := make([]models.Plan, 0, len(plans))
+	for _, p := range plans {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Limits.PriceMonthly < list[j].Limits.PriceMonthly ||
+			list[i].Limits.PriceMonthly == list[j].Limits.PriceMonthly && list[i].Name < list[j].Name
+	})
+
+	return c.JSON(fiber.Map{
+		"plans": list,
+	})
+}
+
+// GetPlan returns one plan
+func (h *AdminHandler) GetPlan(c *fiber.Ctx) error {
+	plans, err := h.db.GetPlans(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch plans",
+		})
+	}
+	p, ok := plans[c.Params("name")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "plan not found",
+		})
+	}
+	return c.JSON(p)
+}
+
+// UpdatePlan creates or replaces a plan. Users on it get the new limits
+// straight away. A plan's price can't change while it is linked to a Stripe
+// price, since what Stripe charges wouldn't follow; link a new price instead.
+func (h *AdminHandler) UpdatePlan(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if !planNameRegex.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "plan name must be 1 to 50 lowercase letters, digits, dashes or underscores",
+		})
+	}
+
+	var req models.PlanRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if err := validatePlanLimits(req.Limits); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "invalid plan limits",
+			Code:    "INVALID_PLAN",
+			Details: err.Error(),
+		})
+	}
+	if req.StripePriceID != nil {
+		if *req.StripePriceID = strings.TrimSpace(*req.StripePriceID); *req.StripePriceID == "" {
+			req.StripePriceID = nil
+		}
+	}
+
+	plans, err := h.db.GetPlans(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch plans",
+		})
+	}
+	if old, ok := plans[name]; ok && old.StripePriceID != nil &&
+		req.StripePriceID != nil && *req.StripePriceID == *old.StripePriceID &&
+		req.Limits.PriceMonthly != old.Limits.PriceMonthly {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error:   "price can't change while the plan is linked to a Stripe price",
+			Code:    "PRICE_LOCKED",
+			Details: "set stripe_price_id to the price matching the new amount",
+		})
+	}
+
+	p := &models.Plan{Name: name, Limits: req.Limits, StripePriceID: req.StripePriceID}
+	if err := h.db.SavePlan(c.UserContext(), p); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save plan",
+		})
+	}
+
+	return c.JSON(p)
+}
+
+// DeletePlan deletes a plan, which nobody may be on. The free plan is what
+// users fall back to and can't be deleted.
+func (h *AdminHandler) DeletePlan(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "free" {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "the free plan can't be deleted",
+		})
+	}
+
+	n, err := h.db.CountPlanSubscribers(c.UserContext(), name)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to delete plan",
+		})
+	}
+	if n > 0 {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error:   "plan has subscribers",
+			Code:    "PLAN_IN_USE",
+			Details: fmt.Sprintf("%d users are on this plan; move them first", n),
+		})
+	}
+
+	deleted, err := h.db.DeletePlan(c.UserContext(), name)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to delete plan",
+		})
+	}
+	if !deleted {
+		// Gone already, or someone joined it since we counted
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "plan not found or in use",
+		})
+	}
+
+	return c.JSON(models.SuccessResponse{
+		Message: "plan deleted",
+	})
+}
+
+// publicPlansMaxAge is how long clients and proxies may cache the public
+// plans; the ETag lets them revalidate cheaply after that
+const publicPlansMaxAge = "public, max-age=300"
+
+// PlanHandler serves the plans to anyone, so pricing pages show what is
+// enforced instead of a copy of it
+type PlanHandler struct {
+	db *database.Database
+}
+
+func NewPlanHandler(db *database.Database) *PlanHandler {
+	return &PlanHandler{db: db}
+}
+
+// publicPlans returns the plans as shown publicly, cheapest first, and an
+// ETag that changes whenever a plan is saved or deleted
+func (h *PlanHandler) publicPlans(ctx context.Context) ([]models.PublicPlan, string, error) {
+	plans, err := h.db.GetPlans(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	list := make([]models.PublicPlan, 0, len(plans))
+	var latest int64
+	for name, p := range plans {
+		l := p.Limits
+		list = append(list, models.PublicPlan{
+			Name:         name,
+			PriceMonthly: l.PriceMonthly,
+			PriceAnnual:  l.PriceAnnual,
+			Limits: models.PublicPlanLimits{
+				DownloadGB:       l.DownloadLimitGB,
+				Concurrent:       l.ConcurrentLimit,
+				StorageGB:        l.StorageLimitGB,
+				RetentionDays:    l.RetentionDays,
+				MaxUploadMB:      l.MaxUploadMB,
+				AddsPerHour:      l.AddsPerHour,
+				AddsPerDay:       l.AddsPerDay,
+				ConcurrentZips:   l.ConcurrentZips,
+				PrivateSeedRatio: l.PrivateSeedRatio,
+				ConcurrentSeeds:  l.ConcurrentSeeds,
+			},
+			Features: models.PublicPlanFeatures{
+				UnlimitedBandwidth: l.DownloadLimitGB < 0,
+				ExtendRetention:    name != "free", // see ExtendTorrent
+				PrivateSeeding:     l.PrivateSeedRatio > 0,
+				SeedOwnFiles:       l.ConcurrentSeeds > 0,
+			},
+		})
+		if t := p.UpdatedAt.UnixNano(); t > latest {
+			latest = t
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PriceMonthly < list[j].PriceMonthly ||
+			list[i].PriceMonthly == list[j].PriceMonthly && list[i].Name < list[j].Name
+	})
+
+	return list, fmt.Sprintf(`W/"plans-%d-%d"`, latest, len(list)), nil
+}
+
+// cachePlans sets the caching headers of a public plans response and
+// reports whether the client's copy is current, in which case it has
+// answered 304
+func cachePlans(c *fiber.Ctx, etag string) bool {
+	c.Set(fiber.HeaderCacheControl, publicPlansMaxAge)
+	c.Set(fiber.HeaderETag, etag)
+	if c.Get(fiber.HeaderIfNoneMatch) == etag {
+		c.Status(fiber.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ListPlans returns every plan's prices, limits and features
+func (h *PlanHandler) ListPlans(c *fiber.Ctx) error {
+	plans, etag, err := h.publicPlans(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch plans",
+		})
+	}
+	if cachePlans(c, etag) {
+		return nil
+	}
+
+	return c.JSON(fiber.Map{
+		"plans": plans,
+	})
+}
+
+// EstimatePlan returns the cheapest plan allowing gb of downloads a month
+// and concurrent downloads at once, by the limits the plans enforce. Both
+// default to 0.
+func (h *PlanHandler) EstimatePlan(c *fiber.Ctx) error {
+	gb, err := strconv.Atoi(c.Query("gb", "0"))
+	if err != nil || gb < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "gb must be a whole number of GB, 0 or more",
+		})
+	}
+	concurrent, err := strconv.Atoi(c.Query("concurrent", "0"))
+	if err != nil || concurrent < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "concurrent must be a whole number, 0 or more",
+		})
+	}
+
+	plans, etag, err := h.publicPlans(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch plans",
+		})
+	}
+	if cachePlans(c, etag) {
+		return nil
+	}
+
+	// Plans are cheapest first, so the first that fits is the answer
+	for _, p := range plans {
+		if (p.Limits.DownloadGB < 0 || p.Limits.DownloadGB >= gb) && p.Limits.Concurrent >= concurrent {
+			return c.JSON(fiber.Map{
+				"gb":         gb,
+				"concurrent": concurrent,
+				"plan":       p,
+			})
+		}
+	}
+	return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+		Error: "no plan allows that much",
+		Code:  "NO_MATCHING_PLAN",
+	})
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// TestPublicPlans runs the public plan endpoints against TEST_DATABASE_URL:
+// a saved plan shows up in both without a restart, and responses are
+// cached by ETag
+func TestPublicPlans(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := database.New(url, false)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	h := NewPlanHandler(db)
+	app := fiber.New()
+	app.Get("/plans", h.ListPlans)
+	app.Get("/plans/estimate", h.EstimatePlan)
+
+	get := func(path, etag string) (*http.Response, map[string]json.RawMessage) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set(fiber.HeaderIfNoneMatch, etag)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var body map[string]json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	// More than any seeded plan allows
+	const huge = "/plans/estimate?gb=100&concurrent=1000000"
+	if resp, body := get(huge, ""); resp.StatusCode != http.StatusNotFound || string(body["code"]) != `"NO_MATCHING_PLAN"` {
+		t.Fatalf("estimate before the plan exists: status %d, code %s", resp.StatusCode, body["code"])
+	}
+	for _, path := range []string{"/plans/estimate?gb=-1", "/plans/estimate?concurrent=x"} {
+		if resp, _ := get(path, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", path, resp.StatusCode)
+		}
+	}
+	resp, _ := get("/plans", "")
+	before := resp.Header.Get(fiber.HeaderETag)
+
+	plan := &models.Plan{
+		Name:   "test-" + uuid.NewString()[:8],
+		Limits: models.PlanLimits{DownloadLimitGB: -1, ConcurrentLimit: 1000000, PriceMonthly: 1},
+	}
+	if err := db.SavePlan(ctx, plan); err != nil {
+		t.Fatalf("save plan: %v", err)
+	}
+	t.Cleanup(func() { db.DeletePlan(ctx, plan.Name) })
+
+	resp, body := get("/plans", "")
+	etag := resp.Header.Get(fiber.HeaderETag)
+	if etag == "" || etag == before {
+		t.Errorf("ETag %q after saving a plan, was %q", etag, before)
+	}
+	if resp.Header.Get(fiber.HeaderCacheControl) != publicPlansMaxAge {
+		t.Errorf("Cache-Control %q", resp.Header.Get(fiber.HeaderCacheControl))
+	}
+	var plans []models.PublicPlan
+	json.Unmarshal(body["plans"], &plans)
+	found := false
+	for _, p := range plans {
+		if p.Name == plan.Name {
+			found = p.Limits.Concurrent == 1000000 && p.Features.UnlimitedBandwidth
+		}
+	}
+	if !found {
+		t.Errorf("saved plan missing from /plans: %+v", plans)
+	}
+	if resp, _ := get("/plans", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET /plans with its ETag: status %d, want 304", resp.StatusCode)
+	}
+
+	resp, body = get(huge, "")
+	var estimate models.PublicPlan
+	json.Unmarshal(body["plan"], &estimate)
+	if resp.StatusCode != http.StatusOK || estimate.Name != plan.Name {
+		t.Errorf("estimate after saving the plan: status %d, plan %q, want %q", resp.StatusCode, estimate.Name, plan.Name)
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxDownloadRedirects bounds the redirects, which every request is
+// checked against
+const maxDownloadRedirects = 20
+
+// LoadDownloadRedirects puts the redirects saved in the settings into r
+func LoadDownloadRedirects(ctx context.Context, db *database.Database, r *middleware.DownloadRedirects) error {
+	var redirects []models.DownloadRedirect
+	if _, err := db.GetSetting(ctx, models.SettingDownloadRedirects, &redirects); err != nil {
+		return err
+	}
+	r.Set(redirects)
+	return nil
+}
+
+// GetDownloadRedirects returns the download redirects with how often this
+// server has answered each
+func (h *AdminHandler) GetDownloadRedirects(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"redirects": h.redirects.Stats(),
+	})
+}
+
+// UpdateDownloadRedirects replaces the download redirects. This server
+// applies them at once, others within a minute.
+func (h *AdminHandler) UpdateDownloadRedirects(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "unauthorized",
+		})
+	}
+
+	var req struct {
+		Redirects []models.DownloadRedirect `json:"redirects"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if err := normalizeDownloadRedirects(req.Redirects); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "invalid redirects",
+			Code:    "INVALID_REDIRECT",
+			Details: err.Error(),
+		})
+	}
+	if req.Redirects == nil {
+		req.Redirects = []models.DownloadRedirect{}
+	}
+
+	if err := h.db.SetSetting(c.UserContext(), models.SettingDownloadRedirects, req.Redirects, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save redirects",
+		})
+	}
+	h.redirects.Set(req.Redirects)
+
+	return c.JSON(fiber.Map{
+		"redirects": h.redirects.Stats(),
+	})
+}
+
+// DeleteDownloadRedirects removes every download redirect
+func (h *AdminHandler) DeleteDownloadRedirects(c *fiber.Ctx) error {
+	if _, err := h.db.DeleteSetting(c.UserContext(), models.SettingDownloadRedirects); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to remove redirects",
+		})
+	}
+	h.redirects.Set(nil)
+
+	return c.JSON(models.SuccessResponse{
+		Message: "redirects removed",
+	})
+}
+
+// normalizeDownloadRedirects checks redirects, lowercasing hosts and
+// trimming the base URLs' trailing slash where the path is kept. A
+// redirect must not match where it sends requests, and a path prefix may
+// only take over API paths that are downloads.
+func normalizeDownloadRedirects(redirects []models.DownloadRedirect) error {
+	if len(redirects) > maxDownloadRedirects {
+		return fmt.Errorf("at most %d redirects", maxDownloadRedirects)
+	}
+	for i := range redirects {
+		r := &redirects[i]
+		r.Host = strings.ToLower(strings.TrimSpace(r.Host))
+		r.PathPrefix = strings.TrimSpace(r.PathPrefix)
+		r.BaseURL = strings.TrimSpace(r.BaseURL)
+
+		if r.Host == "" && r.PathPrefix == "" {
+			return fmt.Errorf("redirect %d: host or path_prefix required", i+1)
+		}
+		if r.Host != "" && (strings.ContainsAny(r.Host, "/?#@ ") || strings.Contains(r.Host, "://")) {
+			return fmt.Errorf("redirect %d: host must be a Host header such as dl.example.com", i+1)
+		}
+		if r.PathPrefix != "" {
+			if !strings.HasPrefix(r.PathPrefix, "/") || r.PathPrefix == "/" {
+				return fmt.Errorf("redirect %d: path_prefix must start with / and not be /", i+1)
+			}
+			if (strings.HasPrefix(r.PathPrefix, "/api") || strings.HasPrefix(r.PathPrefix, "/health")) &&
+				!middleware.IsDownloadPath(r.PathPrefix) {
+				return fmt.Errorf("redirect %d: path_prefix may only cover API paths under %s", i+1,
+					strings.Join(middleware.DownloadPaths, " or "))
+			}
+		}
+
+		u, err := url.Parse(r.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("redirect %d: base_url must be an absolute http(s) URL", i+1)
+		}
+		if r.PathPrefix == "" {
+			r.BaseURL = strings.TrimRight(r.BaseURL, "/")
+		}
+		onSameHost := r.Host == "" || strings.EqualFold(r.Host, u.Host)
+		if onSameHost && (r.PathPrefix == "" || strings.HasPrefix(u.Path, r.PathPrefix)) {
+			return fmt.Errorf("redirect %d: base_url would be redirected again", i+1)
+		}
+	}
+	return nil
+}
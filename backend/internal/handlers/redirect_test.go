@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+func TestNormalizeDownloadRedirects(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect models.DownloadRedirect
+		want     string // the error must mention it; "" for none
+	}{
+		{"host", models.DownloadRedirect{Host: "old.example.com", BaseURL: "https://dl.example.com"}, ""},
+		{"host with port", models.DownloadRedirect{Host: "old.example.com:8080", BaseURL: "https://dl.example.com"}, ""},
+		{"path prefix", models.DownloadRedirect{PathPrefix: "/files/", BaseURL: "https://dl.example.com/api/v1/download/"}, ""},
+		{"download path prefix on a host", models.DownloadRedirect{Host: "old.example.com", PathPrefix: "/api/v1/dl/", BaseURL: "https://dl.example.com/api/v1/dl/"}, ""},
+
+		{"neither", models.DownloadRedirect{BaseURL: "https://dl.example.com"}, "host or path_prefix"},
+		{"host with scheme", models.DownloadRedirect{Host: "https://old.example.com", BaseURL: "https://dl.example.com"}, "host"},
+		{"relative prefix", models.DownloadRedirect{PathPrefix: "files/", BaseURL: "https://dl.example.com"}, "path_prefix"},
+		{"root prefix", models.DownloadRedirect{PathPrefix: "/", BaseURL: "https://dl.example.com"}, "path_prefix"},
+		{"api prefix", models.DownloadRedirect{PathPrefix: "/api/v1/", BaseURL: "https://dl.example.com/api/v1/"}, "API paths"},
+		{"relative base", models.DownloadRedirect{Host: "old.example.com", BaseURL: "dl.example.com"}, "base_url"},
+		{"base with query", models.DownloadRedirect{Host: "old.example.com", BaseURL: "https://dl.example.com/?a=1"}, "base_url"},
+		{"to its own host", models.DownloadRedirect{Host: "dl.example.com", BaseURL: "https://DL.example.com"}, "redirected again"},
+		{"to its own prefix", models.DownloadRedirect{PathPrefix: "/api/v1/dl/", BaseURL: "https://dl.example.com/api/v1/dl/"}, "redirected again"},
+	}
+	for _, tt := range tests {
+		err := normalizeDownloadRedirects([]models.DownloadRedirect{tt.redirect})
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	redirects := []models.DownloadRedirect{{Host: " Old.Example.com ", BaseURL: "https://dl.example.com/ "}}
+	if err := normalizeDownloadRedirects(redirects); err != nil || redirects[0].Host != "old.example.com" || redirects[0].BaseURL != "https://dl.example.com" {
+		t.Errorf("normalized: %+v, %v", redirects, err)
+	}
+
+	if err := normalizeDownloadRedirects(make([]models.DownloadRedirect, maxDownloadRedirects+1)); err == nil {
+		t.Error("too many redirects accepted")
+	}
+}
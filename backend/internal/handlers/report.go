@@ -0,0 +1,471 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/redact"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	maxReportContact = 255
+	maxReportReason  = 5000
+	maxReportURL     = 2048
+
+	// captchaTimeout bounds the siteverify call of a report's CAPTCHA
+	captchaTimeout = 10 * time.Second
+)
+
+// ReportHandler takes abuse reports from anyone, rights holders mostly
+type ReportHandler struct {
+	db     *database.Database
+	cfg    *config.Config
+	signer *auth.DownloadSigner
+	client *http.Client
+}
+
+func NewReportHandler(db *database.Database, cfg *config.Config, signer *auth.DownloadSigner) *ReportHandler {
+	return &ReportHandler{
+		db:     db,
+		cfg:    cfg,
+		signer: signer,
+		client: &http.Client{Timeout: captchaTimeout},
+	}
+}
+
+// CreateReport stores an abuse report naming a torrent by info hash (or
+// magnet URI) or by one of our download URLs. Reports are kept even when
+// nobody has the torrent, so repeat submissions show up for admins.
+func (h *ReportHandler) CreateReport(c *fiber.Ctx) error {
+	var req models.AbuseReportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	req.Contact = strings.TrimSpace(req.Contact)
+	req.Reason = strings.TrimSpace(req.Reason)
+	req.InfoHash = strings.TrimSpace(req.InfoHash)
+	req.DownloadURL = strings.TrimSpace(req.DownloadURL)
+
+	switch {
+	case req.Contact == "" || len(req.Contact) > maxReportContact:
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "invalid contact",
+			Details: "contact is required, up to 255 characters",
+		})
+	case req.Reason == "" || len(req.Reason) > maxReportReason:
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "invalid reason",
+			Details: "reason is required, up to 5000 characters",
+		})
+	case req.InfoHash == "" && req.DownloadURL == "":
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "info_hash or download_url required",
+		})
+	case len(req.DownloadURL) > maxReportURL:
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "download_url is too long",
+		})
+	}
+
+	if h.cfg.CaptchaSecret != "" {
+		ok, err := h.verifyCaptcha(c.UserContext(), req.CaptchaToken, middleware.ClientIP(c))
+		if err != nil {
+			log.Printf("Failed to verify report CAPTCHA: %v", err)
+			return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+				Error: "failed to verify CAPTCHA",
+			})
+		}
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "CAPTCHA failed",
+				Code:  "CAPTCHA_FAILED",
+			})
+		}
+	}
+
+	report := &models.AbuseReport{
+		DownloadURL: req.DownloadURL,
+		Contact:     req.Contact,
+		Reason:      req.Reason,
+		ReporterIP:  middleware.ClientIP(c),
+	}
+	if req.InfoHash != "" {
+		_, infoHash, err := importMagnet(req.InfoHash)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid info_hash",
+				Details: redact.Error(err),
+			})
+		}
+		report.InfoHash = infoHash
+	} else {
+		report.InfoHash = h.downloadInfoHash(c.UserContext(), req.DownloadURL)
+	}
+
+	if err := h.db.CreateAbuseReport(c.UserContext(), report); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save report",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":         report.ID,
+		"status":     report.Status,
+		"created_at": report.CreatedAt,
+	})
+}
+
+// downloadInfoHash finds the info hash behind one of our download URLs,
+// /download/:token or /dl/:token, expired or not. It returns "" for URLs
+// it can't place; the report is kept with the URL for admins to look at.
+func (h *ReportHandler) downloadInfoHash(ctx context.Context, downloadURL string) string {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	kind, token := parts[len(parts)-2], parts[len(parts)-1]
+
+	switch kind {
+	case "dl":
+		if d, err := h.signer.Decode(token); err == nil {
+			return d.InfoHash
+		}
+	case "download":
+		dt, err := h.db.GetDownloadToken(ctx, token)
+		if err != nil || dt == nil {
+			return ""
+		}
+		t, err := h.db.GetTorrent(ctx, dt.TorrentID)
+		if err == nil && t != nil {
+			return t.InfoHash
+		}
+	}
+	return ""
+}
+
+// verifyCaptcha checks a CAPTCHA answer at the siteverify endpoint
+// Turnstile and hCaptcha share
+func (h *ReportHandler) verifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {h.cfg.CaptchaSecret}, "response": {token}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.CaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// ListReports returns a page of abuse reports, open ones unless status says
+// otherwise ("all" for every status), each with the torrents users have of
+// its info hash. Pages like activity.
+func (h *AdminHandler) ListReports(c *fiber.Ctx) error {
+	status := c.Query("status", models.ReportOpen)
+	switch status {
+	case models.ReportOpen, models.ReportTakenDown, models.ReportRejected:
+	case "all":
+		status = ""
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "invalid status",
+			Details: "expected open, taken_down, rejected or all",
+		})
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	var before *time.Time
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid before",
+				Details: "expected an RFC 3339 timestamp",
+			})
+		}
+		before = &t
+	}
+
+	reports, err := h.db.GetAbuseReports(c.UserContext(), status, before, limit)
+	if err == nil {
+		err = h.attachReportTorrents(c.UserContext(), reports)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch reports",
+		})
+	}
+
+	resp := models.AbuseReportListResponse{Reports: reports}
+	if resp.Reports == nil {
+		resp.Reports = []models.AbuseReport{}
+	}
+	if len(reports) == limit {
+		resp.NextBefore = &reports[len(reports)-1].CreatedAt
+	}
+	return c.JSON(resp)
+}
+
+// GetReport returns an abuse report with the torrents users have of its
+// info hash
+func (h *AdminHandler) GetReport(c *fiber.Ctx) error {
+	report, ok, err := h.report(c)
+	if !ok {
+		return err
+	}
+	reports := []models.AbuseReport{*report}
+	if err := h.attachReportTorrents(c.UserContext(), reports); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrents",
+		})
+	}
+	return c.JSON(reports[0])
+}
+
+// TakedownReport blocks the reported info hash, removes every user's
+// torrent of it with its data, and closes this and every other open report
+// of it as taken down with the admin's note
+func (h *AdminHandler) TakedownReport(c *fiber.Ctx) error {
+	adminID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	var req models.ReportResolution
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid request body",
+			})
+		}
+	}
+
+	report, ok, err := h.report(c)
+	if !ok {
+		return err
+	}
+	if report.Status != models.ReportOpen {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "report is already resolved",
+			Code:  "REPORT_RESOLVED",
+		})
+	}
+	if report.InfoHash == "" {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error:   "report doesn't name a torrent we can find",
+			Code:    "REPORT_NO_INFO_HASH",
+			Details: "reject it, or block the torrent by hand once it is identified",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), report.InfoHash)
+
+	// Blocked first, so nobody re-adds it while it is being removed
+	reason := "abuse report " + report.ID.String()
+	if req.Note != "" {
+		reason += ": " + req.Note
+	}
+	if err := h.db.BlockInfoHash(c.UserContext(), &models.BlockedHash{
+		InfoHash:  report.InfoHash,
+		Reason:    reason,
+		ReportID:  &report.ID,
+		BlockedBy: &adminID,
+	}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to block torrent",
+		})
+	}
+
+	torrents, err := h.db.GetTorrentsByInfoHash(c.UserContext(), report.InfoHash)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrents",
+		})
+	}
+	for _, t := range torrents {
+		h.engine.RemoveOwner(t.InfoHash, t.ID, true)
+		if err := h.db.LogTorrentTakenDown(c.UserContext(), &t, report.ID); err != nil {
+			log.Printf("Failed to log takedown of %s: %v", t.ID, err)
+		}
+		if err := h.db.DeleteTorrent(c.UserContext(), t.ID, models.ClosedDMCA); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to delete torrent",
+			})
+		}
+		h.hooks.OnTorrentDeleted(&t, hooks.DeleteReasonTakedown)
+	}
+
+	resolved, err := h.db.ResolveAbuseReports(c.UserContext(), report.ID, report.InfoHash, models.ReportTakenDown, req.Note, adminID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to resolve report",
+		})
+	}
+	log.Printf("Admin %s took down %s for report %s: %d torrents removed, %d reports resolved",
+		adminID, report.InfoHash, report.ID, len(torrents), resolved)
+
+	return c.JSON(fiber.Map{
+		"info_hash":        report.InfoHash,
+		"torrents_removed": len(torrents),
+		"reports_resolved": resolved,
+	})
+}
+
+// RejectReport closes an abuse report without acting on it
+func (h *AdminHandler) RejectReport(c *fiber.Ctx) error {
+	adminID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	var req models.ReportResolution
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid request body",
+			})
+		}
+	}
+
+	report, ok, err := h.report(c)
+	if !ok {
+		return err
+	}
+	resolved, err := h.db.ResolveAbuseReports(c.UserContext(), report.ID, "", models.ReportRejected, req.Note, adminID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to resolve report",
+		})
+	}
+	if resolved == 0 {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "report is already resolved",
+			Code:  "REPORT_RESOLVED",
+		})
+	}
+
+	return c.JSON(models.SuccessResponse{
+		Message: "report rejected",
+	})
+}
+
+// ListBlockedHashes returns every info hash that may not be added
+func (h *AdminHandler) ListBlockedHashes(c *fiber.Ctx) error {
+	blocked, err := h.db.GetBlockedHashes(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch blocked hashes",
+		})
+	}
+	if blocked == nil {
+		blocked = []models.BlockedHash{}
+	}
+
+	return c.JSON(fiber.Map{
+		"blocked_hashes": blocked,
+	})
+}
+
+// UnblockHash lets an info hash be added again. Torrents removed when it
+// was blocked stay removed.
+func (h *AdminHandler) UnblockHash(c *fiber.Ctx) error {
+	unblocked, err := h.db.UnblockInfoHash(c.UserContext(), c.Params("hash"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to unblock hash",
+		})
+	}
+	if !unblocked {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "hash is not blocked",
+		})
+	}
+
+	return c.JSON(models.SuccessResponse{
+		Message: "hash unblocked",
+	})
+}
+
+// report loads the report named by the :id parameter. Reports false once it
+// has responded.
+func (h *AdminHandler) report(c *fiber.Ctx) (*models.AbuseReport, bool, error) {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, false, c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid report ID",
+		})
+	}
+	report, err := h.db.GetAbuseReport(c.UserContext(), id)
+	if err != nil {
+		return nil, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch report",
+		})
+	}
+	if report == nil {
+		return nil, false, c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "report not found",
+		})
+	}
+	return report, true, nil
+}
+
+// attachReportTorrents sets the torrents users have of each report's info
+// hash, looking each hash up once
+func (h *AdminHandler) attachReportTorrents(ctx context.Context, reports []models.AbuseReport) error {
+	byHash := make(map[string][]models.AdminTorrent)
+	for i := range reports {
+		infoHash := reports[i].InfoHash
+		if infoHash == "" {
+			continue
+		}
+		matches, seen := byHash[infoHash]
+		if !seen {
+			torrents, err := h.db.GetTorrentsByInfoHash(ctx, infoHash)
+			if err != nil {
+				return err
+			}
+			matches = models.NewAdminTorrents(torrents)
+			byHash[infoHash] = matches
+		}
+		reports[i].Torrents = matches
+	}
+	return nil
+}
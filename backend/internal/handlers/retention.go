@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetFailedRetention returns how many days failed and cancelled torrents
+// are kept before cleanup purges them
+func (h *AdminHandler) GetFailedRetention(c *fiber.Ctx) error {
+	retention, err := h.completer.FailedRetention(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to read retention",
+		})
+	}
+	return c.JSON(retention)
+}
+
+// UpdateFailedRetention sets how many days failed and cancelled torrents
+// are kept. It applies from the next cleanup, on every server.
+func (h *AdminHandler) UpdateFailedRetention(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "unauthorized",
+		})
+	}
+
+	var req struct {
+		Days int `json:"days"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if req.Days < config.MinFailedRetentionDays || req.Days > config.MaxFailedRetentionDays {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid retention",
+			Code:  "INVALID_RETENTION",
+			Details: fmt.Sprintf("days must be between %d and %d",
+				config.MinFailedRetentionDays, config.MaxFailedRetentionDays),
+		})
+	}
+
+	if err := h.db.SetSetting(c.UserContext(), models.SettingFailedRetentionDays, req.Days, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save retention",
+		})
+	}
+	return h.GetFailedRetention(c)
+}
+
+// DeleteFailedRetention goes back to FAILED_RETENTION_DAYS
+func (h *AdminHandler) DeleteFailedRetention(c *fiber.Ctx) error {
+	if _, err := h.db.DeleteSetting(c.UserContext(), models.SettingFailedRetentionDays); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to reset retention",
+		})
+	}
+	return h.GetFailedRetention(c)
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/search"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxSearchQuery bounds search queries, in characters
+const maxSearchQuery = 200
+
+// SearchHandler searches the configured Torznab providers and adds results
+// through the torrent handler's add flow
+type SearchHandler struct {
+	enabled  bool
+	searcher *search.Searcher
+	torrents *TorrentHandler
+}
+
+func NewSearchHandler(cfg *config.Config, searcher *search.Searcher, torrents *TorrentHandler) *SearchHandler {
+	return &SearchHandler{
+		enabled:  cfg.Capabilities().Search,
+		searcher: searcher,
+		torrents: torrents,
+	}
+}
+
+// searchDisabled answers search routes when no providers are configured
+func searchDisabled(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+		Error: "search not configured",
+	})
+}
+
+// Search queries the providers for q, or only the one named by provider
+func (h *SearchHandler) Search(c *fiber.Ctx) error {
+	if !h.enabled {
+		return searchDisabled(c)
+	}
+
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" || utf8.RuneCountInString(q) > maxSearchQuery {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "q must be 1 to 200 characters",
+		})
+	}
+
+	resp, err := h.searcher.Search(c.UserContext(), userID, q, c.Query("provider"))
+	if errors.Is(err, search.ErrUnknownProvider) {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "unknown provider",
+			Code:  "UNKNOWN_PROVIDER",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "search failed",
+		})
+	}
+
+	return c.JSON(resp)
+}
+
+// AddResult adds a result of one of the user's recent searches, by its ID,
+// exactly as if its magnet or .torrent link had been added directly
+func (h *SearchHandler) AddResult(c *fiber.Ctx) error {
+	if !h.enabled {
+		return searchDisabled(c)
+	}
+
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var req models.SearchAddRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	result, ok := h.searcher.Result(userID, req.ID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error:   "search result not found",
+			Code:    "RESULT_EXPIRED",
+			Details: "results can be added for 30 minutes; search again",
+		})
+	}
+
+	add := models.AddTorrentRequest{
+		MagnetURI:    result.MagnetURI,
+		Zip:          req.Zip,
+		CollectionID: req.CollectionID,
+	}
+	if add.MagnetURI == "" {
+		add.TorrentURL = result.Link
+	}
+	return h.torrents.addTorrent(c, userID, add)
+}
@@ -4,11 +4,12 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/events"
 	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
 	"github.com/freetorrent/freetorrent/internal/torrent"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -16,53 +17,63 @@ import (
 )
 
 type SSEHandler struct {
-	engine      *torrent.Engine
-	authService *auth.AuthService
+	engine  torrent.Service
+	tickets *auth.TicketStore
+	events  *events.Broker
 }
 
-func NewSSEHandler(engine *torrent.Engine, authService *auth.AuthService) *SSEHandler {
+func NewSSEHandler(engine torrent.Service, tickets *auth.TicketStore, broker *events.Broker) *SSEHandler {
 	return &SSEHandler{
-		engine:      engine,
-		authService: authService,
+		engine:  engine,
+		tickets: tickets,
+		events:  broker,
 	}
 }
 
-// getSSEUserID extracts user ID from either Authorization header or token query param
-// This allows SSE to work with both standard auth middleware and browser EventSource
-func (h *SSEHandler) getSSEUserID(c *fiber.Ctx) (uuid.UUID, string, error) {
-	// First try standard middleware (Authorization header)
+// CreateTicket issues a single-use ticket for opening an event stream as
+// the current user, passed as ?ticket= so the access token stays out of URLs
+func (h *SSEHandler) CreateTicket(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
-	if err == nil {
-		role := middleware.GetUserRole(c)
-		return userID, role, nil
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
 	}
 
-	// Fall back to token query parameter for EventSource compatibility
-	token := c.Query("token")
-	if token == "" {
-		// Also check Authorization header directly (in case middleware didn't run)
-		authHeader := c.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
+	ticket, err := h.tickets.Issue(auth.Claims{
+		UserID: userID.String(),
+		Email:  middleware.GetUserEmail(c),
+		Role:   middleware.GetUserRole(c),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create ticket",
+		})
 	}
 
-	if token == "" {
-		return uuid.Nil, "", fmt.Errorf("no authentication token")
-	}
+	return c.JSON(fiber.Map{
+		"ticket":     ticket,
+		"expires_in": int(auth.TicketTTL.Seconds()),
+	})
+}
 
-	// Validate the token
-	claims, err := h.authService.ValidateAccessToken(token)
+// writeEvent writes a broker event as an SSE frame
+func writeEvent(w *bufio.Writer, ev events.Event) error {
+	data, err := json.Marshal(ev.Data)
 	if err != nil {
-		return uuid.Nil, "", fmt.Errorf("invalid token: %w", err)
+		return nil
 	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return w.Flush()
+}
 
-	uid, err := uuid.Parse(claims.UserID)
+// getSSEUserID returns the user SSEAuthMiddleware authenticated
+func (h *SSEHandler) getSSEUserID(c *fiber.Ctx) (uuid.UUID, string, error) {
+	userID, err := middleware.GetUserID(c)
 	if err != nil {
-		return uuid.Nil, "", fmt.Errorf("invalid user ID in token")
+		return uuid.Nil, "", err
 	}
-
-	return uid, claims.Role, nil
+	return userID, middleware.GetUserRole(c), nil
 }
 
 // Events streams real-time torrent updates via Server-Sent Events
@@ -80,7 +91,11 @@ func (h *SSEHandler) Events(c *fiber.Ctx) error {
 	c.Set("Transfer-Encoding", "chunked")
 	c.Set("Access-Control-Allow-Origin", "*")
 
+	userEvents, unsubscribe := h.events.Subscribe(userID)
+
 	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
 		// Send initial connection message
 		fmt.Fprintf(w, "event: connected\ndata: {\"status\":\"connected\"}\n\n")
 		w.Flush()
@@ -91,6 +106,9 @@ func (h *SSEHandler) Events(c *fiber.Ctx) error {
 		// Keep connection alive for max 30 minutes
 		timeout := time.After(30 * time.Minute)
 
+		// The summary is sent when it changes
+		var summary torrent.UserAggregate
+
 		for {
 			select {
 			case <-timeout:
@@ -98,6 +116,11 @@ func (h *SSEHandler) Events(c *fiber.Ctx) error {
 				w.Flush()
 				return
 
+			case ev := <-userEvents:
+				if err := writeEvent(w, ev); err != nil {
+					return
+				}
+
 			case <-ticker.C:
 				// Get user's torrents
 				torrents := h.engine.GetUserTorrents(userID)
@@ -115,6 +138,13 @@ func (h *SSEHandler) Events(c *fiber.Ctx) error {
 					}
 				}
 
+				if s := h.engine.GetUserAggregate(userID); s != summary {
+					summary = s
+					if err := writeEvent(w, events.Event{Type: "summary", Data: s}); err != nil {
+						return
+					}
+				}
+
 				// Send heartbeat
 				fmt.Fprintf(w, "event: heartbeat\ndata: {\"time\":%d}\n\n", time.Now().Unix())
 				if err := w.Flush(); err != nil {
@@ -146,7 +176,11 @@ func (h *SSEHandler) EventsAll(c *fiber.Ctx) error {
 	c.Set("Connection", "keep-alive")
 	c.Set("Transfer-Encoding", "chunked")
 
+	allEvents, unsubscribe := h.events.SubscribeAll()
+
 	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
 		fmt.Fprintf(w, "event: connected\ndata: {\"status\":\"connected\"}\n\n")
 		w.Flush()
 
@@ -162,6 +196,11 @@ func (h *SSEHandler) EventsAll(c *fiber.Ctx) error {
 				w.Flush()
 				return
 
+			case ev := <-allEvents:
+				if err := writeEvent(w, ev); err != nil {
+					return
+				}
+
 			case <-ticker.C:
 				torrents := h.engine.GetActiveTorrents()
 				
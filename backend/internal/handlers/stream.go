@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// ndjsonContentType is the media type of streamed lists, one JSON object a
+// line
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonFlushRows is how many rows are buffered before they are flushed to
+// the client
+const ndjsonFlushRows = 100
+
+// ndjsonTimeout is how long a stream may run before it's ended, so a slow
+// or stalled client can't hold a database query open indefinitely
+var ndjsonTimeout = 10 * time.Minute
+
+// wantsStream reports whether a list was asked for as a stream, with
+// stream=true or by accepting NDJSON
+func wantsStream(c *fiber.Ctx) bool {
+	return c.QueryBool("stream") || strings.Contains(c.Get(fiber.HeaderAccept), ndjsonContentType)
+}
+
+// streamNDJSON responds with the rows each passes to emit, one JSON object
+// a line, writing them as they come rather than gathering them first. each
+// runs after the handler returns, so it must not use c; its context is
+// cancelled once a write to the client fails or after ndjsonTimeout, and
+// emit fails from then on. An error once rows have been sent can't change
+// the status, so the stream ends with an error object in ErrorResponse
+// form instead.
+func streamNDJSON(c *fiber.Ctx, name string, each func(ctx context.Context, emit func(v any) error) error) error {
+	c.Set(fiber.HeaderContentType, ndjsonContentType)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithTimeout(context.Background(), ndjsonTimeout)
+		defer cancel()
+
+		var rows int
+		var writeErr error
+		write := func(data []byte) error {
+			if writeErr != nil {
+				return writeErr
+			}
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				writeErr = err
+				cancel()
+				return err
+			}
+			return nil
+		}
+		emit := func(v any) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := write(data); err != nil {
+				return err
+			}
+			rows++
+			if rows%ndjsonFlushRows == 0 {
+				if err := w.Flush(); err != nil {
+					writeErr = err
+					cancel()
+					return err
+				}
+			}
+			return nil
+		}
+
+		err := each(ctx, emit)
+		if err != nil && writeErr == nil {
+			log.Printf("%s stream failed after %d rows: %v", name, rows, err)
+			resp := models.ErrorResponse{Error: "stream failed"}
+			if errors.Is(err, context.DeadlineExceeded) {
+				resp = models.ErrorResponse{Error: "stream timed out", Code: "STREAM_TIMEOUT"}
+			}
+			data, _ := json.Marshal(resp)
+			write(data)
+		}
+		if writeErr == nil {
+			writeErr = w.Flush()
+		}
+		if writeErr != nil {
+			log.Printf("%s stream stopped after %d rows: %v", name, rows, writeErr)
+		}
+	}))
+	return nil
+}
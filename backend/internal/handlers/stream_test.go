@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// streamServer serves streamNDJSON over a real connection, as app.Test
+// would buffer the whole response
+func streamServer(tb testing.TB, each func(ctx context.Context, emit func(v any) error) error) string {
+	tb.Helper()
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/", func(c *fiber.Ctx) error { return streamNDJSON(c, "Test", each) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go app.Listener(ln)
+	tb.Cleanup(func() { app.Shutdown() })
+	return "http://" + ln.Addr().String() + "/"
+}
+
+// syntheticTorrent is a list row of typical size
+func syntheticTorrent(i int) models.AdminTorrent {
+	t := models.Torrent{
+		ID:        uuid.New(),
+		UserID:    uuid.New(),
+		InfoHash:  fmt.Sprintf("%040x", i),
+		Name:      fmt.Sprintf("Synthetic.Torrent.%d.1080p.mkv", i),
+		Status:    models.TorrentStatusCompleted,
+		TotalSize: 1 << 30,
+		Progress:  100,
+		CreatedAt: time.Now(),
+	}
+	return models.AdminTorrent{Torrent: t, TorrentAudit: t.Audit}
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	get := func(url string) []string {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get(fiber.HeaderContentType); ct != ndjsonContentType {
+			t.Errorf("content type %q", ct)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	}
+
+	url := streamServer(t, func(ctx context.Context, emit func(v any) error) error {
+		for i := 0; i < 250; i++ {
+			if err := emit(syntheticTorrent(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	lines := get(url)
+	if len(lines) != 250 {
+		t.Fatalf("got %d lines, want 250", len(lines))
+	}
+	var row models.AdminTorrent
+	if err := json.Unmarshal([]byte(lines[249]), &row); err != nil || row.InfoHash != fmt.Sprintf("%040x", 249) {
+		t.Errorf("last line %q: %v", lines[249], err)
+	}
+
+	// A failure part way through ends the stream with an error object
+	url = streamServer(t, func(ctx context.Context, emit func(v any) error) error {
+		for i := 0; i < 3; i++ {
+			emit(syntheticTorrent(i))
+		}
+		return errors.New("connection reset")
+	})
+	lines = get(url)
+	var failed models.ErrorResponse
+	if len(lines) != 4 || json.Unmarshal([]byte(lines[3]), &failed) != nil || failed.Error == "" {
+		t.Errorf("failed stream: %q", lines)
+	}
+
+	// A client going away cancels the rows still to come
+	stopped := make(chan error, 1)
+	url = streamServer(t, func(ctx context.Context, emit func(v any) error) error {
+		for {
+			if err := emit(syntheticTorrent(0)); err != nil {
+				stopped <- ctx.Err()
+				return err
+			}
+		}
+	})
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("stopped with context error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("stream kept going after the client left")
+	}
+
+	// A stream running past ndjsonTimeout is ended with a timeout error
+	defer func(d time.Duration) { ndjsonTimeout = d }(ndjsonTimeout)
+	ndjsonTimeout = 100 * time.Millisecond
+	url = streamServer(t, func(ctx context.Context, emit func(v any) error) error {
+		if err := emit(syntheticTorrent(0)); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	lines = get(url)
+	var timedOut models.ErrorResponse
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &timedOut) != nil || timedOut.Code != "STREAM_TIMEOUT" {
+		t.Errorf("timed out stream: %q", lines)
+	}
+}
+
+// BenchmarkStreamNDJSON streams synthetic torrent rows to a client that
+// discards them. peak-heap-MB, the most the heap grew while streaming,
+// stays flat as the row count grows: rows are written as they come.
+func BenchmarkStreamNDJSON(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("rows=%d", n), func(b *testing.B) {
+			var base, peak atomic.Uint64
+			url := streamServer(b, func(ctx context.Context, emit func(v any) error) error {
+				var mem runtime.MemStats
+				for i := 0; i < n; i++ {
+					if err := emit(syntheticTorrent(i)); err != nil {
+						return err
+					}
+					if i%1000 == 0 {
+						runtime.ReadMemStats(&mem)
+						if start := base.Load(); mem.HeapInuse > start && mem.HeapInuse-start > peak.Load() {
+							peak.Store(mem.HeapInuse - start)
+						}
+					}
+				}
+				return nil
+			})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				var mem runtime.MemStats
+				runtime.ReadMemStats(&mem)
+				base.Store(mem.HeapInuse)
+
+				resp, err := http.Get(url)
+				if err != nil {
+					b.Fatal(err)
+				}
+				written, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(written)
+			}
+			b.ReportMetric(float64(peak.Load())/(1<<20), "peak-heap-MB")
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// zoneinfoDirs are where Go looks for tzdata, in its order, after $ZONEINFO
+var zoneinfoDirs = []string{
+	"/usr/share/zoneinfo/",
+	"/usr/share/lib/zoneinfo/",
+	"/usr/lib/locale/TZ/",
+}
+
+var (
+	timezonesOnce sync.Once
+	timezones     []string
+)
+
+// supportedTimezones lists the IANA zone names this server's tzdata can load,
+// sorted. UTC is always among them.
+func supportedTimezones() []string {
+	timezonesOnce.Do(func() {
+		dirs := zoneinfoDirs
+		if dir := os.Getenv("ZONEINFO"); dir != "" {
+			dirs = append([]string{dir}, dirs...)
+		}
+		for _, dir := range dirs {
+			if names := zoneNames(dir); len(names) > 0 {
+				timezones = names
+				break
+			}
+		}
+		if i := sort.SearchStrings(timezones, models.DefaultTimezone); i == len(timezones) || timezones[i] != models.DefaultTimezone {
+			timezones = append(timezones, models.DefaultTimezone)
+			sort.Strings(timezones)
+		}
+	})
+	return timezones
+}
+
+// zoneNames lists the loadable zones in a zoneinfo directory. Zone names
+// are capitalised at every level, which leaves out the tables beside them
+// (zone.tab, leapseconds, ...); posix/ and right/ repeat the zones.
+func zoneNames(dir string) []string {
+	var names []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		base := d.Name()
+		if base == "" || base[0] < 'A' || base[0] > 'Z' || base == "Factory" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(path, filepath.Clean(dir)+string(filepath.Separator)))
+		if validTimezone(name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+// validTimezone reports whether name is an IANA zone the server can load.
+// "Local" is refused as it means whatever zone the server runs in.
+func validTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// ListTimezones returns the zones accepted for the timezone setting
+func (h *AuthHandler) ListTimezones(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"timezones": supportedTimezones(),
+		"default":   models.DefaultTimezone,
+	})
+}
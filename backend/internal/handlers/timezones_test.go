@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	_ "time/tzdata" // the zones tested, whatever the machine has
+)
+
+func TestValidTimezone(t *testing.T) {
+	tests := map[string]bool{
+		"UTC":              true,
+		"Europe/Paris":     true,
+		"America/New_York": true,
+		"":                 false,
+		"Local":            false,
+		"Mars/Olympus":     false,
+		"../etc/passwd":    false,
+		"+02:00":           false,
+	}
+	for name, want := range tests {
+		if got := validTimezone(name); got != want {
+			t.Errorf("validTimezone(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestZoneNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"UTC", "Europe/Paris", "America/Argentina/Salta",
+		"zone.tab", "posixrules", "Factory", "posix/Europe/Paris", "right/UTC", "Mars/Olympus",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"America/Argentina/Salta", "Europe/Paris", "UTC"}
+	if got := zoneNames(dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("zoneNames = %q, want %q", got, want)
+	}
+}
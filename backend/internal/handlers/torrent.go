@@ -1,33 +1,101 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/freetorrent/freetorrent/internal/auth"
 	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/hooks"
 	"github.com/freetorrent/freetorrent/internal/middleware"
 	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/redact"
 	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/uploads"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// maxTorrentFileSize bounds .torrent files read from uploads and URLs
+	maxTorrentFileSize = 10 * 1024 * 1024
+
+	// maxTorrentRetries is how many times a failed torrent may be retried
+	maxTorrentRetries = 5
+
+	// maxTorrentExtensions is how many times a torrent's retention may be extended
+	maxTorrentExtensions = 3
+
+	// torrentFetchTimeout bounds background downloads of torrent URLs
+	torrentFetchTimeout = 60 * time.Second
+
+	// signedURLExpiry and maxSignedURLExpiry are the default and longest
+	// lifetimes of a signed download URL
+	signedURLExpiry    = 24 * time.Hour
+	maxSignedURLExpiry = 7 * 24 * time.Hour
+
+	// recentCompletionConfirm is how long after completing a torrent deleting
+	// it needs confirming
+	recentCompletionConfirm = time.Hour
+
+	// existingRowWait bounds how long an add that lost a race for the same
+	// torrent waits for the winner's row, checking every existingRowPoll
+	existingRowWait = 5 * time.Second
+	existingRowPoll = 100 * time.Millisecond
 )
 
 type TorrentHandler struct {
-	db     *database.Database
-	engine *torrent.Engine
+	db      *database.Database
+	engine  torrent.Service
+	events  *events.Broker
+	uploads *uploads.Store
+	signer  *auth.DownloadSigner
+	zips    *middleware.ConcurrencyLimiter // zip streams per torrent owner
+	hooks   hooks.Hooks
+
+	importWake chan struct{} // see ImportWake
+
+	confirmDeleteBytes int64 // deleting torrents larger than this needs confirming; 0 = never
+
+	publicBaseURL string // prefixed to download URLs; "" leaves them relative
 }
 
-func NewTorrentHandler(db *database.Database, engine *torrent.Engine) *TorrentHandler {
+func NewTorrentHandler(db *database.Database, engine torrent.Service, broker *events.Broker, uploadStore *uploads.Store, signer *auth.DownloadSigner, zips *middleware.ConcurrencyLimiter, h hooks.Hooks, confirmDeleteGB int,
+	publicBaseURL string) *TorrentHandler {
 	return &TorrentHandler{
-		db:     db,
-		engine: engine,
+		db:      db,
+		engine:  engine,
+		events:  broker,
+		uploads: uploadStore,
+		signer:  signer,
+		zips:    zips,
+		hooks:   h,
+
+		importWake: make(chan struct{}, 1),
+
+		confirmDeleteBytes: models.GBytes(confirmDeleteGB),
+
+		publicBaseURL: publicBaseURL,
 	}
 }
 
@@ -47,8 +115,27 @@ func (h *TorrentHandler) AddTorrent(c *fiber.Ctx) error {
 		})
 	}
 
+	return h.addTorrent(c, userID, req)
+}
+
+// addTorrent adds a magnet or torrent URL for the user, after the same
+// quota and limit checks whichever route it came from
+func (h *TorrentHandler) addTorrent(c *fiber.Ctx, userID uuid.UUID, req models.AddTorrentRequest) error {
+	if ok, err := h.checkDiskError(c); !ok {
+		return err
+	}
 	// Check quota
-	if err := h.checkQuota(c, userID); err != nil {
+	if ok, err := h.checkQuota(c, userID); !ok {
+		return err
+	}
+	if ok, err := h.checkAddVelocity(c, userID); !ok {
+		return err
+	}
+	// A magnet's size is unknown until its metadata arrives
+	if ok, err := h.checkStorage(c, userID, 0); !ok {
+		return err
+	}
+	if ok, err := h.checkCollection(c, userID, req.CollectionID); !ok {
 		return err
 	}
 
@@ -60,83 +147,235 @@ func (h *TorrentHandler) AddTorrent(c *fiber.Ctx) error {
 	}
 
 	torrentID := uuid.New()
-	var update *torrent.TorrentUpdate
 
-	if req.MagnetURI != "" {
-		// Validate magnet link
-		if !strings.HasPrefix(req.MagnetURI, "magnet:") {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error: "invalid magnet URI",
-			})
-		}
+	// Torrent URLs are fetched in the background so a slow remote host
+	// can't hold the request open
+	if req.MagnetURI == "" {
+		return h.addTorrentURL(c, torrentID, userID, req)
+	}
 
-		update, err = h.engine.AddMagnet(c.Context(), torrentID, userID, req.MagnetURI)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error:   "failed to add magnet",
-				Details: err.Error(),
-			})
-		}
-	} else {
-		// Download torrent file from URL
-		resp, err := http.Get(req.TorrentURL)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error:   "failed to download torrent file",
-				Details: err.Error(),
-			})
-		}
-		defer resp.Body.Close()
+	// Validate magnet link
+	if !strings.HasPrefix(req.MagnetURI, "magnet:") {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid magnet URI",
+		})
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error: "failed to download torrent file: " + resp.Status,
-			})
+	// Refuse blocked and churned magnets before the engine starts fetching
+	// metadata
+	if infoHash, err := torrent.MagnetInfoHash(req.MagnetURI); err == nil {
+		if ok, err := h.checkBlocked(c, infoHash); !ok {
+			return err
 		}
-
-		update, err = h.engine.AddTorrentFile(c.Context(), torrentID, userID, resp.Body)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-				Error:   "failed to parse torrent file",
-				Details: err.Error(),
-			})
+		if ok, err := h.checkChurn(c, userID, infoHash); !ok {
+			return err
 		}
 	}
 
+	update, err := h.engine.AddMagnet(h.engine.Context(), torrentID, userID, req.MagnetURI)
+	if errors.Is(err, torrent.ErrPrivateTorrentInUse) {
+		return privateTorrentInUse(c)
+	}
+	if errors.Is(err, torrent.ErrV2NotSupported) {
+		return v2NotSupported(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "failed to add magnet",
+			Details: redact.Error(err),
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), update.InfoHash)
+
 	// Check if torrent already exists
-	if update.Status == "exists" {
-		// Return existing torrent from database
-		existing, err := h.db.GetTorrentByInfoHash(c.Context(), userID, update.InfoHash)
-		if err == nil && existing != nil {
+	if update.Status == torrent.StatusExists {
+		return h.existingTorrent(c, userID, update)
+	}
+
+	// Save to database
+	t := &models.Torrent{
+		ID:           torrentID,
+		UserID:       userID,
+		InfoHash:     update.InfoHash,
+		Name:         update.Name,
+		MagnetURI:    req.MagnetURI,
+		IsPrivate:    update.IsPrivate,
+		Audit:        addAudit(c, models.SourceMagnet),
+		AutoZip:      req.Zip,
+		CollectionID: req.CollectionID,
+		Metadata:     update.Metadata,
+		Status:       update.Status,
+		TotalSize:    update.TotalSize,
+	}
+
+	if err := h.db.CreateTorrent(c.UserContext(), t); err != nil {
+		h.engine.RemoveOwner(update.InfoHash, torrentID, false)
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save torrent",
+		})
+	}
+	h.db.LogTorrentAdded(c.UserContext(), t)
+	h.hooks.OnTorrentAdded(t)
+	c.Locals(string(middleware.TorrentIDKey), t.ID)
+
+	// Whether it is private is only known once the metadata arrives
+	h.engine.SetSeedRatio(update.InfoHash, h.seedRatio(c.UserContext(), userID))
+
+	return c.Status(fiber.StatusCreated).JSON(t)
+}
+
+// existingTorrent answers an add the engine reported as "exists" with the
+// user's row for it. When two adds of the same torrent race, the loser can
+// get here before the winner has inserted its row, so the row is waited for
+// briefly by the ID the engine holds.
+func (h *TorrentHandler) existingTorrent(c *fiber.Ctx, userID uuid.UUID, update *torrent.TorrentUpdate) error {
+	deadline := time.Now().Add(existingRowWait)
+	for {
+		existing, err := h.db.GetTorrent(c.UserContext(), update.ID)
+		if err == nil && existing != nil && existing.UserID == userID {
+			c.Locals(string(middleware.TorrentIDKey), existing.ID)
 			return c.Status(fiber.StatusOK).JSON(existing)
 		}
-		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
-			Error: "torrent already exists",
-			Code:  "TORRENT_EXISTS",
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(existingRowPoll)
+	}
+	return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+		Error: "torrent already exists",
+		Code:  "TORRENT_EXISTS",
+	})
+}
+
+// addTorrentURL records a torrent in "fetching" state and returns 202
+// immediately; the .torrent file is downloaded and added in the background
+func (h *TorrentHandler) addTorrentURL(c *fiber.Ctx, torrentID, userID uuid.UUID, req models.AddTorrentRequest) error {
+	u, err := url.Parse(req.TorrentURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent URL",
 		})
 	}
 
-	// Save to database
 	t := &models.Torrent{
-		ID:        torrentID,
-		UserID:    userID,
-		InfoHash:  update.InfoHash,
-		Name:      update.Name,
-		MagnetURI: req.MagnetURI,
-		Status:    update.Status,
-		TotalSize: update.TotalSize,
+		ID:           torrentID,
+		UserID:       userID,
+		Name:         "Fetching torrent file...",
+		Status:       models.TorrentStatusFetching,
+		Audit:        addAudit(c, models.SourceURL),
+		AutoZip:      req.Zip,
+		CollectionID: req.CollectionID,
 	}
 
-	if err := h.db.CreateTorrent(c.Context(), t); err != nil {
+	if err := h.db.CreateTorrent(c.UserContext(), t); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to save torrent",
 		})
 	}
+	h.db.LogTorrentAdded(c.UserContext(), t)
+	h.hooks.OnTorrentAdded(t)
+	c.Locals(string(middleware.TorrentIDKey), t.ID)
 
-	return c.Status(fiber.StatusCreated).JSON(t)
+	go h.fetchTorrentURL(torrentID, userID, req.TorrentURL)
+
+	return c.Status(fiber.StatusAccepted).JSON(t)
+}
+
+// fetchTorrentURL downloads a .torrent file and adds it to the engine,
+// moving the torrent out of "fetching" and telling the client over SSE
+func (h *TorrentHandler) fetchTorrentURL(torrentID, userID uuid.UUID, torrentURL string) {
+	ctx, cancel := context.WithTimeout(h.engine.Context(), torrentFetchTimeout)
+	defer cancel()
+
+	fail := func(reason models.ClosedReason, msg string) {
+		msg = redact.String(msg)
+		h.db.SetTorrentError(context.Background(), torrentID, reason, msg)
+		h.events.Publish(events.Event{
+			UserID: userID,
+			Type:   "torrent_failed",
+			Data:   fiber.Map{"id": torrentID, "error": msg, "closed_reason": reason},
+		})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, torrentURL, nil)
+	if err != nil {
+		fail(models.ClosedFailedMetadata, "failed to download torrent file: "+err.Error())
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Not the URL itself, which may carry a search provider's API key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		fail(models.ClosedFailedMetadata, "failed to download torrent file: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fail(models.ClosedFailedMetadata, "failed to download torrent file: "+resp.Status)
+		return
+	}
+
+	metainfo, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize))
+	if err != nil {
+		fail(models.ClosedFailedMetadata, "failed to download torrent file: "+err.Error())
+		return
+	}
+
+	if infoHash, _, err := torrent.InspectTorrentFile(metainfo); err == nil {
+		blocked, err := h.db.IsInfoHashBlocked(ctx, infoHash)
+		if err != nil {
+			fail(models.ClosedFailedInternal, "failed to check torrent")
+			return
+		}
+		if blocked {
+			fail(models.ClosedDMCA, "torrent has been removed following an abuse report")
+			return
+		}
+	}
+
+	update, err := h.engine.AddTorrentFile(h.engine.Context(), torrentID, userID, bytes.NewReader(metainfo))
+	if errors.Is(err, torrent.ErrPrivateTorrentInUse) || errors.Is(err, torrent.ErrV2NotSupported) {
+		fail(models.ClosedFailedMetadata, err.Error())
+		return
+	}
+	if err != nil {
+		fail(models.ClosedFailedMetadata, "failed to parse torrent file: "+err.Error())
+		return
+	}
+
+	if update.Status == torrent.StatusExists {
+		fail(models.ClosedFailedDup, "torrent already added")
+		return
+	}
+
+	if err := h.db.UpdateTorrentFetched(ctx, torrentID, update.InfoHash, update.Name, update.TotalSize, update.IsPrivate, update.Status, metainfo); err != nil {
+		h.engine.RemoveOwner(update.InfoHash, torrentID, false)
+		fail(models.ClosedFailedInternal, "failed to save torrent")
+		return
+	}
+	if update.Metadata != nil {
+		h.db.UpdateTorrentMetadata(ctx, torrentID, update.Metadata)
+	}
+	h.engine.SetSeedRatio(update.InfoHash, h.seedRatio(ctx, userID))
+
+	t, err := h.db.GetTorrent(ctx, torrentID)
+	if err != nil || t == nil {
+		return
+	}
+	h.events.Publish(events.Event{
+		UserID: userID,
+		Type:   "torrent_added",
+		Data:   t,
+	})
 }
 
-// UploadTorrent handles .torrent file uploads
+// UploadTorrent handles .torrent file uploads, either as a multipart "file"
+// or as the upload_id of a completed resumable upload
 func (h *TorrentHandler) UploadTorrent(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
 	if err != nil {
@@ -145,75 +384,261 @@ func (h *TorrentHandler) UploadTorrent(c *fiber.Ctx) error {
 		})
 	}
 
+	if ok, err := h.checkDiskError(c); !ok {
+		return err
+	}
 	// Check quota
-	if err := h.checkQuota(c, userID); err != nil {
+	if ok, err := h.checkQuota(c, userID); !ok {
+		return err
+	}
+	if ok, err := h.checkAddVelocity(c, userID); !ok {
 		return err
 	}
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Error: "no file uploaded",
-		})
+	// Optional override of the user's default_zip
+	var autoZip *bool
+	if v := c.FormValue("zip"); v != "" {
+		zip, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "zip must be true or false",
+			})
+		}
+		autoZip = &zip
 	}
 
-	// Validate file extension
-	if !strings.HasSuffix(strings.ToLower(file.Filename), ".torrent") {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Error: "file must be a .torrent file",
-		})
+	var collectionID *uuid.UUID
+	if v := c.FormValue("collection_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid collection ID",
+			})
+		}
+		collectionID = &id
+	}
+	if ok, err := h.checkCollection(c, userID, collectionID); !ok {
+		return err
 	}
 
-	// Open file
-	f, err := file.Open()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to open file",
-		})
+	var metainfo []byte
+	var upload *models.Upload
+	if uploadID := c.FormValue("upload_id"); uploadID != "" {
+		id, err := uuid.Parse(uploadID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid upload ID",
+			})
+		}
+		metainfo, upload, err = h.uploads.Read(c.UserContext(), userID, id, maxTorrentFileSize)
+		switch {
+		case errors.Is(err, uploads.ErrIncomplete):
+			return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Error: "upload is not complete",
+				Code:  "UPLOAD_INCOMPLETE",
+			})
+		case errors.Is(err, uploads.ErrTooLarge):
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "torrent file too large",
+			})
+		case err != nil:
+			return uploadError(c, err)
+		}
+		if !strings.HasSuffix(strings.ToLower(upload.Filename), ".torrent") {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "file must be a .torrent file",
+			})
+		}
+	} else {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "no file uploaded",
+			})
+		}
+
+		// Validate file extension
+		if !strings.HasSuffix(strings.ToLower(file.Filename), ".torrent") {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "file must be a .torrent file",
+			})
+		}
+
+		// Open file
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to open file",
+			})
+		}
+		defer f.Close()
+
+		metainfo, err = io.ReadAll(io.LimitReader(f, maxTorrentFileSize))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to read file",
+			})
+		}
+	}
+
+	if infoHash, size, err := torrent.InspectTorrentFile(metainfo); err == nil {
+		if ok, err := h.checkBlocked(c, infoHash); !ok {
+			return err
+		}
+		if ok, err := h.checkChurn(c, userID, infoHash); !ok {
+			return err
+		}
+		if ok, err := h.checkStorage(c, userID, size); !ok {
+			return err
+		}
 	}
-	defer f.Close()
 
 	torrentID := uuid.New()
-	update, err := h.engine.AddTorrentFile(c.Context(), torrentID, userID, f)
+	update, err := h.engine.AddTorrentFile(h.engine.Context(), torrentID, userID, bytes.NewReader(metainfo))
+	if errors.Is(err, torrent.ErrPrivateTorrentInUse) {
+		return privateTorrentInUse(c)
+	}
+	if errors.Is(err, torrent.ErrV2NotSupported) {
+		return v2NotSupported(c)
+	}
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
 			Error:   "failed to parse torrent file",
-			Details: err.Error(),
+			Details: redact.Error(err),
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), update.InfoHash)
 
 	// Check if torrent already exists
-	if update.Status == "exists" {
-		existing, err := h.db.GetTorrentByInfoHash(c.Context(), userID, update.InfoHash)
-		if err == nil && existing != nil {
-			return c.Status(fiber.StatusOK).JSON(existing)
-		}
-		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
-			Error: "torrent already exists",
-			Code:  "TORRENT_EXISTS",
-		})
+	if update.Status == torrent.StatusExists {
+		return h.existingTorrent(c, userID, update)
 	}
 
 	// Save to database
 	t := &models.Torrent{
-		ID:        torrentID,
-		UserID:    userID,
-		InfoHash:  update.InfoHash,
-		Name:      update.Name,
-		Status:    update.Status,
-		TotalSize: update.TotalSize,
-	}
-
-	if err := h.db.CreateTorrent(c.Context(), t); err != nil {
+		ID:           torrentID,
+		UserID:       userID,
+		InfoHash:     update.InfoHash,
+		Name:         update.Name,
+		IsPrivate:    update.IsPrivate,
+		Metadata:     update.Metadata,
+		Status:       update.Status,
+		TotalSize:    update.TotalSize,
+		Metainfo:     metainfo,
+		Audit:        addAudit(c, models.SourceFile),
+		AutoZip:      autoZip,
+		CollectionID: collectionID,
+	}
+
+	if err := h.db.CreateTorrent(c.UserContext(), t); err != nil {
+		h.engine.RemoveOwner(update.InfoHash, torrentID, false)
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to save torrent",
 		})
 	}
+	h.db.LogTorrentAdded(c.UserContext(), t)
+	h.hooks.OnTorrentAdded(t)
+	c.Locals(string(middleware.TorrentIDKey), t.ID)
+	h.engine.SetSeedRatio(update.InfoHash, h.seedRatio(c.UserContext(), userID))
+
+	if upload != nil {
+		if err := h.uploads.Remove(c.UserContext(), upload); err != nil {
+			log.Printf("Failed to remove consumed upload %s: %v", upload.ID, err)
+		}
+	}
 
 	return c.Status(fiber.StatusCreated).JSON(t)
 }
 
-// ListTorrents returns all torrents for the authenticated user
+// PreviewTorrent describes a magnet (JSON magnet_uri) or an uploaded
+// .torrent file (multipart "file") without adding it or spending quota, and
+// says whether adding it now would exceed the user's plan limits. Magnets
+// wait up to a minute for metadata; see Engine.PreviewMagnet.
+func (h *TorrentHandler) PreviewTorrent(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var preview *models.TorrentPreview
+	if file, err := c.FormFile("file"); err == nil {
+		if !strings.HasSuffix(strings.ToLower(file.Filename), ".torrent") {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "file must be a .torrent file",
+			})
+		}
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to open file",
+			})
+		}
+		defer f.Close()
+
+		data, err := io.ReadAll(io.LimitReader(f, maxTorrentFileSize))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to read file",
+			})
+		}
+		preview, err = torrent.PreviewTorrentFile(data)
+		if errors.Is(err, torrent.ErrV2NotSupported) {
+			return v2NotSupported(c)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "invalid torrent file",
+				Details: redact.Error(err),
+			})
+		}
+	} else {
+		var req models.AddTorrentRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid request body",
+			})
+		}
+		if !strings.HasPrefix(req.MagnetURI, "magnet:") {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "magnet_uri or a .torrent file required",
+			})
+		}
+
+		preview, err = h.engine.PreviewMagnet(c.UserContext(), req.MagnetURI)
+		switch {
+		case errors.Is(err, torrent.ErrV2NotSupported):
+			return v2NotSupported(c)
+		case errors.Is(err, torrent.ErrPreviewTimeout):
+			return c.Status(fiber.StatusGatewayTimeout).JSON(models.ErrorResponse{
+				Error: "no peers sent the torrent's metadata in time",
+				Code:  "PREVIEW_TIMEOUT",
+			})
+		case err != nil:
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error:   "failed to preview magnet",
+				Details: redact.Error(err),
+			})
+		}
+	}
+	c.Locals(string(middleware.InfoHashKey), preview.InfoHash)
+
+	reasons, err := h.limitReasons(c.UserContext(), userID, preview.InfoHash, preview.TotalSize)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check plan limits",
+		})
+	}
+	preview.LimitReasons = reasons
+	preview.ExceedsLimits = len(reasons) > 0
+
+	return c.JSON(preview)
+}
+
+// ListTorrents returns all torrents for the authenticated user, optionally
+// searched by name with q= or narrowed with status=, in full or with
+// view=compact
 func (h *TorrentHandler) ListTorrents(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
 	if err != nil {
@@ -232,7 +657,50 @@ func (h *TorrentHandler) ListTorrents(c *fiber.Ctx) error {
 	}
 	offset := (page - 1) * pageSize
 
-	torrents, total, err := h.db.GetTorrentsByUser(c.Context(), userID, pageSize, offset)
+	var collectionID *uuid.UUID
+	if v := c.Query("collection_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "invalid collection ID",
+			})
+		}
+		collectionID = &id
+	}
+
+	status := models.TorrentStatus(c.Query("status"))
+	if status != "" && !status.IsValid() {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid status",
+			Code:  "INVALID_STATUS",
+		})
+	}
+
+	// The compact view skips live stats and most columns, for overviews of
+	// accounts with thousands of torrents
+	switch c.Query("view") {
+	case "", "full":
+	case "compact":
+		torrents, total, err := h.db.GetCompactTorrentsByUser(c.UserContext(), userID, collectionID, status, c.Query("q"), pageSize, offset)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to fetch torrents",
+			})
+		}
+		return c.JSON(models.CompactTorrentListResponse{
+			Torrents:   torrents,
+			TotalCount: total,
+			Page:       page,
+			PageSize:   pageSize,
+		})
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "view must be full or compact",
+			Code:  "INVALID_VIEW",
+		})
+	}
+
+	torrents, total, err := h.db.GetTorrentsByUser(c.UserContext(), userID, collectionID, status, c.Query("q"), pageSize, offset)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to fetch torrents",
@@ -242,21 +710,7 @@ func (h *TorrentHandler) ListTorrents(c *fiber.Ctx) error {
 	// Enrich with live stats from engine
 	for i := range torrents {
 		if status, err := h.engine.GetTorrentStatus(torrents[i].InfoHash); err == nil {
-			torrents[i].DownloadSpeed = status.DownloadSpeed
-			torrents[i].UploadSpeed = status.UploadSpeed
-			torrents[i].Progress = status.Progress
-			torrents[i].Peers = status.Peers
-			torrents[i].Seeds = status.Seeds
-			torrents[i].DownloadedSize = status.Downloaded
-			if len(status.Files) > 0 {
-				torrents[i].Files = status.Files
-			}
-			if status.Name != "" && status.Name != "Fetching metadata..." {
-				torrents[i].Name = status.Name
-			}
-			if status.Status != "" && status.Status != "exists" {
-				torrents[i].Status = status.Status
-			}
+			applyLiveStatus(&torrents[i], status)
 		}
 	}
 
@@ -284,7 +738,7 @@ func (h *TorrentHandler) GetTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	t, err := h.db.GetTorrent(c.Context(), torrentID)
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to fetch torrent",
@@ -295,6 +749,7 @@ func (h *TorrentHandler) GetTorrent(c *fiber.Ctx) error {
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
 	// Check ownership (unless admin)
 	role := middleware.GetUserRole(c)
@@ -306,23 +761,14 @@ func (h *TorrentHandler) GetTorrent(c *fiber.Ctx) error {
 
 	// Enrich with live stats
 	if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil {
-		t.DownloadSpeed = status.DownloadSpeed
-		t.UploadSpeed = status.UploadSpeed
-		t.Progress = status.Progress
-		t.Peers = status.Peers
-		t.Seeds = status.Seeds
-		t.DownloadedSize = status.Downloaded
-		t.Files = status.Files
-		if status.Status != "" {
-			t.Status = status.Status
-		}
+		applyLiveStatus(t, status)
 	}
 
 	return c.JSON(t)
 }
 
-// DeleteTorrent removes a torrent
-func (h *TorrentHandler) DeleteTorrent(c *fiber.Ctx) error {
+// GetFileTree returns a torrent's files as a directory tree
+func (h *TorrentHandler) GetFileTree(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
@@ -337,14 +783,19 @@ func (h *TorrentHandler) DeleteTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	t, err := h.db.GetTorrent(c.Context(), torrentID)
-	if err != nil || t == nil {
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent",
+		})
+	}
+	if t == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
-	// Check ownership (unless admin)
 	role := middleware.GetUserRole(c)
 	if t.UserID != userID && role != "admin" {
 		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
@@ -352,23 +803,200 @@ func (h *TorrentHandler) DeleteTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	deleteFiles := c.Query("delete_files", "true") == "true"
-
+	if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil {
+		applyLiveStatus(t, status)
+	}
+
+	return c.JSON(buildFileTree(t.Name, t.Files))
+}
+
+// buildFileTree nests a torrent's flat file list under a root named after
+// the torrent. Directories come before files, each sorted by name.
+func buildFileTree(name string, files []models.TorrentFile) *models.FileNode {
+	root := &models.FileNode{Name: name, IsDir: true}
+	dirs := map[string]*models.FileNode{"": root}
+	completed := map[*models.FileNode]float64{}
+
+	var dirFor func(p string) *models.FileNode
+	dirFor = func(p string) *models.FileNode {
+		if node, ok := dirs[p]; ok {
+			return node
+		}
+		parent := dirFor(parentDir(p))
+		node := &models.FileNode{Name: path.Base(p), Path: p, IsDir: true}
+		parent.Children = append(parent.Children, node)
+		dirs[p] = node
+		return node
+	}
+
+	for _, f := range files {
+		parent := dirFor(parentDir(f.Path))
+		parent.Children = append(parent.Children, &models.FileNode{
+			Name:     path.Base(f.Path),
+			Path:     f.Path,
+			Size:     f.Size,
+			Progress: f.Progress,
+		})
+
+		// Roll size and completed bytes up to every enclosing directory
+		done := float64(f.Size) * f.Progress / 100
+		for p := parentDir(f.Path); ; p = parentDir(p) {
+			dirs[p].Size += f.Size
+			completed[dirs[p]] += done
+			if p == "" {
+				break
+			}
+		}
+	}
+
+	for node, done := range completed {
+		if node.Size > 0 {
+			node.Progress = done / float64(node.Size) * 100
+		}
+	}
+	for _, node := range dirs {
+		sort.Slice(node.Children, func(i, j int) bool {
+			a, b := node.Children[i], node.Children[j]
+			if a.IsDir != b.IsDir {
+				return a.IsDir
+			}
+			return a.Name < b.Name
+		})
+	}
+	return root
+}
+
+// parentDir returns the directory part of a torrent file path, "" at the top
+func parentDir(p string) string {
+	if dir := path.Dir(p); dir != "." && dir != "/" {
+		return dir
+	}
+	return ""
+}
+
+// filesUnder returns the files beneath dir
+func filesUnder(files []models.TorrentFile, dir string) []models.TorrentFile {
+	var under []models.TorrentFile
+	for _, f := range files {
+		if strings.HasPrefix(f.Path, dir+"/") {
+			under = append(under, f)
+		}
+	}
+	return under
+}
+
+// applyLiveStatus overlays the engine's live stats onto a database row.
+// A torrent the database records as completed is never downgraded by engine
+// state, which lags behind while a reloaded torrent re-resolves metadata, and
+// the live status is only shown when the stored one could move to it.
+func applyLiveStatus(t *models.Torrent, status *torrent.TorrentUpdate) {
+	t.DownloadSpeed = status.DownloadSpeed
+	t.UploadSpeed = status.UploadSpeed
+	t.Peers = status.Peers
+	t.Seeds = status.Seeds
+
+	if t.Status == models.TorrentStatusCompleted {
+		return
+	}
+
+	t.Progress = status.Progress
+	t.DownloadedSize = status.Downloaded
+	if len(status.Files) > 0 {
+		t.Files = status.Files
+	}
+	if status.Name != "" && status.Name != "Fetching metadata..." {
+		t.Name = status.Name
+	}
+	// The engine's status is the torrent's as a whole; other owners may
+	// still be downloading one this row paused
+	if t.Status == models.TorrentStatusPaused {
+		t.DownloadSpeed, t.UploadSpeed = 0, 0
+		return
+	}
+	if t.Status.CanTransitionTo(status.Status) {
+		t.Status = status.Status
+	}
+}
+
+// DeleteTorrent removes a torrent
+func (h *TorrentHandler) DeleteTorrent(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil || t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	// Check ownership (unless admin)
+	role := middleware.GetUserRole(c)
+	if t.UserID != userID && role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+
+	deleteFiles := c.Query("delete_files", "true") == "true"
+
+	if ok, err := confirmDestructive(c, h.db, userID, "delete_torrent:"+t.ID.String(), h.deleteConfirmReason(t)); !ok {
+		return err
+	}
+
 	// Remove from engine
-	h.engine.RemoveTorrent(t.InfoHash, deleteFiles)
+	h.engine.RemoveOwner(t.InfoHash, t.ID, deleteFiles)
+
+	reason, closedReason := hooks.DeleteReasonUser, models.ClosedUserDeleted
+	if t.UserID != userID {
+		reason, closedReason = hooks.DeleteReasonAdmin, models.ClosedAdminDeleted
+	}
 
 	// Remove from database
-	if err := h.db.DeleteTorrent(c.Context(), torrentID); err != nil {
+	if err := h.db.DeleteTorrent(c.UserContext(), torrentID, closedReason); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to delete torrent",
 		})
 	}
+	h.hooks.OnTorrentDeleted(t, reason)
+
+	// Owners adding and deleting the same torrent over and over are using
+	// us to scrape metadata; count it towards a cool-down
+	if t.UserID == userID && t.InfoHash != "" {
+		if err := h.db.RecordTorrentChurn(c.UserContext(), userID, t.InfoHash); err != nil {
+			log.Printf("Failed to record churn for %s: %v", t.InfoHash, err)
+		}
+	}
 
 	return c.JSON(models.SuccessResponse{
 		Message: "torrent deleted",
 	})
 }
 
+// deleteConfirmReason says why deleting t needs confirming: it is big or was
+// only just completed. It returns "" when it doesn't.
+func (h *TorrentHandler) deleteConfirmReason(t *models.Torrent) string {
+	if h.confirmDeleteBytes > 0 && t.TotalSize > h.confirmDeleteBytes {
+		return fmt.Sprintf("torrent is larger than %s", models.HumanBytes(h.confirmDeleteBytes))
+	}
+	if t.CompletedAt != nil && time.Since(*t.CompletedAt) < recentCompletionConfirm {
+		return "torrent completed less than an hour ago"
+	}
+	return ""
+}
+
 // PauseTorrent pauses a torrent download
 func (h *TorrentHandler) PauseTorrent(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
@@ -385,12 +1013,13 @@ func (h *TorrentHandler) PauseTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	t, err := h.db.GetTorrent(c.Context(), torrentID)
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
 	if err != nil || t == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
 	if t.UserID != userID {
 		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
@@ -398,13 +1027,20 @@ func (h *TorrentHandler) PauseTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := h.engine.PauseTorrent(t.InfoHash); err != nil {
+	if !t.Status.CanTransitionTo(models.TorrentStatusPaused) {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "only torrents still downloading can be paused",
+			Code:  "NOT_PAUSABLE",
+		})
+	}
+
+	if err := h.engine.PauseTorrent(t.InfoHash, t.ID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to pause torrent",
 		})
 	}
 
-	h.db.UpdateTorrentStatus(c.Context(), torrentID, "paused", t.Progress, t.DownloadedSize, t.UploadedSize, 0, 0, 0, 0)
+	h.db.UpdateTorrentStatus(c.UserContext(), torrentID, models.TorrentStatusPaused, t.Progress, t.DownloadedSize, 0, 0, 0, 0, false)
 
 	return c.JSON(models.SuccessResponse{
 		Message: "torrent paused",
@@ -427,12 +1063,13 @@ func (h *TorrentHandler) ResumeTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	t, err := h.db.GetTorrent(c.Context(), torrentID)
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
 	if err != nil || t == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
 	if t.UserID != userID {
 		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
@@ -440,26 +1077,50 @@ func (h *TorrentHandler) ResumeTorrent(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check quota before resuming
-	if err := h.checkQuota(c, userID); err != nil {
+	if t.Status != models.TorrentStatusPaused {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "torrent is not paused",
+			Code:  "NOT_PAUSED",
+		})
+	}
+
+	// Check quota before resuming, and that what is left to download fits
+	// the bandwidth left. ?partial=true resumes on what does fit.
+	if ok, err := h.checkQuota(c, userID); !ok {
+		return err
+	}
+	pauseAt, ok, err := h.checkResumeBandwidth(c, t, c.QueryBool("partial"))
+	if !ok {
 		return err
 	}
 
-	if err := h.engine.ResumeTorrent(t.InfoHash); err != nil {
+	if err := h.engine.ResumeTorrent(t.InfoHash, t.ID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
 			Error: "failed to resume torrent",
 		})
 	}
+	h.engine.SetPauseAt(t.InfoHash, t.ID, pauseAt)
+
+	h.db.SetTorrentPauseAt(c.UserContext(), torrentID, pauseAt)
+	// The user asked for it, so a status the engine wrote meanwhile doesn't block it
+	h.db.UpdateTorrentStatus(c.UserContext(), torrentID, models.TorrentStatusDownloading, t.Progress, t.DownloadedSize, 0, 0, 0, 0, true)
 
-	h.db.UpdateTorrentStatus(c.Context(), torrentID, "downloading", t.Progress, t.DownloadedSize, t.UploadedSize, 0, 0, 0, 0)
+	if pauseAt > 0 {
+		return c.JSON(models.SuccessResponse{
+			Message: "torrent resumed until the bandwidth left is used",
+			Data:    fiber.Map{"pause_at_bytes": pauseAt},
+		})
+	}
 
 	return c.JSON(models.SuccessResponse{
 		Message: "torrent resumed",
 	})
 }
 
-// CreateDownloadToken generates a secure download link
-func (h *TorrentHandler) CreateDownloadToken(c *fiber.Ctx) error {
+// RetryTorrent re-adds a failed or stalled torrent, or a restored one whose
+// data wasn't on disk, to the engine from its stored magnet or .torrent
+// file, keeping its history
+func (h *TorrentHandler) RetryTorrent(c *fiber.Ctx) error {
 	userID, err := middleware.GetUserID(c)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
@@ -474,219 +1135,1110 @@ func (h *TorrentHandler) CreateDownloadToken(c *fiber.Ctx) error {
 		})
 	}
 
-	type TokenRequest struct {
-		FilePath string `json:"file_path"`
-		UseZip   bool   `json:"use_zip"`
-	}
-
-	var req TokenRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Error: "invalid request body",
-		})
-	}
-
-	t, err := h.db.GetTorrent(c.Context(), torrentID)
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
 	if err != nil || t == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
-	if t.UserID != userID {
+	// Check ownership (unless admin)
+	role := middleware.GetUserRole(c)
+	if t.UserID != userID && role != "admin" {
 		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
 			Error: "access denied",
 		})
 	}
 
-	// Generate token
-	token, err := auth.GenerateDownloadToken()
+	if t.Status != models.TorrentStatusFailed && t.Status != models.TorrentStatusStalled &&
+		t.Status != models.TorrentStatusNeedsRedownload {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "only failed, stalled or restored torrents without data can be retried",
+			Code:  "NOT_RETRYABLE",
+		})
+	}
+
+	metainfo, err := h.db.GetTorrentMetainfo(c.UserContext(), torrentID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to generate token",
+			Error: "failed to fetch torrent",
+		})
+	}
+	if len(metainfo) == 0 && t.MagnetURI == "" {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(models.ErrorResponse{
+			Error: "torrent has no stored magnet or torrent file to retry from",
+			Code:  "NO_SOURCE",
 		})
 	}
 
-	// Determine file path - use zip if available and requested or if multiple files
-	filePath := req.FilePath
-	if req.UseZip && t.ZipPath != nil && *t.ZipPath != "" {
-		filePath = *t.ZipPath
+	// Quota rules apply as for a new add, against the owner's plan
+	if ok, err := h.checkDiskError(c); !ok {
+		return err
+	}
+	if ok, err := h.checkQuota(c, t.UserID); !ok {
+		return err
 	}
 
-	// Save token (expires in 24 hours, max 10 downloads)
-	if err := h.db.CreateDownloadToken(c.Context(), torrentID, filePath, token, 10, 24*time.Hour); err != nil {
+	ok, err := h.db.ResetTorrentForRetry(c.UserContext(), torrentID, maxTorrentRetries)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to save token",
+			Error: "failed to reset torrent",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: fmt.Sprintf("torrent has already been retried %d times", maxTorrentRetries),
+			Code:  "RETRY_LIMIT",
 		})
 	}
 
-	downloadURL := fmt.Sprintf("/api/v1/download/%s", token)
-
-	return c.JSON(fiber.Map{
-		"token":        token,
-		"download_url": downloadURL,
-		"expires_in":   24 * 60 * 60,
-		"is_zip":       req.UseZip && t.ZipPath != nil && *t.ZipPath != "",
-	})
-}
+	// Drop the stale engine entry before adding it again
+	h.engine.RemoveOwner(t.InfoHash, t.ID, false)
 
-// Download serves a file using a download token
-func (h *TorrentHandler) Download(c *fiber.Ctx) error {
-	token := c.Params("token")
-	if token == "" {
+	if len(metainfo) > 0 {
+		_, err = h.engine.AddTorrentFile(h.engine.Context(), t.ID, t.UserID, bytes.NewReader(metainfo))
+	} else {
+		_, err = h.engine.AddMagnet(h.engine.Context(), t.ID, t.UserID, t.MagnetURI)
+	}
+	if errors.Is(err, torrent.ErrPrivateTorrentInUse) {
+		h.db.SetTorrentError(c.UserContext(), torrentID, models.ClosedFailedMetadata, redact.Error(err))
+		return privateTorrentInUse(c)
+	}
+	if err != nil {
+		h.db.SetTorrentError(c.UserContext(), torrentID, models.ClosedFailedMetadata, redact.Error(err))
 		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
-			Error: "missing token",
+			Error:   "failed to re-add torrent",
+			Details: redact.Error(err),
 		})
 	}
 
-	// Look up token
-	dt, err := h.db.GetDownloadToken(c.Context(), token)
-	if err != nil {
+	h.engine.SetSeedRatio(t.InfoHash, h.seedRatio(c.UserContext(), t.UserID))
+
+	t, err = h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil || t == nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "database error",
-		})
-	}
-	if dt == nil {
-		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
-			Error: "invalid or expired token",
+			Error: "failed to fetch torrent",
 		})
 	}
 
-	// Check expiry
-	if time.Now().After(dt.ExpiresAt) {
-		return c.Status(fiber.StatusGone).JSON(models.ErrorResponse{
-			Error: "token expired",
+	return c.JSON(t)
+}
+
+// ExtendTorrent pushes a completed torrent's expiry out by re-applying the
+// plan's retention from now. Paid plans only, at most maxTorrentExtensions
+// times per torrent.
+func (h *TorrentHandler) ExtendTorrent(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
 		})
 	}
 
-	// Check download count
-	if dt.DownloadCount >= dt.MaxDownloads {
-		return c.Status(fiber.StatusGone).JSON(models.ErrorResponse{
-			Error: "download limit exceeded",
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
 		})
 	}
 
-	// Get torrent
-	t, err := h.db.GetTorrent(c.Context(), dt.TorrentID)
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
 	if err != nil || t == nil {
 		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
 			Error: "torrent not found",
 		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
-	// Increment download count
-	h.db.IncrementDownloadCount(c.Context(), token)
-
-	// Set headers
-	filename := dt.FilePath
-	if idx := strings.LastIndex(filename, "/"); idx >= 0 {
-		filename = filename[idx+1:]
+	if t.UserID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
 	}
 
-	// Try to get file reader from engine first
-	reader, size, err := h.engine.GetFileReader(t.InfoHash, dt.FilePath)
-	if err == nil {
-		// Log usage
-		h.db.LogUsage(c.Context(), t.UserID, "download_started", size, dt.FilePath)
-
-		c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
-		c.Set("Content-Type", "application/octet-stream")
-		c.Set("Content-Length", strconv.FormatInt(size, 10))
-		c.Set("Accept-Ranges", "bytes")
-
-		// Handle range requests for streaming
-		rangeHeader := c.Get("Range")
-		if rangeHeader != "" {
-			return h.handleRangeRequest(c, reader, size, rangeHeader)
-		}
-
-		// Stream the file
-		c.Status(fiber.StatusOK)
-		_, err = io.Copy(c.Response().BodyWriter(), reader)
-		return err
+	sub, err := h.db.GetSubscription(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check subscription",
+		})
 	}
-
-	// Fall back to serving from disk
-	downloadDir := h.engine.GetDownloadDir()
-	filePath := filepath.Join(downloadDir, dt.FilePath)
-	
-	// Security check - prevent path traversal
-	if !strings.HasPrefix(filepath.Clean(filePath), filepath.Clean(downloadDir)) {
+	if sub == nil || sub.Plan == "free" {
 		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
-			Error: "invalid file path",
+			Error: "extending retention requires a paid plan",
+			Code:  "PLAN_REQUIRED",
 		})
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
-			Error: "file not found on disk",
+	if t.ExpiresAt == nil {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "only completed torrents have an expiry to extend",
+			Code:  "NOT_COMPLETED",
 		})
 	}
 
-	// Log usage
-	fileInfo, _ := os.Stat(filePath)
-	if fileInfo != nil {
-		h.db.LogUsage(c.Context(), t.UserID, "download_started", fileInfo.Size(), dt.FilePath)
+	ok, err := h.db.ExtendTorrentExpiry(c.UserContext(), torrentID, sub.RetentionDays, maxTorrentExtensions)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to extend torrent",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error:   "torrent retention has been extended too many times",
+			Code:    "EXTENSION_LIMIT",
+			Details: fmt.Sprintf("at most %d extensions", maxTorrentExtensions),
+		})
 	}
 
-	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
-	return c.SendFile(filePath)
+	t, err = h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil || t == nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent",
+		})
+	}
+	return c.JSON(t)
 }
 
-func (h *TorrentHandler) handleRangeRequest(c *fiber.Ctx, reader io.ReadSeeker, size int64, rangeHeader string) error {
-	// Parse range header: "bytes=start-end"
-	rangeHeader = strings.TrimPrefix(rangeHeader, "bytes=")
-	parts := strings.Split(rangeHeader, "-")
-	if len(parts) != 2 {
-		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
+// UpdateTorrent changes a torrent's user-editable fields. For now that is
+// collection_id: a collection ID moves the torrent into it, null removes it
+// from its collection.
+func (h *TorrentHandler) UpdateTorrent(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
 	}
 
-	start, _ := strconv.ParseInt(parts[0], 10, 64)
-	end := size - 1
-	if parts[1] != "" {
-		end, _ = strconv.ParseInt(parts[1], 10, 64)
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
 	}
 
-	if start > end || start < 0 || end >= size {
-		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
+	var req struct {
+		CollectionID json.RawMessage `json:"collection_id"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if req.CollectionID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "collection_id required",
+		})
+	}
+	var collectionID *uuid.UUID
+	if err := json.Unmarshal(req.CollectionID, &collectionID); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid collection ID",
+		})
 	}
 
-	// Seek to start
-	if _, err := reader.Seek(start, io.SeekStart); err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Seek failed")
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil || t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
 	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
 
-	length := end - start + 1
+	if t.UserID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+	if ok, err := h.checkCollection(c, userID, collectionID); !ok {
+		return err
+	}
 
-	c.Status(fiber.StatusPartialContent)
-	c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
-	c.Set("Content-Length", strconv.FormatInt(length, 10))
+	if err := h.db.SetTorrentCollection(c.UserContext(), torrentID, collectionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to update torrent",
+		})
+	}
+	t.CollectionID = collectionID
 
-	_, err := io.CopyN(c.Response().BodyWriter(), reader, length)
-	return err
+	return c.JSON(t)
 }
 
-func (h *TorrentHandler) checkQuota(c *fiber.Ctx, userID uuid.UUID) error {
-	// Get subscription
-	sub, err := h.db.GetSubscription(c.Context(), userID)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
-			Error: "failed to check subscription",
-		})
+// seedRatio returns the ratio the user's plan seeds private torrents to
+func (h *TorrentHandler) seedRatio(ctx context.Context, userID uuid.UUID) float64 {
+	plan := "free"
+	if sub, _ := h.db.GetSubscription(ctx, userID); sub != nil {
+		plan = sub.Plan
 	}
+	limits, _ := h.db.GetPlanLimits(ctx, plan)
+	return limits.PrivateSeedRatio
+}
 
-	limits := models.Plans["free"]
-	if sub != nil {
-		if planLimits, ok := models.Plans[sub.Plan]; ok {
-			limits = planLimits
-		}
+// maxAuditUserAgent bounds the user agent stored with a new torrent
+const maxAuditUserAgent = 512
+
+// addAudit records how the request is adding a torrent and from where
+func addAudit(c *fiber.Ctx, source string) models.TorrentAudit {
+	ua := strings.Clone(c.Get(fiber.HeaderUserAgent))
+	if len(ua) > maxAuditUserAgent {
+		ua = ua[:maxAuditUserAgent]
+	}
+	return models.TorrentAudit{
+		Source:         source,
+		AddedIP:        middleware.ClientIP(c),
+		AddedUserAgent: ua,
 	}
+}
 
-	// Check concurrent limit
-	activeCount, _ := h.db.CountActiveTorrents(c.Context(), userID)
+// privateTorrentInUse rejects adding a private torrent another user already
+// has active: its announce URL would carry the wrong user's passkey
+func privateTorrentInUse(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+		Error: "this private torrent is already active for another account",
+		Code:  "PRIVATE_TORRENT_IN_USE",
+	})
+}
+
+// v2NotSupported rejects BitTorrent v2-only torrents
+func v2NotSupported(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+		Error: "BitTorrent v2-only torrents are not supported",
+		Code:  "V2_NOT_SUPPORTED",
+	})
+}
+
+// Download tokens allow downloadTokenUses downloads within downloadTokenTTL,
+// or until the torrent expires if that is sooner. A request for a link
+// reuses a token for the same file that has uses left and at least
+// tokenReuseMinValidity to go.
+const (
+	downloadTokenTTL      = 24 * time.Hour
+	downloadTokenUses     = 10
+	tokenReuseMinValidity = time.Hour
+)
+
+// tokenExpiry is when a download token or signed URL made now for t
+// expires: after ttl, or when t expires and its files are deleted if that is
+// sooner, in which case clamped is true
+func tokenExpiry(t *models.Torrent, now time.Time, ttl time.Duration) (expiresAt time.Time, clamped bool) {
+	expiresAt = now.Add(ttl)
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(expiresAt) {
+		return *t.ExpiresAt, true
+	}
+	return expiresAt, false
+}
+
+// torrentExpired answers for a download of a torrent that has expired,
+// whether or not the cleanup job has deleted it yet
+func torrentExpired(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+		Error: "torrent has expired and its files were deleted",
+		Code:  "TORRENT_EXPIRED",
+	})
+}
+
+// CreateDownloadToken generates a secure download link, or returns an
+// unexpired one already made for the same file unless reuse is false
+func (h *TorrentHandler) CreateDownloadToken(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	type TokenRequest struct {
+		FilePath  string `json:"file_path"`
+		Directory string `json:"directory"` // download every completed file under it as a zip
+		UseZip    bool   `json:"use_zip"`
+		Reuse     *bool  `json:"reuse"` // default true
+	}
+
+	var req TokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil || t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	if t.UserID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+	expiresAt, clamped := tokenExpiry(t, time.Now(), downloadTokenTTL)
+	if !expiresAt.After(time.Now()) {
+		return torrentExpired(c)
+	}
+
+	// Torrents the zip policy skipped are streamed as a zip of their top
+	// directory instead
+	if req.UseZip && t.ZipStatus != "" && t.ZipStatus != models.ZipStatusReady && req.Directory == "" && len(t.Files) > 0 {
+		req.Directory, _, _ = strings.Cut(t.Files[0].Path, "/")
+	}
+
+	// Determine file path - use zip if available and requested or if multiple files
+	filePath := req.FilePath
+	isDirectory := false
+	if req.UseZip && t.ZipPath != nil && *t.ZipPath != "" {
+		filePath = *t.ZipPath
+	} else if req.Directory != "" {
+		dir := path.Clean(strings.Trim(req.Directory, "/"))
+		if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil {
+			applyLiveStatus(t, status)
+		}
+		files := filesUnder(t.Files, dir)
+		if len(files) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+				Error: "directory not found or empty",
+				Code:  "EMPTY_DIRECTORY",
+			})
+		}
+		if len(completedFiles(files)) == 0 {
+			return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+				Error: "no file in this directory has finished downloading",
+				Code:  "DIRECTORY_INCOMPLETE",
+			})
+		}
+		filePath, isDirectory = dir, true
+	}
+
+	isZip := (req.UseZip && t.ZipPath != nil && *t.ZipPath != "") || isDirectory
+
+	if req.Reuse == nil || *req.Reuse {
+		dt, err := h.db.GetActiveTokenForFile(c.UserContext(), torrentID, filePath, isDirectory,
+			downloadTokenUses, tokenReuseMinValidity)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to look up tokens",
+			})
+		}
+		if dt != nil {
+			return c.JSON(fiber.Map{
+				"token":          dt.Token,
+				"download_url":   h.publicBaseURL + "/api/v1/download/" + dt.Token,
+				"expires_in":     int64(time.Until(dt.ExpiresAt).Seconds()),
+				"expires_at":     dt.ExpiresAt,
+				"clamped":        t.ExpiresAt != nil && !dt.ExpiresAt.Before(*t.ExpiresAt),
+				"downloads_left": dt.MaxDownloads - dt.DownloadCount,
+				"is_zip":         isZip,
+				"is_directory":   isDirectory,
+				"reused":         true,
+			})
+		}
+	}
+
+	// Generate token
+	token, err := auth.GenerateDownloadToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to generate token",
+		})
+	}
+
+	if err := h.db.CreateDownloadToken(c.UserContext(), torrentID, filePath, isDirectory, token, downloadTokenUses, expiresAt); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save token",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"token":          token,
+		"download_url":   h.publicBaseURL + "/api/v1/download/" + token,
+		"expires_in":     int64(time.Until(expiresAt).Seconds()),
+		"expires_at":     expiresAt,
+		"clamped":        clamped,
+		"downloads_left": downloadTokenUses,
+		"is_zip":         isZip,
+		"is_directory":   isDirectory,
+		"reused":         false,
+	})
+}
+
+// CreateSignedURL returns a stateless download URL for one completed file,
+// or the zip. Unlike tokens it is stored nowhere and has no download count:
+// it is valid until it expires, no later than the torrent, the torrent is
+// deleted, or the signing secret is rotated.
+func (h *TorrentHandler) CreateSignedURL(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	if !h.signer.Enabled() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+			Error: "signed download URLs are not enabled",
+			Code:  "SIGNED_URLS_DISABLED",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	var req struct {
+		FilePath  string `json:"file_path"`
+		UseZip    bool   `json:"use_zip"`
+		ExpiresIn int64  `json:"expires_in"` // seconds
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	expiry := signedURLExpiry
+	if req.ExpiresIn > 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if expiry > maxSignedURLExpiry {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "expires_in too long",
+			Details: fmt.Sprintf("at most %d seconds", int64(maxSignedURLExpiry.Seconds())),
+		})
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil || t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	if t.UserID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+	expiresAt, clamped := tokenExpiry(t, time.Now(), expiry)
+	if !expiresAt.After(time.Now()) {
+		return torrentExpired(c)
+	}
+
+	// The file must be complete: its size is signed into the URL
+	var filePath, checksum string
+	var size int64
+	if req.UseZip {
+		if t.ZipPath == nil || *t.ZipPath == "" {
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Error: "torrent has no zip",
+			})
+		}
+		filePath, size, checksum = *t.ZipPath, t.ZipSize, zipChecksum(t, *t.ZipPath)
+	} else {
+		if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil {
+			applyLiveStatus(t, status)
+		}
+		for _, f := range completedFiles(t.Files) {
+			if f.Path == req.FilePath {
+				filePath, size = f.Path, f.Size
+				break
+			}
+		}
+		if filePath == "" {
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Error: "file not found or not finished downloading",
+			})
+		}
+	}
+
+	token, err := h.signer.Sign(auth.SignedDownload{
+		TorrentID: t.ID,
+		UserID:    t.UserID,
+		InfoHash:  t.InfoHash,
+		FilePath:  filePath,
+		ExpiresAt: expiresAt.Unix(),
+		MaxBytes:  size,
+		SHA256:    checksum,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to sign URL",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"download_url": h.publicBaseURL + "/api/v1/dl/" + token,
+		"expires_at":   expiresAt,
+		"expires_in":   int64(time.Until(expiresAt).Seconds()),
+		"clamped":      clamped,
+	})
+}
+
+// completedFiles returns the files that have finished downloading
+func completedFiles(files []models.TorrentFile) []models.TorrentFile {
+	var done []models.TorrentFile
+	for _, f := range files {
+		if f.Progress >= 100 {
+			done = append(done, f)
+		}
+	}
+	return done
+}
+
+// downloadDirectory streams every completed file under dir as a zip built on
+// the fly, keeping paths relative to dir's parent. Usage is logged with the
+// bytes actually sent once the stream ends, and release, the owner's zip
+// slot, is called then.
+func (h *TorrentHandler) downloadDirectory(c *fiber.Ctx, t *models.Torrent, dir string, release func()) error {
+	if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil {
+		applyLiveStatus(t, status)
+	}
+
+	var entries []torrent.ZipEntry
+	base := path.Base(dir)
+	for _, f := range completedFiles(filesUnder(t.Files, dir)) {
+		entries = append(entries, torrent.ZipEntry{
+			Path: f.Path,
+			Name: base + "/" + strings.TrimPrefix(f.Path, dir+"/"),
+		})
+	}
+	if len(entries) == 0 {
+		release()
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "no completed files in directory",
+		})
+	}
+
+	c.Set("Content-Disposition", attachmentDisposition(base+".zip"))
+	c.Set("Content-Type", "application/zip")
+
+	torrentDir := h.engine.TorrentDir(t.InfoHash)
+	userID := t.UserID
+	metadata := fiber.Map{"torrent_id": t.ID, "name": t.Name, "directory": dir}
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer release()
+		written, err := torrent.WriteZip(h.engine.Context(), w, torrentDir, entries)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("Directory download of %s stopped after %d bytes: %v", dir, written, err)
+		}
+
+		ctx, cancel := database.WithTimeout(context.Background())
+		defer cancel()
+		h.db.LogUsage(ctx, userID, "download_started", written, metadata)
+		if written > 0 {
+			h.db.LogUsage(ctx, userID, "download_served", written, metadata)
+		}
+	}))
+	return nil
+}
+
+// GetZipManifest lists the entries of a torrent's zip archive with their
+// sizes and CRC-32s, and the archive's SHA-256, so a downloaded zip can be
+// checked without unzipping it
+func (h *TorrentHandler) GetZipManifest(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent",
+		})
+	}
+	if t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	role := middleware.GetUserRole(c)
+	if t.UserID != userID && role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+
+	if t.ZipPath == nil || *t.ZipPath == "" {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent has no zip",
+		})
+	}
+	entries, err := h.db.GetTorrentZipManifest(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch zip manifest",
+		})
+	}
+	if entries == nil || t.ZipSHA256 == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "zip was made before manifests were recorded",
+			Code:  "NO_MANIFEST",
+		})
+	}
+
+	return c.JSON(models.ZipManifestResponse{
+		Name:    *t.ZipPath,
+		Size:    t.ZipSize,
+		SHA256:  *t.ZipSHA256,
+		Entries: entries,
+	})
+}
+
+// Download serves a file using a download token
+func (h *TorrentHandler) Download(c *fiber.Ctx) error {
+	token := c.Params("token")
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "missing token",
+		})
+	}
+
+	// Look up token
+	dt, err := h.db.GetDownloadToken(c.UserContext(), token)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "database error",
+		})
+	}
+	if dt == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "invalid or expired token",
+		})
+	}
+	if dt.TorrentExpired {
+		return torrentExpired(c)
+	}
+
+	// Get torrent
+	t, err := h.db.GetTorrent(c.UserContext(), dt.TorrentID)
+	if err != nil || t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	// An expired torrent's files may go any moment, if they haven't yet
+	if t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt) {
+		return torrentExpired(c)
+	}
+
+	// Check expiry
+	if time.Now().After(dt.ExpiresAt) {
+		return c.Status(fiber.StatusGone).JSON(models.ErrorResponse{
+			Error: "token expired",
+		})
+	}
+
+	// Check download count
+	if dt.DownloadCount >= dt.MaxDownloads {
+		return c.Status(fiber.StatusGone).JSON(models.ErrorResponse{
+			Error: "download limit exceeded",
+		})
+	}
+
+	// Zip streams are limited per owner; refuse before using up a download
+	var release func()
+	if dt.IsDirectory {
+		var ok bool
+		if release, ok = h.zips.Acquire(c.UserContext(), t.UserID); !ok {
+			return h.zips.Reject(c)
+		}
+	}
+
+	// Increment download count
+	h.db.IncrementDownloadCount(c.UserContext(), token)
+
+	if dt.IsDirectory {
+		stream := middleware.HoldConcurrencySlot(c)
+		return h.downloadDirectory(c, t, dt.FilePath, func() {
+			release()
+			stream()
+		})
+	}
+
+	return h.serveFile(c, t.InfoHash, dt.FilePath, recordedFile(t, dt.FilePath), zipChecksum(t, dt.FilePath), 0, t.UserID, fiber.Map{
+		"torrent_id": t.ID, "name": t.Name, "file": dt.FilePath,
+	})
+}
+
+// zipChecksum returns the SHA-256 of the torrent's zip when relPath is the
+// zip and its checksum was recorded, else ""
+func zipChecksum(t *models.Torrent, relPath string) string {
+	if t.ZipPath == nil || *t.ZipPath != relPath || t.ZipSHA256 == nil {
+		return ""
+	}
+	return *t.ZipSHA256
+}
+
+// recordedFile returns the torrent's stored entry for relPath, or nil when
+// relPath isn't one of its files (the zip)
+func recordedFile(t *models.Torrent, relPath string) *models.TorrentFile {
+	for i := range t.Files {
+		if t.Files[i].Path == relPath {
+			return &t.Files[i]
+		}
+	}
+	return nil
+}
+
+// DownloadSigned serves a file using a signed URL. The signature and expiry
+// are checked first; the torrent's row must still be there, as another
+// owner's row can keep its files after this one is deleted.
+func (h *TorrentHandler) DownloadSigned(c *fiber.Ctx) error {
+	d, err := h.signer.Verify(c.Params("token"))
+	if errors.Is(err, auth.ErrExpiredToken) {
+		return c.Status(fiber.StatusGone).JSON(models.ErrorResponse{
+			Error: "link expired",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "invalid link",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), d.InfoHash)
+
+	t, err := h.db.GetTorrent(c.UserContext(), d.TorrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "database error",
+		})
+	}
+	if t == nil || t.UserID != d.UserID || t.InfoHash != d.InfoHash {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	if t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt) {
+		return torrentExpired(c)
+	}
+
+	// Signed URLs are only issued for complete files
+	return h.serveFile(c, d.InfoHash, d.FilePath, nil, d.SHA256, d.MaxBytes, d.UserID, fiber.Map{
+		"torrent_id": d.TorrentID, "file": d.FilePath, "signed": true,
+	})
+}
+
+// serveFile sends one of a torrent's files, or its zip, with range support:
+// from the engine while it has the torrent, else from disk. The engine waits
+// for pieces still downloading, up to a bound; from disk, a file whose
+// recorded progress is under 100% is refused with 409 FILE_INCOMPLETE unless
+// ?allow_partial=true, which sends the bytes on disk so far marked with
+// X-File-Complete: false. file is the recorded entry, nil for zips and other
+// files known to be complete. checksum, the whole file's SHA-256 when known,
+// is sent as X-Checksum-SHA256. A positive maxBytes refuses files that have
+// grown past it. Both sources get the same headers, ETag included, and the
+// same Range and If-Range handling. Usage is logged in the background:
+// download_started with the bytes the response is to send up front, and
+// download_served with the bytes actually sent once it ends.
+func (h *TorrentHandler) serveFile(c *fiber.Ctx, infoHash, relPath string, file *models.TorrentFile, checksum string, maxBytes int64, userID uuid.UUID, metadata fiber.Map) error {
+	filename := relPath
+	if idx := strings.LastIndex(filename, "/"); idx >= 0 {
+		filename = filename[idx+1:]
+	}
+
+	// Try to get file reader from engine first. Range requests mostly come
+	// from players that seek, the rest read the file through.
+	opts := h.engine.DownloadReaderOptions()
+	if c.Get(fiber.HeaderRange) != "" {
+		opts = h.engine.StreamReaderOptions()
+	}
+	partial := false
+	reader, size, err := h.engine.GetFileReader(infoHash, relPath, opts)
+	etag := contentETag(infoHash, relPath, size)
+	if err != nil {
+		if file != nil && file.Progress < 100 {
+			if c.Query("allow_partial") != "true" {
+				return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+					Error:   "file has not finished downloading",
+					Code:    "FILE_INCOMPLETE",
+					Details: fmt.Sprintf("%.1f%% downloaded; pass allow_partial=true to get what there is", file.Progress),
+				})
+			}
+			partial = true
+		}
+
+		// Fall back to serving from disk; zips live next to the torrent's files
+		torrentDir := h.engine.TorrentDir(infoHash)
+		filePath := filepath.Join(torrentDir, relPath)
+
+		// Security check - prevent path traversal
+		if !withinDir(torrentDir, filePath) {
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Error: "invalid file path",
+			})
+		}
+
+		f, err := os.Open(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Error: "file not found on disk",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+				Error: "failed to open file",
+			})
+		}
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+				Error: "file not found on disk",
+			})
+		}
+		reader, size = f, info.Size()
+		if partial && size > file.Size {
+			size = file.Size
+		}
+
+		// The engine only serves the torrent's own files, fixed by its info
+		// hash. On disk the same holds for recorded files, but a zip can be
+		// rebuilt, so its modification time stands in, and a partial file
+		// is still growing.
+		switch {
+		case partial:
+			etag = ""
+		case file == nil:
+			etag = fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), size)
+		}
+	}
+	if checksum != "" {
+		etag = `"` + checksum + `"`
+	}
+
+	// fasthttp closes the body once the response ends, sent or not, and
+	// every early return below closes it
+	body := &servedReader{Reader: reader, closer: reader, done: func(n int64) {
+		h.logDownload(userID, "download_served", n, metadata)
+	}, release: middleware.HoldConcurrencySlot(c)}
+
+	if maxBytes > 0 && size > maxBytes {
+		body.Close()
+		return fileChanged(c)
+	}
+
+	// A resume only gets the range it asks for if its copy is of the same
+	// content; otherwise, or when that can't be told, it gets all of it
+	rangeHeader := c.Get(fiber.HeaderRange)
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange != "" && (etag == "" || ifRange != etag) {
+		rangeHeader = ""
+	}
+	var ranges []byteRange
+	if rangeHeader != "" {
+		if ranges, err = parseByteRanges(rangeHeader, size); err != nil {
+			body.Close()
+			return rangeNotSatisfiable(c, size, err)
+		}
+	}
+	h.logDownload(userID, "download_started", rangesLength(ranges, size), metadata)
+
+	c.Set("Content-Disposition", attachmentDisposition(filename))
+	c.Set("Content-Type", "application/octet-stream")
+	c.Set("Accept-Ranges", "bytes")
+	if etag != "" {
+		c.Set(fiber.HeaderETag, etag)
+	}
+	if partial {
+		c.Set("X-File-Complete", "false")
+	}
+	if checksum != "" {
+		c.Set("X-Checksum-SHA256", checksum)
+	}
+
+	// Handle range requests for streaming
+	if len(ranges) > 0 {
+		return h.serveRanges(c, reader, body, size, ranges)
+	}
+
+	// A partial file is the start of the real one
+	if partial && size > 0 && size < file.Size {
+		c.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", size-1, file.Size))
+		c.Status(fiber.StatusPartialContent)
+		c.Context().SetBodyStream(body, int(size))
+		return nil
+	}
+
+	c.Status(fiber.StatusOK)
+	c.Context().SetBodyStream(body, int(size))
+	return nil
+}
+
+// withinDir reports whether name lies below dir. A plain prefix check
+// would also pass siblings such as dir+"-other".
+func withinDir(dir, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil || rel == "." || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// logDownload records a download usage entry in the background, so serving
+// never waits on the database
+func (h *TorrentHandler) logDownload(userID uuid.UUID, action string, bytes int64, metadata fiber.Map) {
+	go func() {
+		ctx, cancel := database.WithTimeout(context.Background())
+		defer cancel()
+		if err := h.db.LogUsage(ctx, userID, action, bytes, metadata); err != nil {
+			log.Printf("Failed to log %s for %s: %v", action, userID, err)
+		}
+	}()
+}
+
+// servedReader is a response body that counts the bytes read from it to be
+// sent. Close closes the underlying file and reports the count, if any.
+type servedReader struct {
+	io.Reader
+	closer  io.Closer
+	n       int64
+	done    func(n int64)
+	release func() // frees the request's stream slot
+}
+
+func (r *servedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *servedReader) Close() error {
+	if r.done != nil && r.n > 0 {
+		r.done(r.n)
+	}
+	r.done = nil
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// fileChanged refuses a signed download whose file is larger than when the
+// URL was signed
+func fileChanged(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+		Error: "file has changed since the link was created",
+		Code:  "FILE_CHANGED",
+	})
+}
+
+// contentETag is the ETag of a torrent's file: its info hash fixes the
+// content, so the path and size are all that's left to tell files apart
+func contentETag(infoHash, relPath string, size int64) string {
+	return fmt.Sprintf(`"%s-%08x-%x"`, infoHash, crc32.ChecksumIEEE([]byte(relPath)), size)
+}
+
+// serveRanges serves parsed byte ranges of reader through body: one range
+// as a plain 206, several as multipart/byteranges
+func (h *TorrentHandler) serveRanges(c *fiber.Ctx, reader io.ReadSeeker, body *servedReader, size int64, ranges []byteRange) error {
+	if len(ranges) == 1 {
+		r := ranges[0]
+		if _, err := reader.Seek(r.start, io.SeekStart); err != nil {
+			body.Close()
+			return c.Status(fiber.StatusInternalServerError).SendString("Seek failed")
+		}
+
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentRange, r.contentRange(size))
+		body.Reader = io.LimitReader(reader, r.length())
+		c.Context().SetBodyStream(body, int(r.length()))
+		return nil
+	}
+
+	// The boundary goes in the header before the body is written
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	c.Status(fiber.StatusPartialContent)
+	c.Set(fiber.HeaderContentType, "multipart/byteranges; boundary="+boundary)
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer body.Close()
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(boundary)
+		for _, r := range ranges {
+			if _, err := reader.Seek(r.start, io.SeekStart); err != nil {
+				log.Printf("Range download stopped: %v", err)
+				return
+			}
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				fiber.HeaderContentType:  {"application/octet-stream"},
+				fiber.HeaderContentRange: {r.contentRange(size)},
+			})
+			if err != nil {
+				return
+			}
+			body.Reader = io.LimitReader(reader, r.length())
+			if _, err := io.Copy(part, body); err != nil {
+				return
+			}
+		}
+		if mw.Close() == nil {
+			w.Flush()
+		}
+	}))
+	return nil
+}
+
+// checkDiskError refuses torrents that would download while the engine is
+// stopped by a disk write error, until an admin clears it. When it reports
+// false it has already written the error response.
+func (h *TorrentHandler) checkDiskError(c *fiber.Ctx) (bool, error) {
+	if h.engine.DiskError() == nil {
+		return true, nil
+	}
+	return false, c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+		Error: "new torrents are paused after a disk write error",
+		Code:  "DISK_ERROR",
+	})
+}
+
+// checkQuota enforces the user's plan limits. When it reports false it has
+// already written the error response, which the caller should return.
+func (h *TorrentHandler) checkQuota(c *fiber.Ctx, userID uuid.UUID) (bool, error) {
+	limits, err := h.planLimits(c.UserContext(), userID)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check subscription",
+		})
+	}
+
+	// Check concurrent limit
+	activeCount, _ := h.db.CountActiveTorrents(c.UserContext(), userID)
 	if activeCount >= limits.ConcurrentLimit {
-		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+		return false, c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
 			Error: "concurrent download limit reached",
 			Code:  "CONCURRENT_LIMIT",
 		})
@@ -694,15 +2246,309 @@ func (h *TorrentHandler) checkQuota(c *fiber.Ctx, userID uuid.UUID) error {
 
 	// Check monthly bandwidth (if not unlimited)
 	if limits.DownloadLimitGB > 0 {
-		monthlyUsage, _ := h.db.GetMonthlyUsage(c.Context(), userID)
-		limitBytes := int64(limits.DownloadLimitGB) * 1024 * 1024 * 1024
-		if monthlyUsage >= limitBytes {
-			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+		period, _ := h.db.GetUsagePeriod(c.UserContext(), userID)
+		monthlyUsage, _ := h.db.GetMonthlyUsage(c.UserContext(), userID, period)
+		if models.BandwidthExhausted(monthlyUsage, limits.DownloadLimitGB) {
+			return false, c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
 				Error: "monthly download limit reached",
 				Code:  "BANDWIDTH_LIMIT",
 			})
 		}
 	}
 
-	return nil
+	return true, nil
+}
+
+// checkResumeBandwidth refuses resuming t when what it still has to
+// download would take its owner past the plan's monthly bandwidth. At
+// exactly the limit it still fits. With partial it resumes anyway on the
+// bandwidth left, returning the downloaded bytes at which t is to be paused
+// again; zero means it may download in full. Reports false once it has
+// responded.
+func (h *TorrentHandler) checkResumeBandwidth(c *fiber.Ctx, t *models.Torrent, partial bool) (int64, bool, error) {
+	limits, err := h.planLimits(c.UserContext(), t.UserID)
+	if err != nil {
+		return 0, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check subscription",
+		})
+	}
+	if limits.DownloadLimitGB <= 0 {
+		return 0, true, nil
+	}
+
+	period, err := h.db.GetUsagePeriod(c.UserContext(), t.UserID)
+	if err != nil {
+		return 0, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check usage",
+		})
+	}
+	used, err := h.db.GetMonthlyUsage(c.UserContext(), t.UserID, period)
+	if err != nil {
+		return 0, false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check usage",
+		})
+	}
+
+	downloaded, remaining := h.remainingBytes(t)
+	limit := models.GBytes(limits.DownloadLimitGB)
+	available := max(limit-used, 0)
+	if pauseAt, ok := resumeBudget(downloaded, remaining, available, partial); ok {
+		return pauseAt, true, nil
+	}
+
+	return 0, false, c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+		Error: "not enough bandwidth left to finish this torrent",
+		Code:  "BANDWIDTH_LIMIT",
+		Details: fmt.Sprintf("%s left to download, %s of %s left this period; resume with ?partial=true to download what fits",
+			models.HumanBytes(remaining), models.HumanBytes(available), models.HumanBytes(limit)),
+	})
+}
+
+// resumeBudget decides a resume with remaining bytes still to download and
+// available bytes of bandwidth left: in full (pauseAt zero) when they fit,
+// or with partial up to downloaded+available
+func resumeBudget(downloaded, remaining, available int64, partial bool) (pauseAt int64, ok bool) {
+	if remaining <= available {
+		return 0, true
+	}
+	if partial && available > 0 {
+		return downloaded + available, true
+	}
+	return 0, false
+}
+
+// remainingBytes returns how much of t is downloaded and how much is left,
+// from the engine's live stats when it has the torrent's metadata and from
+// the database row otherwise
+func (h *TorrentHandler) remainingBytes(t *models.Torrent) (downloaded, remaining int64) {
+	if status, err := h.engine.GetTorrentStatus(t.InfoHash); err == nil && status.WantedSize > 0 {
+		return status.Downloaded, max(status.WantedSize-status.Downloaded, 0)
+	}
+	return t.DownloadedSize, max(t.TotalSize-t.DownloadedSize, 0)
+}
+
+// checkAddVelocity enforces the plan's hourly and daily add limits. Unlike
+// the concurrent limit these count deleted torrents too, so scripted
+// add-and-delete loops run out. Reports false once it has responded.
+func (h *TorrentHandler) checkAddVelocity(c *fiber.Ctx, userID uuid.UUID) (bool, error) {
+	limits, err := h.planLimits(c.UserContext(), userID)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check subscription",
+		})
+	}
+
+	hour, day, err := h.db.CountTorrentAdds(c.UserContext(), userID)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check add limits",
+		})
+	}
+
+	var details string
+	switch {
+	case hour >= limits.AddsPerHour:
+		c.Set(fiber.HeaderRetryAfter, "3600")
+		details = fmt.Sprintf("limit is %d torrents per hour", limits.AddsPerHour)
+	case day >= limits.AddsPerDay:
+		c.Set(fiber.HeaderRetryAfter, "86400")
+		details = fmt.Sprintf("limit is %d torrents per day", limits.AddsPerDay)
+	default:
+		return true, nil
+	}
+
+	return false, c.Status(fiber.StatusTooManyRequests).JSON(models.ErrorResponse{
+		Error:   "too many torrents added",
+		Code:    "ADD_VELOCITY_LIMIT",
+		Details: details,
+	})
+}
+
+// checkStorage refuses an add of addBytes when the user's data on disk, plus
+// what their unfinished torrents will still bring, would go over the plan's
+// storage limit. Reports false once it has responded.
+func (h *TorrentHandler) checkStorage(c *fiber.Ctx, userID uuid.UUID, addBytes int64) (bool, error) {
+	limits, err := h.planLimits(c.UserContext(), userID)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check subscription",
+		})
+	}
+	if limits.StorageLimitGB <= 0 {
+		return true, nil
+	}
+
+	usage, err := h.db.GetStorageUsage(c.UserContext(), userID)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check storage",
+		})
+	}
+
+	committed := usage.Used + usage.Pending
+	if !models.StorageExceeded(committed, addBytes, limits.StorageLimitGB) {
+		return true, nil
+	}
+	return false, c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+		Error:   "storage limit reached",
+		Code:    "STORAGE_LIMIT",
+		Details: fmt.Sprintf("%s of %s in use or downloading", models.HumanBytes(committed), models.HumanBytes(models.GBytes(limits.StorageLimitGB))),
+	})
+}
+
+// checkChurn refuses an info hash the user has recently added and deleted
+// too often. Reports false once it has responded.
+func (h *TorrentHandler) checkChurn(c *fiber.Ctx, userID uuid.UUID, infoHash string) (bool, error) {
+	until, err := h.db.GetChurnCooldown(c.UserContext(), userID, infoHash)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check add limits",
+		})
+	}
+	if until == nil {
+		return true, nil
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(*until).Seconds())+1))
+	return false, c.Status(fiber.StatusTooManyRequests).JSON(models.ErrorResponse{
+		Error:   "torrent was added and deleted too many times",
+		Code:    "ADD_COOLDOWN",
+		Details: fmt.Sprintf("try again after %s", until.UTC().Format(time.RFC3339)),
+	})
+}
+
+// checkBlocked refuses an info hash taken down after an abuse report.
+// Reports false once it has responded.
+func (h *TorrentHandler) checkBlocked(c *fiber.Ctx, infoHash string) (bool, error) {
+	blocked, err := h.db.IsInfoHashBlocked(c.UserContext(), infoHash)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check add limits",
+		})
+	}
+	if !blocked {
+		return true, nil
+	}
+
+	return false, c.Status(fiber.StatusUnavailableForLegalReasons).JSON(models.ErrorResponse{
+		Error: "torrent has been removed following an abuse report",
+		Code:  "TORRENT_BLOCKED",
+	})
+}
+
+// checkCollection refuses a collection that doesn't exist or belongs to
+// someone else. A nil collection is always fine. Reports false once it has
+// responded.
+func (h *TorrentHandler) checkCollection(c *fiber.Ctx, userID uuid.UUID, collectionID *uuid.UUID) (bool, error) {
+	if collectionID == nil {
+		return true, nil
+	}
+	collection, err := h.db.GetCollection(c.UserContext(), *collectionID)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch collection",
+		})
+	}
+	if collection == nil || collection.UserID != userID {
+		return false, c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "collection not found",
+		})
+	}
+	return true, nil
+}
+
+// limitReasons returns the error codes adding a torrent of the given size
+// would fail with right now, the same checks AddTorrent makes without
+// responding
+func (h *TorrentHandler) limitReasons(ctx context.Context, userID uuid.UUID, infoHash string, size int64) ([]string, error) {
+	limits, err := h.planLimits(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reasons []string
+	active, err := h.db.CountActiveTorrents(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if active >= limits.ConcurrentLimit {
+		reasons = append(reasons, "CONCURRENT_LIMIT")
+	}
+
+	if limits.DownloadLimitGB > 0 {
+		period, err := h.db.GetUsagePeriod(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		used, err := h.db.GetMonthlyUsage(ctx, userID, period)
+		if err != nil {
+			return nil, err
+		}
+		if models.BandwidthExhausted(used, limits.DownloadLimitGB) || used+size > models.GBytes(limits.DownloadLimitGB) {
+			reasons = append(reasons, "BANDWIDTH_LIMIT")
+		}
+	}
+
+	if limits.StorageLimitGB > 0 {
+		usage, err := h.db.GetStorageUsage(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if models.StorageExceeded(usage.Used+usage.Pending, size, limits.StorageLimitGB) {
+			reasons = append(reasons, "STORAGE_LIMIT")
+		}
+	}
+
+	hour, day, err := h.db.CountTorrentAdds(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if hour >= limits.AddsPerHour || day >= limits.AddsPerDay {
+		reasons = append(reasons, "ADD_VELOCITY_LIMIT")
+	}
+
+	until, err := h.db.GetChurnCooldown(ctx, userID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	if until != nil {
+		reasons = append(reasons, "ADD_COOLDOWN")
+	}
+
+	blocked, err := h.db.IsInfoHashBlocked(ctx, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		reasons = append(reasons, "TORRENT_BLOCKED")
+	}
+	return reasons, nil
+}
+
+// UserPlanLimits returns the limits of the user's plan, defaulting to free
+// when it can't be read
+func UserPlanLimits(ctx context.Context, db *database.Database, userID uuid.UUID) models.PlanLimits {
+	limits, _ := db.GetPlanLimits(ctx, "free")
+	if sub, _ := db.GetSubscription(ctx, userID); sub != nil {
+		if planLimits, ok := db.GetPlanLimits(ctx, sub.Plan); ok {
+			limits = planLimits
+		}
+	}
+	return limits
+}
+
+// planLimits returns the limits of the user's plan, defaulting to free
+func (h *TorrentHandler) planLimits(ctx context.Context, userID uuid.UUID) (models.PlanLimits, error) {
+	sub, err := h.db.GetSubscription(ctx, userID)
+	if err != nil {
+		return models.PlanLimits{}, err
+	}
+
+	limits, _ := h.db.GetPlanLimits(ctx, "free")
+	if sub != nil {
+		if planLimits, ok := h.db.GetPlanLimits(ctx, sub.Plan); ok {
+			limits = planLimits
+		}
+	}
+	return limits, nil
 }
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+func TestWithinDir(t *testing.T) {
+	dir := filepath.FromSlash("/data/abc")
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"/data/abc/file.mkv", true},
+		{"/data/abc/sub/file.mkv", true},
+		{"/data/abc/..hidden", true},
+		{"/data/abc", false},
+		{"/data/abc/", false},
+		{"/data/abc-evil/file.mkv", false},
+		{"/data/abcd", false},
+		{"/data/abc/../abc-evil/file.mkv", false},
+		{"/data/file.mkv", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := withinDir(dir, filepath.FromSlash(tt.name)); got != tt.want {
+			t.Errorf("withinDir(%q, %q) = %v, want %v", dir, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResumeBudget(t *testing.T) {
+	tests := []struct {
+		name                             string
+		downloaded, remaining, available int64
+		partial                          bool
+		pauseAt                          int64
+		ok                               bool
+	}{
+		{"fits", 100, 500, 1000, false, 0, true},
+		{"exactly the bandwidth left", 100, 1000, 1000, false, 0, true},
+		{"one byte over", 100, 1001, 1000, false, 0, false},
+		{"one byte over, partial", 100, 1001, 1000, true, 1100, true},
+		{"nothing left to download", 100, 0, 0, false, 0, true},
+		{"no bandwidth left", 100, 1, 0, false, 0, false},
+		{"no bandwidth left, partial", 100, 1, 0, true, 0, false},
+	}
+	for _, tt := range tests {
+		pauseAt, ok := resumeBudget(tt.downloaded, tt.remaining, tt.available, tt.partial)
+		if pauseAt != tt.pauseAt || ok != tt.ok {
+			t.Errorf("%s: resumeBudget = %d, %v; want %d, %v", tt.name, pauseAt, ok, tt.pauseAt, tt.ok)
+		}
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		want      time.Time
+		clamped   bool
+	}{
+		{"no expiry", nil, now.Add(downloadTokenTTL), false},
+		{"expires later", ptr(now.Add(72 * time.Hour)), now.Add(downloadTokenTTL), false},
+		{"expires with the token", ptr(now.Add(downloadTokenTTL)), now.Add(downloadTokenTTL), false},
+		{"expires sooner", ptr(now.Add(3 * time.Hour)), now.Add(3 * time.Hour), true},
+		{"expires in a second", ptr(now.Add(time.Second)), now.Add(time.Second), true},
+	}
+	for _, tt := range tests {
+		got, clamped := tokenExpiry(&models.Torrent{ExpiresAt: tt.expiresAt}, now, downloadTokenTTL)
+		if !got.Equal(tt.want) || clamped != tt.clamped {
+			t.Errorf("%s: tokenExpiry = %v, %v; want %v, %v", tt.name, got, clamped, tt.want, tt.clamped)
+		}
+	}
+
+	// Signed URLs live longer than tokens, and are clamped the same way
+	expiresAt := now.Add(72 * time.Hour)
+	if got, clamped := tokenExpiry(&models.Torrent{ExpiresAt: &expiresAt}, now, maxSignedURLExpiry); !got.Equal(expiresAt) || !clamped {
+		t.Errorf("signed URL: tokenExpiry = %v, %v; want %v, true", got, clamped, expiresAt)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetTrackers lists a torrent's trackers with their announce state and
+// swarm counts, as the engine last refreshed them. A torrent the engine
+// isn't running lists none.
+func (h *TorrentHandler) GetTrackers(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	torrentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid torrent ID",
+		})
+	}
+
+	t, err := h.db.GetTorrent(c.UserContext(), torrentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to fetch torrent",
+		})
+	}
+	if t == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "torrent not found",
+		})
+	}
+	c.Locals(string(middleware.InfoHashKey), t.InfoHash)
+
+	role := middleware.GetUserRole(c)
+	if t.UserID != userID && role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "access denied",
+		})
+	}
+
+	trackers, active := h.engine.Trackers(t.InfoHash)
+	if trackers == nil {
+		trackers = []torrent.TrackerStatus{}
+	}
+	return c.JSON(fiber.Map{
+		"trackers":       trackers,
+		"active":         active,
+		"health_warning": t.HealthWarning,
+	})
+}
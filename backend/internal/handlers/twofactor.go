@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// twoFactorAttempts is how many two-factor codes a user may try a minute
+const twoFactorAttempts = 5
+
+// checkTwoFactorCode reports whether code is a current code of the user's
+// TOTP secret that hasn't been used yet, using it up if so. Attempts past
+// twoFactorAttempts a minute are refused unchecked.
+func (h *AuthHandler) checkTwoFactorCode(ctx context.Context, userID uuid.UUID, code string) (bool, error) {
+	if !h.codeAttempts.Allow(userID.String()) {
+		return false, nil
+	}
+	secret, _, lastStep, err := h.db.GetTOTP(ctx, userID)
+	if err != nil || secret == "" {
+		return false, err
+	}
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	return h.db.UseTOTPStep(ctx, userID, step)
+}
+
+// SetupTwoFactor creates a TOTP secret for the current user to add to an
+// authenticator app. Sign-in doesn't ask for codes until EnableTwoFactor
+// confirms one; setting up again replaces the secret.
+func (h *AuthHandler) SetupTwoFactor(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "user not found",
+		})
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to generate secret",
+		})
+	}
+	set, err := h.db.SetTOTPSecret(c.UserContext(), userID, secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to save secret",
+		})
+	}
+	if !set {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "two-factor sign-in is already enabled",
+			Code:  "TWO_FACTOR_ENABLED",
+		})
+	}
+
+	return c.JSON(models.TwoFactorSetup{
+		Secret:     secret,
+		OTPAuthURL: auth.TOTPURI(secret, user.Email),
+	})
+}
+
+// EnableTwoFactor turns on two-factor sign-in once a code from the secret
+// set up is confirmed. Sessions signed in before don't count as two-factor
+// ones; signing in again gives one that does.
+func (h *AuthHandler) EnableTwoFactor(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	var req models.TwoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	secret, enabled, _, err := h.db.GetTOTP(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "database error",
+		})
+	}
+	switch {
+	case enabled:
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "two-factor sign-in is already enabled",
+			Code:  "TWO_FACTOR_ENABLED",
+		})
+	case secret == "":
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "set up two-factor sign-in first",
+			Code:  "TWO_FACTOR_NOT_SET_UP",
+		})
+	}
+
+	step, ok := auth.ValidateTOTP(secret, req.Code, time.Now())
+	if !h.codeAttempts.Allow(userID.String()) || !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid two-factor code",
+			Code:  "TWO_FACTOR_CODE_INVALID",
+		})
+	}
+	if _, err := h.db.EnableTOTP(c.UserContext(), userID, step); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to enable two-factor sign-in",
+		})
+	}
+
+	user, err := h.db.GetUserByID(c.UserContext(), userID)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "user not found",
+		})
+	}
+	return c.JSON(user)
+}
+
+// DisableTwoFactor turns off two-factor sign-in, confirmed with a current
+// code
+func (h *AuthHandler) DisableTwoFactor(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+	var req models.TwoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+
+	_, enabled, _, err := h.db.GetTOTP(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "database error",
+		})
+	}
+	if !enabled {
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "two-factor sign-in is not enabled",
+			Code:  "TWO_FACTOR_NOT_ENABLED",
+		})
+	}
+	valid, err := h.checkTwoFactorCode(c.UserContext(), userID, req.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "database error",
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid two-factor code",
+			Code:  "TWO_FACTOR_CODE_INVALID",
+		})
+	}
+
+	if err := h.db.DisableTOTP(c.UserContext(), userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to disable two-factor sign-in",
+		})
+	}
+	return c.JSON(models.SuccessResponse{
+		Message: "two-factor sign-in disabled",
+	})
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/uploads"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// UploadHandler serves resumable uploads: create one, send it in chunks with
+// Content-Range, and ask for the offset to resume from after a dropped
+// connection. Completed uploads are consumed elsewhere, e.g. by UploadTorrent.
+type UploadHandler struct {
+	db    *database.Database
+	store *uploads.Store
+}
+
+func NewUploadHandler(db *database.Database, store *uploads.Store) *UploadHandler {
+	return &UploadHandler{
+		db:    db,
+		store: store,
+	}
+}
+
+// CreateUpload starts a resumable upload, within the plan's size and
+// concurrent upload limits
+func (h *UploadHandler) CreateUpload(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	var req struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid request body",
+		})
+	}
+	if req.Filename == "" || req.Size <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "filename and a positive size are required",
+		})
+	}
+
+	limits := h.limits(c.UserContext(), userID)
+	if req.Size > int64(limits.MaxUploadMB)*1024*1024 {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Error:   "upload exceeds your plan's size limit",
+			Code:    "UPLOAD_TOO_LARGE",
+			Details: fmt.Sprintf("limit is %d MB", limits.MaxUploadMB),
+		})
+	}
+
+	active, err := h.db.CountActiveUploads(c.UserContext(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to check uploads",
+		})
+	}
+	if active >= limits.ConcurrentUploads {
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error: "too many uploads in progress",
+			Code:  "CONCURRENT_UPLOAD_LIMIT",
+		})
+	}
+
+	u, err := h.store.Create(c.UserContext(), userID, req.Filename, req.Size)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to create upload",
+		})
+	}
+
+	c.Set(fiber.HeaderLocation, "/api/v1/uploads/"+u.ID.String())
+	c.Set("Upload-Offset", "0")
+	return c.Status(fiber.StatusCreated).JSON(u)
+}
+
+// GetUpload reports how much of an upload has arrived
+func (h *UploadHandler) GetUpload(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	uploadID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid upload ID",
+		})
+	}
+
+	u, err := h.store.Get(c.UserContext(), userID, uploadID)
+	if err != nil {
+		return uploadError(c, err)
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	return c.JSON(u)
+}
+
+// PatchUpload stores one chunk, described by a Content-Range header of the
+// form "bytes start-end/size". The chunk must start at the current offset.
+func (h *UploadHandler) PatchUpload(c *fiber.Ctx) error {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(models.ErrorResponse{
+			Error: "invalid user",
+		})
+	}
+
+	uploadID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "invalid upload ID",
+		})
+	}
+
+	body := c.Body()
+	start, end, size, err := parseContentRange(c.Get(fiber.HeaderContentRange))
+	if err != nil || end-start+1 != int64(len(body)) {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error:   "invalid Content-Range",
+			Details: "expected bytes start-end/size matching the body",
+		})
+	}
+
+	u, err := h.store.Get(c.UserContext(), userID, uploadID)
+	if err != nil {
+		return uploadError(c, err)
+	}
+	if size >= 0 && size != u.Size {
+		return c.Status(fiber.StatusBadRequest).JSON(models.ErrorResponse{
+			Error: "Content-Range size does not match the upload",
+		})
+	}
+
+	u, err = h.store.Append(c.UserContext(), userID, uploadID, start, bytes.NewReader(body), int64(len(body)))
+	if u != nil {
+		c.Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	}
+	if err != nil {
+		return uploadError(c, err)
+	}
+	return c.JSON(u)
+}
+
+// uploadError maps upload store errors to responses
+func uploadError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, uploads.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(models.ErrorResponse{
+			Error: "upload not found",
+		})
+	case errors.Is(err, uploads.ErrOffsetMismatch):
+		return c.Status(fiber.StatusConflict).JSON(models.ErrorResponse{
+			Error: "chunk does not start at the upload offset",
+			Code:  "OFFSET_MISMATCH",
+		})
+	case errors.Is(err, uploads.ErrTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+			Error: "chunk runs past the end of the upload",
+			Code:  "UPLOAD_TOO_LARGE",
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(models.ErrorResponse{
+			Error: "failed to store upload",
+		})
+	}
+}
+
+// limits returns the user's plan limits
+func (h *UploadHandler) limits(ctx context.Context, userID uuid.UUID) models.PlanLimits {
+	return UserPlanLimits(ctx, h.db, userID)
+}
+
+// parseContentRange parses "bytes start-end/size" from a chunk upload. size
+// is -1 when given as "*".
+func parseContentRange(header string) (start, end, size int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, errMalformedRange
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, errMalformedRange
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, errMalformedRange
+	}
+
+	if start, err = parseRangeInt(first); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = parseRangeInt(last); err != nil {
+		return 0, 0, 0, err
+	}
+	if end < start {
+		return 0, 0, 0, errMalformedRange
+	}
+
+	size = -1
+	if total != "*" {
+		if size, err = parseRangeInt(total); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return start, end, size, nil
+}
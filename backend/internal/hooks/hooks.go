@@ -0,0 +1,192 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/redact"
+	"github.com/google/uuid"
+)
+
+// maxRunning bounds the hook commands running at once, so a bulk import or
+// cleanup queues them instead of forking hundreds of processes
+const maxRunning = 4
+
+// maxOutput is how much of a failed command's output is logged
+const maxOutput = 2048
+
+// Hooks is told about moments in a torrent's or user's life, for behavior
+// one deployment wants and others don't: scanning completed files, pushing
+// them to a CDN, syncing accounts. Calls must return promptly and can't
+// fail the operation that made them; implementations log their own errors.
+type Hooks interface {
+	OnTorrentAdded(t *models.Torrent)
+	// files are the wanted files of the torrent, with paths on disk
+	OnTorrentCompleted(t *models.Torrent, files []File)
+	// reason is DeleteReasonUser, DeleteReasonAdmin, DeleteReasonExpired,
+	// DeleteReasonTakedown or DeleteReasonPurged
+	OnTorrentDeleted(t *models.Torrent, reason string)
+	OnUserRegistered(u *models.User)
+}
+
+// Why a torrent was deleted
+const (
+	DeleteReasonUser    = "user"
+	DeleteReasonAdmin   = "admin"
+	DeleteReasonExpired = "expired"
+	// DeleteReasonTakedown is an admin acting on an abuse report
+	DeleteReasonTakedown = "takedown"
+	// DeleteReasonPurged is a failed or cancelled torrent past its retention
+	DeleteReasonPurged = "purged"
+)
+
+// File is a completed torrent's file on disk
+type File struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Commands are the external commands run for each hook, as a program and
+// its arguments separated by spaces; empty skips the hook
+type Commands struct {
+	TorrentAdded     string
+	TorrentCompleted string
+	TorrentDeleted   string
+	UserRegistered   string
+}
+
+// Nop ignores every hook
+type Nop struct{}
+
+func (Nop) OnTorrentAdded(*models.Torrent)             {}
+func (Nop) OnTorrentCompleted(*models.Torrent, []File) {}
+func (Nop) OnTorrentDeleted(*models.Torrent, string)   {}
+func (Nop) OnUserRegistered(*models.User)              {}
+
+// New returns hooks that run cmds, each given the event as JSON on stdin
+// and killed after timeout, or Nop when no command is set
+func New(cmds Commands, timeout time.Duration) Hooks {
+	if cmds == (Commands{}) {
+		return Nop{}
+	}
+	return &execHooks{
+		cmds:    cmds,
+		timeout: timeout,
+		slots:   make(chan struct{}, maxRunning),
+	}
+}
+
+// Torrent is what a hook command is told about a torrent
+type Torrent struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	InfoHash  string    `json:"info_hash,omitempty"`
+	Name      string    `json:"name"`
+	TotalSize int64     `json:"total_size"`
+	Source    string    `json:"source,omitempty"`
+}
+
+// User is what a hook command is told about a user
+type User struct {
+	ID    uuid.UUID `json:"id"`
+	Email string    `json:"email"`
+	Role  string    `json:"role"`
+}
+
+// Payload is the JSON a hook command reads from stdin
+type Payload struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Torrent *Torrent  `json:"torrent,omitempty"`
+	Files   []File    `json:"files,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	User    *User     `json:"user,omitempty"`
+}
+
+type execHooks struct {
+	cmds    Commands
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func (h *execHooks) OnTorrentAdded(t *models.Torrent) {
+	h.run(h.cmds.TorrentAdded, Payload{Event: "torrent_added", Torrent: torrentOf(t)})
+}
+
+func (h *execHooks) OnTorrentCompleted(t *models.Torrent, files []File) {
+	h.run(h.cmds.TorrentCompleted, Payload{Event: "torrent_completed", Torrent: torrentOf(t), Files: files})
+}
+
+func (h *execHooks) OnTorrentDeleted(t *models.Torrent, reason string) {
+	h.run(h.cmds.TorrentDeleted, Payload{Event: "torrent_deleted", Torrent: torrentOf(t), Reason: reason})
+}
+
+func (h *execHooks) OnUserRegistered(u *models.User) {
+	h.run(h.cmds.UserRegistered, Payload{Event: "user_registered", User: &User{ID: u.ID, Email: u.Email, Role: u.Role}})
+}
+
+func torrentOf(t *models.Torrent) *Torrent {
+	return &Torrent{
+		ID:        t.ID,
+		UserID:    t.UserID,
+		InfoHash:  t.InfoHash,
+		Name:      t.Name,
+		TotalSize: t.TotalSize,
+		Source:    t.Audit.Source,
+	}
+}
+
+// run starts command in the background with p on stdin. The event is also
+// in HOOK_EVENT, for scripts handling several.
+func (h *execHooks) run(command string, p Payload) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return
+	}
+	p.Time = time.Now()
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Hook %s: failed to encode payload: %v", p.Event, err)
+		return
+	}
+
+	go func() {
+		h.slots <- struct{}{}
+		defer func() { <-h.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), "HOOK_EVENT="+p.Event)
+		cmd.Stdin = bytes.NewReader(body)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		// A child left holding the output open mustn't outlive the timeout
+		cmd.WaitDelay = time.Second
+
+		start := time.Now()
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("timed out after %s", h.timeout)
+			}
+			output := out.String()
+			if len(output) > maxOutput {
+				output = output[:maxOutput] + "..."
+			}
+			// A script may echo the payload, magnet URIs and all
+			log.Printf("Hook %s (%s) failed: %s: %s", p.Event, args[0], redact.Error(err), redact.String(strings.TrimSpace(output)))
+			return
+		}
+		log.Printf("Hook %s (%s) ran in %s", p.Event, args[0], time.Since(start).Round(time.Millisecond))
+	}()
+}
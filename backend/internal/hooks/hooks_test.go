@@ -0,0 +1,133 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// writeScript writes an executable shell script to a temporary directory
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts need a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// waitFor polls cond for up to five seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a log destination safe to read while hooks write to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	var b syncBuffer
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &b
+}
+
+func TestNewWithoutCommands(t *testing.T) {
+	if _, ok := New(Commands{}, time.Second).(Nop); !ok {
+		t.Fatal("New without commands isn't Nop")
+	}
+}
+
+func TestHookPayload(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "payload")
+	script := writeScript(t, `cat > "$1.tmp" && echo "$HOOK_EVENT" > "$1.event" && mv "$1.tmp" "$1"`+"\n")
+	h := New(Commands{TorrentDeleted: script + " " + out}, 5*time.Second)
+
+	tr := &models.Torrent{ID: uuid.New(), UserID: uuid.New(), InfoHash: "abc", Name: "Show", TotalSize: 42}
+	start := time.Now()
+	h.OnTorrentDeleted(tr, DeleteReasonExpired)
+	// Hooks this deployment doesn't set are skipped
+	h.OnTorrentAdded(tr)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("hook calls took %s; they must not wait for the command", elapsed)
+	}
+
+	waitFor(t, "the hook to run", func() bool {
+		_, err := os.Stat(out)
+		return err == nil
+	})
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Payload
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatalf("payload %s: %v", data, err)
+	}
+	if p.Event != "torrent_deleted" || p.Reason != DeleteReasonExpired || p.Time.IsZero() ||
+		p.Torrent == nil || *p.Torrent != (Torrent{ID: tr.ID, UserID: tr.UserID, InfoHash: "abc", Name: "Show", TotalSize: 42}) {
+		t.Errorf("payload %s", data)
+	}
+	event, _ := os.ReadFile(out + ".event")
+	if got := strings.TrimSpace(string(event)); got != "torrent_deleted" {
+		t.Errorf("HOOK_EVENT = %q, want torrent_deleted", got)
+	}
+}
+
+func TestHookFailureIsLogged(t *testing.T) {
+	logged := captureLog(t)
+	tests := []struct {
+		name, script string
+		timeout      time.Duration
+		want         string
+	}{
+		{"exit status", "cat; exit 3\n", 5 * time.Second, "exit status 3"},
+		{"timeout", "sleep 30\n", 100 * time.Millisecond, "timed out after 100ms"},
+	}
+	for _, tt := range tests {
+		h := New(Commands{UserRegistered: writeScript(t, tt.script)}, tt.timeout)
+		h.OnUserRegistered(&models.User{ID: uuid.New(), Email: "user@example.com"})
+		waitFor(t, tt.name+" to be logged", func() bool {
+			return strings.Contains(logged.String(), tt.want)
+		})
+	}
+	// The failed script echoed its payload, which is logged with it
+	if !strings.Contains(logged.String(), "user@example.com") {
+		t.Errorf("failed hook's output not logged: %s", logged.String())
+	}
+}
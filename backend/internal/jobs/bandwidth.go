@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// alertBandwidth warns the user once per usage period when their downloads
+// reach 80% and then 100% of their plan's bandwidth: a quota_warning event,
+// a notification and, unless they opted out, an email. A failure only costs
+// the warning, so it is logged rather than failing the completion.
+func (c *Completer) alertBandwidth(ctx context.Context, userID uuid.UUID) {
+	dbCtx, cancel := database.WithTimeout(ctx)
+	alert, err := c.db.ClaimBandwidthAlert(dbCtx, userID)
+	cancel()
+	if err != nil {
+		log.Printf("Failed to check bandwidth alerts for user %s: %v", userID, err)
+		return
+	}
+	if alert == nil {
+		return
+	}
+
+	used, limit := models.HumanBytes(alert.UsedBytes), models.HumanBytes(alert.LimitBytes)
+	c.events.Publish(events.Event{
+		UserID: userID,
+		Type:   "quota_warning",
+		Data: map[string]interface{}{
+			"threshold":   alert.Threshold,
+			"used_bytes":  alert.UsedBytes,
+			"limit_bytes": alert.LimitBytes,
+			"used_human":  used,
+			"limit_human": limit,
+			"used_gb":     float64(alert.UsedBytes) / float64(models.GB),
+			"limit_gb":    float64(alert.LimitBytes) / float64(models.GB),
+			"period_end":  alert.Period.End,
+		},
+	})
+
+	dbCtx, cancel = database.WithTimeout(ctx)
+	user, err := c.db.GetUserByID(dbCtx, userID)
+	cancel()
+	email, timezone := "", models.DefaultTimezone
+	if err == nil && user != nil {
+		timezone = user.Timezone
+		if user.EmailNotifications {
+			email = user.Email
+		}
+	}
+
+	resets := models.FormatUserDate(alert.Period.End, timezone)
+	title := fmt.Sprintf("You've used %d%% of your monthly bandwidth", alert.Threshold)
+	body := fmt.Sprintf("You've downloaded %s of your plan's %s this period, which resets on %s.\n\n"+
+		"Upgrade your plan if you need more before then.\n", used, limit, resets)
+	if alert.Threshold >= 100 {
+		title = "You've reached your monthly bandwidth limit"
+		body = fmt.Sprintf("You've downloaded %s of your plan's %s this period. "+
+			"New torrents can't be added until it resets on %s, or until you upgrade your plan.\n", used, limit, resets)
+	}
+
+	err = c.notifier.Notify(ctx, &models.Notification{
+		UserID: userID,
+		Type:   models.NotificationQuotaWarning,
+		Title:  title,
+		Body:   body,
+		Metadata: map[string]interface{}{
+			"threshold":   alert.Threshold,
+			"used_bytes":  alert.UsedBytes,
+			"limit_bytes": alert.LimitBytes,
+			"period_end":  alert.Period.End,
+		},
+	}, email)
+	if err != nil {
+		log.Printf("Failed to record bandwidth alert for user %s: %v", userID, err)
+	}
+}
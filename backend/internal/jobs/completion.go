@@ -0,0 +1,334 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/notify"
+	"github.com/freetorrent/freetorrent/internal/reporting"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/google/uuid"
+)
+
+// Completer runs the side effects of a torrent finishing: retention, the
+// stored file list, usage accounting and bandwidth alerts, the owner's
+// notification, the completion hook and the zip archive. Every step checks
+// the database before acting, so the update processor and the reconciliation
+// pass can both call it as often as they like.
+type Completer struct {
+	db       *database.Database
+	engine   torrent.Service
+	cfg      *config.Config
+	reporter reporting.Reporter
+	events   *events.Broker
+	notifier *notify.Notifier
+	hooks    hooks.Hooks
+
+	zipMu   sync.Mutex
+	zipping map[string][]uuid.UUID // info hash -> rows waiting on the zip being built
+	done    sync.Map               // torrent ID -> time.Time every side effect had run by, see Forget
+}
+
+// completionDoneTTL is how long a completed torrent skips CompleteTorrent's
+// checks. Past it they run again, picking up a zip a repair cleared.
+const completionDoneTTL = 10 * time.Minute
+
+// NewCompleter creates a new completion runner
+func NewCompleter(db *database.Database, engine torrent.Service, cfg *config.Config, reporter reporting.Reporter, broker *events.Broker, notifier *notify.Notifier, h hooks.Hooks) *Completer {
+	return &Completer{
+		db:       db,
+		engine:   engine,
+		cfg:      cfg,
+		reporter: reporter,
+		events:   broker,
+		notifier: notifier,
+		hooks:    h,
+		zipping:  make(map[string][]uuid.UUID),
+	}
+}
+
+// CompleteTorrent brings a finished torrent's database state up to date. It is
+// safe to call repeatedly; steps that already happened are skipped. ctx is the
+// caller's long-lived context: each database call gets its own deadline from
+// it, and a zip build started here is cancelled with it.
+func (c *Completer) CompleteTorrent(ctx context.Context, id uuid.UUID) error {
+	if at, ok := c.done.Load(id); ok {
+		if time.Since(at.(time.Time)) < completionDoneTTL {
+			return nil
+		}
+		c.done.Delete(id)
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	t, err := c.db.GetTorrent(dbCtx, id)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to load torrent: %w", err)
+	}
+	if t == nil {
+		return nil
+	}
+
+	// Take name, size and files from the engine while it still has them
+	if status, err := c.engine.GetTorrentStatus(t.InfoHash); err == nil && len(status.Files) > 0 {
+		if status.Name != "" && status.Name != "Fetching metadata..." &&
+			(status.Name != t.Name || status.TotalSize != t.TotalSize || status.IsPrivate != t.IsPrivate) {
+			dbCtx, cancel := database.WithTimeout(ctx)
+			err := c.db.UpdateTorrentName(dbCtx, id, status.Name, status.TotalSize, status.IsPrivate)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to update name: %w", err)
+			}
+			t.Name, t.TotalSize = status.Name, status.TotalSize
+		}
+		if t.CompletedAt == nil {
+			dbCtx, cancel := database.WithTimeout(ctx)
+			err := c.db.UpdateTorrentFiles(dbCtx, id, status.Files)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to update files: %w", err)
+			}
+		}
+		t.Files = status.Files
+	}
+
+	if t.CompletedAt == nil {
+		retentionDays := 1
+		dbCtx, cancel := database.WithTimeout(ctx)
+		sub, _ := c.db.GetSubscription(dbCtx, t.UserID)
+		cancel()
+		if sub != nil {
+			retentionDays = sub.RetentionDays
+		}
+		dbCtx, cancel = database.WithTimeout(ctx)
+		err := c.db.SetTorrentCompleted(dbCtx, id, retentionDays)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to mark completed: %w", err)
+		}
+
+		// A created torrent completes once its own files are verified
+		if t.Audit.Source != models.SourceCreated {
+			err := c.notifier.Notify(ctx, &models.Notification{
+				UserID:   t.UserID,
+				Type:     models.NotificationTorrentCompleted,
+				Title:    fmt.Sprintf("%q completed", t.Name),
+				Body:     fmt.Sprintf("Your torrent %q finished downloading and is ready to download from your dashboard.", t.Name),
+				Metadata: map[string]interface{}{"torrent_id": t.ID},
+			}, "")
+			if err != nil {
+				log.Printf("Failed to record completion of %s: %v", id, err)
+			}
+		}
+		c.hooks.OnTorrentCompleted(t, c.hookFiles(t))
+	}
+
+	// A created torrent's data was uploaded, not downloaded. Skipped files
+	// aren't charged.
+	if !t.CompletionLogged && t.Audit.Source != models.SourceCreated {
+		dbCtx, cancel := database.WithTimeout(ctx)
+		err := c.db.LogCompletionUsage(dbCtx, id, t.UserID, t.WantedSize(), t.Name)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to log usage: %w", err)
+		}
+		c.alertBandwidth(ctx, t.UserID)
+	}
+
+	// Store the same release added twice, usually from two trackers, once
+	if c.cfg.CrossSeedDedup && t.DeduplicatedFrom == nil && t.Audit.Source != models.SourceCreated {
+		c.dedupe(ctx, t)
+	}
+
+	// Auto-zip torrents of several wanted files unless the zip policy skips
+	// them
+	if len(models.WantedFiles(t.Files)) > 1 && (t.ZipPath == nil || *t.ZipPath == "") && t.ZipStatus == "" {
+		skip, err := c.zipSkipStatus(ctx, t)
+		if err != nil {
+			return fmt.Errorf("failed to check zip policy: %w", err)
+		}
+		if skip == "" {
+			c.startZip(ctx, t)
+			return nil
+		}
+
+		dbCtx, cancel := database.WithTimeout(ctx)
+		err = c.db.SetTorrentZipStatus(dbCtx, id, skip)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to update zip status: %w", err)
+		}
+	}
+
+	c.done.Store(id, time.Now())
+	return nil
+}
+
+// Forget makes the next CompleteTorrent of a torrent check everything
+// again, for one no longer complete, such as a retried one
+func (c *Completer) Forget(id uuid.UUID) {
+	c.done.Delete(id)
+}
+
+// pruneDone drops expired entries of torrents CompleteTorrent hasn't seen
+// since, such as deleted ones
+func (c *Completer) pruneDone() {
+	c.done.Range(func(id, at any) bool {
+		if time.Since(at.(time.Time)) >= completionDoneTTL {
+			c.done.Delete(id)
+		}
+		return true
+	})
+}
+
+// hookFiles lists t's wanted files with their paths on disk
+func (c *Completer) hookFiles(t *models.Torrent) []hooks.File {
+	dir := torrent.DataDir(c.cfg.DownloadDir, t.InfoHash)
+	wanted := models.WantedFiles(t.Files)
+	files := make([]hooks.File, 0, len(wanted))
+	for _, f := range wanted {
+		files = append(files, hooks.File{Path: filepath.Join(dir, f.Path), Size: f.Size})
+	}
+	return files
+}
+
+// zipSkipStatus applies the zip policy to a completed torrent: the
+// torrent's own override, else its owner's default_zip, and in either case
+// the AUTO_ZIP_MAX_GB ceiling. Torrents created from the owner's own files
+// are never zipped. It returns the zip status recording why the torrent
+// isn't zipped, or "" if it should be.
+func (c *Completer) zipSkipStatus(ctx context.Context, t *models.Torrent) (string, error) {
+	// The owner has the files already
+	if t.Audit.Source == models.SourceCreated {
+		return models.ZipStatusDisabled, nil
+	}
+
+	want := true
+	if t.AutoZip != nil {
+		want = *t.AutoZip
+	} else {
+		dbCtx, cancel := database.WithTimeout(ctx)
+		user, err := c.db.GetUserByID(dbCtx, t.UserID)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		if user != nil {
+			want = user.DefaultZip
+		}
+	}
+	if !want {
+		return models.ZipStatusDisabled, nil
+	}
+
+	if c.cfg.AutoZipMaxGB > 0 && t.WantedSize() > models.GBytes(c.cfg.AutoZipMaxGB) {
+		return models.ZipStatusSkippedSize, nil
+	}
+	return "", nil
+}
+
+// startZip builds the torrent's zip archive in the background. Rows sharing
+// an info hash share its data directory, so they share one archive: a row
+// whose info hash is already being zipped waits for that build, and a zip
+// another row finished is reused as it is.
+func (c *Completer) startZip(ctx context.Context, t *models.Torrent) {
+	c.zipMu.Lock()
+	if ids, busy := c.zipping[t.InfoHash]; busy {
+		if !slices.Contains(ids, t.ID) {
+			c.zipping[t.InfoHash] = append(ids, t.ID)
+		}
+		c.zipMu.Unlock()
+		return
+	}
+	c.zipping[t.InfoHash] = []uuid.UUID{t.ID}
+	c.zipMu.Unlock()
+
+	// Skipped files aren't downloaded, so they have no place in the zip
+	var filePaths []string
+	for _, f := range models.WantedFiles(t.Files) {
+		filePaths = append(filePaths, f.Path)
+	}
+
+	go func(infoHash, name string) {
+		finished := false
+		finish := func() []uuid.UUID {
+			c.zipMu.Lock()
+			defer c.zipMu.Unlock()
+			finished = true
+			ids := c.zipping[infoHash]
+			delete(c.zipping, infoHash)
+			return ids
+		}
+		// Waiting rows start over on their next completion check
+		defer func() {
+			if !finished {
+				finish()
+			}
+		}()
+		defer reporting.Recover(c.reporter, "zip worker", map[string]string{
+			"torrent_id": t.ID.String(),
+			"info_hash":  infoHash,
+		})
+
+		archive, err := c.sharedZip(ctx, t)
+		if err != nil {
+			log.Printf("Failed to look up a shared zip for %s: %v", name, err)
+		}
+		if archive == nil {
+			archive, err = torrent.CreateZipFromFiles(ctx, torrent.DataDir(c.cfg.DownloadDir, infoHash), name, filePaths)
+			if err != nil {
+				log.Printf("Failed to create zip for %s: %v", name, err)
+				return
+			}
+			log.Printf("Created zip archive: %s (%.2f MB)", archive.Name, float64(archive.Size)/1024/1024)
+		}
+
+		for _, id := range finish() {
+			dbCtx, cancel := database.WithTimeout(ctx)
+			err := c.db.UpdateTorrentZip(dbCtx, id, archive.Name, archive.Size, archive.SHA256, archive.Manifest)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to save zip path of %s: %v", id, err)
+			}
+		}
+	}(t.InfoHash, t.Name)
+}
+
+// sharedZip returns the zip another row of t's info hash already has, nil
+// when there is none or its file is gone or changed size
+func (c *Completer) sharedZip(ctx context.Context, t *models.Torrent) (*torrent.ZipArchive, error) {
+	dbCtx, cancel := database.WithTimeout(ctx)
+	rows, err := c.db.GetTorrentsByInfoHash(dbCtx, t.InfoHash)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if r.ID == t.ID || r.ZipStatus != models.ZipStatusReady || r.ZipPath == nil || *r.ZipPath == "" || r.ZipSHA256 == nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(torrent.DataDir(c.cfg.DownloadDir, t.InfoHash), *r.ZipPath))
+		if err != nil || info.Size() != r.ZipSize {
+			continue
+		}
+		dbCtx, cancel := database.WithTimeout(ctx)
+		manifest, err := c.db.GetTorrentZipManifest(dbCtx, r.ID)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		return &torrent.ZipArchive{Name: *r.ZipPath, Size: r.ZipSize, SHA256: *r.ZipSHA256, Manifest: manifest}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,144 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+)
+
+// dedupe looks for a completed torrent of the same user with the same
+// wanted files, usually the same release added from another tracker, and
+// replaces t's files with hard links to that torrent's. Files are only
+// hashed once some candidate has the same file sizes, and the hashes are
+// kept. A failure only costs the saving, so it is logged.
+func (c *Completer) dedupe(ctx context.Context, t *models.Torrent) {
+	wanted := models.WantedFiles(t.Files)
+	if len(wanted) == 0 || t.InfoHash == "" {
+		return
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	candidates, err := c.db.GetDedupCandidates(dbCtx, t.UserID, t.ID, t.TotalSize)
+	cancel()
+	if err != nil {
+		log.Printf("Dedup: failed to find candidates for %s: %v", t.ID, err)
+		return
+	}
+
+	var hashes map[string]string
+	for i := range candidates {
+		cand := &candidates[i]
+		candWanted := models.WantedFiles(cand.Files)
+		if !sameSizes(wanted, candWanted) {
+			continue
+		}
+		if hashes == nil {
+			dbCtx, cancel := database.WithTimeout(ctx)
+			stored, err := c.db.GetTorrentFileHashes(dbCtx, t.ID)
+			cancel()
+			if err != nil {
+				log.Printf("Dedup: failed to load hashes of %s: %v", t.ID, err)
+				return
+			}
+			t.FileHashes = stored
+			if hashes, err = c.fileHashes(ctx, t, wanted); err != nil {
+				log.Printf("Dedup: failed to hash %s: %v", t.ID, err)
+				return
+			}
+		}
+		candHashes, err := c.fileHashes(ctx, cand, candWanted)
+		if err != nil {
+			log.Printf("Dedup: failed to hash %s: %v", cand.ID, err)
+			continue
+		}
+
+		links := matchFiles(wanted, hashes, candWanted, candHashes)
+		if links == nil {
+			continue
+		}
+		if err := torrent.LinkFiles(c.cfg.DownloadDir, cand.InfoHash, t.InfoHash, links); err != nil {
+			log.Printf("Dedup: failed to link %s to %s: %v", t.ID, cand.ID, err)
+			return
+		}
+		dbCtx, cancel := database.WithTimeout(ctx)
+		err = c.db.SetTorrentDeduplicated(dbCtx, t.ID, cand.ID)
+		cancel()
+		if err != nil {
+			log.Printf("Dedup: failed to record %s as a copy of %s: %v", t.ID, cand.ID, err)
+			return
+		}
+		t.DeduplicatedFrom = &cand.ID
+		log.Printf("Dedup: %s has the content of %s, linked %d files", t.ID, cand.ID, len(links))
+		return
+	}
+}
+
+// fileHashes returns the SHA-256s of t's files, recorded ones if they cover
+// them, else hashed from disk and recorded
+func (c *Completer) fileHashes(ctx context.Context, t *models.Torrent, files []models.TorrentFile) (map[string]string, error) {
+	if t.FileHashes != nil && !slices.ContainsFunc(files, func(f models.TorrentFile) bool {
+		_, ok := t.FileHashes[f.Path]
+		return !ok
+	}) {
+		return t.FileHashes, nil
+	}
+
+	hashes, err := torrent.HashFiles(ctx, c.cfg.DownloadDir, t.InfoHash, files)
+	if err != nil {
+		return nil, err
+	}
+	dbCtx, cancel := database.WithTimeout(ctx)
+	err = c.db.SetTorrentFileHashes(dbCtx, t.ID, hashes)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	t.FileHashes = hashes
+	return hashes, nil
+}
+
+// sameSizes reports whether two file lists have the same sizes, in any order
+func sameSizes(a, b []models.TorrentFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sizes := func(files []models.TorrentFile) []int64 {
+		s := make([]int64, len(files))
+		for i, f := range files {
+			s[i] = f.Size
+		}
+		slices.Sort(s)
+		return s
+	}
+	return slices.Equal(sizes(a), sizes(b))
+}
+
+// matchFiles pairs every file of dst with a distinct file of src of the
+// same size and hash, whatever their names, returning dst paths mapped to
+// src paths, or nil unless all of them pair up
+func matchFiles(dst []models.TorrentFile, dstHashes map[string]string, src []models.TorrentFile, srcHashes map[string]string) map[string]string {
+	type content struct {
+		size int64
+		hash string
+	}
+	available := make(map[content][]string, len(src))
+	for _, f := range src {
+		key := content{f.Size, srcHashes[f.Path]}
+		available[key] = append(available[key], f.Path)
+	}
+
+	links := make(map[string]string, len(dst))
+	for _, f := range dst {
+		key := content{f.Size, dstHashes[f.Path]}
+		paths := available[key]
+		if len(paths) == 0 {
+			return nil
+		}
+		links[f.Path], available[key] = paths[0], paths[1:]
+	}
+	return links
+}
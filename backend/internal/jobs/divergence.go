@@ -0,0 +1,216 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/redact"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/google/uuid"
+)
+
+// Divergence compares the engine's torrents against the database's active
+// rows. Adds and deletes in flight can show up for a moment, as the engine
+// and the database change one after the other; RepairDivergence checks
+// again before acting.
+func (c *Completer) Divergence(ctx context.Context) (*models.EngineDivergence, error) {
+	if !c.engine.Available() {
+		return nil, torrent.ErrEngineUnavailable
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	rows, err := c.db.GetActiveInfoHashes(dbCtx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load torrents: %w", err)
+	}
+	running := c.engine.GetActiveTorrents()
+
+	now := time.Now()
+	d := &models.EngineDivergence{
+		MissingFromEngine: []models.MissingTorrent{},
+		Orphans:           []models.OrphanTorrent{},
+		IDMismatches:      []models.TorrentIDMismatch{},
+		CheckedAt:         now,
+	}
+
+	rowIDs := make(map[uuid.UUID]bool, len(rows))
+	byHash := make(map[string][]uuid.UUID)
+	for _, t := range rows {
+		rowIDs[t.ID] = true
+		if t.InfoHash != "" {
+			byHash[t.InfoHash] = append(byHash[t.InfoHash], t.ID)
+		}
+	}
+
+	inEngine := make(map[string]bool, len(running))
+	for _, u := range running {
+		inEngine[u.InfoHash] = true
+		ids, ok := byHash[u.InfoHash]
+		switch {
+		// A fetched .torrent is in the engine just before its row has the
+		// info hash
+		case !ok && !rowIDs[u.ID]:
+			d.Orphans = append(d.Orphans, models.OrphanTorrent{
+				InfoHash:      u.InfoHash,
+				EngineID:      u.ID,
+				Name:          u.Name,
+				Status:        u.Status,
+				Peers:         u.Peers,
+				DownloadSpeed: u.DownloadSpeed,
+				UploadSpeed:   u.UploadSpeed,
+			})
+		case ok && !slices.Contains(ids, u.ID):
+			d.IDMismatches = append(d.IDMismatches, models.TorrentIDMismatch{
+				InfoHash:   u.InfoHash,
+				EngineID:   u.ID,
+				TorrentIDs: ids,
+			})
+		}
+	}
+
+	for _, t := range rows {
+		// Rows still fetching their .torrent file have nothing to run yet
+		if t.InfoHash == "" || t.Status == models.TorrentStatusFetching || inEngine[t.InfoHash] {
+			continue
+		}
+		d.MissingFromEngine = append(d.MissingFromEngine, models.MissingTorrent{
+			TorrentID:  t.ID,
+			UserID:     t.UserID,
+			InfoHash:   t.InfoHash,
+			Name:       t.Name,
+			Status:     t.Status,
+			UpdatedAt:  t.UpdatedAt,
+			AgeSeconds: int64(now.Sub(t.UpdatedAt).Seconds()),
+		})
+	}
+	return d, nil
+}
+
+// RepairDivergence brings the engine in line with the database: missing
+// torrents are reloaded, mismatched engine torrents get their rows attached
+// and their stale ID dropped, and orphans are removed, with their files
+// unless a failed or cancelled row still names them. Each orphan is looked
+// up again first, in case it was only being added.
+func (c *Completer) RepairDivergence(ctx context.Context) (*models.DivergenceRepair, error) {
+	d, err := c.Divergence(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repair := &models.DivergenceRepair{Errors: []string{}}
+	fail := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("Divergence repair: %s", msg)
+		repair.Errors = append(repair.Errors, msg)
+	}
+
+	for _, m := range d.MissingFromEngine {
+		dbCtx, cancel := database.WithTimeout(ctx)
+		t, err := c.db.GetTorrent(dbCtx, m.TorrentID)
+		cancel()
+		if err != nil {
+			fail("failed to load %s: %v", m.TorrentID, err)
+			continue
+		}
+		if t == nil || inactiveStatus(t.Status) {
+			continue
+		}
+		if err := ReloadTorrent(ctx, c.db, c.engine, t); err != nil {
+			fail("failed to reload %s: %v", m.TorrentID, err)
+			continue
+		}
+		repair.Reloaded++
+	}
+
+	for _, m := range d.IDMismatches {
+		dbCtx, cancel := database.WithTimeout(ctx)
+		rows, err := c.db.GetTorrentsByInfoHash(dbCtx, m.InfoHash)
+		cancel()
+		if err != nil {
+			fail("failed to load rows of %s: %v", m.InfoHash, err)
+			continue
+		}
+		attached := 0
+		for i := range rows {
+			if !slices.Contains(m.TorrentIDs, rows[i].ID) {
+				continue
+			}
+			if err := ReloadTorrent(ctx, c.db, c.engine, &rows[i]); err != nil {
+				fail("failed to attach %s: %v", rows[i].ID, err)
+				continue
+			}
+			attached++
+		}
+		// Only with a row attached, or the torrent would go with its ID
+		if attached > 0 {
+			c.engine.RemoveOwner(m.InfoHash, m.EngineID, false)
+			repair.Reattached++
+		}
+	}
+
+	for _, o := range d.Orphans {
+		dbCtx, cancel := database.WithTimeout(ctx)
+		rows, err := c.db.GetTorrentsByInfoHash(dbCtx, o.InfoHash)
+		cancel()
+		if err != nil {
+			fail("failed to check %s: %v", o.InfoHash, err)
+			continue
+		}
+		if slices.ContainsFunc(rows, func(r models.Torrent) bool {
+			return r.ID == o.EngineID || !inactiveStatus(r.Status)
+		}) {
+			continue
+		}
+		if err := c.engine.RemoveTorrent(o.InfoHash, len(rows) == 0); err != nil {
+			fail("failed to remove %s: %v", o.InfoHash, err)
+			continue
+		}
+		repair.OrphansDropped++
+	}
+
+	return repair, nil
+}
+
+// inactiveStatus reports whether a row with this status isn't run by the
+// engine, the statuses GetActiveInfoHashes leaves out
+func inactiveStatus(s models.TorrentStatus) bool {
+	return s == models.TorrentStatusFailed || s == models.TorrentStatusCancelled ||
+		s == models.TorrentStatusNeedsRedownload
+}
+
+// ReloadTorrent adds a torrent row to the engine again, or attaches it as
+// another owner when the engine already has its info hash. Created torrents
+// are seeded from their stored metainfo. A private torrent already in use
+// by someone else fails its row. A bandwidth budget it was resumed on is
+// carried over.
+func ReloadTorrent(ctx context.Context, db *database.Database, engine torrent.Service, t *models.Torrent) error {
+	var err error
+	if t.Audit.Source == models.SourceCreated {
+		// Created torrents have no swarm to fetch metadata from
+		var data []byte
+		dbCtx, cancel := database.WithTimeout(ctx)
+		data, err = db.GetTorrentMetainfo(dbCtx, t.ID)
+		cancel()
+		if err == nil {
+			err = engine.ReloadCreated(t.ID, t.UserID, data)
+		}
+	} else {
+		err = engine.ReloadTorrent(engine.Context(), t.ID, t.UserID, t.MagnetURI, t.InfoHash, t.Status)
+	}
+	if errors.Is(err, torrent.ErrPrivateTorrentInUse) {
+		dbCtx, cancel := database.WithTimeout(ctx)
+		db.SetTorrentError(dbCtx, t.ID, models.ClosedFailedMetadata, redact.Error(err))
+		cancel()
+	}
+	if err == nil && t.PauseAtBytes > 0 {
+		engine.SetPauseAt(t.InfoHash, t.ID, t.PauseAtBytes)
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/notify"
+)
+
+// ExpiryWarningWindow is how long before expiry users are warned
+const ExpiryWarningWindow = 24 * time.Hour
+
+// ExpiryWarner tells users their torrents are about to expire, over SSE, in
+// their notifications and, when mail is configured and they haven't opted
+// out, by email. Each torrent is warned once per expiry; extending it re-arms
+// the warning.
+type ExpiryWarner struct {
+	db       *database.Database
+	events   *events.Broker
+	notifier *notify.Notifier
+}
+
+// NewExpiryWarner creates a new expiry warner
+func NewExpiryWarner(db *database.Database, broker *events.Broker, notifier *notify.Notifier) *ExpiryWarner {
+	return &ExpiryWarner{
+		db:       db,
+		events:   broker,
+		notifier: notifier,
+	}
+}
+
+// WarnExpiring warns the owners of torrents expiring within
+// ExpiryWarningWindow and returns how many were warned
+func (w *ExpiryWarner) WarnExpiring(ctx context.Context) (int, error) {
+	dbCtx, cancel := database.WithTimeout(ctx)
+	expiring, err := w.db.GetTorrentsExpiringWithin(dbCtx, ExpiryWarningWindow)
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expiring torrents: %w", err)
+	}
+
+	for _, t := range expiring {
+		w.events.Publish(events.Event{
+			UserID: t.UserID,
+			Type:   "torrent_expiring",
+			Data: map[string]interface{}{
+				"id":                 t.ID,
+				"name":               t.Name,
+				"expires_at":         t.ExpiresAt,
+				"expires_in_seconds": int64(time.Until(t.ExpiresAt).Seconds()),
+			},
+		})
+
+		email := ""
+		if t.EmailNotifications {
+			email = t.Email
+		}
+		err := w.notifier.Notify(ctx, &models.Notification{
+			UserID: t.UserID,
+			Type:   models.NotificationTorrentExpiring,
+			Title:  fmt.Sprintf("%q expires soon", t.Name),
+			Body: fmt.Sprintf("Your torrent %q will be deleted at %s.\n\n"+
+				"Download what you need before then, or extend its retention from your dashboard if your plan allows.\n",
+				t.Name, models.FormatUserTime(t.ExpiresAt, t.Timezone)),
+			Metadata: map[string]interface{}{
+				"torrent_id": t.ID,
+				"expires_at": t.ExpiresAt,
+			},
+		}, email)
+		if err != nil {
+			log.Printf("Failed to record expiry warning for %s: %v", t.ID, err)
+		}
+
+		dbCtx, cancel := database.WithTimeout(ctx)
+		err = w.db.MarkExpiryWarned(dbCtx, t.ID)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to mark expiry warned for %s: %v", t.ID, err)
+		}
+	}
+	return len(expiring), nil
+}
@@ -0,0 +1,93 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+)
+
+// FailedRetentionDays returns how many days failed and cancelled torrents
+// are kept: the runtime setting when an admin has set one in range,
+// otherwise defaultDays. set reports whether the setting applies.
+func FailedRetentionDays(ctx context.Context, db *database.Database, defaultDays int) (days int, set bool, err error) {
+	dbCtx, cancel := database.WithTimeout(ctx)
+	defer cancel()
+	found, err := db.GetSetting(dbCtx, models.SettingFailedRetentionDays, &days)
+	if err != nil {
+		return 0, false, err
+	}
+	if !found || days < config.MinFailedRetentionDays || days > config.MaxFailedRetentionDays {
+		return defaultDays, false, nil
+	}
+	return days, true, nil
+}
+
+// FailedRetention returns how long failed and cancelled torrents are kept
+func (c *Completer) FailedRetention(ctx context.Context) (models.FailedRetention, error) {
+	days, set, err := FailedRetentionDays(ctx, c.db, c.cfg.FailedRetentionDays)
+	return models.FailedRetention{Days: days, DefaultDays: c.cfg.FailedRetentionDays, Set: set}, err
+}
+
+// PurgeFailed removes failed and cancelled torrents older than their
+// retention from the engine, disk and database, and returns how many went.
+// Each is logged as auto_deleted in its owner's activity; one that can't be
+// deleted is logged and left for the next pass. Without the engine
+// nothing is purged, as it may still hold a torrent's partial files.
+func (c *Completer) PurgeFailed(ctx context.Context) (int, error) {
+	if !c.engine.Available() {
+		return 0, nil
+	}
+	days, _, err := FailedRetentionDays(ctx, c.db, c.cfg.FailedRetentionDays)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the retention: %w", err)
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	failed, err := c.db.GetFailedTorrentsBefore(dbCtx, time.Now().AddDate(0, 0, -days))
+	cancel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list failed torrents: %w", err)
+	}
+
+	purged := 0
+	for _, t := range failed {
+		if t.InfoHash != "" {
+			// Not found unless it's still loaded; its files are removed below
+			c.engine.RemoveOwner(t.InfoHash, t.ID, true)
+		}
+		dbCtx, cancel := database.WithTimeout(ctx)
+		err := c.db.DeleteTorrent(dbCtx, t.ID, models.ClosedAutoDeleted)
+		cancel()
+		if err != nil {
+			// Already gone from the engine; the next pass deletes the row
+			log.Printf("Failed to delete purged torrent %s: %v", t.ID, err)
+			continue
+		}
+		purged++
+		c.hooks.OnTorrentDeleted(&t, hooks.DeleteReasonPurged)
+
+		// Partial files of a torrent the engine had dropped, unless another
+		// torrent shares them
+		if t.InfoHash == "" {
+			continue
+		}
+		dbCtx, cancel = database.WithTimeout(ctx)
+		inUse, err := c.db.InfoHashInUse(dbCtx, t.InfoHash)
+		cancel()
+		if err == nil && !inUse {
+			err = os.RemoveAll(torrent.DataDir(c.cfg.DownloadDir, t.InfoHash))
+		}
+		if err != nil {
+			log.Printf("Failed to remove the data of purged torrent %s: %v", t.ID, err)
+		}
+	}
+	return purged, nil
+}
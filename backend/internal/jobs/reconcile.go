@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+)
+
+// Reconcile compares each torrent's database status against engine and disk
+// state. Torrents whose data is complete but whose status never reached
+// completed (the process died before the side effects ran) are completed now;
+// completed torrents whose files have gone are flagged data_missing.
+func (c *Completer) Reconcile(ctx context.Context) error {
+	c.pruneDone()
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	torrents, err := c.db.GetTorrentsForReconciliation(dbCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to load torrents: %w", err)
+	}
+
+	var completed, missing int
+	for i := range torrents {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		t := &torrents[i]
+
+		if t.Status != models.TorrentStatusCompleted {
+			if !c.dataComplete(t) {
+				continue
+			}
+			if err := c.CompleteTorrent(ctx, t.ID); err != nil {
+				log.Printf("Reconcile: failed to complete torrent %s: %v", t.ID, err)
+				continue
+			}
+			completed++
+			continue
+		}
+
+		// Without a recorded file list there is nothing to check on disk
+		if len(t.Files) == 0 {
+			continue
+		}
+		isMissing := !c.filesOnDisk(t.InfoHash, t.Files)
+		if isMissing != t.DataMissing {
+			dbCtx, cancel := database.WithTimeout(ctx)
+			err := c.db.SetTorrentDataMissing(dbCtx, t.ID, isMissing)
+			cancel()
+			if err != nil {
+				log.Printf("Reconcile: failed to flag torrent %s: %v", t.ID, err)
+				continue
+			}
+		}
+		if isMissing {
+			missing++
+		}
+	}
+
+	if completed > 0 || missing > 0 {
+		log.Printf("Reconcile: completed %d torrents, %d completed torrents missing data", completed, missing)
+	}
+
+	// Only reported: repairing drops torrents, which an admin should decide
+	if d, err := c.Divergence(ctx); err == nil && !d.Empty() {
+		log.Printf("Reconcile: engine and database diverge: %d torrents missing from the engine, %d orphans, %d ID mismatches; see /admin/diagnostics/divergence",
+			len(d.MissingFromEngine), len(d.Orphans), len(d.IDMismatches))
+	} else if err != nil && !errors.Is(err, torrent.ErrEngineUnavailable) {
+		log.Printf("Reconcile: failed to compare engine and database: %v", err)
+	}
+	return nil
+}
+
+// dataComplete reports whether a not-yet-completed torrent has all its data.
+// The engine is authoritative when it has metadata; otherwise the file list
+// recorded by the last update must show every file finished and on disk.
+func (c *Completer) dataComplete(t *models.Torrent) bool {
+	if status, err := c.engine.GetTorrentStatus(t.InfoHash); err == nil && status.TotalSize > 0 {
+		return status.Status.IsComplete() && status.Progress >= 100
+	}
+
+	if len(t.Files) == 0 {
+		return false
+	}
+	for _, f := range t.Files {
+		if f.Progress < 100 {
+			return false
+		}
+	}
+	return c.filesOnDisk(t.InfoHash, t.Files)
+}
+
+// filesOnDisk checks that every file exists at its full size
+func (c *Completer) filesOnDisk(infoHash string, files []models.TorrentFile) bool {
+	return torrent.FilesOnDisk(c.cfg.DownloadDir, infoHash, files)
+}
@@ -0,0 +1,131 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+)
+
+// layoutMarker is written to the download directory once its data is laid
+// out by info hash, so relocation runs only once
+const layoutMarker = ".layout-info-hash"
+
+// relocateProgressEvery is how many torrents are relocated between progress
+// log lines
+const relocateProgressEvery = 100
+
+// RelocateDownloads moves data downloaded before torrents were stored by
+// info hash from downloadDir/<path> to downloadDir/<info_hash>/<path>, zips
+// included. It must run before the engine starts. Files already in place or
+// gone are skipped, so an interrupted run can simply be repeated; torrents
+// not in the database are left where they are.
+func RelocateDownloads(ctx context.Context, db *database.Database, downloadDir string) error {
+	marker := filepath.Join(downloadDir, layoutMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+
+	// A fresh download directory has nothing to move
+	entries, err := os.ReadDir(downloadDir)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(entries) == 0) {
+		return writeLayoutMarker(downloadDir, marker)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read download directory: %w", err)
+	}
+
+	dbCtx, cancel := database.WithTimeout(ctx)
+	torrents, err := db.GetTorrentsForRelocation(dbCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to load torrents: %w", err)
+	}
+
+	log.Printf("Relocating downloads of %d torrents into per-torrent directories", len(torrents))
+	var moved, failed int
+	for i, t := range torrents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		dir := torrent.DataDir(downloadDir, t.InfoHash)
+		paths := make([]string, 0, len(t.Files)+1)
+		for _, f := range t.Files {
+			paths = append(paths, f.Path)
+		}
+		if t.ZipPath != nil && *t.ZipPath != "" {
+			paths = append(paths, *t.ZipPath)
+		}
+
+		for _, p := range paths {
+			ok, err := relocateFile(downloadDir, dir, p)
+			if err != nil {
+				log.Printf("Relocate: torrent %s: %v", t.ID, err)
+				failed++
+				continue
+			}
+			if ok {
+				moved++
+			}
+		}
+
+		if (i+1)%relocateProgressEvery == 0 {
+			log.Printf("Relocating downloads: %d/%d torrents, %d files moved", i+1, len(torrents), moved)
+		}
+	}
+
+	log.Printf("Relocated %d files of %d torrents, %d failed", moved, len(torrents), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be relocated", failed)
+	}
+	return writeLayoutMarker(downloadDir, marker)
+}
+
+// relocateFile moves downloadDir/rel to dir/rel and reports whether it
+// moved anything. Directories left empty behind it are removed.
+func relocateFile(downloadDir, dir, rel string) (bool, error) {
+	src := filepath.Join(downloadDir, rel)
+	dst := filepath.Join(dir, rel)
+	if !strings.HasPrefix(filepath.Clean(src), filepath.Clean(downloadDir)+string(filepath.Separator)) {
+		return false, fmt.Errorf("invalid path %q", rel)
+	}
+
+	if _, err := os.Lstat(src); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", filepath.Dir(dst), err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return false, fmt.Errorf("failed to move %s: %w", rel, err)
+	}
+
+	// Remove now-empty parents up to, not including, the download directory
+	for parent := filepath.Dir(src); parent != filepath.Clean(downloadDir); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+	return true, nil
+}
+
+func writeLayoutMarker(downloadDir, marker string) error {
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		return fmt.Errorf("failed to create download directory: %w", err)
+	}
+	if err := os.WriteFile(marker, []byte("info_hash\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write layout marker: %w", err)
+	}
+	return nil
+}
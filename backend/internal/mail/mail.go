@@ -0,0 +1,85 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email to one recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers user-facing email
+type Sender interface {
+	Send(m Message) error
+	// Enabled reports whether mail actually leaves the server
+	Enabled() bool
+}
+
+// Config is where and as whom mail is sent
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// New returns a sender that delivers through the SMTP server in cfg, or one
+// that only logs messages when no host is configured
+func New(cfg Config) Sender {
+	if cfg.Host == "" {
+		return &logSender{}
+	}
+	return &smtpSender{cfg: cfg}
+}
+
+type logSender struct{}
+
+func (s *logSender) Send(m Message) error {
+	log.Printf("Mail not configured, dropping %q to %s", m.Subject, m.To)
+	return nil
+}
+
+func (s *logSender) Enabled() bool { return false }
+
+type smtpSender struct {
+	cfg Config
+}
+
+func (s *smtpSender) Enabled() bool { return true }
+
+// Send delivers m, upgrading to TLS when the server offers it
+func (s *smtpSender) Send(m Message) error {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&body, "To: %s\r\n", m.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	if err := smtp.SendMail(addr, auth, s.cfg.From, []string{m.To}, []byte(body.String())); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// adminAuditInterval is how often the same refusal of the same user is
+// written to the audit log; repeats in between are only logged
+const adminAuditInterval = time.Minute
+
+// AdminGuard keeps the admin routes to admins, from the allowlisted
+// addresses when there is an allowlist, and optionally the destructive ones
+// to sessions signed in with a two-factor code. Refusals are audited.
+type AdminGuard struct {
+	allowlist        []*net.IPNet
+	requireTwoFactor bool
+	audit            func(ctx context.Context, d models.AdminDenial) error
+
+	mu      sync.Mutex
+	audited map[string]time.Time // user and reason to when last audited
+}
+
+// NewAdminGuard creates a guard admitting clients whose resolved IP is in
+// allowlist (IPs or CIDRs; empty admits any), writing each refusal with
+// audit
+func NewAdminGuard(allowlist []string, requireTwoFactor bool, audit func(ctx context.Context, d models.AdminDenial) error) *AdminGuard {
+	return &AdminGuard{
+		allowlist:        parseNets(allowlist, "admin allowlist entry"),
+		requireTwoFactor: requireTwoFactor,
+		audit:            audit,
+		audited:          make(map[string]time.Time),
+	}
+}
+
+// Handler admits admins from allowed addresses. It goes after AuthMiddleware.
+// Every refusal is the same plain 403, so a stolen token can't be used to
+// learn whether the address or the role was wrong.
+func (g *AdminGuard) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		reason := ""
+		if !g.allowed(ClientIP(c)) {
+			reason = models.AdminDeniedIP
+		} else if c.Locals(string(UserRoleKey)) != "admin" {
+			reason = models.AdminDeniedRole
+		}
+		if reason != "" {
+			g.deny(c, reason)
+			return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+				Error: "forbidden",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// RequireTwoFactor refuses sessions that didn't sign in with a two-factor
+// code when the guard requires it, and passes everything otherwise. It goes
+// after Handler on destructive routes, so only admins learn why.
+func (g *AdminGuard) RequireTwoFactor() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if twoFactor, _ := c.Locals(string(TwoFactorKey)).(bool); twoFactor || !g.requireTwoFactor {
+			return c.Next()
+		}
+		g.deny(c, models.AdminDeniedTwoFactor)
+		return c.Status(fiber.StatusForbidden).JSON(models.ErrorResponse{
+			Error:   "two-factor sign-in required",
+			Code:    "TWO_FACTOR_SESSION_REQUIRED",
+			Details: "sign in again with a two-factor code to do this",
+		})
+	}
+}
+
+// allowed reports whether a canonical client IP may reach the admin routes
+func (g *AdminGuard) allowed(ip string) bool {
+	if len(g.allowlist) == 0 {
+		return true
+	}
+	addr, ok := parseIP(ip)
+	return ok && ipTrusted(addr, g.allowlist)
+}
+
+// deny logs a refusal and audits it, at most once per adminAuditInterval
+// for the same user and reason
+func (g *AdminGuard) deny(c *fiber.Ctx, reason string) {
+	d := models.AdminDenial{
+		Reason: reason,
+		IP:     strings.Clone(ClientIP(c)),
+		Method: strings.Clone(c.Method()),
+		Path:   strings.Clone(c.Path()),
+	}
+	if id, ok := c.Locals(string(UserIDKey)).(string); ok {
+		d.UserID, _ = uuid.Parse(id)
+	}
+	log.Printf("Admin request refused (%s): user %s from %s: %s %s", reason, d.UserID, d.IP, d.Method, d.Path)
+
+	key := d.UserID.String() + " " + reason
+	now := time.Now()
+	g.mu.Lock()
+	// Sweep here rather than from a janitor goroutine; refusals are rare
+	for k, t := range g.audited {
+		if now.Sub(t) >= adminAuditInterval {
+			delete(g.audited, k)
+		}
+	}
+	_, recent := g.audited[key]
+	if !recent {
+		g.audited[key] = now
+	}
+	g.mu.Unlock()
+	if recent {
+		return
+	}
+
+	if err := g.audit(c.UserContext(), d); err != nil {
+		log.Printf("Failed to audit refused admin request of user %s: %v", d.UserID, err)
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestAdminGuard(t *testing.T) {
+	var audited []models.AdminDenial
+	audit := func(ctx context.Context, d models.AdminDenial) error {
+		audited = append(audited, d)
+		return nil
+	}
+	g := NewAdminGuard([]string{"10.0.0.0/8", "2001:db8::1"}, true, audit)
+
+	userID := uuid.New()
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		// What ClientIPMiddleware and AuthMiddleware would set
+		c.Locals(string(ClientIPKey), c.Get("X-Test-IP"))
+		c.Locals(string(UserIDKey), userID.String())
+		c.Locals(string(UserRoleKey), c.Get("X-Test-Role"))
+		c.Locals(string(TwoFactorKey), c.Get("X-Test-2FA") == "true")
+		return c.Next()
+	})
+	app.Get("/admin/users", g.Handler(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	app.Delete("/admin/users/:id", g.Handler(), g.RequireTwoFactor(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	do := func(method, path, ip, role string, twoFactor bool) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-Test-IP", ip)
+		req.Header.Set("X-Test-Role", role)
+		req.Header.Set("X-Test-2FA", strconv.FormatBool(twoFactor))
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := do("GET", "/admin/users", "10.1.2.3", "admin", false); status != http.StatusOK {
+		t.Errorf("allowed admin: status %d", status)
+	}
+	if status, _ := do("GET", "/admin/users", "2001:db8::1", "admin", false); status != http.StatusOK {
+		t.Errorf("allowed admin over IPv6: status %d", status)
+	}
+
+	// The address and the role fail alike
+	_, wrongIP := do("GET", "/admin/users", "192.0.2.1", "admin", false)
+	status, notAdmin := do("GET", "/admin/users", "10.1.2.3", "user", false)
+	if status != http.StatusForbidden || wrongIP != notAdmin {
+		t.Errorf("refusals differ: %q, %d %q", wrongIP, status, notAdmin)
+	}
+
+	if status, _ := do("DELETE", "/admin/users/1", "10.1.2.3", "admin", true); status != http.StatusOK {
+		t.Errorf("two-factor session: status %d", status)
+	}
+	if status, body := do("DELETE", "/admin/users/1", "10.1.2.3", "admin", false); status != http.StatusForbidden || body == notAdmin {
+		t.Errorf("password-only session: %d %q", status, body)
+	}
+
+	// A repeat within the interval is only logged
+	do("GET", "/admin/users", "10.1.2.3", "user", false)
+	want := []models.AdminDenial{
+		{UserID: userID, Reason: models.AdminDeniedIP, IP: "192.0.2.1", Method: "GET", Path: "/admin/users"},
+		{UserID: userID, Reason: models.AdminDeniedRole, IP: "10.1.2.3", Method: "GET", Path: "/admin/users"},
+		{UserID: userID, Reason: models.AdminDeniedTwoFactor, IP: "10.1.2.3", Method: "DELETE", Path: "/admin/users/1"},
+	}
+	if len(audited) != len(want) {
+		t.Fatalf("audited %+v, want %+v", audited, want)
+	}
+	for i := range want {
+		if audited[i] != want[i] {
+			t.Errorf("audit %d: %+v, want %+v", i, audited[i], want[i])
+		}
+	}
+
+	// Without an allowlist any address is let through; without the
+	// requirement, so are password-only sessions
+	open := NewAdminGuard(nil, false, audit)
+	app = fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(string(ClientIPKey), "192.0.2.1")
+		c.Locals(string(UserRoleKey), "admin")
+		return c.Next()
+	})
+	app.Delete("/admin/users/:id", open.Handler(), open.RequireTwoFactor(), func(c *fiber.Ctx) error { return c.SendString("ok") })
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/admin/users/1", nil), -1)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("open guard: %v %v", resp.StatusCode, err)
+	}
+}
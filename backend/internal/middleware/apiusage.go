@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// apiUsageWindow is how many minutes of bytes out the adaptive limit looks at
+const apiUsageWindow = 10
+
+// maxUserClients bounds the clients counted per user between flushes;
+// requests from any more are counted as "other"
+const maxUserClients = 16
+
+// APIUsage accounts each user's API requests in memory: totals since the
+// last Flush, which the caller writes to usage logs, and bytes out per
+// minute over the last apiUsageWindow minutes. A user whose bytes out in
+// that window pass heavyBytes is held to the heavy rate limit until they
+// fall back under it.
+type APIUsage struct {
+	mu    sync.Mutex
+	users map[uuid.UUID]*userAPIUsage
+
+	heavyBytes int64 // 0 = never throttle
+	heavy      *RateLimiter
+}
+
+type userAPIUsage struct {
+	total   models.APIUsage
+	minutes [apiUsageWindow]minuteBytes // ring, by minute number
+}
+
+type minuteBytes struct {
+	minute int64 // Unix minute
+	bytes  int64
+}
+
+// NewAPIUsage creates an API usage tracker throttling users past heavyMB
+// out within apiUsageWindow minutes to heavyRate requests a minute. A
+// heavyMB of 0 only accounts.
+func NewAPIUsage(heavyMB, heavyRate int) *APIUsage {
+	u := &APIUsage{users: make(map[uuid.UUID]*userAPIUsage)}
+	if heavyMB > 0 && heavyRate > 0 {
+		u.heavyBytes = int64(heavyMB) << 20
+		u.heavy = NewRateLimiter(heavyRate, time.Minute)
+	}
+	return u
+}
+
+func (u *APIUsage) record(userID uuid.UUID, client string, in, out int64, elapsed time.Duration) {
+	minute := time.Now().Unix() / 60
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage, ok := u.users[userID]
+	if !ok {
+		usage = &userAPIUsage{}
+		u.users[userID] = usage
+	}
+	usage.total.Requests++
+	usage.total.BytesIn += in
+	usage.total.BytesOut += out
+	usage.total.TimeMs += elapsed.Milliseconds()
+	if usage.total.Clients == nil {
+		usage.total.Clients = make(map[string]int64)
+	}
+	if _, ok := usage.total.Clients[client]; !ok && len(usage.total.Clients) >= maxUserClients {
+		client = "other"
+	}
+	usage.total.Clients[client]++
+
+	slot := &usage.minutes[minute%apiUsageWindow]
+	if slot.minute != minute {
+		*slot = minuteBytes{minute: minute}
+	}
+	slot.bytes += out
+}
+
+// recentBytes returns the user's bytes out within the window. Must be
+// called with u.mu held.
+func (usage *userAPIUsage) recentBytes(now int64) int64 {
+	var total int64
+	for _, m := range usage.minutes {
+		if now-m.minute < apiUsageWindow {
+			total += m.bytes
+		}
+	}
+	return total
+}
+
+// Recent returns the user's usage not yet flushed, their bytes out within
+// the window, and whether they are being throttled
+func (u *APIUsage) Recent(userID uuid.UUID) (models.APIUsage, int64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage, ok := u.users[userID]
+	if !ok {
+		return models.APIUsage{}, 0, false
+	}
+	recent := usage.recentBytes(time.Now().Unix() / 60)
+	total := usage.total
+	total.Clients = maps.Clone(total.Clients)
+	return total, recent, u.heavyBytes > 0 && recent > u.heavyBytes
+}
+
+// Flush returns every user's totals since the last flush and starts them
+// over. Users idle for the whole window are forgotten.
+func (u *APIUsage) Flush() map[uuid.UUID]models.APIUsage {
+	now := time.Now().Unix() / 60
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	totals := make(map[uuid.UUID]models.APIUsage)
+	for userID, usage := range u.users {
+		if usage.total.Requests > 0 {
+			totals[userID] = usage.total
+			usage.total = models.APIUsage{}
+		}
+		if usage.recentBytes(now) == 0 {
+			delete(u.users, userID)
+		}
+	}
+	return totals
+}
+
+// heavyUser reports whether the user is past the heavy threshold
+func (u *APIUsage) heavyUser(userID uuid.UUID) bool {
+	if u.heavyBytes == 0 {
+		return false
+	}
+	_, _, heavy := u.Recent(userID)
+	return heavy
+}
+
+// APIUsageMiddleware accounts the request to the user in u and, once their
+// recent bytes out pass the threshold, holds them to the heavy rate limit
+// with 429 API_THROTTLED. Admins are accounted but never throttled. Must
+// run after AuthMiddleware; SSE streams are left out by not using it.
+func APIUsageMiddleware(u *APIUsage) fiber.Handler {
+	retryAfter := "60"
+
+	return func(c *fiber.Ctx) error {
+		userID, err := GetUserID(c)
+		if err != nil {
+			return c.Next()
+		}
+
+		if GetUserRole(c) != "admin" && u.heavyUser(userID) && !u.heavy.Allow("user:"+userID.String()) {
+			c.Set("Retry-After", retryAfter)
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "API usage is too high; slow down",
+				"code":  "API_THROTTLED",
+			})
+		}
+
+		start := time.Now()
+		err = c.Next()
+
+		var out int64
+		if !c.Response().IsBodyStream() {
+			out = int64(len(c.Response().Body()))
+		}
+		u.record(userID, ClientKey(c), int64(len(c.Body())), out, time.Since(start))
+		return err
+	}
+}
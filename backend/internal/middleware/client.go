@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Headers clients name themselves with, e.g. X-Client: web and
+// X-Client-Version: 1.4.2. Both are optional.
+const (
+	ClientHeader        = "X-Client"
+	ClientVersionHeader = "X-Client-Version"
+)
+
+// maxClientField bounds a client name or version, which are recorded and
+// grouped by
+const maxClientField = 32
+
+// Client returns the client and version the request names, lowercased and
+// stripped to letters, digits and .-_+; "" when not given
+func Client(c *fiber.Ctx) (name, version string) {
+	return cleanClientField(c.Get(ClientHeader)), cleanClientField(c.Get(ClientVersionHeader))
+}
+
+// ClientKey returns the client and version the request names as one key,
+// "web/1.4.2", "web" without a version, or "unknown"
+func ClientKey(c *fiber.Ctx) string {
+	name, version := Client(c)
+	switch {
+	case name == "":
+		return "unknown"
+	case version == "":
+		return name
+	default:
+		return name + "/" + version
+	}
+}
+
+func cleanClientField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '+':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return -1
+	}, s)
+	if len(s) > maxClientField {
+		s = s[:maxClientField]
+	}
+	return s
+}
+
+// MinClientVersionMiddleware refuses requests that change anything from
+// clients older than their minimum in minimums, by client name, with 426
+// CLIENT_UPGRADE_REQUIRED. Reads always pass, so an old client can still
+// show what it has, and so do clients without a minimum and versions that
+// don't parse: unknown clients are never blocked. Minimums that don't
+// parse are dropped with a warning.
+func MinClientVersionMiddleware(minimums map[string]string) fiber.Handler {
+	parsed := make(map[string][]int, len(minimums))
+	shown := make(map[string]string, len(minimums))
+	for name, min := range minimums {
+		v, ok := parseVersion(min)
+		if !ok {
+			log.Printf("Warning: ignoring invalid minimum version %q for client %q", min, name)
+			continue
+		}
+		parsed[cleanClientField(name)] = v
+		shown[cleanClientField(name)] = min
+	}
+
+	return func(c *fiber.Ctx) error {
+		if len(parsed) == 0 || c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead ||
+			c.Method() == fiber.MethodOptions {
+			return c.Next()
+		}
+		name, version := Client(c)
+		min, known := parsed[name]
+		if !known {
+			return c.Next()
+		}
+		v, ok := parseVersion(version)
+		if !ok || compareVersions(v, min) >= 0 {
+			return c.Next()
+		}
+		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{
+			"error":       "this version of " + name + " is no longer supported; please upgrade",
+			"code":        "CLIENT_UPGRADE_REQUIRED",
+			"min_version": shown[name],
+		})
+	}
+}
+
+// parseVersion parses a dotted numeric version such as 1.4.2 or v2.0,
+// ignoring any -prerelease or +build suffix
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	if s == "" {
+		return nil, false
+	}
+	var v []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		v = append(v, n)
+	}
+	return v, true
+}
+
+// compareVersions compares two parsed versions, missing parts counting as
+// 0, and returns -1, 0 or 1
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+// minCompressBytes is the smallest body worth compressing; below it the
+// encoding overhead eats the saving
+const minCompressBytes = 200
+
+// Response encodings, in order of preference when a client accepts
+// several equally
+const (
+	EncodingZstd     = "zstd"
+	EncodingBrotli   = "br"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+var encodingPreference = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// zstdEncoder is shared; EncodeAll is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+
+// Compression compresses response bodies with the best encoding the
+// client's Accept-Encoding allows, honoring q-values, so identity or
+// gzip;q=0 is never answered with gzip. It counts responses and bytes by
+// encoding for the admin stats.
+type Compression struct {
+	skip    func(c *fiber.Ctx) bool
+	metrics map[string]*encodingCounters
+}
+
+type encodingCounters struct {
+	responses atomic.Int64
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+}
+
+// EncodingMetrics are the totals of responses sent with one encoding.
+// BytesIn is the uncompressed size, BytesOut what was sent.
+type EncodingMetrics struct {
+	Responses int64 `json:"responses"`
+	BytesIn   int64 `json:"bytes_in"`
+	BytesOut  int64 `json:"bytes_out"`
+}
+
+// NewCompression creates the compression middleware. Requests skip
+// returns true for, streams such as downloads and SSE, are passed through
+// untouched and uncounted.
+func NewCompression(skip func(c *fiber.Ctx) bool) *Compression {
+	m := &Compression{skip: skip, metrics: make(map[string]*encodingCounters)}
+	for _, enc := range append([]string{EncodingIdentity}, encodingPreference...) {
+		m.metrics[enc] = &encodingCounters{}
+	}
+	return m
+}
+
+// Handler returns the middleware
+func (m *Compression) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if m.skip != nil && m.skip(c) {
+			return c.Next()
+		}
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		resp := c.Response()
+		// Streams, bodies encoded already (precompressed files) and
+		// anything too small or already compressed are left alone
+		if resp.IsBodyStream() || len(resp.Header.ContentEncoding()) > 0 {
+			return nil
+		}
+		body := resp.Body()
+		if len(body) < minCompressBytes || !compressible(string(resp.Header.ContentType())) {
+			m.count(EncodingIdentity, len(body), len(body))
+			return nil
+		}
+
+		c.Vary(fiber.HeaderAcceptEncoding)
+		enc := negotiateEncoding(c.Get(fiber.HeaderAcceptEncoding))
+		var out []byte
+		switch enc {
+		case EncodingZstd:
+			out = zstdEncoder.EncodeAll(body, nil)
+		case EncodingBrotli:
+			out = fasthttp.AppendBrotliBytesLevel(nil, body, fasthttp.CompressBrotliBestSpeed)
+		case EncodingGzip:
+			out = fasthttp.AppendGzipBytesLevel(nil, body, fasthttp.CompressBestSpeed)
+		default:
+			m.count(EncodingIdentity, len(body), len(body))
+			return nil
+		}
+
+		m.count(enc, len(body), len(out))
+		resp.SetBodyRaw(out)
+		resp.Header.Set(fiber.HeaderContentEncoding, enc)
+		return nil
+	}
+}
+
+func (m *Compression) count(enc string, in, out int) {
+	counters := m.metrics[enc]
+	counters.responses.Add(1)
+	counters.bytesIn.Add(int64(in))
+	counters.bytesOut.Add(int64(out))
+}
+
+// Metrics returns the totals by encoding since startup
+func (m *Compression) Metrics() map[string]EncodingMetrics {
+	metrics := make(map[string]EncodingMetrics, len(m.metrics))
+	for enc, counters := range m.metrics {
+		metrics[enc] = EncodingMetrics{
+			Responses: counters.responses.Load(),
+			BytesIn:   counters.bytesIn.Load(),
+			BytesOut:  counters.bytesOut.Load(),
+		}
+	}
+	return metrics
+}
+
+// negotiateEncoding returns the encoding to answer an Accept-Encoding
+// header with: the supported one of highest q-value, by preference on a
+// tie, or identity when none is acceptable. "*" stands for every encoding
+// not named; q=0 refuses one.
+func negotiateEncoding(header string) string {
+	if strings.TrimSpace(header) == "" {
+		return EncodingIdentity
+	}
+
+	named := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else if name != "" {
+			named[name] = q
+		}
+	}
+
+	best, bestQ := EncodingIdentity, 0.0
+	for _, enc := range encodingPreference {
+		q, ok := named[enc]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	// identity is acceptable unless refused, but only preferred when the
+	// client ranks it above every encoding offered
+	if q, ok := named[EncodingIdentity]; ok && q > bestQ {
+		return EncodingIdentity
+	}
+	return best
+}
+
+// compressible reports whether a content type is worth compressing;
+// media and archives are compressed already
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case fiber.MIMEApplicationJSON, fiber.MIMEApplicationJavaScript, fiber.MIMEApplicationXML:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", EncodingIdentity},
+		{"gzip", EncodingGzip},
+		{"GZIP", EncodingGzip},
+		{"gzip, deflate, br", EncodingBrotli},
+		{"gzip, br, zstd", EncodingZstd},
+		{"*", EncodingZstd},
+		{"deflate", EncodingIdentity},
+
+		// q-values
+		{"gzip;q=1.0, br;q=0.5", EncodingGzip},
+		{"br;q=0.5, gzip;q=0.8, zstd;q=0.1", EncodingGzip},
+		{"gzip;q=0", EncodingIdentity},
+		{"gzip; q=0.000", EncodingIdentity},
+		{"*;q=0", EncodingIdentity},
+		{"*;q=0, gzip", EncodingGzip},
+		{"*, zstd;q=0", EncodingBrotli},
+		{"*;q=0.5, gzip", EncodingGzip},
+		{"gzip;Q=0.5, br;q=0.4", EncodingGzip},
+		{"gzip;q=bogus", EncodingGzip},
+
+		// identity
+		{"identity", EncodingIdentity},
+		{"identity, gzip", EncodingGzip},
+		{"identity;q=1, gzip;q=0.5", EncodingIdentity},
+		{"identity;q=0.5, gzip;q=0.5", EncodingGzip},
+		{"identity;q=0, gzip;q=0", EncodingIdentity},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat(`{"name":"compressible"}`, 50)
+	m := NewCompression(func(c *fiber.Ctx) bool { return c.Path() == "/skip" })
+	app := fiber.New()
+	app.Use(m.Handler())
+	handler := func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.SendString(body)
+	}
+	app.Get("/json", handler)
+	app.Get("/skip", handler)
+	app.Get("/small", func(c *fiber.Ctx) error { return c.JSON(fiber.Map{"ok": true}) })
+
+	get := func(path, acceptEncoding string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(fiber.HeaderAcceptEncoding, acceptEncoding)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/json", "gzip;q=0.8, br;q=0.5")
+	if enc := resp.Header.Get(fiber.HeaderContentEncoding); enc != EncodingGzip {
+		t.Fatalf("Content-Encoding %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != body {
+		t.Errorf("gzip body doesn't round trip")
+	}
+
+	for _, tt := range []struct{ path, acceptEncoding string }{
+		{"/json", "gzip;q=0"},
+		{"/skip", "gzip"},
+		{"/small", "gzip"},
+	} {
+		if enc := get(tt.path, tt.acceptEncoding).Header.Get(fiber.HeaderContentEncoding); enc != "" {
+			t.Errorf("%s with Accept-Encoding %q: Content-Encoding %q, want none", tt.path, tt.acceptEncoding, enc)
+		}
+	}
+
+	metrics := m.Metrics()
+	if got := metrics[EncodingGzip].Responses; got != 1 {
+		t.Errorf("gzip responses counted %d, want 1", got)
+	}
+	// The skipped route isn't counted
+	if got := metrics[EncodingIdentity].Responses; got != 2 {
+		t.Errorf("identity responses counted %d, want 2", got)
+	}
+}
@@ -2,12 +2,27 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/reporting"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/google/uuid"
 )
 
@@ -17,66 +32,105 @@ const (
 	UserIDKey    contextKey = "user_id"
 	UserEmailKey contextKey = "user_email"
 	UserRoleKey  contextKey = "user_role"
+	TwoFactorKey contextKey = "two_factor" // the session signed in with a two-factor code
+	ClientIPKey  contextKey = "client_ip"
+	InfoHashKey  contextKey = "info_hash" // set by torrent handlers for error reports
+	TorrentIDKey contextKey = "torrent_id" // set by handlers that create a torrent
+
+	panicReportedKey = "panic_reported"
 )
 
-// AuthMiddleware validates JWT tokens
-// Supports both Authorization header and query parameter (for SSE compatibility)
+// AuthMiddleware validates the JWT in the Authorization header
 func AuthMiddleware(authService *auth.AuthService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		var token string
-
-		// Try Authorization header first
-		authHeader := c.Get("Authorization")
-		if authHeader != "" {
-			parts := strings.Split(authHeader, " ")
-			if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
-				token = parts[1]
+		return authenticate(c, authService, bearerToken(c))
+	}
+}
+
+// SSEAuthMiddleware authenticates EventSource requests, which can't send
+// headers, by a ?ticket= from auth.TicketStore; the Authorization header
+// works too. With allowQueryToken the access token itself is still accepted
+// as ?token=, marked with a Deprecation header.
+func SSEAuthMiddleware(authService *auth.AuthService, tickets *auth.TicketStore, allowQueryToken bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if id := c.Query("ticket"); id != "" {
+			claims, ok := tickets.Redeem(id)
+			if !ok {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "invalid or expired ticket",
+					"code":  "TICKET_INVALID",
+				})
 			}
+			setClaims(c, claims)
+			return c.Next()
 		}
 
-		// Fall back to query parameter (for SSE/EventSource compatibility)
-		if token == "" {
-			token = c.Query("token")
+		token := bearerToken(c)
+		if token == "" && allowQueryToken {
+			if token = c.Query("token"); token != "" {
+				c.Set("Deprecation", "true")
+			}
 		}
+		return authenticate(c, authService, token)
+	}
+}
 
-		if token == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "missing authorization header",
-			})
-		}
+// bearerToken returns the token of a "Bearer" Authorization header
+func bearerToken(c *fiber.Ctx) string {
+	parts := strings.Split(c.Get("Authorization"), " ")
+	if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
+		return parts[1]
+	}
+	return ""
+}
 
-		claims, err := authService.ValidateAccessToken(token)
-		if err != nil {
-			if err == auth.ErrExpiredToken {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"error": "token expired",
-					"code":  "TOKEN_EXPIRED",
-				})
-			}
+// authenticate validates an access token and stores its user in the
+// context before moving on, or responds with 401
+func authenticate(c *fiber.Ctx, authService *auth.AuthService, token string) error {
+	if token == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "missing authorization header",
+		})
+	}
+
+	claims, err := authService.ValidateAccessToken(token)
+	if err != nil {
+		if err == auth.ErrExpiredToken {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "invalid token",
+				"error": "token expired",
+				"code":  "TOKEN_EXPIRED",
 			})
 		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid token",
+		})
+	}
 
-		// Store user info in context
-		c.Locals(string(UserIDKey), claims.UserID)
-		c.Locals(string(UserEmailKey), claims.Email)
-		c.Locals(string(UserRoleKey), claims.Role)
+	setClaims(c, claims)
+	return c.Next()
+}
 
-		return c.Next()
-	}
+// setClaims stores user info in the context
+func setClaims(c *fiber.Ctx, claims *auth.Claims) {
+	c.Locals(string(UserIDKey), claims.UserID)
+	c.Locals(string(UserEmailKey), claims.Email)
+	c.Locals(string(UserRoleKey), claims.Role)
+	c.Locals(string(TwoFactorKey), claims.TwoFactor)
 }
 
-// AdminMiddleware ensures the user has admin role
-func AdminMiddleware() fiber.Handler {
+// EngineMiddleware refuses requests that change torrents with 503 while the
+// torrent engine is down, so they fail plainly instead of halfway. Reads
+// pass: they are served from the database.
+func EngineMiddleware(available func() bool) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		role := c.Locals(string(UserRoleKey))
-		if role != "admin" {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"error": "admin access required",
-			})
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead || available() {
+			return c.Next()
 		}
-		return c.Next()
+		return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+			Error:   "torrent engine unavailable",
+			Code:    "ENGINE_UNAVAILABLE",
+			Details: "adding and changing torrents is paused until the engine recovers; try again shortly",
+		})
 	}
 }
 
@@ -95,15 +149,40 @@ func GetUserRole(c *fiber.Ctx) string {
 	return role.(string)
 }
 
+// GetUserEmail extracts user email from context
+func GetUserEmail(c *fiber.Ctx) string {
+	email := c.Locals(string(UserEmailKey))
+	if email == nil {
+		return ""
+	}
+	return email.(string)
+}
+
 // RateLimiter implements a simple token bucket rate limiter
 type RateLimiter struct {
-	mu       sync.Mutex
-	buckets  map[string]*bucket
-	rate     int           // requests per window
-	window   time.Duration // time window
-	cleanup  time.Duration // cleanup interval
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rate    int           // requests per window
+	window  time.Duration // time window
+	cleanup time.Duration // cleanup interval
+
+	store       LimiterStore // shared counts, or nil to count in memory
+	name        string       // prefix of this limiter's keys in store
+	storeLogged time.Time    // when a store failure was last logged
+}
+
+// LimiterStore keeps rate limit counts shared by every server, so a client
+// can't multiply its budget by spreading requests across them
+type LimiterStore interface {
+	// Incr counts a request for key and returns how many were counted in
+	// the current window, which starts with the first and lasts window
+	Incr(ctx context.Context, key string, window time.Duration) (int64, error)
 }
 
+// limiterStoreTimeout bounds a request's wait on the LimiterStore before it
+// is counted in memory instead
+const limiterStoreTimeout = 200 * time.Millisecond
+
 type bucket struct {
 	tokens    int
 	lastReset time.Time
@@ -123,6 +202,14 @@ func NewRateLimiter(rate int, window time.Duration) *RateLimiter {
 	return rl
 }
 
+// NewSharedRateLimiter creates a rate limiter counting in store, under
+// name, and in memory while store fails. A nil store counts in memory only.
+func NewSharedRateLimiter(store LimiterStore, name string, rate int, window time.Duration) *RateLimiter {
+	rl := NewRateLimiter(rate, window)
+	rl.store, rl.name = store, name
+	return rl
+}
+
 func (rl *RateLimiter) cleanupLoop() {
 	ticker := time.NewTicker(rl.cleanup)
 	for range ticker.C {
@@ -138,77 +225,477 @@ func (rl *RateLimiter) cleanupLoop() {
 }
 
 func (rl *RateLimiter) Allow(key string) bool {
+	allowed, _ := rl.take(key)
+	return allowed
+}
+
+// take counts a request for key and returns whether it is allowed and how
+// many requests are left in the window
+func (rl *RateLimiter) take(key string) (bool, int) {
+	if rl.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), limiterStoreTimeout)
+		n, err := rl.store.Incr(ctx, rl.name+":"+key, rl.window)
+		cancel()
+		if err == nil {
+			return n <= int64(rl.rate), max(rl.rate-int(n), 0)
+		}
+		rl.logStoreError(err)
+	}
+
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
 	now := time.Now()
 	b, exists := rl.buckets[key]
-	
+
 	if !exists || now.Sub(b.lastReset) >= rl.window {
 		rl.buckets[key] = &bucket{
 			tokens:    rl.rate - 1,
 			lastReset: now,
 		}
-		return true
+		return true, rl.rate - 1
 	}
 
 	if b.tokens > 0 {
 		b.tokens--
-		return true
+		return true, b.tokens
 	}
 
-	return false
+	return false, 0
 }
 
-func (rl *RateLimiter) Remaining(key string) int {
+// logStoreError logs a LimiterStore failure, at most once a minute per
+// limiter, as every request meets it until the store recovers
+func (rl *RateLimiter) logStoreError(err error) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-
-	b, exists := rl.buckets[key]
-	if !exists {
-		return rl.rate
+	if time.Since(rl.storeLogged) < time.Minute {
+		return
 	}
+	rl.storeLogged = time.Now()
+	log.Printf("Rate limiter %s counting in memory, shared store failed: %v", rl.name, err)
+}
 
-	if time.Since(b.lastReset) >= rl.window {
-		return rl.rate
-	}
+// RateLimitMiddleware applies rate limiting. Requests are keyed by user ID
+// when it runs after AuthMiddleware, and by client IP otherwise.
+func RateLimitMiddleware(rl *RateLimiter) fiber.Handler {
+	return rateLimit(rl, func(c *fiber.Ctx) string {
+		if userID := c.Locals(string(UserIDKey)); userID != nil {
+			return "user:" + userID.(string)
+		}
+		return "ip:" + ipLimitKey(ClientIP(c))
+	})
+}
 
-	return b.tokens
+// ipLimitKey is the part of a canonical address rate limits count by: an
+// IPv4 address, or an IPv6 address's /64, since a host usually gets a whole
+// /64 and could otherwise take a fresh address for every request
+func ipLimitKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() {
+		return ip
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix.String()
 }
 
-// RateLimitMiddleware applies rate limiting
-func RateLimitMiddleware(rl *RateLimiter) fiber.Handler {
+// MutationRateLimitMiddleware applies rate limiting as RateLimitMiddleware
+// does, to requests that change something; reads pass
+func MutationRateLimitMiddleware(rl *RateLimiter) fiber.Handler {
+	limit := RateLimitMiddleware(rl)
 	return func(c *fiber.Ctx) error {
-		// Use user ID if authenticated, otherwise IP
-		key := c.IP()
-		if userID := c.Locals(string(UserIDKey)); userID != nil {
-			key = userID.(string)
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+			return c.Next()
 		}
+		return limit(c)
+	}
+}
+
+// ParamRateLimitMiddleware applies rate limiting keyed by a route parameter,
+// such as a download token, whichever client sends the request
+func ParamRateLimitMiddleware(rl *RateLimiter, param string) fiber.Handler {
+	return rateLimit(rl, func(c *fiber.Ctx) string {
+		return param + ":" + c.Params(param)
+	})
+}
+
+func rateLimit(rl *RateLimiter, keyFunc func(c *fiber.Ctx) string) fiber.Handler {
+	limit := strconv.Itoa(rl.rate)
+	retryAfter := strconv.Itoa(int(rl.window.Seconds()))
 
-		if !rl.Allow(key) {
-			c.Set("X-RateLimit-Limit", "100")
+	return func(c *fiber.Ctx) error {
+		allowed, remaining := rl.take(keyFunc(c))
+		if !allowed {
+			c.Set("X-RateLimit-Limit", limit)
 			c.Set("X-RateLimit-Remaining", "0")
-			c.Set("Retry-After", "60")
+			c.Set("Retry-After", retryAfter)
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 				"error": "rate limit exceeded",
 				"code":  "RATE_LIMITED",
 			})
 		}
 
-		remaining := rl.Remaining(key)
-		c.Set("X-RateLimit-Limit", "100")
-		c.Set("X-RateLimit-Remaining", string(rune(remaining)))
+		c.Set("X-RateLimit-Limit", limit)
+		c.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		return c.Next()
+	}
+}
+
+// ConcurrencyLimiter caps how many of one class of expensive request, like
+// zip streams, each user has running at once. The cap may differ per user,
+// e.g. by plan. Slots can also be keyed by something other than a user,
+// such as a download token, with AcquireKey.
+type ConcurrencyLimiter struct {
+	limit      func(ctx context.Context, userID uuid.UUID) int
+	retryAfter string
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// NewConcurrencyLimiter creates a limiter that allows limit(user) requests
+// per user at once and tells rejected clients to retry after retryAfter.
+// limit may be nil if only AcquireKey is used.
+func NewConcurrencyLimiter(retryAfter time.Duration, limit func(ctx context.Context, userID uuid.UUID) int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limit:      limit,
+		retryAfter: strconv.Itoa(int(retryAfter.Seconds())),
+		active:     make(map[string]int),
+	}
+}
+
+// Acquire takes one of the user's slots and returns the func that gives it
+// back, which is safe to call more than once. Reports false, taking nothing,
+// when the user is at their cap.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, userID uuid.UUID) (func(), bool) {
+	return l.AcquireKey("user:"+userID.String(), l.limit(ctx, userID))
+}
+
+// AcquireKey is Acquire for any key, with a cap of limit
+func (l *ConcurrencyLimiter) AcquireKey(key string, limit int) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] >= limit {
+		return nil, false
+	}
+	l.active[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.active[key]--; l.active[key] <= 0 {
+				delete(l.active, key)
+			}
+		})
+	}, true
+}
+
+// Reject answers a request over the user's cap with 429 TOO_MANY_CONCURRENT
+func (l *ConcurrencyLimiter) Reject(c *fiber.Ctx) error {
+	c.Set("Retry-After", l.retryAfter)
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error": "too many concurrent requests of this kind",
+		"code":  "TOO_MANY_CONCURRENT",
+	})
+}
+
+// concurrencySlotKey holds the request's slot for HoldConcurrencySlot
+const concurrencySlotKey = "concurrency_slot"
+
+// ConcurrencyMiddleware holds one of the user's slots in l for the request.
+// The slot is freed when the handler returns, unless the handler streams its
+// body and takes the slot over with HoldConcurrencySlot. Must run after
+// AuthMiddleware.
+func ConcurrencyMiddleware(l *ConcurrencyLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, err := GetUserID(c)
+		if err != nil {
+			return c.Next()
+		}
+
+		release, ok := l.Acquire(c.UserContext(), userID)
+		if !ok {
+			return l.Reject(c)
+		}
+		return holdSlot(c, release)
+	}
+}
+
+// ParamConcurrencyMiddleware is ConcurrencyMiddleware keyed by a route
+// parameter, such as a download token, allowing limit requests at once
+func ParamConcurrencyMiddleware(l *ConcurrencyLimiter, param string, limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		release, ok := l.AcquireKey(param+":"+c.Params(param), limit)
+		if !ok {
+			return l.Reject(c)
+		}
+		return holdSlot(c, release)
+	}
+}
+
+// holdSlot runs the rest of the chain holding a slot, freed when it returns
+// unless the handler takes it over with HoldConcurrencySlot
+func holdSlot(c *fiber.Ctx, release func()) error {
+	held := false
+	c.Locals(concurrencySlotKey, func() func() {
+		held = true
+		return release
+	})
+	defer func() {
+		if !held {
+			release()
+		}
+	}()
+	return c.Next()
+}
+
+// HoldConcurrencySlot takes over the request's slot from
+// ConcurrencyMiddleware so it outlives the handler. Call the returned func
+// when the streamed body ends: fasthttp ends a stream writer once it
+// returns, and fails its writes once the client disconnects, so freeing the
+// slot there covers both. Returns a no-op on routes that aren't limited.
+func HoldConcurrencySlot(c *fiber.Ctx) func() {
+	if hold, ok := c.Locals(concurrencySlotKey).(func() func()); ok {
+		return hold()
+	}
+	return func() {}
+}
+
+// TimeoutMiddleware puts a deadline on the handler's context: read for GET
+// and HEAD requests, write for the rest; zero means none. Handlers must pass
+// c.UserContext() to whatever should stop at the deadline. A request that
+// fails once its deadline has passed is answered with 504 TIMEOUT. Streaming
+// routes (SSE, downloads) must not use it: their body is written after the
+// handler returns, and a deadline only bounds the handler.
+func TimeoutMiddleware(read, write time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		d := write
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+			d = read
+		}
+		if d <= 0 {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), d)
+		defer cancel()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+		if err == nil && c.Response().StatusCode() < fiber.StatusInternalServerError {
+			return nil
+		}
+		c.Response().ResetBody()
+		return requestTimedOut(c)
+	}
+}
+
+func requestTimedOut(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+		"error": "request timed out",
+		"code":  "TIMEOUT",
+	})
+}
+
+// SlowRequestMiddleware logs requests that take longer than threshold,
+// with the number of queries they ran and the time spent in them
+func SlowRequestMiddleware(threshold time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		ctx, queries := database.WithQueryStats(c.UserContext())
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		if elapsed := time.Since(start); threshold > 0 && elapsed > threshold {
+			tags := RequestTags(c)
+			log.Printf("Slow request: %s %s took %s, %d queries in %s (status %d, user %s, request %s)",
+				tags["method"], tags["route"], elapsed.Round(time.Millisecond),
+				queries.Count(), queries.Duration().Round(time.Millisecond),
+				c.Response().StatusCode(), tags["user_id"], tags["request_id"])
+		}
+		return err
+	}
+}
 
+// BodyLimitMiddleware rejects request bodies over limit bytes with 413, for
+// routes that only ever take small ones. It can only tighten the server-wide
+// BodyLimit, which applies first.
+func BodyLimitMiddleware(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Request().Header.ContentLength() > limit || len(c.Body()) > limit {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(models.ErrorResponse{
+				Error: fmt.Sprintf("request body is larger than %d bytes", limit),
+				Code:  "BODY_TOO_LARGE",
+			})
+		}
 		return c.Next()
 	}
 }
 
+// IdempotencyKeyHeader lets clients retry a request without repeating it
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength matches the idempotency_keys.key column
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyMiddleware makes a route safe to retry. The first request with a
+// given Idempotency-Key runs normally and its response is stored for the
+// user; repeats within database.IdempotencyKeyTTL get that response back
+// unchanged. Reusing a key for a different request body is rejected with 422,
+// and a repeat that arrives while the first is still running with 409; once
+// the first has held the key for database.IdempotencyClaimLease it is taken
+// to have died with its server, and the repeat runs in its place.
+// Server errors are not stored, so they can be retried. Requests without the
+// header pass through. Must run after AuthMiddleware.
+func IdempotencyMiddleware(db *database.Database) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "idempotency key too long",
+				"code":  "INVALID_IDEMPOTENCY_KEY",
+			})
+		}
+		key = strings.Clone(key)
+
+		userID, err := GetUserID(c)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "unauthorized",
+			})
+		}
+
+		requestHash, err := requestFingerprint(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "failed to read request",
+			})
+		}
+
+		existing, err := db.ClaimIdempotencyKey(c.UserContext(), userID, key, requestHash)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if existing.RequestHash != requestHash {
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+					"error": "idempotency key was already used for a different request",
+					"code":  "IDEMPOTENCY_KEY_REUSED",
+				})
+			}
+			if existing.StatusCode == 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "a request with this idempotency key is still in progress",
+					"code":  "IDEMPOTENCY_KEY_IN_PROGRESS",
+				})
+			}
+			c.Set("Idempotent-Replayed", "true")
+			if existing.ContentType != "" {
+				c.Set(fiber.HeaderContentType, existing.ContentType)
+			}
+			return c.Status(existing.StatusCode).Send(existing.ResponseBody)
+		}
+
+		// Release the key unless a response is stored, including when the
+		// handler panics
+		stored := false
+		defer func() {
+			if !stored {
+				db.ReleaseIdempotencyKey(context.Background(), userID, key)
+			}
+		}()
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status >= fiber.StatusInternalServerError {
+			return nil
+		}
+
+		rec := &models.IdempotencyRecord{
+			Key:          key,
+			RequestHash:  requestHash,
+			StatusCode:   status,
+			ContentType:  string(c.Response().Header.ContentType()),
+			ResponseBody: append([]byte(nil), c.Response().Body()...),
+		}
+		if id, ok := c.Locals(string(TorrentIDKey)).(uuid.UUID); ok {
+			rec.TorrentID = &id
+		}
+		if err := db.CompleteIdempotencyKey(context.Background(), userID, rec); err != nil {
+			log.Printf("Failed to store idempotent response for key %q: %v", key, err)
+			return nil
+		}
+		stored = true
+		return nil
+	}
+}
+
+// requestFingerprint hashes what makes a request the same request: its
+// route and body. Multipart bodies are hashed by their fields and file
+// contents, since a retried upload gets a new boundary.
+func requestFingerprint(c *fiber.Ctx) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, c.Method()+" "+c.Path()+"\n")
+
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		h.Write(c.Body())
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "value %q %q\n", name, form.Value[name])
+	}
+
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, fh := range form.File[name] {
+			fmt.Fprintf(h, "file %q %q %d\n", name, fh.Filename, fh.Size)
+			f, err := fh.Open()
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // CORSMiddleware handles CORS headers
 func CORSMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		c.Set("Access-Control-Allow-Origin", "*")
 		c.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-		c.Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
+		c.Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, Idempotency-Key, X-Confirm-Token, Content-Range, X-Client, X-Client-Version")
+		c.Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Idempotent-Replayed, X-File-Complete, X-Checksum-SHA256")
 		c.Set("Access-Control-Max-Age", "86400")
 
 		if c.Method() == fiber.MethodOptions {
@@ -228,10 +715,201 @@ func RequestIDMiddleware() fiber.Handler {
 		}
 		c.Set("X-Request-ID", requestID)
 		c.Locals("request_id", requestID)
+		c.SetUserContext(database.WithRequestID(c.UserContext(), requestID))
+		return c.Next()
+	}
+}
+
+// ClientIPMiddleware resolves the real client address. Forwarding headers are
+// only believed when the peer is one of trustedProxies (IPs or CIDRs):
+// X-Forwarded-For is walked from the right, skipping our own proxies, so an
+// address the client prepended itself is never used. X-Real-IP is used when
+// the proxy sends no X-Forwarded-For.
+func ClientIPMiddleware(trustedProxies []string) fiber.Handler {
+	trusted := parseTrustedProxies(trustedProxies)
+
+	return func(c *fiber.Ctx) error {
+		c.Locals(string(ClientIPKey), resolveClientIP(c, trusted))
 		return c.Next()
 	}
 }
 
+// ClientIP returns the address resolved by ClientIPMiddleware, falling back
+// to the peer address, in CanonicalIP's form
+func ClientIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals(string(ClientIPKey)).(string); ok && ip != "" {
+		return ip
+	}
+	return CanonicalIP(c.IP())
+}
+
+// CanonicalIP returns the one spelling of an address used for rate limit
+// keys and audit records: IPv4-mapped IPv6 as plain IPv4, IPv6 compressed
+// and lowercase, without a zone. A port, with IPv6 in brackets, is
+// dropped. It returns "" if s isn't an address.
+func CanonicalIP(s string) string {
+	ip, ok := parseIP(s)
+	if !ok {
+		return ""
+	}
+	return ip.String()
+}
+
+// parseIP parses an address as CanonicalIP describes
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(s)
+		if err != nil {
+			// A bracketed IPv6 address without a port
+			if ip, err = netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err != nil {
+				return netip.Addr{}, false
+			}
+		} else {
+			ip = addrPort.Addr()
+		}
+	}
+	return ip.WithZone("").Unmap(), true
+}
+
+func resolveClientIP(c *fiber.Ctx, trusted []*net.IPNet) string {
+	peer, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	if !ok {
+		return ""
+	}
+	peer = peer.Unmap()
+	if !ipTrusted(peer, trusted) {
+		return peer.String()
+	}
+
+	if xff := c.Get(fiber.HeaderXForwardedFor); xff != "" {
+		client := peer
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip, ok := parseIP(hops[i])
+			if !ok {
+				break
+			}
+			client = ip
+			if !ipTrusted(ip, trusted) {
+				break
+			}
+		}
+		return client.String()
+	}
+
+	if ip, ok := parseIP(c.Get("X-Real-IP")); ok {
+		return ip.String()
+	}
+
+	return peer.String()
+}
+
+func ipTrusted(ip netip.Addr, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip.AsSlice()) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	return parseNets(entries, "trusted proxy")
+}
+
+// parseNets parses IPs and CIDRs, a lone IP as a network of its own,
+// logging and skipping entries that are neither
+func parseNets(entries []string, what string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		} else if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		log.Printf("WARNING: ignoring invalid %s %q", what, entry)
+	}
+	return nets
+}
+
+// RecoverMiddleware turns panics into 500 responses and reports them with
+// the stack and request context
+func RecoverMiddleware(reporter reporting.Reporter) fiber.Handler {
+	return recover.New(recover.Config{
+		EnableStackTrace: true,
+		StackTraceHandler: func(c *fiber.Ctx, e interface{}) {
+			c.Locals(panicReportedKey, true)
+			reporter.Report(reporting.Event{
+				Error: fmt.Sprintf("panic: %v", e),
+				Stack: string(debug.Stack()),
+				Tags:  RequestTags(c),
+			})
+		},
+	})
+}
+
+// ErrorHandler is the app's fiber.ErrorHandler. Errors that escape a handler
+// become JSON responses; server errors are reported unless they came from a
+// panic RecoverMiddleware already reported.
+func ErrorHandler(reporter reporting.Reporter) fiber.ErrorHandler {
+	return func(c *fiber.Ctx, err error) error {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return requestTimedOut(c)
+		}
+
+		code := fiber.StatusInternalServerError
+		message := "internal server error"
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			code = fe.Code
+			message = fe.Message
+		}
+
+		if code >= fiber.StatusInternalServerError && c.Locals(panicReportedKey) == nil {
+			reporter.Report(reporting.Event{
+				Error: err.Error(),
+				Tags:  RequestTags(c),
+			})
+		}
+
+		return c.Status(code).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+}
+
+// RequestTags describes the request for an error report
+func RequestTags(c *fiber.Ctx) map[string]string {
+	tags := map[string]string{
+		"method": c.Method(),
+		"route":  c.Route().Path,
+		"path":   c.Path(),
+	}
+	if requestID, ok := c.Locals("request_id").(string); ok {
+		tags["request_id"] = requestID
+	}
+	if userID, ok := c.Locals(string(UserIDKey)).(string); ok {
+		tags["user_id"] = userID
+	}
+	if infoHash, ok := c.Locals(string(InfoHashKey)).(string); ok && infoHash != "" {
+		tags["info_hash"] = infoHash
+	}
+	if torrentID, ok := c.Locals(string(TorrentIDKey)).(uuid.UUID); ok {
+		tags["torrent_id"] = torrentID.String()
+	}
+	return tags
+}
+
 // SecurityHeadersMiddleware adds security headers
 func SecurityHeadersMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/valyala/fasthttp"
+)
+
+// TestIdempotencyMiddleware runs a route behind the middleware against
+// TEST_DATABASE_URL: a key's first request runs and later ones replay it, a
+// repeat while it runs is refused, and a claim past its lease is taken over
+func TestIdempotencyMiddleware(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := database.New(url, false)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	user, err := db.CreateUser(ctx, uuid.NewString()+"@example.com", "x")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(string(UserIDKey), user.ID.String())
+		return c.Next()
+	})
+	app.Post("/things", IdempotencyMiddleware(db), func(c *fiber.Ctx) error {
+		n := calls.Add(1)
+		if c.Query("wait") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"n": n})
+	})
+
+	type result struct {
+		status   int
+		body     string
+		replayed bool
+	}
+	post := func(path, key, body string) result {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(IdempotencyKeyHeader, key)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Errorf("POST %s: %v", path, err)
+			return result{}
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return result{resp.StatusCode, string(data), resp.Header.Get("Idempotent-Replayed") == "true"}
+	}
+
+	// Claim and complete, then replay
+	if got := post("/things", "k1", `{"a":1}`); got != (result{201, `{"n":1}`, false}) {
+		t.Fatalf("first request: %+v", got)
+	}
+	if got := post("/things", "k1", `{"a":1}`); got != (result{201, `{"n":1}`, true}) {
+		t.Fatalf("repeat: %+v", got)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times, want 1", n)
+	}
+	if got := post("/things", "k1", `{"a":2}`); got.status != http.StatusUnprocessableEntity {
+		t.Fatalf("key reused for another body: status %d, want 422", got.status)
+	}
+
+	// A repeat while the first still runs
+	first := make(chan result)
+	go func() { first <- post("/things?wait=1", "k2", `{}`) }()
+	<-started
+	if got := post("/things", "k2", `{}`); got.status != http.StatusConflict {
+		t.Fatalf("repeat in progress: status %d, want 409", got.status)
+	}
+
+	// The first outlives its lease, as if its server had died: a retry
+	// takes the key over, and the late first response doesn't replace it
+	if _, err := pool.Exec(ctx,
+		`UPDATE idempotency_keys SET created_at = $1 WHERE user_id = $2 AND key = 'k2'`,
+		time.Now().Add(-database.IdempotencyClaimLease-time.Minute), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := post("/things", "k2", `{}`); got != (result{201, `{"n":3}`, false}) {
+		t.Fatalf("retry after the lease: %+v", got)
+	}
+	close(release)
+	if got := <-first; got != (result{201, `{"n":2}`, false}) {
+		t.Fatalf("first request: %+v", got)
+	}
+	if got := post("/things", "k2", `{}`); got != (result{201, `{"n":3}`, true}) {
+		t.Fatalf("replay after takeover: %+v", got)
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	tests := []struct {
+		name   string
+		peer   string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"direct", "203.0.113.5", "", "", "203.0.113.5"},
+		{"spoofed from an untrusted peer", "203.0.113.5", "1.2.3.4", "5.6.7.8", "203.0.113.5"},
+		{"one proxy", "10.0.0.1", "1.2.3.4", "", "1.2.3.4"},
+		{"client prepended its own", "10.0.0.1", "6.6.6.6, 1.2.3.4", "", "1.2.3.4"},
+		{"two proxies", "10.0.0.1", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", "1.2.3.4"},
+		{"single trusted address", "192.168.1.1", "1.2.3.4", "", "1.2.3.4"},
+		{"untrusted neighbour", "192.168.1.2", "1.2.3.4", "", "192.168.1.2"},
+		{"only proxies", "10.0.0.1", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"junk before the client", "10.0.0.1", "junk, 1.2.3.4", "", "1.2.3.4"},
+		{"junk from the proxy", "10.0.0.1", "1.2.3.4, junk", "", "10.0.0.1"},
+		{"X-Real-IP without X-Forwarded-For", "10.0.0.1", "", "1.2.3.4", "1.2.3.4"},
+		{"X-Forwarded-For over X-Real-IP", "10.0.0.1", "1.2.3.4", "5.6.7.8", "1.2.3.4"},
+		{"mapped client", "10.0.0.1", "::ffff:1.2.3.4", "", "1.2.3.4"},
+		{"mapped peer", "::ffff:10.0.0.1", "1.2.3.4", "", "1.2.3.4"},
+		{"IPv6 proxy and client", "fd00::1", "2001:DB8::1, fd00::2", "", "2001:db8::1"},
+	}
+	app := fiber.New()
+	for _, tt := range tests {
+		var req fasthttp.Request
+		if tt.xff != "" {
+			req.Header.Set(fiber.HeaderXForwardedFor, tt.xff)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		var fctx fasthttp.RequestCtx
+		fctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 1234}, nil)
+		c := app.AcquireCtx(&fctx)
+		if got := resolveClientIP(c, trusted); got != tt.want {
+			t.Errorf("%s: resolveClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+		app.ReleaseCtx(c)
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{" 1.2.3.4 ", "1.2.3.4"},
+		{"1.2.3.4:8080", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:443", "1.2.3.4"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:443", "fe80::1"},
+		{"", ""},
+		{"example.com", ""},
+		{"1.2.3", ""},
+	}
+	for _, tt := range tests {
+		if got := CanonicalIP(tt.in); got != tt.want {
+			t.Errorf("CanonicalIP(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIPLimitKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:ffff:ffff:ffff:ffff", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		if got := ipLimitKey(tt.in); got != tt.want {
+			t.Errorf("ipLimitKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// countingStore is a LimiterStore in a map, failing while down
+type countingStore struct {
+	counts map[string]int64
+	down   bool
+}
+
+func (s *countingStore) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	if s.down {
+		return 0, errors.New("connection refused")
+	}
+	s.counts[key]++
+	return s.counts[key], nil
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	store := &countingStore{counts: make(map[string]int64)}
+	// Two servers' limiters with the same name share one budget
+	a := NewSharedRateLimiter(store, "user", 3, time.Minute)
+	b := NewSharedRateLimiter(store, "user", 3, time.Minute)
+	for i, rl := range []*RateLimiter{a, b, a} {
+		if !rl.Allow("user:1") {
+			t.Fatalf("request %d refused", i+1)
+		}
+	}
+	if allowed, remaining := b.take("user:1"); allowed || remaining != 0 {
+		t.Errorf("fourth request: allowed %v with %d left, want refused", allowed, remaining)
+	}
+	// Another limiter's keys are its own
+	if !NewSharedRateLimiter(store, "public", 3, time.Minute).Allow("user:1") {
+		t.Error("other limiter refused")
+	}
+
+	// While the store is down each server counts in memory
+	store.down = true
+	for i := 0; i < 3; i++ {
+		if !a.Allow("user:1") {
+			t.Fatalf("request %d while down refused", i+1)
+		}
+	}
+	if a.Allow("user:1") {
+		t.Error("memory fallback allowed more than the rate")
+	}
+}
+
+// TestRedisLimiterStore counts against TEST_REDIS_URL
+func TestRedisLimiterStore(t *testing.T) {
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL not set")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(opts)
+	defer client.Close()
+	store := NewRedisLimiterStore(client)
+
+	ctx := context.Background()
+	key := "test:" + uuid.NewString()
+	for want := int64(1); want <= 3; want++ {
+		if n, err := store.Incr(ctx, key, 200*time.Millisecond); err != nil || n != want {
+			t.Fatalf("Incr = %d, %v; want %d", n, err, want)
+		}
+	}
+	// The window starts over once it has passed
+	time.Sleep(300 * time.Millisecond)
+	if n, err := store.Incr(ctx, key, 200*time.Millisecond); err != nil || n != 1 {
+		t.Errorf("Incr after the window = %d, %v; want 1", n, err)
+	}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DownloadPaths are the prefixes download URLs are served under
+var DownloadPaths = []string{"/api/v1/download/", "/api/v1/dl/"}
+
+// DownloadRedirects answers requests for download URLs that have moved,
+// to a new host or from an old path, with a 308 to where they live now, so
+// links saved in users' scripts keep working. Each redirect counts its hits
+// so it can be removed once nothing uses it.
+type DownloadRedirects struct {
+	rules atomic.Pointer[[]*redirectRule]
+}
+
+type redirectRule struct {
+	models.DownloadRedirect
+	since   time.Time
+	hits    atomic.Int64
+	lastHit atomic.Int64 // unix nanoseconds, 0 for never
+}
+
+// NewDownloadRedirects creates the middleware with no redirects
+func NewDownloadRedirects() *DownloadRedirects {
+	return &DownloadRedirects{}
+}
+
+// Set replaces the redirects. Ones unchanged keep their counts.
+func (r *DownloadRedirects) Set(redirects []models.DownloadRedirect) {
+	old := make(map[models.DownloadRedirect]*redirectRule)
+	if rules := r.rules.Load(); rules != nil {
+		for _, rule := range *rules {
+			old[rule.DownloadRedirect] = rule
+		}
+	}
+
+	rules := make([]*redirectRule, 0, len(redirects))
+	for _, redirect := range redirects {
+		rule, ok := old[redirect]
+		if !ok {
+			rule = &redirectRule{DownloadRedirect: redirect, since: time.Now()}
+		}
+		rules = append(rules, rule)
+	}
+	r.rules.Store(&rules)
+}
+
+// Stats returns each redirect with its hits on this server
+func (r *DownloadRedirects) Stats() []models.DownloadRedirectStats {
+	rules := r.rules.Load()
+	if rules == nil {
+		return []models.DownloadRedirectStats{}
+	}
+	stats := make([]models.DownloadRedirectStats, 0, len(*rules))
+	for _, rule := range *rules {
+		s := models.DownloadRedirectStats{
+			DownloadRedirect: rule.DownloadRedirect,
+			Hits:             rule.hits.Load(),
+			CountingSince:    rule.since,
+		}
+		if last := rule.lastHit.Load(); last != 0 {
+			at := time.Unix(0, last)
+			s.LastHitAt = &at
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Handler returns the middleware. Register it ahead of the routes so a
+// moved path prefix is answered even where nothing else is served.
+func (r *DownloadRedirects) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rules := r.rules.Load()
+		if rules == nil || len(*rules) == 0 {
+			return c.Next()
+		}
+		method := c.Method()
+		if method != fiber.MethodGet && method != fiber.MethodHead {
+			return c.Next()
+		}
+
+		path, host := c.Path(), string(c.Request().Host())
+		for _, rule := range *rules {
+			location, ok := rule.rewrite(host, path)
+			if !ok {
+				continue
+			}
+			if query := c.Request().URI().QueryString(); len(query) > 0 {
+				location += "?" + string(query)
+			}
+			rule.hits.Add(1)
+			rule.lastHit.Store(time.Now().UnixNano())
+			return c.Redirect(location, fiber.StatusPermanentRedirect)
+		}
+		return c.Next()
+	}
+}
+
+// rewrite returns where a request for path on host moved to, if the rule
+// matches it
+func (rule *redirectRule) rewrite(host, path string) (string, bool) {
+	if rule.Host != "" && !sameHost(rule.Host, host) {
+		return "", false
+	}
+	if rule.PathPrefix != "" {
+		if !strings.HasPrefix(path, rule.PathPrefix) {
+			return "", false
+		}
+		return rule.BaseURL + strings.TrimPrefix(path, rule.PathPrefix), true
+	}
+	if !IsDownloadPath(path) {
+		return "", false
+	}
+	return rule.BaseURL + path, true
+}
+
+// sameHost reports whether a Host header is want, with its port or, when
+// want has none, with any
+func sameHost(want, host string) bool {
+	if strings.EqualFold(want, host) {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil && !strings.Contains(want, ":") {
+		return strings.EqualFold(want, h)
+	}
+	return false
+}
+
+// IsDownloadPath reports whether path is under one of DownloadPaths
+func IsDownloadPath(path string) bool {
+	for _, prefix := range DownloadPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
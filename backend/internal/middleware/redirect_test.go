@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDownloadRedirects(t *testing.T) {
+	r := NewDownloadRedirects()
+	app := fiber.New()
+	app.Use(r.Handler())
+	app.Get("/*", func(c *fiber.Ctx) error { return c.SendString("served") })
+
+	get := func(method, host, target string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		req.Host = host
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("%s %s%s: %v", method, host, target, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get(fiber.HeaderLocation)
+	}
+
+	if status, _ := get(http.MethodGet, "old.example.com", "/api/v1/download/tok"); status != http.StatusOK {
+		t.Fatalf("no redirects: status %d", status)
+	}
+
+	r.Set([]models.DownloadRedirect{
+		{Host: "old.example.com:8080", PathPrefix: "/api/v1/dl/", BaseURL: "https://signed.example.com/api/v1/dl/"},
+		{Host: "old.example.com", BaseURL: "https://dl.example.com"},
+		{PathPrefix: "/files/", BaseURL: "https://dl.example.com/api/v1/download/"},
+	})
+	tests := []struct {
+		method, host, target string
+		status               int
+		location             string
+	}{
+		{"GET", "old.example.com", "/api/v1/download/tok", 308, "https://dl.example.com/api/v1/download/tok"},
+		{"GET", "OLD.example.com:443", "/api/v1/dl/signed?x=1", 308, "https://dl.example.com/api/v1/dl/signed?x=1"},
+		{"HEAD", "old.example.com", "/api/v1/download/tok", 308, "https://dl.example.com/api/v1/download/tok"},
+		// The first match applies
+		{"GET", "old.example.com:8080", "/api/v1/dl/signed", 308, "https://signed.example.com/api/v1/dl/signed"},
+		{"GET", "old.example.com:8080", "/api/v1/download/tok", 308, "https://dl.example.com/api/v1/download/tok"},
+		{"GET", "any.example.com", "/files/tok", 308, "https://dl.example.com/api/v1/download/tok"},
+
+		// A host alone only moves downloads
+		{"GET", "old.example.com", "/api/v1/torrents", 200, ""},
+		{"GET", "old.example.com", "/", 200, ""},
+		{"GET", "dl.example.com", "/api/v1/download/tok", 200, ""},
+		{"POST", "old.example.com", "/api/v1/download/tok", 405, ""},
+	}
+	for _, tt := range tests {
+		status, location := get(tt.method, tt.host, tt.target)
+		if status != tt.status || location != tt.location {
+			t.Errorf("%s %s%s: %d %q, want %d %q", tt.method, tt.host, tt.target, status, location, tt.status, tt.location)
+		}
+	}
+
+	stats := r.Stats()
+	if len(stats) != 3 || stats[0].Hits != 1 || stats[1].Hits != 4 || stats[1].LastHitAt == nil || stats[2].Hits != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+
+	// Unchanged redirects keep their counts
+	r.Set([]models.DownloadRedirect{
+		{Host: "old.example.com", BaseURL: "https://dl.example.com"},
+		{Host: "older.example.com", BaseURL: "https://dl.example.com"},
+	})
+	stats = r.Stats()
+	if len(stats) != 2 || stats[0].Hits != 4 || stats[1].Hits != 0 || stats[1].LastHitAt != nil {
+		t.Errorf("stats after replacing: %+v", stats)
+	}
+
+	r.Set(nil)
+	if status, _ := get(http.MethodGet, "old.example.com", "/api/v1/download/tok"); status != http.StatusOK || len(r.Stats()) != 0 {
+		t.Errorf("redirects removed: status %d, stats %+v", status, r.Stats())
+	}
+}
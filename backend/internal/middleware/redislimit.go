@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisIncr counts a request and starts its window on the first, in one
+// step so no key is left without an expiry
+var redisIncr = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// RedisLimiterStore keeps rate limit counts in Redis, shared by every
+// server using it
+type RedisLimiterStore struct {
+	client *redis.Client
+}
+
+// NewRedisLimiterStore creates a LimiterStore on client
+func NewRedisLimiterStore(client *redis.Client) *RedisLimiterStore {
+	return &RedisLimiterStore{client: client}
+}
+
+// Incr implements LimiterStore
+func (s *RedisLimiterStore) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	return redisIncr.Run(ctx, s.client, []string{"ratelimit:" + key}, window.Milliseconds()).Int64()
+}
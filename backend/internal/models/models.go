@@ -1,6 +1,8 @@
 package models
 
 import (
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,10 +15,49 @@ type User struct {
 	PasswordHash     string     `json:"-"`
 	Role             string     `json:"role"` // user, premium, admin
 	StripeCustomerID *string    `json:"stripe_customer_id,omitempty"`
+	DefaultZip       bool       `json:"default_zip"` // zip multi-file torrents on completion
+	EmailNotifications bool     `json:"email_notifications"`
+	Timezone         string     `json:"timezone"` // IANA name messages show times in; the API is always UTC
+	TwoFactorEnabled bool       `json:"two_factor_enabled"` // sign-in asks for a TOTP code
 	CreatedAt        time.Time  `json:"created_at"`
 	UpdatedAt        time.Time  `json:"updated_at"`
 }
 
+// UserSettings is a partial update of a user's settings; nil fields are left
+// unchanged
+type UserSettings struct {
+	DefaultZip         *bool   `json:"default_zip,omitempty"`
+	EmailNotifications *bool   `json:"email_notifications,omitempty"`
+	Timezone           *string `json:"timezone,omitempty"`
+}
+
+// DefaultTimezone is the timezone of users who haven't chosen one
+const DefaultTimezone = "UTC"
+
+// UserLocation returns the location of a user's timezone, UTC for one that
+// doesn't load (any more)
+func UserLocation(timezone string) *time.Location {
+	if timezone == "" || timezone == "Local" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// FormatUserTime renders t in a user's timezone, as notifications and
+// emails show times
+func FormatUserTime(t time.Time, timezone string) string {
+	return t.In(UserLocation(timezone)).Format("2006-01-02 15:04 MST")
+}
+
+// FormatUserDate renders t's date in a user's timezone
+func FormatUserDate(t time.Time, timezone string) string {
+	return t.In(UserLocation(timezone)).Format("2006-01-02")
+}
+
 // Subscription represents a user's subscription plan
 type Subscription struct {
 	ID                   uuid.UUID  `json:"id"`
@@ -24,37 +65,318 @@ type Subscription struct {
 	StripeSubscriptionID *string    `json:"stripe_subscription_id,omitempty"`
 	Plan                 string     `json:"plan"` // free, starter, pro, unlimited
 	Status               string     `json:"status"` // active, past_due, canceled, trialing
+	CurrentPeriodStart   *time.Time `json:"current_period_start,omitempty"` // Stripe billing period
 	CurrentPeriodEnd     *time.Time `json:"current_period_end,omitempty"`
 	DownloadLimitGB      int        `json:"download_limit_gb"`
 	ConcurrentLimit      int        `json:"concurrent_limit"`
 	RetentionDays        int        `json:"retention_days"`
+	StorageLimitGB       int        `json:"storage_limit_gb"`
 	CreatedAt            time.Time  `json:"created_at"`
 }
 
+// ZipManifestEntry is a file in a torrent's zip archive, with its size and
+// CRC-32 (8 hex digits) as stored, to check an archive without unzipping it
+type ZipManifestEntry struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 string `json:"crc32"`
+}
+
+// ZipManifestResponse describes a torrent's zip archive and its entries
+type ZipManifestResponse struct {
+	Name    string             `json:"name"`
+	Size    int64              `json:"size"`
+	SHA256  string             `json:"sha256"`
+	Entries []ZipManifestEntry `json:"entries"`
+}
+
+// Subscription change actor types
+const (
+	SubscriptionActorSystem = "system"
+	SubscriptionActorAdmin  = "admin"
+	SubscriptionActorStripe = "stripe"
+	SubscriptionActorUser   = "user"
+)
+
+// SubscriptionActor is who changed a subscription, and why
+type SubscriptionActor struct {
+	Type   string
+	ID     *uuid.UUID // the admin or user; nil for system and Stripe changes
+	Reason string     // the Stripe event ID for webhook changes
+}
+
+// SubscriptionEvent is a recorded change of a user's plan or status.
+// Users see their own without who or why.
+type SubscriptionEvent struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	ActorType  string     `json:"actor_type"`
+	ActorID    *uuid.UUID `json:"actor_id,omitempty"`
+	ActorEmail string     `json:"actor_email,omitempty"`
+	OldPlan    string     `json:"old_plan"`
+	NewPlan    string     `json:"new_plan"`
+	OldStatus  string     `json:"old_status"`
+	NewStatus  string     `json:"new_status"`
+	Reason     string     `json:"reason,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// SubscriptionHistoryResponse is a page of subscription changes, newest
+// first. NextBefore is the before= value for the next page, absent on the
+// last one.
+type SubscriptionHistoryResponse struct {
+	Events     []SubscriptionEvent `json:"events"`
+	NextBefore *time.Time          `json:"next_before,omitempty"`
+}
+
 // Torrent represents a torrent download
 type Torrent struct {
-	ID             uuid.UUID        `json:"id"`
-	UserID         uuid.UUID        `json:"user_id"`
-	InfoHash       string           `json:"info_hash"`
-	Name           string           `json:"name"`
-	MagnetURI      string           `json:"magnet_uri,omitempty"`
-	Status         string           `json:"status"` // pending, downloading, seeding, completed, failed, paused
-	TotalSize      int64            `json:"total_size"`
-	DownloadedSize int64            `json:"downloaded_size"`
-	UploadedSize   int64            `json:"uploaded_size"`
-	DownloadSpeed  float64          `json:"download_speed"`
-	UploadSpeed    float64          `json:"upload_speed"`
-	Progress       float64          `json:"progress"`
-	Peers          int              `json:"peers"`
-	Seeds          int              `json:"seeds"`
-	Files          []TorrentFile    `json:"files,omitempty"`
-	ZipPath        *string          `json:"zip_path,omitempty"`
-	ZipSize        int64            `json:"zip_size,omitempty"`
-	ErrorMessage   *string          `json:"error_message,omitempty"`
-	StartedAt      *time.Time       `json:"started_at,omitempty"`
-	CompletedAt    *time.Time       `json:"completed_at,omitempty"`
-	ExpiresAt      *time.Time       `json:"expires_at,omitempty"`
-	CreatedAt      time.Time        `json:"created_at"`
+	ID             uuid.UUID          `json:"id"`
+	UserID         uuid.UUID          `json:"user_id"`
+	InfoHash       string             `json:"info_hash"`
+	Name           string             `json:"name"`
+	MagnetURI      string             `json:"magnet_uri,omitempty"`
+	IsPrivate      bool               `json:"is_private"`
+	Status         TorrentStatus      `json:"status"`
+	TotalSize      int64              `json:"total_size"`
+	DownloadedSize int64              `json:"downloaded_size"`
+	UploadedSize   int64              `json:"uploaded_size"`
+	DownloadSpeed  float64            `json:"download_speed"`
+	UploadSpeed    float64            `json:"upload_speed"`
+	Progress       float64            `json:"progress"`
+	Peers          int                `json:"peers"`
+	Seeds          int                `json:"seeds"`
+	Files          []TorrentFile      `json:"files,omitempty"`
+	FilesCompleted int                `json:"files_completed"` // files fully downloaded, as of the last files write
+	FilesTotal     int                `json:"files_total"`
+	ZipPath        *string            `json:"zip_path,omitempty"`
+	ZipSize        int64              `json:"zip_size,omitempty"`
+	ZipSHA256      *string            `json:"zip_sha256,omitempty"` // hex; absent for zips made before it was recorded
+	ZipStatus      string             `json:"zip_status,omitempty"`
+	AutoZip        *bool              `json:"auto_zip,omitempty"` // per-torrent override of the user's default_zip
+	ErrorMessage   *string            `json:"error_message,omitempty"`
+	ClosedReason   ClosedReason       `json:"closed_reason,omitempty"` // why a completed or failed torrent is finished
+	StartedAt      *time.Time         `json:"started_at,omitempty"`
+	CompletedAt    *time.Time         `json:"completed_at,omitempty"`
+	ExpiresAt      *time.Time         `json:"expires_at,omitempty"`
+	ExpiresIn      *int64             `json:"expires_in_seconds,omitempty"` // computed from ExpiresAt when read
+	Extensions     int                `json:"extensions"`                   // times the retention was extended
+	CollectionID   *uuid.UUID         `json:"collection_id,omitempty"`
+	CreatedAt      time.Time          `json:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+	StatusHistory  []StatusTransition `json:"status_history,omitempty"`
+	DataMissing    bool               `json:"data_missing,omitempty"`
+	HealthWarning  string             `json:"health_warning,omitempty"` // e.g. no_seeders: the swarm looks dead; trackers_failing: no tracker answers
+	PauseAtBytes   int64              `json:"pause_at_bytes,omitempty"` // paused again once this much is downloaded, see ResumeTorrent
+	RetryCount     int                `json:"retry_count"`
+	Metadata       *TorrentMetadata   `json:"metadata,omitempty"`
+	Metainfo       []byte             `json:"-"` // original .torrent file, if added from one
+
+	// DeduplicatedFrom is the same user's torrent this one's files are hard
+	// links to, having found the same content; only that one's size counts
+	// toward storage while it exists
+	DeduplicatedFrom *uuid.UUID        `json:"deduplicated_from,omitempty"`
+	FileHashes       map[string]string `json:"-"` // SHA-256 by path, once compared
+
+	// Audit is only shown to admins, see AdminTorrent
+	Audit TorrentAudit `json:"-"`
+
+	// CompletionLogged records that completion usage has been accounted
+	CompletionLogged bool `json:"-"`
+}
+
+// ExpiringTorrent is a torrent about to expire whose owner hasn't been warned
+type ExpiringTorrent struct {
+	ID                 uuid.UUID
+	UserID             uuid.UUID
+	Name               string
+	ExpiresAt          time.Time
+	Email              string
+	EmailNotifications bool
+	Timezone           string
+}
+
+// TorrentStatus is the state of a torrent as stored in the database
+type TorrentStatus string
+
+// Torrent statuses
+const (
+	TorrentStatusFetching        TorrentStatus = "fetching"        // a .torrent URL is being downloaded
+	TorrentStatusMetadataQueued  TorrentStatus = "metadata_queued" // waiting for a metadata fetch slot
+	TorrentStatusPending         TorrentStatus = "pending"         // fetching metadata
+	TorrentStatusChecking        TorrentStatus = "checking"        // a created torrent's data is being hashed
+	TorrentStatusDownloading     TorrentStatus = "downloading"
+	TorrentStatusStalled         TorrentStatus = "stalled" // no peers to download from
+	TorrentStatusPaused          TorrentStatus = "paused"
+	TorrentStatusSeeding         TorrentStatus = "seeding" // complete, a private torrent still below its seed ratio
+	TorrentStatusCompleted       TorrentStatus = "completed"
+	TorrentStatusFailed          TorrentStatus = "failed"
+	TorrentStatusCancelled       TorrentStatus = "cancelled"
+	TorrentStatusNeedsRedownload TorrentStatus = "needs_redownload" // completed, but its data went missing
+)
+
+var torrentStatuses = []TorrentStatus{
+	TorrentStatusFetching, TorrentStatusMetadataQueued, TorrentStatusPending,
+	TorrentStatusChecking, TorrentStatusDownloading, TorrentStatusStalled,
+	TorrentStatusPaused, TorrentStatusSeeding, TorrentStatusCompleted,
+	TorrentStatusFailed, TorrentStatusCancelled, TorrentStatusNeedsRedownload,
+}
+
+// torrentTransitions lists the statuses each status may move to on its own,
+// as the engine reports progress or the user pauses and resumes. Retrying,
+// failing and completing a torrent are explicit and not bound by it.
+var torrentTransitions = map[TorrentStatus][]TorrentStatus{
+	TorrentStatusFetching: {TorrentStatusMetadataQueued, TorrentStatusPending, TorrentStatusDownloading},
+	TorrentStatusMetadataQueued: {TorrentStatusPending, TorrentStatusDownloading, TorrentStatusStalled,
+		TorrentStatusPaused},
+	TorrentStatusPending: {TorrentStatusMetadataQueued, TorrentStatusChecking, TorrentStatusDownloading,
+		TorrentStatusStalled, TorrentStatusPaused},
+	TorrentStatusChecking: {TorrentStatusDownloading, TorrentStatusStalled, TorrentStatusPaused},
+	// Back to fetching metadata when reloaded after a restart
+	TorrentStatusDownloading: {TorrentStatusMetadataQueued, TorrentStatusPending, TorrentStatusChecking,
+		TorrentStatusStalled, TorrentStatusPaused},
+	TorrentStatusStalled: {TorrentStatusMetadataQueued, TorrentStatusPending, TorrentStatusChecking,
+		TorrentStatusDownloading, TorrentStatusPaused},
+	TorrentStatusPaused: {TorrentStatusMetadataQueued, TorrentStatusPending, TorrentStatusChecking,
+		TorrentStatusDownloading, TorrentStatusStalled},
+	TorrentStatusSeeding:   {TorrentStatusCompleted},
+	TorrentStatusCompleted: {TorrentStatusSeeding},
+}
+
+// IsValid reports whether s is a known torrent status
+func (s TorrentStatus) IsValid() bool {
+	return slices.Contains(torrentStatuses, s)
+}
+
+// CanTransitionTo reports whether a torrent in status s may move to next
+// without an explicit retry. Staying in the same status is always allowed.
+// A completed torrent never goes back to downloading this way.
+func (s TorrentStatus) CanTransitionTo(next TorrentStatus) bool {
+	if !next.IsValid() {
+		return false
+	}
+	if s == next {
+		return true
+	}
+	return slices.Contains(torrentTransitions[s], next)
+}
+
+// TransitionsTo returns the statuses a torrent may move to next from
+func TransitionsTo(next TorrentStatus) []TorrentStatus {
+	var from []TorrentStatus
+	for _, s := range torrentStatuses {
+		if s.CanTransitionTo(next) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
+
+// IsComplete reports whether a torrent in status s has all its wanted data
+func (s TorrentStatus) IsComplete() bool {
+	return s == TorrentStatusCompleted || s == TorrentStatusSeeding
+}
+
+// ClosedReason is why a torrent was finished: completed, failed, or deleted.
+// Torrents keep theirs while their row exists; deleted ones are gone, so
+// why is recorded in the owner's activity instead.
+type ClosedReason string
+
+// Closed reasons
+const (
+	ClosedCompleted      ClosedReason = "completed"
+	ClosedExpired        ClosedReason = "expired"
+	ClosedUserDeleted    ClosedReason = "user_deleted"
+	ClosedAdminDeleted   ClosedReason = "admin_deleted"
+	ClosedDMCA           ClosedReason = "dmca"             // taken down after an abuse report
+	ClosedFailedMetadata ClosedReason = "failed_metadata"  // no usable metadata or .torrent file
+	ClosedFailedStalled  ClosedReason = "failed_stalled"   // made no progress, such as a fetch that never finished
+	ClosedFailedDisk     ClosedReason = "failed_disk"      // its data couldn't be written
+	ClosedFailedDup      ClosedReason = "failed_duplicate" // the user already has it
+	ClosedFailedInternal ClosedReason = "failed_internal"  // a database or engine error on our side
+	ClosedAutoDeleted    ClosedReason = "auto_deleted"     // failed or cancelled, and purged after FAILED_RETENTION_DAYS
+)
+
+var closedReasons = []ClosedReason{
+	ClosedCompleted, ClosedExpired, ClosedUserDeleted, ClosedAdminDeleted, ClosedDMCA,
+	ClosedFailedMetadata, ClosedFailedStalled, ClosedFailedDisk, ClosedFailedDup, ClosedFailedInternal,
+	ClosedAutoDeleted,
+}
+
+// IsValid reports whether r is a known closed reason
+func (r ClosedReason) IsValid() bool {
+	return slices.Contains(closedReasons, r)
+}
+
+// IsFailure reports whether r is one a failed torrent closes with
+func (r ClosedReason) IsFailure() bool {
+	switch r {
+	case ClosedFailedMetadata, ClosedFailedStalled, ClosedFailedDisk, ClosedFailedDup, ClosedFailedInternal:
+		return true
+	}
+	return false
+}
+
+// Zip statuses of a completed multi-file torrent. Without a zip, files are
+// downloaded one by one or as a streamed directory zip.
+const (
+	ZipStatusReady       = "ready"
+	ZipStatusSkippedSize = "skipped_size" // larger than AUTO_ZIP_MAX_GB
+	ZipStatusDisabled    = "disabled"     // turned off by the user or for the torrent
+)
+
+// Torrent sources, recorded for abuse investigation
+const (
+	SourceMagnet   = "magnet"
+	SourceFile     = "file"
+	SourceURL      = "url"
+	SourceRSS      = "rss"
+	SourceWatchDir = "watchdir"
+	SourceAPI      = "api"
+	SourceImport   = "import"
+	SourceCreated  = "created" // made from the user's own uploaded files
+)
+
+// TorrentAudit records how a torrent was added and from where. Torrents
+// added before it was recorded have an empty source.
+type TorrentAudit struct {
+	Source         string `json:"source"`
+	AddedIP        string `json:"added_ip,omitempty"`
+	AddedUserAgent string `json:"added_user_agent,omitempty"`
+}
+
+// AdminTorrent is a torrent as admins see it, audit fields included
+type AdminTorrent struct {
+	Torrent
+	TorrentAudit
+}
+
+// NewAdminTorrents wraps torrents for an admin response
+func NewAdminTorrents(torrents []Torrent) []AdminTorrent {
+	out := make([]AdminTorrent, len(torrents))
+	for i, t := range torrents {
+		out[i] = AdminTorrent{Torrent: t, TorrentAudit: t.Audit}
+	}
+	return out
+}
+
+// TorrentMetadata describes a torrent as its metainfo does. Name on Torrent
+// is our display name; InternalName is the name in the info dictionary.
+// Creation fields are only known for torrents added from a .torrent file.
+type TorrentMetadata struct {
+	InternalName string     `json:"internal_name"`
+	PieceLength  int64      `json:"piece_length"`
+	PieceCount   int        `json:"piece_count"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	Version      string     `json:"version"` // v1, v2 or hybrid
+}
+
+// StatusTransition records when a torrent entered a status
+type StatusTransition struct {
+	Status TorrentStatus `json:"status"`
+	At     time.Time     `json:"at"`
 }
 
 // TorrentFile represents a file within a torrent
@@ -65,6 +387,61 @@ type TorrentFile struct {
 	Priority int     `json:"priority"` // 0=skip, 1=low, 2=normal, 3=high
 }
 
+// WantedFiles returns the files that aren't skipped (priority 0)
+func WantedFiles(files []TorrentFile) []TorrentFile {
+	wanted := make([]TorrentFile, 0, len(files))
+	for _, f := range files {
+		if f.Priority != 0 {
+			wanted = append(wanted, f)
+		}
+	}
+	return wanted
+}
+
+// WantedSize is the size of the files that aren't skipped. It is total, the
+// torrent's size, while the files are unknown or none is skipped.
+func WantedSize(files []TorrentFile, total int64) int64 {
+	wanted := WantedFiles(files)
+	if len(files) == 0 || len(wanted) == len(files) {
+		return total
+	}
+	var n int64
+	for _, f := range wanted {
+		n += f.Size
+	}
+	return n
+}
+
+// WantedSize is the size of the torrent's files that aren't skipped, what a
+// completed download costs
+func (t *Torrent) WantedSize() int64 {
+	return WantedSize(t.Files, t.TotalSize)
+}
+
+// CompletedFiles counts the files that are fully downloaded
+func CompletedFiles(files []TorrentFile) int {
+	n := 0
+	for _, f := range files {
+		if f.Progress >= 100 {
+			n++
+		}
+	}
+	return n
+}
+
+// TorrentPreview describes a torrent's contents before it is added.
+// ExceedsLimits and LimitReasons are for the requesting user; LimitReasons
+// holds the error codes an add would fail with.
+type TorrentPreview struct {
+	InfoHash      string        `json:"info_hash"`
+	Name          string        `json:"name"`
+	TotalSize     int64         `json:"total_size"`
+	IsPrivate     bool          `json:"is_private"`
+	Files         []TorrentFile `json:"files"`
+	ExceedsLimits bool          `json:"exceeds_limits"`
+	LimitReasons  []string      `json:"limit_reasons,omitempty"`
+}
+
 // DownloadToken represents a secure download token
 type DownloadToken struct {
 	ID            uuid.UUID  `json:"id"`
@@ -74,7 +451,62 @@ type DownloadToken struct {
 	ExpiresAt     time.Time  `json:"expires_at"`
 	DownloadCount int        `json:"download_count"`
 	MaxDownloads  int        `json:"max_downloads"`
+	IsDirectory   bool       `json:"is_directory"` // FilePath is a directory, served as a zip
 	CreatedAt     time.Time  `json:"created_at"`
+
+	// TorrentExpired is set, and TorrentID zero, once the cleanup job has
+	// deleted the token's expired torrent
+	TorrentExpired bool `json:"torrent_expired,omitempty"`
+}
+
+// Upload is a resumable upload. Received counts the bytes stored so far; the
+// upload is complete once it reaches Size.
+type Upload struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Received  int64     `json:"offset"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Complete reports whether every byte of the upload has arrived
+func (u *Upload) Complete() bool {
+	return u.Received >= u.Size
+}
+
+// FileNode is a file or directory in a torrent's file tree. A directory's
+// size and progress cover everything beneath it.
+type FileNode struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	IsDir    bool        `json:"is_dir"`
+	Size     int64       `json:"size"`
+	Progress float64     `json:"progress"`
+	Children []*FileNode `json:"children,omitempty"`
+}
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key. StatusCode is zero while the first request is in flight.
+type IdempotencyRecord struct {
+	Key          string
+	RequestHash  string
+	StatusCode   int
+	ContentType  string
+	ResponseBody []byte
+	TorrentID    *uuid.UUID
+	CreatedAt    time.Time
+}
+
+// ConfirmationResponse is returned with 202 when a destructive request must be
+// repeated with the X-Confirm-Token header before it takes effect
+type ConfirmationResponse struct {
+	Message      string    `json:"message"`
+	Code         string    `json:"code"` // CONFIRMATION_REQUIRED
+	Reason       string    `json:"reason"`
+	ConfirmToken string    `json:"confirm_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
 }
 
 // UsageLog represents usage tracking
@@ -87,30 +519,414 @@ type UsageLog struct {
 	CreatedAt        time.Time  `json:"created_at"`
 }
 
+// GB is the unit plan limits are set in. It is binary: a "2 GB" plan
+// allows 2×2^30 bytes, as the dashboard's sizes count in 1024s too. Sizes
+// are stored and compared in bytes; convert a limit with GBytes.
+const GB int64 = 1 << 30
+
+// GBytes converts a limit in GB to bytes
+func GBytes(gb int) int64 {
+	return int64(gb) * GB
+}
+
+// BandwidthExhausted reports whether used bytes leave nothing of a monthly
+// download limit in GB. A user at exactly the limit has none left. Limits
+// of 0 or less are unlimited.
+func BandwidthExhausted(used int64, limitGB int) bool {
+	return limitGB > 0 && used >= GBytes(limitGB)
+}
+
+// StorageExceeded reports whether adding addBytes to committed bytes (on
+// disk plus still downloading) doesn't fit a storage limit in GB. At
+// exactly the limit nothing more fits, not even an add of unknown size.
+// Limits of 0 or less are unlimited.
+func StorageExceeded(committed, addBytes int64, limitGB int) bool {
+	if limitGB <= 0 {
+		return false
+	}
+	limit := GBytes(limitGB)
+	return committed >= limit || committed+addBytes > limit
+}
+
+// HumanBytes formats a size for display in the units of GB, with two
+// decimals rounded down so a limit never shows as reached before it is
+func HumanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(1024), 0
+	for m := n / 1024; m >= 1024 && exp < len(units)-1; m /= 1024 {
+		div *= 1024
+		exp++
+	}
+	frac := min(int64(float64(n%div)/float64(div)*100), 99)
+	return fmt.Sprintf("%d.%02d %cB", n/div, frac, units[exp])
+}
+
 // Plan constants
 type PlanLimits struct {
 	DownloadLimitGB int
 	ConcurrentLimit int
 	RetentionDays   int
 	PriceMonthly    int // cents
+
+	// PriceAnnual is the yearly price in cents shown on GET /plans, 0 for
+	// none. Checkout bills the Stripe price, whichever period it is.
+	PriceAnnual int
+
+	// PrivateSeedRatio is the upload ratio private-tracker torrents seed to
+	// once complete; 0 means they never upload
+	PrivateSeedRatio float64
+
+	// Resumable uploads: largest allowed and how many may be in progress
+	MaxUploadMB       int
+	ConcurrentUploads int
+
+	// Torrents that may be added per hour and per day, deleted ones included
+	AddsPerHour int
+	AddsPerDay  int
+
+	// StorageLimitGB caps the data a user keeps on disk at once
+	StorageLimitGB int
+
+	// Expensive requests a user may have running at once: zip streams and
+	// torrent previews
+	ConcurrentZips     int
+	ConcurrentPreviews int
+
+	// ConcurrentSeeds caps the torrents a user may have created from their
+	// own files and be seeding at once; 0 means the plan can't create any
+	ConcurrentSeeds int
 }
 
-var Plans = map[string]PlanLimits{
-	"free":      {DownloadLimitGB: 2, ConcurrentLimit: 1, RetentionDays: 1, PriceMonthly: 0},
-	"starter":   {DownloadLimitGB: 50, ConcurrentLimit: 3, RetentionDays: 7, PriceMonthly: 500},
-	"pro":       {DownloadLimitGB: 500, ConcurrentLimit: 10, RetentionDays: 30, PriceMonthly: 1500},
-	"unlimited": {DownloadLimitGB: -1, ConcurrentLimit: 25, RetentionDays: 90, PriceMonthly: 3000},
+// DefaultPlans are the built-in plans, seeded into the plans table of a new
+// deployment; after that the table is what counts
+var DefaultPlans = map[string]PlanLimits{
+	"free":      {DownloadLimitGB: 2, ConcurrentLimit: 1, RetentionDays: 1, PriceMonthly: 0, MaxUploadMB: 50, ConcurrentUploads: 1, AddsPerHour: 10, AddsPerDay: 30, StorageLimitGB: 5, ConcurrentZips: 1, ConcurrentPreviews: 1},
+	"starter":   {DownloadLimitGB: 50, ConcurrentLimit: 3, RetentionDays: 7, PriceMonthly: 500, PrivateSeedRatio: 1.0, MaxUploadMB: 1024, ConcurrentUploads: 2, AddsPerHour: 30, AddsPerDay: 150, StorageLimitGB: 100, ConcurrentZips: 2, ConcurrentPreviews: 2},
+	"pro":       {DownloadLimitGB: 500, ConcurrentLimit: 10, RetentionDays: 30, PriceMonthly: 1500, PrivateSeedRatio: 1.0, MaxUploadMB: 10240, ConcurrentUploads: 5, AddsPerHour: 100, AddsPerDay: 500, StorageLimitGB: 1000, ConcurrentZips: 3, ConcurrentPreviews: 3, ConcurrentSeeds: 3},
+	"unlimited": {DownloadLimitGB: -1, ConcurrentLimit: 25, RetentionDays: 90, PriceMonthly: 3000, PrivateSeedRatio: 2.0, MaxUploadMB: 51200, ConcurrentUploads: 10, AddsPerHour: 250, AddsPerDay: 1500, StorageLimitGB: 4000, ConcurrentZips: 5, ConcurrentPreviews: 5, ConcurrentSeeds: 10},
+}
+
+// DefaultStripePriceIDs are the Stripe prices the built-in paid plans are
+// seeded with; replace them with real price IDs through the admin API
+var DefaultStripePriceIDs = map[string]string{
+	"starter":   "price_starter_monthly",
+	"pro":       "price_pro_monthly",
+	"unlimited": "price_unlimited_monthly",
+}
+
+// Plan is a subscription plan as stored in the plans table. Checkout for a
+// paid plan needs StripePriceID; webhooks map Stripe prices back to plans
+// by it.
+type Plan struct {
+	Name          string     `json:"name"`
+	Limits        PlanLimits `json:"limits"`
+	StripePriceID *string    `json:"stripe_price_id,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// PublicPlan is a plan as GET /plans shows it to anyone, for pricing pages
+type PublicPlan struct {
+	Name         string             `json:"name"`
+	PriceMonthly int                `json:"price_monthly"`          // cents
+	PriceAnnual  int                `json:"price_annual,omitempty"` // cents
+	Limits       PublicPlanLimits   `json:"limits"`
+	Features     PublicPlanFeatures `json:"features"`
+}
+
+// PublicPlanLimits are the limits of a plan worth advertising
+type PublicPlanLimits struct {
+	DownloadGB       int     `json:"download_gb"` // per month, -1 for unlimited
+	Concurrent       int     `json:"concurrent"`
+	StorageGB        int     `json:"storage_gb"`
+	RetentionDays    int     `json:"retention_days"`
+	MaxUploadMB      int     `json:"max_upload_mb"`
+	AddsPerHour      int     `json:"adds_per_hour"`
+	AddsPerDay       int     `json:"adds_per_day"`
+	ConcurrentZips   int     `json:"concurrent_zips"`
+	PrivateSeedRatio float64 `json:"private_seed_ratio"`
+	ConcurrentSeeds  int     `json:"concurrent_seeds"`
+}
+
+// PublicPlanFeatures are what a plan allows beyond its limits
+type PublicPlanFeatures struct {
+	UnlimitedBandwidth bool `json:"unlimited_bandwidth"`
+	ExtendRetention    bool `json:"extend_retention"`
+	PrivateSeeding     bool `json:"private_seeding"`
+	SeedOwnFiles       bool `json:"seed_own_files"`
+}
+
+// PlanRequest creates or replaces a plan through the admin API
+type PlanRequest struct {
+	Limits        PlanLimits `json:"limits"`
+	StripePriceID *string    `json:"stripe_price_id"`
+}
+
+// AddOffender is a user's torrent add and delete activity over the last day,
+// listed in admin stats for abuse review
+type AddOffender struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Adds      int       `json:"adds"`
+	Deletes   int       `json:"churn_deletes"`
+	Cooldowns int       `json:"cooldowns"`
+}
+
+// Activity types shown in the activity feed
+const (
+	ActivityTorrentAdded     = "torrent_added"
+	ActivityTorrentCompleted = "torrent_completed"
+	ActivityTorrentFailed    = "torrent_failed"
+	ActivityTorrentExpired   = "torrent_expired"
+	ActivityDownloaded       = "downloaded"
+	ActivityPlanChanged      = "plan_changed"
+	ActivityInviteUsed       = "invite_used"
+	ActivityTorrentTakenDown = "torrent_taken_down"
+	ActivityAdminDenied      = "admin_denied"
+	ActivityTorrentDeleted   = "torrent_deleted"
+)
+
+// ActivityActions maps the usage_logs actions shown in the activity feed to
+// their activity type. Other actions, like per-torrent upload accounting,
+// stay out of the feed.
+var ActivityActions = map[string]string{
+	"torrent_added":      ActivityTorrentAdded,
+	"download_completed": ActivityTorrentCompleted,
+	"torrent_failed":     ActivityTorrentFailed,
+	"expired":            ActivityTorrentExpired,
+	"download_started":   ActivityDownloaded,
+	"plan_changed":       ActivityPlanChanged,
+	"invite_used":        ActivityInviteUsed,
+	"taken_down":         ActivityTorrentTakenDown,
+	"admin_denied":       ActivityAdminDenied,
+	"torrent_deleted":    ActivityTorrentDeleted,
+}
+
+// AdminOnlyActions are the ActivityActions only the admin feed shows
+var AdminOnlyActions = map[string]bool{
+	"admin_denied": true,
+}
+
+// Activity is one entry of a user's activity feed, read from usage_logs
+type Activity struct {
+	ID           uuid.UUID    `json:"id"`
+	UserID       *uuid.UUID   `json:"user_id,omitempty"`
+	Email        string       `json:"email,omitempty"` // admin feed only
+	Type         string       `json:"type"`
+	TorrentID    *uuid.UUID   `json:"torrent_id,omitempty"`
+	TorrentName  string       `json:"torrent_name,omitempty"`
+	Bytes        int64        `json:"bytes,omitempty"`
+	Plan         string       `json:"plan,omitempty"`
+	InviteCode   string       `json:"invite_code,omitempty"`
+	Reason       string       `json:"reason,omitempty"`        // admin_denied: which check refused it
+	IP           string       `json:"ip,omitempty"`            // admin_denied
+	Request      string       `json:"request,omitempty"`       // admin_denied: method and path
+	ClosedReason ClosedReason `json:"closed_reason,omitempty"` // torrents finished, failed or removed
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// Reasons an admin request is refused, recorded as admin_denied activity.
+// The client is told none of them apart from AdminDeniedTwoFactor.
+const (
+	AdminDeniedIP        = "ip_not_allowed"
+	AdminDeniedRole      = "not_admin"
+	AdminDeniedTwoFactor = "two_factor_required"
+)
+
+// AdminDenial is a refused admin request, for the audit log
+type AdminDenial struct {
+	UserID uuid.UUID
+	Reason string
+	IP     string
+	Method string
+	Path   string
+}
+
+// ActivityListResponse is a page of activity, newest first. NextBefore is
+// the before= value for the next page, absent on the last one.
+type ActivityListResponse struct {
+	Activities []Activity `json:"activities"`
+	NextBefore *time.Time `json:"next_before,omitempty"`
+}
+
+// Notification types
+const (
+	NotificationTorrentCompleted = "torrent_completed"
+	NotificationTorrentExpiring  = "torrent_expiring"
+	NotificationPaymentFailed    = "payment_failed"
+	NotificationQuotaWarning     = "quota_warning"
+)
+
+// Notification is an entry in a user's in-app inbox
+type Notification struct {
+	ID        uuid.UUID              `json:"id"`
+	UserID    uuid.UUID              `json:"user_id"`
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Body      string                 `json:"body"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	ReadAt    *time.Time             `json:"read_at"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// BandwidthAlert is a bandwidth threshold, in percent of the plan's limit,
+// a user's downloads reached in a usage period
+type BandwidthAlert struct {
+	Threshold  int
+	UsedBytes  int64
+	LimitBytes int64
+	Period     UsagePeriod
+}
+
+// NotificationListResponse is a page of notifications, newest first.
+// NextBefore is the before= value for the next page, absent on the last one.
+type NotificationListResponse struct {
+	Notifications []Notification `json:"notifications"`
+	NextBefore    *time.Time     `json:"next_before,omitempty"`
+	Unread        int            `json:"unread"`
 }
 
 // API Request/Response types
 type RegisterRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	InviteCode string `json:"invite_code,omitempty"` // required in invite mode
+}
+
+// Invite is a code that lets people register while registration is
+// invite-only. Each registration takes one of its uses.
+type Invite struct {
+	ID        uuid.UUID  `json:"id"`
+	Code      string     `json:"code"`
+	CreatedBy *uuid.UUID `json:"created_by,omitempty"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// InviteRequest creates or updates an invite. On update, omitted fields are
+// left unchanged and the code can't be changed.
+type InviteRequest struct {
+	Code      string     `json:"code,omitempty"` // generated when empty
+	MaxUses   *int       `json:"max_uses,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Abuse report statuses
+const (
+	ReportOpen      = "open"
+	ReportTakenDown = "taken_down" // the info hash was blocked and its torrents removed
+	ReportRejected  = "rejected"
+)
+
+// AbuseReport is a complaint about a torrent, usually a rights holder's
+// takedown request. Reports are kept whether or not anyone has the info
+// hash, so repeat submissions show up.
+type AbuseReport struct {
+	ID          uuid.UUID  `json:"id"`
+	InfoHash    string     `json:"info_hash,omitempty"` // from the download URL when not given
+	DownloadURL string     `json:"download_url,omitempty"`
+	Contact     string     `json:"contact"`
+	Reason      string     `json:"reason"`
+	ReporterIP  string     `json:"reporter_ip,omitempty"`
+	Status      string     `json:"status"`
+	Resolution  string     `json:"resolution,omitempty"`
+	ResolvedBy  *uuid.UUID `json:"resolved_by,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// For admins: how many reports name the same info hash, this one
+	// included, and the torrents users have of it
+	HashReports int            `json:"hash_reports"`
+	Torrents    []AdminTorrent `json:"torrents,omitempty"`
+}
+
+// AbuseReportRequest is a report as submitted. It names the torrent by
+// info hash (or magnet URI) or by one of our download URLs.
+type AbuseReportRequest struct {
+	InfoHash     string `json:"info_hash"`
+	DownloadURL  string `json:"download_url"`
+	Contact      string `json:"contact"`
+	Reason       string `json:"reason"`
+	CaptchaToken string `json:"captcha_token"` // required when a CAPTCHA is configured
+}
+
+// AbuseReportListResponse is one page of abuse reports, newest first
+type AbuseReportListResponse struct {
+	Reports    []AbuseReport `json:"reports"`
+	NextBefore *time.Time    `json:"next_before,omitempty"` // pass as before= for the next page
+}
+
+// ReportResolution is an admin's note on resolving a report
+type ReportResolution struct {
+	Note string `json:"note"`
+}
+
+// BlockedHash is an info hash nobody may add, usually after a takedown
+type BlockedHash struct {
+	InfoHash  string     `json:"info_hash"`
+	Reason    string     `json:"reason"`
+	ReportID  *uuid.UUID `json:"report_id,omitempty"`
+	BlockedBy *uuid.UUID `json:"blocked_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// SettingDownloadRedirects is the settings key holding the download
+// redirects, a list of DownloadRedirect
+const SettingDownloadRedirects = "download_redirects"
+
+// SettingFailedRetentionDays is the settings key holding how many days
+// failed and cancelled torrents are kept, overriding FAILED_RETENTION_DAYS
+const SettingFailedRetentionDays = "failed_retention_days"
+
+// FailedRetention is how long failed and cancelled torrents are kept before
+// the cleanup job purges them
+type FailedRetention struct {
+	Days        int  `json:"days"`
+	DefaultDays int  `json:"default_days"` // FAILED_RETENTION_DAYS
+	Set         bool `json:"set"`          // Days is an admin's setting rather than the default
+}
+
+// DownloadRedirect sends requests the downloads have moved away from to
+// BaseURL with a 308. A Host alone matches download requests carrying that
+// Host header and keeps their path; a PathPrefix matches any request under
+// it, on Host if that is set too, and is replaced by BaseURL. The first
+// redirect matching a request applies.
+type DownloadRedirect struct {
+	Host       string `json:"host,omitempty"`        // e.g. dl.old.example.com
+	PathPrefix string `json:"path_prefix,omitempty"` // e.g. /files/
+	BaseURL    string `json:"base_url"`              // e.g. https://dl.example.com
+}
+
+// DownloadRedirectStats are the requests one redirect has answered on this
+// server since it was set or the server started
+type DownloadRedirectStats struct {
+	DownloadRedirect
+	Hits          int64      `json:"hits"`
+	LastHitAt     *time.Time `json:"last_hit_at,omitempty"`
+	CountingSince time.Time  `json:"counting_since"`
 }
 
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	TOTPCode string `json:"totp_code,omitempty"` // required once two-factor sign-in is enabled
+}
+
+// TwoFactorSetup is a new, not yet enabled TOTP secret for an authenticator
+// app, as the secret and an otpauth:// URI to show as a QR code
+type TwoFactorSetup struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+}
+
+// TwoFactorCodeRequest confirms a change to two-factor sign-in with a
+// current code
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
 }
 
 type AuthResponse struct {
@@ -118,11 +934,230 @@ type AuthResponse struct {
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int    `json:"expires_in"`
 	User         *User  `json:"user"`
+
+	// RefreshExpiresAt is when the refresh token stops working unless used
+	// before; each refresh moves it on. SessionExpiresAt is when the
+	// session ends however often it is refreshed, absent when uncapped.
+	RefreshExpiresAt time.Time  `json:"refresh_expires_at"`
+	SessionExpiresAt *time.Time `json:"session_expires_at,omitempty"`
+}
+
+// Session is a signed-in client, as its current refresh token. StartedAt
+// is when it signed in and is carried across refreshes; RefreshedAt is when
+// the current refresh token was issued.
+type Session struct {
+	ID               uuid.UUID  `json:"id"`
+	Client           string     `json:"client,omitempty"`
+	ClientVersion    string     `json:"client_version,omitempty"`
+	StartedAt        time.Time  `json:"started_at"`
+	RefreshedAt      time.Time  `json:"refreshed_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	SessionExpiresAt *time.Time `json:"session_expires_at,omitempty"`
+	TwoFactor        bool       `json:"two_factor"` // signed in with a two-factor code
 }
 
 type AddTorrentRequest struct {
 	MagnetURI  string `json:"magnet_uri,omitempty"`
 	TorrentURL string `json:"torrent_url,omitempty"`
+	Zip          *bool      `json:"zip,omitempty"` // overrides the user's default_zip
+	CollectionID *uuid.UUID `json:"collection_id,omitempty"`
+}
+
+// CreateTorrentRequest makes a torrent of completed resumable uploads and
+// seeds it. One upload makes a single-file torrent; several make a directory
+// named Name holding each under its filename.
+type CreateTorrentRequest struct {
+	UploadIDs    []uuid.UUID `json:"upload_ids"`
+	Name         string      `json:"name,omitempty"`       // defaults to the filename of a single upload
+	PieceSize    int64       `json:"piece_size,omitempty"` // bytes, a power of two; chosen by size if 0
+	Trackers     []string    `json:"trackers,omitempty"`   // defaults to CREATE_TRACKERS
+	Comment      string      `json:"comment,omitempty"`
+	CollectionID *uuid.UUID  `json:"collection_id,omitempty"`
+}
+
+// SearchResult is one torrent found by a search provider. Link, a .torrent
+// URL that may carry the provider's API key, stays on the server; results
+// are added by ID through POST /search/add.
+type SearchResult struct {
+	ID          string     `json:"id"`
+	Provider    string     `json:"provider"`
+	Title       string     `json:"title"`
+	Size        int64      `json:"size"`
+	Seeders     int        `json:"seeders"`
+	Leechers    int        `json:"leechers"`
+	InfoHash    string     `json:"info_hash,omitempty"`
+	MagnetURI   string     `json:"magnet_uri,omitempty"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	Link        string     `json:"-"`
+}
+
+// SearchProviderError is a provider that failed to answer a search
+type SearchProviderError struct {
+	Provider string `json:"provider"`
+	Error    string `json:"error"`
+}
+
+// SearchResponse holds the results of the providers that answered, most
+// seeded first, and what went wrong with the others
+type SearchResponse struct {
+	Query   string                `json:"query"`
+	Results []SearchResult        `json:"results"`
+	Errors  []SearchProviderError `json:"errors"`
+}
+
+// SearchAddRequest adds a search result as a torrent
+type SearchAddRequest struct {
+	ID           string     `json:"id"`
+	Zip          *bool      `json:"zip,omitempty"`
+	CollectionID *uuid.UUID `json:"collection_id,omitempty"`
+}
+
+// Import job statuses. A job is running until none of its items is
+// pending or queued.
+const (
+	ImportRunning = "running"
+	ImportDone    = "done"
+)
+
+// Import item statuses
+const (
+	ImportItemPending = "pending" // not tried yet
+	ImportItemQueued  = "queued"  // waiting for a plan limit to allow it
+	ImportItemAdded   = "added"
+	ImportItemExists  = "exists" // the user already has it
+	ImportItemFailed  = "failed"
+)
+
+// ImportJob is a bulk import of magnets and info hashes, added in the
+// background. Items held up by a plan limit wait as "queued" and are tried
+// again as the limit allows instead of failing.
+type ImportJob struct {
+	ID         uuid.UUID      `json:"id"`
+	UserID     uuid.UUID      `json:"-"`
+	Status     string         `json:"status"`
+	Total      int            `json:"total"`
+	Counts     map[string]int `json:"counts"` // items by status
+	Items      []ImportItem   `json:"items,omitempty"`
+	Audit      TorrentAudit   `json:"-"` // applied to the torrents it adds
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// ImportItem is one line of an import and what became of it
+type ImportItem struct {
+	JobID        uuid.UUID    `json:"-"`
+	UserID       uuid.UUID    `json:"-"`
+	Audit        TorrentAudit `json:"-"`
+	Position     int          `json:"position"`
+	Source       string       `json:"source"` // magnet URI or info hash, as given
+	Label        string       `json:"label,omitempty"`
+	CollectionID *uuid.UUID   `json:"collection_id,omitempty"`
+	Status       string       `json:"status"`
+	TorrentID    *uuid.UUID   `json:"torrent_id,omitempty"`
+	Error        string       `json:"error,omitempty"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// ImportRequestItem is one entry of a JSON import: a magnet URI or info
+// hash with an optional label, matched to a collection of the same name
+type ImportRequestItem struct {
+	Magnet string `json:"magnet"`
+	Label  string `json:"label,omitempty"`
+}
+
+// Consistency problems found in torrent rows
+const (
+	ProblemProgressOutOfRange  = "progress_out_of_range"
+	ProblemDownloadedExceeds   = "downloaded_exceeds_total" // or negative
+	ProblemUploadedImplausible = "uploaded_implausible"
+	ProblemCompleteWithoutData = "complete_without_data"
+	ProblemCompletedBelow100   = "completed_below_100"
+)
+
+// TorrentInconsistency is a torrent whose sizes or progress contradict
+// each other or its data, as last found by the consistency check
+type TorrentInconsistency struct {
+	TorrentID      uuid.UUID     `json:"torrent_id"`
+	UserID         uuid.UUID     `json:"user_id"`
+	InfoHash       string        `json:"info_hash"`
+	Name           string        `json:"name"`
+	Status         TorrentStatus `json:"status"`
+	TotalSize      int64         `json:"total_size"`
+	DownloadedSize int64         `json:"downloaded_size"`
+	UploadedSize   int64         `json:"uploaded_size"`
+	Progress       float64       `json:"progress"`
+	DataMissing    bool          `json:"data_missing"`
+	Files          []TorrentFile `json:"-"`
+	Problems       []string      `json:"problems"`
+	FoundAt        time.Time     `json:"found_at"`
+	CheckedAt      time.Time     `json:"checked_at"`
+}
+
+// EngineDivergence is where the torrent engine and the database disagree
+// about which torrents should be running, as after a failed reload or a row
+// deleted while the engine kept its torrent
+type EngineDivergence struct {
+	// Torrents the database expects to run that the engine doesn't have
+	MissingFromEngine []MissingTorrent `json:"missing_from_engine"`
+	// Engine torrents no active row has, using resources for nobody
+	Orphans []OrphanTorrent `json:"orphans"`
+	// Engine torrents whose ID is no active row of their info hash
+	IDMismatches []TorrentIDMismatch `json:"id_mismatches"`
+	CheckedAt    time.Time           `json:"checked_at"`
+}
+
+// Empty reports whether the engine and database agree
+func (d *EngineDivergence) Empty() bool {
+	return len(d.MissingFromEngine) == 0 && len(d.Orphans) == 0 && len(d.IDMismatches) == 0
+}
+
+// DivergenceRepair is what a divergence repair did; Errors lists what it
+// couldn't fix
+type DivergenceRepair struct {
+	Reloaded       int      `json:"reloaded"`
+	Reattached     int      `json:"reattached"`
+	OrphansDropped int      `json:"orphans_dropped"`
+	Errors         []string `json:"errors"`
+}
+
+// MissingTorrent is an active row whose torrent the engine doesn't have
+type MissingTorrent struct {
+	TorrentID  uuid.UUID     `json:"torrent_id"`
+	UserID     uuid.UUID     `json:"user_id"`
+	InfoHash   string        `json:"info_hash"`
+	Name       string        `json:"name"`
+	Status     TorrentStatus `json:"status"` // the last status recorded
+	UpdatedAt  time.Time     `json:"updated_at"`
+	AgeSeconds int64         `json:"age_seconds"` // since the row last changed
+}
+
+// OrphanTorrent is an engine torrent without an active row
+type OrphanTorrent struct {
+	InfoHash      string        `json:"info_hash"`
+	EngineID      uuid.UUID     `json:"engine_id"`
+	Name          string        `json:"name"`
+	Status        TorrentStatus `json:"status"`
+	Peers         int           `json:"peers"`
+	DownloadSpeed float64       `json:"download_speed"`
+	UploadSpeed   float64       `json:"upload_speed"`
+}
+
+// TorrentIDMismatch is an engine torrent held under an ID that isn't one of
+// the active rows of its info hash, so status updates go nowhere
+type TorrentIDMismatch struct {
+	InfoHash   string      `json:"info_hash"`
+	EngineID   uuid.UUID   `json:"engine_id"`
+	TorrentIDs []uuid.UUID `json:"torrent_ids"`
+}
+
+// Collection groups a user's torrents, e.g. a season or a project
+type Collection struct {
+	ID           uuid.UUID `json:"id"`
+	UserID       uuid.UUID `json:"user_id"`
+	Name         string    `json:"name"`
+	TorrentCount int       `json:"torrent_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type TorrentListResponse struct {
@@ -132,6 +1167,24 @@ type TorrentListResponse struct {
 	PageSize   int       `json:"page_size"`
 }
 
+// CompactTorrent is a torrent as the compact list view has it: what an
+// overview shows, read straight from the database without live stats
+type CompactTorrent struct {
+	ID        uuid.UUID     `json:"id"`
+	Name      string        `json:"name"`
+	Status    TorrentStatus `json:"status"`
+	Progress  float64       `json:"progress"`
+	TotalSize int64         `json:"total_size"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+}
+
+type CompactTorrentListResponse struct {
+	Torrents   []CompactTorrent `json:"torrents"`
+	TotalCount int              `json:"total_count"`
+	Page       int              `json:"page"`
+	PageSize   int              `json:"page_size"`
+}
+
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Code    string `json:"code,omitempty"`
@@ -143,10 +1196,128 @@ type SuccessResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// UsageStats is a user's usage against their plan. Sizes are in bytes;
+// the _human strings format them for display (see HumanBytes) and the
+// _gb fields are kept for older clients, in the binary GB of plan limits.
 type UsageStats struct {
+	UsedBytes         int64 `json:"used_bytes"`
+	UploadedBytes     int64 `json:"uploaded_bytes"`      // this month; not counted against LimitBytes
+	ServedBytes       int64 `json:"served_bytes"`        // sent over HTTP this month; not counted against LimitBytes
+	LimitBytes        int64 `json:"limit_bytes"`         // -1 for unlimited
+	StorageUsedBytes  int64 `json:"storage_used_bytes"`  // completed torrents and zips on disk
+	StorageLimitBytes int64 `json:"storage_limit_bytes"` // -1 for unlimited
+
+	// Whether adding a torrent is refused for bandwidth or storage, decided
+	// as the add itself decides it
+	LimitReached        bool `json:"limit_reached"`
+	StorageLimitReached bool `json:"storage_limit_reached"`
+
+	UsedHuman         string `json:"used_human"`
+	LimitHuman        string `json:"limit_human"` // "unlimited" for -1
+	StorageUsedHuman  string `json:"storage_used_human"`
+	StorageLimitHuman string `json:"storage_limit_human"`
+
 	UsedGB          float64 `json:"used_gb"`
+	UploadedGB      float64 `json:"uploaded_gb"`
+	ServedGB        float64 `json:"served_gb"`
 	LimitGB         int     `json:"limit_gb"`
 	ActiveTorrents  int     `json:"active_torrents"`
 	ConcurrentLimit int     `json:"concurrent_limit"`
 	Plan            string  `json:"plan"`
+	StorageUsedGB   float64 `json:"storage_used_gb"`
+	StorageLimitGB  int     `json:"storage_limit_gb"`
+	UsagePeriod             // what UsedBytes, UploadedBytes and ServedBytes cover
+}
+
+// NewUsageStats fills in usage from byte totals and the plan's limits in
+// GB, with the same limit checks adding a torrent makes. The caller sets
+// the torrent counts, plan and period.
+func NewUsageStats(used, uploaded, served int64, limitGB int, storage StorageUsage, storageLimitGB int) UsageStats {
+	u := UsageStats{
+		UsedBytes:           used,
+		UploadedBytes:       uploaded,
+		ServedBytes:         served,
+		LimitBytes:          -1,
+		StorageUsedBytes:    storage.Used,
+		StorageLimitBytes:   -1,
+		LimitReached:        BandwidthExhausted(used, limitGB),
+		StorageLimitReached: StorageExceeded(storage.Used+storage.Pending, 0, storageLimitGB),
+		UsedHuman:           HumanBytes(used),
+		LimitHuman:          "unlimited",
+		StorageUsedHuman:    HumanBytes(storage.Used),
+		StorageLimitHuman:   "unlimited",
+		UsedGB:              float64(used) / float64(GB),
+		UploadedGB:          float64(uploaded) / float64(GB),
+		ServedGB:            float64(served) / float64(GB),
+		LimitGB:             limitGB,
+		StorageUsedGB:       float64(storage.Used) / float64(GB),
+		StorageLimitGB:      storageLimitGB,
+	}
+	if limitGB > 0 {
+		u.LimitBytes = GBytes(limitGB)
+		u.LimitHuman = HumanBytes(u.LimitBytes)
+	}
+	if storageLimitGB > 0 {
+		u.StorageLimitBytes = GBytes(storageLimitGB)
+		u.StorageLimitHuman = HumanBytes(u.StorageLimitBytes)
+	}
+	return u
+}
+
+// maxStalePeriods is how many billing periods past the stored one usage
+// periods are projected before falling back to calendar months
+const maxStalePeriods = 3
+
+// APIUsage totals a user's API requests. Streamed responses, such as zip
+// downloads, count as requests but not bytes; downloads are logged apart.
+type APIUsage struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	TimeMs   int64 `json:"time_ms"` // spent in handlers
+	// Requests by client, as middleware.ClientKey names it
+	Clients map[string]int64 `json:"clients,omitempty"`
+}
+
+// ClientUsage is one client version's share of the API: requests and the
+// users making them over a period, and sessions signed in with it now
+type ClientUsage struct {
+	Client   string `json:"client"` // "web/1.4.2", "web" or "unknown"
+	Requests int64  `json:"requests"`
+	Users    int64  `json:"users"`
+	Sessions int64  `json:"sessions"`
+}
+
+// UsagePeriod is the window usage is metered over, [Start, End)
+type UsagePeriod struct {
+	Start time.Time `json:"period_start"`
+	End   time.Time `json:"period_end"`
+}
+
+// CurrentUsagePeriod returns the usage period containing now. Paying users
+// are metered over their Stripe billing period, so quotas reset when they
+// are invoiced; everyone else, including paying users with no period on
+// record, over the calendar month in UTC. sub may be nil.
+func CurrentUsagePeriod(sub *Subscription, now time.Time) UsagePeriod {
+	now = now.UTC()
+	if sub != nil && sub.Plan != "free" && sub.CurrentPeriodStart != nil && sub.CurrentPeriodEnd != nil {
+		p := UsagePeriod{Start: sub.CurrentPeriodStart.UTC(), End: sub.CurrentPeriodEnd.UTC()}
+		// The renewal webhook may not have arrived yet: assume monthly renewal
+		for i := 0; i < maxStalePeriods && !now.Before(p.End); i++ {
+			p = UsagePeriod{Start: p.End, End: p.End.AddDate(0, 1, 0)}
+		}
+		if p.Start.Before(p.End) && !now.Before(p.Start) && now.Before(p.End) {
+			return p
+		}
+	}
+
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return UsagePeriod{Start: start, End: start.AddDate(0, 1, 0)}
+}
+
+// StorageUsage is a user's data on disk: Used is completed torrents and
+// their zips, Pending what torrents still downloading will add
+type StorageUsage struct {
+	Used    int64 `json:"used_bytes"`
+	Pending int64 `json:"pending_bytes"`
 }
@@ -0,0 +1,271 @@
+package models
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // the zones tested, whatever the machine has
+)
+
+func TestTorrentStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to TorrentStatus
+		want     bool
+	}{
+		{TorrentStatusPending, TorrentStatusDownloading, true},
+		{TorrentStatusDownloading, TorrentStatusPaused, true},
+		{TorrentStatusPaused, TorrentStatusDownloading, true},
+		{TorrentStatusSeeding, TorrentStatusCompleted, true},
+		{TorrentStatusCompleted, TorrentStatusCompleted, true},
+		// Late engine ticks arriving after a terminal status
+		{TorrentStatusCompleted, TorrentStatusDownloading, false},
+		{TorrentStatusCompleted, TorrentStatusStalled, false},
+		{TorrentStatusFailed, TorrentStatusDownloading, false},
+		{TorrentStatusFailed, TorrentStatusPending, false},
+		{TorrentStatusCancelled, TorrentStatusDownloading, false},
+		{TorrentStatusDownloading, "removed_dmca", false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// Updates for one torrent can be applied out of order, say downloading
+// ticks queued behind completion, which is written explicitly; replaying
+// them must leave the torrent completed
+func TestTorrentStatusOutOfOrderUpdates(t *testing.T) {
+	seq := []TorrentStatus{
+		TorrentStatusDownloading, TorrentStatusStalled, TorrentStatusPaused,
+		TorrentStatusDownloading, TorrentStatusSeeding, TorrentStatusCompleted,
+	}
+	current := TorrentStatusCompleted
+	for _, next := range seq {
+		if current.CanTransitionTo(next) {
+			current = next
+		}
+	}
+	if current != TorrentStatusCompleted {
+		t.Fatalf("status after out-of-order updates = %s, want %s", current, TorrentStatusCompleted)
+	}
+}
+
+func TestTransitionsToExcludesTerminal(t *testing.T) {
+	for _, s := range TransitionsTo(TorrentStatusDownloading) {
+		switch s {
+		case TorrentStatusCompleted, TorrentStatusFailed, TorrentStatusCancelled:
+			t.Errorf("TransitionsTo(downloading) includes %s", s)
+		}
+	}
+}
+
+func TestClosedReason(t *testing.T) {
+	tests := []struct {
+		reason         ClosedReason
+		valid, failure bool
+	}{
+		{ClosedCompleted, true, false},
+		{ClosedUserDeleted, true, false},
+		{ClosedDMCA, true, false},
+		{ClosedFailedMetadata, true, true},
+		{ClosedFailedStalled, true, true},
+		{ClosedFailedDisk, true, true},
+		{ClosedFailedDup, true, true},
+		{ClosedFailedInternal, true, true},
+		{ClosedAutoDeleted, true, false},
+		{"", false, false},
+		{"failed", false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.reason.IsValid(); got != tt.valid {
+			t.Errorf("%q.IsValid() = %v, want %v", tt.reason, got, tt.valid)
+		}
+		if got := tt.reason.IsFailure(); got != tt.failure {
+			t.Errorf("%q.IsFailure() = %v, want %v", tt.reason, got, tt.failure)
+		}
+	}
+}
+
+func TestBandwidthExhausted(t *testing.T) {
+	tests := []struct {
+		used    int64
+		limitGB int
+		want    bool
+	}{
+		{0, 2, false},
+		{GBytes(2) - 1, 2, false},
+		{GBytes(2), 2, true},
+		{GBytes(2) + 1, 2, true},
+		{GBytes(100), 0, false},
+		{GBytes(100), -1, false},
+	}
+	for _, tt := range tests {
+		if got := BandwidthExhausted(tt.used, tt.limitGB); got != tt.want {
+			t.Errorf("BandwidthExhausted(%d, %d) = %v, want %v", tt.used, tt.limitGB, got, tt.want)
+		}
+	}
+}
+
+func TestStorageExceeded(t *testing.T) {
+	tests := []struct {
+		committed, add int64
+		limitGB        int
+		want           bool
+	}{
+		{0, GBytes(5), 5, false},
+		{GBytes(5) - 10, 10, 5, false},
+		{GBytes(5) - 10, 11, 5, true},
+		// At exactly the limit even an add of unknown size doesn't fit
+		{GBytes(5), 0, 5, true},
+		{GBytes(5) - 1, 0, 5, false},
+		{GBytes(50), GBytes(50), 0, false},
+	}
+	for _, tt := range tests {
+		if got := StorageExceeded(tt.committed, tt.add, tt.limitGB); got != tt.want {
+			t.Errorf("StorageExceeded(%d, %d, %d) = %v, want %v", tt.committed, tt.add, tt.limitGB, got, tt.want)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.00 KB"},
+		{1536, "1.50 KB"},
+		{GB, "1.00 GB"},
+		// One byte short of the limit never rounds up to it
+		{GBytes(2) - 1, "1.99 GB"},
+		{GBytes(2), "2.00 GB"},
+		{1 << 40, "1.00 TB"},
+	}
+	for _, tt := range tests {
+		if got := HumanBytes(tt.n); got != tt.want {
+			t.Errorf("HumanBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNewUsageStatsAtLimit(t *testing.T) {
+	u := NewUsageStats(GBytes(2), 0, 0, 2, StorageUsage{Used: GBytes(4), Pending: GBytes(1)}, 5)
+	if !u.LimitReached || u.LimitBytes != GBytes(2) || u.LimitHuman != "2.00 GB" {
+		t.Errorf("bandwidth at the limit: reached %v, limit %d %q", u.LimitReached, u.LimitBytes, u.LimitHuman)
+	}
+	// Pending downloads count toward storage, so 4 GB on disk and 1 GB on
+	// its way fills a 5 GB plan
+	if !u.StorageLimitReached || u.StorageLimitBytes != GBytes(5) {
+		t.Errorf("storage at the limit: reached %v, limit %d", u.StorageLimitReached, u.StorageLimitBytes)
+	}
+
+	u = NewUsageStats(GBytes(2)-1, 0, 0, 2, StorageUsage{Used: GBytes(4)}, 5)
+	if u.LimitReached || u.StorageLimitReached || u.UsedHuman != "1.99 GB" {
+		t.Errorf("under the limits: reached %v, %v, used %q", u.LimitReached, u.StorageLimitReached, u.UsedHuman)
+	}
+
+	u = NewUsageStats(GBytes(500), 0, 0, 0, StorageUsage{Used: GBytes(500)}, 0)
+	if u.LimitReached || u.StorageLimitReached || u.LimitBytes != -1 || u.StorageLimitBytes != -1 ||
+		u.LimitHuman != "unlimited" || u.StorageLimitHuman != "unlimited" {
+		t.Errorf("unlimited: %+v", u)
+	}
+}
+
+func TestCurrentUsagePeriod(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	period := func(start, end time.Time) UsagePeriod { return UsagePeriod{Start: start, End: end} }
+	sub := func(plan string, start, end time.Time) *Subscription {
+		return &Subscription{Plan: plan, CurrentPeriodStart: &start, CurrentPeriodEnd: &end}
+	}
+	est := time.FixedZone("EST", -5*60*60)
+
+	tests := []struct {
+		name string
+		sub  *Subscription
+		now  time.Time
+		want UsagePeriod
+	}{
+		{"no subscription", nil, day(2026, 3, 15), period(day(2026, 3, 1), day(2026, 4, 1))},
+		{"no subscription in December", nil, day(2026, 12, 31), period(day(2026, 12, 1), day(2027, 1, 1))},
+		{"now in another zone", nil, time.Date(2026, 3, 31, 20, 0, 0, 0, est), period(day(2026, 4, 1), day(2026, 5, 1))},
+		{"free plan with a period", sub("free", day(2026, 3, 10), day(2026, 4, 10)), day(2026, 3, 15), period(day(2026, 3, 1), day(2026, 4, 1))},
+		{"paid plan without Stripe data", &Subscription{Plan: "pro"}, day(2026, 3, 15), period(day(2026, 3, 1), day(2026, 4, 1))},
+		{"paid plan without a period end", &Subscription{Plan: "pro", CurrentPeriodStart: ptr(day(2026, 3, 10))}, day(2026, 3, 15), period(day(2026, 3, 1), day(2026, 4, 1))},
+
+		{"billing period", sub("pro", day(2026, 3, 10), day(2026, 4, 10)), day(2026, 3, 15), period(day(2026, 3, 10), day(2026, 4, 10))},
+		{"at the period's start", sub("pro", day(2026, 3, 10), day(2026, 4, 10)), day(2026, 3, 10), period(day(2026, 3, 10), day(2026, 4, 10))},
+
+		// The renewal webhook hasn't arrived: the next period starts at the
+		// stored end
+		{"at the period's end", sub("pro", day(2026, 3, 10), day(2026, 4, 10)), day(2026, 4, 10), period(day(2026, 4, 10), day(2026, 5, 10))},
+		{"two periods late", sub("pro", day(2026, 3, 10), day(2026, 4, 10)), day(2026, 5, 20), period(day(2026, 5, 10), day(2026, 6, 10))},
+		{"over the year's end", sub("pro", day(2026, 11, 20), day(2026, 12, 20)), day(2027, 1, 5), period(day(2026, 12, 20), day(2027, 1, 20))},
+		{"end of a short month", sub("pro", day(2026, 1, 31), day(2026, 2, 28)), day(2026, 3, 1), period(day(2026, 2, 28), day(2026, 3, 28))},
+		{"too stale", sub("pro", day(2026, 1, 10), day(2026, 2, 10)), day(2026, 6, 15), period(day(2026, 6, 1), day(2026, 7, 1))},
+
+		{"before the period", sub("pro", day(2026, 3, 10), day(2026, 4, 10)), day(2026, 3, 5), period(day(2026, 3, 1), day(2026, 4, 1))},
+		{"empty period", sub("pro", day(2026, 3, 10), day(2026, 3, 10)), day(2026, 3, 5), period(day(2026, 3, 1), day(2026, 4, 1))},
+	}
+	for _, tt := range tests {
+		got := CurrentUsagePeriod(tt.sub, tt.now)
+		if !got.Start.Equal(tt.want.Start) || !got.End.Equal(tt.want.End) {
+			t.Errorf("%s: CurrentUsagePeriod = [%v, %v), want [%v, %v)", tt.name, got.Start, got.End, tt.want.Start, tt.want.End)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestHalfSkippedTorrent(t *testing.T) {
+	files := []TorrentFile{
+		{Path: "a.mkv", Size: 400, Progress: 100, Priority: 2},
+		{Path: "b.mkv", Size: 300, Progress: 0, Priority: 0},
+		{Path: "c.nfo", Size: 100, Progress: 100, Priority: 3},
+		{Path: "d.mkv", Size: 200, Progress: 0, Priority: 0},
+	}
+	tr := &Torrent{TotalSize: 1000, Files: files}
+
+	wanted := WantedFiles(files)
+	if len(wanted) != 2 || wanted[0].Path != "a.mkv" || wanted[1].Path != "c.nfo" {
+		t.Errorf("WantedFiles = %+v", wanted)
+	}
+	if got := tr.WantedSize(); got != 500 {
+		t.Errorf("WantedSize = %d, want 500", got)
+	}
+	// Every wanted file is done though the skipped ones aren't on disk
+	if got := CompletedFiles(wanted); got != len(wanted) {
+		t.Errorf("CompletedFiles of the wanted files = %d, want %d", got, len(wanted))
+	}
+
+	// Nothing skipped, or the files not known yet: the torrent's size
+	if got := WantedSize(files[:1], 1000); got != 1000 {
+		t.Errorf("nothing skipped: WantedSize = %d, want 1000", got)
+	}
+	if got := WantedSize(nil, 1000); got != 1000 {
+		t.Errorf("no files: WantedSize = %d, want 1000", got)
+	}
+}
+
+func TestFormatUserTime(t *testing.T) {
+	at := time.Date(2026, 3, 31, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		timezone, time, date string
+	}{
+		{"UTC", "2026-03-31 23:30 UTC", "2026-03-31"},
+		{"", "2026-03-31 23:30 UTC", "2026-03-31"},
+		{"Europe/Berlin", "2026-04-01 01:30 CEST", "2026-04-01"},
+		{"America/New_York", "2026-03-31 19:30 EDT", "2026-03-31"},
+		// A zone that no longer loads, or the server's own, falls back to UTC
+		{"Mars/Olympus_Mons", "2026-03-31 23:30 UTC", "2026-03-31"},
+		{"Local", "2026-03-31 23:30 UTC", "2026-03-31"},
+	}
+	for _, tt := range tests {
+		if got := FormatUserTime(at, tt.timezone); got != tt.time {
+			t.Errorf("FormatUserTime(%q) = %q, want %q", tt.timezone, got, tt.time)
+		}
+		if got := FormatUserDate(at, tt.timezone); got != tt.date {
+			t.Errorf("FormatUserDate(%q) = %q, want %q", tt.timezone, got, tt.date)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"context"
+	"log"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/mail"
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+// Notifier tells users about things that happened to their account. Every
+// notification lands in the user's in-app inbox and is published as a
+// "notification" event so open dashboards update; those worth an email are
+// mailed as well.
+type Notifier struct {
+	db     *database.Database
+	events *events.Broker
+	mailer mail.Sender
+}
+
+// New creates a new notifier
+func New(db *database.Database, broker *events.Broker, mailer mail.Sender) *Notifier {
+	return &Notifier{
+		db:     db,
+		events: broker,
+		mailer: mailer,
+	}
+}
+
+// Notify records n in its user's inbox and publishes it. When email is not
+// empty and mail is configured, n is also mailed there, its title as the
+// subject; callers pass the address only if the user hasn't opted out of
+// email. Mail is sent even if recording n fails, whose error is returned.
+func (nf *Notifier) Notify(ctx context.Context, n *models.Notification, email string) error {
+	dbCtx, cancel := database.WithTimeout(ctx)
+	err := nf.db.CreateNotification(dbCtx, n)
+	cancel()
+	if err == nil {
+		nf.events.Publish(events.Event{
+			UserID: n.UserID,
+			Type:   "notification",
+			Data:   n,
+		})
+	}
+
+	if email != "" && nf.mailer.Enabled() {
+		if err := nf.mailer.Send(mail.Message{To: email, Subject: n.Title, Body: n.Body}); err != nil {
+			log.Printf("Failed to mail %s notification to user %s: %v", n.Type, n.UserID, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+// Package redact strips secrets from URLs and magnet URIs before they are
+// logged or sent to a client. Private trackers put a user's passkey in the
+// announce URL, as a query parameter or a path segment, and magnet URIs
+// carry those announce URLs in their tr parameters.
+package redact
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces whatever was removed
+const Redacted = "REDACTED"
+
+// minTokenLen is the shortest path segment taken for a passkey or token:
+// one of letters and digits only, like a tracker passkey or the secret in
+// a Slack webhook URL
+const minTokenLen = 16
+
+var (
+	// urlPattern finds the URLs in free text, such as an error message,
+	// stopping at whitespace and the quotes errors wrap them in
+	urlPattern = regexp.MustCompile(`(?i)\b(?:magnet:\?|(?:https?|udp|wss?)://)[^\s"'<>]+`)
+	// xtPattern finds a magnet's exact topics, the info hashes, which are
+	// kept so the torrent can still be told apart
+	xtPattern    = regexp.MustCompile(`(?i)\bxt=urn:(?:btih|btmh):[a-z0-9]+`)
+	tokenPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+)
+
+// URL returns s without its secrets. A magnet URI keeps only its info
+// hashes. Any other URL loses its user info, query and fragment, and path
+// segments that look like tokens. One that doesn't parse keeps only its
+// scheme.
+func URL(s string) string {
+	if strings.HasPrefix(strings.ToLower(s), "magnet:") {
+		return magnet(s)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		scheme, _, found := strings.Cut(s, "://")
+		if !found {
+			return Redacted
+		}
+		return scheme + "://" + Redacted
+	}
+	if u.User != nil {
+		u.User = url.User(Redacted)
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		u.RawQuery = Redacted
+	}
+	u.Fragment, u.RawFragment = "", ""
+
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if token(segment) {
+			segments[i] = Redacted
+		}
+	}
+	u.RawPath = ""
+	u.Path, _ = url.PathUnescape(strings.Join(segments, "/"))
+	return u.String()
+}
+
+// String returns s with every URL and magnet URI in it passed through URL
+func String(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, URL)
+}
+
+// Error returns err's message passed through String, or "" for nil
+func Error(err error) string {
+	if err == nil {
+		return ""
+	}
+	return String(err.Error())
+}
+
+// magnet keeps a magnet URI's info hashes, read from the raw text so one
+// too malformed to parse is still redacted
+func magnet(s string) string {
+	topics := xtPattern.FindAllString(s, -1)
+	if len(topics) == 0 {
+		return "magnet:?" + Redacted
+	}
+	return "magnet:?" + strings.Join(topics, "&")
+}
+
+// token reports whether a path segment looks like a passkey or other
+// secret rather than a name
+func token(segment string) bool {
+	// A file name such as HASH.torrent is kept by its extension
+	return len(segment) >= minTokenLen && tokenPattern.MatchString(segment)
+}
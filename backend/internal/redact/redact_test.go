@@ -0,0 +1,83 @@
+package redact
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	passkey = "0123456789abcdef0123456789abcdef"
+	hash    = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+)
+
+// privateMagnet is a magnet for a private tracker that takes the passkey
+// in its path, with another that takes it in the query
+var privateMagnet = "magnet:?xt=urn:btih:" + hash + "&dn=Some+Show" +
+	"&tr=" + url.QueryEscape("https://tracker.example/"+passkey+"/announce") +
+	"&tr=" + url.QueryEscape("udp://other.example:80/announce?passkey="+passkey)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{privateMagnet, "magnet:?xt=urn:btih:" + hash},
+		{"MAGNET:?XT=urn:btih:" + hash + "&tr=x", "magnet:?XT=urn:btih:" + hash},
+		{"magnet:?dn=no+hash&tr=https://t.example/" + passkey, "magnet:?" + Redacted},
+		{"magnet:?xt=urn:btih:" + hash + "&tr=%zz" + passkey, "magnet:?xt=urn:btih:" + hash},
+
+		{"https://tracker.example/" + passkey + "/announce", "https://tracker.example/" + Redacted + "/announce"},
+		{"https://tracker.example/announce?passkey=" + passkey + "&x=1", "https://tracker.example/announce?" + Redacted},
+		{"https://user:" + passkey + "@tracker.example/announce", "https://" + Redacted + "@tracker.example/announce"},
+		{"https://example.com/file#" + passkey, "https://example.com/file"},
+		{"https://example.com/" + passkey + ".torrent", "https://example.com/" + passkey + ".torrent"},
+		{"https://example.com/releases/show", "https://example.com/releases/show"},
+		{"https://hooks.slack.com/services/T000/B000/" + passkey, "https://hooks.slack.com/services/T000/B000/" + Redacted},
+		{"http://[::1]:%zz/" + passkey, "http://" + Redacted},
+	}
+	for _, tt := range tests {
+		if got := URL(tt.in); got != tt.want {
+			t.Errorf("URL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestErrorPaths feeds passkey-bearing magnets and announce URLs through
+// the errors they end up in and checks the passkey never comes out
+func TestErrorPaths(t *testing.T) {
+	_, parseErr := url.Parse(privateMagnet + "\x7f")
+	if parseErr == nil {
+		t.Fatal("malformed magnet parsed")
+	}
+	announce := "https://tracker.example/announce?passkey=" + passkey
+
+	errs := []error{
+		parseErr,
+		fmt.Errorf("failed to add torrent: %w", parseErr),
+		fmt.Errorf("invalid magnet %q", privateMagnet),
+		fmt.Errorf("announce to %s: connection refused", announce),
+		fmt.Errorf("fetching <%s>: 404", "https://tracker.example/"+passkey+"/file.torrent"),
+		errors.New("two trackers: " + announce + ", " + privateMagnet),
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Error(), passkey) {
+			t.Fatalf("test error doesn't carry the passkey: %v", err)
+		}
+		got := Error(err)
+		if strings.Contains(got, passkey) {
+			t.Errorf("Error(%v) = %q, still has the passkey", err, got)
+		}
+		if strings.Contains(err.Error(), hash) && !strings.Contains(got, hash) {
+			t.Errorf("Error(%v) = %q, lost the info hash", err, got)
+		}
+	}
+
+	if got := Error(nil); got != "" {
+		t.Errorf("Error(nil) = %q", got)
+	}
+	if got := String("no URLs here"); got != "no URLs here" {
+		t.Errorf("String changed plain text: %q", got)
+	}
+}
@@ -0,0 +1,109 @@
+package reporting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/redact"
+)
+
+// Event is one error or panic worth telling someone about
+type Event struct {
+	Error       string            `json:"error"`
+	Stack       string            `json:"stack,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Environment string            `json:"environment"`
+	Time        time.Time         `json:"time"`
+}
+
+// Reporter receives errors and panics that would otherwise only reach the log
+type Reporter interface {
+	Report(e Event)
+}
+
+// New returns a reporter that posts events as JSON to url, or one that only
+// logs them when url is empty
+func New(url, environment string) Reporter {
+	if url == "" {
+		return &logReporter{}
+	}
+	return &webhookReporter{
+		url:         url,
+		environment: environment,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Recover reports a panic in a background goroutine instead of letting it
+// crash the process. It must be deferred directly:
+//
+//	defer reporting.Recover(r, "cleanup job", nil)
+func Recover(r Reporter, where string, tags map[string]string) {
+	if v := recover(); v != nil {
+		r.Report(Event{
+			Error: fmt.Sprintf("panic in %s: %v", where, v),
+			Stack: string(debug.Stack()),
+			Tags:  tags,
+		})
+	}
+}
+
+type logReporter struct{}
+
+func (r *logReporter) Report(e Event) {
+	e = redactEvent(e)
+	log.Printf("ERROR: %s %v", e.Error, e.Tags)
+	if e.Stack != "" {
+		log.Print(e.Stack)
+	}
+}
+
+type webhookReporter struct {
+	url         string
+	environment string
+	client      *http.Client
+}
+
+// Report logs the event and delivers it in the background, so a slow
+// endpoint never holds up the request or job that failed
+func (r *webhookReporter) Report(e Event) {
+	e = redactEvent(e)
+	e.Environment = r.environment
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Printf("ERROR: %s %v", e.Error, e.Tags)
+
+	go func() {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			// The error names the endpoint, which may carry its own token
+			log.Printf("Failed to send error report: %s", redact.Error(err))
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// redactEvent strips secrets from the URLs and magnet URIs an event's
+// error and tags mention before it is logged or sent anywhere
+func redactEvent(e Event) Event {
+	e.Error = redact.String(e.Error)
+	if len(e.Tags) > 0 {
+		tags := make(map[string]string, len(e.Tags))
+		for k, v := range e.Tags {
+			tags[k] = redact.String(v)
+		}
+		e.Tags = tags
+	}
+	return e
+}
@@ -0,0 +1,49 @@
+package reporting
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const passkey = "0123456789abcdef0123456789abcdef"
+
+func TestReportRedacts(t *testing.T) {
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer srv.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	magnet := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&tr=https%3A%2F%2Ftracker.example%2F" + passkey + "%2Fannounce"
+	event := Event{
+		Error: `failed to add torrent: parse "` + magnet + `": invalid URL escape "%zz"`,
+		Tags:  map[string]string{"announce": "https://tracker.example/announce?passkey=" + passkey},
+	}
+	New(srv.URL, "test").Report(event)
+	New("", "test").Report(event)
+
+	sent := <-received
+	for what, out := range map[string]string{"sent event": sent, "log": logged.String()} {
+		if strings.Contains(out, passkey) {
+			t.Errorf("%s has the passkey: %s", what, out)
+		}
+		if !strings.Contains(out, "c12fe1c06bba254a9dc9f519b335aa7c1367a88a") {
+			t.Errorf("%s lost the info hash: %s", what, out)
+		}
+	}
+	// The caller's event is left alone
+	if !strings.Contains(event.Tags["announce"], passkey) {
+		t.Errorf("Report changed the caller's tags")
+	}
+}
@@ -0,0 +1,152 @@
+package search
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// ResultTTL is how long a search result may be added after the search
+const ResultTTL = 30 * time.Minute
+
+// ErrUnknownProvider is returned when a search names a provider that isn't
+// configured
+var ErrUnknownProvider = errors.New("unknown search provider")
+
+// storedResult is a result kept for adding, for the user who searched
+type storedResult struct {
+	userID    uuid.UUID
+	result    models.SearchResult
+	expiresAt time.Time
+}
+
+// Searcher queries Torznab providers. Results are remembered for
+// ResultTTL so they can be added by ID; they are kept in memory, so they
+// only add on the instance that ran the search.
+type Searcher struct {
+	providers []config.SearchProvider
+	timeout   time.Duration
+	client    *http.Client
+
+	mu      sync.Mutex
+	results map[string]storedResult
+}
+
+// NewSearcher creates a searcher that gives each provider timeout to answer
+func NewSearcher(providers []config.SearchProvider, timeout time.Duration) *Searcher {
+	return &Searcher{
+		providers: providers,
+		timeout:   timeout,
+		client:    &http.Client{},
+		results:   make(map[string]storedResult),
+	}
+}
+
+// Search queries the named provider, or every provider when provider is
+// empty, all at once. Providers that fail or time out are listed in the
+// response's errors; the others' results are still returned.
+func (s *Searcher) Search(ctx context.Context, userID uuid.UUID, q, provider string) (*models.SearchResponse, error) {
+	providers := s.providers
+	if provider != "" {
+		providers = nil
+		for _, p := range s.providers {
+			if p.Name == provider {
+				providers = []config.SearchProvider{p}
+			}
+		}
+		if providers == nil {
+			return nil, ErrUnknownProvider
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	type answer struct {
+		results []models.SearchResult
+		err     error
+	}
+	answers := make([]answer, len(providers))
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		wg.Add(1)
+		go func(i int, p config.SearchProvider) {
+			defer wg.Done()
+			results, err := query(ctx, s.client, p, q)
+			answers[i] = answer{results, err}
+		}(i, p)
+	}
+	wg.Wait()
+
+	resp := &models.SearchResponse{
+		Query:   q,
+		Results: []models.SearchResult{},
+		Errors:  []models.SearchProviderError{},
+	}
+	for i, a := range answers {
+		if a.err != nil {
+			resp.Errors = append(resp.Errors, models.SearchProviderError{
+				Provider: providers[i].Name,
+				Error:    a.err.Error(),
+			})
+			continue
+		}
+		resp.Results = append(resp.Results, a.results...)
+	}
+	sort.SliceStable(resp.Results, func(i, j int) bool {
+		return resp.Results[i].Seeders > resp.Results[j].Seeders
+	})
+
+	if err := s.remember(userID, resp.Results); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// remember gives each result an ID and keeps it for adding
+func (s *Searcher) remember(userID uuid.UUID, results []models.SearchResult) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, r := range s.results {
+		if now.After(r.expiresAt) {
+			delete(s.results, k)
+		}
+	}
+	for i := range results {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		results[i].ID = hex.EncodeToString(b)
+		s.results[results[i].ID] = storedResult{
+			userID:    userID,
+			result:    results[i],
+			expiresAt: now.Add(ResultTTL),
+		}
+	}
+	return nil
+}
+
+// Result returns a result from one of the user's recent searches. It
+// returns false for unknown or expired IDs and for other users' results.
+func (s *Searcher) Result(userID uuid.UUID, id string) (*models.SearchResult, bool) {
+	s.mu.Lock()
+	r, ok := s.results[id]
+	s.mu.Unlock()
+
+	if !ok || r.userID != userID || time.Now().After(r.expiresAt) {
+		return nil, false
+	}
+	return &r.result, true
+}
@@ -0,0 +1,159 @@
+package search
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+// maxFeedSize bounds a provider's response
+const maxFeedSize = 5 * 1024 * 1024
+
+// maxProviderResults bounds the results kept from one provider
+const maxProviderResults = 100
+
+// torznabFeed is a Torznab search response: an RSS feed, or an <error>
+// element when the provider refuses the request
+type torznabFeed struct {
+	XMLName     xml.Name
+	Code        string        `xml:"code,attr"`
+	Description string        `xml:"description,attr"`
+	Items       []torznabItem `xml:"channel>item"`
+}
+
+type torznabItem struct {
+	Title     string `xml:"title"`
+	Link      string `xml:"link"`
+	Size      int64  `xml:"size"`
+	PubDate   string `xml:"pubDate"`
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Attrs []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"attr"`
+}
+
+// attr returns the value of the item's torznab:attr with the given name
+func (it *torznabItem) attr(name string) string {
+	for _, a := range it.Attrs {
+		if strings.EqualFold(a.Name, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// query runs a search against one provider
+func query(ctx context.Context, client *http.Client, p config.SearchProvider, q string) ([]models.SearchResult, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, errors.New("invalid provider URL")
+	}
+	params := u.Query()
+	params.Set("t", "search")
+	params.Set("q", q)
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.New("invalid provider URL")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider returned %s", resp.Status)
+	}
+
+	var feed torznabFeed
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxFeedSize)).Decode(&feed); err != nil {
+		return nil, providerError(err)
+	}
+	if feed.XMLName.Local == "error" {
+		return nil, fmt.Errorf("provider error %s: %s", feed.Code, feed.Description)
+	}
+
+	var results []models.SearchResult
+	for i := range feed.Items {
+		if r, ok := normalize(p.Name, &feed.Items[i]); ok {
+			results = append(results, r)
+			if len(results) == maxProviderResults {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// normalize turns a feed item into a result; items with neither a magnet
+// nor a .torrent link can't be added and are dropped
+func normalize(provider string, it *torznabItem) (models.SearchResult, bool) {
+	r := models.SearchResult{
+		Provider: provider,
+		Title:    strings.TrimSpace(it.Title),
+		Size:     it.Size,
+		InfoHash: strings.ToLower(it.attr("infohash")),
+	}
+	if r.Size == 0 {
+		r.Size = it.Enclosure.Length
+	}
+	if r.Size == 0 {
+		r.Size, _ = strconv.ParseInt(it.attr("size"), 10, 64)
+	}
+	r.Seeders, _ = strconv.Atoi(it.attr("seeders"))
+	if peers, err := strconv.Atoi(it.attr("peers")); err == nil && peers > r.Seeders {
+		// Torznab's peers count includes the seeders
+		r.Leechers = peers - r.Seeders
+	}
+	if t, err := time.Parse(time.RFC1123Z, it.PubDate); err == nil {
+		r.PublishedAt = &t
+	}
+
+	for _, link := range []string{it.attr("magneturl"), it.Link, it.Enclosure.URL} {
+		switch {
+		case link == "":
+		case strings.HasPrefix(link, "magnet:"):
+			if r.MagnetURI == "" {
+				r.MagnetURI = link
+			}
+		case strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://"):
+			if r.Link == "" {
+				r.Link = link
+			}
+		}
+	}
+	return r, r.Title != "" && (r.MagnetURI != "" || r.Link != "")
+}
+
+// providerError describes a failed request without the provider's URL,
+// which holds its API key
+func providerError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("timed out")
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return errors.New("timed out")
+		}
+		return errors.New("request failed: " + urlErr.Err.Error())
+	}
+	return errors.New("invalid response: " + err.Error())
+}
@@ -0,0 +1,388 @@
+// Package server assembles the HTTP API: the Fiber app with its
+// middleware, handlers and routes. It is built on services the caller
+// starts, stops and runs background jobs on, so cmd/server and the
+// integration tests serve the same app.
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/auth"
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/events"
+	"github.com/freetorrent/freetorrent/internal/handlers"
+	"github.com/freetorrent/freetorrent/internal/hooks"
+	"github.com/freetorrent/freetorrent/internal/jobs"
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/freetorrent/freetorrent/internal/notify"
+	"github.com/freetorrent/freetorrent/internal/reporting"
+	"github.com/freetorrent/freetorrent/internal/search"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/uploads"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/google/uuid"
+)
+
+// Services are what the API is built on
+type Services struct {
+	DB        *database.Database
+	Engine    torrent.Service
+	Auth      *auth.AuthService
+	Broker    *events.Broker
+	Notifier  *notify.Notifier
+	Hooks     hooks.Hooks
+	Uploads   *uploads.Store
+	Completer *jobs.Completer
+	Reporter  reporting.Reporter
+	// Limits holds rate limit counts shared with other servers; nil counts
+	// them per server
+	Limits middleware.LimiterStore
+}
+
+// App is the API, with the parts of it background jobs also work on
+type App struct {
+	*fiber.App
+
+	// Torrents runs bulk imports for the import job
+	Torrents *handlers.TorrentHandler
+	// APIUsage is written to usage logs by the API usage job
+	APIUsage *middleware.APIUsage
+	// Redirects are reloaded from the settings by the redirects job
+	Redirects *middleware.DownloadRedirects
+}
+
+// New builds the API on s, configured by cfg
+func New(cfg *config.Config, s Services) *App {
+	db, engine, reporter := s.DB, s.Engine, s.Reporter
+	authService, broker, notifier := s.Auth, s.Broker, s.Notifier
+	lifecycle, uploadStore, completer := s.Hooks, s.Uploads, s.Completer
+
+	// Expensive requests each user may run at once, capped by plan
+	zipSlots := middleware.NewConcurrencyLimiter(30*time.Second, func(ctx context.Context, userID uuid.UUID) int {
+		return handlers.UserPlanLimits(ctx, db, userID).ConcurrentZips
+	})
+	previewSlots := middleware.NewConcurrencyLimiter(10*time.Second, func(ctx context.Context, userID uuid.UUID) int {
+		return handlers.UserPlanLimits(ctx, db, userID).ConcurrentPreviews
+	})
+
+	// Initialize handlers
+	signer := auth.NewDownloadSigner(cfg.DownloadSigningSecret, cfg.DownloadSigningSecretPrevious)
+	authHandler := handlers.NewAuthHandler(db, authService, cfg, engine, lifecycle)
+	torrentHandler := handlers.NewTorrentHandler(db, engine, broker, uploadStore, signer, zipSlots, lifecycle, cfg.DeleteConfirmGB, cfg.PublicBaseURL)
+	uploadHandler := handlers.NewUploadHandler(db, uploadStore)
+	collectionHandler := handlers.NewCollectionHandler(db, engine, lifecycle)
+	activityHandler := handlers.NewActivityHandler(db)
+	notificationHandler := handlers.NewNotificationHandler(db)
+	apiUsage := middleware.NewAPIUsage(cfg.APIHeavyMB, cfg.RateLimitHeavy)
+	compression := middleware.NewCompression(skipCompression)
+	redirects := middleware.NewDownloadRedirects()
+	adminHandler := handlers.NewAdminHandler(db, engine, apiUsage, compression, redirects, lifecycle, completer)
+	sseTickets := auth.NewTicketStore(auth.TicketTTL)
+	sseHandler := handlers.NewSSEHandler(engine, sseTickets, broker)
+	billingHandler := handlers.NewBillingHandler(db, cfg, notifier)
+	capabilitiesHandler := handlers.NewCapabilitiesHandler(cfg, db, engine)
+	graphqlHandler := handlers.NewGraphQLHandler(db, engine)
+	planHandler := handlers.NewPlanHandler(db)
+	reportHandler := handlers.NewReportHandler(db, cfg, signer)
+	diagnosticsHandler := handlers.NewDiagnosticsHandler(completer)
+	searchHandler := handlers.NewSearchHandler(cfg, search.NewSearcher(cfg.SearchProviders, time.Duration(cfg.SearchTimeout)*time.Second), torrentHandler)
+
+	// Initialize rate limiters: public routes are keyed by client IP with a
+	// tight budget, authenticated routes by user ID with a larger one
+	publicLimiter := middleware.NewSharedRateLimiter(s.Limits, "public", cfg.RateLimitPublic, time.Minute)
+	userLimiter := middleware.NewSharedRateLimiter(s.Limits, "user", cfg.RateLimitUser, time.Minute)
+	previewLimiter := middleware.NewSharedRateLimiter(s.Limits, "preview", cfg.RateLimitPreview, time.Minute)
+	filePreviewLimiter := middleware.NewSharedRateLimiter(s.Limits, "file_preview", cfg.RateLimitFilePreview, time.Minute)
+	downloadLimiter := middleware.NewSharedRateLimiter(s.Limits, "download", cfg.RateLimitDownload, time.Minute)
+	reportLimiter := middleware.NewSharedRateLimiter(s.Limits, "report", cfg.RateLimitReport, time.Hour)
+	adminLimiter := middleware.NewSharedRateLimiter(s.Limits, "admin", cfg.RateLimitAdmin, time.Minute)
+	downloadStreams := middleware.NewConcurrencyLimiter(10*time.Second, nil)
+	publicLimit := middleware.RateLimitMiddleware(publicLimiter)
+
+	// Admin routes are kept to admins, from ADMIN_IP_ALLOWLIST when it is
+	// set, with their own tighter limit on changes; destructive ones may
+	// also need a session signed in with a two-factor code
+	adminGuard := middleware.NewAdminGuard(cfg.AdminIPAllowlist, cfg.AdminRequire2FA, db.LogAdminDenied)
+	adminOnly := adminGuard.Handler()
+	adminLimit := middleware.MutationRateLimitMiddleware(adminLimiter)
+	destructive := adminGuard.RequireTwoFactor()
+
+	// Create Fiber app
+	app := fiber.New(fiber.Config{
+		AppName:               "CT-SaaS",
+		ServerHeader:          "CT-SaaS",
+		DisableStartupMessage: cfg.Environment == "production",
+		ReadTimeout:           30 * time.Second,
+		WriteTimeout:          30 * time.Second,
+		IdleTimeout:           120 * time.Second,
+		BodyLimit:             config.MaxRequestBody,
+		ErrorHandler:          middleware.ErrorHandler(reporter),
+	})
+
+	// Global middleware
+	app.Use(middleware.RecoverMiddleware(reporter))
+	app.Use(middleware.RequestIDMiddleware())
+	app.Use(middleware.SlowRequestMiddleware(time.Duration(cfg.SlowRequestMs) * time.Millisecond))
+	app.Use(middleware.ClientIPMiddleware(cfg.TrustedProxies))
+	app.Use(middleware.CORSMiddleware())
+
+	if cfg.Environment != "production" {
+		app.Use(logger.New(logger.Config{
+			Format: "${time} | ${status} | ${latency} | ${client_ip} | ${method} | ${path}\n",
+			CustomTags: map[string]logger.LogFunc{
+				"client_ip": func(output logger.Buffer, c *fiber.Ctx, data *logger.Data, extraParam string) (int, error) {
+					return output.WriteString(middleware.ClientIP(c))
+				},
+			},
+		}))
+	}
+
+	app.Use(compression.Handler())
+
+	// Download URLs that moved to another host or path
+	app.Use(redirects.Handler())
+
+	// Health check
+	app.Get("/health", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"status":  "healthy",
+			"service": "ct-saas",
+			"time":    time.Now().Format(time.RFC3339),
+		})
+	})
+	app.Get("/health/ready", readinessCheck(db, engine))
+
+	// API v1 routes
+	api := app.Group("/api/v1")
+
+	// Request deadlines for everything but streams
+	timeouts := middleware.TimeoutMiddleware(
+		time.Duration(cfg.RequestTimeoutRead)*time.Second,
+		time.Duration(cfg.RequestTimeoutWrite)*time.Second)
+
+	// Public auth routes (rate limited per IP)
+	authRoutes := api.Group("/auth", timeouts)
+	authRoutes.Post("/register", publicLimit, authHandler.Register)
+	authRoutes.Post("/login", publicLimit, authHandler.Login)
+	authRoutes.Post("/refresh", publicLimit, authHandler.Refresh)
+	authRoutes.Post("/logout", publicLimit, authHandler.Logout)
+
+	// What this deployment supports, for the SPA
+	api.Get("/capabilities", publicLimit, capabilitiesHandler.GetCapabilities)
+	api.Get("/plans", publicLimit, planHandler.ListPlans)
+	api.Get("/plans/estimate", publicLimit, planHandler.EstimatePlan)
+
+	// Abuse reports, open to rights holders without an account
+	api.Post("/reports", middleware.RateLimitMiddleware(reportLimiter), timeouts, reportHandler.CreateReport)
+
+	// Public download routes (token-based auth, NOT JWT), limited per link
+	// rather than per IP: a leaked link can't be hammered from many
+	// addresses, and users sharing an address don't throttle each other
+	linkLimit := middleware.ParamRateLimitMiddleware(downloadLimiter, "token")
+	linkStreams := middleware.ParamConcurrencyMiddleware(downloadStreams, "token", cfg.DownloadLinkStreams)
+	api.Get("/download/:token", linkLimit, linkStreams, torrentHandler.Download)
+	api.Get("/dl/:token", linkLimit, linkStreams, torrentHandler.DownloadSigned)
+
+	// Stripe webhook (no auth, uses signature verification)
+	api.Post("/webhooks/stripe", middleware.BodyLimitMiddleware(handlers.WebhookMaxBody), timeouts, billingHandler.HandleWebhook)
+
+	// SSE events authenticate with a ticket from /events/ticket, since
+	// EventSource can't send headers. Registered ahead of the protected group
+	// so they skip its header-only auth and its deadline.
+	sseAuth := middleware.SSEAuthMiddleware(authService, sseTickets, cfg.SSEQueryToken)
+	api.Get("/events", sseAuth, middleware.RateLimitMiddleware(userLimiter), sseHandler.Events)
+	api.Get("/admin/events", sseAuth, middleware.RateLimitMiddleware(userLimiter), adminOnly, sseHandler.EventsAll)
+
+	// Protected routes (require authentication, rate limited per user, and
+	// accounted per user with an adaptive limit for heavy API use). Clients
+	// below their minimum version can still read but not make changes;
+	// signing in stays open to them.
+	protected := api.Group("", middleware.AuthMiddleware(authService), middleware.RateLimitMiddleware(userLimiter), middleware.APIUsageMiddleware(apiUsage),
+		middleware.MinClientVersionMiddleware(cfg.MinClientVersions))
+	idempotent := middleware.IdempotencyMiddleware(db)
+
+	// The collection zip stream, torrent previews, which wait up to a minute
+	// for magnet metadata, torrent creation, which hashes the uploaded
+	// files, and file previews, which stream. Registered ahead of the groups
+	// so they skip their deadline: a route registered first is matched first.
+	protected.Get("/collections/:id/download", middleware.ConcurrencyMiddleware(zipSlots), collectionHandler.DownloadCollection)
+	engineUp := middleware.EngineMiddleware(engine.Available)
+	protected.Post("/torrents/preview", engineUp, middleware.RateLimitMiddleware(previewLimiter), middleware.ConcurrencyMiddleware(previewSlots), torrentHandler.PreviewTorrent)
+	protected.Post("/torrents/create", engineUp, idempotent, torrentHandler.CreateTorrent)
+	protected.Get("/torrents/:id/preview", middleware.RateLimitMiddleware(filePreviewLimiter), torrentHandler.PreviewFile)
+
+	// User routes
+	protected.Get("/auth/me", timeouts, authHandler.Me)
+	protected.Patch("/auth/me", timeouts, authHandler.UpdateMe)
+	protected.Get("/settings/timezones", timeouts, authHandler.ListTimezones)
+	protected.Post("/auth/2fa/setup", timeouts, authHandler.SetupTwoFactor)
+	protected.Post("/auth/2fa/enable", timeouts, authHandler.EnableTwoFactor)
+	protected.Delete("/auth/2fa", timeouts, authHandler.DisableTwoFactor)
+	protected.Get("/auth/sessions", timeouts, authHandler.ListSessions)
+	protected.Get("/activity", timeouts, activityHandler.ListActivity)
+	protected.Get("/graphql", timeouts, graphqlHandler.Query)
+	protected.Post("/graphql", timeouts, graphqlHandler.Query)
+	protected.Get("/notifications", timeouts, notificationHandler.ListNotifications)
+	protected.Post("/notifications/read_all", timeouts, notificationHandler.MarkAllRead)
+	protected.Post("/notifications/:id/read", timeouts, notificationHandler.MarkRead)
+	protected.Post("/events/ticket", timeouts, sseHandler.CreateTicket)
+
+	// Torrent routes
+	torrents := protected.Group("/torrents", timeouts, engineUp)
+	torrents.Post("", idempotent, torrentHandler.AddTorrent)
+	torrents.Post("/upload", idempotent, torrentHandler.UploadTorrent)
+	torrents.Post("/import", idempotent, torrentHandler.ImportTorrents)
+	torrents.Get("/import/:jobID", torrentHandler.GetImportJob)
+	torrents.Get("", torrentHandler.ListTorrents)
+	torrents.Get("/:id", torrentHandler.GetTorrent)
+	torrents.Get("/:id/tree", torrentHandler.GetFileTree)
+	torrents.Get("/:id/torrentfile", torrentHandler.GetTorrentFile)
+	torrents.Get("/:id/trackers", torrentHandler.GetTrackers)
+	torrents.Get("/:id/zip/manifest", torrentHandler.GetZipManifest)
+	torrents.Delete("/:id", torrentHandler.DeleteTorrent)
+	torrents.Post("/:id/pause", torrentHandler.PauseTorrent)
+	torrents.Post("/:id/resume", torrentHandler.ResumeTorrent)
+	torrents.Post("/:id/retry", torrentHandler.RetryTorrent)
+	torrents.Patch("/:id", torrentHandler.UpdateTorrent)
+	torrents.Post("/:id/extend", torrentHandler.ExtendTorrent)
+	torrents.Post("/:id/token", torrentHandler.CreateDownloadToken)
+	torrents.Post("/:id/signed-url", torrentHandler.CreateSignedURL)
+
+	// Search routes
+	searchRoutes := protected.Group("/search", timeouts)
+	searchRoutes.Get("", searchHandler.Search)
+	searchRoutes.Post("/add", engineUp, idempotent, searchHandler.AddResult)
+
+	// Collection routes
+	collections := protected.Group("/collections", timeouts)
+	collections.Get("", collectionHandler.ListCollections)
+	collections.Post("", collectionHandler.CreateCollection)
+	collections.Get("/:id", collectionHandler.GetCollection)
+	collections.Patch("/:id", collectionHandler.UpdateCollection)
+	collections.Delete("/:id", collectionHandler.DeleteCollection)
+
+	// Resumable upload routes
+	uploadRoutes := protected.Group("/uploads", timeouts)
+	uploadRoutes.Post("", uploadHandler.CreateUpload)
+	uploadRoutes.Get("/:id", uploadHandler.GetUpload)
+	uploadRoutes.Patch("/:id", uploadHandler.PatchUpload)
+
+	// Billing routes
+	billing := protected.Group("/subscription", timeouts)
+	billing.Get("", billingHandler.GetSubscription)
+	billing.Get("/history", billingHandler.GetSubscriptionHistory)
+	billing.Post("/checkout", idempotent, billingHandler.CreateCheckoutSession)
+	billing.Post("/portal", billingHandler.CreatePortalSession)
+
+	// Admin routes. The backup stream is registered ahead of the group so
+	// it skips the deadline.
+	protected.Post("/admin/backup", adminOnly, adminLimit, destructive, adminHandler.Backup)
+	admin := protected.Group("/admin", adminOnly, adminLimit, timeouts)
+	admin.Get("/users", adminHandler.ListUsers)
+	admin.Get("/users/:id", adminHandler.GetUser)
+	admin.Get("/users/:id/subscription-history", adminHandler.GetSubscriptionHistory)
+	admin.Patch("/users/:id", destructive, adminHandler.UpdateUser)
+	admin.Delete("/users/:id", destructive, adminHandler.DeleteUser)
+	admin.Get("/torrents", adminHandler.ListAllTorrents)
+	admin.Delete("/torrents/:id", destructive, adminHandler.DeleteTorrent)
+	admin.Get("/stats", adminHandler.GetStats)
+	admin.Get("/activity", adminHandler.ListActivity)
+	admin.Get("/engine", adminHandler.GetEngineStatus)
+	admin.Get("/engine/portcheck", adminHandler.CheckPort)
+	admin.Delete("/engine/disk-error", adminHandler.ClearDiskError)
+	admin.Post("/cleanup", destructive, adminHandler.CleanupExpired)
+	admin.Get("/consistency", adminHandler.ListInconsistencies)
+	admin.Post("/consistency/repair", destructive, adminHandler.RepairInconsistencies)
+	admin.Get("/diagnostics/divergence", diagnosticsHandler.GetDivergence)
+	admin.Post("/diagnostics/repair", destructive, diagnosticsHandler.RepairDivergence)
+	admin.Get("/invites", adminHandler.ListInvites)
+	admin.Post("/invites", adminHandler.CreateInvite)
+	admin.Patch("/invites/:id", adminHandler.UpdateInvite)
+	admin.Delete("/invites/:id", adminHandler.DeleteInvite)
+	admin.Get("/plans", adminHandler.ListPlans)
+	admin.Get("/plans/:name", adminHandler.GetPlan)
+	admin.Put("/plans/:name", adminHandler.UpdatePlan)
+	admin.Delete("/plans/:name", destructive, adminHandler.DeletePlan)
+	admin.Get("/reports", adminHandler.ListReports)
+	admin.Get("/reports/:id", adminHandler.GetReport)
+	admin.Post("/reports/:id/takedown", destructive, adminHandler.TakedownReport)
+	admin.Post("/reports/:id/reject", adminHandler.RejectReport)
+	admin.Get("/blocked-hashes", adminHandler.ListBlockedHashes)
+	admin.Delete("/blocked-hashes/:hash", adminHandler.UnblockHash)
+	admin.Get("/settings/download-redirects", adminHandler.GetDownloadRedirects)
+	admin.Put("/settings/download-redirects", adminHandler.UpdateDownloadRedirects)
+	admin.Delete("/settings/download-redirects", adminHandler.DeleteDownloadRedirects)
+	admin.Get("/settings/failed-retention", adminHandler.GetFailedRetention)
+	admin.Put("/settings/failed-retention", adminHandler.UpdateFailedRetention)
+	admin.Delete("/settings/failed-retention", adminHandler.DeleteFailedRetention)
+
+	// The dashboard, when this server is to serve it; after every route so
+	// none is shadowed
+	if cfg.FrontendDir != "" {
+		app.Use(handlers.NewFrontendHandler(cfg.FrontendDir).Serve)
+	}
+
+	return &App{App: app, Torrents: torrentHandler, APIUsage: apiUsage, Redirects: redirects}
+}
+
+// readinessCheck answers whether the server can do its work: the database
+// answers, the torrent engine runs and takes new torrents, and the download
+// directory takes writes, which a read-only remount stops. Any failure
+// answers 503 with every check's result.
+func readinessCheck(db *database.Database, engine torrent.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		checks := fiber.Map{}
+		ready := true
+		record := func(name string, err error) {
+			if err != nil {
+				checks[name] = err.Error()
+				ready = false
+			} else {
+				checks[name] = "ok"
+			}
+		}
+
+		ctx, cancel := database.WithTimeout(c.UserContext())
+		record("database", db.Ping(ctx))
+		cancel()
+		if engine.Available() {
+			record("engine", nil)
+		} else {
+			record("engine", torrent.ErrEngineUnavailable)
+		}
+		if diskErr := engine.DiskError(); diskErr != nil {
+			record("disk_error", fmt.Errorf("%v at %s: %s", torrent.ErrDiskWrite, diskErr.At.Format(time.RFC3339), diskErr.Error))
+		} else {
+			record("disk_error", nil)
+		}
+		record("download_dir", engine.ProbeDownloadDir())
+
+		status := fiber.StatusOK
+		if !ready {
+			status = fiber.StatusServiceUnavailable
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"ready":  ready,
+			"checks": checks,
+		})
+	}
+}
+
+// skipCompression excludes file downloads, file previews and SSE streams
+// from compression. Downloads are usually already-compressed media and must
+// keep their Content-Length, file previews stream ranges of the file, and
+// compressing SSE would buffer frames instead of flushing them.
+func skipCompression(c *fiber.Ctx) bool {
+	path := c.Path()
+	id, preview := strings.CutSuffix(strings.TrimPrefix(path, "/api/v1/torrents/"), "/preview")
+	return middleware.IsDownloadPath(path) ||
+		(strings.HasPrefix(path, "/api/v1/collections/") && strings.HasSuffix(path, "/download")) ||
+		(strings.HasPrefix(path, "/api/v1/torrents/") && preview && id != "" && !strings.Contains(id, "/")) ||
+		path == "/api/v1/events" ||
+		path == "/api/v1/admin/events"
+}
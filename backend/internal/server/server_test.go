@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+func TestSkipCompression(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/v1/download/abc123", true},
+		{"/api/v1/dl/abc123", true},
+		{"/api/v1/collections/7d3c/download", true},
+		{"/api/v1/torrents/7d3c/preview", true},
+		{"/api/v1/events", true},
+		{"/api/v1/admin/events", true},
+
+		{"/api/v1/torrents", false},
+		{"/api/v1/torrents/preview", false},
+		{"/api/v1/torrents/7d3c/download", false},
+		{"/api/v1/torrents/7d3c/files/preview", false},
+		{"/api/v1/collections/7d3c", false},
+		{"/api/v1/events/ticket", false},
+		{"/api/v1/downloads", false},
+		{"/health", false},
+	}
+	app := fiber.New()
+	for _, tt := range tests {
+		var fctx fasthttp.RequestCtx
+		fctx.Request.SetRequestURI(tt.path)
+		c := app.AcquireCtx(&fctx)
+		if got := skipCompression(c); got != tt.want {
+			t.Errorf("skipCompression(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+		app.ReleaseCtx(c)
+	}
+}
+
+// compressionServer serves compressible text on download, preview and API
+// paths, and an SSE stream that sends one frame and then waits for release,
+// behind the compression middleware
+func compressionServer(t *testing.T, release chan struct{}) string {
+	t.Helper()
+	app := fiber.New()
+	app.Use(middleware.NewCompression(skipCompression).Handler())
+
+	text := func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+		return c.SendString(strings.Repeat("compressible text ", 1000))
+	}
+	app.Get("/api/v1/download/:token", text)
+	app.Get("/api/v1/torrents/:id/preview", text)
+	app.Get("/api/v1/torrents", text)
+	app.Get("/api/v1/events", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			w.WriteString("event: ping\ndata: {}\n\n")
+			w.Flush()
+			<-release
+		})
+		return nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	return "http://" + ln.Addr().String()
+}
+
+// TestCompressionThroughApp sends Accept-Encoding through the app: downloads
+// and previews come back as they are, and SSE frames arrive as they are sent
+func TestCompressionThroughApp(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	base := compressionServer(t, release)
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip, br, zstd")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, path := range []string{"/api/v1/download/abc123", "/api/v1/torrents/7d3c/preview"} {
+		resp := get(path)
+		resp.Body.Close()
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s: Content-Encoding %q, want none", path, enc)
+		}
+	}
+	// The same body elsewhere is compressed, so the skip is what kept it out
+	resp := get("/api/v1/torrents")
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") == "" {
+		t.Error("API response not compressed")
+	}
+
+	resp = get("/api/v1/events")
+	defer resp.Body.Close()
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("events: Content-Encoding %q, want none", enc)
+	}
+	frame := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		frame <- line
+	}()
+	select {
+	case line := <-frame:
+		if line != "event: ping\n" {
+			t.Errorf("first SSE line = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SSE frame held back while the stream stays open")
+	}
+}
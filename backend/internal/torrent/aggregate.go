@@ -0,0 +1,65 @@
+package torrent
+
+import "github.com/google/uuid"
+
+// UserAggregate sums a user's live transfers in the engine. A torrent
+// shared by several users counts for each of them.
+type UserAggregate struct {
+	ActiveTorrents int     `json:"active_torrents"` // not yet complete
+	DownloadSpeed  float64 `json:"download_speed"`  // bytes per second
+	UploadSpeed    float64 `json:"upload_speed"`
+	RemainingBytes int64   `json:"remaining_bytes"` // of the wanted files of torrents with metadata
+}
+
+// GetUserAggregate returns the user's live transfer totals. Every user's
+// totals are computed in one pass over the torrents and kept until the
+// update loop's next pass, so callers within a tick don't scan again, and a
+// stuck client is never asked.
+func (e *Engine) GetUserAggregate(userID uuid.UUID) UserAggregate {
+	if !e.available.Load() {
+		return UserAggregate{}
+	}
+
+	tick := e.lastTick.Load()
+	e.aggMu.Lock()
+	defer e.aggMu.Unlock()
+	if e.aggregates == nil || e.aggregatesAt != tick {
+		e.aggregates = e.buildAggregates()
+		e.aggregatesAt = tick
+	}
+	return e.aggregates[userID]
+}
+
+// buildAggregates sums every user's torrents
+func (e *Engine) buildAggregates() map[uuid.UUID]UserAggregate {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	aggregates := make(map[uuid.UUID]UserAggregate)
+	for _, mt := range e.torrents {
+		var remaining int64
+		complete := mt.reloadedComplete
+		if mt.Torrent.Info() != nil {
+			remaining = max(mt.WantedLength()-mt.WantedCompleted(), 0)
+			complete = remaining == 0
+		}
+
+		counted := make(map[uuid.UUID]bool, len(mt.owners))
+		for _, userID := range mt.owners {
+			if counted[userID] {
+				continue
+			}
+			counted[userID] = true
+
+			a := aggregates[userID]
+			a.DownloadSpeed += mt.downloadSpeed
+			a.UploadSpeed += mt.uploadSpeed
+			if !complete {
+				a.ActiveTorrents++
+				a.RemainingBytes += remaining
+			}
+			aggregates[userID] = a
+		}
+	}
+	return aggregates
+}
@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+)
+
+// minEstablishedConns is the fewest connections a torrent is cut to when
+// the connection budget is shared between many
+const minEstablishedConns = 5
+
+// fileHeadroom is the open files the server keeps for itself beside peer
+// connections: half-open dials, the database pool, clients and torrent data
+const fileHeadroom = 1024
+
+// errFileLimitUnsupported is returned by raiseFileLimit where the open file
+// limit can't be read
+var errFileLimitUnsupported = errors.New("open file limit can't be read on this platform")
+
+// ConnStats describes how peer connections are shared, for admins
+type ConnStats struct {
+	Budget      int    `json:"budget"`      // 0: unbounded
+	PerTorrent  int    `json:"per_torrent"` // limit of a torrent not being streamed
+	Torrents    int    `json:"torrents"`    // torrents allowed connections
+	Streaming   int    `json:"streaming"`   // of those, being streamed
+	Established int    `json:"established"` // connections open at the last pass
+	FileLimit   uint64 `json:"file_limit,omitempty"`
+}
+
+// connShare is the limit of each torrent not being streamed when active
+// torrents share the budget and streaming of them take maxEstablishedConns
+// first
+func connShare(budget, active, streaming int) int {
+	others := active - streaming
+	if budget <= 0 || others <= 0 {
+		return maxEstablishedConns
+	}
+	share := (budget - streaming*maxEstablishedConns) / others
+	return min(max(share, minEstablishedConns), maxEstablishedConns)
+}
+
+// connLimitLocked is the connection limit mt should have: none while paused
+// or waiting for a metadata slot, all it may have while streamed, otherwise
+// its share. The caller must hold e.mu.
+func (e *Engine) connLimitLocked(mt *ManagedTorrent) int {
+	switch {
+	case mt.paused || mt.metadataQueued:
+		return 0
+	case mt.streams > 0:
+		return maxEstablishedConns
+	}
+	return e.connShare
+}
+
+// applyConnLimitLocked sets mt's connection limit when it changed. The
+// caller must hold e.mu for writing.
+func (e *Engine) applyConnLimitLocked(mt *ManagedTorrent) {
+	limit := e.connLimitLocked(mt)
+	if limit != mt.connLimit {
+		mt.Torrent.SetMaxEstablishedConns(limit)
+		mt.connLimit = limit
+	}
+}
+
+// balanceConns shares the connection budget between the torrents allowed
+// connections, once per update loop pass, and records the totals
+func (e *Engine) balanceConns() {
+	e.mu.Lock()
+	var active, streaming int
+	for _, mt := range e.torrents {
+		if mt.paused || mt.metadataQueued {
+			continue
+		}
+		active++
+		if mt.streams > 0 {
+			streaming++
+		}
+	}
+	e.connShare = connShare(e.cfg.ConnBudget, active, streaming)
+	managed := make([]*ManagedTorrent, 0, len(e.torrents))
+	for _, mt := range e.torrents {
+		e.applyConnLimitLocked(mt)
+		managed = append(managed, mt)
+	}
+	stats := ConnStats{
+		Budget:     max(e.cfg.ConnBudget, 0),
+		PerTorrent: e.connShare,
+		Torrents:   active,
+		Streaming:  streaming,
+		FileLimit:  e.fileLimit,
+	}
+	e.mu.Unlock()
+
+	for _, mt := range managed {
+		stats.Established += mt.Torrent.Stats().ActivePeers
+	}
+	e.healthMu.Lock()
+	e.health.Connections = stats
+	e.healthMu.Unlock()
+}
+
+// trackStream counts a reader streaming from mt, which keeps all its
+// connections until the returned release is called
+func (e *Engine) trackStream(mt *ManagedTorrent) (release func()) {
+	e.mu.Lock()
+	mt.streams++
+	e.applyConnLimitLocked(mt)
+	e.mu.Unlock()
+
+	return func() {
+		e.mu.Lock()
+		mt.streams--
+		e.applyConnLimitLocked(mt)
+		e.mu.Unlock()
+	}
+}
+
+// checkFileLimit raises the open file limit as far as allowed and warns
+// when it can't hold the connection budget, which ends in "too many open
+// files" once the torrents fill it
+func checkFileLimit(budget int) uint64 {
+	limit, err := raiseFileLimit()
+	if err != nil {
+		if !errors.Is(err, errFileLimitUnsupported) {
+			log.Printf("Warning: failed to read the open file limit: %v", err)
+		}
+		return 0
+	}
+	if budget <= 0 {
+		log.Printf("Warning: TORRENT_CONN_BUDGET is 0; peer connections are bounded only by the open file limit of %d", limit)
+	} else if uint64(budget)+fileHeadroom > limit {
+		log.Printf("Warning: TORRENT_CONN_BUDGET %d plus %d for the server's own files exceeds the open file limit of %d; raise the limit or lower the budget",
+			budget, fileHeadroom, limit)
+	}
+	return limit
+}
@@ -0,0 +1,189 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// Piece sizes a created torrent may use
+const (
+	MinPieceLength = 16 << 10
+	MaxPieceLength = 16 << 20
+)
+
+// createdBy is written into the metainfo of created torrents
+const createdBy = "CT-SaaS"
+
+// ErrContentActive is returned when creating a torrent whose info hash the
+// engine already has, e.g. the same files created twice
+var ErrContentActive = errors.New("a torrent of this content is already active")
+
+// CreateOptions shape a torrent created from a user's own files
+type CreateOptions struct {
+	PieceLength int64    // a power of two; 0 chooses one by size
+	Trackers    []string // announce URLs, a tier each; nil for CREATE_TRACKERS
+	Comment     string
+}
+
+// CreatedTorrent is a torrent CreateTorrent made and is seeding
+type CreatedTorrent struct {
+	InfoHash  string
+	Name      string
+	TotalSize int64
+	Magnet    string
+	Metainfo  []byte // the .torrent file
+	Metadata  *models.TorrentMetadata
+}
+
+// CreateTorrent hashes the file or directory at root into a new torrent
+// named after it, moves it into place as that torrent's data and seeds it.
+// root must be on the download directory's filesystem. The data is hashed
+// once here to build the metainfo and again by the client in the
+// background, during which the torrent reports "checking".
+func (e *Engine) CreateTorrent(id, userID uuid.UUID, root string, opts CreateOptions) (*CreatedTorrent, error) {
+	info := metainfo.Info{PieceLength: opts.PieceLength}
+	if err := info.BuildFromFilePath(root); err != nil {
+		return nil, fmt.Errorf("failed to hash files: %w", err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode info: %w", err)
+	}
+
+	mi := &metainfo.MetaInfo{
+		InfoBytes:    infoBytes,
+		CreatedBy:    createdBy,
+		CreationDate: time.Now().Unix(),
+		Comment:      opts.Comment,
+	}
+	trackers := opts.Trackers
+	if trackers == nil {
+		trackers = e.cfg.CreateTrackers
+	}
+	if len(trackers) > 0 {
+		mi.Announce = trackers[0]
+		for _, tr := range trackers {
+			mi.AnnounceList = append(mi.AnnounceList, []string{tr})
+		}
+	}
+	var file bytes.Buffer
+	if err := mi.Write(&file); err != nil {
+		return nil, fmt.Errorf("failed to encode metainfo: %w", err)
+	}
+	infoHash := mi.HashInfoBytes().HexString()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.torrents[infoHash]; ok {
+		return nil, ErrContentActive
+	}
+	if e.client == nil {
+		return nil, ErrEngineUnavailable
+	}
+
+	// Anything already at the destination was left by a torrent the engine
+	// no longer has
+	dir := DataDir(e.cfg.DownloadDir, infoHash)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear data directory: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.Rename(root, filepath.Join(dir, info.Name)); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to move files into place: %w", err)
+	}
+
+	t, err := e.client.AddTorrent(mi)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to add torrent: %w", err)
+	}
+	mt := newManagedTorrent(id, userID, t)
+	mt.seedOwn = true
+	mt.metadata = newTorrentMetadata(&info, infoBytes, mi)
+	e.registerLocked(infoHash, mt)
+
+	t.AllowDataUpload()
+	t.DownloadAll()
+	go func() {
+		t.VerifyData()
+		e.sendUpdate(infoHash)
+	}()
+
+	return &CreatedTorrent{
+		InfoHash:  infoHash,
+		Name:      info.Name,
+		TotalSize: info.TotalLength(),
+		Magnet:    mi.Magnet(nil, &info).String(),
+		Metainfo:  file.Bytes(),
+		Metadata:  mt.metadata,
+	}, nil
+}
+
+// ReloadCreated seeds a created torrent again after a restart, from its
+// stored metainfo. Its data is already in place and known to be complete,
+// so nothing is hashed again.
+func (e *Engine) ReloadCreated(id, userID uuid.UUID, data []byte) error {
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse torrent file: %w", err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return fmt.Errorf("failed to parse torrent file: %w", err)
+	}
+	infoHash := mi.HashInfoBytes().HexString()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if mt, ok := e.torrents[infoHash]; ok {
+		mt.owners[id] = userID
+		e.updatePausedLocked(mt)
+		return nil
+	}
+	if e.client == nil {
+		return ErrEngineUnavailable
+	}
+
+	t, err := e.client.AddTorrent(mi)
+	if err != nil {
+		return fmt.Errorf("failed to add torrent: %w", err)
+	}
+	mt := newManagedTorrent(id, userID, t)
+	mt.seedOwn = true
+	mt.metadata = newTorrentMetadata(&info, mi.InfoBytes, mi)
+	e.registerLocked(infoHash, mt)
+
+	t.AllowDataUpload()
+	t.DownloadAll()
+	return nil
+}
+
+// MetainfoFile returns the .torrent file of a torrent the engine has the
+// metadata of
+func (e *Engine) MetainfoFile(infoHash string) ([]byte, bool) {
+	e.mu.RLock()
+	mt, ok := e.torrents[infoHash]
+	e.mu.RUnlock()
+	if !ok || mt.Torrent.Info() == nil {
+		return nil, false
+	}
+
+	mi := mt.Torrent.Metainfo()
+	var file bytes.Buffer
+	if err := mi.Write(&file); err != nil {
+		return nil, false
+	}
+	return file.Bytes(), true
+}
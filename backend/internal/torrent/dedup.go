@@ -0,0 +1,77 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+// HashFiles returns the SHA-256 of each of a torrent's files on disk, by
+// path. It stops between files once ctx is cancelled.
+func HashFiles(ctx context.Context, downloadDir, infoHash string, files []models.TorrentFile) (map[string]string, error) {
+	dir := DataDir(downloadDir, infoHash)
+	hashes := make(map[string]string, len(files))
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		sum, err := hashFile(filepath.Join(dir, f.Path))
+		if err != nil {
+			return nil, err
+		}
+		hashes[f.Path] = sum
+	}
+	return hashes, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// LinkFiles replaces files of the torrent dstHash with hard links to the
+// identical files of srcHash, links mapping each destination path to its
+// source path, so the data is stored once. Removing either torrent's
+// directory later only drops its links; the data stays while the other has
+// them. Files already linked are left alone.
+func LinkFiles(downloadDir, srcHash, dstHash string, links map[string]string) error {
+	srcDir, dstDir := DataDir(downloadDir, srcHash), DataDir(downloadDir, dstHash)
+	for dstPath, srcPath := range links {
+		src, dst := filepath.Join(srcDir, srcPath), filepath.Join(dstDir, dstPath)
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+			continue
+		}
+
+		// Linked beside the copy and renamed over it, so the file is never
+		// missing
+		tmp := dst + ".dedup"
+		os.Remove(tmp)
+		if err := os.Link(src, tmp); err != nil {
+			return fmt.Errorf("failed to link %s: %w", dstPath, err)
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to replace %s: %w", dstPath, err)
+		}
+	}
+	return nil
+}
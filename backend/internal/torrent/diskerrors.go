@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+// Chunk write failures: the client retries a failed write, so while they
+// keep failing the torrent's directory is probed at most every
+// writeProbeInterval. A failed probe, or failures going on for
+// diskErrorGrace even though probes pass (a full disk can take a small
+// probe file), fail the torrent. Failures further apart than
+// writeErrorGap are separate incidents.
+const (
+	writeProbeInterval = 5 * time.Second
+	diskErrorGrace     = time.Minute
+	writeErrorGap      = 30 * time.Second
+)
+
+// ErrDiskWrite is what torrents fail with once storage stops taking their
+// data. New torrents are refused until an admin clears the engine's
+// DiskError.
+var ErrDiskWrite = errors.New("disk write error")
+
+// DiskError is the storage failure that stopped the engine taking new
+// torrents
+type DiskError struct {
+	InfoHash string    `json:"info_hash"`
+	Error    string    `json:"error"`
+	At       time.Time `json:"at"`
+}
+
+// registerLocked adds mt to the engine under infoHash and watches its
+// storage writes. The caller must hold e.mu for writing.
+func (e *Engine) registerLocked(infoHash string, mt *ManagedTorrent) {
+	e.torrents[infoHash] = mt
+	t := mt.Torrent
+	// Without a handler the client silently stops downloading the torrent
+	t.SetOnWriteChunkError(func(err error) {
+		e.onWriteError(infoHash, t, err)
+	})
+}
+
+// onWriteError handles a chunk of t that failed to write to disk. The
+// client calls it on its own goroutine.
+func (e *Engine) onWriteError(infoHash string, t *torrent.Torrent, writeErr error) {
+	now := time.Now()
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok || mt.Torrent != t || mt.writeFailed {
+		e.mu.Unlock()
+		return
+	}
+	if now.Sub(mt.lastWriteError) > writeErrorGap {
+		mt.writeErrorsSince = now
+	}
+	mt.lastWriteError = now
+	since := mt.writeErrorsSince
+	if now.Sub(mt.lastWriteProbe) < writeProbeInterval && now.Sub(since) < diskErrorGrace {
+		e.mu.Unlock()
+		return
+	}
+	mt.lastWriteProbe = now
+	e.mu.Unlock()
+
+	probeErr := probeWrite(e.TorrentDir(infoHash))
+	if probeErr == nil && now.Sub(since) < diskErrorGrace {
+		log.Printf("Torrent %s: chunk write failed, retrying: %v", infoHash, writeErr)
+		return
+	}
+	e.failWrites(infoHash, t, writeErr)
+}
+
+// failWrites stops a torrent whose data can't be written, fails it for
+// every owner and stops the engine taking new torrents
+func (e *Engine) failWrites(infoHash string, t *torrent.Torrent, writeErr error) {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok || mt.Torrent != t || mt.writeFailed {
+		e.mu.Unlock()
+		return
+	}
+	mt.writeFailed = true
+	ids := mt.ownerIDs()
+	e.mu.Unlock()
+
+	t.DisallowDataDownload()
+	e.diskError.Store(&DiskError{InfoHash: infoHash, Error: writeErr.Error(), At: time.Now()})
+	log.Printf("Torrent %s: %v, failing it; new torrents are refused until an admin clears the disk error: %v",
+		infoHash, ErrDiskWrite, writeErr)
+
+	for _, id := range ids {
+		e.updateCh <- TorrentUpdate{
+			ID:           id,
+			InfoHash:     infoHash,
+			Status:       models.TorrentStatusFailed,
+			Error:        fmt.Sprintf("%v: %v", ErrDiskWrite, writeErr),
+			DiskError:    true,
+			ClosedReason: models.ClosedFailedDisk,
+		}
+	}
+}
+
+// probeWrite checks a file can be created, written and removed in dir
+func probeWrite(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("probe"))
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// ProbeDownloadDir checks the download directory still takes writes, as a
+// read-only remount would stop it
+func (e *Engine) ProbeDownloadDir() error {
+	return probeWrite(e.cfg.DownloadDir)
+}
+
+// DiskError returns the storage failure that stopped the engine taking new
+// torrents, or nil
+func (e *Engine) DiskError() *DiskError {
+	return e.diskError.Load()
+}
+
+// ClearDiskError lets the engine take new torrents again once an admin has
+// fixed the storage, and returns the error cleared, if any. Torrents that
+// failed stay failed until retried.
+func (e *Engine) ClearDiskError() *DiskError {
+	return e.diskError.Swap(nil)
+}
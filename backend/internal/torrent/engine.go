@@ -1,30 +1,119 @@
 package torrent
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/types"
 	"github.com/freetorrent/freetorrent/internal/config"
 	"github.com/freetorrent/freetorrent/internal/models"
 	"github.com/google/uuid"
 )
 
-// Engine manages the torrent client and downloads
+// metadataTimeout is how long a magnet link may take to resolve its metadata
+// once it has a fetch slot
+const metadataTimeout = 5 * time.Minute
+
+// HealthNoSeeders is the health warning of a torrent whose swarm showed no
+// seeders, and next to no peers, for the probe period after its metadata
+// arrived. Such torrents usually sit at 0% for good.
+const HealthNoSeeders = "no_seeders"
+
+// Swarm probe tuning: how often the swarm is looked at, and the most peers a
+// swarm may have while still counting as dead
+const (
+	swarmProbeInterval = 5 * time.Second
+	deadSwarmPeers     = 1
+)
+
+// maxEstablishedConns is the most connections one torrent may have. The
+// connection budget shares out less as torrents are added, and paused and
+// queued torrents have none; see conns.go.
+const maxEstablishedConns = 50
+
+// pieceWaitTimeout bounds how long a file reader waits for a missing piece
+// to download before failing the read with ErrPieceTimeout
+const pieceWaitTimeout = 60 * time.Second
+
+// ErrPieceTimeout is returned by file readers when the data asked for hasn't
+// downloaded within pieceWaitTimeout
+var ErrPieceTimeout = errors.New("timed out waiting for piece to download")
+
+// Engine manages the torrent client and downloads. The client, the
+// torrents, the settings and the metadata slots belong to one run of the
+// client and are replaced by Restart, so they are only touched under mu.
 type Engine struct {
-	client    *torrent.Client
+	client    *torrent.Client // nil while unavailable
 	cfg       *config.Config
 	torrents  map[string]*ManagedTorrent // keyed by info hash
 	mu        sync.RWMutex
 	updateCh  chan TorrentUpdate
-	closeCh   chan struct{}
+
+	settings EngineSettings
+
+	// metadataSlots bounds how many magnets fetch metadata at once. A magnet
+	// that can't take a slot is added with no connections allowed and waits.
+	metadataSlots chan struct{}
+
+	// Health, read without mu so a client stuck holding it can be detected
+	// and replaced; see health.go
+	available atomic.Bool
+	loopGen   atomic.Int64 // generation of the update loop that should run
+	lastTick  atomic.Int64 // unix nanos the update loop last finished a pass
+	health    EngineHealth
+	healthMu  sync.Mutex
+
+	// previews holds magnet previews being fetched or cached, keyed by info
+	// hash; see PreviewMagnet
+	previews  map[string]*previewCall
+	previewMu sync.Mutex
+
+	// aggregates caches every user's UserAggregate for the update loop pass
+	// that finished at aggregatesAt; see GetUserAggregate
+	aggregates   map[uuid.UUID]UserAggregate
+	aggregatesAt int64
+	aggMu        sync.Mutex
+
+	// connShare is the connection limit of torrents not being streamed, as
+	// last set by balanceConns; fileLimit is the open file limit found at
+	// startup. Guarded by mu.
+	connShare int
+	fileLimit uint64
+
+	// diskError is set once a torrent's data failed to write; new torrents
+	// are refused until it is cleared, see diskerrors.go
+	diskError atomic.Pointer[DiskError]
+
+	// portCheck is the last CheckPortReachability result
+	portCheck *PortCheck
+	portMu    sync.Mutex
+
+	// refreshing and scraping are set while a refreshTrackers or
+	// scrapeTrackers pass runs
+	refreshing atomic.Bool
+	scraping   atomic.Bool
+
+	// ctx lives as long as the engine; background waiters select on it
+	// rather than on the context of the request that started them
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // ManagedTorrent wraps a torrent with metadata
@@ -33,71 +122,488 @@ type ManagedTorrent struct {
 	UserID     uuid.UUID
 	Torrent    *torrent.Torrent
 	AddedAt    time.Time
-	lastUpdate time.Time
+
+	// Transfer sampling, advanced only by sendUpdate so that reading a
+	// torrent's status doesn't skew its speeds. pendingUpload holds data
+	// bytes uploaded but not yet delivered in an update. Guarded by Engine.mu.
+	lastSample    time.Time
+	lastRead      int64
+	lastWritten   int64
+	downloadSpeed float64
+	uploadSpeed   float64
+	pendingUpload int64
+
+	// reloadedComplete marks a torrent the database already knows is
+	// completed, re-added after a restart. Until its metadata resolves and
+	// the on-disk data can be checked, it is reported as completed rather
+	// than as pending.
+	reloadedComplete bool
+
+	// owners maps every database torrent ID sharing this engine torrent to
+	// the user that added it. ID/UserID always name one of the owners.
+	// Guarded by Engine.mu.
+	owners map[uuid.UUID]uuid.UUID
+
+	// private is the metainfo private flag. A private torrent's announce
+	// URLs carry the adding user's passkey, so it is never shared between
+	// users. seedRatio is the upload ratio it seeds to (zero: no upload);
+	// ratioReached is set once it gets there. Guarded by Engine.mu.
+	private      bool
+	seedRatio    float64
+	ratioReached bool
+
+	// seedOwn marks a torrent created from its owner's own files, which
+	// always uploads, whatever it is; see CreateTorrent. Set before the
+	// torrent is registered and never changed.
+	seedOwn bool
+
+	// metadata is filled from the metainfo once known; metadataReported is
+	// set once an update carrying it has been delivered. Guarded by Engine.mu.
+	metadata         *models.TorrentMetadata
+	metadataReported bool
+
+	// metadataQueued marks a magnet waiting for a metadata fetch slot. It
+	// has no connections until it gets one. Guarded by Engine.mu.
+	metadataQueued bool
+
+	// pausedBy holds the owners that paused the torrent; their rows are
+	// reported as paused until they resume. paused is set once every owner
+	// has, and the torrent then keeps no connections. Guarded by Engine.mu.
+	pausedBy map[uuid.UUID]bool
+	paused   bool
+
+	// pauseAt holds, per owner that resumed on what was left of their
+	// bandwidth, the downloaded bytes at which their row is to be paused
+	// again. Each owner's updates carry their own; the update processor
+	// pauses that owner alone. Guarded by Engine.mu.
+	pauseAt map[uuid.UUID]int64
+
+	// connLimit is the connection limit last set on the torrent; streams
+	// counts readers streaming from it, see trackStream. Guarded by
+	// Engine.mu.
+	connLimit int
+	streams   int
+
+	// Chunk write failures, see onWriteError: writeFailed is set once they
+	// failed the torrent, which then sends no more updates. Guarded by
+	// Engine.mu.
+	writeErrorsSince time.Time
+	lastWriteError   time.Time
+	lastWriteProbe   time.Time
+	writeFailed      bool
+
+	// healthWarning is set by probeSwarm, cleared once a seeder shows up, or
+	// by refreshTrackers while every tracker fails; healthReported is set
+	// once an update carrying its latest value has been delivered to every
+	// owner. Guarded by Engine.mu.
+	healthWarning  string
+	healthReported bool
+
+	// trackers is the torrent's trackers as of the last refreshTrackers,
+	// with the counts of the last scrape. Guarded by Engine.mu.
+	trackers []TrackerStatus
+}
+
+// WantedLength is the size of the files the torrent downloads, leaving out
+// skipped ones (priority none). Its metadata must be known.
+func (mt *ManagedTorrent) WantedLength() int64 {
+	var n int64
+	skipped := false
+	for _, f := range mt.Torrent.Files() {
+		if f.Priority() == types.PiecePriorityNone {
+			skipped = true
+			continue
+		}
+		n += f.Length()
+	}
+	if !skipped {
+		return mt.Torrent.Length()
+	}
+	return n
+}
+
+// WantedCompleted is how much of the files the torrent downloads is done.
+// The torrent is complete once it reaches WantedLength, whether or not
+// skipped files are on disk. Its metadata must be known.
+func (mt *ManagedTorrent) WantedCompleted() int64 {
+	var n int64
+	skipped := false
+	for _, f := range mt.Torrent.Files() {
+		if f.Priority() == types.PiecePriorityNone {
+			skipped = true
+			continue
+		}
+		n += f.BytesCompleted()
+	}
+	if !skipped {
+		return mt.Torrent.BytesCompleted()
+	}
+	return n
+}
+
+// filePriority maps a file's piece priority onto the models.TorrentFile
+// scale, which has no readahead levels
+func filePriority(f *torrent.File) int {
+	switch f.Priority() {
+	case types.PiecePriorityNone:
+		return 0
+	case types.PiecePriorityNormal:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// newManagedTorrent wraps t for the engine. Torrents start download-only;
+// applyUploadPolicy opens uploads for private torrents that seed.
+func newManagedTorrent(id, userID uuid.UUID, t *torrent.Torrent) *ManagedTorrent {
+	t.DisallowDataUpload()
+	return &ManagedTorrent{
+		ID:      id,
+		UserID:  userID,
+		Torrent: t,
+		AddedAt: time.Now(),
+		owners:   map[uuid.UUID]uuid.UUID{id: userID},
+		pausedBy: make(map[uuid.UUID]bool),
+		pauseAt:  make(map[uuid.UUID]int64),
+
+		connLimit: maxEstablishedConns, // the client's EstablishedConnsPerTorrent
+	}
+}
+
+// torrentIDFor returns the database torrent ID the user owns for this torrent
+func (mt *ManagedTorrent) torrentIDFor(userID uuid.UUID) (uuid.UUID, bool) {
+	for id, uid := range mt.owners {
+		if uid == userID {
+			return id, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// setPausedLocked records whether owner id has the torrent paused, and
+// pauses the torrent itself only while every owner has. The caller must
+// hold e.mu.
+func (e *Engine) setPausedLocked(mt *ManagedTorrent, id uuid.UUID, paused bool) {
+	if paused {
+		mt.pausedBy[id] = true
+	} else {
+		delete(mt.pausedBy, id)
+	}
+	e.updatePausedLocked(mt)
+}
+
+// updatePausedLocked pauses or resumes the torrent as its owners have it,
+// after owners were added, removed, paused or resumed. The caller must hold
+// e.mu.
+func (e *Engine) updatePausedLocked(mt *ManagedTorrent) {
+	paused := len(mt.owners) > 0
+	for id := range mt.owners {
+		if !mt.pausedBy[id] {
+			paused = false
+			break
+		}
+	}
+	for id := range mt.pausedBy {
+		if _, ok := mt.owners[id]; !ok {
+			delete(mt.pausedBy, id)
+		}
+	}
+	for id := range mt.pauseAt {
+		if _, ok := mt.owners[id]; !ok {
+			delete(mt.pauseAt, id)
+		}
+	}
+	if paused == mt.paused {
+		return
+	}
+	mt.paused = paused
+	e.applyConnLimitLocked(mt)
+}
+
+// forOwner returns u as owner id's row sees it, with that owner's pause
+// budget, and paused while that owner has the torrent paused and it isn't
+// complete. The caller must hold e.mu.
+func (mt *ManagedTorrent) forOwner(u TorrentUpdate, id uuid.UUID) TorrentUpdate {
+	u.ID = id
+	u.PauseAt = mt.pauseAt[id]
+	if mt.pausedBy[id] && !u.Status.IsComplete() && u.Status != models.TorrentStatusChecking {
+		u.Status = models.TorrentStatusPaused
+		u.DownloadSpeed, u.UploadSpeed = 0, 0
+	}
+	return u
+}
+
+// ownerIDs returns a snapshot of the owning torrent IDs. The caller must hold Engine.mu.
+func (mt *ManagedTorrent) ownerIDs() []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(mt.owners))
+	for id := range mt.owners {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
+// isPrivate reports the metainfo private flag of a torrent with info
+func isPrivate(info *metainfo.Info) bool {
+	return info != nil && info.Private != nil && *info.Private
+}
+
+// ErrPrivateTorrentInUse is returned when a user adds a private torrent that
+// another user already has active
+var ErrPrivateTorrentInUse = errors.New("private torrent is already active for another user")
+
+// ErrV2NotSupported is returned for BitTorrent v2-only torrents, which the
+// client can't download reliably. Hybrid torrents are added as v1.
+var ErrV2NotSupported = errors.New("BitTorrent v2-only torrents are not supported")
+
+// metaVersion classifies an info dictionary as "v1", "v2" or "hybrid" (BEP 52)
+func metaVersion(infoBytes []byte) string {
+	var probe struct {
+		MetaVersion int64  `bencode:"meta version"`
+		Pieces      []byte `bencode:"pieces"`
+	}
+	if bencode.Unmarshal(infoBytes, &probe) != nil || probe.MetaVersion != 2 {
+		return "v1"
+	}
+	if len(probe.Pieces) > 0 {
+		return "hybrid"
+	}
+	return "v2"
+}
+
+// isV2OnlyMagnet reports whether a magnet link carries only a v2 (btmh) info hash
+func isV2OnlyMagnet(magnetURI string) bool {
+	u, err := url.Parse(magnetURI)
+	if err != nil {
+		return false
+	}
+	v2 := false
+	for _, xt := range u.Query()["xt"] {
+		if strings.HasPrefix(xt, "urn:btih:") {
+			return false
+		}
+		if strings.HasPrefix(xt, "urn:btmh:") {
+			v2 = true
+		}
+	}
+	return v2
+}
+
+// MagnetInfoHash returns the info hash a magnet link would be added under
+func MagnetInfoHash(magnetURI string) (string, error) {
+	m, err := metainfo.ParseMagnetUri(magnetURI)
+	if err != nil {
+		return "", fmt.Errorf("invalid magnet URI: %w", err)
+	}
+	return m.InfoHash.HexString(), nil
+}
+
+// InspectTorrentFile returns the info hash a .torrent file would be added
+// under and the total size of its files
+func InspectTorrentFile(data []byte) (infoHash string, totalSize int64, err error) {
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse torrent: %w", err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse torrent info: %w", err)
+	}
+	return mi.HashInfoBytes().HexString(), info.TotalLength(), nil
+}
+
+// newTorrentMetadata describes a torrent from its info dictionary and, when
+// added from a file, the surrounding metainfo. The client's own Metainfo()
+// invents creation fields, so it is never used for them.
+func newTorrentMetadata(info *metainfo.Info, infoBytes []byte, mi *metainfo.MetaInfo) *models.TorrentMetadata {
+	md := &models.TorrentMetadata{
+		InternalName: info.Name,
+		PieceLength:  info.PieceLength,
+		PieceCount:   info.NumPieces(),
+		Version:      metaVersion(infoBytes),
+	}
+	if mi != nil {
+		md.CreatedBy = mi.CreatedBy
+		md.Comment = mi.Comment
+		if mi.CreationDate > 0 {
+			created := time.Unix(mi.CreationDate, 0).UTC()
+			md.CreationDate = &created
+		}
+	}
+	return md
+}
+
+// StatusExists is the status of an add for a torrent the user already has.
+// It is never stored; the update carries the existing torrent's ID.
+const StatusExists models.TorrentStatus = "exists"
+
 // TorrentUpdate represents a status update for a torrent
 type TorrentUpdate struct {
-	ID             uuid.UUID
-	InfoHash       string
-	Status         string
-	Progress       float64
-	Downloaded     int64
-	Uploaded       int64
-	DownloadSpeed  float64
-	UploadSpeed    float64
-	Peers          int
-	Seeds          int
-	Name           string
-	TotalSize      int64
-	Files          []models.TorrentFile
-	Error          string
-}
-
-// NewEngine creates a new torrent engine
-func NewEngine(cfg *config.Config) (*Engine, error) {
+	ID            uuid.UUID
+	InfoHash      string
+	IsPrivate     bool
+	Metadata      *models.TorrentMetadata // set until an update carrying it is delivered
+	Status        models.TorrentStatus
+	Progress      float64
+	Downloaded    int64
+	Uploaded      int64 // data bytes uploaded this session
+	UploadedDelta int64 // data bytes uploaded since the previous update
+	DownloadSpeed float64
+	UploadSpeed   float64
+	Peers         int
+	Seeds         int
+	Name          string
+	TotalSize     int64
+	WantedSize    int64 // TotalSize less skipped files; what Progress is of
+	Files         []models.TorrentFile
+	Error         string
+	HealthWarning string
+	HealthChanged bool                // HealthWarning is new to the receiver
+	DiskError     bool                // Error is a failure to write the torrent's data
+	ClosedReason  models.ClosedReason // why Error failed the torrent
+	PauseAt       int64               // downloaded bytes to pause at, see SetPauseAt; zero for none
+}
+
+// Clamp keeps an update within what a torrent can report: progress between
+// 0 and 100, and downloaded bytes between 0 and the total size once that is
+// known. Negative counters are zeroed.
+func (u *TorrentUpdate) Clamp() {
+	switch {
+	case math.IsNaN(u.Progress) || u.Progress < 0:
+		u.Progress = 0
+	case u.Progress > 100:
+		u.Progress = 100
+	}
+	if u.Downloaded < 0 {
+		u.Downloaded = 0
+	}
+	if u.TotalSize > 0 && u.Downloaded > u.TotalSize {
+		u.Downloaded = u.TotalSize
+	}
+	if u.UploadedDelta < 0 {
+		u.UploadedDelta = 0
+	}
+}
+
+// EngineSettings is the torrent client's effective network identity
+type EngineSettings struct {
+	ListenAddrs  []string `json:"listen_addrs"`
+	IPFamily     string   `json:"ip_family"` // dual, ipv4 or ipv6
+	DHTEnabled   bool     `json:"dht_enabled"`
+	PEXEnabled   bool     `json:"pex_enabled"`
+	PeerIDPrefix string   `json:"peer_id_prefix"`
+	UserAgent    string   `json:"user_agent"`
+}
+
+// NewEngine creates a new torrent engine. If the client fails to start, the
+// engine is returned anyway with the error: it is unavailable (see
+// Available) until Restart succeeds, and the rest of the server can run
+// without it.
+func NewEngine(ctx context.Context, cfg *config.Config) (*Engine, error) {
+	engineCtx, cancel := context.WithCancel(ctx)
+	engine := &Engine{
+		cfg:           cfg,
+		torrents:      make(map[string]*ManagedTorrent),
+		updateCh:      make(chan TorrentUpdate, 100),
+		metadataSlots: make(chan struct{}, max(cfg.MetadataFetches, 1)),
+		previews:      make(map[string]*previewCall),
+		connShare:     maxEstablishedConns,
+		fileLimit:     checkFileLimit(cfg.ConnBudget),
+		ctx:           engineCtx,
+		cancel:        cancel,
+	}
+	if err := engine.start(); err != nil {
+		return engine, err
+	}
+	return engine, nil
+}
+
+// newClient creates the torrent client cfg describes
+func newClient(cfg *config.Config) (*torrent.Client, EngineSettings, error) {
 	// Ensure download directory exists
 	if err := os.MkdirAll(cfg.DownloadDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create download directory: %w", err)
+		return nil, EngineSettings{}, fmt.Errorf("failed to create download directory: %w", err)
 	}
 
 	clientCfg := torrent.NewDefaultClientConfig()
 	clientCfg.DataDir = cfg.DownloadDir
+	// Each torrent's files live under DOWNLOAD_DIR/<info_hash>, see DataDir
+	clientCfg.DefaultStorage = storage.NewFileByInfoHash(cfg.DownloadDir)
 	clientCfg.ListenPort = cfg.DefaultPort
-	clientCfg.Seed = false      // Disable seeding by default
-	clientCfg.NoUpload = true   // No uploading
-	clientCfg.DisableIPv6 = false
+	clientCfg.Seed = true       // Uploads are gated per torrent, see applyUploadPolicy
+	clientCfg.NoUpload = false
 	clientCfg.Debug = false
 
 	// Performance tuning
-	clientCfg.EstablishedConnsPerTorrent = 50
+	clientCfg.EstablishedConnsPerTorrent = maxEstablishedConns
 	clientCfg.HalfOpenConnsPerTorrent = 25
 	clientCfg.TorrentPeersHighWater = 500
 	clientCfg.TorrentPeersLowWater = 50
 
-	client, err := torrent.NewClient(clientCfg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create torrent client: %w", err)
+	// Network identity. Private torrents never use DHT or PEX whatever these
+	// say: the client checks the metainfo private flag before either.
+	if cfg.TorrentListenAddr != "" {
+		clientCfg.SetListenAddr(net.JoinHostPort(cfg.TorrentListenAddr, strconv.Itoa(cfg.DefaultPort)))
 	}
-
-	engine := &Engine{
-		client:   client,
-		cfg:      cfg,
-		torrents: make(map[string]*ManagedTorrent),
-		updateCh: make(chan TorrentUpdate, 100),
-		closeCh:  make(chan struct{}),
+	// Dual stack listens on both families and dials peers on either, so
+	// peers only reachable over IPv6 are found too
+	switch cfg.TorrentIPFamily {
+	case config.IPFamilyIPv4:
+		clientCfg.DisableIPv6 = true
+	case config.IPFamilyIPv6:
+		clientCfg.DisableIPv4 = true
+		clientCfg.DisableIPv4Peers = true
+	default:
+		clientCfg.DisableIPv6 = false
+	}
+	clientCfg.NoDHT = cfg.TorrentDisableDHT
+	clientCfg.DisablePEX = cfg.TorrentDisablePEX
+	if cfg.TorrentPeerIDPrefix != "" {
+		clientCfg.Bep20 = cfg.TorrentPeerIDPrefix
+	}
+	if cfg.TorrentUserAgent != "" {
+		clientCfg.HTTPUserAgent = cfg.TorrentUserAgent
+		clientCfg.ExtendedHandshakeClientVersion = cfg.TorrentUserAgent
 	}
 
-	// Start update loop
-	go engine.updateLoop()
-
-	return engine, nil
+	client, err := torrent.NewClient(clientCfg)
+	if err != nil {
+		return nil, EngineSettings{}, fmt.Errorf("failed to create torrent client: %w", err)
+	}
+	return client, EngineSettings{
+		IPFamily:     cfg.TorrentIPFamily,
+		DHTEnabled:   !clientCfg.NoDHT,
+		PEXEnabled:   !clientCfg.DisablePEX,
+		PeerIDPrefix: clientCfg.Bep20,
+		UserAgent:    clientCfg.HTTPUserAgent,
+	}, nil
 }
 
 // Close shuts down the engine
 func (e *Engine) Close() {
-	close(e.closeCh)
-	e.client.Close()
+	e.cancel()
+	e.available.Store(false)
+	e.mu.Lock()
+	client := e.client
+	e.client = nil
+	e.mu.Unlock()
+	if client != nil {
+		client.Close()
+	}
+}
+
+// Settings returns the client's effective network settings and the addresses
+// it is actually listening on
+func (e *Engine) Settings() EngineSettings {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	s := e.settings
+	if e.client != nil {
+		for _, addr := range e.client.ListenAddrs() {
+			s.ListenAddrs = append(s.ListenAddrs, addr.String())
+		}
+	}
+	return s
 }
 
 // Updates returns the channel for torrent updates
@@ -105,67 +611,238 @@ func (e *Engine) Updates() <-chan TorrentUpdate {
 	return e.updateCh
 }
 
-// AddMagnet adds a torrent from a magnet link
+// Context returns the engine's lifecycle context, cancelled by Close. HTTP
+// handlers pass it to AddMagnet, AddTorrentFile and ReloadTorrent instead of
+// c.Context(): fasthttp recycles request contexts once the response is
+// written, which would cut background work short.
+func (e *Engine) Context() context.Context {
+	return e.ctx
+}
+
+// AddMagnet adds a torrent from a magnet link. ctx bounds the background
+// metadata wait and must outlive the request that added the torrent; see
+// Context. The info hash is checked and claimed under one lock, so of
+// concurrent adds of the same torrent exactly one adds it and the others
+// see it as existing.
 func (e *Engine) AddMagnet(ctx context.Context, id, userID uuid.UUID, magnetURI string) (*TorrentUpdate, error) {
-	t, err := e.client.AddMagnet(magnetURI)
+	if isV2OnlyMagnet(magnetURI) {
+		return nil, ErrV2NotSupported
+	}
+
+	m, err := metainfo.ParseMagnetUri(magnetURI)
 	if err != nil {
 		return nil, fmt.Errorf("failed to add magnet: %w", err)
 	}
+	infoHash := m.InfoHash.HexString()
 
-	infoHash := t.InfoHash().HexString()
-
-	// Check if already exists
+	// Check if already exists before touching the client: re-adding a known
+	// torrent merges the new trackers into it, and a private torrent must
+	// not pick up another user's announce URL
 	e.mu.Lock()
 	if existing, ok := e.torrents[infoHash]; ok {
+		update, err := e.claimExisting(infoHash, existing, id, userID, false)
 		e.mu.Unlock()
-		return &TorrentUpdate{
-			ID:       existing.ID,
-			InfoHash: infoHash,
-			Status:   "exists",
-		}, nil
+		return update, err
+	}
+	if e.client == nil {
+		e.mu.Unlock()
+		return nil, ErrEngineUnavailable
 	}
 
-	e.torrents[infoHash] = &ManagedTorrent{
-		ID:      id,
-		UserID:  userID,
-		Torrent: t,
-		AddedAt: time.Now(),
+	t, err := e.client.AddMagnet(magnetURI)
+	if err != nil {
+		e.mu.Unlock()
+		return nil, fmt.Errorf("failed to add magnet: %w", err)
 	}
+
+	mt := newManagedTorrent(id, userID, t)
+	queued := e.queueMetadataFetch(mt)
+	e.registerLocked(infoHash, mt)
+	slots := e.metadataSlots
 	e.mu.Unlock()
 
 	// Wait for info in background
-	go func() {
-		select {
-		case <-t.GotInfo():
-			// Start download
-			t.DownloadAll()
-			
-			// Send initial update with metadata
-			e.sendUpdate(infoHash)
-		case <-ctx.Done():
-			return
-		case <-time.After(5 * time.Minute):
-			// Timeout waiting for metadata
-			e.mu.Lock()
-			if mt, ok := e.torrents[infoHash]; ok {
-				e.updateCh <- TorrentUpdate{
-					ID:       mt.ID,
-					InfoHash: infoHash,
-					Status:   "failed",
-					Error:    "timeout waiting for torrent metadata",
-				}
+	go e.waitForInfo(ctx, t, infoHash, slots, queued, func() {
+		e.mu.RLock()
+		var ids []uuid.UUID
+		if mt, ok := e.torrents[infoHash]; ok {
+			ids = mt.ownerIDs()
+		}
+		e.mu.RUnlock()
+		for _, ownerID := range ids {
+			e.updateCh <- TorrentUpdate{
+				ID:           ownerID,
+				InfoHash:     infoHash,
+				Status:       models.TorrentStatusFailed,
+				Error:        "timeout waiting for torrent metadata",
+				ClosedReason: models.ClosedFailedMetadata,
 			}
-			e.mu.Unlock()
 		}
-	}()
+	})
 
+	status := models.TorrentStatusPending
+	if queued {
+		status = models.TorrentStatusMetadataQueued
+	}
 	return &TorrentUpdate{
 		ID:       id,
 		InfoHash: infoHash,
-		Status:   "pending",
+		Status:   status,
 	}, nil
 }
 
+// queueMetadataFetch takes a metadata fetch slot for mt if one is free, and
+// otherwise marks it queued with connections shut off. It reports whether mt
+// was queued. Must be called with e.mu held.
+func (e *Engine) queueMetadataFetch(mt *ManagedTorrent) bool {
+	select {
+	case e.metadataSlots <- struct{}{}:
+	default:
+		mt.metadataQueued = true
+	}
+	e.applyConnLimitLocked(mt)
+	return mt.metadataQueued
+}
+
+// startMetadataFetch lets a queued magnet connect once it holds a slot
+func (e *Engine) startMetadataFetch(infoHash string, t *torrent.Torrent) {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if ok && mt.Torrent == t && mt.metadataQueued {
+		mt.metadataQueued = false
+		e.applyConnLimitLocked(mt)
+	}
+	e.mu.Unlock()
+
+	if ok {
+		e.sendUpdate(infoHash)
+	}
+}
+
+// MetadataQueueStats describes the metadata fetch queue
+type MetadataQueueStats struct {
+	Fetching int `json:"fetching"`
+	Queued   int `json:"queued"`
+	Limit    int `json:"limit"`
+}
+
+// MetadataQueue returns how many magnets are fetching metadata and how many
+// are queued waiting for a slot
+func (e *Engine) MetadataQueue() MetadataQueueStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	stats := MetadataQueueStats{
+		Fetching: len(e.metadataSlots),
+		Limit:    cap(e.metadataSlots),
+	}
+	for _, mt := range e.torrents {
+		if mt.metadataQueued {
+			stats.Queued++
+		}
+	}
+	return stats
+}
+
+// waitForInfo starts downloading t once its metadata arrives. A queued
+// magnet first waits for a fetch slot of slots, the metadata slots of the
+// run t was added in; the slot is held until the wait ends.
+// The wait is bounded by metadataTimeout, counted from taking the slot, and
+// abandoned if t is dropped or ctx or the engine is cancelled; onTimeout, if
+// set, runs only when the timeout itself expires.
+func (e *Engine) waitForInfo(ctx context.Context, t *torrent.Torrent, infoHash string, slots chan struct{}, queued bool, onTimeout func()) {
+	if queued {
+		select {
+		case slots <- struct{}{}:
+		case <-t.Closed():
+			return
+		case <-ctx.Done():
+			return
+		case <-e.ctx.Done():
+			return
+		}
+		e.startMetadataFetch(infoHash, t)
+	}
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			<-slots
+		}
+	}
+	defer release()
+
+	waitCtx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	select {
+	case <-t.GotInfo():
+		e.resolveMetadata(infoHash)
+		e.resolvePrivate(infoHash)
+
+		// Start download
+		t.DownloadAll()
+
+		// Send initial update with metadata
+		e.sendUpdate(infoHash)
+
+		// The probe doesn't need the fetch slot
+		release()
+		e.probeSwarm(ctx, t, infoHash)
+	case <-t.Closed():
+	case <-e.ctx.Done():
+	case <-waitCtx.Done():
+		if errors.Is(waitCtx.Err(), context.DeadlineExceeded) && onTimeout != nil {
+			onTimeout()
+		}
+	}
+}
+
+// probeSwarm watches a torrent whose metadata just arrived for
+// DeadProbeSeconds. If in all that time no seeder connects, no more than
+// deadSwarmPeers peers do and no data arrives, it is given the
+// HealthNoSeeders warning, which sendUpdate clears if a seeder turns up later.
+func (e *Engine) probeSwarm(ctx context.Context, t *torrent.Torrent, infoHash string) {
+	probe := time.Duration(e.cfg.DeadProbeSeconds) * time.Second
+	if probe <= 0 || t.BytesMissing() == 0 {
+		return
+	}
+	start := t.BytesCompleted()
+
+	timer := time.NewTimer(probe)
+	defer timer.Stop()
+	ticker := time.NewTicker(swarmProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			stats := t.Stats()
+			if stats.ConnectedSeeders > 0 || stats.ActivePeers > deadSwarmPeers || t.BytesCompleted() > start {
+				return
+			}
+		case <-timer.C:
+			e.mu.Lock()
+			mt, ok := e.torrents[infoHash]
+			if ok && mt.Torrent == t && mt.healthWarning == "" {
+				mt.healthWarning = HealthNoSeeders
+				mt.healthReported = false
+			}
+			e.mu.Unlock()
+			if ok {
+				e.sendUpdate(infoHash)
+			}
+			return
+		case <-t.Closed():
+			return
+		case <-ctx.Done():
+			return
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
 // AddTorrentFile adds a torrent from a .torrent file
 func (e *Engine) AddTorrentFile(ctx context.Context, id, userID uuid.UUID, reader io.Reader) (*TorrentUpdate, error) {
 	mi, err := metainfo.Load(reader)
@@ -173,29 +850,47 @@ func (e *Engine) AddTorrentFile(ctx context.Context, id, userID uuid.UUID, reade
 		return nil, fmt.Errorf("failed to parse torrent file: %w", err)
 	}
 
-	t, err := e.client.AddTorrent(mi)
+	// A private torrent's embedded DHT nodes must not reach the routing
+	// table; the client itself keeps DHT and PEX off for it
+	info, err := mi.UnmarshalInfo()
 	if err != nil {
-		return nil, fmt.Errorf("failed to add torrent: %w", err)
+		return nil, fmt.Errorf("failed to parse torrent file: %w", err)
+	}
+	metadata := newTorrentMetadata(&info, mi.InfoBytes, mi)
+	if metadata.Version == "v2" {
+		return nil, ErrV2NotSupported
+	}
+
+	private := isPrivate(&info)
+	if private {
+		mi.Nodes = nil
 	}
 
-	infoHash := t.InfoHash().HexString()
+	infoHash := mi.HashInfoBytes().HexString()
 
+	// As with magnets, check before the client merges this file's trackers
+	// into a torrent it already has
 	e.mu.Lock()
 	if existing, ok := e.torrents[infoHash]; ok {
+		update, err := e.claimExisting(infoHash, existing, id, userID, private)
 		e.mu.Unlock()
-		return &TorrentUpdate{
-			ID:       existing.ID,
-			InfoHash: infoHash,
-			Status:   "exists",
-		}, nil
+		return update, err
+	}
+	if e.client == nil {
+		e.mu.Unlock()
+		return nil, ErrEngineUnavailable
 	}
 
-	e.torrents[infoHash] = &ManagedTorrent{
-		ID:      id,
-		UserID:  userID,
-		Torrent: t,
-		AddedAt: time.Now(),
+	t, err := e.client.AddTorrent(mi)
+	if err != nil {
+		e.mu.Unlock()
+		return nil, fmt.Errorf("failed to add torrent: %w", err)
 	}
+
+	mt := newManagedTorrent(id, userID, t)
+	mt.private = private
+	mt.metadata = metadata
+	e.registerLocked(infoHash, mt)
 	e.mu.Unlock()
 
 	// Start download immediately since we have the info
@@ -205,13 +900,154 @@ func (e *Engine) AddTorrentFile(ctx context.Context, id, userID uuid.UUID, reade
 	e.sendUpdate(infoHash)
 
 	return &TorrentUpdate{
+		ID:        id,
+		InfoHash:  infoHash,
+		IsPrivate: private,
+		Metadata:  metadata,
+		Status:    models.TorrentStatusDownloading,
+	}, nil
+}
+
+// claimExisting handles an add for an info hash the engine already manages.
+// The caller must hold e.mu. A user re-adding their own torrent gets status
+// "exists" with their existing ID; any other user becomes an additional owner
+// of the shared engine torrent under the new ID, so their database row
+// receives its own updates. Private torrents are never shared.
+func (e *Engine) claimExisting(infoHash string, mt *ManagedTorrent, id, userID uuid.UUID, private bool) (*TorrentUpdate, error) {
+	if ownID, ok := mt.torrentIDFor(userID); ok {
+		return &TorrentUpdate{
+			ID:       ownID,
+			InfoHash: infoHash,
+			Status:   StatusExists,
+		}, nil
+	}
+
+	if mt.private || private {
+		return nil, ErrPrivateTorrentInUse
+	}
+
+	mt.owners[id] = userID
+	e.updatePausedLocked(mt)
+	// The new owner's row hears of any health warning with the next update
+	mt.healthReported = false
+
+	update := &TorrentUpdate{
 		ID:       id,
 		InfoHash: infoHash,
-		Status:   "downloading",
-	}, nil
+		Status:   models.TorrentStatusPending,
+	}
+	if mt.Torrent.Info() != nil {
+		update.Name = mt.Torrent.Name()
+		update.TotalSize = mt.Torrent.Length()
+		update.Metadata = mt.metadata
+		update.Status = models.TorrentStatusDownloading
+	} else if mt.metadataQueued {
+		update.Status = models.TorrentStatusMetadataQueued
+	}
+	return update, nil
 }
 
-// RemoveTorrent stops and removes a torrent
+// resolveMetadata fills in a magnet torrent's metadata once its info arrives
+func (e *Engine) resolveMetadata(infoHash string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	mt, ok := e.torrents[infoHash]
+	if !ok || mt.metadata != nil || mt.Torrent.Info() == nil {
+		return
+	}
+	mt.metadata = newTorrentMetadata(mt.Torrent.Info(), mt.Torrent.Metainfo().InfoBytes, nil)
+}
+
+// resolvePrivate records a magnet torrent's private flag once its metadata
+// arrives. Other users may have been attached while the flag was unknown;
+// they are failed so that only the first user's torrent stays active.
+func (e *Engine) resolvePrivate(infoHash string) {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok || !isPrivate(mt.Torrent.Info()) {
+		e.mu.Unlock()
+		return
+	}
+	mt.private = true
+	var evicted []uuid.UUID
+	for id, userID := range mt.owners {
+		if userID != mt.UserID {
+			evicted = append(evicted, id)
+			delete(mt.owners, id)
+		}
+	}
+	e.mu.Unlock()
+
+	e.applyUploadPolicy(mt)
+
+	for _, id := range evicted {
+		e.updateCh <- TorrentUpdate{
+			ID:           id,
+			InfoHash:     infoHash,
+			Status:       models.TorrentStatusFailed,
+			Error:        ErrPrivateTorrentInUse.Error(),
+			ClosedReason: models.ClosedFailedMetadata, // its metadata says it's private
+		}
+	}
+}
+
+// SetSeedRatio sets the upload ratio a private torrent seeds to. Public
+// torrents never upload, so it has no effect on them.
+func (e *Engine) SetSeedRatio(infoHash string, ratio float64) {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if ok {
+		mt.seedRatio = ratio
+	}
+	e.mu.Unlock()
+
+	if ok {
+		e.applyUploadPolicy(mt)
+	}
+}
+
+// applyUploadPolicy allows uploading only for a private torrent that has a
+// seed ratio it hasn't reached yet, and for a user's own created torrent
+func (e *Engine) applyUploadPolicy(mt *ManagedTorrent) {
+	e.mu.RLock()
+	allow := mt.seedOwn || mt.private && mt.seedRatio > 0 && !mt.ratioReached
+	e.mu.RUnlock()
+
+	if allow {
+		mt.Torrent.AllowDataUpload()
+	} else {
+		mt.Torrent.DisallowDataUpload()
+	}
+}
+
+// seedingToRatio reports whether a completed torrent should keep seeding, as
+// a created torrent always does and a private one below its seed ratio does.
+// Guarded by Engine.mu.
+func (mt *ManagedTorrent) seedingToRatio(uploaded, total int64) bool {
+	if mt.seedOwn {
+		return true
+	}
+	return mt.private && mt.seedRatio > 0 && !mt.ratioReached && float64(uploaded) < mt.seedRatio*float64(total)
+}
+
+// reachSeedRatio closes uploads of a completed private torrent once it
+// reaches its seed ratio
+func (e *Engine) reachSeedRatio(mt *ManagedTorrent, uploaded, total int64) {
+	e.mu.Lock()
+	reached := !mt.seedOwn && mt.private && mt.seedRatio > 0 && !mt.ratioReached &&
+		float64(uploaded) >= mt.seedRatio*float64(total)
+	if reached {
+		mt.ratioReached = true
+	}
+	e.mu.Unlock()
+
+	if reached {
+		e.applyUploadPolicy(mt)
+	}
+}
+
+// RemoveTorrent stops and removes a torrent for every owner
 func (e *Engine) RemoveTorrent(infoHash string, deleteFiles bool) error {
 	e.mu.Lock()
 	mt, ok := e.torrents[infoHash]
@@ -219,69 +1055,118 @@ func (e *Engine) RemoveTorrent(infoHash string, deleteFiles bool) error {
 		e.mu.Unlock()
 		return fmt.Errorf("torrent not found")
 	}
+	e.dropLocked(infoHash, mt)
+	e.mu.Unlock()
+
+	if deleteFiles {
+		e.removeFiles(infoHash)
+	}
+
+	return nil
+}
+
+// RemoveOwner detaches one database torrent from the engine torrent it shares.
+// The engine torrent, and optionally its files, is only removed once no other
+// owner references it.
+func (e *Engine) RemoveOwner(infoHash string, id uuid.UUID, deleteFiles bool) error {
+	e.mu.Lock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		e.mu.Unlock()
+		return fmt.Errorf("torrent not found")
+	}
 
-	// Get file paths before dropping
-	var filePaths []string
-	if deleteFiles && mt.Torrent.Info() != nil {
-		for _, f := range mt.Torrent.Files() {
-			filePaths = append(filePaths, filepath.Join(e.cfg.DownloadDir, f.Path()))
+	delete(mt.owners, id)
+	if len(mt.owners) > 0 {
+		if mt.ID == id {
+			for ownerID, userID := range mt.owners {
+				mt.ID, mt.UserID = ownerID, userID
+				break
+			}
 		}
+		e.updatePausedLocked(mt)
+		e.mu.Unlock()
+		return nil
 	}
 
-	mt.Torrent.Drop()
-	delete(e.torrents, infoHash)
+	e.dropLocked(infoHash, mt)
 	e.mu.Unlock()
 
-	// Delete files if requested
 	if deleteFiles {
-		for _, path := range filePaths {
-			os.Remove(path)
-		}
-		// Try to remove parent directories if empty
-		if len(filePaths) > 0 {
-			dir := filepath.Dir(filePaths[0])
-			os.Remove(dir) // Will fail if not empty, which is fine
-		}
+		e.removeFiles(infoHash)
 	}
 
 	return nil
 }
 
-// PauseTorrent pauses a torrent download
-func (e *Engine) PauseTorrent(infoHash string) error {
-	e.mu.RLock()
-	mt, ok := e.torrents[infoHash]
-	e.mu.RUnlock()
+// dropLocked drops the torrent from the client. The caller must hold e.mu.
+func (e *Engine) dropLocked(infoHash string, mt *ManagedTorrent) {
+	mt.Torrent.Drop()
+	delete(e.torrents, infoHash)
+}
 
+// removeFiles deletes a torrent's data directory, its zip included
+func (e *Engine) removeFiles(infoHash string) {
+	if infoHash == "" {
+		return
+	}
+	os.RemoveAll(e.TorrentDir(infoHash))
+}
+
+// PauseTorrent pauses owner id's download of a torrent. Other owners keep
+// downloading it; the torrent itself stops once every owner has paused it.
+func (e *Engine) PauseTorrent(infoHash string, id uuid.UUID) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	mt, ok := e.torrents[infoHash]
 	if !ok {
 		return fmt.Errorf("torrent not found")
 	}
 
-	mt.Torrent.SetMaxEstablishedConns(0)
+	e.setPausedLocked(mt, id, true)
 	return nil
 }
 
-// ResumeTorrent resumes a paused torrent
-func (e *Engine) ResumeTorrent(infoHash string) error {
-	e.mu.RLock()
+// ResumeTorrent resumes owner id's download of a paused torrent
+func (e *Engine) ResumeTorrent(infoHash string, id uuid.UUID) error {
+	e.mu.Lock()
 	mt, ok := e.torrents[infoHash]
-	e.mu.RUnlock()
-
 	if !ok {
+		e.mu.Unlock()
 		return fmt.Errorf("torrent not found")
 	}
 
-	mt.Torrent.SetMaxEstablishedConns(50)
-	mt.Torrent.DownloadAll()
+	// A queued magnet gets its connections back when it takes a slot
+	e.setPausedLocked(mt, id, false)
+	e.mu.Unlock()
+	// Without metadata there are no pieces yet; waitForInfo downloads them
+	if mt.Torrent.Info() != nil {
+		mt.Torrent.DownloadAll()
+	}
 	return nil
 }
 
+// SetPauseAt sets the downloaded bytes at which owner id's row of a torrent
+// is to be paused again. The engine only reports it in that owner's updates;
+// the update processor does the pausing, and the torrent stops once every
+// owner is paused. Zero clears it.
+func (e *Engine) SetPauseAt(infoHash string, id uuid.UUID, downloaded int64) {
+	e.mu.Lock()
+	if mt, ok := e.torrents[infoHash]; ok {
+		if downloaded > 0 {
+			mt.pauseAt[id] = downloaded
+		} else {
+			delete(mt.pauseAt, id)
+		}
+	}
+	e.mu.Unlock()
+}
+
 // GetTorrentStatus returns current status of a torrent
 func (e *Engine) GetTorrentStatus(infoHash string) (*TorrentUpdate, error) {
 	e.mu.RLock()
+	defer e.mu.RUnlock()
 	mt, ok := e.torrents[infoHash]
-	e.mu.RUnlock()
-
 	if !ok {
 		return nil, fmt.Errorf("torrent not found")
 	}
@@ -306,9 +1191,10 @@ func (e *Engine) GetFilePath(infoHash, relativePath string) (string, error) {
 	// Find the file
 	for _, f := range mt.Torrent.Files() {
 		if f.Path() == relativePath {
-			fullPath := filepath.Join(e.cfg.DownloadDir, f.Path())
+			dir := e.TorrentDir(infoHash)
+			fullPath := filepath.Join(dir, f.Path())
 			// Security check - prevent path traversal
-			if !strings.HasPrefix(fullPath, e.cfg.DownloadDir) {
+			if !strings.HasPrefix(fullPath, dir) {
 				return "", fmt.Errorf("invalid file path")
 			}
 			return fullPath, nil
@@ -318,8 +1204,37 @@ func (e *Engine) GetFilePath(infoHash, relativePath string) (string, error) {
 	return "", fmt.Errorf("file not found in torrent")
 }
 
-// GetFileReader returns a reader for streaming a file
-func (e *Engine) GetFileReader(infoHash, relativePath string) (io.ReadSeeker, int64, error) {
+// ReaderOptions tune a file reader for the way it will be read
+type ReaderOptions struct {
+	Readahead  int64           // bytes fetched ahead of the read position; 0 = the client's default
+	Responsive bool            // return data as soon as its piece verifies, for players that seek
+	Context    context.Context // ends reads still waiting for pieces when done; nil = never
+}
+
+// StreamReaderOptions are for readers that seek, such as media players
+// asking for ranges: a small readahead so a seek doesn't fetch data that
+// won't be played, returning data as it arrives
+func (e *Engine) StreamReaderOptions() ReaderOptions {
+	return ReaderOptions{
+		Readahead:  int64(e.cfg.StreamReadaheadMB) << 20,
+		Responsive: true,
+		Context:    e.ctx,
+	}
+}
+
+// DownloadReaderOptions are for readers that go through a file from start
+// to end, such as whole-file downloads and archiving: a large readahead
+// keeps the swarm busy ahead of the reader
+func (e *Engine) DownloadReaderOptions() ReaderOptions {
+	return ReaderOptions{
+		Readahead: int64(e.cfg.DownloadReadaheadMB) << 20,
+		Context:   e.ctx,
+	}
+}
+
+// GetFileReader returns a reader for a file of a torrent, tuned by opts.
+// The caller must close it, which releases the torrent's reader.
+func (e *Engine) GetFileReader(infoHash, relativePath string, opts ReaderOptions) (io.ReadSeekCloser, int64, error) {
 	e.mu.RLock()
 	mt, ok := e.torrents[infoHash]
 	e.mu.RUnlock()
@@ -335,30 +1250,102 @@ func (e *Engine) GetFileReader(infoHash, relativePath string) (io.ReadSeeker, in
 	for _, f := range mt.Torrent.Files() {
 		if f.Path() == relativePath {
 			reader := f.NewReader()
-			reader.SetReadahead(10 * 1024 * 1024) // 10MB readahead for streaming
-			reader.SetResponsive()
-			return reader, f.Length(), nil
+			if opts.Readahead > 0 {
+				reader.SetReadahead(opts.Readahead)
+			}
+			if opts.Responsive {
+				reader.SetResponsive()
+			}
+			ctx := opts.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			r := &pieceWaitReader{Reader: reader, ctx: ctx, wait: pieceWaitTimeout}
+			// A stream is waited on as it plays, so it keeps all connections
+			if opts.Responsive {
+				r.release = e.trackStream(mt)
+			}
+			return r, f.Length(), nil
 		}
 	}
 
 	return nil, 0, fmt.Errorf("file not found")
 }
 
-// updateLoop periodically updates torrent statuses
-func (e *Engine) updateLoop() {
+// pieceWaitReader is a file reader whose reads give up with ErrPieceTimeout
+// after waiting wait for a piece, instead of blocking until it arrives, and
+// end with ctx's error once ctx is done
+type pieceWaitReader struct {
+	torrent.Reader
+	ctx     context.Context
+	wait    time.Duration
+	release func() // called once on Close, if set
+}
+
+func (r *pieceWaitReader) Close() error {
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	return r.Reader.Close()
+}
+
+func (r *pieceWaitReader) Read(p []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.wait)
+	defer cancel()
+	n, err := r.Reader.ReadContext(ctx, p)
+	if n == 0 && errors.Is(err, context.DeadlineExceeded) && r.ctx.Err() == nil {
+		err = ErrPieceTimeout
+	}
+	return n, err
+}
+
+// updateLoop periodically updates torrent statuses, noting each finished
+// pass for the watchdog. Trackers are refreshed and scraped less often. It
+// exits once a restart starts a newer generation.
+func (e *Engine) updateLoop(gen int64) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	var trackersAt time.Time
+	// The first scrape waits a minute, for the first announces
+	scrapedAt := time.Now().Add(time.Minute - trackerScrapeInterval)
 
 	for {
 		select {
-		case <-e.closeCh:
+		case <-e.ctx.Done():
 			return
 		case <-ticker.C:
+			if e.loopGen.Load() != gen {
+				return
+			}
 			e.mu.RLock()
+			infoHashes := make([]string, 0, len(e.torrents))
 			for infoHash := range e.torrents {
-				e.sendUpdate(infoHash)
+				infoHashes = append(infoHashes, infoHash)
 			}
 			e.mu.RUnlock()
+
+			for _, infoHash := range infoHashes {
+				e.sendUpdate(infoHash)
+			}
+			e.balanceConns()
+
+			now := time.Now()
+			if now.Sub(trackersAt) >= trackerRefreshInterval && e.refreshing.CompareAndSwap(false, true) {
+				trackersAt = now
+				go func() {
+					defer e.refreshing.Store(false)
+					e.refreshTrackers()
+				}()
+			}
+			if now.Sub(scrapedAt) >= trackerScrapeInterval && e.scraping.CompareAndSwap(false, true) {
+				scrapedAt = now
+				go func() {
+					defer e.scraping.Store(false)
+					e.scrapeTrackers()
+				}()
+			}
+			e.lastTick.Store(time.Now().UnixNano())
 		}
 	}
 }
@@ -366,21 +1353,102 @@ func (e *Engine) updateLoop() {
 func (e *Engine) sendUpdate(infoHash string) {
 	e.mu.RLock()
 	mt, ok := e.torrents[infoHash]
+	var ownerIDs []uuid.UUID
+	if ok {
+		ownerIDs = mt.ownerIDs()
+		// A torrent failed for a disk write error has said its last
+		ok = !mt.writeFailed
+	}
 	e.mu.RUnlock()
 
 	if !ok {
 		return
 	}
 
+	// A reloaded completed torrent has nothing new to persist until its
+	// metadata resolves; reporting it now would only regress the database.
+	if mt.reloadedComplete && mt.Torrent.Info() == nil {
+		return
+	}
+
+	e.sampleTransfer(mt)
+	e.mu.RLock()
 	update := e.buildUpdate(infoHash, mt)
-	
-	select {
-	case e.updateCh <- *update:
-	default:
-		// Channel full, skip update
+	e.mu.RUnlock()
+	if update.Progress >= 100 {
+		e.reachSeedRatio(mt, update.Uploaded, update.WantedSize)
+	}
+
+	e.mu.Lock()
+	update.UploadedDelta = mt.pendingUpload
+	mt.pendingUpload = 0
+	if !mt.metadataReported {
+		update.Metadata = mt.metadata
+	}
+	if mt.healthWarning == HealthNoSeeders && (update.Seeds > 0 || update.Progress >= 100) {
+		mt.healthWarning = ""
+		mt.healthReported = false
+	}
+	update.HealthWarning = mt.healthWarning
+	update.HealthChanged = !mt.healthReported
+
+	// Every owner's database row gets its own copy of the update
+	ownerUpdates := make([]TorrentUpdate, 0, len(ownerIDs))
+	for _, id := range ownerIDs {
+		ownerUpdates = append(ownerUpdates, mt.forOwner(*update, id))
 	}
+	e.mu.Unlock()
+
+	dropped := false
+	for _, ownerUpdate := range ownerUpdates {
+		select {
+		case e.updateCh <- ownerUpdate:
+		default:
+			// Channel full, skip update
+			dropped = true
+		}
+	}
+
+	// Keep undelivered upload for the next update so accounting stays whole
+	e.mu.Lock()
+	if dropped {
+		mt.pendingUpload += update.UploadedDelta
+	} else {
+		if update.Metadata != nil {
+			mt.metadataReported = true
+		}
+		// Unless the warning changed again while this update was sent
+		if update.HealthChanged && mt.healthWarning == update.HealthWarning {
+			mt.healthReported = true
+		}
+	}
+	e.mu.Unlock()
+}
+
+// sampleTransfer advances a torrent's transfer counters and speeds. Only
+// payload counters are used: useful data read for downloads, data written
+// for uploads, so protocol overhead and wasted chunks don't count.
+func (e *Engine) sampleTransfer(mt *ManagedTorrent) {
+	stats := mt.Torrent.Stats()
+	read := stats.BytesReadUsefulData.Int64()
+	written := stats.BytesWrittenData.Int64()
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !mt.lastSample.IsZero() {
+		if elapsed := now.Sub(mt.lastSample).Seconds(); elapsed > 0 {
+			mt.downloadSpeed = float64(read-mt.lastRead) / elapsed
+			mt.uploadSpeed = float64(written-mt.lastWritten) / elapsed
+		}
+	}
+	mt.pendingUpload += written - mt.lastWritten
+	mt.lastSample, mt.lastRead, mt.lastWritten = now, read, written
 }
 
+// buildUpdate reports a torrent's state. e.mu must be held, for reading at
+// least.
 func (e *Engine) buildUpdate(infoHash string, mt *ManagedTorrent) *TorrentUpdate {
 	t := mt.Torrent
 	
@@ -391,49 +1459,61 @@ func (e *Engine) buildUpdate(infoHash string, mt *ManagedTorrent) *TorrentUpdate
 
 	// Check if we have metadata
 	if t.Info() == nil {
-		update.Status = "pending"
+		if mt.reloadedComplete {
+			update.Status = models.TorrentStatusCompleted
+			update.Progress = 100
+			return update
+		}
+		update.Status = models.TorrentStatusPending
+		if mt.paused {
+			update.Status = models.TorrentStatusPaused
+		} else if mt.metadataQueued {
+			update.Status = models.TorrentStatusMetadataQueued
+		}
 		update.Name = "Fetching metadata..."
 		return update
 	}
 
-	// Get stats
+	// Get stats. Progress and completion count only the wanted files.
 	stats := t.Stats()
-	bytesCompleted := t.BytesCompleted()
-	totalLength := t.Length()
+	bytesCompleted := mt.WantedCompleted()
+	wantedLength := mt.WantedLength()
 
 	update.Name = t.Name()
-	update.TotalSize = totalLength
+	update.TotalSize = t.Length()
+	update.WantedSize = wantedLength
 	update.Downloaded = bytesCompleted
 	update.Uploaded = stats.BytesWrittenData.Int64()
 	update.Peers = stats.ActivePeers
 	update.Seeds = stats.ConnectedSeeders
 
 	// Calculate progress
-	if totalLength > 0 {
-		update.Progress = float64(bytesCompleted) / float64(totalLength) * 100
+	if wantedLength > 0 {
+		update.Progress = float64(bytesCompleted) / float64(wantedLength) * 100
 	}
 
-	// Calculate speeds (bytes per second)
-	now := time.Now()
-	if !mt.lastUpdate.IsZero() {
-		elapsed := now.Sub(mt.lastUpdate).Seconds()
-		if elapsed > 0 {
-			// This is a simplified calculation - in production you'd track previous values
-			update.DownloadSpeed = float64(stats.BytesReadData.Int64()) / elapsed
-			update.UploadSpeed = float64(stats.BytesWrittenData.Int64()) / elapsed
+	// Speeds (bytes per second) come from the last sample
+	update.DownloadSpeed = mt.downloadSpeed
+	update.UploadSpeed = mt.uploadSpeed
+	update.IsPrivate = mt.private
+
+	// Determine status. A complete private torrent still below its seed
+	// ratio reports seeding; the data is as usable as a completed one's.
+	if bytesCompleted >= wantedLength {
+		update.Status = models.TorrentStatusCompleted
+		update.Progress = 100
+		if mt.seedingToRatio(update.Uploaded, wantedLength) {
+			update.Status = models.TorrentStatusSeeding
 		}
-	}
-	mt.lastUpdate = now
-
-	// Determine status
-	if bytesCompleted >= totalLength {
-		update.Status = "completed"
-	} else if t.Seeding() {
-		update.Status = "seeding"
+	} else if mt.paused {
+		update.Status = models.TorrentStatusPaused
+	} else if mt.seedOwn {
+		// Its data is all here, being hashed; see CreateTorrent
+		update.Status = models.TorrentStatusChecking
 	} else if stats.ActivePeers > 0 {
-		update.Status = "downloading"
+		update.Status = models.TorrentStatusDownloading
 	} else {
-		update.Status = "stalled"
+		update.Status = models.TorrentStatusStalled
 	}
 
 	// Get file list
@@ -449,7 +1529,7 @@ func (e *Engine) buildUpdate(infoHash string, mt *ManagedTorrent) *TorrentUpdate
 			Path:     f.Path(),
 			Size:     length,
 			Progress: progress,
-			Priority: 2, // normal
+			Priority: filePriority(f),
 		})
 	}
 
@@ -463,7 +1543,7 @@ func (e *Engine) GetActiveTorrents() []TorrentUpdate {
 
 	var updates []TorrentUpdate
 	for infoHash, mt := range e.torrents {
-		updates = append(updates, *e.buildUpdate(infoHash, mt))
+		updates = append(updates, mt.forOwner(*e.buildUpdate(infoHash, mt), mt.ID))
 	}
 	return updates
 }
@@ -475,8 +1555,8 @@ func (e *Engine) GetUserTorrents(userID uuid.UUID) []TorrentUpdate {
 
 	var updates []TorrentUpdate
 	for infoHash, mt := range e.torrents {
-		if mt.UserID == userID {
-			updates = append(updates, *e.buildUpdate(infoHash, mt))
+		if id, ok := mt.torrentIDFor(userID); ok {
+			updates = append(updates, mt.forOwner(*e.buildUpdate(infoHash, mt), id))
 		}
 	}
 	return updates
@@ -491,60 +1571,65 @@ func (e *Engine) IsInfoHashActive(infoHash string) bool {
 }
 
 // ReloadTorrent reloads a torrent from magnet URI (used for server restarts)
-func (e *Engine) ReloadTorrent(ctx context.Context, id, userID uuid.UUID, magnetURI, infoHash string, status string) error {
-	// Skip if already loaded
-	e.mu.RLock()
-	if _, ok := e.torrents[infoHash]; ok {
-		e.mu.RUnlock()
+func (e *Engine) ReloadTorrent(ctx context.Context, id, userID uuid.UUID, magnetURI, infoHash string, status models.TorrentStatus) error {
+	// Skip if already loaded, attaching this row as another owner
+	e.mu.Lock()
+	if mt, ok := e.torrents[infoHash]; ok {
+		defer e.mu.Unlock()
+		if _, owned := mt.owners[id]; !owned {
+			if mt.private {
+				return ErrPrivateTorrentInUse
+			}
+			mt.owners[id] = userID
+			e.setPausedLocked(mt, id, status == models.TorrentStatusPaused)
+		}
 		return nil
 	}
-	e.mu.RUnlock()
 
 	// Skip failed or cancelled torrents
-	if status == "failed" || status == "cancelled" {
+	if status == models.TorrentStatusFailed || status == models.TorrentStatusCancelled {
+		e.mu.Unlock()
 		return nil
 	}
+	if e.client == nil {
+		e.mu.Unlock()
+		return ErrEngineUnavailable
+	}
 
 	var t *torrent.Torrent
 	var err error
-
 	if magnetURI != "" {
 		t, err = e.client.AddMagnet(magnetURI)
 	} else {
 		// Try to add by info hash directly
 		var ih metainfo.Hash
 		if err := ih.FromHexString(infoHash); err != nil {
+			e.mu.Unlock()
 			return fmt.Errorf("invalid info hash: %w", err)
 		}
 		t, _ = e.client.AddTorrentInfoHash(ih)
 	}
-
 	if err != nil {
+		e.mu.Unlock()
 		return err
 	}
 
-	e.mu.Lock()
-	e.torrents[infoHash] = &ManagedTorrent{
-		ID:      id,
-		UserID:  userID,
-		Torrent: t,
-		AddedAt: time.Now(),
+	mt := newManagedTorrent(id, userID, t)
+	mt.reloadedComplete = status.IsComplete()
+	queued := false
+	if !mt.reloadedComplete {
+		queued = e.queueMetadataFetch(mt)
 	}
+	if status == models.TorrentStatusPaused {
+		e.setPausedLocked(mt, id, true)
+	}
+	e.registerLocked(infoHash, mt)
+	slots := e.metadataSlots
 	e.mu.Unlock()
 
 	// Start download in background if not completed
-	if status != "completed" && status != "seeding" {
-		go func() {
-			select {
-			case <-t.GotInfo():
-				t.DownloadAll()
-				e.sendUpdate(infoHash)
-			case <-ctx.Done():
-				return
-			case <-time.After(5 * time.Minute):
-				// Timeout
-			}
-		}()
+	if !mt.reloadedComplete {
+		go e.waitForInfo(ctx, t, infoHash, slots, queued, nil)
 	}
 
 	return nil
@@ -554,3 +1639,54 @@ func (e *Engine) ReloadTorrent(ctx context.Context, id, userID uuid.UUID, magnet
 func (e *Engine) GetDownloadDir() string {
 	return e.cfg.DownloadDir
 }
+
+// TorrentDir returns the directory a torrent's files and zip are stored in
+func (e *Engine) TorrentDir(infoHash string) string {
+	return DataDir(e.cfg.DownloadDir, infoHash)
+}
+
+// DataDir returns the directory under downloadDir holding the torrent with
+// the given info hash. Torrents are kept apart by info hash so same-named
+// files of different torrents, or users, never collide.
+func DataDir(downloadDir, infoHash string) string {
+	return filepath.Join(downloadDir, infoHash)
+}
+
+// FilesOnDisk reports whether every file of a torrent is on disk at its
+// full size
+func FilesOnDisk(downloadDir, infoHash string, files []models.TorrentFile) bool {
+	dir := DataDir(downloadDir, infoHash)
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(dir, f.Path))
+		if err != nil || info.Size() < f.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// BytesOnDisk estimates how much of a torrent is downloaded from its files
+// on disk. Files may be allocated at full size before they are written, so
+// each counts only up to what its recorded progress vouches for.
+func BytesOnDisk(downloadDir, infoHash string, files []models.TorrentFile) int64 {
+	dir := DataDir(downloadDir, infoHash)
+	var total int64
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(dir, f.Path))
+		if err != nil {
+			continue
+		}
+		total += min(info.Size(), f.Size, int64(float64(f.Size)*f.Progress/100))
+	}
+	return total
+}
+
+// MeasureDownloaded returns how much of a torrent is downloaded and where
+// that was measured: by the engine ("engine") when it has the torrent's
+// metadata, otherwise from its files on disk ("disk")
+func (e *Engine) MeasureDownloaded(infoHash string, files []models.TorrentFile) (int64, string) {
+	if status, err := e.GetTorrentStatus(infoHash); err == nil && status.TotalSize > 0 {
+		return status.Downloaded, "engine"
+	}
+	return BytesOnDisk(e.cfg.DownloadDir, infoHash, files), "disk"
+}
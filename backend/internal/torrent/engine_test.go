@@ -0,0 +1,276 @@
+package torrent
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// newTestClient starts a client on localhost that finds no peers on its own
+func newTestClient(t *testing.T) *torrent.Client {
+	t.Helper()
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.SetListenAddr("127.0.0.1:0")
+	cfg.NoDHT = true
+	cfg.DisablePEX = true
+	cfg.DisableIPv6 = true
+	cfg.NoDefaultPortForwarding = true
+	client, err := torrent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// addCompleteTorrent adds a one-file torrent whose data is all on disk
+func addCompleteTorrent(t *testing.T, client *torrent.Client) *torrent.Torrent {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), make([]byte, 1<<16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 1 << 14}
+	if err := info.BuildFromFilePath(filepath.Join(dir, "a.bin")); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(&metainfo.MetaInfo{InfoBytes: infoBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Storage = storage.NewFile(dir)
+	tr, _, err := client.AddTorrentSpec(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tr.GotInfo()
+	for _, f := range tr.Files() {
+		f.Download()
+	}
+	tr.VerifyData()
+	if missing := tr.BytesMissing(); missing != 0 {
+		t.Fatalf("%d bytes missing", missing)
+	}
+	return tr
+}
+
+// TestListWhileLocking lists a private torrent seeding to its ratio while
+// the update loop's writer contends for the lock, which deadlocked when
+// building an update took the lock the listing already held
+func TestListWhileLocking(t *testing.T) {
+	tr := addCompleteTorrent(t, newTestClient(t))
+	mt := newManagedTorrent(uuid.New(), uuid.New(), tr)
+	mt.private, mt.seedRatio = true, 1
+	e := &Engine{torrents: map[string]*ManagedTorrent{tr.InfoHash().HexString(): mt}}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				e.mu.Lock()
+				e.mu.Unlock()
+			}
+		}
+	}()
+
+	done := make(chan []TorrentUpdate)
+	go func() {
+		var updates []TorrentUpdate
+		for range 100 {
+			updates = e.GetActiveTorrents()
+			e.GetUserTorrents(mt.UserID)
+		}
+		done <- updates
+	}()
+	select {
+	case updates := <-done:
+		if len(updates) != 1 || updates[0].Status != models.TorrentStatusSeeding {
+			t.Errorf("updates = %+v, want one seeding", updates)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("listing torrents deadlocked")
+	}
+}
+
+func TestTorrentUpdateClamp(t *testing.T) {
+	tests := []struct {
+		name string
+		in   TorrentUpdate
+		want TorrentUpdate
+	}{
+		{"in range",
+			TorrentUpdate{Progress: 50, Downloaded: 500, TotalSize: 1000, UploadedDelta: 10},
+			TorrentUpdate{Progress: 50, Downloaded: 500, TotalSize: 1000, UploadedDelta: 10}},
+		{"progress over 100",
+			TorrentUpdate{Progress: 100.4, Downloaded: 1000, TotalSize: 1000},
+			TorrentUpdate{Progress: 100, Downloaded: 1000, TotalSize: 1000}},
+		{"negative progress",
+			TorrentUpdate{Progress: -3},
+			TorrentUpdate{Progress: 0}},
+		{"NaN progress from a zero-size division",
+			TorrentUpdate{Progress: math.NaN()},
+			TorrentUpdate{Progress: 0}},
+		{"downloaded past the total",
+			TorrentUpdate{Progress: 100, Downloaded: 1500, TotalSize: 1000},
+			TorrentUpdate{Progress: 100, Downloaded: 1000, TotalSize: 1000}},
+		{"downloaded before the total is known",
+			TorrentUpdate{Downloaded: 1500},
+			TorrentUpdate{Downloaded: 1500}},
+		{"negative counters",
+			TorrentUpdate{Downloaded: -1, TotalSize: 1000, UploadedDelta: -5},
+			TorrentUpdate{Downloaded: 0, TotalSize: 1000, UploadedDelta: 0}},
+	}
+	for _, tt := range tests {
+		got := tt.in
+		got.Clamp()
+		if got.Progress != tt.want.Progress || got.Downloaded != tt.want.Downloaded ||
+			got.TotalSize != tt.want.TotalSize || got.UploadedDelta != tt.want.UploadedDelta {
+			t.Errorf("%s: Clamp() = progress %v, downloaded %d, uploaded delta %d; want %v, %d, %d",
+				tt.name, got.Progress, got.Downloaded, got.UploadedDelta,
+				tt.want.Progress, tt.want.Downloaded, tt.want.UploadedDelta)
+		}
+	}
+}
+
+// TestIsPrivate reads the private flag as a .torrent file carries it.
+// Private torrents are kept off DHT and PEX whatever the configuration.
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		want bool
+	}{
+		{"private", "d6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1ee", true},
+		{"private 0", "d6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei0ee", false},
+		{"no flag", "d6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae", false},
+	}
+	for _, tt := range tests {
+		var info metainfo.Info
+		if err := bencode.Unmarshal([]byte(tt.info), &info); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := isPrivate(&info); got != tt.want {
+			t.Errorf("%s: isPrivate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if isPrivate(nil) {
+		t.Error("isPrivate(nil) = true before the metadata is known")
+	}
+}
+
+// TestPausePerOwner pauses a torrent two users share: each row is paused
+// on its own, and the torrent only stops once both are
+func TestPausePerOwner(t *testing.T) {
+	tr, _, err := newTestClient(t).AddTorrentSpec(&torrent.TorrentSpec{
+		InfoHash: metainfo.NewHashFromHex("0123456789abcdef0123456789abcdef01234567"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idA, userA, idB, userB := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	mt := newManagedTorrent(idA, userA, tr)
+	mt.owners[idB] = userB
+	infoHash := tr.InfoHash().HexString()
+	e := &Engine{torrents: map[string]*ManagedTorrent{infoHash: mt}}
+
+	status := func(userID uuid.UUID) models.TorrentStatus {
+		t.Helper()
+		updates := e.GetUserTorrents(userID)
+		if len(updates) != 1 {
+			t.Fatalf("%d torrents, want 1", len(updates))
+		}
+		return updates[0].Status
+	}
+
+	if err := e.PauseTorrent(infoHash, idA); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(userA); got != models.TorrentStatusPaused {
+		t.Errorf("pausing owner sees %s, want paused", got)
+	}
+	if got := status(userB); got == models.TorrentStatusPaused {
+		t.Error("other owner's row paused too")
+	}
+	if mt.paused || mt.connLimit == 0 {
+		t.Error("torrent stopped while an owner still downloads it")
+	}
+
+	if err := e.PauseTorrent(infoHash, idB); err != nil {
+		t.Fatal(err)
+	}
+	if !mt.paused || mt.connLimit != 0 {
+		t.Error("torrent still running with every owner paused")
+	}
+
+	if err := e.ResumeTorrent(infoHash, idA); err != nil {
+		t.Fatal(err)
+	}
+	if mt.paused || status(userA) == models.TorrentStatusPaused || status(userB) != models.TorrentStatusPaused {
+		t.Error("resuming one owner didn't restart only that owner's row")
+	}
+
+	if err := e.RemoveOwner(infoHash, idA, false); err != nil {
+		t.Fatal(err)
+	}
+	if !mt.paused {
+		t.Error("torrent left running once its only downloading owner was removed")
+	}
+}
+
+// TestPauseAtPerOwner gives one owner of a shared torrent a bandwidth
+// budget: only that owner's updates carry it, and it goes with the owner
+func TestPauseAtPerOwner(t *testing.T) {
+	tr, _, err := newTestClient(t).AddTorrentSpec(&torrent.TorrentSpec{
+		InfoHash: metainfo.NewHashFromHex("0123456789abcdef0123456789abcdef01234567"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idA, userA, idB, userB := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	mt := newManagedTorrent(idA, userA, tr)
+	mt.owners[idB] = userB
+	infoHash := tr.InfoHash().HexString()
+	e := &Engine{torrents: map[string]*ManagedTorrent{infoHash: mt}}
+
+	pauseAt := func(userID uuid.UUID) int64 {
+		t.Helper()
+		updates := e.GetUserTorrents(userID)
+		if len(updates) != 1 {
+			t.Fatalf("%d torrents, want 1", len(updates))
+		}
+		return updates[0].PauseAt
+	}
+
+	e.SetPauseAt(infoHash, idA, 1<<20)
+	if got := pauseAt(userA); got != 1<<20 {
+		t.Errorf("owner with a budget sees pause at %d, want %d", got, 1<<20)
+	}
+	if got := pauseAt(userB); got != 0 {
+		t.Errorf("other owner held to a budget of %d", got)
+	}
+
+	if err := e.RemoveOwner(infoHash, idA, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(mt.pauseAt) != 0 {
+		t.Errorf("removed owner's budget kept: %v", mt.pauseAt)
+	}
+}
@@ -0,0 +1,1303 @@
+// The torrent engine as a service, so the HTTP API and the engine can run on
+// different machines. Regenerate the Go code after changing this file:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative engine.proto
+//
+// with protoc-gen-go v1.30.0 and protoc-gen-go-grpc v1.3.0.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: engine.proto
+
+package enginepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Engine_AddMagnet_FullMethodName             = "/freetorrent.engine.v1.Engine/AddMagnet"
+	Engine_AddTorrentFile_FullMethodName        = "/freetorrent.engine.v1.Engine/AddTorrentFile"
+	Engine_PreviewMagnet_FullMethodName         = "/freetorrent.engine.v1.Engine/PreviewMagnet"
+	Engine_ReloadTorrent_FullMethodName         = "/freetorrent.engine.v1.Engine/ReloadTorrent"
+	Engine_RemoveOwner_FullMethodName           = "/freetorrent.engine.v1.Engine/RemoveOwner"
+	Engine_RemoveTorrent_FullMethodName         = "/freetorrent.engine.v1.Engine/RemoveTorrent"
+	Engine_PauseTorrent_FullMethodName          = "/freetorrent.engine.v1.Engine/PauseTorrent"
+	Engine_ResumeTorrent_FullMethodName         = "/freetorrent.engine.v1.Engine/ResumeTorrent"
+	Engine_SetSeedRatio_FullMethodName          = "/freetorrent.engine.v1.Engine/SetSeedRatio"
+	Engine_SetPauseAt_FullMethodName            = "/freetorrent.engine.v1.Engine/SetPauseAt"
+	Engine_GetTorrentStatus_FullMethodName      = "/freetorrent.engine.v1.Engine/GetTorrentStatus"
+	Engine_GetActiveTorrents_FullMethodName     = "/freetorrent.engine.v1.Engine/GetActiveTorrents"
+	Engine_GetUserTorrents_FullMethodName       = "/freetorrent.engine.v1.Engine/GetUserTorrents"
+	Engine_GetUserAggregate_FullMethodName      = "/freetorrent.engine.v1.Engine/GetUserAggregate"
+	Engine_Settings_FullMethodName              = "/freetorrent.engine.v1.Engine/Settings"
+	Engine_MetadataQueue_FullMethodName         = "/freetorrent.engine.v1.Engine/MetadataQueue"
+	Engine_CreateTorrent_FullMethodName         = "/freetorrent.engine.v1.Engine/CreateTorrent"
+	Engine_ReloadCreated_FullMethodName         = "/freetorrent.engine.v1.Engine/ReloadCreated"
+	Engine_MetainfoFile_FullMethodName          = "/freetorrent.engine.v1.Engine/MetainfoFile"
+	Engine_Trackers_FullMethodName              = "/freetorrent.engine.v1.Engine/Trackers"
+	Engine_Health_FullMethodName                = "/freetorrent.engine.v1.Engine/Health"
+	Engine_Stalled_FullMethodName               = "/freetorrent.engine.v1.Engine/Stalled"
+	Engine_Restart_FullMethodName               = "/freetorrent.engine.v1.Engine/Restart"
+	Engine_ProbeDownloadDir_FullMethodName      = "/freetorrent.engine.v1.Engine/ProbeDownloadDir"
+	Engine_DiskError_FullMethodName             = "/freetorrent.engine.v1.Engine/DiskError"
+	Engine_ClearDiskError_FullMethodName        = "/freetorrent.engine.v1.Engine/ClearDiskError"
+	Engine_CheckPortReachability_FullMethodName = "/freetorrent.engine.v1.Engine/CheckPortReachability"
+	Engine_LastPortCheck_FullMethodName         = "/freetorrent.engine.v1.Engine/LastPortCheck"
+	Engine_SubscribeUpdates_FullMethodName      = "/freetorrent.engine.v1.Engine/SubscribeUpdates"
+	Engine_GetFileReader_FullMethodName         = "/freetorrent.engine.v1.Engine/GetFileReader"
+)
+
+// EngineClient is the client API for Engine service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EngineClient interface {
+	AddMagnet(ctx context.Context, in *AddMagnetRequest, opts ...grpc.CallOption) (*Value, error)
+	// The first message carries the IDs, the rest the .torrent file in chunks
+	AddTorrentFile(ctx context.Context, opts ...grpc.CallOption) (Engine_AddTorrentFileClient, error)
+	PreviewMagnet(ctx context.Context, in *PreviewMagnetRequest, opts ...grpc.CallOption) (*Value, error)
+	ReloadTorrent(ctx context.Context, in *ReloadTorrentRequest, opts ...grpc.CallOption) (*Empty, error)
+	RemoveOwner(ctx context.Context, in *RemoveOwnerRequest, opts ...grpc.CallOption) (*Empty, error)
+	RemoveTorrent(ctx context.Context, in *RemoveTorrentRequest, opts ...grpc.CallOption) (*Empty, error)
+	PauseTorrent(ctx context.Context, in *OwnerRequest, opts ...grpc.CallOption) (*Empty, error)
+	ResumeTorrent(ctx context.Context, in *OwnerRequest, opts ...grpc.CallOption) (*Empty, error)
+	SetSeedRatio(ctx context.Context, in *SetSeedRatioRequest, opts ...grpc.CallOption) (*Empty, error)
+	SetPauseAt(ctx context.Context, in *SetPauseAtRequest, opts ...grpc.CallOption) (*Empty, error)
+	GetTorrentStatus(ctx context.Context, in *TorrentRequest, opts ...grpc.CallOption) (*Value, error)
+	GetActiveTorrents(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	GetUserTorrents(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Value, error)
+	GetUserAggregate(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Value, error)
+	Settings(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	MetadataQueue(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	// root is under the shared download directory
+	CreateTorrent(ctx context.Context, in *CreateTorrentRequest, opts ...grpc.CallOption) (*Value, error)
+	ReloadCreated(ctx context.Context, in *ReloadCreatedRequest, opts ...grpc.CallOption) (*Empty, error)
+	// null when the engine doesn't have the torrent's metadata
+	MetainfoFile(ctx context.Context, in *TorrentRequest, opts ...grpc.CallOption) (*Value, error)
+	Trackers(ctx context.Context, in *TorrentRequest, opts ...grpc.CallOption) (*Value, error)
+	Health(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	Stalled(ctx context.Context, in *StalledRequest, opts ...grpc.CallOption) (*Value, error)
+	Restart(ctx context.Context, in *RestartRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Checks the download directory from the worker, which writes to it
+	ProbeDownloadDir(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+	// null when there is none
+	DiskError(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	ClearDiskError(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	CheckPortReachability(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	// null when no check has run
+	LastPortCheck(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error)
+	// Hands out the engine's updates. Each update goes to one subscriber, as
+	// the local channel does to one reader. The response header carries
+	// engine-instance, which changes when the worker restarts.
+	SubscribeUpdates(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Engine_SubscribeUpdatesClient, error)
+	// The first message carries only the file's size, the rest its data from
+	// offset on, unless size_only is set. Reads waiting for pieces end with
+	// the call.
+	GetFileReader(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (Engine_GetFileReaderClient, error)
+}
+
+type engineClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEngineClient(cc grpc.ClientConnInterface) EngineClient {
+	return &engineClient{cc}
+}
+
+func (c *engineClient) AddMagnet(ctx context.Context, in *AddMagnetRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_AddMagnet_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) AddTorrentFile(ctx context.Context, opts ...grpc.CallOption) (Engine_AddTorrentFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Engine_ServiceDesc.Streams[0], Engine_AddTorrentFile_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &engineAddTorrentFileClient{stream}
+	return x, nil
+}
+
+type Engine_AddTorrentFileClient interface {
+	Send(*AddTorrentFileRequest) error
+	CloseAndRecv() (*Value, error)
+	grpc.ClientStream
+}
+
+type engineAddTorrentFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *engineAddTorrentFileClient) Send(m *AddTorrentFileRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *engineAddTorrentFileClient) CloseAndRecv() (*Value, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Value)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *engineClient) PreviewMagnet(ctx context.Context, in *PreviewMagnetRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_PreviewMagnet_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) ReloadTorrent(ctx context.Context, in *ReloadTorrentRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_ReloadTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) RemoveOwner(ctx context.Context, in *RemoveOwnerRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_RemoveOwner_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) RemoveTorrent(ctx context.Context, in *RemoveTorrentRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_RemoveTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) PauseTorrent(ctx context.Context, in *OwnerRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_PauseTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) ResumeTorrent(ctx context.Context, in *OwnerRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_ResumeTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) SetSeedRatio(ctx context.Context, in *SetSeedRatioRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_SetSeedRatio_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) SetPauseAt(ctx context.Context, in *SetPauseAtRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_SetPauseAt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) GetTorrentStatus(ctx context.Context, in *TorrentRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_GetTorrentStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) GetActiveTorrents(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_GetActiveTorrents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) GetUserTorrents(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_GetUserTorrents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) GetUserAggregate(ctx context.Context, in *UserRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_GetUserAggregate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Settings(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_Settings_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) MetadataQueue(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_MetadataQueue_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) CreateTorrent(ctx context.Context, in *CreateTorrentRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_CreateTorrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) ReloadCreated(ctx context.Context, in *ReloadCreatedRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_ReloadCreated_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) MetainfoFile(ctx context.Context, in *TorrentRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_MetainfoFile_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Trackers(ctx context.Context, in *TorrentRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_Trackers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Health(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_Health_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Stalled(ctx context.Context, in *StalledRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_Stalled_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Restart(ctx context.Context, in *RestartRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_Restart_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) ProbeDownloadDir(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Engine_ProbeDownloadDir_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) DiskError(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_DiskError_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) ClearDiskError(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_ClearDiskError_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) CheckPortReachability(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_CheckPortReachability_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) LastPortCheck(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Engine_LastPortCheck_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) SubscribeUpdates(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Engine_SubscribeUpdatesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Engine_ServiceDesc.Streams[1], Engine_SubscribeUpdates_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &engineSubscribeUpdatesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Engine_SubscribeUpdatesClient interface {
+	Recv() (*Value, error)
+	grpc.ClientStream
+}
+
+type engineSubscribeUpdatesClient struct {
+	grpc.ClientStream
+}
+
+func (x *engineSubscribeUpdatesClient) Recv() (*Value, error) {
+	m := new(Value)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *engineClient) GetFileReader(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (Engine_GetFileReaderClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Engine_ServiceDesc.Streams[2], Engine_GetFileReader_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &engineGetFileReaderClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Engine_GetFileReaderClient interface {
+	Recv() (*FileChunk, error)
+	grpc.ClientStream
+}
+
+type engineGetFileReaderClient struct {
+	grpc.ClientStream
+}
+
+func (x *engineGetFileReaderClient) Recv() (*FileChunk, error) {
+	m := new(FileChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EngineServer is the server API for Engine service.
+// All implementations must embed UnimplementedEngineServer
+// for forward compatibility
+type EngineServer interface {
+	AddMagnet(context.Context, *AddMagnetRequest) (*Value, error)
+	// The first message carries the IDs, the rest the .torrent file in chunks
+	AddTorrentFile(Engine_AddTorrentFileServer) error
+	PreviewMagnet(context.Context, *PreviewMagnetRequest) (*Value, error)
+	ReloadTorrent(context.Context, *ReloadTorrentRequest) (*Empty, error)
+	RemoveOwner(context.Context, *RemoveOwnerRequest) (*Empty, error)
+	RemoveTorrent(context.Context, *RemoveTorrentRequest) (*Empty, error)
+	PauseTorrent(context.Context, *OwnerRequest) (*Empty, error)
+	ResumeTorrent(context.Context, *OwnerRequest) (*Empty, error)
+	SetSeedRatio(context.Context, *SetSeedRatioRequest) (*Empty, error)
+	SetPauseAt(context.Context, *SetPauseAtRequest) (*Empty, error)
+	GetTorrentStatus(context.Context, *TorrentRequest) (*Value, error)
+	GetActiveTorrents(context.Context, *Empty) (*Value, error)
+	GetUserTorrents(context.Context, *UserRequest) (*Value, error)
+	GetUserAggregate(context.Context, *UserRequest) (*Value, error)
+	Settings(context.Context, *Empty) (*Value, error)
+	MetadataQueue(context.Context, *Empty) (*Value, error)
+	// root is under the shared download directory
+	CreateTorrent(context.Context, *CreateTorrentRequest) (*Value, error)
+	ReloadCreated(context.Context, *ReloadCreatedRequest) (*Empty, error)
+	// null when the engine doesn't have the torrent's metadata
+	MetainfoFile(context.Context, *TorrentRequest) (*Value, error)
+	Trackers(context.Context, *TorrentRequest) (*Value, error)
+	Health(context.Context, *Empty) (*Value, error)
+	Stalled(context.Context, *StalledRequest) (*Value, error)
+	Restart(context.Context, *RestartRequest) (*Empty, error)
+	// Checks the download directory from the worker, which writes to it
+	ProbeDownloadDir(context.Context, *Empty) (*Empty, error)
+	// null when there is none
+	DiskError(context.Context, *Empty) (*Value, error)
+	ClearDiskError(context.Context, *Empty) (*Value, error)
+	CheckPortReachability(context.Context, *Empty) (*Value, error)
+	// null when no check has run
+	LastPortCheck(context.Context, *Empty) (*Value, error)
+	// Hands out the engine's updates. Each update goes to one subscriber, as
+	// the local channel does to one reader. The response header carries
+	// engine-instance, which changes when the worker restarts.
+	SubscribeUpdates(*Empty, Engine_SubscribeUpdatesServer) error
+	// The first message carries only the file's size, the rest its data from
+	// offset on, unless size_only is set. Reads waiting for pieces end with
+	// the call.
+	GetFileReader(*FileRequest, Engine_GetFileReaderServer) error
+	mustEmbedUnimplementedEngineServer()
+}
+
+// UnimplementedEngineServer must be embedded to have forward compatible implementations.
+type UnimplementedEngineServer struct {
+}
+
+func (UnimplementedEngineServer) AddMagnet(context.Context, *AddMagnetRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddMagnet not implemented")
+}
+func (UnimplementedEngineServer) AddTorrentFile(Engine_AddTorrentFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method AddTorrentFile not implemented")
+}
+func (UnimplementedEngineServer) PreviewMagnet(context.Context, *PreviewMagnetRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PreviewMagnet not implemented")
+}
+func (UnimplementedEngineServer) ReloadTorrent(context.Context, *ReloadTorrentRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReloadTorrent not implemented")
+}
+func (UnimplementedEngineServer) RemoveOwner(context.Context, *RemoveOwnerRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveOwner not implemented")
+}
+func (UnimplementedEngineServer) RemoveTorrent(context.Context, *RemoveTorrentRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveTorrent not implemented")
+}
+func (UnimplementedEngineServer) PauseTorrent(context.Context, *OwnerRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseTorrent not implemented")
+}
+func (UnimplementedEngineServer) ResumeTorrent(context.Context, *OwnerRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeTorrent not implemented")
+}
+func (UnimplementedEngineServer) SetSeedRatio(context.Context, *SetSeedRatioRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSeedRatio not implemented")
+}
+func (UnimplementedEngineServer) SetPauseAt(context.Context, *SetPauseAtRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPauseAt not implemented")
+}
+func (UnimplementedEngineServer) GetTorrentStatus(context.Context, *TorrentRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTorrentStatus not implemented")
+}
+func (UnimplementedEngineServer) GetActiveTorrents(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetActiveTorrents not implemented")
+}
+func (UnimplementedEngineServer) GetUserTorrents(context.Context, *UserRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserTorrents not implemented")
+}
+func (UnimplementedEngineServer) GetUserAggregate(context.Context, *UserRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserAggregate not implemented")
+}
+func (UnimplementedEngineServer) Settings(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Settings not implemented")
+}
+func (UnimplementedEngineServer) MetadataQueue(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MetadataQueue not implemented")
+}
+func (UnimplementedEngineServer) CreateTorrent(context.Context, *CreateTorrentRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateTorrent not implemented")
+}
+func (UnimplementedEngineServer) ReloadCreated(context.Context, *ReloadCreatedRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReloadCreated not implemented")
+}
+func (UnimplementedEngineServer) MetainfoFile(context.Context, *TorrentRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MetainfoFile not implemented")
+}
+func (UnimplementedEngineServer) Trackers(context.Context, *TorrentRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Trackers not implemented")
+}
+func (UnimplementedEngineServer) Health(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedEngineServer) Stalled(context.Context, *StalledRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stalled not implemented")
+}
+func (UnimplementedEngineServer) Restart(context.Context, *RestartRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restart not implemented")
+}
+func (UnimplementedEngineServer) ProbeDownloadDir(context.Context, *Empty) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProbeDownloadDir not implemented")
+}
+func (UnimplementedEngineServer) DiskError(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DiskError not implemented")
+}
+func (UnimplementedEngineServer) ClearDiskError(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClearDiskError not implemented")
+}
+func (UnimplementedEngineServer) CheckPortReachability(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckPortReachability not implemented")
+}
+func (UnimplementedEngineServer) LastPortCheck(context.Context, *Empty) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LastPortCheck not implemented")
+}
+func (UnimplementedEngineServer) SubscribeUpdates(*Empty, Engine_SubscribeUpdatesServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeUpdates not implemented")
+}
+func (UnimplementedEngineServer) GetFileReader(*FileRequest, Engine_GetFileReaderServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetFileReader not implemented")
+}
+func (UnimplementedEngineServer) mustEmbedUnimplementedEngineServer() {}
+
+// UnsafeEngineServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EngineServer will
+// result in compilation errors.
+type UnsafeEngineServer interface {
+	mustEmbedUnimplementedEngineServer()
+}
+
+func RegisterEngineServer(s grpc.ServiceRegistrar, srv EngineServer) {
+	s.RegisterService(&Engine_ServiceDesc, srv)
+}
+
+func _Engine_AddMagnet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddMagnetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).AddMagnet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_AddMagnet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).AddMagnet(ctx, req.(*AddMagnetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_AddTorrentFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EngineServer).AddTorrentFile(&engineAddTorrentFileServer{stream})
+}
+
+type Engine_AddTorrentFileServer interface {
+	SendAndClose(*Value) error
+	Recv() (*AddTorrentFileRequest, error)
+	grpc.ServerStream
+}
+
+type engineAddTorrentFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *engineAddTorrentFileServer) SendAndClose(m *Value) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *engineAddTorrentFileServer) Recv() (*AddTorrentFileRequest, error) {
+	m := new(AddTorrentFileRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Engine_PreviewMagnet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PreviewMagnetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).PreviewMagnet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_PreviewMagnet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).PreviewMagnet(ctx, req.(*PreviewMagnetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_ReloadTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadTorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).ReloadTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_ReloadTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).ReloadTorrent(ctx, req.(*ReloadTorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_RemoveOwner_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveOwnerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).RemoveOwner(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_RemoveOwner_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).RemoveOwner(ctx, req.(*RemoveOwnerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_RemoveTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveTorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).RemoveTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_RemoveTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).RemoveTorrent(ctx, req.(*RemoveTorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_PauseTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OwnerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).PauseTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_PauseTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).PauseTorrent(ctx, req.(*OwnerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_ResumeTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OwnerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).ResumeTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_ResumeTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).ResumeTorrent(ctx, req.(*OwnerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_SetSeedRatio_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetSeedRatioRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).SetSeedRatio(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_SetSeedRatio_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).SetSeedRatio(ctx, req.(*SetSeedRatioRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_SetPauseAt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPauseAtRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).SetPauseAt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_SetPauseAt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).SetPauseAt(ctx, req.(*SetPauseAtRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_GetTorrentStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).GetTorrentStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_GetTorrentStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).GetTorrentStatus(ctx, req.(*TorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_GetActiveTorrents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).GetActiveTorrents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_GetActiveTorrents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).GetActiveTorrents(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_GetUserTorrents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).GetUserTorrents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_GetUserTorrents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).GetUserTorrents(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_GetUserAggregate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).GetUserAggregate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_GetUserAggregate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).GetUserAggregate(ctx, req.(*UserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Settings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Settings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_Settings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Settings(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_MetadataQueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).MetadataQueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_MetadataQueue_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).MetadataQueue(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_CreateTorrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateTorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).CreateTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_CreateTorrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).CreateTorrent(ctx, req.(*CreateTorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_ReloadCreated_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadCreatedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).ReloadCreated(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_ReloadCreated_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).ReloadCreated(ctx, req.(*ReloadCreatedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_MetainfoFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).MetainfoFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_MetainfoFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).MetainfoFile(ctx, req.(*TorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Trackers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Trackers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_Trackers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Trackers(ctx, req.(*TorrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Health(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Stalled_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StalledRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Stalled(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_Stalled_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Stalled(ctx, req.(*StalledRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Restart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Restart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_Restart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Restart(ctx, req.(*RestartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_ProbeDownloadDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).ProbeDownloadDir(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_ProbeDownloadDir_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).ProbeDownloadDir(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_DiskError_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).DiskError(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_DiskError_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).DiskError(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_ClearDiskError_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).ClearDiskError(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_ClearDiskError_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).ClearDiskError(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_CheckPortReachability_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).CheckPortReachability(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_CheckPortReachability_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).CheckPortReachability(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_LastPortCheck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).LastPortCheck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Engine_LastPortCheck_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).LastPortCheck(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_SubscribeUpdates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EngineServer).SubscribeUpdates(m, &engineSubscribeUpdatesServer{stream})
+}
+
+type Engine_SubscribeUpdatesServer interface {
+	Send(*Value) error
+	grpc.ServerStream
+}
+
+type engineSubscribeUpdatesServer struct {
+	grpc.ServerStream
+}
+
+func (x *engineSubscribeUpdatesServer) Send(m *Value) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Engine_GetFileReader_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EngineServer).GetFileReader(m, &engineGetFileReaderServer{stream})
+}
+
+type Engine_GetFileReaderServer interface {
+	Send(*FileChunk) error
+	grpc.ServerStream
+}
+
+type engineGetFileReaderServer struct {
+	grpc.ServerStream
+}
+
+func (x *engineGetFileReaderServer) Send(m *FileChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Engine_ServiceDesc is the grpc.ServiceDesc for Engine service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Engine_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "freetorrent.engine.v1.Engine",
+	HandlerType: (*EngineServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddMagnet",
+			Handler:    _Engine_AddMagnet_Handler,
+		},
+		{
+			MethodName: "PreviewMagnet",
+			Handler:    _Engine_PreviewMagnet_Handler,
+		},
+		{
+			MethodName: "ReloadTorrent",
+			Handler:    _Engine_ReloadTorrent_Handler,
+		},
+		{
+			MethodName: "RemoveOwner",
+			Handler:    _Engine_RemoveOwner_Handler,
+		},
+		{
+			MethodName: "RemoveTorrent",
+			Handler:    _Engine_RemoveTorrent_Handler,
+		},
+		{
+			MethodName: "PauseTorrent",
+			Handler:    _Engine_PauseTorrent_Handler,
+		},
+		{
+			MethodName: "ResumeTorrent",
+			Handler:    _Engine_ResumeTorrent_Handler,
+		},
+		{
+			MethodName: "SetSeedRatio",
+			Handler:    _Engine_SetSeedRatio_Handler,
+		},
+		{
+			MethodName: "SetPauseAt",
+			Handler:    _Engine_SetPauseAt_Handler,
+		},
+		{
+			MethodName: "GetTorrentStatus",
+			Handler:    _Engine_GetTorrentStatus_Handler,
+		},
+		{
+			MethodName: "GetActiveTorrents",
+			Handler:    _Engine_GetActiveTorrents_Handler,
+		},
+		{
+			MethodName: "GetUserTorrents",
+			Handler:    _Engine_GetUserTorrents_Handler,
+		},
+		{
+			MethodName: "GetUserAggregate",
+			Handler:    _Engine_GetUserAggregate_Handler,
+		},
+		{
+			MethodName: "Settings",
+			Handler:    _Engine_Settings_Handler,
+		},
+		{
+			MethodName: "MetadataQueue",
+			Handler:    _Engine_MetadataQueue_Handler,
+		},
+		{
+			MethodName: "CreateTorrent",
+			Handler:    _Engine_CreateTorrent_Handler,
+		},
+		{
+			MethodName: "ReloadCreated",
+			Handler:    _Engine_ReloadCreated_Handler,
+		},
+		{
+			MethodName: "MetainfoFile",
+			Handler:    _Engine_MetainfoFile_Handler,
+		},
+		{
+			MethodName: "Trackers",
+			Handler:    _Engine_Trackers_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _Engine_Health_Handler,
+		},
+		{
+			MethodName: "Stalled",
+			Handler:    _Engine_Stalled_Handler,
+		},
+		{
+			MethodName: "Restart",
+			Handler:    _Engine_Restart_Handler,
+		},
+		{
+			MethodName: "ProbeDownloadDir",
+			Handler:    _Engine_ProbeDownloadDir_Handler,
+		},
+		{
+			MethodName: "DiskError",
+			Handler:    _Engine_DiskError_Handler,
+		},
+		{
+			MethodName: "ClearDiskError",
+			Handler:    _Engine_ClearDiskError_Handler,
+		},
+		{
+			MethodName: "CheckPortReachability",
+			Handler:    _Engine_CheckPortReachability_Handler,
+		},
+		{
+			MethodName: "LastPortCheck",
+			Handler:    _Engine_LastPortCheck_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AddTorrentFile",
+			Handler:       _Engine_AddTorrentFile_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "SubscribeUpdates",
+			Handler:       _Engine_SubscribeUpdates_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "GetFileReader",
+			Handler:       _Engine_GetFileReader_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "engine.proto",
+}
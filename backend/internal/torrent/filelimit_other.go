@@ -0,0 +1,9 @@
+//go:build !unix
+
+package torrent
+
+// raiseFileLimit can't read the open file limit here; the connection
+// budget isn't checked against it
+func raiseFileLimit() (uint64, error) {
+	return 0, errFileLimitUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package torrent
+
+import "syscall"
+
+// raiseFileLimit raises the soft open file limit to the hard limit, where
+// Go hasn't already, and returns the limit in effect
+func raiseFileLimit() (uint64, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	if lim.Cur < lim.Max {
+		raised := lim
+		raised.Cur = lim.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+			lim = raised
+		}
+	}
+	return uint64(lim.Cur), nil
+}
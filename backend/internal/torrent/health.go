@@ -0,0 +1,147 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrEngineUnavailable is returned when the torrent client failed to start or
+// is being restarted
+var ErrEngineUnavailable = errors.New("torrent engine is unavailable")
+
+// Restart tuning: how long Restart waits for a stuck call to let go of the
+// engine lock, and for the old client to close before abandoning it
+const (
+	restartLockTimeout = 10 * time.Second
+	clientCloseTimeout = 10 * time.Second
+)
+
+// EngineHealth describes the torrent client's state, for admins
+type EngineHealth struct {
+	Available         bool       `json:"available"`
+	Error             string     `json:"error,omitempty"` // why the client last failed to start
+	StartedAt         *time.Time `json:"started_at,omitempty"`
+	UptimeSeconds     int64      `json:"uptime_seconds"`
+	LastUpdateAt      *time.Time `json:"last_update_at,omitempty"`
+	Restarts          int        `json:"restarts"`
+	LastRestartAt     *time.Time `json:"last_restart_at,omitempty"`
+	LastRestartReason string     `json:"last_restart_reason,omitempty"`
+	Connections       ConnStats  `json:"connections"`
+	DiskError         *DiskError `json:"disk_error,omitempty"` // new torrents are refused while set
+}
+
+// start creates a torrent client and the update loop reporting on it, with
+// an empty set of torrents
+func (e *Engine) start() error {
+	client, settings, err := newClient(e.cfg)
+	if err != nil {
+		e.healthMu.Lock()
+		e.health.Error = err.Error()
+		e.healthMu.Unlock()
+		return err
+	}
+
+	e.mu.Lock()
+	e.client = client
+	e.settings = settings
+	e.torrents = make(map[string]*ManagedTorrent)
+	e.metadataSlots = make(chan struct{}, max(e.cfg.MetadataFetches, 1))
+	e.mu.Unlock()
+
+	now := time.Now()
+	e.healthMu.Lock()
+	e.health.Error = ""
+	e.health.StartedAt = &now
+	e.healthMu.Unlock()
+
+	e.lastTick.Store(now.UnixNano())
+	e.available.Store(true)
+	go e.updateLoop(e.loopGen.Add(1))
+	return nil
+}
+
+// Restart replaces the torrent client with a new one, for a client that
+// stopped responding or failed to start. Every torrent is dropped from the
+// engine, so the caller must reload them. Waiters of the old client's
+// torrents end as those torrents close. An old client that won't close is
+// abandoned, and may keep the listen port until the process exits, in which
+// case the new one fails to start and Restart should be tried again later.
+func (e *Engine) Restart(reason string) error {
+	e.available.Store(false)
+
+	now := time.Now()
+	e.healthMu.Lock()
+	e.health.Restarts++
+	e.health.LastRestartAt = &now
+	e.health.LastRestartReason = reason
+	e.healthMu.Unlock()
+
+	// A deadlocked client can leave a call stuck holding the lock
+	deadline := now.Add(restartLockTimeout)
+	for !e.mu.TryLock() {
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("engine lock still held after %s", restartLockTimeout)
+			e.healthMu.Lock()
+			e.health.Error = err.Error()
+			e.healthMu.Unlock()
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	old := e.client
+	e.client = nil
+	e.torrents = make(map[string]*ManagedTorrent)
+	e.mu.Unlock()
+
+	// The old loop exits if it ever wakes
+	e.loopGen.Add(1)
+
+	if old != nil {
+		closed := make(chan struct{})
+		go func() {
+			old.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(clientCloseTimeout):
+			log.Printf("Old torrent client did not close within %s, abandoning it", clientCloseTimeout)
+		}
+	}
+
+	return e.start()
+}
+
+// Available reports whether the torrent client is running. Adding torrents
+// fails with ErrEngineUnavailable while it isn't.
+func (e *Engine) Available() bool {
+	return e.available.Load()
+}
+
+// Stalled reports whether a running client's update loop hasn't finished a
+// pass for longer than after, a sign the client is stuck
+func (e *Engine) Stalled(after time.Duration) bool {
+	if !e.available.Load() || after <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, e.lastTick.Load())) > after
+}
+
+// Health returns the client's state without taking the engine lock, so it
+// answers even when the client is stuck
+func (e *Engine) Health() EngineHealth {
+	e.healthMu.Lock()
+	h := e.health
+	e.healthMu.Unlock()
+
+	h.Available = e.available.Load()
+	h.DiskError = e.diskError.Load()
+	if h.Available && h.StartedAt != nil {
+		h.UptimeSeconds = int64(time.Since(*h.StartedAt).Seconds())
+		lastUpdate := time.Unix(0, e.lastTick.Load())
+		h.LastUpdateAt = &lastUpdate
+	}
+	return h
+}
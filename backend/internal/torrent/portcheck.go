@@ -0,0 +1,198 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+)
+
+// portCheckTimeout bounds each step of a port check
+const portCheckTimeout = 4 * time.Second
+
+// Port check outcomes
+const (
+	PortOpen    = "open"
+	PortClosed  = "closed"
+	PortUnknown = "unknown"
+)
+
+// PortCheck is the result of checking whether the BitTorrent listen port
+// can be reached from the internet. Each address family the client uses is
+// checked on its own; the port is open if it is over either, and
+// ExternalIP is the IPv4 address when there is one.
+type PortCheck struct {
+	Status     string       `json:"status"` // open, closed or unknown
+	ExternalIP string       `json:"external_ip,omitempty"`
+	Port       int          `json:"port"`
+	CheckedAt  time.Time    `json:"checked_at"`
+	Error      string       `json:"error,omitempty"`
+	IPv4       *FamilyCheck `json:"ipv4,omitempty"`
+	IPv6       *FamilyCheck `json:"ipv6,omitempty"`
+}
+
+// FamilyCheck is a port check over one address family
+type FamilyCheck struct {
+	Status     string `json:"status"`
+	ExternalIP string `json:"external_ip,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CheckPortReachability finds the engine's external IPv4 and IPv6 addresses
+// from the echo service at PORT_CHECK_URL, which answers with the caller's
+// address as plain text, and connects to the listen port on each. Only the
+// families TORRENT_IP_FAMILY enables are checked, and the echo service
+// must answer over both for dual stack. The result is kept for
+// LastPortCheck.
+//
+// This relies on the router looping the connection back (hairpin NAT); one
+// that doesn't reports closed even when the port is forwarded, so "closed"
+// says to check forwarding rather than proving it missing.
+func (e *Engine) CheckPortReachability(ctx context.Context) PortCheck {
+	check := PortCheck{Status: PortUnknown, Port: e.listenPort(), CheckedAt: time.Now()}
+	defer func() {
+		e.portMu.Lock()
+		e.portCheck = &check
+		e.portMu.Unlock()
+	}()
+
+	if e.cfg.PortCheckURL == "" {
+		check.Error = "port checks are disabled"
+		return check
+	}
+	if check.Port == 0 {
+		check.Status = PortClosed
+		check.Error = "the client is not listening"
+		return check
+	}
+
+	if e.cfg.TorrentIPFamily != config.IPFamilyIPv6 {
+		check.IPv4 = checkFamily(ctx, e.cfg.PortCheckURL, "tcp4", check.Port)
+	}
+	if e.cfg.TorrentIPFamily != config.IPFamilyIPv4 {
+		check.IPv6 = checkFamily(ctx, e.cfg.PortCheckURL, "tcp6", check.Port)
+	}
+
+	var errs []string
+	for _, f := range []struct {
+		name  string
+		check *FamilyCheck
+	}{{"IPv4", check.IPv4}, {"IPv6", check.IPv6}} {
+		if f.check == nil {
+			continue
+		}
+		switch {
+		case f.check.Status == PortOpen:
+			check.Status = PortOpen
+		case f.check.Status == PortClosed && check.Status == PortUnknown:
+			check.Status = PortClosed
+		}
+		if check.ExternalIP == "" {
+			check.ExternalIP = f.check.ExternalIP
+		}
+		if f.check.Error != "" {
+			errs = append(errs, f.name+": "+f.check.Error)
+		}
+	}
+	if check.Status != PortOpen {
+		check.Error = strings.Join(errs, "; ")
+	}
+	return check
+}
+
+// checkFamily checks the listen port over one address family, network
+// being "tcp4" or "tcp6"
+func checkFamily(ctx context.Context, echoURL, network string, port int) *FamilyCheck {
+	check := &FamilyCheck{Status: PortUnknown}
+	ip, err := externalIP(ctx, echoURL, network)
+	if err != nil {
+		check.Error = "failed to find the external IP: " + err.Error()
+		return check
+	}
+	check.ExternalIP = ip.String()
+
+	dialer := net.Dialer{Timeout: portCheckTimeout}
+	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		check.Status = PortClosed
+		check.Error = err.Error()
+		return check
+	}
+	conn.Close()
+	check.Status = PortOpen
+	return check
+}
+
+// LastPortCheck returns the most recent port check, or nil if none has run
+func (e *Engine) LastPortCheck() *PortCheck {
+	e.portMu.Lock()
+	defer e.portMu.Unlock()
+	if e.portCheck == nil {
+		return nil
+	}
+	check := *e.portCheck
+	return &check
+}
+
+// listenPort is the port the client accepts peers on, 0 if none
+func (e *Engine) listenPort() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.client == nil {
+		return e.cfg.DefaultPort
+	}
+	for _, addr := range e.client.ListenAddrs() {
+		if tcp, ok := addr.(*net.TCPAddr); ok {
+			return tcp.Port
+		}
+	}
+	return e.cfg.DefaultPort
+}
+
+// externalIP asks an echo service for the address it sees us coming from
+// over network, "tcp4" or "tcp6"
+func externalIP(ctx context.Context, echoURL, network string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, portCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, echoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defer transport.CloseIdleConnections()
+	dialer := net.Dialer{Timeout: portCheckTimeout}
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("echo service returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, errors.New("echo service did not return an IP address")
+	}
+	// A NAT64 gateway or a single-stack echo service can answer with the
+	// other family
+	if (ip.To4() != nil) != (network == "tcp4") {
+		return nil, fmt.Errorf("echo service returned %s over %s", ip, network)
+	}
+	return ip, nil
+}
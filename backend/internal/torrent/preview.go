@@ -0,0 +1,190 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/freetorrent/freetorrent/internal/models"
+)
+
+// previewTimeout caps how long a preview waits for a magnet's metadata
+const previewTimeout = 60 * time.Second
+
+// previewCacheTTL is how long a resolved preview is served from cache
+const previewCacheTTL = time.Hour
+
+// ErrPreviewTimeout is returned when a magnet's metadata doesn't arrive
+// within previewTimeout
+var ErrPreviewTimeout = errors.New("timed out waiting for torrent metadata")
+
+// previewCall is one magnet preview, resolving or cached. preview and err
+// are set before done is closed; expires is guarded by Engine.previewMu.
+type previewCall struct {
+	done    chan struct{}
+	preview *models.TorrentPreview
+	err     error
+	expires time.Time
+}
+
+// PreviewMagnet returns a magnet's name, size and files without downloading
+// it. Metadata is fetched by a short session of its own, or read from the
+// engine's torrent when it already has one, and cached by info hash for
+// previewCacheTTL. Concurrent previews of the same magnet share one fetch,
+// which outlives ctx: a caller that gives up leaves it to warm the cache.
+func (e *Engine) PreviewMagnet(ctx context.Context, magnetURI string) (*models.TorrentPreview, error) {
+	if isV2OnlyMagnet(magnetURI) {
+		return nil, ErrV2NotSupported
+	}
+	m, err := metainfo.ParseMagnetUri(magnetURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet URI: %w", err)
+	}
+	infoHash := m.InfoHash.HexString()
+
+	now := time.Now()
+	e.previewMu.Lock()
+	call, ok := e.previews[infoHash]
+	if !ok || (!call.expires.IsZero() && now.After(call.expires)) {
+		for hash, c := range e.previews {
+			if !c.expires.IsZero() && now.After(c.expires) {
+				delete(e.previews, hash)
+			}
+		}
+		call = &previewCall{done: make(chan struct{})}
+		e.previews[infoHash] = call
+		go e.resolvePreview(infoHash, magnetURI, call)
+	}
+	e.previewMu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	preview := *call.preview
+	return &preview, nil
+}
+
+// resolvePreview runs a preview fetch and caches its result; failures
+// aren't cached so the next preview tries again
+func (e *Engine) resolvePreview(infoHash, magnetURI string, call *previewCall) {
+	call.preview, call.err = e.fetchPreview(infoHash, magnetURI)
+
+	e.previewMu.Lock()
+	if call.err != nil {
+		delete(e.previews, infoHash)
+	} else {
+		call.expires = time.Now().Add(previewCacheTTL)
+	}
+	e.previewMu.Unlock()
+	close(call.done)
+}
+
+// fetchPreview waits up to previewTimeout for a magnet's metadata. A torrent
+// the engine already manages is waited on as is; otherwise the magnet is
+// added without DownloadAll, holding a metadata fetch slot, and dropped
+// again once its info arrives.
+func (e *Engine) fetchPreview(infoHash, magnetURI string) (*models.TorrentPreview, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, previewTimeout)
+	defer cancel()
+
+	e.mu.RLock()
+	mt, managed := e.torrents[infoHash]
+	slots := e.metadataSlots
+	e.mu.RUnlock()
+	if managed {
+		return waitPreview(ctx, infoHash, mt.Torrent)
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrPreviewTimeout
+	}
+	defer func() { <-slots }()
+
+	// Checked again under the lock: a user may have added it meanwhile, and
+	// the client would hand back their torrent, trackers merged
+	e.mu.Lock()
+	if mt, ok := e.torrents[infoHash]; ok {
+		e.mu.Unlock()
+		return waitPreview(ctx, infoHash, mt.Torrent)
+	}
+	if e.client == nil {
+		e.mu.Unlock()
+		return nil, ErrEngineUnavailable
+	}
+	t, err := e.client.AddMagnet(magnetURI)
+	e.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to add magnet: %w", err)
+	}
+	defer e.dropPreview(infoHash, t)
+
+	return waitPreview(ctx, infoHash, t)
+}
+
+// dropPreview drops a preview session, unless a user added the same
+// torrent while it ran and it is now theirs
+func (e *Engine) dropPreview(infoHash string, t *torrent.Torrent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if mt, ok := e.torrents[infoHash]; ok && mt.Torrent == t {
+		return
+	}
+	t.Drop()
+}
+
+// waitPreview waits for t's info until ctx ends
+func waitPreview(ctx context.Context, infoHash string, t *torrent.Torrent) (*models.TorrentPreview, error) {
+	select {
+	case <-t.GotInfo():
+		return newPreview(infoHash, t.Info()), nil
+	case <-t.Closed():
+		return nil, errors.New("torrent was removed during preview")
+	case <-ctx.Done():
+		return nil, ErrPreviewTimeout
+	}
+}
+
+// PreviewTorrentFile describes a .torrent file without adding it
+func PreviewTorrentFile(data []byte) (*models.TorrentPreview, error) {
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent: %w", err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent info: %w", err)
+	}
+	if metaVersion(mi.InfoBytes) == "v2" {
+		return nil, ErrV2NotSupported
+	}
+	return newPreview(mi.HashInfoBytes().HexString(), &info), nil
+}
+
+// newPreview describes a torrent from its info dictionary
+func newPreview(infoHash string, info *metainfo.Info) *models.TorrentPreview {
+	preview := &models.TorrentPreview{
+		InfoHash:  infoHash,
+		Name:      info.Name,
+		TotalSize: info.TotalLength(),
+		IsPrivate: isPrivate(info),
+	}
+	for _, f := range info.UpvertedFiles() {
+		preview.Files = append(preview.Files, models.TorrentFile{
+			Path:     f.DisplayPath(info),
+			Size:     f.Length,
+			Priority: 2, // normal
+		})
+	}
+	return preview
+}
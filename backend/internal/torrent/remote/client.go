@@ -0,0 +1,718 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/torrent/enginepb"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// callTimeout bounds each unary call to the engine
+	callTimeout = 30 * time.Second
+
+	// Health is checked this often, and given this long, to keep Available
+	// current without a call per request
+	healthInterval = 5 * time.Second
+	healthTimeout  = 5 * time.Second
+
+	// Resubscription backoff after the update stream drops
+	minResubscribeDelay = time.Second
+	maxResubscribeDelay = 30 * time.Second
+)
+
+// Client is a torrent.Service running on an engine served by NewServer.
+// Updates are subscribed to from the first call to Updates, and
+// resubscribed after the stream drops; a new engine instance behind the
+// stream, a restarted worker, is reported to the OnRestart callback.
+type Client struct {
+	conn        *grpc.ClientConn
+	engine      enginepb.EngineClient
+	downloadDir string
+
+	// Reader presets, from the API's own configuration
+	streamReadahead   int64
+	downloadReadahead int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	subscribe sync.Once
+	updates   chan torrent.TorrentUpdate
+	onRestart func()
+
+	available     atomic.Bool               // as of the last health check
+	lastRestartAt atomic.Pointer[time.Time] // of a Restart that didn't reach the worker
+}
+
+var _ torrent.Service = (*Client)(nil)
+
+// Dial returns a client of the engine at cfg.EngineAddr, authenticating
+// with cfg.EngineToken. The connection is made lazily and remade as needed.
+// cfg.DownloadDir is where the API sees the engine's DOWNLOAD_DIR.
+func Dial(cfg *config.Config) (*Client, error) {
+	conn, err := grpc.Dial(cfg.EngineAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(tokenCredentials(cfg.EngineToken)),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		conn:              conn,
+		engine:            enginepb.NewEngineClient(conn),
+		downloadDir:       cfg.DownloadDir,
+		streamReadahead:   int64(cfg.StreamReadaheadMB) << 20,
+		downloadReadahead: int64(cfg.DownloadReadaheadMB) << 20,
+		ctx:               ctx,
+		cancel:            cancel,
+		updates:           make(chan torrent.TorrentUpdate, 100),
+	}
+	c.Health()
+	go c.watchHealth()
+	return c, nil
+}
+
+// tokenCredentials sends the engine token with every call. The engine is
+// reached over a private network, so no transport security is required.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool { return false }
+
+// OnRestart sets fn to run, in its own goroutine, when the update stream
+// finds a different engine instance than before. Set it before the first
+// call to Updates.
+func (c *Client) OnRestart(fn func()) {
+	c.onRestart = fn
+}
+
+// Close stops the update subscription and closes the connection
+func (c *Client) Close() {
+	c.cancel()
+	c.conn.Close()
+}
+
+// Context returns the client's lifecycle context, cancelled by Close
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+// Updates returns the channel of the engine's updates, closed by Close
+func (c *Client) Updates() <-chan torrent.TorrentUpdate {
+	c.subscribe.Do(func() { go c.subscribeUpdates() })
+	return c.updates
+}
+
+// subscribeUpdates feeds the updates channel from the engine's update
+// stream until Close, resubscribing with backoff whenever it drops
+func (c *Client) subscribeUpdates() {
+	defer close(c.updates)
+
+	var instance string
+	delay := minResubscribeDelay
+	for {
+		stream, err := c.engine.SubscribeUpdates(c.ctx, &enginepb.Empty{}, grpc.WaitForReady(true))
+		var header metadata.MD
+		if err == nil {
+			header, err = stream.Header()
+		}
+		if err == nil {
+			if id := header.Get(instanceHeader); len(id) > 0 && id[0] != instance {
+				if instance != "" && c.onRestart != nil {
+					log.Printf("Torrent engine restarted")
+					go c.onRestart()
+				}
+				instance = id[0]
+			}
+			delay = minResubscribeDelay
+			err = c.receiveUpdates(stream)
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Engine update stream failed, resubscribing in %s: %v", delay, err)
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxResubscribeDelay)
+	}
+}
+
+func (c *Client) receiveUpdates(stream enginepb.Engine_SubscribeUpdatesClient) error {
+	for {
+		v, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		var update torrent.TorrentUpdate
+		if err := json.Unmarshal(v.Json, &update); err != nil {
+			log.Printf("Dropping undecodable engine update: %v", err)
+			continue
+		}
+		select {
+		case c.updates <- update:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+// decode unwraps a call's Value into out, translating its error
+func decode(v *enginepb.Value, err error, out interface{}) error {
+	if err != nil {
+		return fromStatus(err)
+	}
+	return json.Unmarshal(v.Json, out)
+}
+
+func (c *Client) AddMagnet(ctx context.Context, id, userID uuid.UUID, magnetURI string) (*torrent.TorrentUpdate, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	var update torrent.TorrentUpdate
+	v, err := c.engine.AddMagnet(ctx, &enginepb.AddMagnetRequest{
+		Id: id.String(), UserId: userID.String(), MagnetUri: magnetURI,
+	})
+	if err := decode(v, err, &update); err != nil {
+		return nil, err
+	}
+	return &update, nil
+}
+
+// AddTorrentFile streams the .torrent file to the engine in chunks
+func (c *Client) AddTorrentFile(ctx context.Context, id, userID uuid.UUID, reader io.Reader) (*torrent.TorrentUpdate, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	stream, err := c.engine.AddTorrentFile(ctx)
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	err = stream.Send(&enginepb.AddTorrentFileRequest{Id: id.String(), UserId: userID.String()})
+	for err == nil {
+		// Sent messages may be read after Send returns, so each gets its own buffer
+		chunk := make([]byte, 64*1024)
+		n, rerr := reader.Read(chunk)
+		if n > 0 {
+			err = stream.Send(&enginepb.AddTorrentFileRequest{Chunk: chunk[:n]})
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+
+	// A failed Send means the stream ended; the reason comes with CloseAndRecv
+	var update torrent.TorrentUpdate
+	v, err := stream.CloseAndRecv()
+	if err := decode(v, err, &update); err != nil {
+		return nil, err
+	}
+	return &update, nil
+}
+
+func (c *Client) PreviewMagnet(ctx context.Context, magnetURI string) (*models.TorrentPreview, error) {
+	var preview models.TorrentPreview
+	v, err := c.engine.PreviewMagnet(ctx, &enginepb.PreviewMagnetRequest{MagnetUri: magnetURI})
+	if err := decode(v, err, &preview); err != nil {
+		return nil, err
+	}
+	return &preview, nil
+}
+
+func (c *Client) ReloadTorrent(ctx context.Context, id, userID uuid.UUID, magnetURI, infoHash string, status models.TorrentStatus) error {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.ReloadTorrent(ctx, &enginepb.ReloadTorrentRequest{
+		Id: id.String(), UserId: userID.String(), MagnetUri: magnetURI, InfoHash: infoHash, Status: string(status),
+	})
+	return fromStatus(err)
+}
+
+func (c *Client) RemoveOwner(infoHash string, id uuid.UUID, deleteFiles bool) error {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.RemoveOwner(ctx, &enginepb.RemoveOwnerRequest{
+		InfoHash: infoHash, Id: id.String(), DeleteFiles: deleteFiles,
+	})
+	return fromStatus(err)
+}
+
+func (c *Client) RemoveTorrent(infoHash string, deleteFiles bool) error {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.RemoveTorrent(ctx, &enginepb.RemoveTorrentRequest{InfoHash: infoHash, DeleteFiles: deleteFiles})
+	return fromStatus(err)
+}
+
+func (c *Client) PauseTorrent(infoHash string, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.PauseTorrent(ctx, &enginepb.OwnerRequest{InfoHash: infoHash, Id: id.String()})
+	return fromStatus(err)
+}
+
+func (c *Client) ResumeTorrent(infoHash string, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.ResumeTorrent(ctx, &enginepb.OwnerRequest{InfoHash: infoHash, Id: id.String()})
+	return fromStatus(err)
+}
+
+func (c *Client) SetSeedRatio(infoHash string, ratio float64) {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	if _, err := c.engine.SetSeedRatio(ctx, &enginepb.SetSeedRatioRequest{InfoHash: infoHash, Ratio: ratio}); err != nil {
+		log.Printf("Failed to set seed ratio of %s on the engine: %v", infoHash, fromStatus(err))
+	}
+}
+
+func (c *Client) SetPauseAt(infoHash string, id uuid.UUID, downloaded int64) {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	req := &enginepb.SetPauseAtRequest{InfoHash: infoHash, Id: id.String(), Downloaded: downloaded}
+	if _, err := c.engine.SetPauseAt(ctx, req); err != nil {
+		log.Printf("Failed to set pause budget of %s on the engine: %v", infoHash, fromStatus(err))
+	}
+}
+
+// Available reports whether the engine was reachable and running at the
+// last health check, at most healthInterval ago
+func (c *Client) Available() bool {
+	return c.available.Load()
+}
+
+// watchHealth keeps Available current until Close
+func (c *Client) watchHealth() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.Health()
+		}
+	}
+}
+
+// Health returns the engine's health. An unreachable worker is reported as
+// unavailable, with the time of the last Restart that failed to reach it so
+// the watchdog paces its retries as it does for a local engine.
+func (c *Client) Health() torrent.EngineHealth {
+	ctx, cancel := context.WithTimeout(c.ctx, healthTimeout)
+	defer cancel()
+
+	var health torrent.EngineHealth
+	v, err := c.engine.Health(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &health); err != nil {
+		health = torrent.EngineHealth{
+			Error:         "engine worker unreachable: " + err.Error(),
+			LastRestartAt: c.lastRestartAt.Load(),
+		}
+	}
+	c.available.Store(health.Available)
+	return health
+}
+
+// Stalled asks the engine, so the stall is timed by the worker's clock
+func (c *Client) Stalled(after time.Duration) bool {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var stalled bool
+	v, err := c.engine.Stalled(ctx, &enginepb.StalledRequest{AfterNanos: int64(after)})
+	if err := decode(v, err, &stalled); err != nil {
+		// Health reports an unreachable worker
+		return false
+	}
+	return stalled
+}
+
+// Restart restarts the worker's torrent client. It has no deadline of its
+// own, since the engine bounds its waits for the old client.
+func (c *Client) Restart(reason string) error {
+	_, err := c.engine.Restart(c.ctx, &enginepb.RestartRequest{Reason: reason})
+	if err != nil && status.Code(err) == codes.Unavailable {
+		now := time.Now()
+		c.lastRestartAt.Store(&now)
+	}
+	c.Health()
+	return fromStatus(err)
+}
+
+func (c *Client) ProbeDownloadDir() error {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.ProbeDownloadDir(ctx, &enginepb.Empty{})
+	return fromStatus(err)
+}
+
+// DiskError returns nil while the engine can't be reached; Available
+// reports that
+func (c *Client) DiskError() *torrent.DiskError {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var diskErr *torrent.DiskError
+	v, err := c.engine.DiskError(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &diskErr); err != nil {
+		return nil
+	}
+	return diskErr
+}
+
+func (c *Client) ClearDiskError() *torrent.DiskError {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var diskErr *torrent.DiskError
+	v, err := c.engine.ClearDiskError(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &diskErr); err != nil {
+		log.Printf("Failed to clear the engine's disk error: %v", err)
+		return nil
+	}
+	return diskErr
+}
+
+// CreateTorrent has no deadline, since hashing takes as long as the data
+// is large
+func (c *Client) CreateTorrent(id, userID uuid.UUID, root string, opts torrent.CreateOptions) (*torrent.CreatedTorrent, error) {
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	var created torrent.CreatedTorrent
+	v, err := c.engine.CreateTorrent(c.ctx, &enginepb.CreateTorrentRequest{
+		Id: id.String(), UserId: userID.String(), Root: root, Options: options,
+	})
+	if err := decode(v, err, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) ReloadCreated(id, userID uuid.UUID, data []byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	_, err := c.engine.ReloadCreated(ctx, &enginepb.ReloadCreatedRequest{
+		Id: id.String(), UserId: userID.String(), Metainfo: data,
+	})
+	return fromStatus(err)
+}
+
+func (c *Client) MetainfoFile(infoHash string) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var data []byte
+	v, err := c.engine.MetainfoFile(ctx, &enginepb.TorrentRequest{InfoHash: infoHash})
+	if err := decode(v, err, &data); err != nil {
+		log.Printf("Failed to fetch the torrent file of %s from the engine: %v", infoHash, err)
+		return nil, false
+	}
+	return data, data != nil
+}
+
+func (c *Client) Trackers(infoHash string) ([]torrent.TrackerStatus, bool) {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var trackers []torrent.TrackerStatus
+	v, err := c.engine.Trackers(ctx, &enginepb.TorrentRequest{InfoHash: infoHash})
+	if err := decode(v, err, &trackers); err != nil {
+		log.Printf("Failed to fetch the trackers of %s from the engine: %v", infoHash, err)
+		return nil, false
+	}
+	return trackers, trackers != nil
+}
+
+func (c *Client) GetTorrentStatus(infoHash string) (*torrent.TorrentUpdate, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var update torrent.TorrentUpdate
+	v, err := c.engine.GetTorrentStatus(ctx, &enginepb.TorrentRequest{InfoHash: infoHash})
+	if err := decode(v, err, &update); err != nil {
+		return nil, err
+	}
+	return &update, nil
+}
+
+// GetActiveTorrents returns nil when the engine can't be reached
+func (c *Client) GetActiveTorrents() []torrent.TorrentUpdate {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var updates []torrent.TorrentUpdate
+	v, err := c.engine.GetActiveTorrents(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &updates); err != nil {
+		log.Printf("Failed to list the engine's torrents: %v", err)
+		return nil
+	}
+	return updates
+}
+
+// GetUserTorrents returns nil when the engine can't be reached, leaving
+// callers with the stored state
+func (c *Client) GetUserTorrents(userID uuid.UUID) []torrent.TorrentUpdate {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var updates []torrent.TorrentUpdate
+	v, err := c.engine.GetUserTorrents(ctx, &enginepb.UserRequest{UserId: userID.String()})
+	if err := decode(v, err, &updates); err != nil {
+		log.Printf("Failed to list the engine's torrents of user %s: %v", userID, err)
+		return nil
+	}
+	return updates
+}
+
+// GetUserAggregate returns zeros while the engine can't be reached, as the
+// local engine does while unavailable
+func (c *Client) GetUserAggregate(userID uuid.UUID) torrent.UserAggregate {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var aggregate torrent.UserAggregate
+	v, err := c.engine.GetUserAggregate(ctx, &enginepb.UserRequest{UserId: userID.String()})
+	if err := decode(v, err, &aggregate); err != nil {
+		return torrent.UserAggregate{}
+	}
+	return aggregate
+}
+
+func (c *Client) Settings() torrent.EngineSettings {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var settings torrent.EngineSettings
+	v, err := c.engine.Settings(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &settings); err != nil {
+		log.Printf("Failed to read the engine's settings: %v", err)
+	}
+	return settings
+}
+
+func (c *Client) MetadataQueue() torrent.MetadataQueueStats {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var stats torrent.MetadataQueueStats
+	v, err := c.engine.MetadataQueue(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &stats); err != nil {
+		log.Printf("Failed to read the engine's metadata queue: %v", err)
+	}
+	return stats
+}
+
+// CheckPortReachability runs the check on the engine's machine, whose port
+// is the one peers connect to
+func (c *Client) CheckPortReachability(ctx context.Context) torrent.PortCheck {
+	check := torrent.PortCheck{Status: torrent.PortUnknown, CheckedAt: time.Now()}
+	v, err := c.engine.CheckPortReachability(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &check); err != nil {
+		check.Error = "failed to reach the engine: " + err.Error()
+	}
+	return check
+}
+
+func (c *Client) LastPortCheck() *torrent.PortCheck {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	var check *torrent.PortCheck
+	v, err := c.engine.LastPortCheck(ctx, &enginepb.Empty{})
+	if err := decode(v, err, &check); err != nil {
+		log.Printf("Failed to read the engine's port check: %v", err)
+		return nil
+	}
+	return check
+}
+
+// MeasureDownloaded asks the engine, falling back to the shared download
+// directory when it doesn't have the torrent
+func (c *Client) MeasureDownloaded(infoHash string, files []models.TorrentFile) (int64, string) {
+	if status, err := c.GetTorrentStatus(infoHash); err == nil && status.TotalSize > 0 {
+		return status.Downloaded, "engine"
+	}
+	return torrent.BytesOnDisk(c.downloadDir, infoHash, files), "disk"
+}
+
+// GetDownloadDir returns the engine's download directory as the API sees it
+func (c *Client) GetDownloadDir() string {
+	return c.downloadDir
+}
+
+// TorrentDir returns the directory a torrent's files and zip are stored in
+func (c *Client) TorrentDir(infoHash string) string {
+	return torrent.DataDir(c.downloadDir, infoHash)
+}
+
+// StreamReaderOptions are the engine's presets for readers that seek; see
+// torrent.Engine.StreamReaderOptions
+func (c *Client) StreamReaderOptions() torrent.ReaderOptions {
+	return torrent.ReaderOptions{Readahead: c.streamReadahead, Responsive: true, Context: c.ctx}
+}
+
+// DownloadReaderOptions are the engine's presets for readers that go
+// through a file
+func (c *Client) DownloadReaderOptions() torrent.ReaderOptions {
+	return torrent.ReaderOptions{Readahead: c.downloadReadahead, Context: c.ctx}
+}
+
+// GetFileReader returns a reader streaming the file from the engine. Only
+// the size is fetched up front; data is streamed from the first Read, and
+// again from the new offset after a Seek, so the engine prioritizes the
+// pieces actually read. Streams end with opts.Context.
+func (c *Client) GetFileReader(infoHash, relativePath string, opts torrent.ReaderOptions) (io.ReadSeekCloser, int64, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, callTimeout)
+	defer cancel()
+
+	if opts.Context == nil {
+		opts.Context = c.ctx
+	}
+	r := &fileReader{client: c, infoHash: infoHash, path: relativePath, opts: opts}
+	stream, err := c.engine.GetFileReader(ctx, &enginepb.FileRequest{
+		InfoHash: infoHash, Path: relativePath, SizeOnly: true,
+		Readahead: opts.Readahead, Responsive: opts.Responsive,
+	})
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+	r.size = first.Size
+	return r, r.size, nil
+}
+
+// fileReader reads a file through GetFileReader streams. Close ends the
+// open stream.
+type fileReader struct {
+	client   *Client
+	infoHash string
+	path     string
+	opts     torrent.ReaderOptions
+	size     int64
+	pos      int64
+
+	stream enginepb.Engine_GetFileReaderClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *fileReader) open() error {
+	ctx, cancel := context.WithCancel(r.opts.Context)
+	req := &enginepb.FileRequest{
+		InfoHash: r.infoHash, Path: r.path, Offset: r.pos,
+		Readahead: r.opts.Readahead, Responsive: r.opts.Responsive,
+	}
+	stream, err := r.client.engine.GetFileReader(ctx, req)
+	if err == nil {
+		// Skip the size
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		cancel()
+		return fromStatus(err)
+	}
+	r.stream, r.cancel = stream, cancel
+	return nil
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.stream == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	for len(r.buf) == 0 {
+		chunk, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, fromStatus(err)
+		}
+		r.buf = chunk.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	if pos != r.pos {
+		r.Close()
+		r.pos = pos
+	}
+	return pos, nil
+}
+
+func (r *fileReader) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.stream, r.cancel, r.buf = nil, nil, nil
+	return nil
+}
@@ -0,0 +1,77 @@
+package remote
+
+import (
+	"context"
+	"errors"
+
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/torrent/enginepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sentinels are the torrent package's errors that callers match with
+// errors.Is, by the name they travel under
+var sentinels = map[string]error{
+	"private_torrent_in_use": torrent.ErrPrivateTorrentInUse,
+	"v2_not_supported":       torrent.ErrV2NotSupported,
+	"preview_timeout":        torrent.ErrPreviewTimeout,
+	"content_active":         torrent.ErrContentActive,
+	"engine_unavailable":     torrent.ErrEngineUnavailable,
+}
+
+// remoteError is an engine error received over the wire: the engine's
+// message, matching the sentinel it wrapped if any
+type remoteError struct {
+	msg      string
+	sentinel error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.sentinel }
+
+// toStatus turns an engine error into a gRPC status, naming its sentinel
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	for name, sentinel := range sentinels {
+		if errors.Is(err, sentinel) {
+			st := status.New(codes.FailedPrecondition, err.Error())
+			if detailed, derr := st.WithDetails(&enginepb.ErrorKind{Name: name}); derr == nil {
+				st = detailed
+			}
+			return st.Err()
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// fromStatus turns an error returned by a call into what the local engine
+// would have returned
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	switch st.Code() {
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+	rerr := &remoteError{msg: st.Message()}
+	// An unreachable worker is as unavailable as a failed client
+	if st.Code() == codes.Unavailable {
+		rerr.sentinel = torrent.ErrEngineUnavailable
+	}
+	for _, detail := range st.Details() {
+		if kind, ok := detail.(*enginepb.ErrorKind); ok {
+			rerr.sentinel = sentinels[kind.Name]
+		}
+	}
+	return rerr
+}
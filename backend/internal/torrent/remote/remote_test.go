@@ -0,0 +1,456 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+)
+
+const testToken = "secret"
+
+// fakeEngine is a torrent.Service serving files from memory
+type fakeEngine struct {
+	updates chan torrent.TorrentUpdate
+	files   map[string][]byte
+	err     error // returned by AddMagnet
+	diskErr *torrent.DiskError
+	added   chan []byte
+	pauseAt map[string]int64 // info hash/owner ID -> bytes
+}
+
+func newFakeEngine() *fakeEngine {
+	return &fakeEngine{
+		updates: make(chan torrent.TorrentUpdate, 10),
+		files:   map[string][]byte{},
+		added:   make(chan []byte, 1),
+		pauseAt: map[string]int64{},
+	}
+}
+
+func (f *fakeEngine) Close()                                {}
+func (f *fakeEngine) Context() context.Context              { return context.Background() }
+func (f *fakeEngine) Updates() <-chan torrent.TorrentUpdate { return f.updates }
+
+func (f *fakeEngine) Settings() torrent.EngineSettings {
+	return torrent.EngineSettings{DHTEnabled: true}
+}
+
+func (f *fakeEngine) MetadataQueue() torrent.MetadataQueueStats {
+	return torrent.MetadataQueueStats{}
+}
+
+func (f *fakeEngine) Available() bool                  { return true }
+func (f *fakeEngine) Stalled(after time.Duration) bool { return after < time.Minute }
+func (f *fakeEngine) Restart(reason string) error      { return torrent.ErrEngineUnavailable }
+
+func (f *fakeEngine) Health() torrent.EngineHealth {
+	return torrent.EngineHealth{Available: true, Restarts: 2}
+}
+
+func (f *fakeEngine) ProbeDownloadDir() error       { return errors.New("read-only file system") }
+func (f *fakeEngine) DiskError() *torrent.DiskError { return f.diskErr }
+
+func (f *fakeEngine) ClearDiskError() *torrent.DiskError {
+	cleared := f.diskErr
+	f.diskErr = nil
+	return cleared
+}
+
+func (f *fakeEngine) CheckPortReachability(ctx context.Context) torrent.PortCheck {
+	return torrent.PortCheck{Status: torrent.PortOpen, Port: 42069}
+}
+
+func (f *fakeEngine) LastPortCheck() *torrent.PortCheck { return nil }
+
+func (f *fakeEngine) AddMagnet(ctx context.Context, id, userID uuid.UUID, magnetURI string) (*torrent.TorrentUpdate, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &torrent.TorrentUpdate{ID: id, Name: magnetURI}, nil
+}
+
+func (f *fakeEngine) AddTorrentFile(ctx context.Context, id, userID uuid.UUID, reader io.Reader) (*torrent.TorrentUpdate, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	f.added <- data
+	return &torrent.TorrentUpdate{ID: id, TotalSize: int64(len(data))}, nil
+}
+
+func (f *fakeEngine) PreviewMagnet(ctx context.Context, magnetURI string) (*models.TorrentPreview, error) {
+	return nil, torrent.ErrPreviewTimeout
+}
+
+func (f *fakeEngine) ReloadTorrent(ctx context.Context, id, userID uuid.UUID, magnetURI, infoHash string, status models.TorrentStatus) error {
+	return nil
+}
+
+func (f *fakeEngine) RemoveOwner(infoHash string, id uuid.UUID, deleteFiles bool) error { return nil }
+func (f *fakeEngine) RemoveTorrent(infoHash string, deleteFiles bool) error             { return nil }
+func (f *fakeEngine) PauseTorrent(infoHash string, id uuid.UUID) error                  { return nil }
+func (f *fakeEngine) ResumeTorrent(infoHash string, id uuid.UUID) error                 { return nil }
+func (f *fakeEngine) SetSeedRatio(infoHash string, ratio float64)                       {}
+func (f *fakeEngine) SetPauseAt(infoHash string, id uuid.UUID, downloaded int64) {
+	f.pauseAt[infoHash+"/"+id.String()] = downloaded
+}
+
+func (f *fakeEngine) CreateTorrent(id, userID uuid.UUID, root string, opts torrent.CreateOptions) (*torrent.CreatedTorrent, error) {
+	if opts.Trackers != nil {
+		return nil, torrent.ErrContentActive
+	}
+	return &torrent.CreatedTorrent{Name: root, Metainfo: []byte("d4:infoe")}, nil
+}
+
+func (f *fakeEngine) ReloadCreated(id, userID uuid.UUID, data []byte) error { return nil }
+
+func (f *fakeEngine) MetainfoFile(infoHash string) ([]byte, bool) {
+	data, ok := f.files[infoHash+".torrent"]
+	return data, ok
+}
+
+func (f *fakeEngine) Trackers(infoHash string) ([]torrent.TrackerStatus, bool) {
+	if infoHash != "abc" {
+		return nil, false
+	}
+	return []torrent.TrackerStatus{{URL: "udp://tracker.example.com:1337", LastError: "timed out"}}, true
+}
+
+func (f *fakeEngine) GetTorrentStatus(infoHash string) (*torrent.TorrentUpdate, error) {
+	return &torrent.TorrentUpdate{InfoHash: infoHash, Progress: 50}, nil
+}
+
+func (f *fakeEngine) GetActiveTorrents() []torrent.TorrentUpdate               { return nil }
+func (f *fakeEngine) GetUserTorrents(userID uuid.UUID) []torrent.TorrentUpdate { return nil }
+func (f *fakeEngine) MeasureDownloaded(infoHash string, files []models.TorrentFile) (int64, string) {
+	return 0, "disk"
+}
+
+func (f *fakeEngine) GetUserAggregate(userID uuid.UUID) torrent.UserAggregate {
+	return torrent.UserAggregate{ActiveTorrents: 3, RemainingBytes: 1 << 40}
+}
+
+func (f *fakeEngine) GetDownloadDir() string            { return "/downloads" }
+func (f *fakeEngine) TorrentDir(infoHash string) string { return "/downloads/" + infoHash }
+
+func (f *fakeEngine) StreamReaderOptions() torrent.ReaderOptions   { return torrent.ReaderOptions{} }
+func (f *fakeEngine) DownloadReaderOptions() torrent.ReaderOptions { return torrent.ReaderOptions{} }
+
+func (f *fakeEngine) GetFileReader(infoHash, relativePath string, opts torrent.ReaderOptions) (io.ReadSeekCloser, int64, error) {
+	data, ok := f.files[relativePath]
+	if !ok {
+		return nil, 0, fmt.Errorf("file not found")
+	}
+	if opts.Readahead != 2<<20 || !opts.Responsive || opts.Context == nil {
+		return nil, 0, fmt.Errorf("options not passed on: %+v", opts)
+	}
+	return nopCloser{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+type nopCloser struct{ io.ReadSeeker }
+
+func (nopCloser) Close() error { return nil }
+
+// serve runs engine on addr ("" for any free port) until the test ends or
+// the returned server is stopped
+func serve(t *testing.T, engine torrent.Service, addr string) (string, *grpc.Server) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(engine, testToken)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String(), srv
+}
+
+func dial(t *testing.T, addr, token string) *Client {
+	t.Helper()
+	client, err := Dial(&config.Config{
+		EngineAddr:          addr,
+		EngineToken:         token,
+		DownloadDir:         "/downloads",
+		StreamReadaheadMB:   2,
+		DownloadReadaheadMB: 32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestErrors(t *testing.T) {
+	engine := newFakeEngine()
+	addr, _ := serve(t, engine, "")
+	client := dial(t, addr, testToken)
+
+	engine.err = fmt.Errorf("adding: %w", torrent.ErrV2NotSupported)
+	_, err := client.AddMagnet(context.Background(), uuid.New(), uuid.New(), "magnet:?xt=urn:btmh:x")
+	if !errors.Is(err, torrent.ErrV2NotSupported) {
+		t.Errorf("err = %v, want ErrV2NotSupported", err)
+	}
+	if err == nil || err.Error() != engine.err.Error() {
+		t.Errorf("message = %v, want %q", err, engine.err)
+	}
+
+	engine.err = errors.New("disk full")
+	_, err = client.AddMagnet(context.Background(), uuid.New(), uuid.New(), "magnet:?xt=urn:btih:x")
+	if err == nil || err.Error() != "disk full" || errors.Is(err, torrent.ErrV2NotSupported) {
+		t.Errorf("err = %v, want a plain disk full", err)
+	}
+
+	if _, err := client.PreviewMagnet(context.Background(), "magnet:"); !errors.Is(err, torrent.ErrPreviewTimeout) {
+		t.Errorf("preview err = %v, want ErrPreviewTimeout", err)
+	}
+
+	if _, err := dial(t, addr, "wrong").GetTorrentStatus("abc"); err == nil {
+		t.Error("call with the wrong token succeeded")
+	}
+}
+
+func TestCalls(t *testing.T) {
+	engine := newFakeEngine()
+	addr, _ := serve(t, engine, "")
+	client := dial(t, addr, testToken)
+
+	id := uuid.New()
+	update, err := client.AddMagnet(context.Background(), id, uuid.New(), "magnet:?xt=urn:btih:x")
+	if err != nil || update.ID != id || update.Name != "magnet:?xt=urn:btih:x" {
+		t.Errorf("AddMagnet = %+v, %v", update, err)
+	}
+	if status, err := client.GetTorrentStatus("abc"); err != nil || status.InfoHash != "abc" || status.Progress != 50 {
+		t.Errorf("GetTorrentStatus = %+v, %v", status, err)
+	}
+	if !client.Settings().DHTEnabled {
+		t.Error("settings not carried over")
+	}
+	if health := client.Health(); !health.Available || health.Restarts != 2 || !client.Available() {
+		t.Errorf("Health = %+v, Available = %v", health, client.Available())
+	}
+	if agg := client.GetUserAggregate(uuid.New()); agg.ActiveTorrents != 3 || agg.RemainingBytes != 1<<40 {
+		t.Errorf("GetUserAggregate = %+v", agg)
+	}
+	if !client.Stalled(time.Second) || client.Stalled(time.Hour) {
+		t.Error("Stalled not passed the duration")
+	}
+	if err := client.Restart("test"); !errors.Is(err, torrent.ErrEngineUnavailable) {
+		t.Errorf("Restart err = %v, want ErrEngineUnavailable", err)
+	}
+	if err := client.ProbeDownloadDir(); err == nil || err.Error() != "read-only file system" {
+		t.Errorf("ProbeDownloadDir = %v", err)
+	}
+	if diskErr := client.DiskError(); diskErr != nil {
+		t.Errorf("DiskError = %+v, want nil", diskErr)
+	}
+	engine.diskErr = &torrent.DiskError{InfoHash: "abc", Error: "disk write error"}
+	if diskErr := client.ClearDiskError(); diskErr == nil || diskErr.InfoHash != "abc" || client.DiskError() != nil {
+		t.Errorf("ClearDiskError = %+v", diskErr)
+	}
+	if check := client.CheckPortReachability(context.Background()); check.Status != torrent.PortOpen || check.Port != 42069 {
+		t.Errorf("CheckPortReachability = %+v", check)
+	}
+	if check := client.LastPortCheck(); check != nil {
+		t.Errorf("LastPortCheck = %+v, want nil", check)
+	}
+	if created, err := client.CreateTorrent(id, uuid.New(), "/downloads/x", torrent.CreateOptions{}); err != nil || created.Name != "/downloads/x" || string(created.Metainfo) != "d4:infoe" {
+		t.Errorf("CreateTorrent = %+v, %v", created, err)
+	}
+	// Empty trackers differ from the default nil
+	_, err = client.CreateTorrent(id, uuid.New(), "/downloads/x", torrent.CreateOptions{Trackers: []string{}})
+	if !errors.Is(err, torrent.ErrContentActive) {
+		t.Errorf("CreateTorrent with no trackers err = %v, want ErrContentActive", err)
+	}
+	engine.files["abc.torrent"] = []byte("d4:infoe")
+	if data, ok := client.MetainfoFile("abc"); !ok || string(data) != "d4:infoe" {
+		t.Errorf("MetainfoFile = %q, %v", data, ok)
+	}
+	if data, ok := client.MetainfoFile("def"); ok {
+		t.Errorf("MetainfoFile of an unknown torrent = %q", data)
+	}
+	if trackers, ok := client.Trackers("abc"); !ok || len(trackers) != 1 || trackers[0].LastError != "timed out" {
+		t.Errorf("Trackers = %+v, %v", trackers, ok)
+	}
+	if trackers, ok := client.Trackers("def"); ok {
+		t.Errorf("Trackers of an unknown torrent = %+v", trackers)
+	}
+	owner := uuid.New()
+	client.SetPauseAt("abc", owner, 1<<30)
+	if engine.pauseAt["abc/"+owner.String()] != 1<<30 {
+		t.Errorf("SetPauseAt not carried over: %v", engine.pauseAt)
+	}
+	if dir := client.TorrentDir("abc"); dir != torrent.DataDir("/downloads", "abc") {
+		t.Errorf("TorrentDir = %q", dir)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	client := dial(t, addr, testToken)
+
+	if client.Available() {
+		t.Error("unreachable engine reported available")
+	}
+	if health := client.Health(); health.Available || health.Error == "" || health.LastRestartAt != nil {
+		t.Errorf("Health = %+v, want unavailable with an error", health)
+	}
+	if err := client.PauseTorrent("abc", uuid.New()); !errors.Is(err, torrent.ErrEngineUnavailable) {
+		t.Errorf("PauseTorrent err = %v, want ErrEngineUnavailable", err)
+	}
+	client.Restart("test")
+	if health := client.Health(); health.LastRestartAt == nil {
+		t.Error("failed restart not recorded")
+	}
+}
+
+func TestAddTorrentFile(t *testing.T) {
+	engine := newFakeEngine()
+	addr, _ := serve(t, engine, "")
+	client := dial(t, addr, testToken)
+
+	for _, size := range []int{0, 100, 200 * 1024} {
+		data := make([]byte, size)
+		rand.Read(data)
+		id := uuid.New()
+		update, err := client.AddTorrentFile(context.Background(), id, uuid.New(), bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if update.ID != id || update.TotalSize != int64(size) {
+			t.Errorf("%d bytes: update = %+v", size, update)
+		}
+		if got := <-engine.added; !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: engine got %d different bytes", size, len(got))
+		}
+	}
+
+	big := bytes.NewReader(make([]byte, maxTorrentFileSize+1))
+	if _, err := client.AddTorrentFile(context.Background(), uuid.New(), uuid.New(), big); err == nil {
+		t.Error("oversized torrent file accepted")
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	engine := newFakeEngine()
+	data := make([]byte, 3*fileChunkSize+123)
+	rand.Read(data)
+	engine.files["a/b.bin"] = data
+	addr, _ := serve(t, engine, "")
+	client := dial(t, addr, testToken)
+
+	if _, _, err := client.GetFileReader("abc", "missing", client.StreamReaderOptions()); err == nil {
+		t.Error("reader for a missing file")
+	}
+
+	reader, size, err := client.GetFileReader("abc", "a/b.bin", client.StreamReaderOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if size != int64(len(data)) {
+		t.Fatalf("size = %d, want %d", size, len(data))
+	}
+
+	got, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v; want the whole file", len(got), err)
+	}
+
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{fileChunkSize + 7, io.SeekStart, fileChunkSize + 7},
+		{-10, io.SeekEnd, int64(len(data)) - 10},
+		{0, io.SeekStart, 0},
+	}
+	for _, tt := range tests {
+		pos, err := reader.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v; want %d", tt.offset, tt.whence, pos, err, tt.want)
+		}
+		buf := make([]byte, 10)
+		n, err := io.ReadFull(reader, buf)
+		if err != nil || !bytes.Equal(buf[:n], data[pos:pos+10]) {
+			t.Errorf("after Seek(%d, %d): read %v, %v", tt.offset, tt.whence, buf[:n], err)
+		}
+	}
+
+	reader.Seek(0, io.SeekEnd)
+	if n, err := reader.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read at end = %d, %v; want EOF", n, err)
+	}
+}
+
+func TestUpdatesResubscribe(t *testing.T) {
+	first := newFakeEngine()
+	addr, srv := serve(t, first, "")
+	client := dial(t, addr, testToken)
+	restarted := make(chan struct{}, 1)
+	client.OnRestart(func() { restarted <- struct{}{} })
+
+	receive := func(engine *fakeEngine) {
+		t.Helper()
+		id := uuid.New()
+		engine.updates <- torrent.TorrentUpdate{ID: id, Status: models.TorrentStatusDownloading}
+		select {
+		case update := <-client.Updates():
+			if update.ID != id || update.Status != models.TorrentStatusDownloading {
+				t.Errorf("update = %+v, want %s downloading", update, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update received")
+		}
+	}
+
+	receive(first)
+	select {
+	case <-restarted:
+		t.Fatal("first subscription reported as a restart")
+	default:
+	}
+
+	// The worker restarts on the same address
+	srv.Stop()
+	second := newFakeEngine()
+	serve(t, second, addr)
+
+	receive(second)
+	select {
+	case <-restarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("restart not reported")
+	}
+
+	client.Close()
+	select {
+	case _, ok := <-client.Updates():
+		if ok {
+			t.Error("update after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("updates not closed by Close")
+	}
+}
@@ -0,0 +1,373 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+	"github.com/freetorrent/freetorrent/internal/torrent/enginepb"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// instanceHeader names the update stream header identifying the
+	// engine process, so clients notice a restart
+	instanceHeader = "engine-instance"
+
+	// maxTorrentFileSize bounds .torrent files sent to AddTorrentFile
+	maxTorrentFileSize = 10 * 1024 * 1024
+
+	// fileChunkSize is how much file data each GetFileReader message carries
+	fileChunkSize = 256 * 1024
+)
+
+// NewServer returns a gRPC server for engine, ready to Serve. Calls must
+// carry token as a bearer credential.
+func NewServer(engine torrent.Service, token string) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorize(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(ss.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+		// Clients ping idle connections to notice a dead worker
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	enginepb.RegisterEngineServer(srv, &server{engine: engine, instance: uuid.NewString()})
+	return srv
+}
+
+func authorize(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid engine token")
+}
+
+type server struct {
+	enginepb.UnimplementedEngineServer
+	engine   torrent.Service
+	instance string
+}
+
+// encode wraps a value for the wire; see enginepb.Value
+func encode(v interface{}) (*enginepb.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &enginepb.Value{Json: data}, nil
+}
+
+func parseIDs(id, userID string) (uuid.UUID, uuid.UUID, error) {
+	tid, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, status.Error(codes.InvalidArgument, "invalid torrent ID")
+	}
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, status.Error(codes.InvalidArgument, "invalid user ID")
+	}
+	return tid, uid, nil
+}
+
+func (s *server) AddMagnet(ctx context.Context, req *enginepb.AddMagnetRequest) (*enginepb.Value, error) {
+	id, userID, err := parseIDs(req.Id, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	// The metadata wait outlives the call, as it outlives the request locally
+	update, err := s.engine.AddMagnet(s.engine.Context(), id, userID, req.MagnetUri)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return encode(update)
+}
+
+func (s *server) AddTorrentFile(stream enginepb.Engine_AddTorrentFileServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	id, userID, err := parseIDs(first.Id, first.UserId)
+	if err != nil {
+		return err
+	}
+
+	var metainfo bytes.Buffer
+	metainfo.Write(first.Chunk)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if metainfo.Len()+len(req.Chunk) > maxTorrentFileSize {
+			return status.Error(codes.InvalidArgument, "torrent file too large")
+		}
+		metainfo.Write(req.Chunk)
+	}
+
+	update, err := s.engine.AddTorrentFile(s.engine.Context(), id, userID, &metainfo)
+	if err != nil {
+		return toStatus(err)
+	}
+	v, err := encode(update)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(v)
+}
+
+func (s *server) PreviewMagnet(ctx context.Context, req *enginepb.PreviewMagnetRequest) (*enginepb.Value, error) {
+	preview, err := s.engine.PreviewMagnet(ctx, req.MagnetUri)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return encode(preview)
+}
+
+func (s *server) ReloadTorrent(ctx context.Context, req *enginepb.ReloadTorrentRequest) (*enginepb.Empty, error) {
+	id, userID, err := parseIDs(req.Id, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	err = s.engine.ReloadTorrent(s.engine.Context(), id, userID, req.MagnetUri, req.InfoHash, models.TorrentStatus(req.Status))
+	return &enginepb.Empty{}, toStatus(err)
+}
+
+func (s *server) RemoveOwner(ctx context.Context, req *enginepb.RemoveOwnerRequest) (*enginepb.Empty, error) {
+	id, err := uuid.Parse(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid torrent ID")
+	}
+	return &enginepb.Empty{}, toStatus(s.engine.RemoveOwner(req.InfoHash, id, req.DeleteFiles))
+}
+
+func (s *server) RemoveTorrent(ctx context.Context, req *enginepb.RemoveTorrentRequest) (*enginepb.Empty, error) {
+	return &enginepb.Empty{}, toStatus(s.engine.RemoveTorrent(req.InfoHash, req.DeleteFiles))
+}
+
+func (s *server) PauseTorrent(ctx context.Context, req *enginepb.OwnerRequest) (*enginepb.Empty, error) {
+	id, err := uuid.Parse(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid torrent ID")
+	}
+	return &enginepb.Empty{}, toStatus(s.engine.PauseTorrent(req.InfoHash, id))
+}
+
+func (s *server) ResumeTorrent(ctx context.Context, req *enginepb.OwnerRequest) (*enginepb.Empty, error) {
+	id, err := uuid.Parse(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid torrent ID")
+	}
+	return &enginepb.Empty{}, toStatus(s.engine.ResumeTorrent(req.InfoHash, id))
+}
+
+func (s *server) SetSeedRatio(ctx context.Context, req *enginepb.SetSeedRatioRequest) (*enginepb.Empty, error) {
+	s.engine.SetSeedRatio(req.InfoHash, req.Ratio)
+	return &enginepb.Empty{}, nil
+}
+
+func (s *server) SetPauseAt(ctx context.Context, req *enginepb.SetPauseAtRequest) (*enginepb.Empty, error) {
+	id, err := uuid.Parse(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid torrent ID")
+	}
+	s.engine.SetPauseAt(req.InfoHash, id, req.Downloaded)
+	return &enginepb.Empty{}, nil
+}
+
+func (s *server) CreateTorrent(ctx context.Context, req *enginepb.CreateTorrentRequest) (*enginepb.Value, error) {
+	id, userID, err := parseIDs(req.Id, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	var opts torrent.CreateOptions
+	if err := json.Unmarshal(req.Options, &opts); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid options")
+	}
+	created, err := s.engine.CreateTorrent(id, userID, req.Root, opts)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return encode(created)
+}
+
+func (s *server) ReloadCreated(ctx context.Context, req *enginepb.ReloadCreatedRequest) (*enginepb.Empty, error) {
+	id, userID, err := parseIDs(req.Id, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return &enginepb.Empty{}, toStatus(s.engine.ReloadCreated(id, userID, req.Metainfo))
+}
+
+func (s *server) MetainfoFile(ctx context.Context, req *enginepb.TorrentRequest) (*enginepb.Value, error) {
+	data, _ := s.engine.MetainfoFile(req.InfoHash)
+	return encode(data)
+}
+
+func (s *server) Trackers(ctx context.Context, req *enginepb.TorrentRequest) (*enginepb.Value, error) {
+	trackers, ok := s.engine.Trackers(req.InfoHash)
+	if !ok {
+		return encode(nil)
+	}
+	return encode(trackers)
+}
+
+func (s *server) GetTorrentStatus(ctx context.Context, req *enginepb.TorrentRequest) (*enginepb.Value, error) {
+	update, err := s.engine.GetTorrentStatus(req.InfoHash)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return encode(update)
+}
+
+func (s *server) GetActiveTorrents(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.GetActiveTorrents())
+}
+
+func (s *server) GetUserTorrents(ctx context.Context, req *enginepb.UserRequest) (*enginepb.Value, error) {
+	userID, err := uuid.Parse(req.UserId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid user ID")
+	}
+	return encode(s.engine.GetUserTorrents(userID))
+}
+
+func (s *server) GetUserAggregate(ctx context.Context, req *enginepb.UserRequest) (*enginepb.Value, error) {
+	userID, err := uuid.Parse(req.UserId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid user ID")
+	}
+	return encode(s.engine.GetUserAggregate(userID))
+}
+
+func (s *server) Settings(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.Settings())
+}
+
+func (s *server) MetadataQueue(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.MetadataQueue())
+}
+
+func (s *server) Health(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.Health())
+}
+
+func (s *server) Stalled(ctx context.Context, req *enginepb.StalledRequest) (*enginepb.Value, error) {
+	return encode(s.engine.Stalled(time.Duration(req.AfterNanos)))
+}
+
+func (s *server) Restart(ctx context.Context, req *enginepb.RestartRequest) (*enginepb.Empty, error) {
+	return &enginepb.Empty{}, toStatus(s.engine.Restart(req.Reason))
+}
+
+func (s *server) ProbeDownloadDir(ctx context.Context, _ *enginepb.Empty) (*enginepb.Empty, error) {
+	return &enginepb.Empty{}, toStatus(s.engine.ProbeDownloadDir())
+}
+
+func (s *server) DiskError(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.DiskError())
+}
+
+func (s *server) ClearDiskError(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.ClearDiskError())
+}
+
+func (s *server) CheckPortReachability(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.CheckPortReachability(ctx))
+}
+
+func (s *server) LastPortCheck(ctx context.Context, _ *enginepb.Empty) (*enginepb.Value, error) {
+	return encode(s.engine.LastPortCheck())
+}
+
+// SubscribeUpdates reads the engine's update channel for as long as the
+// subscriber stays. Several subscribers share the channel rather than each
+// seeing every update, so the engine's backpressure is unchanged: with no
+// subscriber, updates wait in the channel until one arrives.
+func (s *server) SubscribeUpdates(_ *enginepb.Empty, stream enginepb.Engine_SubscribeUpdatesServer) error {
+	if err := stream.SendHeader(metadata.Pairs(instanceHeader, s.instance)); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case update, ok := <-s.engine.Updates():
+			if !ok {
+				return status.Error(codes.Unavailable, "engine closed")
+			}
+			v, err := encode(update)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(v); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *server) GetFileReader(req *enginepb.FileRequest, stream enginepb.Engine_GetFileReaderServer) error {
+	reader, size, err := s.engine.GetFileReader(req.InfoHash, req.Path, torrent.ReaderOptions{
+		Readahead:  req.Readahead,
+		Responsive: req.Responsive,
+		Context:    stream.Context(),
+	})
+	if err != nil {
+		return toStatus(err)
+	}
+	defer reader.Close()
+
+	if err := stream.Send(&enginepb.FileChunk{Size: size}); err != nil || req.SizeOnly {
+		return err
+	}
+	if req.Offset > 0 {
+		if _, err := reader.Seek(req.Offset, io.SeekStart); err != nil {
+			return toStatus(err)
+		}
+	}
+	for {
+		// Sent messages may be read after Send returns, so each gets its own buffer
+		buf := make([]byte, fileChunkSize)
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&enginepb.FileChunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return toStatus(err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// Service is the engine as the handlers and jobs use it: the local *Engine,
+// or a client of one running elsewhere (see package remote). Paths it
+// returns are under the same DOWNLOAD_DIR either way, so a remote engine
+// needs that directory shared with the API.
+type Service interface {
+	Close()
+	Context() context.Context
+	Updates() <-chan TorrentUpdate
+	Settings() EngineSettings
+	MetadataQueue() MetadataQueueStats
+	Available() bool
+	Stalled(after time.Duration) bool
+	Health() EngineHealth
+	Restart(reason string) error
+	ProbeDownloadDir() error
+	DiskError() *DiskError
+	ClearDiskError() *DiskError
+	CheckPortReachability(ctx context.Context) PortCheck
+	LastPortCheck() *PortCheck
+
+	AddMagnet(ctx context.Context, id, userID uuid.UUID, magnetURI string) (*TorrentUpdate, error)
+	AddTorrentFile(ctx context.Context, id, userID uuid.UUID, reader io.Reader) (*TorrentUpdate, error)
+	PreviewMagnet(ctx context.Context, magnetURI string) (*models.TorrentPreview, error)
+	ReloadTorrent(ctx context.Context, id, userID uuid.UUID, magnetURI, infoHash string, status models.TorrentStatus) error
+	RemoveOwner(infoHash string, id uuid.UUID, deleteFiles bool) error
+	RemoveTorrent(infoHash string, deleteFiles bool) error
+	PauseTorrent(infoHash string, id uuid.UUID) error
+	ResumeTorrent(infoHash string, id uuid.UUID) error
+	SetSeedRatio(infoHash string, ratio float64)
+	SetPauseAt(infoHash string, id uuid.UUID, downloaded int64)
+	CreateTorrent(id, userID uuid.UUID, root string, opts CreateOptions) (*CreatedTorrent, error)
+	ReloadCreated(id, userID uuid.UUID, data []byte) error
+	MetainfoFile(infoHash string) ([]byte, bool)
+	Trackers(infoHash string) ([]TrackerStatus, bool)
+
+	GetTorrentStatus(infoHash string) (*TorrentUpdate, error)
+	GetActiveTorrents() []TorrentUpdate
+	GetUserTorrents(userID uuid.UUID) []TorrentUpdate
+	GetUserAggregate(userID uuid.UUID) UserAggregate
+	MeasureDownloaded(infoHash string, files []models.TorrentFile) (int64, string)
+	StreamReaderOptions() ReaderOptions
+	DownloadReaderOptions() ReaderOptions
+	GetFileReader(infoHash, relativePath string, opts ReaderOptions) (io.ReadSeekCloser, int64, error)
+	GetDownloadDir() string
+	TorrentDir(infoHash string) string
+}
+
+var _ Service = (*Engine)(nil)
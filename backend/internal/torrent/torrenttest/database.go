@@ -0,0 +1,97 @@
+//go:build integration
+
+package torrenttest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// Database is a migrated test database
+type Database struct {
+	*database.Database
+
+	// pool is a connection of the test's own, for Exec
+	pool *pgxpool.Pool
+}
+
+// NewDatabase returns a migrated database, closed when the test ends:
+// TEST_DATABASE_URL when set, else a PostgreSQL started in Docker for the
+// test and removed after it
+func NewDatabase(tb testing.TB) *Database {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		url = startPostgres(tb)
+	}
+
+	var db *database.Database
+	deadline := time.Now().Add(time.Minute)
+	for {
+		var err error
+		if db, err = database.New(url, false); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("connecting to the test database: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	tb.Cleanup(db.Close)
+
+	if err := db.Migrate(context.Background()); err != nil {
+		tb.Fatalf("migrating the test database: %v", err)
+	}
+
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		tb.Fatalf("connecting to the test database: %v", err)
+	}
+	tb.Cleanup(pool.Close)
+	return &Database{Database: db, pool: pool}
+}
+
+// Exec runs a statement directly, for state the API has no way to
+// arrange, say an expiry in the past
+func (d *Database) Exec(tb testing.TB, sql string, args ...any) {
+	tb.Helper()
+	if _, err := d.pool.Exec(context.Background(), sql, args...); err != nil {
+		tb.Fatalf("exec %q: %v", sql, err)
+	}
+}
+
+// startPostgres runs a throwaway PostgreSQL container and returns its URL
+func startPostgres(tb testing.TB) string {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		tb.Skipf("Docker unavailable and TEST_DATABASE_URL unset: %v", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		tb.Skipf("Docker unavailable and TEST_DATABASE_URL unset: %v", err)
+	}
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "16-alpine",
+		Env:        []string{"POSTGRES_USER=test", "POSTGRES_PASSWORD=test", "POSTGRES_DB=test"},
+	}, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		tb.Fatalf("starting PostgreSQL: %v", err)
+	}
+	tb.Cleanup(func() { pool.Purge(resource) })
+	// A test killed before its cleanup still leaves no container behind
+	resource.Expire(600)
+
+	return fmt.Sprintf("postgres://test:test@%s/test?sslmode=disable", resource.GetHostPort("5432/tcp"))
+}
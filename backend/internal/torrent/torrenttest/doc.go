@@ -0,0 +1,13 @@
+//go:build integration
+
+// Package torrenttest runs torrents end to end without the internet: a
+// tracker and a seeder on localhost serving generated fixture data, an
+// engine configured to find peers through that tracker alone, and a
+// throwaway PostgreSQL. It is built only with the integration tag, so
+// ordinary builds and test runs never pull it in:
+//
+//	go test -tags integration ./...
+//
+// Set TEST_DATABASE_URL to use an existing database instead of starting
+// one in Docker; it is migrated but not emptied.
+package torrenttest
@@ -0,0 +1,127 @@
+//go:build integration
+
+package torrenttest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/torrent"
+)
+
+// Engine is a torrent engine downloading into a temporary directory. It
+// listens on localhost only, with DHT and PEX off, so it finds peers
+// through fixtures' trackers alone. Its updates are recorded for
+// WaitForUpdate and, once Updates has been called, passed on to its
+// reader, say the server's update processor.
+type Engine struct {
+	*torrent.Engine
+	Config *config.Config
+
+	mu      sync.Mutex
+	updates []torrent.TorrentUpdate
+	changed chan struct{} // closed and replaced on every update
+
+	out     chan torrent.TorrentUpdate
+	reading atomic.Bool
+}
+
+// NewEngine starts an engine, closed when the test ends. configure, if
+// not nil, adjusts the configuration before it starts.
+func NewEngine(tb testing.TB, configure func(cfg *config.Config)) *Engine {
+	tb.Helper()
+	cfg := config.Load()
+	cfg.DownloadDir = tb.TempDir()
+	cfg.DefaultPort = 0
+	cfg.TorrentListenAddr = "127.0.0.1"
+	cfg.TorrentIPFamily = config.IPFamilyIPv4
+	cfg.TorrentDisableDHT = true
+	cfg.TorrentDisablePEX = true
+	cfg.PortCheckURL = ""
+	if configure != nil {
+		configure(cfg)
+	}
+	return startEngine(tb, cfg)
+}
+
+// Reopen closes the engine and starts another on the same configuration
+// and download directory, as after a server restart. Like the server, the
+// caller reloads its torrents.
+func (e *Engine) Reopen(tb testing.TB) *Engine {
+	tb.Helper()
+	e.Close()
+	return startEngine(tb, e.Config)
+}
+
+func startEngine(tb testing.TB, cfg *config.Config) *Engine {
+	engine, err := torrent.NewEngine(context.Background(), cfg)
+	if err != nil {
+		tb.Fatalf("starting engine: %v", err)
+	}
+	e := &Engine{Engine: engine, Config: cfg, changed: make(chan struct{}), out: make(chan torrent.TorrentUpdate, 100)}
+	tb.Cleanup(engine.Close)
+
+	go func() {
+		for update := range engine.Updates() {
+			e.mu.Lock()
+			e.updates = append(e.updates, update)
+			close(e.changed)
+			e.changed = make(chan struct{})
+			e.mu.Unlock()
+			if e.reading.Load() {
+				e.out <- update
+			}
+		}
+	}()
+	return e
+}
+
+// Updates returns the engine's updates from the first call on, each
+// also recorded for WaitForUpdate
+func (e *Engine) Updates() <-chan torrent.TorrentUpdate {
+	e.reading.Store(true)
+	return e.out
+}
+
+// WaitForUpdate returns the first update since the engine started that
+// match accepts, waiting up to timeout for one, and fails the test if
+// none comes
+func (e *Engine) WaitForUpdate(tb testing.TB, timeout time.Duration, match func(torrent.TorrentUpdate) bool) torrent.TorrentUpdate {
+	tb.Helper()
+	deadline := time.After(timeout)
+	seen := 0
+	for {
+		e.mu.Lock()
+		updates, changed := e.updates[seen:], e.changed
+		seen = len(e.updates)
+		e.mu.Unlock()
+		for _, update := range updates {
+			if match(update) {
+				return update
+			}
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			tb.Fatalf("no matching torrent update within %s", timeout)
+			return torrent.TorrentUpdate{}
+		}
+	}
+}
+
+// Eventually polls cond until it holds, failing the test if it doesn't
+// within timeout
+func Eventually(tb testing.TB, timeout time.Duration, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,102 @@
+//go:build integration
+
+package torrenttest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// fixturePieceLength is small, so even little fixtures have many pieces
+// and a download is seen to progress
+const fixturePieceLength = 16 << 10
+
+// Fixture is generated data and a torrent of it
+type Fixture struct {
+	// Dir holds the data, under Dir/Name
+	Dir      string
+	Name     string
+	Files    map[string][]byte // contents, by path within the torrent
+	MetaInfo *metainfo.MetaInfo
+}
+
+// NewFixture writes random files of the given sizes, by path within the
+// torrent, under a temporary directory and builds a multi-file torrent of
+// them that announces to trackerURL
+func NewFixture(tb testing.TB, name string, sizes map[string]int, trackerURL string) *Fixture {
+	tb.Helper()
+	f := &Fixture{Dir: tb.TempDir(), Name: name, Files: make(map[string][]byte, len(sizes))}
+	root := filepath.Join(f.Dir, name)
+	for path, size := range sizes {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			tb.Fatalf("generating %s: %v", path, err)
+		}
+		file := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			tb.Fatal(err)
+		}
+		f.Files[path] = data
+	}
+
+	info := metainfo.Info{PieceLength: fixturePieceLength}
+	if err := info.BuildFromFilePath(root); err != nil {
+		tb.Fatalf("building torrent of %s: %v", name, err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f.MetaInfo = &metainfo.MetaInfo{Announce: trackerURL, InfoBytes: infoBytes}
+	f.MetaInfo.SetDefaults()
+	return f
+}
+
+// InfoHash returns the torrent's info hash in hex, as the engine and
+// database keep it
+func (f *Fixture) InfoHash() string {
+	return f.MetaInfo.HashInfoBytes().HexString()
+}
+
+// Magnet returns a magnet URI of the torrent, with its tracker
+func (f *Fixture) Magnet() string {
+	info, err := f.MetaInfo.UnmarshalInfo()
+	if err != nil {
+		panic(err)
+	}
+	return f.MetaInfo.Magnet(nil, &info).String()
+}
+
+// TorrentFile returns the torrent's .torrent file
+func (f *Fixture) TorrentFile() []byte {
+	var buf bytes.Buffer
+	if err := f.MetaInfo.Write(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Verify checks that dir holds the fixture's files, as the engine lays
+// them out under a torrent's directory
+func (f *Fixture) Verify(tb testing.TB, dir string) {
+	tb.Helper()
+	for path, want := range f.Files {
+		got, err := os.ReadFile(filepath.Join(dir, f.Name, filepath.FromSlash(path)))
+		if err != nil {
+			tb.Errorf("reading downloaded %s: %v", path, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			tb.Errorf("downloaded %s differs from the fixture", path)
+		}
+	}
+}
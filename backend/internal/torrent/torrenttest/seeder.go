@@ -0,0 +1,68 @@
+//go:build integration
+
+package torrenttest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Seeder is a BitTorrent client on localhost seeding fixtures from where
+// they were generated
+type Seeder struct {
+	Client *torrent.Client
+}
+
+// NewSeeder starts a client seeding fixtures, closed when the test ends.
+// It finds peers through the fixtures' tracker only.
+func NewSeeder(tb testing.TB, fixtures ...*Fixture) *Seeder {
+	tb.Helper()
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = tb.TempDir()
+	cfg.SetListenAddr("127.0.0.1:0")
+	cfg.Seed = true
+	cfg.NoDHT = true
+	cfg.DisablePEX = true
+	cfg.DisableIPv6 = true
+	cfg.NoDefaultPortForwarding = true
+	client, err := torrent.NewClient(cfg)
+	if err != nil {
+		tb.Fatalf("starting seeder: %v", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	s := &Seeder{Client: client}
+	for _, f := range fixtures {
+		s.Seed(tb, f)
+	}
+	return s
+}
+
+// Seed adds f and returns once its data is verified, so the seeder
+// announces it complete
+func (s *Seeder) Seed(tb testing.TB, f *Fixture) *torrent.Torrent {
+	tb.Helper()
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(f.MetaInfo)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	spec.Storage = storage.NewFile(f.Dir)
+	t, _, err := s.Client.AddTorrentSpec(spec)
+	if err != nil {
+		tb.Fatalf("seeding %s: %v", f.Name, err)
+	}
+	<-t.GotInfo()
+	t.VerifyData()
+	if missing := t.BytesMissing(); missing != 0 {
+		tb.Fatalf("seeder is missing %d bytes of %s", missing, f.Name)
+	}
+	return t
+}
+
+// Addr returns the address the seeder accepts peers on
+func (s *Seeder) Addr() net.Addr {
+	return s.Client.ListenAddrs()[0]
+}
@@ -0,0 +1,101 @@
+//go:build integration
+
+package torrenttest
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/tracker"
+	httpTrackerServer "github.com/anacrolix/torrent/tracker/http/server"
+	trackerServer "github.com/anacrolix/torrent/tracker/server"
+	"github.com/anacrolix/torrent/tracker/udp"
+)
+
+// Tracker is an HTTP tracker on localhost that answers every announce with
+// the torrent's other peers. It keeps no state beyond the test.
+type Tracker struct {
+	// URL is the announce URL to put in metainfo and magnets
+	URL string
+
+	mu    sync.Mutex
+	peers map[trackerServer.InfoHash]map[netip.AddrPort]bool // to seeding
+}
+
+// NewTracker starts a tracker, stopped when the test ends
+func NewTracker(tb testing.TB) *Tracker {
+	tr := &Tracker{peers: make(map[trackerServer.InfoHash]map[netip.AddrPort]bool)}
+	srv := httptest.NewServer(httpTrackerServer.Handler{
+		Announce: &trackerServer.AnnounceHandler{AnnounceTracker: tr},
+	})
+	tb.Cleanup(srv.Close)
+	tr.URL = srv.URL + "/announce"
+	return tr
+}
+
+// Peers returns how many peers have announced a torrent and not stopped
+func (tr *Tracker) Peers(infoHash [20]byte) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.peers[infoHash])
+}
+
+// TrackAnnounce records or forgets the announcing peer
+func (tr *Tracker) TrackAnnounce(_ context.Context, req udp.AnnounceRequest, addr trackerServer.AnnounceAddr) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	peers := tr.peers[req.InfoHash]
+	if peers == nil {
+		peers = make(map[netip.AddrPort]bool)
+		tr.peers[req.InfoHash] = peers
+	}
+	if req.Event == tracker.Stopped {
+		delete(peers, addr)
+		return nil
+	}
+	peers[addr] = req.Left == 0
+	return nil
+}
+
+// Scrape reports the seeders and leechers of each torrent
+func (tr *Tracker) Scrape(_ context.Context, infoHashes []trackerServer.InfoHash) ([]udp.ScrapeInfohashResult, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	results := make([]udp.ScrapeInfohashResult, len(infoHashes))
+	for i, ih := range infoHashes {
+		for _, seeding := range tr.peers[ih] {
+			if seeding {
+				results[i].Seeders++
+			} else {
+				results[i].Leechers++
+			}
+		}
+	}
+	return results, nil
+}
+
+// GetPeers returns the torrent's peers other than the one asking
+func (tr *Tracker) GetPeers(_ context.Context, infoHash trackerServer.InfoHash, _ trackerServer.GetPeersOpts, remote trackerServer.AnnounceAddr) (ret trackerServer.ServerAnnounceResult) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var seeders, leechers int32
+	for addr, seeding := range tr.peers[infoHash] {
+		if seeding {
+			seeders++
+		} else {
+			leechers++
+		}
+		if addr != remote {
+			ret.Peers = append(ret.Peers, trackerServer.PeerInfo{AnnounceAddr: addr})
+		}
+	}
+	// Announce often, so a peer that joins late is found quickly
+	ret.Interval = generics.Some[int32](5)
+	ret.Seeders = generics.Some(seeders)
+	ret.Leechers = generics.Some(leechers)
+	return ret
+}
@@ -0,0 +1,454 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/tracker"
+	"github.com/anacrolix/torrent/tracker/udp"
+	"github.com/freetorrent/freetorrent/internal/config"
+	"github.com/freetorrent/freetorrent/internal/redact"
+)
+
+// HealthTrackersFailing is the health warning of a torrent whose every
+// tracker failed its last announce, which usually means a dead or mistyped
+// tracker. It takes precedence over HealthNoSeeders.
+const HealthTrackersFailing = "trackers_failing"
+
+// Tracker refresh tuning: how often announce results are read from the
+// client, how often trackers are scraped, and how many torrents one scrape
+// request asks about
+const (
+	trackerRefreshInterval = 30 * time.Second
+	trackerScrapeInterval  = 15 * time.Minute
+	trackerScrapeTimeout   = 15 * time.Second
+	trackerScrapeBatch     = 50
+)
+
+// announceSlack is how far the next announce may move between refreshes
+// before it counts as a new announce, covering the client's rounding
+const announceSlack = 5 * time.Second
+
+// TrackerStatus is one of a torrent's trackers as of the engine's last
+// refresh. LastAnnounceAt is when a refresh first saw the announce's
+// result, so up to trackerRefreshInterval late; NextAnnounceAt is absent
+// while an announce is due. The swarm counts come from scrapes and are
+// absent until the tracker has answered one.
+type TrackerStatus struct {
+	URL            string     `json:"url"` // passkeys and other secrets redacted
+	Tier           int        `json:"tier"`
+	LastAnnounceAt *time.Time `json:"last_announce_at,omitempty"`
+	NextAnnounceAt *time.Time `json:"next_announce_at,omitempty"`
+	Peers          int        `json:"peers"` // returned by the last announce
+	LastError      string     `json:"last_error,omitempty"`
+	Seeders        *int       `json:"seeders,omitempty"`
+	Leechers       *int       `json:"leechers,omitempty"`
+	Downloaded     *int       `json:"downloaded,omitempty"` // times completed
+	ScrapedAt      *time.Time `json:"scraped_at,omitempty"`
+
+	url    string    // as announced to
+	result string    // the client's last announce result, to tell announces apart
+	nextAt time.Time // zero while due
+}
+
+// announceState is a tracker's line in the client's status
+type announceState struct {
+	next   time.Duration // until the next announce; zero while due
+	result string        // "never", "<n> peers" or the error
+}
+
+var peersResult = regexp.MustCompile(`^(\d+) peers$`)
+
+// parseTrackerStatus reads the announce state of every torrent's trackers
+// from the client's status, keyed by info hash and then tracker URL.
+// Trackers whose line doesn't describe an announce (WebTorrent ones) are
+// left out.
+func parseTrackerStatus(r io.Reader) map[string]map[string]announceState {
+	states := make(map[string]map[string]announceState)
+	var infoHash string
+	inTrackers := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Infohash: "):
+			infoHash = strings.TrimPrefix(line, "Infohash: ")
+			inTrackers = false
+		case line == "Enabled trackers:":
+			inTrackers = infoHash != ""
+		case inTrackers:
+			entry := strings.TrimLeft(line, " ")
+			if len(entry) == len(line) {
+				// The tracker table ends at the first line not indented
+				inTrackers = false
+				continue
+			}
+			quoted, err := strconv.QuotedPrefix(entry)
+			if err != nil {
+				continue // the header
+			}
+			trackerURL, _ := strconv.Unquote(quoted)
+			state, ok := parseAnnounceState(strings.TrimSpace(entry[len(quoted):]))
+			if !ok {
+				continue
+			}
+			if states[infoHash] == nil {
+				states[infoHash] = make(map[string]announceState)
+			}
+			if _, seen := states[infoHash][trackerURL]; !seen {
+				states[infoHash][trackerURL] = state
+			}
+		}
+	}
+	return states
+}
+
+// parseAnnounceState parses "next ann: <duration|anytime>, last ann: <result>"
+func parseAnnounceState(s string) (announceState, bool) {
+	rest, ok := strings.CutPrefix(s, "next ann: ")
+	if !ok {
+		return announceState{}, false
+	}
+	next, result, ok := strings.Cut(rest, ", last ann: ")
+	if !ok {
+		return announceState{}, false
+	}
+	state := announceState{result: result}
+	if next != "anytime" {
+		d, err := time.ParseDuration(next)
+		if err != nil {
+			return announceState{}, false
+		}
+		state.next = d
+	}
+	return state, true
+}
+
+// trackerStatuses lists a torrent's trackers in announce list order with
+// their announce states read at now. Announce times and scrape counts carry
+// over from prev.
+func trackerStatuses(announceList [][]string, states map[string]announceState, prev []TrackerStatus, now time.Time) []TrackerStatus {
+	old := make(map[string]TrackerStatus, len(prev))
+	for _, t := range prev {
+		old[t.url] = t
+	}
+
+	var trackers []TrackerStatus
+	seen := make(map[string]bool)
+	for tier, urls := range announceList {
+		for _, s := range urls {
+			key := s
+			if u, err := url.Parse(s); err == nil {
+				key = u.String() // as the client prints it
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			t := old[key]
+			t.URL, t.Tier, t.url = redact.URL(s), tier, key
+			state, ok := states[key]
+			if ok && state.result != "never" {
+				var nextAt time.Time
+				if state.next > 0 {
+					nextAt = now.Add(state.next)
+				}
+				moved := !nextAt.IsZero() && (t.nextAt.IsZero() || nextAt.Sub(t.nextAt).Abs() > announceSlack)
+				if t.LastAnnounceAt == nil || state.result != t.result || moved {
+					at := now
+					t.LastAnnounceAt = &at
+				}
+				if !nextAt.IsZero() || state.result != t.result {
+					t.nextAt = nextAt
+				}
+				t.result = state.result
+
+				t.Peers, t.LastError = 0, ""
+				if m := peersResult.FindStringSubmatch(state.result); m != nil {
+					t.Peers, _ = strconv.Atoi(m[1])
+				} else {
+					t.LastError = redact.String(state.result)
+				}
+			}
+			t.NextAnnounceAt = nil
+			if !t.nextAt.IsZero() && t.nextAt.After(now) {
+				next := t.nextAt
+				t.NextAnnounceAt = &next
+			}
+			trackers = append(trackers, t)
+		}
+	}
+	return trackers
+}
+
+// trackersFailing reports whether a torrent has trackers and every one of
+// them failed its last announce
+func trackersFailing(trackers []TrackerStatus) bool {
+	for _, t := range trackers {
+		if t.LastError == "" {
+			return false
+		}
+	}
+	return len(trackers) > 0
+}
+
+// refreshTrackers reads every torrent's announce results from the client
+// and updates its trackers and its HealthTrackersFailing warning. The
+// client keeps announce results to itself; its status dump is the only
+// place they show, and writing it covers every torrent under the client's
+// lock, so this runs off the update loop every trackerRefreshInterval
+// rather than per request. TestParseClientStatus pins the dump's format.
+func (e *Engine) refreshTrackers() {
+	e.mu.RLock()
+	client := e.client
+	torrents := make(map[string]*ManagedTorrent, len(e.torrents))
+	for infoHash, mt := range e.torrents {
+		torrents[infoHash] = mt
+	}
+	e.mu.RUnlock()
+	if client == nil {
+		return
+	}
+
+	var status bytes.Buffer
+	client.WriteStatus(&status)
+	states := parseTrackerStatus(&status)
+
+	announceLists := make(map[string][][]string, len(torrents))
+	for infoHash, mt := range torrents {
+		mi := mt.Torrent.Metainfo()
+		announceLists[infoHash] = mi.UpvertedAnnounceList()
+	}
+
+	now := time.Now()
+	var changed []string
+	e.mu.Lock()
+	for infoHash, announceList := range announceLists {
+		mt, ok := e.torrents[infoHash]
+		if !ok || mt != torrents[infoHash] {
+			continue
+		}
+		mt.trackers = trackerStatuses(announceList, states[infoHash], mt.trackers, now)
+
+		failing := trackersFailing(mt.trackers)
+		switch {
+		case failing && mt.healthWarning != HealthTrackersFailing:
+			mt.healthWarning = HealthTrackersFailing
+		case !failing && mt.healthWarning == HealthTrackersFailing:
+			mt.healthWarning = ""
+		default:
+			continue
+		}
+		mt.healthReported = false
+		changed = append(changed, infoHash)
+	}
+	e.mu.Unlock()
+
+	for _, infoHash := range changed {
+		e.sendUpdate(infoHash)
+	}
+}
+
+// Trackers returns a torrent's trackers as of the last refresh; false if
+// the engine doesn't have the torrent
+func (e *Engine) Trackers(infoHash string) ([]TrackerStatus, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	mt, ok := e.torrents[infoHash]
+	if !ok {
+		return nil, false
+	}
+	return append([]TrackerStatus{}, mt.trackers...), true
+}
+
+// scrapeTrackers asks every tracker for the swarm counts of the torrents
+// announcing to it, in batches, and keeps them on the torrents' trackers.
+// A tracker that can't be scraped is skipped until the next pass.
+func (e *Engine) scrapeTrackers() {
+	e.mu.RLock()
+	targets := make(map[string][]string) // tracker URL to info hashes
+	for infoHash, mt := range e.torrents {
+		for _, t := range mt.trackers {
+			targets[t.url] = append(targets[t.url], infoHash)
+		}
+	}
+	settings := e.settings
+	e.mu.RUnlock()
+
+	for announce, infoHashes := range targets {
+		for len(infoHashes) > 0 {
+			batch := infoHashes[:min(len(infoHashes), trackerScrapeBatch)]
+			infoHashes = infoHashes[len(batch):]
+
+			ctx, cancel := context.WithTimeout(e.ctx, trackerScrapeTimeout)
+			results, err := scrape(ctx, announce, batch, settings)
+			cancel()
+			if err != nil {
+				if e.ctx.Err() != nil {
+					return
+				}
+				break
+			}
+			e.storeScrape(announce, results)
+		}
+	}
+}
+
+// storeScrape sets the swarm counts one tracker returned, keyed by info hash
+func (e *Engine) storeScrape(announce string, results map[string]udp.ScrapeInfohashResult) {
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for infoHash, r := range results {
+		mt, ok := e.torrents[infoHash]
+		if !ok {
+			continue
+		}
+		for i := range mt.trackers {
+			t := &mt.trackers[i]
+			if t.url != announce {
+				continue
+			}
+			seeders, leechers, downloaded := int(r.Seeders), int(r.Leechers), int(r.Completed)
+			t.Seeders, t.Leechers, t.Downloaded = &seeders, &leechers, &downloaded
+			at := now
+			t.ScrapedAt = &at
+		}
+	}
+}
+
+// errNoScrape is returned for trackers with no scrape URL
+var errNoScrape = errors.New("tracker has no scrape URL")
+
+// scrape asks one tracker for the swarm counts of torrents, keyed by info
+// hash. Torrents the tracker doesn't report on are left out.
+func scrape(ctx context.Context, announce string, infoHashes []string, settings EngineSettings) (map[string]udp.ScrapeInfohashResult, error) {
+	hashes := make([]metainfo.Hash, 0, len(infoHashes))
+	for _, s := range infoHashes {
+		var h metainfo.Hash
+		if err := h.FromHexString(s); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpScrape(ctx, announce, hashes, settings.UserAgent)
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errNoScrape
+	}
+
+	opts := tracker.NewClientOpts{}
+	switch settings.IPFamily {
+	case config.IPFamilyIPv4:
+		opts.UdpNetwork = "udp4"
+	case config.IPFamilyIPv6:
+		opts.UdpNetwork = "udp6"
+	}
+	client, err := tracker.NewClient(announce, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	resp, err := client.Scrape(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]udp.ScrapeInfohashResult, len(resp))
+	for i, r := range resp {
+		if i < len(hashes) {
+			results[hashes[i].HexString()] = r
+		}
+	}
+	return results, nil
+}
+
+// httpScrape scrapes an HTTP tracker. The client's own HTTP scrape logs the
+// URL, passkey and all, so it isn't used.
+func httpScrape(ctx context.Context, announce string, hashes []metainfo.Hash, userAgent string) (map[string]udp.ScrapeInfohashResult, error) {
+	target, ok := scrapeURL(announce)
+	if !ok {
+		return nil, errNoScrape
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	for _, h := range hashes {
+		query.Add("info_hash", h.AsString())
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.New(redact.Error(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scrape returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Files   map[string]udp.ScrapeInfohashResult `bencode:"files"`
+		Failure string                              `bencode:"failure reason"`
+	}
+	if err := bencode.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Failure != "" {
+		return nil, errors.New(redact.String(body.Failure))
+	}
+	results := make(map[string]udp.ScrapeInfohashResult, len(body.Files))
+	for _, h := range hashes {
+		if r, ok := body.Files[h.AsString()]; ok {
+			results[h.HexString()] = r
+		}
+	}
+	return results, nil
+}
+
+// scrapeURL returns an HTTP tracker's scrape URL by the usual convention:
+// the last path segment, which must start with "announce", has that
+// replaced by "scrape". Trackers not following it can't be scraped.
+func scrapeURL(announce string) (string, bool) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", false
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", false
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+	return u.String(), true
+}
@@ -0,0 +1,173 @@
+package torrent
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// trackerStatusDump is the part of a client status dump that
+// parseTrackerStatus reads, for two torrents
+const trackerStatusDump = `# Torrents: 2
+
+ubuntu.iso
+50.000000% of 1000 bytes (1.0 kB)
+Infohash: 0123456789abcdef0123456789abcdef01234567
+Metadata length: 100
+Enabled trackers:
+    URL                                   Extra
+    "http://tracker.example.com/announce"  next ann: 29m10s, last ann: 12 peers
+    "udp://dead.example.com:1337"          next ann: anytime, last ann: error announcing: timed out
+    "wss://tracker.example.com"            {Sent:0 Received:0}
+DHT Announces: 3
+<unknown name>
+<missing metainfo>
+Infohash: 89abcdef0123456789abcdef0123456789abcdef
+Enabled trackers:
+    URL                          Extra
+    "udp://new.example.com:80"  next ann: anytime, last ann: never
+DHT Announces: 0
+`
+
+func TestParseTrackerStatus(t *testing.T) {
+	states := parseTrackerStatus(strings.NewReader(trackerStatusDump))
+	want := map[string]map[string]announceState{
+		"0123456789abcdef0123456789abcdef01234567": {
+			"http://tracker.example.com/announce": {next: 29*time.Minute + 10*time.Second, result: "12 peers"},
+			"udp://dead.example.com:1337":         {result: "error announcing: timed out"},
+		},
+		"89abcdef0123456789abcdef0123456789abcdef": {
+			"udp://new.example.com:80": {result: "never"},
+		},
+	}
+	if len(states) != len(want) {
+		t.Fatalf("parsed %d torrents, want %d: %+v", len(states), len(want), states)
+	}
+	for infoHash, trackers := range want {
+		if len(states[infoHash]) != len(trackers) {
+			t.Errorf("%s: %+v, want %+v", infoHash, states[infoHash], trackers)
+			continue
+		}
+		for u, state := range trackers {
+			if states[infoHash][u] != state {
+				t.Errorf("%s %s: %+v, want %+v", infoHash, u, states[infoHash][u], state)
+			}
+		}
+	}
+}
+
+// TestParseClientStatus reads a real client's status dump, so a change to
+// its format in an anacrolix upgrade fails here rather than leaving every
+// torrent's trackers silently empty
+func TestParseClientStatus(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason7:go awaye"))
+	}))
+	defer dead.Close()
+	liveURL, deadURL := live.URL+"/announce", dead.URL+"/announce"
+
+	client := newTestClient(t)
+
+	infoHash := metainfo.NewHashFromHex("0123456789abcdef0123456789abcdef01234567")
+	if _, _, err := client.AddTorrentSpec(&torrent.TorrentSpec{
+		InfoHash: infoHash,
+		Trackers: [][]string{{liveURL}, {deadURL}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var states map[string]announceState
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		var status bytes.Buffer
+		client.WriteStatus(&status)
+		states = parseTrackerStatus(&status)[infoHash.HexString()]
+		if states[liveURL].result != "never" && states[deadURL].result != "never" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if got := states[liveURL]; got.result != "0 peers" || got.next <= 0 {
+		t.Errorf("live tracker: %+v, want 0 peers and a next announce", got)
+	}
+	if got := states[deadURL]; !strings.Contains(got.result, "go away") {
+		t.Errorf("failing tracker: %+v, want its failure reason", got)
+	}
+}
+
+func TestTrackerStatuses(t *testing.T) {
+	announceList := [][]string{
+		{"http://tracker.example.com/0123456789abcdef0123456789abcdef/announce"},
+		{"udp://dead.example.com:1337", "udp://new.example.com:80"},
+	}
+	now := time.Now()
+	states := map[string]announceState{
+		"http://tracker.example.com/0123456789abcdef0123456789abcdef/announce": {next: 30 * time.Minute, result: "12 peers"},
+		"udp://dead.example.com:1337":                                          {result: "error announcing: dial udp: lookup dead.example.com: no such host"},
+		"udp://new.example.com:80":                                             {result: "never"},
+	}
+	trackers := trackerStatuses(announceList, states, nil, now)
+	if len(trackers) != 3 {
+		t.Fatalf("got %d trackers: %+v", len(trackers), trackers)
+	}
+	ok, dead, fresh := trackers[0], trackers[1], trackers[2]
+	if strings.Contains(ok.URL, "0123456789abcdef") || ok.Tier != 0 || ok.Peers != 12 || ok.LastError != "" ||
+		ok.LastAnnounceAt == nil || ok.NextAnnounceAt == nil || !ok.NextAnnounceAt.Equal(now.Add(30*time.Minute)) {
+		t.Errorf("announced: %+v", ok)
+	}
+	if dead.Tier != 1 || dead.LastError == "" || dead.LastAnnounceAt == nil || dead.NextAnnounceAt != nil {
+		t.Errorf("failed: %+v", dead)
+	}
+	if fresh.LastAnnounceAt != nil || fresh.LastError != "" || fresh.NextAnnounceAt != nil {
+		t.Errorf("never announced: %+v", fresh)
+	}
+	if trackersFailing(trackers) {
+		t.Error("failing with a tracker answering")
+	}
+
+	// The same announce seen again keeps its time; a new one moves it
+	seeders := 4
+	trackers[0].Seeders = &seeders
+	later := now.Add(trackerRefreshInterval)
+	states["http://tracker.example.com/0123456789abcdef0123456789abcdef/announce"] = announceState{next: 30*time.Minute - trackerRefreshInterval, result: "12 peers"}
+	states["udp://dead.example.com:1337"] = announceState{next: 10 * time.Minute, result: "error announcing: timed out"}
+	again := trackerStatuses(announceList, states, trackers, later)
+	if !again[0].LastAnnounceAt.Equal(now) || again[0].Seeders == nil || *again[0].Seeders != 4 {
+		t.Errorf("announce seen again: %+v", again[0])
+	}
+	if !again[1].LastAnnounceAt.Equal(later) || again[1].LastError != "error announcing: timed out" {
+		t.Errorf("new announce: %+v", again[1])
+	}
+
+	failing := []TrackerStatus{{LastError: "timed out"}, {LastError: "tracker offline"}}
+	if !trackersFailing(failing) || trackersFailing(nil) {
+		t.Error("trackersFailing wrong")
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce, want string
+	}{
+		{"http://tracker.example.com/announce", "http://tracker.example.com/scrape"},
+		{"https://tracker.example.com:443/abc/announce.php?passkey=x", "https://tracker.example.com:443/abc/scrape.php?passkey=x"},
+		{"http://tracker.example.com/a", ""},
+		{"http://tracker.example.com/announce/x", ""},
+	}
+	for _, tt := range tests {
+		got, ok := scrapeURL(tt.announce)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("scrapeURL(%q) = %q, %v; want %q", tt.announce, got, ok, tt.want)
+		}
+	}
+}
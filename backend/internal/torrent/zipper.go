@@ -2,35 +2,66 @@ package torrent
 
 import (
 	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/freetorrent/freetorrent/internal/models"
 )
 
-// CreateZipFromFiles creates a zip archive from a list of files
-func CreateZipFromFiles(downloadDir, torrentName string, files []string) (string, int64, error) {
+// ZipArchive is an archive built by CreateZipFromFiles
+type ZipArchive struct {
+	Name     string // within the download directory
+	Size     int64
+	SHA256   string // hex digest of the whole archive
+	Manifest []models.ZipManifestEntry
+}
+
+// CreateZipFromFiles creates a zip archive in downloadDir from a list of
+// files relative to it. The archive's SHA-256 and each entry's CRC-32 are
+// computed as it is written, so it isn't read back. If ctx is cancelled
+// between files the partial archive is removed.
+func CreateZipFromFiles(ctx context.Context, downloadDir, torrentName string, files []string) (*ZipArchive, error) {
 	// Create zip file path
-	zipName := sanitizeFileName(torrentName) + ".zip"
+	zipName := SanitizeFileName(torrentName) + ".zip"
 	zipPath := filepath.Join(downloadDir, zipName)
 	
-	// Create zip file
-	zipFile, err := os.Create(zipPath)
+	// Built under a temporary name and renamed into place, so rows already
+	// serving a zip of this name never see a half-written one
+	zipFile, err := os.CreateTemp(downloadDir, zipName+".*.tmp")
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to create zip file: %w", err)
+		return nil, fmt.Errorf("failed to create zip file: %w", err)
 	}
+	tmpPath := zipFile.Name()
 	defer zipFile.Close()
 	
-	zipWriter := zip.NewWriter(zipFile)
+	digest := sha256.New()
+	zipWriter := zip.NewWriter(io.MultiWriter(zipFile, digest))
 	defer zipWriter.Close()
 	
+	manifest := make([]models.ZipManifestEntry, 0, len(files))
+	
 	// Add each file to the zip
 	for _, filePath := range files {
+		if err := ctx.Err(); err != nil {
+			zipWriter.Close()
+			zipFile.Close()
+			os.Remove(tmpPath)
+			return nil, err
+		}
+
 		fullPath := filepath.Join(downloadDir, filePath)
 		
 		// Security check
-		if !strings.HasPrefix(filepath.Clean(fullPath), filepath.Clean(downloadDir)) {
+		if !strings.HasPrefix(filepath.Clean(fullPath), filepath.Clean(downloadDir)+string(filepath.Separator)) {
 			continue
 		}
 		
@@ -66,46 +97,166 @@ func CreateZipFromFiles(downloadDir, torrentName string, files []string) (string
 			continue
 		}
 		
-		_, err = io.Copy(writer, file)
+		// The entry is in the archive even if the copy fails, holding what
+		// was copied
+		crc := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(writer, crc), file)
 		file.Close()
+		manifest = append(manifest, models.ZipManifestEntry{
+			Name:  header.Name,
+			Size:  n,
+			CRC32: fmt.Sprintf("%08x", crc.Sum32()),
+		})
 		if err != nil {
 			continue
 		}
 	}
 	
 	// Close the zip writer to flush data
-	zipWriter.Close()
+	if err := zipWriter.Close(); err != nil {
+		zipFile.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to finish zip file: %w", err)
+	}
 	zipFile.Close()
 	
 	// Get zip file size
-	zipInfo, err := os.Stat(zipPath)
+	zipInfo, err := os.Stat(tmpPath)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to stat zip file: %w", err)
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to stat zip file: %w", err)
+	}
+	// CreateTemp makes the file private; the zip is read like the data
+	os.Chmod(tmpPath, 0644)
+	if err := os.Rename(tmpPath, zipPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to move zip file into place: %w", err)
 	}
 	
-	return zipName, zipInfo.Size(), nil
+	return &ZipArchive{
+		Name:     zipName,
+		Size:     zipInfo.Size(),
+		SHA256:   hex.EncodeToString(digest.Sum(nil)),
+		Manifest: manifest,
+	}, nil
+}
+
+// ZipEntry is a file to add to a streamed archive
+type ZipEntry struct {
+	Path string // relative to the directory given to WriteZip
+	Name string // name inside the archive
 }
 
-// sanitizeFileName removes invalid characters from filename
-func sanitizeFileName(name string) string {
-	// Replace invalid characters
-	invalid := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|"}
-	result := name
-	for _, char := range invalid {
-		result = strings.ReplaceAll(result, char, "_")
+// WriteZip streams entries into a zip archive written to w and returns how
+// many bytes of file data went out. Entries are stored uncompressed so the
+// archive streams at disk speed. Unlike CreateZipFromFiles it stops at the
+// first error: once an entry's header is sent it can't be skipped.
+func WriteZip(ctx context.Context, w io.Writer, downloadDir string, entries []ZipEntry) (int64, error) {
+	zipWriter := zip.NewWriter(w)
+
+	var written int64
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		fullPath := filepath.Join(downloadDir, entry.Path)
+		if !strings.HasPrefix(filepath.Clean(fullPath), filepath.Clean(downloadDir)+string(filepath.Separator)) {
+			continue
+		}
+
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return written, fmt.Errorf("failed to open %s: %w", entry.Path, err)
+		}
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			file.Close()
+			continue
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			file.Close()
+			return written, err
+		}
+		header.Name = entry.Name
+		header.Method = zip.Store
+
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			file.Close()
+			return written, err
+		}
+		n, err := io.Copy(writer, file)
+		file.Close()
+		written += n
+		if err != nil {
+			return written, err
+		}
 	}
-	
-	// Limit length
-	if len(result) > 200 {
-		result = result[:200]
+
+	return written, zipWriter.Close()
+}
+
+// maxFileNameBytes bounds sanitized names, leaving room for an extension
+// under the usual 255-byte filesystem limit
+const maxFileNameBytes = 200
+
+// unsafeFileNameChars are path separators and characters Windows rejects
+const unsafeFileNameChars = `/\:*?"<>|`
+
+// windowsDeviceNames can't be used as file names on Windows, whatever the
+// extension
+var windowsDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName makes name safe to save as on Linux, macOS and Windows.
+// Path separators, characters Windows rejects, control characters,
+// bidirectional overrides (which can disguise an extension) and invalid
+// UTF-8 become underscores, and runs of underscores collapse into one.
+// Leading and trailing spaces and dots are dropped, Windows device names
+// such as CON or nul.txt get an underscore prefix, and the result is cut to
+// maxFileNameBytes without splitting a character. Other text, including CJK,
+// right-to-left scripts and emoji, is kept. An empty result becomes
+// "download".
+func SanitizeFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r == utf8.RuneError || unicode.IsControl(r) || isBidiControl(r) || strings.ContainsRune(unsafeFileNameChars, r) {
+			r = '_'
+		}
+		if r == '_' && strings.HasSuffix(b.String(), "_") {
+			continue
+		}
+		b.WriteRune(r)
 	}
-	
-	// Remove leading/trailing spaces and dots
-	result = strings.Trim(result, " .")
-	
+	result := strings.Trim(b.String(), " .")
+
+	stem, _, _ := strings.Cut(result, ".")
+	if windowsDeviceNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		result = "_" + result
+	}
+
+	for len(result) > maxFileNameBytes {
+		_, size := utf8.DecodeLastRuneInString(result)
+		result = result[:len(result)-size]
+	}
+	result = strings.TrimRight(result, " .")
+
 	if result == "" {
 		result = "download"
 	}
-	
 	return result
 }
+
+// isBidiControl reports whether r is a bidirectional embedding, override or
+// isolate. Right-to-left text needs none of them to display correctly.
+func isBidiControl(r rune) bool {
+	return (r >= '\u202A' && r <= '\u202E') || (r >= '\u2066' && r <= '\u2069')
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"movie.mkv", "movie.mkv"},
+
+		// Text in any script is kept
+		{"电影 第一集.mkv", "电影 第一集.mkv"},
+		{"فيلم.mp4", "فيلم.mp4"},
+		{"סרט.mkv", "סרט.mkv"},
+		{"🎬 film 🍿.mkv", "🎬 film 🍿.mkv"},
+
+		// Separators and characters Windows rejects
+		{`a/b\c:d*e?f"g<h>i|j`, "a_b_c_d_e_f_g_h_i_j"},
+		{"../../etc/passwd", "_.._etc_passwd"},
+		{"a///b", "a_b"},
+		{"a__b", "a_b"},
+		{"___", "_"},
+
+		// Control characters, bidi overrides and invalid UTF-8
+		{"tab\there\nnl", "tab_here_nl"},
+		{"evil‮gpj.exe", "evil_gpj.exe"},
+		{"⁧isolated⁩.txt", "_isolated_.txt"},
+		{"\xff\xfebad", "_bad"},
+
+		// Leading and trailing dots and spaces
+		{"..hidden..", "hidden"},
+		{"  spaced  ", "spaced"},
+
+		// Windows device names, with or without an extension
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"con .txt", "_con .txt"},
+		{"COM1.tar.gz", "_COM1.tar.gz"},
+		{"CONSOLE.txt", "CONSOLE.txt"},
+
+		{"", "download"},
+		{"...", "download"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeFileName(tt.in); got != tt.want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFileNameLength(t *testing.T) {
+	for _, name := range []string{
+		strings.Repeat("a", 500),
+		strings.Repeat("é", 150),
+		strings.Repeat("a", maxFileNameBytes-1) + "日本",
+		strings.Repeat("🎬", 100),
+		strings.Repeat("a", maxFileNameBytes-1) + " .mkv",
+	} {
+		got := SanitizeFileName(name)
+		if len(got) > maxFileNameBytes || !utf8.ValidString(got) || !strings.HasPrefix(name, got) {
+			t.Errorf("SanitizeFileName(%d bytes) = %q (%d bytes), want a valid prefix of at most %d bytes",
+				len(name), got, len(got), maxFileNameBytes)
+		}
+		if strings.HasSuffix(got, " ") || strings.HasSuffix(got, ".") {
+			t.Errorf("SanitizeFileName(%d bytes) ends in %q", len(name), got[len(got)-1:])
+		}
+	}
+}
+
+// TestCreateZipFromFiles builds an archive and checks the recorded size and
+// checksum match the file left in place, with no temporary file behind
+func TestCreateZipFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := CreateZipFromFiles(context.Background(), dir, "Some Torrent", []string{"a.txt", "missing.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, archive.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != archive.Size || hex.EncodeToString(sum[:]) != archive.SHA256 {
+		t.Errorf("archive = %d bytes %s, file is %d bytes %x", archive.Size, archive.SHA256, len(data), sum)
+	}
+	if len(archive.Manifest) != 1 || archive.Manifest[0].Name != "a.txt" || archive.Manifest[0].Size != 5 {
+		t.Errorf("manifest = %+v, want a.txt alone", archive.Manifest)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmps) > 0 {
+		t.Errorf("temporary files left: %v", tmps)
+	}
+}
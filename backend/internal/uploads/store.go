@@ -0,0 +1,212 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/freetorrent/freetorrent/internal/database"
+	"github.com/freetorrent/freetorrent/internal/models"
+	"github.com/google/uuid"
+)
+
+// TTL is how long an upload is kept after its last chunk arrives
+const TTL = 24 * time.Hour
+
+var (
+	// ErrNotFound is returned for an unknown, expired or foreign upload
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch is returned when a chunk doesn't start where the
+	// upload left off
+	ErrOffsetMismatch = errors.New("chunk does not start at the upload offset")
+	// ErrTooLarge is returned for a chunk running past the declared size, or
+	// an upload too big for what it is read for
+	ErrTooLarge = errors.New("upload too large")
+	// ErrIncomplete is returned when reading an upload still in progress
+	ErrIncomplete = errors.New("upload is not complete")
+)
+
+// Store keeps resumable uploads: metadata in the database, data in one file
+// per upload under dir, grouped by owner
+type Store struct {
+	db  *database.Database
+	dir string
+}
+
+// NewStore creates an upload store rooted at dir
+func NewStore(db *database.Database, dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return &Store{db: db, dir: dir}, nil
+}
+
+func (s *Store) path(userID, id uuid.UUID) string {
+	return filepath.Join(s.dir, userID.String(), id.String())
+}
+
+// Create starts an empty upload of size bytes for the user
+func (s *Store) Create(ctx context.Context, userID uuid.UUID, filename string, size int64) (*models.Upload, error) {
+	u := &models.Upload{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Filename:  filepath.Base(filename),
+		Size:      size,
+		ExpiresAt: time.Now().Add(TTL),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path(userID, u.ID)), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	f, err := os.Create(s.path(userID, u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	f.Close()
+
+	if err := s.db.CreateUpload(ctx, u); err != nil {
+		os.Remove(s.path(userID, u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+// Get returns the user's upload
+func (s *Store) Get(ctx context.Context, userID, id uuid.UUID) (*models.Upload, error) {
+	u, err := s.db.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || u.UserID != userID {
+		return nil, ErrNotFound
+	}
+	return u, nil
+}
+
+// Append writes a chunk that must start at the upload's current offset and
+// returns the upload as it stands afterwards. A chunk that loses a race with
+// another one for the same offset gets ErrOffsetMismatch.
+func (s *Store) Append(ctx context.Context, userID, id uuid.UUID, start int64, chunk io.Reader, length int64) (*models.Upload, error) {
+	u, err := s.Get(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if start != u.Received {
+		return u, ErrOffsetMismatch
+	}
+	if start+length > u.Size {
+		return u, ErrTooLarge
+	}
+
+	f, err := os.OpenFile(s.path(userID, id), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer f.Close()
+
+	// Writing at the recorded offset overwrites whatever an earlier chunk
+	// left past it without managing to record
+	n, err := io.Copy(io.NewOffsetWriter(f, start), io.LimitReader(chunk, length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write chunk: %w", err)
+	}
+	if n != length {
+		return nil, fmt.Errorf("chunk was %d bytes, expected %d", n, length)
+	}
+
+	expiresAt := time.Now().Add(TTL)
+	ok, err := s.db.AdvanceUpload(ctx, id, start, start+n, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return u, ErrOffsetMismatch
+	}
+
+	u.Received = start + n
+	u.ExpiresAt = expiresAt
+	if u.Complete() {
+		if err := f.Truncate(u.Size); err != nil {
+			return nil, fmt.Errorf("failed to finish upload: %w", err)
+		}
+	}
+	return u, nil
+}
+
+// Read returns the data of a complete upload of at most maxSize bytes. The
+// upload is kept until the caller removes it, so a failed use can be retried.
+func (s *Store) Read(ctx context.Context, userID, id uuid.UUID, maxSize int64) ([]byte, *models.Upload, error) {
+	u, err := s.Get(ctx, userID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !u.Complete() {
+		return nil, u, ErrIncomplete
+	}
+	if u.Size > maxSize {
+		return nil, u, ErrTooLarge
+	}
+
+	data, err := os.ReadFile(s.path(userID, id))
+	if err != nil {
+		return nil, u, fmt.Errorf("failed to read upload: %w", err)
+	}
+	return data, u, nil
+}
+
+// LinkTo makes a complete upload's data appear at dest as well, hard linked
+// when dest is on the same filesystem and copied otherwise. The upload is
+// kept until the caller removes it.
+func (s *Store) LinkTo(u *models.Upload, dest string) error {
+	if !u.Complete() {
+		return ErrIncomplete
+	}
+	src := s.path(u.UserID, u.ID)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to copy upload: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy upload: %w", err)
+	}
+	return out.Close()
+}
+
+// Remove deletes an upload and its data
+func (s *Store) Remove(ctx context.Context, u *models.Upload) error {
+	if err := s.db.DeleteUpload(ctx, u.ID); err != nil {
+		return err
+	}
+	os.Remove(s.path(u.UserID, u.ID))
+	return nil
+}
+
+// SweepExpired removes uploads that expired before completing or being
+// consumed, and returns how many it removed
+func (s *Store) SweepExpired(ctx context.Context) (int, error) {
+	expired, err := s.db.DeleteExpiredUploads(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range expired {
+		if err := os.Remove(s.path(u.UserID, u.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove expired upload %s: %v", u.ID, err)
+		}
+	}
+	return len(expired), nil
+}
@@ -110,20 +110,28 @@ export function Layout({ children }: LayoutProps) {
                   <div className="flex justify-between text-sm mb-1">
                     <span className="text-gray-700">Downloads</span>
                     <span className="text-gray-900 font-medium">
-                      {usage.used_gb.toFixed(2)} / {usage.limit_gb === -1 ? '∞' : usage.limit_gb} GB
+                      {usage.used_human} / {usage.limit_bytes === -1 ? '∞' : usage.limit_human}
                     </span>
                   </div>
                   <div className="h-2 bg-gray-200 rounded-full overflow-hidden">
                     <div
                       className="h-full bg-primary-600 rounded-full transition-all"
                       style={{
-                        width: usage.limit_gb === -1 
-                          ? '10%' 
-                          : `${Math.min(100, (usage.used_gb / usage.limit_gb) * 100)}%`
+                        width: usage.limit_bytes === -1
+                          ? '10%'
+                          : usage.limit_reached
+                            ? '100%'
+                            : `${Math.min(99, (usage.used_bytes / usage.limit_bytes) * 100)}%`
                       }}
                     />
                   </div>
                 </div>
+                <div className="flex justify-between text-sm">
+                  <span className="text-gray-500">Storage</span>
+                  <span className="text-gray-900">
+                    {usage.storage_used_human} / {usage.storage_limit_bytes === -1 ? '∞' : usage.storage_limit_human}
+                  </span>
+                </div>
                 <div className="flex justify-between text-sm">
                   <span className="text-gray-500">Active torrents</span>
                   <span className="text-gray-900">
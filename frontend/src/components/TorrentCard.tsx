@@ -19,6 +19,7 @@ import {
   formatBytes, 
   formatSpeed, 
   formatProgress,
+  formatDuration,
   getStatusColor,
   estimateTimeRemaining
 } from '../lib/utils'
@@ -52,7 +53,8 @@ export function TorrentCard({ torrent }: TorrentCardProps) {
 
   const deleteMutation = useMutation({
     mutationFn: () => torrentsApi.delete(torrent.id),
-    onSuccess: () => {
+    onSuccess: (deleted) => {
+      if (!deleted) return
       queryClient.invalidateQueries({ queryKey: ['torrents'] })
       toast.success('Torrent deleted')
     },
@@ -64,12 +66,18 @@ export function TorrentCard({ torrent }: TorrentCardProps) {
       torrentsApi.createDownloadToken(torrent.id, filePath, useZip),
     onSuccess: (data) => {
       window.open(data.download_url, '_blank')
+      // The link can't outlive the torrent's files
+      if (data.clamped) {
+        toast(`Link expires with the torrent in ${formatDuration(data.expires_in)}`)
+      }
     },
     onError: () => toast.error('Failed to generate download link'),
   })
 
   const hasMultipleFiles = torrent.files && torrent.files.length > 1
   const hasZip = !!torrent.zip_path
+  // Torrents the zip policy skipped are streamed as a zip on demand
+  const zipSkipped = torrent.zip_status === 'skipped_size' || torrent.zip_status === 'disabled'
 
   const isDownloading = torrent.status === 'downloading'
   const isCompleted = torrent.status === 'completed' || torrent.status === 'seeding'
@@ -129,6 +137,20 @@ export function TorrentCard({ torrent }: TorrentCardProps) {
                 <Users className="w-3.5 h-3.5" />
                 {torrent.seeds} seeds, {torrent.peers} peers
               </span>
+
+              {isDownloading && !!torrent.files_total && torrent.files_total > 1 && (
+                <span>{torrent.files_completed ?? 0}/{torrent.files_total} files</span>
+              )}
+
+              {torrent.expires_in_seconds !== undefined && (
+                <span className={cn(
+                  'flex items-center gap-1',
+                  torrent.expires_in_seconds < 24 * 3600 && 'text-red-600 font-medium'
+                )}>
+                  <Clock className="w-3.5 h-3.5" />
+                  Expires in {formatDuration(torrent.expires_in_seconds)}
+                </span>
+              )}
             </div>
 
             {/* Progress bar */}
@@ -180,9 +202,9 @@ export function TorrentCard({ torrent }: TorrentCardProps) {
             {isCompleted && (
               <button
                 onClick={() => {
-                  if (hasMultipleFiles && hasZip) {
+                  if (hasMultipleFiles && (hasZip || zipSkipped)) {
                     // Download zip for multi-file torrents
-                    downloadMutation.mutate({ filePath: torrent.zip_path!, useZip: true })
+                    downloadMutation.mutate({ filePath: torrent.zip_path ?? '', useZip: true })
                   } else if (torrent.files && torrent.files.length > 0) {
                     downloadMutation.mutate({ filePath: torrent.files[0].path, useZip: false })
                   } else if (torrent.name) {
@@ -227,6 +249,12 @@ export function TorrentCard({ torrent }: TorrentCardProps) {
             {torrent.error_message}
           </div>
         )}
+
+        {torrent.health_warning === 'no_seeders' && (
+          <div className="mt-3 p-3 bg-yellow-50 border border-yellow-200 rounded-lg text-sm text-yellow-800">
+            No seeders found for this torrent. Check the magnet link or source is still alive.
+          </div>
+        )}
       </div>
 
       {/* Files list */}
@@ -1,5 +1,7 @@
 import { useEffect, useRef, useCallback, useState } from 'react'
 import { useAuthStore } from '../lib/store'
+import api from '../lib/api'
+import type { Notification, TransferSummary } from '../types'
 
 // SSE event types from backend
 export interface SSETorrentUpdate {
@@ -22,6 +24,7 @@ export interface SSETorrentUpdate {
     Priority: number
   }>
   Error?: string
+  HealthWarning?: string
 }
 
 // Transform backend format to frontend Torrent format
@@ -46,6 +49,7 @@ function transformTorrentUpdate(update: SSETorrentUpdate) {
       priority: f.Priority,
     })),
     error_message: update.Error,
+    health_warning: (update.HealthWarning || undefined) as 'no_seeders' | undefined,
   }
 }
 
@@ -56,6 +60,8 @@ interface UseSSEOptions {
   onConnected?: () => void
   onError?: (error: Event) => void
   onHeartbeat?: (time: number) => void
+  onNotification?: (notification: Notification) => void
+  onSummary?: (summary: TransferSummary) => void
   enabled?: boolean
   reconnectInterval?: number
 }
@@ -67,6 +73,8 @@ export function useSSE({
   onConnected,
   onError,
   onHeartbeat,
+  onNotification,
+  onSummary,
   enabled = true,
   reconnectInterval = 5000,
 }: UseSSEOptions = {}) {
@@ -87,7 +95,7 @@ export function useSSE({
     }
   }, [])
 
-  const connect = useCallback(() => {
+  const connect = useCallback(async () => {
     if (!accessToken || !enabled) {
       setStatus('disconnected')
       return
@@ -98,8 +106,19 @@ export function useSSE({
 
     setStatus('connecting')
 
-    // Create EventSource with token as query param (SSE doesn't support headers)
-    const eventSource = new EventSource(`/api/v1/events?token=${encodeURIComponent(accessToken)}`)
+    // EventSource can't send headers, so trade the token for a single-use
+    // ticket to put in the URL; every reconnect needs a fresh one
+    let ticket: string
+    try {
+      const response = await api.post<{ ticket: string; expires_in: number }>('/events/ticket')
+      ticket = response.data.ticket
+    } catch {
+      setStatus('error')
+      reconnectTimeoutRef.current = setTimeout(connect, reconnectInterval)
+      return
+    }
+
+    const eventSource = new EventSource(`/api/v1/events?ticket=${encodeURIComponent(ticket)}`)
     eventSourceRef.current = eventSource
 
     eventSource.addEventListener('connected', () => {
@@ -128,6 +147,22 @@ export function useSSE({
       }
     })
 
+    eventSource.addEventListener('notification', (event) => {
+      try {
+        onNotification?.(JSON.parse(event.data))
+      } catch (e) {
+        console.error('Failed to parse SSE notification:', e)
+      }
+    })
+
+    eventSource.addEventListener('summary', (event) => {
+      try {
+        onSummary?.(JSON.parse(event.data))
+      } catch (e) {
+        console.error('Failed to parse SSE summary:', e)
+      }
+    })
+
     eventSource.addEventListener('timeout', () => {
       // Server closed connection after timeout, reconnect
       cleanup()
@@ -142,7 +177,7 @@ export function useSSE({
       // Reconnect after interval
       reconnectTimeoutRef.current = setTimeout(connect, reconnectInterval)
     }
-  }, [accessToken, enabled, cleanup, onConnected, onTorrentsUpdate, onHeartbeat, onError, reconnectInterval])
+  }, [accessToken, enabled, cleanup, onConnected, onTorrentsUpdate, onHeartbeat, onNotification, onSummary, onError, reconnectInterval])
 
   // Connect on mount and when dependencies change
   useEffect(() => {
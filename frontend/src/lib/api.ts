@@ -1,11 +1,19 @@
 import axios, { AxiosError } from 'axios'
-import type { AuthResponse, MeResponse, Torrent, TorrentListResponse, ApiError } from '../types'
+import type { AuthResponse, MeResponse, Torrent, TorrentListResponse, CompactTorrentListResponse, ApiError, ConfirmationResponse, SearchResponse, ImportJob, NotificationListResponse, SubscriptionHistoryResponse, ZipManifest } from '../types'
 import { useAuthStore } from './store'
+import { version } from '../../package.json'
+
+// Lets the API tell which clients are in use and turn away outdated ones
+const clientHeaders = {
+  'X-Client': 'web',
+  'X-Client-Version': version,
+}
 
 const api = axios.create({
   baseURL: '/api/v1',
   headers: {
     'Content-Type': 'application/json',
+    ...clientHeaders,
   },
 })
 
@@ -67,7 +75,7 @@ api.interceptors.response.use(
         if (refreshToken) {
           const response = await axios.post<AuthResponse>('/api/v1/auth/refresh', {
             refresh_token: refreshToken,
-          })
+          }, { headers: clientHeaders })
           
           const newToken = response.data.access_token
           useAuthStore.getState().setTokens(newToken, response.data.refresh_token)
@@ -130,6 +138,13 @@ export const torrentsApi = {
     })
     return response.data
   },
+
+  listCompact: async (page = 1, pageSize = 100) => {
+    const response = await api.get<CompactTorrentListResponse>('/torrents', {
+      params: { page, page_size: pageSize, view: 'compact' },
+    })
+    return response.data
+  },
   
   get: async (id: string) => {
     const response = await api.get<Torrent>(`/torrents/${id}`)
@@ -154,9 +169,65 @@ export const torrentsApi = {
     })
     return response.data
   },
+
+  // Creates and seeds a torrent from completed resumable uploads
+  create: async (req: { upload_ids: string[]; name?: string; piece_size?: number; trackers?: string[]; comment?: string; collection_id?: string }) => {
+    const response = await api.post<Torrent>('/torrents/create', req)
+    return response.data
+  },
+
+  // Starts a background import; poll getImport for the outcome of each item
+  import: async (items: { magnet: string; label?: string }[] | File) => {
+    if (items instanceof File) {
+      const formData = new FormData()
+      formData.append('file', items)
+      const response = await api.post<ImportJob>('/torrents/import', formData, {
+        headers: { 'Content-Type': 'multipart/form-data' },
+      })
+      return response.data
+    }
+    const response = await api.post<ImportJob>('/torrents/import', items)
+    return response.data
+  },
+
+  getImport: async (jobId: string) => {
+    const response = await api.get<ImportJob>(`/torrents/import/${jobId}`)
+    return response.data
+  },
+
+  // A file shown inline: text, images and PDFs. Fetched as a blob since it
+  // needs the auth header; lines previews just the start of a text file.
+  previewFile: async (id: string, path: string, lines?: number) => {
+    const response = await api.get<Blob>(`/torrents/${id}/preview`, {
+      params: { path, lines },
+      responseType: 'blob',
+    })
+    return {
+      blob: response.data,
+      truncated: response.headers['x-preview-truncated'] === 'true',
+    }
+  },
+
+  getZipManifest: async (id: string) => {
+    const response = await api.get<ZipManifest>(`/torrents/${id}/zip/manifest`)
+    return response.data
+  },
   
+  // Resolves false when the server asked for confirmation and the user declined
   delete: async (id: string, deleteFiles = true) => {
-    await api.delete(`/torrents/${id}`, { params: { delete_files: deleteFiles } })
+    const params = { delete_files: deleteFiles }
+    const response = await api.delete<ConfirmationResponse | undefined>(`/torrents/${id}`, { params })
+    if (response.status !== 202 || !response.data?.confirm_token) {
+      return true
+    }
+    if (!window.confirm(`Delete this torrent? The ${response.data.reason}.`)) {
+      return false
+    }
+    await api.delete(`/torrents/${id}`, {
+      params,
+      headers: { 'X-Confirm-Token': response.data.confirm_token },
+    })
+    return true
   },
   
   pause: async (id: string) => {
@@ -168,7 +239,7 @@ export const torrentsApi = {
   },
   
   createDownloadToken: async (torrentId: string, filePath: string, useZip = false) => {
-    const response = await api.post<{ token: string; download_url: string; expires_in: number; is_zip: boolean }>(
+    const response = await api.post<{ token: string; download_url: string; expires_in: number; expires_at: string; clamped: boolean; downloads_left: number; is_zip: boolean; reused: boolean }>(
       `/torrents/${torrentId}/token`,
       { file_path: filePath, use_zip: useZip }
     )
@@ -176,6 +247,45 @@ export const torrentsApi = {
   },
 }
 
+// Search API, only when capabilities report search
+export const searchApi = {
+  search: async (q: string, provider?: string) => {
+    const response = await api.get<SearchResponse>('/search', { params: { q, provider } })
+    return response.data
+  },
+
+  add: async (id: string) => {
+    const response = await api.post<Torrent>('/search/add', { id })
+    return response.data
+  },
+}
+
+// Notifications API; the unread count also comes with authApi.me
+export const notificationsApi = {
+  list: async (unread = false, before?: string) => {
+    const response = await api.get<NotificationListResponse>('/notifications', { params: { unread, before } })
+    return response.data
+  },
+
+  markRead: async (id: string) => {
+    const response = await api.post<{ unread: number }>(`/notifications/${id}/read`)
+    return response.data
+  },
+
+  markAllRead: async () => {
+    const response = await api.post<{ marked: number; unread: number }>('/notifications/read_all')
+    return response.data
+  },
+}
+
+// Subscription API
+export const subscriptionApi = {
+  getHistory: async (before?: string) => {
+    const response = await api.get<SubscriptionHistoryResponse>('/subscription/history', { params: { before } })
+    return response.data
+  },
+}
+
 // Admin API
 export const adminApi = {
   getUsers: async (page = 1, pageSize = 20) => {
@@ -188,12 +298,20 @@ export const adminApi = {
     return response.data
   },
   
-  updateUser: async (id: string, data: { role?: string; plan?: string }) => {
+  updateUser: async (id: string, data: { role?: string; plan?: string; reason?: string }) => {
     await api.patch(`/admin/users/${id}`, data)
   },
+
+  getSubscriptionHistory: async (id: string, before?: string) => {
+    const response = await api.get<SubscriptionHistoryResponse>(`/admin/users/${id}/subscription-history`, {
+      params: { before },
+    })
+    return response.data
+  },
   
+  // Callers confirm with the admin first
   deleteUser: async (id: string) => {
-    await api.delete(`/admin/users/${id}`)
+    await api.delete(`/admin/users/${id}`, { params: { force: true } })
   },
   
   getAllTorrents: async (page = 1, pageSize = 20) => {
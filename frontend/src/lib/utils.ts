@@ -57,6 +57,8 @@ export function getStatusColor(status: string): string {
       return 'text-yellow-600 bg-yellow-100'
     case 'failed':
       return 'text-red-600 bg-red-100'
+    case 'needs_redownload':
+      return 'text-orange-600 bg-orange-100'
     case 'pending':
       return 'text-gray-600 bg-gray-100'
     default:
@@ -55,6 +55,7 @@ export function DashboardPage() {
             total_size: update.total_size || torrent.total_size,
             files: update.files || torrent.files,
             error_message: update.error_message,
+            health_warning: update.health_warning,
           }
         }
         return torrent
@@ -17,12 +17,49 @@ export interface Subscription {
   created_at: string
 }
 
+export interface SubscriptionEvent {
+  id: string
+  user_id: string
+  actor_type: 'system' | 'admin' | 'stripe' | 'user'
+  actor_id?: string // admin view only
+  actor_email?: string // admin view only
+  old_plan: string
+  new_plan: string
+  old_status: string
+  new_status: string
+  reason?: string // admin view only
+  created_at: string
+}
+
+export interface SubscriptionHistoryResponse {
+  events: SubscriptionEvent[]
+  next_before?: string
+}
+
 export interface UsageStats {
+  used_bytes: number
+  uploaded_bytes: number
+  served_bytes: number
+  limit_bytes: number // -1 for unlimited
+  storage_used_bytes: number
+  storage_limit_bytes: number // -1 for unlimited
+  limit_reached: boolean
+  storage_limit_reached: boolean
+  used_human: string
+  limit_human: string
+  storage_used_human: string
+  storage_limit_human: string
   used_gb: number
+  uploaded_gb: number
+  served_gb: number
   limit_gb: number
   active_torrents: number
   concurrent_limit: number
   plan: string
+  storage_used_gb: number
+  storage_limit_gb: number
+  period_start: string
+  period_end: string
 }
 
 export interface TorrentFile {
@@ -32,13 +69,37 @@ export interface TorrentFile {
   priority: number
 }
 
+export interface TorrentPreview {
+  info_hash: string
+  name: string
+  total_size: number
+  is_private: boolean
+  files: TorrentFile[]
+  exceeds_limits: boolean
+  limit_reasons?: string[]
+}
+
+export type TorrentStatus =
+  | 'fetching'
+  | 'metadata_queued'
+  | 'pending'
+  | 'checking'
+  | 'downloading'
+  | 'stalled'
+  | 'paused'
+  | 'seeding'
+  | 'completed'
+  | 'failed'
+  | 'cancelled'
+  | 'needs_redownload'
+
 export interface Torrent {
   id: string
   user_id: string
   info_hash: string
   name: string
   magnet_uri?: string
-  status: 'pending' | 'downloading' | 'seeding' | 'completed' | 'failed' | 'paused'
+  status: TorrentStatus
   total_size: number
   downloaded_size: number
   uploaded_size: number
@@ -48,13 +109,31 @@ export interface Torrent {
   peers: number
   seeds: number
   files?: TorrentFile[]
+  files_completed?: number
+  files_total?: number
   zip_path?: string
   zip_size?: number
+  zip_sha256?: string
+  zip_status?: 'ready' | 'skipped_size' | 'disabled'
+  deduplicated_from?: string
   error_message?: string
+  health_warning?: 'no_seeders'
   started_at?: string
   completed_at?: string
   expires_at?: string
+  expires_in_seconds?: number
+  extensions?: number
+  collection_id?: string
+  created_at: string
+}
+
+export interface Collection {
+  id: string
+  user_id: string
+  name: string
+  torrent_count: number
   created_at: string
+  updated_at: string
 }
 
 export interface AuthResponse {
@@ -62,12 +141,66 @@ export interface AuthResponse {
   refresh_token: string
   expires_in: number
   user: User
+  refresh_expires_at: string
+  session_expires_at?: string
+}
+
+export interface Activity {
+  id: string
+  user_id?: string
+  email?: string
+  type: 'torrent_added' | 'torrent_completed' | 'torrent_failed' | 'torrent_expired' | 'torrent_taken_down' | 'downloaded' | 'plan_changed'
+  torrent_id?: string
+  torrent_name?: string
+  bytes?: number
+  plan?: string
+  created_at: string
+}
+
+export interface ActivityListResponse {
+  activities: Activity[]
+  next_before?: string
 }
 
 export interface MeResponse {
   user: User
   subscription: Subscription | null
   usage: UsageStats
+  unread_notifications: number
+  transfers: TransferSummary
+}
+
+// Live totals of the user's torrents in the engine, also sent as the SSE
+// "summary" event when they change
+export interface TransferSummary {
+  active_torrents: number
+  download_speed: number // bytes per second
+  upload_speed: number
+  remaining_bytes: number
+}
+
+export interface Notification {
+  id: string
+  user_id: string
+  type: 'torrent_completed' | 'torrent_expiring' | 'quota_warning' | 'payment_failed'
+  title: string
+  body: string
+  metadata?: Record<string, unknown>
+  read_at: string | null
+  created_at: string
+}
+
+export interface NotificationListResponse {
+  notifications: Notification[]
+  next_before?: string
+  unread: number
+}
+
+export interface ZipManifest {
+  name: string
+  size: number
+  sha256: string
+  entries: { name: string; size: number; crc32: string }[]
 }
 
 export interface TorrentListResponse {
@@ -77,8 +210,92 @@ export interface TorrentListResponse {
   page_size: number
 }
 
+export type CompactTorrent = Pick<Torrent, 'id' | 'name' | 'status' | 'progress' | 'total_size' | 'expires_at'>
+
+export interface CompactTorrentListResponse {
+  torrents: CompactTorrent[]
+  total_count: number
+  page: number
+  page_size: number
+}
+
 export interface ApiError {
   error: string
   code?: string
   details?: string
 }
+
+export interface ConfirmationResponse {
+  message: string
+  code: 'CONFIRMATION_REQUIRED'
+  reason: string
+  confirm_token: string
+  expires_at: string
+}
+
+export interface Capabilities {
+  billing_enabled: boolean
+  email_enabled: boolean
+  s3_storage: boolean
+  transcoding: boolean
+  seeding: boolean
+  registration_mode: 'open' | 'invite' | 'closed'
+  signed_urls: boolean
+  max_upload_size: number
+  search?: boolean
+  search_providers?: string[]
+  port_unreachable?: boolean
+  captcha_site_key?: string
+  plans: Record<string, unknown>
+}
+
+export interface SearchResult {
+  id: string
+  provider: string
+  title: string
+  size: number
+  seeders: number
+  leechers: number
+  info_hash?: string
+  magnet_uri?: string
+  published_at?: string
+}
+
+export interface SearchResponse {
+  query: string
+  results: SearchResult[]
+  errors: { provider: string; error: string }[]
+}
+
+export type ImportItemStatus = 'pending' | 'queued' | 'added' | 'exists' | 'failed'
+
+export interface ImportItem {
+  position: number
+  source: string
+  label?: string
+  collection_id?: string
+  status: ImportItemStatus
+  torrent_id?: string
+  error?: string
+  updated_at: string
+}
+
+export interface ImportJob {
+  id: string
+  status: 'running' | 'done'
+  total: number
+  counts: Partial<Record<ImportItemStatus, number>>
+  items?: ImportItem[]
+  created_at: string
+  finished_at?: string
+}
+
+export interface Invite {
+  id: string
+  code: string
+  created_by?: string
+  max_uses: number
+  uses: number
+  expires_at?: string
+  created_at: string
+}